@@ -0,0 +1,121 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"github.com/foursquare/curator.go"
+	"github.com/samuel/go-zookeeper/zk"
+	"time"
+)
+
+const (
+	// PermissionsAll is the ACL Permissions value which grants every permission
+	PermissionsAll = "all"
+)
+
+// ACL is a zookeeper access control entry applied to each znode created by a Discovery,
+// both for service paths and for registrations.  This type also implements a standard
+// JSON configuration.
+type ACL struct {
+	// Scheme is the zookeeper ACL scheme, e.g. "world", "auth", "digest", or "ip"
+	Scheme string `json:"scheme"`
+
+	// ID identifies who this entry applies to within the Scheme, e.g. "anyone" for "world", or
+	// "user:base64(sha1(user:password))" for "digest".  The "auth" scheme, which grants access to
+	// whoever created the znode, ignores this value.
+	ID string `json:"id"`
+
+	// Permissions is any combination of the letters r (read), w (write), c (create), d (delete),
+	// and a (admin), or PermissionsAll
+	Permissions string `json:"permissions"`
+}
+
+// parsePermissions parses the Permissions of an ACL into zookeeper's permission bits
+func parsePermissions(value string) (int32, bool) {
+	if value == PermissionsAll {
+		return zk.PermAll, true
+	}
+
+	var permissions int32
+	for _, letter := range value {
+		switch letter {
+		case 'r':
+			permissions |= zk.PermRead
+		case 'w':
+			permissions |= zk.PermWrite
+		case 'c':
+			permissions |= zk.PermCreate
+		case 'd':
+			permissions |= zk.PermDelete
+		case 'a':
+			permissions |= zk.PermAdmin
+		default:
+			return 0, false
+		}
+	}
+
+	return permissions, permissions != 0
+}
+
+// parseACLs converts configured ACLs into zookeeper ACLs.  An empty list results in nil,
+// which leaves created znodes open to everyone, as curator does by default.
+func parseACLs(acls []ACL) ([]zk.ACL, error) {
+	if len(acls) == 0 {
+		return nil, nil
+	}
+
+	parsed := make([]zk.ACL, 0, len(acls))
+	for _, acl := range acls {
+		permissions, ok := parsePermissions(acl.Permissions)
+		if !ok || len(acl.Scheme) == 0 {
+			return nil, errors.New(
+				fmt.Sprintf("%v: %#v", ErrorInvalidACL, acl),
+			)
+		}
+
+		parsed = append(parsed, zk.ACL{Perms: permissions, Scheme: acl.Scheme, ID: acl.ID})
+	}
+
+	return parsed, nil
+}
+
+// fixedACLProvider is a curator.ACLProvider which applies the same ACLs to every path
+type fixedACLProvider []zk.ACL
+
+var _ curator.ACLProvider = fixedACLProvider(nil)
+
+func (this fixedACLProvider) GetDefaultAcl() []zk.ACL {
+	return this
+}
+
+func (this fixedACLProvider) GetAclForPath(path string) []zk.ACL {
+	return this
+}
+
+// newACLProvider returns a curator.ACLProvider for the given ACLs, or nil if there are none
+// so that curator's default is used
+func newACLProvider(acls []zk.ACL) curator.ACLProvider {
+	if len(acls) == 0 {
+		return nil
+	}
+
+	return fixedACLProvider(acls)
+}
+
+// newCuratorConnection creates, but does not start, a curator connection to the given zookeeper
+// ensemble.  This mirrors discovery.DefaultConn, except that curator adds the given authentication
+// to each zookeeper connection before it is used, and creates every znode with the given ACLs.
+// A zero connectTimeout or sessionTimeout uses curator's default.  If dialer is nil, curator dials
+// zookeeper itself.
+func newCuratorConnection(connection string, connectTimeout, sessionTimeout time.Duration, authInfos []curator.AuthInfo, acls []zk.ACL, dialer curator.ZookeeperDialer) curator.CuratorFramework {
+	builder := &curator.CuratorFrameworkBuilder{
+		ConnectionTimeout: connectTimeout,
+		SessionTimeout:    sessionTimeout,
+		AuthInfos:         authInfos,
+		ZookeeperDialer:   dialer,
+		RetryPolicy:       curator.NewExponentialBackoffRetry(time.Second, 3, 15*time.Second),
+		AclProvider:       newACLProvider(acls),
+	}
+
+	return builder.ConnectString(connection).Build()
+}
@@ -0,0 +1,348 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/foursquare/curator.go"
+	"github.com/foursquare/fsgo/net/discovery"
+	"github.com/samuel/go-zookeeper/zk"
+	"github.com/stretchr/testify/assert"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeZookeeperConnection simulates a single zookeeper connection beneath curator, recording
+// the order of operations along with the ACLs of each created znode
+type fakeZookeeperConnection struct {
+	mutex      sync.Mutex
+	operations []string
+	znodes     map[string][]byte
+	acls       map[string][]zk.ACL
+	sequence   int
+}
+
+var _ curator.ZookeeperConnection = (*fakeZookeeperConnection)(nil)
+
+func newFakeZookeeperConnection() *fakeZookeeperConnection {
+	return &fakeZookeeperConnection{
+		znodes: map[string][]byte{"/": nil},
+		acls:   make(map[string][]zk.ACL),
+	}
+}
+
+// Dial implements curator.ZookeeperDialer.  No session events are delivered, so curator never
+// reports the connection as established, but operations are still attempted within its
+// connection timeout.
+func (this *fakeZookeeperConnection) Dial(connString string, sessionTimeout time.Duration, canBeReadOnly bool) (curator.ZookeeperConnection, <-chan zk.Event, error) {
+	return this, nil, nil
+}
+
+func (this *fakeZookeeperConnection) record(operation, path string) {
+	this.operations = append(this.operations, operation+" "+path)
+}
+
+func (this *fakeZookeeperConnection) recorded() []string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return append([]string(nil), this.operations...)
+}
+
+func (this *fakeZookeeperConnection) createdACLs() map[string][]zk.ACL {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	createdACLs := make(map[string][]zk.ACL, len(this.acls))
+	for path, acls := range this.acls {
+		createdACLs[path] = acls
+	}
+
+	return createdACLs
+}
+
+func (this *fakeZookeeperConnection) childrenLocked(parent string) ([]string, error) {
+	if _, ok := this.znodes[parent]; !ok {
+		return nil, zk.ErrNoNode
+	}
+
+	var children []string
+	for candidate := range this.znodes {
+		if candidate != "/" && path.Dir(candidate) == parent {
+			children = append(children, path.Base(candidate))
+		}
+	}
+
+	sort.Strings(children)
+	return children, nil
+}
+
+func (this *fakeZookeeperConnection) AddAuth(scheme string, auth []byte) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.record("addAuth", scheme+":"+string(auth))
+	return nil
+}
+
+func (this *fakeZookeeperConnection) Close() {
+}
+
+func (this *fakeZookeeperConnection) Create(znodePath string, data []byte, flags int32, acl []zk.ACL) (string, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.record("create", znodePath)
+	if flags&zk.FlagSequence != 0 {
+		znodePath = fmt.Sprintf("%s%010d", znodePath, this.sequence)
+	}
+
+	if _, ok := this.znodes[znodePath]; ok {
+		return "", zk.ErrNodeExists
+	} else if _, ok := this.znodes[path.Dir(znodePath)]; !ok {
+		return "", zk.ErrNoNode
+	}
+
+	// like zookeeper, only successful creations consume a sequence number
+	if flags&zk.FlagSequence != 0 {
+		this.sequence++
+	}
+
+	this.znodes[znodePath] = data
+	this.acls[znodePath] = acl
+	return znodePath, nil
+}
+
+func (this *fakeZookeeperConnection) Exists(path string) (bool, *zk.Stat, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.record("exists", path)
+	if _, ok := this.znodes[path]; ok {
+		return true, &zk.Stat{}, nil
+	}
+
+	return false, nil, nil
+}
+
+func (this *fakeZookeeperConnection) ExistsW(path string) (bool, *zk.Stat, <-chan zk.Event, error) {
+	exists, stat, err := this.Exists(path)
+	return exists, stat, make(chan zk.Event), err
+}
+
+func (this *fakeZookeeperConnection) Delete(path string, version int32) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.record("delete", path)
+	if _, ok := this.znodes[path]; !ok {
+		return zk.ErrNoNode
+	}
+
+	delete(this.znodes, path)
+	return nil
+}
+
+func (this *fakeZookeeperConnection) Get(path string) ([]byte, *zk.Stat, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.record("get", path)
+	if data, ok := this.znodes[path]; ok {
+		return data, &zk.Stat{}, nil
+	}
+
+	return nil, nil, zk.ErrNoNode
+}
+
+func (this *fakeZookeeperConnection) GetW(path string) ([]byte, *zk.Stat, <-chan zk.Event, error) {
+	data, stat, err := this.Get(path)
+	return data, stat, make(chan zk.Event), err
+}
+
+func (this *fakeZookeeperConnection) Set(path string, data []byte, version int32) (*zk.Stat, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.record("set", path)
+	return nil, errors.New("Set is not supported")
+}
+
+func (this *fakeZookeeperConnection) Children(path string) ([]string, *zk.Stat, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.record("children", path)
+	children, err := this.childrenLocked(path)
+	return children, &zk.Stat{}, err
+}
+
+func (this *fakeZookeeperConnection) ChildrenW(path string) ([]string, *zk.Stat, <-chan zk.Event, error) {
+	children, stat, err := this.Children(path)
+	return children, stat, make(chan zk.Event), err
+}
+
+func (this *fakeZookeeperConnection) GetACL(path string) ([]zk.ACL, *zk.Stat, error) {
+	return nil, nil, errors.New("GetACL is not supported")
+}
+
+func (this *fakeZookeeperConnection) SetACL(path string, acl []zk.ACL, version int32) (*zk.Stat, error) {
+	return nil, errors.New("SetACL is not supported")
+}
+
+func (this *fakeZookeeperConnection) Multi(ops ...interface{}) ([]zk.MultiResponse, error) {
+	return nil, errors.New("Multi is not supported")
+}
+
+func (this *fakeZookeeperConnection) Sync(path string) (string, error) {
+	return path, nil
+}
+
+func TestParseACLs(t *testing.T) {
+	assert := assert.New(t)
+
+	var testData = []struct {
+		acls         []ACL
+		expectedACLs []zk.ACL
+		expectError  bool
+	}{
+		{nil, nil, false},
+		{[]ACL{}, nil, false},
+		{[]ACL{{Scheme: "auth", Permissions: PermissionsAll}}, zk.AuthACL(zk.PermAll), false},
+		{[]ACL{{Scheme: "world", ID: "anyone", Permissions: "r"}}, zk.WorldACL(zk.PermRead), false},
+		{
+			[]ACL{{Scheme: "digest", ID: "user:hash", Permissions: "rwcda"}, {Scheme: "ip", ID: "10.0.0.1", Permissions: "rc"}},
+			[]zk.ACL{{Perms: zk.PermAll, Scheme: "digest", ID: "user:hash"}, {Perms: zk.PermRead | zk.PermCreate, Scheme: "ip", ID: "10.0.0.1"}},
+			false,
+		},
+		{[]ACL{{Scheme: "world", ID: "anyone"}}, nil, true},
+		{[]ACL{{Scheme: "world", ID: "anyone", Permissions: "rx"}}, nil, true},
+		{[]ACL{{ID: "anyone", Permissions: "r"}}, nil, true},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		acls, err := parseACLs(record.acls)
+		assert.Equal(record.expectedACLs, acls)
+		if record.expectError {
+			if assert.NotNil(err) {
+				assert.True(strings.HasPrefix(err.Error(), ErrorInvalidACL.Error()))
+			}
+		} else {
+			assert.Nil(err)
+		}
+	}
+}
+
+func TestDiscoveryBuilderAuth(t *testing.T) {
+	assert := assert.New(t)
+
+	var testData = []struct {
+		builder           DiscoveryBuilder
+		expectedAuthInfos []curator.AuthInfo
+		expectedError     error
+	}{
+		{DiscoveryBuilder{}, nil, nil},
+		{
+			DiscoveryBuilder{AuthScheme: "digest", AuthCredentials: "user:password"},
+			[]curator.AuthInfo{{Scheme: "digest", Auth: []byte("user:password")}},
+			nil,
+		},
+		{DiscoveryBuilder{AuthScheme: "digest"}, nil, ErrorInvalidAuth},
+		{DiscoveryBuilder{AuthCredentials: "user:password"}, nil, ErrorInvalidAuth},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		authInfos, err := record.builder.authInfos()
+		assert.Equal(record.expectedAuthInfos, authInfos)
+		assert.Equal(record.expectedError, err)
+
+		record.builder.Connection = testConnection
+		record.builder.BasePath = testBasePath
+		_, err = record.builder.New(nil)
+		if record.expectedError != nil {
+			assert.ErrorIs(err, record.expectedError)
+		} else {
+			assert.Nil(err)
+		}
+	}
+
+	builder := DiscoveryBuilder{Connection: testConnection, BasePath: testBasePath, ACLs: []ACL{{Scheme: "auth"}}}
+	_, err := builder.New(nil)
+	assert.NotNil(err)
+}
+
+// startCuratorConnection starts a curator connection over the given fake using the builder's
+// authentication and ACLs, as a Discovery created by the builder would
+func startCuratorConnection(t *testing.T, builder DiscoveryBuilder, connection *fakeZookeeperConnection) curator.CuratorFramework {
+	authInfos, err := builder.authInfos()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acls, err := parseACLs(builder.ACLs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	curatorConnection := newCuratorConnection("localhost:2181", 0, 0, authInfos, acls, connection)
+	if err := curatorConnection.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	return curatorConnection
+}
+
+func TestCuratorConnectionAuthAndACLs(t *testing.T) {
+	assert := assert.New(t)
+	connection := newFakeZookeeperConnection()
+	builder := DiscoveryBuilder{
+		AuthScheme:      "digest",
+		AuthCredentials: "user:password",
+		ACLs:            []ACL{{Scheme: "auth", Permissions: PermissionsAll}},
+	}
+
+	curatorConnection := startCuratorConnection(t, builder, connection)
+	defer curatorConnection.Close()
+
+	servicePath := testBasePath + "/" + testServiceName
+	client := &curatorClient{connection: curatorConnection, acls: zk.AuthACL(zk.PermAll)}
+	assert.Nil(client.ensurePath(context.Background(), servicePath))
+
+	port := testPort
+	registration := discovery.NewServiceInstance("registered", testAddress, &port, nil, nil)
+	assert.Nil(NewRegistrar(curatorConnection, testBasePath, nil).Register(registration))
+
+	// authentication precedes every path operation
+	operations := connection.recorded()
+	if assert.NotEmpty(operations) {
+		assert.Equal("addAuth digest:user:password", operations[0])
+		for _, operation := range operations[1:] {
+			assert.False(strings.HasPrefix(operation, "addAuth"), operation)
+		}
+	}
+
+	// the service path, the registration, and all of their parents are created with the ACLs
+	createdACLs := connection.createdACLs()
+	assert.Equal(6, len(createdACLs))
+	assert.Contains(createdACLs, "/test")
+	assert.Contains(createdACLs, servicePath)
+	assert.Contains(createdACLs, testBasePath+"/registered/"+registration.Id)
+	for path, acls := range createdACLs {
+		assert.Equal(zk.AuthACL(zk.PermAll), acls, path)
+	}
+}
+
+func TestCuratorConnectionDefaultACLs(t *testing.T) {
+	assert := assert.New(t)
+	connection := newFakeZookeeperConnection()
+	curatorConnection := startCuratorConnection(t, DiscoveryBuilder{}, connection)
+	defer curatorConnection.Close()
+
+	client := &curatorClient{connection: curatorConnection}
+	assert.Nil(client.ensurePath(context.Background(), testBasePath))
+	assert.Equal(3, len(connection.createdACLs()))
+	for path, acls := range connection.createdACLs() {
+		assert.Equal(curator.OPEN_ACL_UNSAFE, acls, path)
+	}
+
+	for _, operation := range connection.recorded() {
+		assert.False(strings.HasPrefix(operation, "addAuth"), operation)
+	}
+}
@@ -0,0 +1,145 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// AggregateListener receives a coherent view of every watched service at once, rather than one
+// callback per service.  This suits consumers which compute something across services, such as
+// weights for routing between them.
+//
+// The snapshots hold the current Instances of each watched service that has been read, keyed by
+// service name.  Services which have not been read yet are omitted, so that they can be told apart
+// from services without instances.  Each listener receives its own copy of the map and of each
+// Instances, so a listener may retain or modify them.
+type AggregateListener interface {
+	AllServicesChanged(snapshots map[string]Instances)
+}
+
+// AggregateListenerFunc is a function type that implements AggregateListener
+type AggregateListenerFunc func(snapshots map[string]Instances)
+
+func (this AggregateListenerFunc) AllServicesChanged(snapshots map[string]Instances) {
+	this(snapshots)
+}
+
+// aggregateMonitor delivers the snapshots of every service in a serviceWatcherSet to each
+// AggregateListener.  Changes are coalesced: the first change after a delivery schedules the next
+// delivery after the window, and any further changes before then are covered by that delivery.
+type aggregateMonitor struct {
+	window    time.Duration
+	snapshots func() map[string]Instances
+	listeners *listenerSet
+
+	// deliveryMutex serializes deliveries, so that listeners never observe snapshots out of order,
+	// and guards the generation of the snapshots last delivered to each listener
+	deliveryMutex sync.Mutex
+	delivered     map[*listenerSetEntry]uint64
+
+	// mutex guards the remaining fields.  It is never held during callbacks.
+	mutex      sync.Mutex
+	generation uint64
+	scheduled  bool
+	stopped    bool
+}
+
+func newAggregateMonitor(logger Logger, window time.Duration, snapshots func() map[string]Instances) *aggregateMonitor {
+	return &aggregateMonitor{
+		window:    window,
+		snapshots: snapshots,
+		listeners: newListenerSet(logger, "Aggregate"),
+	}
+}
+
+// addListener registers a listener.  If any service has changed since this monitor was created,
+// the new listener receives the current snapshots once the window elapses.
+func (this *aggregateMonitor) addListener(listener AggregateListener) Registration {
+	registration := this.listeners.add(listener)
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.generation > 0 {
+		this.schedule()
+	}
+
+	return registration
+}
+
+// changed records that a service has changed, scheduling a delivery if none is pending
+func (this *aggregateMonitor) changed() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.generation++
+	if this.listeners.len() > 0 {
+		this.schedule()
+	}
+}
+
+// schedule arranges for deliver to run after the window, unless it already will.  Callers must
+// hold the mutex.
+func (this *aggregateMonitor) schedule() {
+	if this.scheduled || this.stopped {
+		return
+	}
+
+	this.scheduled = true
+	time.AfterFunc(this.window, this.deliver)
+}
+
+// deliver passes the current snapshots to each listener which has not yet received them
+func (this *aggregateMonitor) deliver() {
+	this.deliveryMutex.Lock()
+	defer this.deliveryMutex.Unlock()
+
+	// changes from this point on schedule another delivery, so none are lost
+	this.mutex.Lock()
+	this.scheduled = false
+	generation := this.generation
+	stopped := this.stopped
+	this.mutex.Unlock()
+
+	if stopped {
+		return
+	}
+
+	// only current listeners are kept, so that cancelled listeners are forgotten
+	listeners := this.listeners.snapshot()
+	delivered := make(map[*listenerSetEntry]uint64, len(listeners))
+	var snapshots map[string]Instances
+	for _, entry := range listeners {
+		delivered[entry] = this.delivered[entry]
+		if entry.isCancelled() || delivered[entry] >= generation {
+			continue
+		}
+
+		if snapshots == nil {
+			snapshots = this.snapshots()
+		}
+
+		delivered[entry] = generation
+		copied := copySnapshots(snapshots)
+		this.listeners.invoke(entry, func(listener interface{}) {
+			listener.(AggregateListener).AllServicesChanged(copied)
+		})
+	}
+
+	this.delivered = delivered
+}
+
+// stop removes every listener, and abandons any pending delivery
+func (this *aggregateMonitor) stop() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.stopped = true
+	this.listeners.clear()
+}
+
+// copySnapshots returns a copy of the given snapshots, including a copy of each Instances
+func copySnapshots(snapshots map[string]Instances) map[string]Instances {
+	copied := make(map[string]Instances, len(snapshots))
+	for serviceName, instances := range snapshots {
+		copied[serviceName] = append(make(Instances, 0, len(instances)), instances...)
+	}
+
+	return copied
+}
@@ -0,0 +1,173 @@
+package service
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// aggregateChannel returns an AggregateListener which sends each delivery to the returned channel
+func aggregateChannel() (AggregateListener, <-chan map[string]Instances) {
+	deliveries := make(chan map[string]Instances, 10)
+	return AggregateListenerFunc(func(snapshots map[string]Instances) {
+		deliveries <- snapshots
+	}), deliveries
+}
+
+// receiveSnapshots waits for the next delivery, returning the instance ids of each service
+func receiveSnapshots(t *testing.T, deliveries <-chan map[string]Instances) map[string][]string {
+	select {
+	case snapshots := <-deliveries:
+		ids := make(map[string][]string, len(snapshots))
+		for serviceName, instances := range snapshots {
+			ids[serviceName] = instanceIds(instances)
+		}
+
+		return ids
+	case <-time.After(5 * time.Second):
+		t.Fatal("No snapshots were delivered")
+		return nil
+	}
+}
+
+// assertNoSnapshots checks that nothing is delivered within the given time
+func assertNoSnapshots(t *testing.T, deliveries <-chan map[string]Instances, wait time.Duration) {
+	select {
+	case snapshots := <-deliveries:
+		t.Errorf("Unexpected snapshots were delivered: %v", snapshots)
+	case <-time.After(wait):
+	}
+}
+
+func TestAggregateWindow(t *testing.T) {
+	var testData = []struct {
+		builder        DiscoveryBuilder
+		expectedWindow time.Duration
+		expectedError  error
+	}{
+		{DiscoveryBuilder{}, DefaultAggregateWindow, nil},
+		{DiscoveryBuilder{AggregateWindow: "0"}, 0, nil},
+		{DiscoveryBuilder{AggregateWindow: "250ms"}, 250 * time.Millisecond, nil},
+		{DiscoveryBuilder{AggregateWindow: "2"}, 2 * time.Second, nil},
+		{DiscoveryBuilder{AggregateWindow: "-1s"}, -1, ErrorInvalidAggregateWindow},
+		{DiscoveryBuilder{AggregateWindow: "briefly"}, -1, ErrorInvalidAggregateWindow},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+		window, err := record.builder.aggregateWindow()
+		assert.Equal(record.expectedWindow, window)
+		assert.Equal(record.expectedError, err)
+	}
+}
+
+func TestAggregateListener(t *testing.T) {
+	assert := assert.New(t)
+
+	options := watcherOptions{aggregateWindow: 100 * time.Millisecond}
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{"foo", "bar", "baz"}, []string{testBasePath}, options)
+	defer serviceWatcherSet.stop()
+	foo, _ := serviceWatcherSet.findByName("foo")
+	bar, _ := serviceWatcherSet.findByName("bar")
+
+	listener, deliveries := aggregateChannel()
+	registration := serviceWatcherSet.aggregates.addListener(listener)
+
+	// nothing has been read, so nothing is delivered
+	assertNoSnapshots(t, deliveries, 200*time.Millisecond)
+
+	// changes within the window are delivered together, and services not yet read are omitted
+	foo.dispatch(testInstancesWithIds("1"))
+	bar.dispatch(testInstancesWithIds("2", "3"))
+	foo.dispatch(testInstancesWithIds("1", "4"))
+	assert.Equal(map[string][]string{"foo": {"1", "4"}, "bar": {"2", "3"}}, receiveSnapshots(t, deliveries))
+	assertNoSnapshots(t, deliveries, 200*time.Millisecond)
+
+	// unchanged snapshots are not dispatched, so nothing is delivered
+	foo.dispatch(testInstancesWithIds("1", "4"))
+	assertNoSnapshots(t, deliveries, 200*time.Millisecond)
+
+	// removed services are no longer included
+	_, ok := serviceWatcherSet.remove("bar")
+	assert.True(ok)
+	assert.Equal(map[string][]string{"foo": {"1", "4"}}, receiveSnapshots(t, deliveries))
+
+	registration.Cancel()
+	foo.dispatch(testInstancesWithIds("5"))
+	assertNoSnapshots(t, deliveries, 200*time.Millisecond)
+}
+
+func TestAggregateListenerAddedLater(t *testing.T) {
+	assert := assert.New(t)
+
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{"foo"}, []string{testBasePath}, watcherOptions{})
+	defer serviceWatcherSet.stop()
+	foo, _ := serviceWatcherSet.findByName("foo")
+
+	first, firstDeliveries := aggregateChannel()
+	serviceWatcherSet.aggregates.addListener(first)
+	foo.dispatch(testInstancesWithIds("1"))
+	assert.Equal(map[string][]string{"foo": {"1"}}, receiveSnapshots(t, firstDeliveries))
+
+	// a listener added later receives the current snapshots, which are not delivered again to others
+	second, secondDeliveries := aggregateChannel()
+	serviceWatcherSet.aggregates.addListener(second)
+	assert.Equal(map[string][]string{"foo": {"1"}}, receiveSnapshots(t, secondDeliveries))
+	assertNoSnapshots(t, firstDeliveries, 100*time.Millisecond)
+
+	foo.dispatch(testInstancesWithIds("2"))
+	assert.Equal(map[string][]string{"foo": {"2"}}, receiveSnapshots(t, firstDeliveries))
+	assert.Equal(map[string][]string{"foo": {"2"}}, receiveSnapshots(t, secondDeliveries))
+
+	// nothing is delivered once the set is stopped
+	serviceWatcherSet.stop()
+	serviceWatcherSet.aggregates.changed()
+	assertNoSnapshots(t, firstDeliveries, 100*time.Millisecond)
+}
+
+func TestAggregateListenerCopies(t *testing.T) {
+	assert := assert.New(t)
+
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{"foo"}, []string{testBasePath}, watcherOptions{})
+	defer serviceWatcherSet.stop()
+	foo, _ := serviceWatcherSet.findByName("foo")
+
+	// a listener that modifies or panics affects neither the cache nor the other listeners
+	serviceWatcherSet.aggregates.addListener(AggregateListenerFunc(func(snapshots map[string]Instances) {
+		snapshots["foo"][0] = nil
+		delete(snapshots, "foo")
+		panic("expected")
+	}))
+
+	listener, deliveries := aggregateChannel()
+	serviceWatcherSet.aggregates.addListener(listener)
+	foo.dispatch(testInstancesWithIds("1", "2"))
+	assert.Equal(map[string][]string{"foo": {"1", "2"}}, receiveSnapshots(t, deliveries))
+
+	instances, _ := foo.cachedInstances()
+	assert.Equal([]string{"1", "2"}, instanceIds(instances))
+}
+
+func TestDiscoveryAggregateListener(t *testing.T) {
+	assert := assert.New(t)
+
+	static := mustNewStaticDiscovery(t, map[string]Instances{"foo": testInstancesWithIds("1")})
+	listener, deliveries := aggregateChannel()
+	registration := static.AddAggregateListener(listener)
+	assert.Equal(map[string][]string{"foo": {"1"}}, receiveSnapshots(t, deliveries))
+
+	assert.Nil(static.SetInstances("foo", testInstancesWithIds("2")))
+	assert.Equal(map[string][]string{"foo": {"2"}}, receiveSnapshots(t, deliveries))
+	registration.Cancel()
+
+	builder := &DiscoveryBuilder{Connection: testConnection, Watches: []string{testServiceName}, AggregateWindow: "1s"}
+	discovery, err := builder.New(&testLogger{t})
+	if !assert.Nil(err) {
+		return
+	}
+
+	defer discovery.Close()
+	assert.Equal(time.Second, discovery.(*curatorDiscovery).serviceWatcherSet.aggregates.window)
+	assert.NotNil(discovery.AddAggregateListener(listener))
+}
@@ -0,0 +1,127 @@
+package service
+
+import (
+	"github.com/foursquare/fsgo/net/discovery"
+	"time"
+)
+
+// AnnotatedInstance is a ServiceInstance along with where and when it was read.  The
+// ServiceInstance itself is never modified to carry this information.
+type AnnotatedInstance struct {
+	// Instance is the annotated ServiceInstance, which is shared with the Instances it came from
+	Instance *discovery.ServiceInstance
+
+	// ServicePath is the znode path of the service the instance was read from, i.e. the base path
+	// followed by the service name.  It is empty when not known, e.g. for warm started instances
+	// of a service watched beneath more than one base path.
+	ServicePath string
+
+	// ChildId is the name of the instance's child znode beneath the ServicePath
+	ChildId string
+
+	// FetchedAt is the time at which the instance was read from zookeeper, or zero if it was not,
+	// e.g. because it was warm started
+	FetchedAt time.Time
+
+	// Revision is the revision of the set of services which delivered the instance, i.e. the
+	// Sequence of its InstanceEvent
+	Revision uint64
+}
+
+// Path returns the full znode path of this instance, or the empty string if its ServicePath is not known
+func (this AnnotatedInstance) Path() string {
+	if len(this.ServicePath) == 0 {
+		return ""
+	}
+
+	return this.ServicePath + "/" + this.ChildId
+}
+
+// AnnotatedInstances is a slice of AnnotatedInstance, usually parallel to an Instances
+type AnnotatedInstances []AnnotatedInstance
+
+// NewAnnotatedInstances wraps each ServiceInstance in the given Instances, in order.  Only the
+// ChildId, which is the instance's Id, is known, so every other annotation is left empty.
+func NewAnnotatedInstances(instances Instances) AnnotatedInstances {
+	annotated := make(AnnotatedInstances, len(instances))
+	for index, serviceInstance := range instances {
+		annotated[index].Instance = serviceInstance
+		if serviceInstance != nil {
+			annotated[index].ChildId = serviceInstance.Id
+		}
+	}
+
+	return annotated
+}
+
+// Instances returns the ServiceInstance of each element of this slice, in order
+func (this AnnotatedInstances) Instances() Instances {
+	instances := make(Instances, len(this))
+	for index, annotated := range this {
+		instances[index] = annotated.Instance
+	}
+
+	return instances
+}
+
+// recordFetched records the time at which the given ServiceInstance was read
+func (this *serviceWatcher) recordFetched(serviceInstance *discovery.ServiceInstance) {
+	this.fetchedMutex.Lock()
+	defer this.fetchedMutex.Unlock()
+	if this.fetched == nil {
+		this.fetched = make(map[*discovery.ServiceInstance]time.Time)
+	}
+
+	this.fetched[serviceInstance] = time.Now()
+}
+
+// fetchedAt returns the time at which the given ServiceInstance was read by this watcher, if it was
+func (this *serviceWatcher) fetchedAt(serviceInstance *discovery.ServiceInstance) (time.Time, bool) {
+	this.fetchedMutex.Lock()
+	defer this.fetchedMutex.Unlock()
+	fetchedAt, ok := this.fetched[serviceInstance]
+	return fetchedAt, ok
+}
+
+// retainFetched forgets the read times of every ServiceInstance except the given ones, so that
+// read times are only kept for the last-known set of services
+func (this *serviceWatcher) retainFetched(instances Instances) {
+	retained := make(map[*discovery.ServiceInstance]bool, len(instances))
+	for _, serviceInstance := range instances {
+		retained[serviceInstance] = true
+	}
+
+	this.fetchedMutex.Lock()
+	defer this.fetchedMutex.Unlock()
+	for serviceInstance := range this.fetched {
+		if !retained[serviceInstance] {
+			delete(this.fetched, serviceInstance)
+		}
+	}
+}
+
+// annotate describes where and when each of the given instances was read.  A watcher with more
+// than one base path consults its sources, which read the instances on its behalf.
+func (this *serviceWatcher) annotate(instances Instances, revision uint64) AnnotatedInstances {
+	annotated := NewAnnotatedInstances(instances)
+	for index, serviceInstance := range instances {
+		annotated[index].Revision = revision
+		if serviceInstance == nil {
+			continue
+		}
+
+		for _, pathWatcher := range this.pathWatchers() {
+			if fetchedAt, ok := pathWatcher.fetchedAt(serviceInstance); ok {
+				annotated[index].ServicePath = pathWatcher.servicePath
+				annotated[index].FetchedAt = fetchedAt
+				break
+			}
+		}
+
+		if len(annotated[index].ServicePath) == 0 && len(this.sources) == 0 {
+			annotated[index].ServicePath = this.servicePath
+		}
+	}
+
+	return annotated
+}
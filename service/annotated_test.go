@@ -0,0 +1,128 @@
+package service
+
+import (
+	"github.com/foursquare/fsgo/net/discovery"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// testAnnotations returns the annotations of instances dispatched at the given revision by a
+// watcher which neither has a service path nor reads from zookeeper
+func testAnnotations(revision uint64, instances ...*discovery.ServiceInstance) AnnotatedInstances {
+	annotated := NewAnnotatedInstances(Instances(instances))
+	for index := range annotated {
+		annotated[index].Revision = revision
+	}
+
+	return annotated
+}
+
+func TestAnnotatedInstances(t *testing.T) {
+	assert := assert.New(t)
+
+	first := newTestInstance("1", "host.com", 8080)
+	second := newTestInstance("2", "host.com", 8081)
+	instances := Instances{first, nil, second}
+
+	annotated := NewAnnotatedInstances(instances)
+	assert.Equal(
+		AnnotatedInstances{{Instance: first, ChildId: "1"}, {}, {Instance: second, ChildId: "2"}},
+		annotated,
+	)
+
+	assert.Equal(instances, annotated.Instances())
+	assert.Equal(AnnotatedInstances{}, NewAnnotatedInstances(nil))
+	assert.Equal(Instances{}, AnnotatedInstances(nil).Instances())
+
+	assert.Empty(annotated[0].Path())
+	annotated[0].ServicePath = testBasePath + "/" + testServiceName
+	assert.Equal(testBasePath+"/"+testServiceName+"/1", annotated[0].Path())
+}
+
+func TestDispatchAnnotatesFetchedInstances(t *testing.T) {
+	assert := assert.New(t)
+
+	client := newFakeZookeeperClient()
+	servicePath := testBasePath + "/" + testServiceName
+	client.addInstance(servicePath, newTestInstance("1", "host.com", 8080))
+	client.addInstance(servicePath, newTestInstance("2", "host.com", 8081))
+
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, watcherOptions{})
+	defer serviceWatcherSet.stop()
+	serviceWatcher, _ := serviceWatcherSet.findByName(testServiceName)
+
+	var events []InstanceEvent
+	serviceWatcher.addListener(InstancesListenerFunc(func(serviceName string, event InstanceEvent) {
+		events = append(events, event)
+	}))
+
+	before := time.Now()
+	assert.Nil(serviceWatcher.initialize(client))
+
+	// an instance that was never read is still annotated with its service path
+	unread := newTestInstance("3", "host.com", 8082)
+	current, _ := serviceWatcher.cachedInstances()
+	serviceWatcher.dispatch(append(current[:1:1], unread))
+
+	if assert.Len(events, 2) {
+		if assert.Len(events[0].Annotated, 2) {
+			for index, annotated := range events[0].Annotated {
+				assert.True(annotated.Instance == events[0].Current[index])
+				assert.Equal(servicePath, annotated.ServicePath)
+				assert.Equal(events[0].Current[index].Id, annotated.ChildId)
+				assert.False(annotated.FetchedAt.Before(before))
+				assert.Equal(uint64(1), annotated.Revision)
+			}
+		}
+
+		if assert.Len(events[1].Annotated, 2) {
+			assert.Equal(events[0].Annotated[0].FetchedAt, events[1].Annotated[0].FetchedAt)
+			assert.Equal(uint64(2), events[1].Annotated[0].Revision)
+			assert.Equal(AnnotatedInstance{Instance: unread, ServicePath: servicePath, ChildId: "3", Revision: 2}, events[1].Annotated[1])
+		}
+	}
+
+	// only the read times of the last-known instances are kept
+	_, ok := serviceWatcher.fetchedAt(events[0].Current[1])
+	assert.False(ok)
+
+	// a late listener receives the annotations of the last-known instances
+	var late []InstanceEvent
+	serviceWatcher.addListener(InstancesListenerFunc(func(serviceName string, event InstanceEvent) {
+		late = append(late, event)
+	}))
+
+	if assert.Len(late, 1) && assert.Len(events, 2) {
+		assert.Equal(events[1].Annotated, late[0].Annotated)
+	}
+}
+
+func TestMergedWatcherAnnotatesSourcePaths(t *testing.T) {
+	assert := assert.New(t)
+
+	eastPath := testBasePath + "/us-east"
+	westPath := testBasePath + "/us-west"
+	client := newFakeZookeeperClient()
+	client.addInstance(eastPath+"/"+testServiceName, newTestInstance("east-1", "east.com", 8080))
+	client.addInstance(westPath+"/"+testServiceName, newTestInstance("west-1", "west.com", 8080))
+
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{eastPath, westPath}, watcherOptions{})
+	defer serviceWatcherSet.stop()
+	merged, _ := serviceWatcherSet.findByName(testServiceName)
+
+	var events []InstanceEvent
+	merged.addListener(InstancesListenerFunc(func(serviceName string, event InstanceEvent) {
+		events = append(events, event)
+	}))
+
+	assert.Nil(merged.initialize(client))
+	if assert.Len(events, 1) && assert.Len(events[0].Annotated, 2) {
+		assert.Equal(eastPath+"/"+testServiceName+"/east-1", events[0].Annotated[0].Path())
+		assert.Equal(westPath+"/"+testServiceName+"/west-1", events[0].Annotated[1].Path())
+		for _, annotated := range events[0].Annotated {
+			assert.False(annotated.FetchedAt.IsZero())
+			assert.Equal(events[0].Sequence, annotated.Revision)
+		}
+	}
+}
@@ -0,0 +1,456 @@
+package service
+
+import (
+	"errors"
+	"github.com/foursquare/fsgo/net/discovery"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// CompositeUnion merges the instances of every child, in order.  When more than one child has
+	// an instance with the same id, the instance of the earliest child is used.
+	CompositeUnion = "union"
+
+	// CompositeFirstNonEmpty uses the instances of the earliest child which has any, e.g. so that
+	// static instances only apply when zookeeper has none
+	CompositeFirstNonEmpty = "firstNonEmpty"
+)
+
+var (
+	ErrorNoCompositeChildren    = errors.New("A CompositeDiscovery must have at least one child Discovery")
+	ErrorInvalidCompositePolicy = errors.New("The composite policy must be either \"" + CompositeUnion + "\" or \"" + CompositeFirstNonEmpty + "\"")
+)
+
+// CompositeChild is one of the Discovery implementations merged by a CompositeDiscovery
+type CompositeChild struct {
+	Discovery Discovery
+
+	// Owned children are run and closed along with the CompositeDiscovery.  Other children are
+	// managed by the application, and must be run by it.
+	Owned bool
+}
+
+// compositeRegistrations cancels a registration with each child of a CompositeDiscovery
+type compositeRegistrations []Registration
+
+func (this compositeRegistrations) Cancel() {
+	for _, registration := range this {
+		registration.Cancel()
+	}
+}
+
+// compositeService holds the latest Instances of a single service from each child
+type compositeService struct {
+	serviceName string
+
+	// removed is nonzero once the service is no longer watched by the composite
+	removed uint32
+
+	// mutex serializes merges, and guards the snapshots
+	mutex     sync.Mutex
+	snapshots []Instances
+}
+
+// compositeListener delivers the Instances of one child to a CompositeDiscovery
+type compositeListener struct {
+	composite *CompositeDiscovery
+	service   *compositeService
+	index     int
+}
+
+func (this *compositeListener) ServicesChanged(serviceName string, instances Instances) {
+	this.composite.update(this.service, this.index, instances)
+}
+
+// CompositeDiscovery is a Discovery which merges the services of an ordered list of child
+// Discovery implementations, such as a zookeeper-based Discovery, a FileDiscovery, and a
+// StaticDiscovery.  A service is watched if any child watches it.  Whenever any child's
+// instances of a service change, the instances of every child are merged according to the
+// policy, and the result is dispatched to listeners in the same way as by the zookeeper-based
+// Discovery.  A service is first dispatched as soon as any child has delivered its instances.
+//
+// Connection-related methods, such as Connected and CuratorConnection, consult the children in
+// order.  A CompositeDiscovery is safe for concurrent use.
+type CompositeDiscovery struct {
+	*cachedDiscovery
+
+	policy   string
+	children []CompositeChild
+
+	// mutex guards the services and their registrations with the children
+	mutex         sync.Mutex
+	services      map[string]*compositeService
+	registrations map[string]Registration
+
+	once     sync.Once
+	runError error
+
+	closeOnce  sync.Once
+	closeError error
+}
+
+var _ Discovery = (*CompositeDiscovery)(nil)
+
+// NewCompositeDiscovery creates a CompositeDiscovery which merges the given children, in order,
+// according to the given policy.  If the policy is empty, CompositeUnion is used.  Every service
+// watched by any child is watched, and any child instances already known are merged immediately.
+func NewCompositeDiscovery(policy string, children ...CompositeChild) (*CompositeDiscovery, error) {
+	if len(policy) == 0 {
+		policy = CompositeUnion
+	} else if policy != CompositeUnion && policy != CompositeFirstNonEmpty {
+		return nil, ErrorInvalidCompositePolicy
+	}
+
+	if len(children) == 0 {
+		return nil, ErrorNoCompositeChildren
+	}
+
+	var serviceNames []string
+	seen := make(map[string]bool)
+	for _, child := range children {
+		for _, serviceName := range child.Discovery.ServiceNames() {
+			if !seen[serviceName] {
+				seen[serviceName] = true
+				serviceNames = append(serviceNames, serviceName)
+			}
+		}
+	}
+
+	cached, err := newCachedDiscovery(serviceNames)
+	if err != nil {
+		return nil, err
+	}
+
+	composite := &CompositeDiscovery{
+		cachedDiscovery: cached,
+		policy:          policy,
+		children:        append([]CompositeChild(nil), children...),
+		services:        make(map[string]*compositeService),
+		registrations:   make(map[string]Registration),
+	}
+
+	for _, serviceName := range serviceNames {
+		if err := composite.subscribe(serviceName); err != nil {
+			composite.unsubscribeAll()
+			return nil, err
+		}
+	}
+
+	return composite, nil
+}
+
+// subscribe adds a listener for the given service to every child which watches it.  Any child
+// instances already known are merged as each listener is added.
+func (this *CompositeDiscovery) subscribe(serviceName string) error {
+	service := &compositeService{
+		serviceName: serviceName,
+		snapshots:   make([]Instances, len(this.children)),
+	}
+
+	this.mutex.Lock()
+	if _, ok := this.services[serviceName]; ok {
+		this.mutex.Unlock()
+		return nil
+	}
+
+	this.services[serviceName] = service
+	this.mutex.Unlock()
+
+	// listeners are added without holding the mutex, since each may immediately deliver instances
+	var registrations compositeRegistrations
+	for index, child := range this.children {
+		registration, err := child.Discovery.AddListener(serviceName, &compositeListener{this, service, index})
+		if err == ErrorNoSuchService {
+			continue
+		} else if err != nil {
+			registrations.Cancel()
+			this.mutex.Lock()
+			delete(this.services, serviceName)
+			this.mutex.Unlock()
+			return err
+		}
+
+		registrations = append(registrations, registration)
+	}
+
+	this.mutex.Lock()
+	this.registrations[serviceName] = registrations
+	this.mutex.Unlock()
+	return nil
+}
+
+// unsubscribe removes the listeners for the given service from every child
+func (this *CompositeDiscovery) unsubscribe(serviceName string) bool {
+	this.mutex.Lock()
+	service, ok := this.services[serviceName]
+	registration := this.registrations[serviceName]
+	delete(this.services, serviceName)
+	delete(this.registrations, serviceName)
+	this.mutex.Unlock()
+
+	if ok {
+		atomic.StoreUint32(&service.removed, 1)
+	}
+
+	if registration != nil {
+		registration.Cancel()
+	}
+
+	return ok
+}
+
+// unsubscribeAll removes every listener from every child
+func (this *CompositeDiscovery) unsubscribeAll() {
+	this.mutex.Lock()
+	serviceNames := make([]string, 0, len(this.services))
+	for serviceName := range this.services {
+		serviceNames = append(serviceNames, serviceName)
+	}
+
+	this.mutex.Unlock()
+	for _, serviceName := range serviceNames {
+		this.unsubscribe(serviceName)
+	}
+}
+
+// update records the Instances of a service delivered by the child at the given index, then
+// dispatches the merged Instances of every child
+func (this *CompositeDiscovery) update(service *compositeService, index int, instances Instances) {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	if atomic.LoadUint32(&service.removed) != 0 {
+		return
+	}
+
+	service.snapshots[index] = instances
+	this.setInstances(service.serviceName, this.merge(service))
+}
+
+// merge combines the Instances delivered by each child according to the policy.  Callers must
+// hold the service's mutex.
+func (this *CompositeDiscovery) merge(service *compositeService) Instances {
+	merged := Instances{}
+	if this.policy == CompositeFirstNonEmpty {
+		for _, instances := range service.snapshots {
+			if len(instances) > 0 {
+				return append(merged, instances...)
+			}
+		}
+
+		return merged
+	}
+
+	seen := make(map[string]bool)
+	for _, instances := range service.snapshots {
+		for _, serviceInstance := range instances {
+			if serviceInstance != nil && !seen[serviceInstance.Id] {
+				seen[serviceInstance.Id] = true
+				merged = append(merged, serviceInstance)
+			}
+		}
+	}
+
+	return merged
+}
+
+// Policy returns how the instances of the children are merged
+func (this *CompositeDiscovery) Policy() string {
+	return this.policy
+}
+
+// Connected returns true if any child is connected
+func (this *CompositeDiscovery) Connected() bool {
+	for _, child := range this.children {
+		if child.Discovery.Connected() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// InstanceBasePath returns the base path reported by the earliest child which knows the instance
+func (this *CompositeDiscovery) InstanceBasePath(serviceInstance *discovery.ServiceInstance) (string, bool) {
+	for _, child := range this.children {
+		if basePath, ok := child.Discovery.InstanceBasePath(serviceInstance); ok {
+			return basePath, true
+		}
+	}
+
+	return "", false
+}
+
+func (this *CompositeDiscovery) StatusHandler() http.Handler {
+	return NewStatusHandler(this.status)
+}
+
+// status produces the Status of the named services, or of every watched service
+func (this *CompositeDiscovery) status(serviceNames []string) (Status, error) {
+	status, err := this.cachedDiscovery.status(serviceNames)
+	status.Connected = this.Connected()
+	return status, err
+}
+
+// SkippedInstances returns the total skipped by every child which watches the given service
+func (this *CompositeDiscovery) SkippedInstances(serviceName string) (int, error) {
+	if _, ok := this.serviceWatcherSet.findByName(serviceName); !ok {
+		return 0, ErrorNoSuchService
+	}
+
+	total := 0
+	for _, child := range this.children {
+		if skipped, err := child.Discovery.SkippedInstances(serviceName); err == nil {
+			total += skipped
+		}
+	}
+
+	return total, nil
+}
+
+// AddConnectionStateListener registers the listener with every child
+func (this *CompositeDiscovery) AddConnectionStateListener(listener ConnectionStateListener) Registration {
+	registrations := make(compositeRegistrations, 0, len(this.children))
+	for _, child := range this.children {
+		registrations = append(registrations, child.Discovery.AddConnectionStateListener(listener))
+	}
+
+	return registrations
+}
+
+// CuratorConnection returns the connection of the earliest child which has one
+func (this *CompositeDiscovery) CuratorConnection() discovery.Conn {
+	for _, child := range this.children {
+		if curatorConnection := child.Discovery.CuratorConnection(); curatorConnection != nil {
+			return curatorConnection
+		}
+	}
+
+	return nil
+}
+
+// BlockUntilConnected blocks on the earliest child which is running.  If no child is running,
+// ErrorNotRunning is returned.
+func (this *CompositeDiscovery) BlockUntilConnected() error {
+	for _, child := range this.children {
+		if err := child.Discovery.BlockUntilConnected(); err != ErrorNotRunning {
+			return err
+		}
+	}
+
+	return ErrorNotRunning
+}
+
+// BlockUntilConnectedTimeout is like BlockUntilConnected, except that it will abort with an
+// error if the specified time elapses first
+func (this *CompositeDiscovery) BlockUntilConnectedTimeout(maxWaitTime time.Duration) error {
+	for _, child := range this.children {
+		if err := child.Discovery.BlockUntilConnectedTimeout(maxWaitTime); err != ErrorNotRunning {
+			return err
+		}
+	}
+
+	return ErrorNotRunning
+}
+
+// AddService adds the service to every child, then watches it.  If any child cannot add the
+// service, its error is returned and the service is not watched.  The service is then removed
+// from any child which was not already watching it.
+func (this *CompositeDiscovery) AddService(serviceName string) error {
+	if this.isClosed() {
+		return ErrorClosed
+	}
+
+	var added []Discovery
+	rollback := func() {
+		for _, child := range added {
+			child.RemoveService(serviceName)
+		}
+	}
+
+	for _, child := range this.children {
+		watching := child.Discovery.IsWatching(serviceName)
+		if err := child.Discovery.AddService(serviceName); err != nil {
+			rollback()
+			return err
+		} else if !watching {
+			added = append(added, child.Discovery)
+		}
+	}
+
+	if err := this.cachedDiscovery.AddService(serviceName); err != nil {
+		rollback()
+		return err
+	}
+
+	return this.subscribe(serviceName)
+}
+
+// RemoveService stops watching the service, but leaves it watched by the children
+func (this *CompositeDiscovery) RemoveService(serviceName string) error {
+	this.unsubscribe(serviceName)
+	return this.cachedDiscovery.RemoveService(serviceName)
+}
+
+// Registrations returns the registrations of every child, in order
+func (this *CompositeDiscovery) Registrations() Instances {
+	registrations := Instances{}
+	for _, child := range this.children {
+		registrations = append(registrations, child.Discovery.Registrations()...)
+	}
+
+	return registrations
+}
+
+// Deregister deregisters every child.  All children are attempted, and the first error is returned.
+func (this *CompositeDiscovery) Deregister() (err error) {
+	for _, child := range this.children {
+		if childErr := child.Discovery.Deregister(); childErr != nil && err == nil {
+			err = childErr
+		}
+	}
+
+	return
+}
+
+// Run runs each owned child, in order.  It is idempotent.  The first error from a child is
+// returned, from this and every later call, after which no further children are run.  If this
+// CompositeDiscovery has been closed, ErrorClosed is returned.
+func (this *CompositeDiscovery) Run(waitGroup *sync.WaitGroup, shutdown <-chan struct{}) error {
+	if err := this.cachedDiscovery.Run(waitGroup, shutdown); err != nil {
+		return err
+	}
+
+	this.once.Do(func() {
+		for _, child := range this.children {
+			if child.Owned {
+				if this.runError = child.Discovery.Run(waitGroup, shutdown); this.runError != nil {
+					return
+				}
+			}
+		}
+	})
+
+	return this.runError
+}
+
+// Close removes every listener and closes each owned child.  Children which are not owned are
+// left running.  All owned children are closed, and the first error is returned.  Close is
+// idempotent, and every call returns the same error.
+func (this *CompositeDiscovery) Close() error {
+	this.closeOnce.Do(func() {
+		this.cachedDiscovery.Close()
+		this.unsubscribeAll()
+		for _, child := range this.children {
+			if child.Owned {
+				if err := child.Discovery.Close(); err != nil && this.closeError == nil {
+					this.closeError = err
+				}
+			}
+		}
+	})
+
+	return this.closeError
+}
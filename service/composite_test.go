@@ -0,0 +1,226 @@
+package service
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+// mustNewStaticDiscovery creates a StaticDiscovery, failing the test on error
+func mustNewStaticDiscovery(t *testing.T, services map[string]Instances) *StaticDiscovery {
+	static, err := NewStaticDiscovery(services)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return static
+}
+
+func TestNewCompositeDiscoveryInvalid(t *testing.T) {
+	static := mustNewStaticDiscovery(t, nil)
+
+	var testData = []struct {
+		policy        string
+		children      []CompositeChild
+		expectedError error
+	}{
+		{"", nil, ErrorNoCompositeChildren},
+		{CompositeUnion, nil, ErrorNoCompositeChildren},
+		{"invalid", []CompositeChild{{static, false}}, ErrorInvalidCompositePolicy},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		composite, err := NewCompositeDiscovery(record.policy, record.children...)
+		assert.Nil(t, composite)
+		assert.Equal(t, record.expectedError, err)
+	}
+}
+
+func TestCompositeDiscoveryUnion(t *testing.T) {
+	assert := assert.New(t)
+
+	first := mustNewStaticDiscovery(t, map[string]Instances{"foo": testInstancesWithIds("1", "2")})
+	second := mustNewStaticDiscovery(t, map[string]Instances{"bar": testInstancesWithIds("3")})
+	shared := testInstancesWithIds("2", "4")
+	shared[0].Address = "second.com"
+	assert.Nil(second.SetInstances("foo", shared))
+
+	composite, err := NewCompositeDiscovery("", CompositeChild{first, false}, CompositeChild{second, false})
+	if !assert.Nil(err) {
+		return
+	}
+
+	assert.Equal(CompositeUnion, composite.Policy())
+	assert.ElementsMatch([]string{"foo", "bar"}, composite.ServiceNames())
+
+	// an instance with the same id is taken from the earliest child
+	instances, err := composite.FetchServices("foo")
+	assert.Equal([]string{"1", "2", "4"}, instanceIds(instances))
+	assert.Equal("localhost", instances[1].Address)
+	assert.Nil(err)
+
+	instances, err = composite.FetchServices("bar")
+	assert.Equal([]string{"3"}, instanceIds(instances))
+	assert.Nil(err)
+
+	var events []InstanceEvent
+	_, err = composite.AddListener("foo", InstancesListenerFunc(func(serviceName string, event InstanceEvent) {
+		events = append(events, event)
+	}))
+
+	assert.Nil(err)
+	assert.Len(events, 1)
+
+	// a change to any child is merged and dispatched
+	assert.Nil(first.SetInstances("foo", testInstancesWithIds("1")))
+	if assert.Len(events, 2) {
+		assert.Equal([]string{"1", "2", "4"}, instanceIds(events[1].Current))
+		assert.Equal([]string{"2"}, instanceIds(events[1].Updated))
+		assert.Equal("second.com", events[1].Current[1].Address)
+	}
+
+	assert.Nil(second.SetInstances("foo", Instances{}))
+	if assert.Len(events, 3) {
+		assert.Equal([]string{"1"}, instanceIds(events[2].Current))
+		assert.Equal([]string{"2", "4"}, instanceIds(events[2].Removed))
+	}
+}
+
+func TestCompositeDiscoveryFirstNonEmpty(t *testing.T) {
+	assert := assert.New(t)
+
+	primary := mustNewStaticDiscovery(t, map[string]Instances{"foo": nil})
+	fallback := mustNewStaticDiscovery(t, map[string]Instances{"foo": testInstancesWithIds("static")})
+	composite, err := NewCompositeDiscovery(CompositeFirstNonEmpty, CompositeChild{primary, false}, CompositeChild{fallback, false})
+	if !assert.Nil(err) {
+		return
+	}
+
+	var dispatched []Instances
+	_, err = composite.AddListener("foo", ListenerFunc(func(serviceName string, instances Instances) {
+		dispatched = append(dispatched, instances)
+	}))
+
+	assert.Nil(err)
+	assert.Nil(primary.SetInstances("foo", testInstancesWithIds("1")))
+	assert.Nil(primary.SetInstances("foo", Instances{}))
+	if assert.Len(dispatched, 3) {
+		assert.Equal([]string{"static"}, instanceIds(dispatched[0]))
+		assert.Equal([]string{"1"}, instanceIds(dispatched[1]))
+		assert.Equal([]string{"static"}, instanceIds(dispatched[2]))
+	}
+}
+
+func TestCompositeDiscoveryServices(t *testing.T) {
+	assert := assert.New(t)
+
+	first := mustNewStaticDiscovery(t, map[string]Instances{"foo": testInstancesWithIds("1")})
+	second := mustNewStaticDiscovery(t, nil)
+	composite, err := NewCompositeDiscovery(CompositeUnion, CompositeChild{first, false}, CompositeChild{second, false})
+	if !assert.Nil(err) {
+		return
+	}
+
+	// an added service is added to every child
+	assert.Nil(composite.AddService("bar"))
+	assert.Equal(2, first.ServiceCount())
+	assert.Equal(1, second.ServiceCount())
+
+	_, err = composite.FetchServices("bar")
+	assert.Equal(ErrorServiceNotReady, err)
+
+	assert.Nil(second.SetInstances("bar", testInstancesWithIds("2")))
+	instances, err := composite.FetchServices("bar")
+	assert.Equal([]string{"2"}, instanceIds(instances))
+	assert.Nil(err)
+
+	// a removed service is no longer merged, but remains watched by the children
+	assert.Nil(composite.RemoveService("bar"))
+	assert.Equal(ErrorNoSuchService, composite.RemoveService("bar"))
+	assert.Equal(0, second.ListenerCount("bar"))
+	assert.Nil(second.SetInstances("bar", testInstancesWithIds("3")))
+	_, err = composite.FetchServices("bar")
+	assert.Equal(ErrorNoSuchService, err)
+
+	// a service which any child cannot add is removed from the children that added it
+	assert.Nil(second.Close())
+	assert.Equal(ErrorClosed, composite.AddService("baz"))
+	assert.False(first.IsWatching("baz"))
+	assert.False(composite.IsWatching("baz"))
+
+	// but a service the children already watched remains watched by them
+	assert.Equal(ErrorClosed, composite.AddService("bar"))
+	assert.True(first.IsWatching("bar"))
+}
+
+func TestCompositeDiscoveryClose(t *testing.T) {
+	assert := assert.New(t)
+
+	owned := mustNewStaticDiscovery(t, map[string]Instances{"foo": testInstancesWithIds("1")})
+	shared := mustNewStaticDiscovery(t, map[string]Instances{"foo": testInstancesWithIds("2")})
+	composite, err := NewCompositeDiscovery(CompositeUnion, CompositeChild{owned, true}, CompositeChild{shared, false})
+	if !assert.Nil(err) {
+		return
+	}
+
+	assert.Nil(composite.Run(nil, nil))
+	assert.Equal(1, shared.ListenerCount("foo"))
+
+	assert.Nil(composite.Close())
+	assert.Nil(composite.Close())
+
+	// only the owned child is closed, and the composite's listeners are removed from the other
+	_, err = owned.FetchServices("foo")
+	assert.Equal(ErrorClosed, err)
+
+	instances, err := shared.FetchServices("foo")
+	assert.Equal([]string{"2"}, instanceIds(instances))
+	assert.Nil(err)
+	assert.Equal(0, shared.ListenerCount("foo"))
+
+	_, err = composite.FetchServices("foo")
+	assert.Equal(ErrorClosed, err)
+	assert.Equal(ErrorClosed, composite.Run(nil, nil))
+}
+
+// failingDiscovery is a StaticDiscovery whose Run and Close fail
+type failingDiscovery struct {
+	*StaticDiscovery
+	err error
+}
+
+func (this *failingDiscovery) Run(*sync.WaitGroup, <-chan struct{}) error {
+	return this.err
+}
+
+func (this *failingDiscovery) Close() error {
+	this.StaticDiscovery.Close()
+	return this.err
+}
+
+func TestCompositeDiscoveryChildErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	runError := errors.New("expected run error")
+	closeError := errors.New("expected close error")
+	failsRun := &failingDiscovery{mustNewStaticDiscovery(t, nil), runError}
+	failsClose := &failingDiscovery{mustNewStaticDiscovery(t, nil), closeError}
+	composite, err := NewCompositeDiscovery(CompositeUnion, CompositeChild{failsRun, true})
+	if !assert.Nil(err) {
+		return
+	}
+
+	// the error from the first call is returned by every call
+	assert.Equal(runError, composite.Run(nil, nil))
+	assert.Equal(runError, composite.Run(nil, nil))
+
+	composite, err = NewCompositeDiscovery(CompositeUnion, CompositeChild{failsClose, true})
+	if !assert.Nil(err) {
+		return
+	}
+
+	assert.Equal(closeError, composite.Close())
+	assert.Equal(closeError, composite.Close())
+}
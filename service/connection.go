@@ -0,0 +1,124 @@
+package service
+
+import (
+	"github.com/foursquare/curator.go"
+	"sync"
+	"time"
+)
+
+// ConnectionStateEvent describes a transition of the underlying zookeeper connection
+type ConnectionStateEvent struct {
+	// State is the new connection state
+	State curator.ConnectionState
+
+	// PreviousState is the state prior to this transition.  The first event
+	// has a PreviousState of curator.UNKNOWN.
+	PreviousState curator.ConnectionState
+
+	// Timestamp is the time at which the transition was observed
+	Timestamp time.Time
+}
+
+// ConnectionStateListener receives connection state transitions, such as SUSPENDED, LOST,
+// and RECONNECTED.  Events are delivered one at a time, in the order in which they occurred.
+type ConnectionStateListener interface {
+	ConnectionStateChanged(event ConnectionStateEvent)
+}
+
+// ConnectionStateListenerFunc is a function type that implements ConnectionStateListener
+type ConnectionStateListenerFunc func(event ConnectionStateEvent)
+
+func (this ConnectionStateListenerFunc) ConnectionStateChanged(event ConnectionStateEvent) {
+	this(event)
+}
+
+// connectionStateMonitor translates curator connection state changes into ConnectionStateEvents
+// and fans them out to application listeners.
+type connectionStateMonitor struct {
+	logger Logger
+
+	// dispatchMutex serializes the delivery of events, so that listeners observe transitions in order
+	dispatchMutex sync.Mutex
+
+	// mutex guards the current state.  It is never held during callbacks.
+	mutex     sync.Mutex
+	state     curator.ConnectionState
+	listeners *listenerSet
+}
+
+var _ curator.ConnectionStateListener = (*connectionStateMonitor)(nil)
+
+func newConnectionStateMonitor(logger Logger) *connectionStateMonitor {
+	return &connectionStateMonitor{
+		logger:    logger,
+		state:     curator.UNKNOWN,
+		listeners: newListenerSet(logger, "Connection state"),
+	}
+}
+
+// addListener registers a listener for all subsequent transitions
+func (this *connectionStateMonitor) addListener(listener ConnectionStateListener) Registration {
+	return this.listeners.add(listener)
+}
+
+// currentState returns the most recent connection state
+func (this *connectionStateMonitor) currentState() curator.ConnectionState {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.state
+}
+
+// StateChanged records the new state and delivers an event to each listener
+func (this *connectionStateMonitor) StateChanged(client curator.CuratorFramework, newState curator.ConnectionState) {
+	this.dispatchMutex.Lock()
+	defer this.dispatchMutex.Unlock()
+	this.changeState(newState)
+}
+
+// seed delivers the given state as though curator had reported it, but only if no state has
+// been observed yet.  This accounts for a connection that was established before this monitor
+// was added to it, which curator does not report again.
+func (this *connectionStateMonitor) seed(state curator.ConnectionState) {
+	this.dispatchMutex.Lock()
+	defer this.dispatchMutex.Unlock()
+	if this.currentState() == curator.UNKNOWN {
+		this.changeState(state)
+	}
+}
+
+// changeState records the new state and delivers an event to each listener.  The dispatchMutex
+// must be held.
+func (this *connectionStateMonitor) changeState(newState curator.ConnectionState) {
+	this.mutex.Lock()
+	event := ConnectionStateEvent{
+		State:         newState,
+		PreviousState: this.state,
+		Timestamp:     time.Now(),
+	}
+
+	this.state = newState
+	this.mutex.Unlock()
+
+	this.logger.Info("Connection state changed from %s to %s", event.PreviousState, event.State)
+	this.listeners.each(func(listener interface{}) {
+		listener.(ConnectionStateListener).ConnectionStateChanged(event)
+	})
+}
+
+// addConnectionStateListener adds a listener to a curator connection unless that same listener
+// is already present, which can happen when the connection is shared.  This function returns
+// true if the listener was added.
+func addConnectionStateListener(listenable curator.ConnectionStateListenable, listener curator.ConnectionStateListener) bool {
+	present := false
+	listenable.ForEach(func(candidate interface{}) {
+		if candidate == listener {
+			present = true
+		}
+	})
+
+	if !present {
+		listenable.AddListener(listener)
+	}
+
+	return !present
+}
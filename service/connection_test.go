@@ -0,0 +1,135 @@
+package service
+
+import (
+	"github.com/foursquare/curator.go"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func TestConnectionStateMonitor(t *testing.T) {
+	assert := assert.New(t)
+
+	monitor := newConnectionStateMonitor(&testLogger{t})
+	var events []ConnectionStateEvent
+	registration := monitor.addListener(ConnectionStateListenerFunc(func(event ConnectionStateEvent) {
+		events = append(events, event)
+	}))
+
+	monitor.addListener(ConnectionStateListenerFunc(func(event ConnectionStateEvent) {
+		panic("expected")
+	}))
+
+	transitions := []curator.ConnectionState{curator.CONNECTED, curator.SUSPENDED, curator.LOST, curator.RECONNECTED}
+	for _, state := range transitions {
+		monitor.StateChanged(nil, state)
+	}
+
+	if assert.Len(events, len(transitions)) {
+		previous := curator.UNKNOWN
+		for index, event := range events {
+			assert.Equal(transitions[index], event.State)
+			assert.Equal(previous, event.PreviousState)
+			assert.False(event.Timestamp.IsZero())
+			if index > 0 {
+				assert.False(event.Timestamp.Before(events[index-1].Timestamp))
+			}
+
+			previous = event.State
+		}
+	}
+
+	registration.Cancel()
+	registration.Cancel()
+	monitor.StateChanged(nil, curator.SUSPENDED)
+	assert.Len(events, len(transitions))
+}
+
+func TestConnectionStateListenerCancelFromCallback(t *testing.T) {
+	assert := assert.New(t)
+
+	monitor := newConnectionStateMonitor(&testLogger{t})
+	var (
+		registration Registration
+		added        []curator.ConnectionState
+		callCount    int
+	)
+
+	registration = monitor.addListener(ConnectionStateListenerFunc(func(event ConnectionStateEvent) {
+		callCount++
+		registration.Cancel()
+		monitor.addListener(ConnectionStateListenerFunc(func(event ConnectionStateEvent) {
+			added = append(added, event.State)
+		}))
+	}))
+
+	monitor.StateChanged(nil, curator.CONNECTED)
+	monitor.StateChanged(nil, curator.SUSPENDED)
+	assert.Equal(1, callCount)
+	assert.Equal([]curator.ConnectionState{curator.SUSPENDED}, added)
+}
+
+func TestConnectionStateListenerConcurrency(t *testing.T) {
+	monitor := newConnectionStateMonitor(&testLogger{t})
+	waitGroup := &sync.WaitGroup{}
+	waitGroup.Add(2)
+
+	go func() {
+		defer waitGroup.Done()
+		for repeat := 0; repeat < 100; repeat++ {
+			monitor.StateChanged(nil, curator.SUSPENDED)
+			monitor.StateChanged(nil, curator.RECONNECTED)
+		}
+	}()
+
+	go func() {
+		defer waitGroup.Done()
+		for repeat := 0; repeat < 100; repeat++ {
+			monitor.addListener(ConnectionStateListenerFunc(func(ConnectionStateEvent) {})).Cancel()
+		}
+	}()
+
+	waitGroup.Wait()
+}
+
+func TestConnectionStateMonitorSeed(t *testing.T) {
+	assert := assert.New(t)
+
+	monitor := newConnectionStateMonitor(&testLogger{t})
+	var events []ConnectionStateEvent
+	monitor.addListener(ConnectionStateListenerFunc(func(event ConnectionStateEvent) {
+		events = append(events, event)
+	}))
+
+	monitor.seed(curator.CONNECTED)
+	assert.Equal(curator.CONNECTED, monitor.currentState())
+	if assert.Len(events, 1) {
+		assert.Equal(curator.CONNECTED, events[0].State)
+		assert.Equal(curator.UNKNOWN, events[0].PreviousState)
+	}
+
+	// once a state has been observed, seeding has no effect
+	monitor.StateChanged(nil, curator.SUSPENDED)
+	monitor.seed(curator.CONNECTED)
+	assert.Equal(curator.SUSPENDED, monitor.currentState())
+	assert.Len(events, 2)
+}
+
+func TestAddConnectionStateListener(t *testing.T) {
+	assert := assert.New(t)
+
+	curatorConnection := newCuratorConnection(testConnection, 0, 0, nil, nil, newFakeZookeeperConnection())
+	listenable := curatorConnection.ConnectionStateListenable()
+	initial := listenable.Len()
+
+	first := newConnectionStateMonitor(&testLogger{t})
+	second := newConnectionStateMonitor(&testLogger{t})
+	assert.True(addConnectionStateListener(listenable, first))
+	assert.False(addConnectionStateListener(listenable, first))
+	assert.True(addConnectionStateListener(listenable, second))
+	assert.Equal(initial+2, listenable.Len())
+
+	listenable.RemoveListener(first)
+	listenable.RemoveListener(second)
+	assert.Equal(initial, listenable.Len())
+}
@@ -0,0 +1,134 @@
+package service
+
+import (
+	"github.com/foursquare/fsgo/net/discovery"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+// DefaultVirtualNodes is the number of points each instance occupies on a ConsistentHash ring
+// when no positive count is supplied
+const DefaultVirtualNodes = 100
+
+// hashRing is an immutable consistent hash ring
+type hashRing struct {
+	points    []uint64
+	instances []*discovery.ServiceInstance
+}
+
+func (this *hashRing) Len() int {
+	return len(this.points)
+}
+
+func (this *hashRing) Less(i, j int) bool {
+	return this.points[i] < this.points[j]
+}
+
+func (this *hashRing) Swap(i, j int) {
+	this.points[i], this.points[j] = this.points[j], this.points[i]
+	this.instances[i], this.instances[j] = this.instances[j], this.instances[i]
+}
+
+// hashKey maps a string onto a point of the ring
+func hashKey(key string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+
+	// fnv alone clusters similar keys, so finish with a 64-bit mix
+	value := hash.Sum64()
+	value ^= value >> 33
+	value *= 0xff51afd7ed558ccd
+	value ^= value >> 33
+	value *= 0xc4ceb9fe1a85ec53
+	value ^= value >> 33
+	return value
+}
+
+// ConsistentHash selects service instances by hashing keys onto a ring.  When instances are
+// added or removed, only the keys owned by those instances move.  Each instance is placed on
+// the ring according to the key produced by a KeyFunc, so the KeyFunc should be stable across
+// re-registrations of the same instance.  A ConsistentHash is a Listener, and it is safe for
+// concurrent use.  Picks never block, even while an Update is in progress.
+type ConsistentHash struct {
+	keyFunc      KeyFunc
+	virtualNodes int
+
+	// ring holds the current *hashRing
+	ring atomic.Value
+}
+
+var _ Listener = (*ConsistentHash)(nil)
+
+// NewConsistentHash creates an empty ConsistentHash.  If keyFunc is nil, Spec is used.  If
+// virtualNodes is nonpositive, DefaultVirtualNodes is used.
+func NewConsistentHash(keyFunc KeyFunc, virtualNodes int) *ConsistentHash {
+	if keyFunc == nil {
+		keyFunc = Spec
+	}
+
+	if virtualNodes < 1 {
+		virtualNodes = DefaultVirtualNodes
+	}
+
+	consistentHash := &ConsistentHash{
+		keyFunc:      keyFunc,
+		virtualNodes: virtualNodes,
+	}
+
+	consistentHash.ring.Store(&hashRing{})
+	return consistentHash
+}
+
+// Update rebuilds the ring from the given instances.  Instances which map to the same key
+// as an earlier instance are ignored.
+func (this *ConsistentHash) Update(instances Instances) {
+	ring := &hashRing{
+		points:    make([]uint64, 0, len(instances)*this.virtualNodes),
+		instances: make([]*discovery.ServiceInstance, 0, len(instances)*this.virtualNodes),
+	}
+
+	keys := make(map[string]bool, len(instances))
+	for _, serviceInstance := range instances {
+		if serviceInstance == nil {
+			continue
+		}
+
+		key := this.keyFunc(serviceInstance)
+		if keys[key] {
+			continue
+		}
+
+		keys[key] = true
+		for virtualNode := 0; virtualNode < this.virtualNodes; virtualNode++ {
+			ring.points = append(ring.points, hashKey(key+"#"+strconv.Itoa(virtualNode)))
+			ring.instances = append(ring.instances, serviceInstance)
+		}
+	}
+
+	sort.Stable(ring)
+	this.ring.Store(ring)
+}
+
+// Pick returns the instance which owns the given key.  If there are no instances, this
+// method returns nil.
+func (this *ConsistentHash) Pick(key string) *discovery.ServiceInstance {
+	ring := this.ring.Load().(*hashRing)
+	if len(ring.points) == 0 {
+		return nil
+	}
+
+	point := hashKey(key)
+	index := sort.Search(len(ring.points), func(i int) bool { return ring.points[i] >= point })
+	if index == len(ring.points) {
+		index = 0
+	}
+
+	return ring.instances[index]
+}
+
+// ServicesChanged updates this ConsistentHash with the new instances
+func (this *ConsistentHash) ServicesChanged(serviceName string, instances Instances) {
+	this.Update(instances)
+}
@@ -0,0 +1,140 @@
+package service
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+// newHashTestInstances creates count instances with distinct addresses
+func newHashTestInstances(count int) Instances {
+	instances := make(Instances, count)
+	for index := range instances {
+		instances[index] = newTestInstance(fmt.Sprintf("instance-%d", index), fmt.Sprintf("host%d.com", index), 8080)
+	}
+
+	return instances
+}
+
+func TestConsistentHashEmpty(t *testing.T) {
+	assert := assert.New(t)
+
+	consistentHash := NewConsistentHash(nil, 0)
+	assert.Nil(consistentHash.Pick("key"))
+
+	consistentHash.Update(Instances{nil})
+	assert.Nil(consistentHash.Pick("key"))
+
+	consistentHash.Update(newHashTestInstances(1))
+	assert.Equal("instance-0", consistentHash.Pick("key").Id)
+
+	consistentHash.ServicesChanged(testServiceName, Instances{})
+	assert.Nil(consistentHash.Pick("key"))
+}
+
+func TestConsistentHashDistribution(t *testing.T) {
+	assert := assert.New(t)
+
+	var testData = []struct {
+		instanceCount int
+		virtualNodes  int
+	}{
+		{2, 0},
+		{5, 100},
+		{10, 200},
+	}
+
+	const keyCount = 50000
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		consistentHash := NewConsistentHash(AddressPortKey, record.virtualNodes)
+		consistentHash.Update(newHashTestInstances(record.instanceCount))
+
+		counts := make(map[string]int)
+		for key := 0; key < keyCount; key++ {
+			counts[consistentHash.Pick(fmt.Sprintf("key-%d", key)).Id]++
+		}
+
+		assert.Len(counts, record.instanceCount)
+		expected := keyCount / record.instanceCount
+		for id, count := range counts {
+			// each instance should own within 30% of its fair share
+			assert.InDelta(expected, count, float64(expected)*0.3, "instance %s owns %d keys", id, count)
+		}
+	}
+}
+
+func TestConsistentHashMinimalDisruption(t *testing.T) {
+	assert := assert.New(t)
+
+	const keyCount = 10000
+	instances := newHashTestInstances(10)
+	consistentHash := NewConsistentHash(AddressPortKey, 0)
+	consistentHash.Update(instances)
+
+	before := make([]string, keyCount)
+	for key := range before {
+		before[key] = consistentHash.Pick(fmt.Sprintf("key-%d", key)).Id
+	}
+
+	// removing an instance moves only the keys it owned
+	removed := instances[3]
+	consistentHash.Update(append(append(Instances{}, instances[:3]...), instances[4:]...))
+	for key, previous := range before {
+		current := consistentHash.Pick(fmt.Sprintf("key-%d", key)).Id
+		if previous == removed.Id {
+			assert.NotEqual(removed.Id, current)
+		} else {
+			assert.Equal(previous, current)
+		}
+	}
+
+	// adding it back restores the original owners, regardless of order
+	reversed := make(Instances, len(instances))
+	for index, serviceInstance := range instances {
+		reversed[len(instances)-index-1] = serviceInstance
+	}
+
+	consistentHash.Update(reversed)
+	for key, previous := range before {
+		assert.Equal(previous, consistentHash.Pick(fmt.Sprintf("key-%d", key)).Id)
+	}
+}
+
+func TestConsistentHashDuplicateKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	consistentHash := NewConsistentHash(HostnameKey, 10)
+	consistentHash.Update(Instances{newTestInstance("first", "host.com", 80), newTestInstance("second", "host.com", 81)})
+	for key := 0; key < 100; key++ {
+		assert.Equal("first", consistentHash.Pick(fmt.Sprintf("key-%d", key)).Id)
+	}
+}
+
+func TestConsistentHashConcurrency(t *testing.T) {
+	assert := assert.New(t)
+
+	consistentHash := NewConsistentHash(nil, 0)
+	updates := []Instances{newHashTestInstances(3), {}, newHashTestInstances(5)}
+
+	waitGroup := &sync.WaitGroup{}
+	waitGroup.Add(2)
+	go func() {
+		defer waitGroup.Done()
+		for repeat := 0; repeat < 100; repeat++ {
+			consistentHash.Update(updates[repeat%len(updates)])
+		}
+	}()
+
+	go func() {
+		defer waitGroup.Done()
+		for repeat := 0; repeat < 1000; repeat++ {
+			if serviceInstance := consistentHash.Pick(fmt.Sprintf("key-%d", repeat)); serviceInstance != nil {
+				assert.NotEmpty(serviceInstance.Id)
+			}
+		}
+	}()
+
+	waitGroup.Wait()
+}
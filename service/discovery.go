@@ -1,12 +1,18 @@
 package service
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"github.com/foursquare/curator.go"
 	"github.com/foursquare/fsgo/net/discovery"
 	"github.com/samuel/go-zookeeper/zk"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -16,13 +22,65 @@ const (
 	discoveryStateNotStarted = uint32(iota)
 	discoveryStateRunning
 	discoveryStateStopped
+	discoveryStateClosed
 
 	DefaultWatchPollInterval = time.Duration(5 * time.Minute)
+	DefaultFetchConcurrency  = 8
+	DefaultFetchTimeout      = time.Duration(5 * time.Second)
+	DefaultLogSampleSize     = 10
+
+	// DefaultConnectTimeout and DefaultSessionTimeout are used when the DiscoveryBuilder does not
+	// supply a ConnectTimeout or SessionTimeout, and match curator's defaults
+	DefaultConnectTimeout = time.Duration(15 * time.Second)
+	DefaultSessionTimeout = time.Duration(60 * time.Second)
+
+	// DefaultAggregateWindow is used when the DiscoveryBuilder does not supply an AggregateWindow
+	DefaultAggregateWindow = time.Duration(100 * time.Millisecond)
 )
 
 var (
-	ErrorNotRunning               = errors.New("Discovery client not running")
-	ErrorInvalidWatchPollInterval = errors.New("The WatchPollInterval must be a valid time.Duration or an integral seconds value")
+	ErrorNotRunning                 = errors.New("Discovery client not running")
+	ErrorClosed                     = errors.New("Discovery client has been closed")
+	ErrorNoSuchService              = errors.New("No such service is watched")
+	ErrorServiceNotReady            = errors.New("The service has not yet been read from zookeeper")
+	ErrorInitialSnapshotTimeout     = errors.New("Timed out waiting for the service to be read from zookeeper")
+	ErrorNoConnection               = errors.New("At least one zookeeper server must be supplied in the Connection")
+	ErrorInvalidRegistration        = errors.New("Each registration must have a valid name and address, and a port or SSL port between 1 and 65535")
+	ErrorInvalidConnectTimeout      = errors.New("The ConnectTimeout must be a nonnegative time.Duration or integral seconds value")
+	ErrorInvalidSessionTimeout      = errors.New("The SessionTimeout must be a nonnegative time.Duration or integral seconds value")
+	ErrorInvalidConnectRetry        = errors.New("The ConnectRetryInitialDelay, ConnectRetryMaxDelay, and ConnectDeadline must be valid time.Duration or integral seconds values")
+	ErrorConnectDeadline            = errors.New("Unable to connect to zookeeper before the ConnectDeadline")
+	ErrorConnectAbandoned           = errors.New("Connecting to zookeeper was abandoned due to shutdown")
+	ErrorInvalidWatchPollInterval   = errors.New("The WatchPollInterval must be a valid time.Duration or an integral seconds value")
+	ErrorInvalidWatchRetryDelay     = errors.New("The WatchRetryInitialDelay and WatchRetryMaxDelay must be valid time.Duration or integral seconds values")
+	ErrorInvalidWatchDebounceWindow = errors.New("The WatchDebounceWindow must be a nonnegative time.Duration or integral seconds value")
+	ErrorInvalidAggregateWindow     = errors.New("The AggregateWindow must be a nonnegative time.Duration or integral seconds value")
+	ErrorInvalidResyncInterval      = errors.New("The ResyncInterval must be a nonnegative time.Duration or integral seconds value")
+	ErrorInvalidReconnectJitter     = errors.New("The ReconnectJitter must be a nonnegative time.Duration or integral seconds value")
+	ErrorInvalidWatchLossThreshold  = errors.New("The WatchLossThreshold must be a nonnegative time.Duration or integral seconds value")
+	ErrorNoBasePaths                = errors.New("At least one base path must be watched")
+	ErrorInvalidWatchPath           = errors.New("Each of the WatchPaths must be an absolute zookeeper path other than the root")
+	ErrorServicePathCollision       = errors.New("Two watched services cannot share the same path")
+	ErrorInvalidReadRateLimit       = errors.New("The ReadRateLimit and ReadRateBurst must not be negative")
+	ErrorInvalidReadBatchSize       = errors.New("The ReadBatchSize must not be negative")
+	ErrorInvalidFetchTimeout        = errors.New("The FetchTimeout must be a nonnegative time.Duration or integral seconds value")
+	ErrorFetchTimeout               = errors.New("Timed out reading the data of a child znode")
+	ErrorInvalidLogSampleSize       = errors.New("The LogSampleSize must not be negative")
+	ErrorInvalidEventHistorySize    = errors.New("The EventHistorySize must not be negative")
+	ErrorRegistrationUnsupported    = errors.New("This Discovery does not register service instances")
+	ErrorReadOnly                   = errors.New("This Discovery is read-only, and never writes to zookeeper")
+	ErrorReadOnlyRegistrations      = errors.New("A ReadOnly Discovery cannot have Registrations")
+	ErrorReadOnlyServicePathMode    = errors.New("A ReadOnly Discovery cannot use the \"" + ServicePathCreate + "\" ServicePathMode")
+	ErrorInvalidAuth                = errors.New("The AuthScheme and AuthCredentials must be supplied together")
+	ErrorInvalidACL                 = errors.New("Each ACL must have a Scheme and Permissions made up of \"rwcda\" or \"" + PermissionsAll + "\"")
+	ErrorInvalidServicePathMode     = errors.New("The ServicePathMode must be one of \"" + ServicePathCreate + "\", \"" + ServicePathRequire + "\", or \"" + ServicePathWaitForCreation + "\"")
+	ErrorInvalidStaleThreshold      = errors.New("The StaleInstanceThreshold must be a nonnegative time.Duration or integral seconds value")
+	ErrorInvalidVersionConstraint   = errors.New("The VersionConstraint must have a Field and at least one Accepted version")
+	ErrorInvalidListenerTimeout     = errors.New("The ListenerTimeout must be a nonnegative time.Duration or integral seconds value")
+	ErrorInvalidDispatchQueueFull   = errors.New("The DispatchQueueFull policy must be either \"" + DispatchQueueFullBlock + "\" or \"" + DispatchQueueFullDropOldest + "\"")
+	ErrorInvalidDispatchExecutor    = errors.New("The DispatchExecutor cannot be combined with AsyncDispatch")
+	ErrorInvalidDuplicateListener   = errors.New("The DuplicateListener policy must be either \"" + DuplicateListenerIgnore + "\" or \"" + DuplicateListenerError + "\"")
+	ErrorAlreadyRegistered          = errors.New("The listener is already registered")
 )
 
 // Discovery represents a service discovery endpoint.  Instances are
@@ -35,19 +93,188 @@ type Discovery interface {
 	ServiceCount() int
 
 	// ServiceNames returns an independent slice containing the names of the watched services
-	// available in this Discovery
+	// available in this Discovery, in sorted order.  The names reflect every AddService and
+	// RemoveService that has returned.
 	ServiceNames() []string
 
-	// FetchServices returns an Instances containing the set of services with the given name.
-	// If no services by that name are watched, this method returns an error.
+	// IsWatching tests whether the service with the given name is currently watched
+	IsWatching(serviceName string) bool
+
+	// AddWatchedServicesListener registers a listener for changes to the set of watched services,
+	// such as those made by AddService and RemoveService.  The services watched when the listener
+	// is added are not delivered.  The returned Registration removes the listener when cancelled.
+	AddWatchedServicesListener(listener WatchedServicesListener) Registration
+
+	// AddAggregateListener registers a listener for the snapshots of every watched service, which
+	// are delivered after any of the services changes.  Changes within the AggregateWindow are
+	// coalesced into one delivery.  If any service has already been read, the new listener receives
+	// the current snapshots once the window elapses.  The returned Registration removes the
+	// listener when cancelled.
+	AddAggregateListener(listener AggregateListener) Registration
+
+	// FetchServices returns an Instances containing the most recently observed set of services
+	// with the given name.  This method reads from an in-memory cache and never blocks on zookeeper,
+	// which makes it suitable for request-handling code.  The returned Instances is a copy that
+	// may be freely modified.  If no services by that name are watched, ErrorNoSuchService is returned.
 	FetchServices(serviceName string) (Instances, error)
 
-	// AddListener registers a listener for the given service name.
-	AddListener(serviceName string, listener Listener)
-
-	// RemoveListener deregisters a listener for the given service name
+	// FetchRevision is FetchServices, along with the revision of the returned Instances.  Each
+	// watched service has its own revision, which is the Sequence of the InstanceEvent that
+	// delivered the same Instances to listeners.  Revisions only increase, and events are always
+	// dispatched in revision order, so a consumer can discard any Instances older than those it
+	// already holds, whether they were pulled or pushed.
+	FetchRevision(serviceName string) (Instances, uint64, error)
+
+	// PinInstances overrides the Instances of the given service, e.g. to steer consumers onto a
+	// subset of instances during an incident.  The pinned Instances are dispatched at once in an
+	// InstanceEvent which is Pinned, and FetchServices returns them until Unpin is called.
+	// Meanwhile, the Instances read from zookeeper are cached without being dispatched.  Pinning a
+	// pinned service replaces its pinned Instances.  If no services by that name are watched,
+	// ErrorNoSuchService is returned.
+	//
+	// PinInstances may be called from within a listener, e.g. by a ThresholdHandler.  In that case,
+	// or whenever a dispatch of the service is in progress, the pin takes effect once the event in
+	// flight has been delivered to every listener, rather than before PinInstances returns.
+	PinInstances(serviceName string, pinned Instances) error
+
+	// Unpin removes the Instances pinned for the given service, immediately dispatching the
+	// Instances most recently read from zookeeper.  A service which is not pinned is unaffected.
+	// As with PinInstances, Unpin may be called from within a listener, in which case it takes
+	// effect once the event in flight has been delivered.
+	Unpin(serviceName string)
+
+	// SnapshotTo writes the last-known Instances of every watched service that has been read
+	// as a versioned JSON document.  The snapshot can be supplied to a DiscoveryBuilder as its
+	// WarmStartSnapshot, so that a later process can start before zookeeper is reachable.
+	SnapshotTo(writer io.Writer) error
+
+	// InstanceBasePath returns the base path beneath which the given ServiceInstance was read,
+	// which identifies its origin when services are watched beneath more than one base path.
+	// The ServiceInstance is located by its Name and Id among the last-known instances of the
+	// watched service.  If no such ServiceInstance is known, this method returns false.
+	InstanceBasePath(serviceInstance *discovery.ServiceInstance) (string, bool)
+
+	// StatusHandler returns an http.Handler which renders what this Discovery currently believes
+	// as a JSON Status document, for debugging.  Only the in-memory cache is consulted, never
+	// zookeeper, so the handler is safe to use during an outage.  See NewStatusHandler.
+	StatusHandler() http.Handler
+
+	// WaitForInitialSnapshot blocks until the service with the given name has been read from
+	// zookeeper for the first time, then returns a copy of the observed Instances.  This method
+	// may be called before Run, in which case it waits for Run to read the service.  If the
+	// timeout elapses first, ErrorInitialSnapshotTimeout is returned.  If no services by that
+	// name are watched, or the service is removed while waiting, ErrorNoSuchService is returned.
+	// If this Discovery is closed, ErrorClosed is returned.
+	WaitForInitialSnapshot(serviceName string, timeout time.Duration) (Instances, error)
+
+	// WaitForInitialSnapshotContext is like WaitForInitialSnapshot, except that waiting is
+	// bounded by a context.  If the context is done first, the context's error is returned.
+	WaitForInitialSnapshotContext(ctx context.Context, serviceName string) (Instances, error)
+
+	// SkippedInstances returns the number of child znodes of the given service that were skipped
+	// during the most recent read because their data could not be read or deserialized.  A value
+	// above zero usually indicates incompatible registrations.  If no services by that name are
+	// watched, ErrorNoSuchService is returned.
+	SkippedInstances(serviceName string) (int, error)
+
+	// History returns the most recent events dispatched for the given service, oldest first, as
+	// kept when an EventHistorySize is configured.  Nil is returned when no history is kept, or
+	// when no services by that name are watched.
+	History(serviceName string) []EventRecord
+
+	// Metrics returns a snapshot of the metrics for the service with the given name.
+	// If no services by that name are watched, ErrorNoSuchService is returned.
+	Metrics(serviceName string) (Metrics, error)
+
+	// AggregateMetrics returns the metrics of all watched services combined.  Counts are
+	// summed across services, while latencies are the largest of any service.
+	AggregateMetrics() Metrics
+
+	// AddListener registers a listener for the given service name.  The returned Registration
+	// removes the listener when cancelled.  If no services by that name are watched,
+	// ErrorNoSuchService is returned.
+	//
+	// Listeners are invoked without holding any lock on the listeners themselves, so a listener
+	// may add or remove listeners, including itself, e.g. to implement a one-shot listener.  A
+	// listener added during a dispatch receives the last-known Instances and then only subsequent
+	// events.  A listener removed during a dispatch may still receive the event in flight.
+	AddListener(serviceName string, listener Listener) (Registration, error)
+
+	// Subscribe returns a Subscription to the given service, which is a pull-style alternative to
+	// AddListener.  If no services by that name are watched, ErrorNoSuchService is returned.
+	Subscribe(serviceName string) (*Subscription, error)
+
+	// AddOnceListener registers a listener for the given service name which is invoked for the next
+	// change to the service, and is then removed.  Unlike AddListener, the last-known Instances are
+	// not delivered when the listener is added.  The listener is invoked at most once, even when
+	// changes are dispatched concurrently, and the returned Registration removes it beforehand if
+	// cancelled.  If no services by that name are watched, ErrorNoSuchService is returned.
+	AddOnceListener(serviceName string, listener Listener) (Registration, error)
+
+	// AddListenerForServices registers a listener for every watched service whose name matches
+	// the given glob pattern, as defined by path.Match.  For example, "*" matches every service.
+	// The listener is also registered for matching services added later via AddService.  The
+	// returned Registration removes the listener from every service when cancelled.  An invalid
+	// pattern results in path.ErrBadPattern.
+	AddListenerForServices(pattern string, listener Listener) (Registration, error)
+
+	// RemoveListener deregisters a listener for the given service name.  Only listeners in the
+	// DefaultListenerGroup are removed.
+	//
+	// Deprecated: RemoveListener compares listeners by identity, which does not work for
+	// listeners that aren't comparable, such as a ListenerFunc.  Use the Registration returned
+	// by AddListener instead.
 	RemoveListener(serviceName string, listener Listener)
 
+	// RemoveAllListeners removes every listener for the given service name, in every group and
+	// including listeners added by pattern, and returns the number of listeners removed.  Pattern
+	// listeners continue to receive events for other services.  If no services by that name are
+	// watched, nothing is removed.
+	RemoveAllListeners(serviceName string) int
+
+	// ListenerCount returns the number of listeners for the given service name, in every group
+	// and including listeners added by pattern.  If no services by that name are watched, zero
+	// is returned.
+	ListenerCount(serviceName string) int
+
+	// AddGroupListener is like AddListener, except that the listener belongs to the given group.
+	// Groups give independent users of a single Discovery, such as libraries embedded in the same
+	// process, separate namespaces for their listeners.  Removing the listeners of one group never
+	// affects another group, and every group receives the same events.
+	AddGroupListener(group, serviceName string, listener Listener) (Registration, error)
+
+	// AddGroupListenerForServices is like AddListenerForServices, except that the listener belongs
+	// to the given group
+	AddGroupListenerForServices(group, pattern string, listener Listener) (Registration, error)
+
+	// RemoveGroupListeners removes every listener in the given group for the given service,
+	// including listeners added by pattern, and returns the number of listeners removed.  If no
+	// services by that name are watched, nothing is removed.
+	RemoveGroupListeners(group, serviceName string) int
+
+	// CloseGroup removes every listener in the given group from every service.  Pattern listeners
+	// in the group are cancelled, so they are not added to services added later.  The group may
+	// be used again afterward.
+	CloseGroup(group string)
+
+	// AddConnectionStateListener registers a listener for transitions of the underlying zookeeper
+	// connection, such as SUSPENDED, LOST, and RECONNECTED.  Listeners may be added before Run is
+	// called.  The returned Registration removes the listener when cancelled.
+	AddConnectionStateListener(listener ConnectionStateListener) Registration
+
+	// CuratorConnection returns the curator connection used by this Discovery, which allows
+	// additional zookeeper operations without opening a second session.  While this Discovery is
+	// not running, nil is returned.  Unless the connection was supplied as the CuratorConnection
+	// of the DiscoveryBuilder, this Discovery owns it: callers must not Close it, and it is
+	// closed when this Discovery stops.
+	CuratorConnection() discovery.Conn
+
+	// SessionTimeout returns the zookeeper session timeout most recently negotiated by this
+	// Discovery's connection, which the ensemble may have bounded differently from the SessionTimeout
+	// requested by the DiscoveryBuilder.  Zero is returned until a session is established, and when
+	// the timeout cannot be observed, e.g. for a connection supplied to the DiscoveryBuilder.
+	SessionTimeout() time.Duration
+
 	// BlockUntilConnected blocks until the underlying Curator implementation
 	// is in a connected state with Zookeeper
 	BlockUntilConnected() error
@@ -57,25 +284,126 @@ type Discovery interface {
 	// Curator implementation transitioning into a connected state.
 	BlockUntilConnectedTimeout(maxWaitTime time.Duration) error
 
-	// Run starts this Discovery instance.  It is idempotent.
+	// AddService begins watching the service with the given name.  If this Discovery is running,
+	// the service's znode path is ensured, the initial Instances are dispatched to any listeners,
+	// and a watch is set before this method returns.  Otherwise, the service is initialized when
+	// Run is called.  If the service is already watched, this method does nothing and returns nil.
+	// If this Discovery has been closed, ErrorClosed is returned.
+	AddService(serviceName string) error
+
+	// RemoveService stops watching the service with the given name.  Listeners registered
+	// for that service receive no further events, and any outstanding zookeeper watch is
+	// allowed to expire.  If no services by that name are watched, ErrorNoSuchService is returned.
+	RemoveService(serviceName string) error
+
+	// Registrations returns copies of the service instances registered by this Discovery.
+	// These registrations are restored automatically whenever a zookeeper session expires.
+	Registrations() Instances
+
+	// Register registers each of the given service instances while this Discovery is running.
+	// As with the configured Registrations, each instance is given a new Id, and is restored
+	// automatically whenever a zookeeper session expires.  Copies of the registered instances
+	// are returned, with their Ids, so that they can be passed to DeregisterInstances.  If an
+	// instance fails, the instances registered before it are returned along with the error.
+	// If this Discovery is not running, ErrorNotRunning is returned.
+	Register(instances Instances) (Instances, error)
+
+	// DeregisterInstances removes the registrations with the same Ids as the given instances,
+	// as returned by Register, leaving any other registrations in place.  All are attempted, and
+	// any failures are reported via a MultiError.  Instances which are not registered are ignored.
+	DeregisterInstances(instances Instances) error
+
+	// Deregister removes every service instance registered by this Discovery, e.g. during
+	// a graceful shutdown.  All registrations are attempted, and any failures are reported
+	// via a MultiError.  Deregistered instances are no longer restored on session expiration.
+	Deregister() error
+
+	// Run starts this Discovery instance.  It is idempotent.  If this Discovery has been
+	// closed, ErrorClosed is returned.  While Run is connecting to zookeeper and reading the
+	// watched services, FetchServices and FetchRevision return ErrorServiceNotReady.
 	Run(waitGroup *sync.WaitGroup, shutdown <-chan struct{}) error
+
+	// Close permanently shuts down this Discovery.  Every instance registered by this Discovery
+	// is deregistered, and the goroutines started by Run are signalled to stop, which in turn
+	// removes all listeners and closes the curator connection.  Afterward, FetchServices and
+	// AddListener return ErrorClosed.  Close is idempotent and does not wait for the goroutines
+	// to exit, so it is safe to call from within a listener.  Use the WaitGroup passed to Run
+	// to wait for shutdown to complete.
+	Close() error
 }
 
 // curatorDiscovery is the default, Curator-based Service Discovery subsystem.
 type curatorDiscovery struct {
-	state         uint32
-	connection    string
-	basePath      string
-	registrations Instances
-
-	serviceWatcherSet *serviceWatcherSet
-	watchPollInterval time.Duration
-	curatorConnection discovery.Conn
-	logger            zk.Logger
-	serviceDiscovery  *discovery.ServiceDiscovery
+	state          uint32
+	connection     string
+	connectTimeout time.Duration
+	sessionTimeout time.Duration
+	basePath       string
+	registrations  Instances
+
+	// starting is nonzero while Run is establishing the connection and initial watches
+	starting uint32
+
+	// connectRetry, when set, bounds connection establishment with a backoff and connectDeadline
+	connectRetry    *retryOptions
+	connectDeadline time.Duration
+
+	// ownsConnection is false when the curatorConnection was supplied to the DiscoveryBuilder,
+	// in which case it is never started twice or closed by this Discovery
+	ownsConnection bool
+
+	serviceWatcherSet  *serviceWatcherSet
+	watchPollInterval  time.Duration
+	resyncInterval     time.Duration
+	curatorConnection  discovery.Conn
+	zookeeperClient    zookeeperClient
+	readRateLimiter    *rateLimiter
+	logger             Logger
+	instanceSerializer discovery.InstanceSerializer
+
+	// registrationValidator, when set, checks each registration before it is written
+	registrationValidator RegistrationValidator
+
+	// readOnly prevents this Discovery from writing to zookeeper
+	readOnly bool
+
+	// reconnectJitter bounds the random delay before each watcher is refreshed after reconnection.
+	// The random function is only called from the monitor goroutine.
+	reconnectJitter time.Duration
+	random          func() float64
+
+	// watchLossThreshold, when positive, is how long a watched path may be without a watch
+	// before a warning is logged
+	watchLossThreshold time.Duration
+
+	// authInfos are added to each zookeeper connection, and acls are applied to each created znode
+	authInfos []curator.AuthInfo
+	acls      []zk.ACL
+
+	// zookeeperDialer, when set, replaces the dialing of zookeeper connections by curator.
+	// Otherwise, the session timeout negotiated by each connection is recorded.
+	zookeeperDialer          curator.ZookeeperDialer
+	negotiatedSessionTimeout negotiatedTimeout
+
+	registrationManager    *registrationManager
+	connectionStateMonitor *connectionStateMonitor
 
 	curatorEvents chan curator.CuratorEvent
 	once          sync.Once
+
+	closeOnce   sync.Once
+	closeSignal chan struct{}
+	closeError  error
+
+	// cancel cancels the root context from which every watcher's context is derived
+	cancel context.CancelFunc
+
+	// warmStarted is set when services were loaded from a snapshot, which allows them
+	// to be fetched before this Discovery is running
+	warmStarted bool
+
+	// expvarName, when set, is the expvar name under which this Discovery is published
+	expvarName string
 }
 
 // EventReceived provides multiplexing for the various events that this discovery can receive
@@ -88,32 +416,108 @@ func (this *curatorDiscovery) running() bool {
 	return atomic.LoadUint32(&this.state) == discoveryStateRunning
 }
 
+func (this *curatorDiscovery) closed() bool {
+	return atomic.LoadUint32(&this.state) == discoveryStateClosed
+}
+
 // refreshServices iterators over all watchers, reads the services for each, and dispatches
 // to listeners.  This method is appropriate after a reconnect and when polling.  This method
 // does not set or refresh a watch.
 func (this *curatorDiscovery) refreshServices() {
-	this.logger.Printf("Recovering from zookeeper connection disruption")
-	for _, serviceWatcher := range this.serviceWatcherSet.byName {
-		instances, err := serviceWatcher.readServices()
-		if err != nil {
-			this.logger.Printf("Error while attempting to read [%s] service instances after connection disruption: %v", serviceWatcher.serviceName, err)
-		} else {
-			serviceWatcher.dispatch(instances)
-		}
+	this.logger.Info("Recovering from zookeeper connection disruption")
+	for _, serviceWatcher := range this.serviceWatcherSet.pathWatchers() {
+		this.refreshService(serviceWatcher)
+	}
+}
+
+// refreshService reads the services for a single watcher and dispatches them, as refreshServices does
+func (this *curatorDiscovery) refreshService(serviceWatcher *serviceWatcher) {
+	if serviceWatcher.isInitializationPending() {
+		return
+	} else if serviceWatcher.isAwaitingCreation() {
+		serviceWatcher.recheckCreation()
+		return
+	}
+
+	instances, err := serviceWatcher.readServices(serviceWatcher.context)
+	if err != nil {
+		this.logger.Error("Error while attempting to read [%s] service instances after connection disruption: %v", serviceWatcher.serviceName, err)
+		serviceWatcher.rewatch()
+	} else {
+		serviceWatcher.dispatch(instances)
+	}
+}
+
+// recoverServices refreshes every watcher once a zookeeper session has been re-established.  With
+// a reconnectJitter, each watcher is refreshed in the background after its own random delay, so
+// that many clients recovering at once do not all read from zookeeper at the same instant.  Since
+// this only happens after a disruption, the initial reads made by Run are never delayed.
+func (this *curatorDiscovery) recoverServices() {
+	if this.reconnectJitter <= 0 {
+		this.refreshServices()
+		return
+	}
+
+	serviceWatchers := this.serviceWatcherSet.pathWatchers()
+	this.logger.Info("Recovering from zookeeper connection disruption within %s", this.reconnectJitter)
+	for index, delay := range jitterDelays(len(serviceWatchers), this.reconnectJitter, this.random) {
+		this.refreshServiceAfter(serviceWatchers[index], delay)
+	}
+}
+
+// refreshServiceAfter calls refreshService in the background after the given delay.  If a refresh
+// of the watcher is already waiting, this method does nothing.
+func (this *curatorDiscovery) refreshServiceAfter(serviceWatcher *serviceWatcher, delay time.Duration) {
+	if !atomic.CompareAndSwapUint32(&serviceWatcher.refreshPending, 0, 1) {
+		return
 	}
+
+	go func() {
+		defer atomic.StoreUint32(&serviceWatcher.refreshPending, 0)
+		timer := time.NewTimer(delay)
+		select {
+		case <-serviceWatcher.context.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		this.refreshService(serviceWatcher)
+	}()
 }
 
 // updateServices dispatches an update event for services on a given path, if and only
-// if the path is recognized.
+// if the path is recognized
 func (this *curatorDiscovery) updateServices(path string) {
 	if serviceWatcher, ok := this.serviceWatcherSet.findByPath(path); ok {
-		instances, err := serviceWatcher.readServicesAndWatch()
-		if err != nil {
-			this.logger.Printf("Error while updating services: %v", err)
-		} else {
-			serviceWatcher.dispatch(instances)
-		}
+		serviceWatcher.childrenChanged()
+	}
+}
+
+// serviceCreated handles the creation of a service path which a watcher may be waiting for,
+// if and only if the path is recognized
+func (this *curatorDiscovery) serviceCreated(path string) {
+	if serviceWatcher, ok := this.serviceWatcherSet.findByPath(path); ok {
+		serviceWatcher.pathCreated()
+	}
+}
+
+// updateInstance handles a data watch event for a single service instance, if and only if
+// the instance's parent path is recognized
+func (this *curatorDiscovery) updateInstance(instancePath string, deleted bool) {
+	separator := strings.LastIndex(instancePath, "/")
+	if separator < 0 {
+		return
 	}
+
+	if serviceWatcher, ok := this.serviceWatcherSet.findByPath(instancePath[:separator]); ok && serviceWatcher.watchData {
+		serviceWatcher.instanceChanged(instancePath[separator+1:], deleted)
+	}
+}
+
+// connectionState returns the most recent curator connection state
+func (this *curatorDiscovery) connectionState() curator.ConnectionState {
+	return this.connectionStateMonitor.currentState()
 }
 
 func (this *curatorDiscovery) Connected() bool {
@@ -132,22 +536,174 @@ func (this *curatorDiscovery) ServiceNames() []string {
 	return this.serviceWatcherSet.cloneServiceNames()
 }
 
+func (this *curatorDiscovery) IsWatching(serviceName string) bool {
+	return this.serviceWatcherSet.isWatching(serviceName)
+}
+
+func (this *curatorDiscovery) AddWatchedServicesListener(listener WatchedServicesListener) Registration {
+	return this.serviceWatcherSet.watchedServices.addListener(listener)
+}
+
+func (this *curatorDiscovery) AddAggregateListener(listener AggregateListener) Registration {
+	return this.serviceWatcherSet.aggregates.addListener(listener)
+}
+
 func (this *curatorDiscovery) FetchServices(serviceName string) (Instances, error) {
-	if this.running() {
-		if serviceWatcher, ok := this.serviceWatcherSet.findByName(serviceName); ok {
-			return serviceWatcher.readServices()
+	instances, _, err := this.FetchRevision(serviceName)
+	return instances, err
+}
+
+func (this *curatorDiscovery) FetchRevision(serviceName string) (Instances, uint64, error) {
+	if this.closed() {
+		return nil, 0, ErrorClosed
+	} else if !this.running() && !this.warmStarted {
+		if atomic.LoadUint32(&this.starting) != 0 {
+			return nil, 0, ErrorServiceNotReady
 		}
-	} else {
-		return nil, ErrorNotRunning
+
+		return nil, 0, ErrorNotRunning
 	}
 
-	return nil, errors.New(fmt.Sprintf("No such service: %s", serviceName))
+	serviceWatcher, ok := this.serviceWatcherSet.findByName(serviceName)
+	if !ok {
+		return nil, 0, ErrorNoSuchService
+	}
+
+	instances, revision, ok := serviceWatcher.cachedRevision()
+	if !ok {
+		return nil, 0, ErrorServiceNotReady
+	}
+
+	return instances.clone(), revision, nil
+}
+
+func (this *curatorDiscovery) PinInstances(serviceName string, pinned Instances) error {
+	if this.closed() {
+		return ErrorClosed
+	}
+
+	serviceWatcher, ok := this.serviceWatcherSet.findByName(serviceName)
+	if !ok {
+		return ErrorNoSuchService
+	}
+
+	serviceWatcher.pin(pinned.clone())
+	return nil
+}
+
+func (this *curatorDiscovery) Unpin(serviceName string) {
+	if serviceWatcher, ok := this.serviceWatcherSet.findByName(serviceName); ok {
+		serviceWatcher.unpin()
+	}
+}
+
+func (this *curatorDiscovery) SnapshotTo(writer io.Writer) error {
+	return this.serviceWatcherSet.writeSnapshot(writer)
+}
+
+func (this *curatorDiscovery) InstanceBasePath(serviceInstance *discovery.ServiceInstance) (string, bool) {
+	if serviceInstance == nil {
+		return "", false
+	}
+
+	if serviceWatcher, ok := this.serviceWatcherSet.findByName(serviceInstance.Name); ok {
+		return serviceWatcher.instanceBasePath(serviceInstance.Id)
+	}
+
+	return "", false
+}
+
+func (this *curatorDiscovery) WaitForInitialSnapshot(serviceName string, timeout time.Duration) (Instances, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	instances, err := this.WaitForInitialSnapshotContext(ctx, serviceName)
+	if err == context.DeadlineExceeded {
+		err = ErrorInitialSnapshotTimeout
+	}
+
+	return instances, err
+}
+
+func (this *curatorDiscovery) WaitForInitialSnapshotContext(ctx context.Context, serviceName string) (Instances, error) {
+	if this.closed() {
+		return nil, ErrorClosed
+	}
+
+	serviceWatcher, ok := this.serviceWatcherSet.findByName(serviceName)
+	if !ok {
+		return nil, ErrorNoSuchService
+	}
+
+	instances, err := serviceWatcher.waitForInitialized(ctx)
+	if err == ErrorNoSuchService && this.closed() {
+		return nil, ErrorClosed
+	} else if err != nil {
+		return nil, err
+	}
+
+	return instances.clone(), nil
+}
+
+func (this *curatorDiscovery) SkippedInstances(serviceName string) (int, error) {
+	if serviceWatcher, ok := this.serviceWatcherSet.findByName(serviceName); ok {
+		return serviceWatcher.skippedInstances(), nil
+	}
+
+	return 0, ErrorNoSuchService
+}
+
+func (this *curatorDiscovery) History(serviceName string) []EventRecord {
+	if serviceWatcher, ok := this.serviceWatcherSet.findByName(serviceName); ok {
+		return serviceWatcher.history.snapshot()
+	}
+
+	return nil
+}
+
+func (this *curatorDiscovery) Metrics(serviceName string) (Metrics, error) {
+	if serviceWatcher, ok := this.serviceWatcherSet.findByName(serviceName); ok {
+		return serviceWatcher.metricsSnapshot(), nil
+	}
+
+	return Metrics{}, ErrorNoSuchService
+}
+
+func (this *curatorDiscovery) AggregateMetrics() Metrics {
+	var aggregate Metrics
+	for _, serviceWatcher := range this.serviceWatcherSet.watchers() {
+		aggregate.add(serviceWatcher.metricsSnapshot())
+	}
+
+	if this.readRateLimiter != nil {
+		aggregate.ThrottledTime = this.readRateLimiter.throttledTime()
+	}
+
+	return aggregate
+}
+
+func (this *curatorDiscovery) AddListener(serviceName string, listener Listener) (Registration, error) {
+	return this.AddGroupListener(DefaultListenerGroup, serviceName, listener)
 }
 
-func (this *curatorDiscovery) AddListener(serviceName string, listener Listener) {
+func (this *curatorDiscovery) Subscribe(serviceName string) (*Subscription, error) {
+	return NewSubscription(this, serviceName)
+}
+
+func (this *curatorDiscovery) AddOnceListener(serviceName string, listener Listener) (Registration, error) {
+	if this.closed() {
+		return nil, ErrorClosed
+	}
+
 	if serviceWatcher, ok := this.serviceWatcherSet.findByName(serviceName); ok {
-		serviceWatcher.addListener(listener)
+		return serviceWatcher.addOnceListener(DefaultListenerGroup, listener)
 	}
+
+	return nil, ErrorNoSuchService
+}
+
+func (this *curatorDiscovery) AddListenerForServices(pattern string, listener Listener) (Registration, error) {
+	return this.AddGroupListenerForServices(DefaultListenerGroup, pattern, listener)
 }
 
 func (this *curatorDiscovery) RemoveListener(serviceName string, listener Listener) {
@@ -156,6 +712,104 @@ func (this *curatorDiscovery) RemoveListener(serviceName string, listener Listen
 	}
 }
 
+func (this *curatorDiscovery) RemoveAllListeners(serviceName string) int {
+	if serviceWatcher, ok := this.serviceWatcherSet.findByName(serviceName); ok {
+		return serviceWatcher.removeAllListeners()
+	}
+
+	return 0
+}
+
+func (this *curatorDiscovery) ListenerCount(serviceName string) int {
+	if serviceWatcher, ok := this.serviceWatcherSet.findByName(serviceName); ok {
+		return serviceWatcher.listenerCount()
+	}
+
+	return 0
+}
+
+func (this *curatorDiscovery) AddGroupListener(group, serviceName string, listener Listener) (Registration, error) {
+	if this.closed() {
+		return nil, ErrorClosed
+	}
+
+	if serviceWatcher, ok := this.serviceWatcherSet.findByName(serviceName); ok {
+		return serviceWatcher.addGroupListener(group, listener)
+	}
+
+	return nil, ErrorNoSuchService
+}
+
+func (this *curatorDiscovery) AddGroupListenerForServices(group, pattern string, listener Listener) (Registration, error) {
+	if this.closed() {
+		return nil, ErrorClosed
+	}
+
+	return this.serviceWatcherSet.addPatternListener(group, pattern, listener)
+}
+
+func (this *curatorDiscovery) RemoveGroupListeners(group, serviceName string) int {
+	if serviceWatcher, ok := this.serviceWatcherSet.findByName(serviceName); ok {
+		return serviceWatcher.removeGroupListeners(group)
+	}
+
+	return 0
+}
+
+func (this *curatorDiscovery) CloseGroup(group string) {
+	this.serviceWatcherSet.closeGroup(group)
+}
+
+func (this *curatorDiscovery) AddService(serviceName string) error {
+	if this.closed() {
+		return ErrorClosed
+	}
+
+	serviceWatcher, added, err := this.serviceWatcherSet.add(serviceName)
+	if err != nil || !added {
+		return err
+	}
+
+	this.logger.Info("Watching service: %s", serviceName)
+	if this.running() {
+		if err := this.serviceWatcherSet.initializeWatcher(serviceWatcher, this.zookeeperClient); err != nil {
+			this.serviceWatcherSet.remove(serviceName)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (this *curatorDiscovery) RemoveService(serviceName string) error {
+	if _, ok := this.serviceWatcherSet.remove(serviceName); !ok {
+		return ErrorNoSuchService
+	}
+
+	this.logger.Info("No longer watching service: %s", serviceName)
+	return nil
+}
+
+func (this *curatorDiscovery) StatusHandler() http.Handler {
+	return NewStatusHandler(this.status)
+}
+
+func (this *curatorDiscovery) AddConnectionStateListener(listener ConnectionStateListener) Registration {
+	return this.connectionStateMonitor.addListener(listener)
+}
+
+func (this *curatorDiscovery) SessionTimeout() time.Duration {
+	return this.negotiatedSessionTimeout.get()
+}
+
+func (this *curatorDiscovery) CuratorConnection() discovery.Conn {
+	if this.running() {
+		return this.curatorConnection
+	}
+
+	return nil
+}
+
 func (this *curatorDiscovery) BlockUntilConnected() error {
 	if this.running() {
 		return this.curatorConnection.BlockUntilConnected()
@@ -172,17 +826,61 @@ func (this *curatorDiscovery) BlockUntilConnectedTimeout(maxWaitTime time.Durati
 	return ErrorNotRunning
 }
 
-// maintainRegistrations sets up any configured registrations with the underlying fsgo infrastructure.
-// This method does nothing if no registrations are configured.
+func (this *curatorDiscovery) Registrations() Instances {
+	if this.registrationManager != nil {
+		return this.registrationManager.registrations()
+	}
+
+	return Instances{}
+}
+
+func (this *curatorDiscovery) Deregister() error {
+	if this.registrationManager != nil {
+		this.logger.Info("Deregistering: %s", this.registrationManager.registrations())
+		return this.registrationManager.deregisterAll()
+	}
+
+	return nil
+}
+
+func (this *curatorDiscovery) Register(instances Instances) (Instances, error) {
+	if this.readOnly {
+		return nil, ErrorReadOnly
+	} else if !this.running() {
+		return nil, ErrorNotRunning
+	}
+
+	this.logger.Info("Registering: %s", instances)
+	return this.registrationManager.add(instances)
+}
+
+func (this *curatorDiscovery) DeregisterInstances(instances Instances) error {
+	if this.readOnly {
+		return ErrorReadOnly
+	} else if this.registrationManager != nil {
+		this.logger.Info("Deregistering: %s", instances)
+		return this.registrationManager.deregisterEach(instances)
+	}
+
+	return nil
+}
+
+// maintainRegistrations sets up the registrationManager, which registers any configured registrations
+// along with those made later via Register.  The registrations are restored by the registrationManager
+// whenever the zookeeper session expires.
 func (this *curatorDiscovery) maintainRegistrations() error {
-	if len(this.registrations) > 0 {
-		this.logger.Printf("Maintaining registrations: %s", this.registrations)
-		this.serviceDiscovery = discovery.NewServiceDiscovery(this.curatorConnection, this.basePath)
-		if err := this.serviceDiscovery.MaintainRegistrations(); err != nil {
-			return err
-		}
+	registrar := NewRegistrar(this.curatorConnection, this.basePath, this.instanceSerializer)
+	if this.readOnly {
+		registrar = NewReadOnlyRegistrar()
+	} else if this.registrationValidator != nil {
+		registrar = NewValidatingRegistrar(registrar, this.registrationValidator)
+	}
 
-		if err := this.registrations.RegisterWith(this.serviceDiscovery); err != nil {
+	this.registrationManager = newRegistrationManager(this.logger, registrar)
+	addConnectionStateListener(this.curatorConnection.ConnectionStateListenable(), this.registrationManager)
+	if len(this.registrations) > 0 {
+		this.logger.Info("Maintaining registrations: %s", this.registrations)
+		if err := this.registrationManager.register(this.registrations); err != nil {
 			return err
 		}
 	}
@@ -193,8 +891,8 @@ func (this *curatorDiscovery) maintainRegistrations() error {
 // initializeWatchers starts up any service watchers contained by this discovery instance
 func (this *curatorDiscovery) initializeWatchers() error {
 	if this.serviceWatcherSet.serviceCount() > 0 {
-		this.logger.Printf("Watching services: %v", this.serviceWatcherSet.serviceNames)
-		if err := this.serviceWatcherSet.initialize(this.curatorConnection); err != nil {
+		this.logger.Info("Watching services: %v", this.serviceWatcherSet.cloneServiceNames())
+		if err := this.serviceWatcherSet.initialize(this.zookeeperClient); err != nil {
 			return err
 		}
 	}
@@ -202,19 +900,38 @@ func (this *curatorDiscovery) initializeWatchers() error {
 	return nil
 }
 
+// initializeAddedWatchers initializes any service added by AddService after initializeWatchers
+// read the set of watchers, but before this discovery was running.  Such a service cannot be
+// reported to the caller of AddService, so a failure is logged and the service is removed.
+func (this *curatorDiscovery) initializeAddedWatchers() {
+	for _, serviceWatcher := range this.serviceWatcherSet.watchers() {
+		if err := this.serviceWatcherSet.initializeWatcher(serviceWatcher, this.zookeeperClient); err != nil {
+			this.logger.Error("Unable to initialize service %s added during startup: %s", serviceWatcher.serviceName, err)
+			this.serviceWatcherSet.remove(serviceWatcher.serviceName)
+		}
+	}
+}
+
 // monitor is a goroutine that monitors curator until the shutdown channel has any activity
 func (this *curatorDiscovery) monitor(waitGroup *sync.WaitGroup, shutdown <-chan struct{}) {
-	this.logger.Printf("monitor()")
+	this.logger.Debug("monitor()")
 	defer waitGroup.Done()
 
 	defer func() {
-		this.logger.Printf("Discovery client shutting down")
-		atomic.StoreUint32(&this.state, discoveryStateStopped)
+		this.logger.Info("Discovery client shutting down")
+		atomic.CompareAndSwapUint32(&this.state, discoveryStateRunning, discoveryStateStopped)
 		this.curatorConnection.CuratorListenable().RemoveListener(this)
+		this.curatorConnection.ConnectionStateListenable().RemoveListener(this.connectionStateMonitor)
+		if this.registrationManager != nil {
+			this.curatorConnection.ConnectionStateListenable().RemoveListener(this.registrationManager)
+		}
 
 		close(this.curatorEvents)
-		if err := this.curatorConnection.Close(); err != nil {
-			this.logger.Printf("Error while closing Curator: %v", err)
+		this.serviceWatcherSet.stop()
+		if !this.ownsConnection {
+			return
+		} else if err := this.curatorConnection.Close(); err != nil {
+			this.logger.Error("Error while closing Curator: %v", err)
 		}
 	}()
 
@@ -223,18 +940,25 @@ func (this *curatorDiscovery) monitor(waitGroup *sync.WaitGroup, shutdown <-chan
 		case <-shutdown:
 			return
 
+		case <-this.closeSignal:
+			return
+
 		case curatorEvent := <-this.curatorEvents:
 			switch curatorEvent.Type() {
 			case curator.CLOSING:
-				this.logger.Printf("Curator closing.  Service Discovery shutting down.")
+				this.logger.Info("Curator closing.  Service Discovery shutting down.")
 				return
 			case curator.WATCHED:
 				if watchedEvent := curatorEvent.WatchedEvent(); watchedEvent == nil {
-					this.logger.Printf("Nil watched event from Curator")
+					this.logger.Error("Nil watched event from Curator")
 				} else if watchedEvent.Type == zk.EventSession && watchedEvent.State == zk.StateHasSession {
-					this.refreshServices()
+					this.recoverServices()
 				} else if watchedEvent.Type == zk.EventNodeChildrenChanged && len(watchedEvent.Path) > 0 {
 					this.updateServices(watchedEvent.Path)
+				} else if (watchedEvent.Type == zk.EventNodeDataChanged || watchedEvent.Type == zk.EventNodeDeleted) && len(watchedEvent.Path) > 0 {
+					this.updateInstance(watchedEvent.Path, watchedEvent.Type == zk.EventNodeDeleted)
+				} else if watchedEvent.Type == zk.EventNodeCreated && len(watchedEvent.Path) > 0 {
+					this.serviceCreated(watchedEvent.Path)
 				}
 			}
 		}
@@ -252,102 +976,934 @@ func (this *curatorDiscovery) pollWatches(waitGroup *sync.WaitGroup, shutdown <-
 		select {
 		case <-shutdown:
 			return
+		case <-this.closeSignal:
+			return
 		case <-ticker.C:
-			this.logger.Printf("Polling services ...")
-			this.refreshServices()
+			// services may be added at runtime, so only skip polling while nothing is watched
+			if this.serviceWatcherSet.serviceCount() > 0 {
+				this.logger.Debug("Polling services ...")
+				this.refreshServices()
+			}
 		}
 	}
 }
 
-func (this *curatorDiscovery) Run(waitGroup *sync.WaitGroup, shutdown <-chan struct{}) (err error) {
-	this.once.Do(func() {
-		this.logger.Printf("Discovery client starting")
-		this.curatorConnection, err = discovery.DefaultConn(this.connection)
-		if err != nil {
-			return
-		}
-
-		defer func() {
-			if err != nil {
-				this.curatorConnection.Close()
-			}
-		}()
+// resyncWatches periodically re-reads every watched service and re-sets its watch, so that
+// a missed watch event cannot leave the cached services stale indefinitely.  Each service
+// is resynced on its own goroutine, which ends when the service's watcher is stopped.
+func (this *curatorDiscovery) resyncWatches(waitGroup *sync.WaitGroup, shutdown <-chan struct{}) {
+	defer waitGroup.Done()
 
-		if err = this.curatorConnection.BlockUntilConnected(); err != nil {
-			return
-		}
+	ticker := time.NewTicker(this.resyncInterval)
+	defer ticker.Stop()
 
-		if err = this.maintainRegistrations(); err != nil {
+	for {
+		select {
+		case <-shutdown:
 			return
-		}
-
-		if err = this.initializeWatchers(); err != nil {
+		case <-this.closeSignal:
 			return
+		case <-ticker.C:
+			this.logger.Debug("Resyncing services ...")
+			for _, serviceWatcher := range this.serviceWatcherSet.pathWatchers() {
+				if !serviceWatcher.isInitializationPending() && !serviceWatcher.isAwaitingCreation() {
+					go serviceWatcher.resync()
+				}
+			}
 		}
+	}
+}
 
-		this.curatorEvents = make(chan curator.CuratorEvent, 10)
-		this.curatorConnection.CuratorListenable().AddListener(this)
-		atomic.StoreUint32(&this.state, discoveryStateRunning)
+// checkWatches periodically warns about any watched path which has been without a watch for
+// longer than the watchLossThreshold.  Paths which have yet to be read are skipped, since their
+// initialization is already being retried.
+func (this *curatorDiscovery) checkWatches(waitGroup *sync.WaitGroup, shutdown <-chan struct{}) {
+	defer waitGroup.Done()
 
-		waitGroup.Add(1)
-		go this.monitor(waitGroup, shutdown)
+	ticker := time.NewTicker(this.watchLossThreshold / 2)
+	defer ticker.Stop()
 
-		// if we have any watchers, start the polling goroutine
-		if this.serviceWatcherSet.serviceCount() > 0 {
-			waitGroup.Add(1)
-			go this.pollWatches(waitGroup, shutdown)
-		}
-	})
+	for {
+		select {
+		case <-shutdown:
+			return
+		case <-this.closeSignal:
+			return
+		case <-ticker.C:
+			for _, serviceWatcher := range this.serviceWatcherSet.pathWatchers() {
+				if !serviceWatcher.isInitializationPending() && !serviceWatcher.isAwaitingCreation() {
+					serviceWatcher.checkWatch(this.watchLossThreshold)
+				}
+			}
+		}
+	}
+}
+
+// startConnection creates and starts a new curator connection.  Connection state events
+// are observed from before the connection is started.
+func (this *curatorDiscovery) startConnection() error {
+	dialer := this.zookeeperDialer
+	if dialer == nil {
+		dialer = &curator.DefaultZookeeperDialer{Dialer: this.negotiatedSessionTimeout.dialer(net.DialTimeout)}
+	}
+
+	this.curatorConnection = newCuratorConnection(this.connection, this.connectTimeout, this.sessionTimeout, this.authInfos, this.acls, dialer)
+	this.curatorConnection.ConnectionStateListenable().AddListener(this.connectionStateMonitor)
+	if err := this.curatorConnection.Start(); err != nil {
+		this.curatorConnection.ConnectionStateListenable().RemoveListener(this.connectionStateMonitor)
+		return err
+	}
 
+	return nil
+}
+
+// closeConnection stops observing the current curator connection, and closes it if it is owned
+func (this *curatorDiscovery) closeConnection() {
+	this.curatorConnection.ConnectionStateListenable().RemoveListener(this.connectionStateMonitor)
+	if this.ownsConnection {
+		this.curatorConnection.Close()
+	}
+}
+
+// useConnection prepares a curator connection supplied to the DiscoveryBuilder, which may
+// already be started, connected, or shared with another Discovery.  The connection is only
+// started if necessary, and if it is already connected, that state is reported to connection
+// state listeners since curator will not report it again.  A ConnectDeadline bounds the wait
+// for the connection, but no new connections are attempted.
+func (this *curatorDiscovery) useConnection() (err error) {
+	addConnectionStateListener(this.curatorConnection.ConnectionStateListenable(), this.connectionStateMonitor)
+	defer func() {
+		if err != nil {
+			this.closeConnection()
+		}
+	}()
+
+	if !this.curatorConnection.Started() {
+		if err = this.curatorConnection.Start(); err != nil {
+			return
+		}
+	}
+
+	if this.connectDeadline > 0 {
+		if this.curatorConnection.BlockUntilConnectedTimeout(this.connectDeadline) != nil {
+			err = ErrorConnectDeadline
+			return
+		}
+	} else if err = this.curatorConnection.BlockUntilConnected(); err != nil {
+		return
+	}
+
+	this.connectionStateMonitor.seed(curator.CONNECTED)
 	return
 }
 
+// connect establishes the curator connection used by Run.  A connection supplied to the
+// DiscoveryBuilder is used as is, as described by useConnection.  Without a connectRetry policy, this
+// method waits for as long as curator takes to connect.  Otherwise, each attempt waits at most the
+// connect timeout, failed connections are replaced after an exponential backoff, and once the
+// connectDeadline passes ErrorConnectDeadline is returned.  If this method returns an error,
+// no connection is left open.
+func (this *curatorDiscovery) connect(shutdown <-chan struct{}) error {
+	if !this.ownsConnection {
+		return this.useConnection()
+	} else if err := this.startConnection(); err != nil {
+		return err
+	}
+
+	if this.connectRetry == nil {
+		if err := this.curatorConnection.BlockUntilConnected(); err != nil {
+			this.closeConnection()
+			return err
+		}
+
+		return nil
+	}
+
+	attemptTimeout := this.connectTimeout
+	if attemptTimeout <= 0 {
+		attemptTimeout = DefaultConnectTimeout
+	}
+
+	var deadline time.Time
+	if this.connectDeadline > 0 {
+		deadline = time.Now().Add(this.connectDeadline)
+	}
+
+	backoff := newBackoff(*this.connectRetry)
+	for {
+		timeout := attemptTimeout
+		if !deadline.IsZero() {
+			if remaining := time.Until(deadline); remaining < timeout {
+				timeout = remaining
+			}
+		}
+
+		err := this.curatorConnection.BlockUntilConnectedTimeout(timeout)
+		if err == nil {
+			return nil
+		}
+
+		this.closeConnection()
+		delay, _ := backoff.next()
+		expires := false
+		if !deadline.IsZero() {
+			if remaining := time.Until(deadline); remaining <= delay {
+				delay, expires = remaining, true
+			}
+		}
+
+		if expires {
+			this.logger.Error("Unable to connect to zookeeper [%s] before the deadline: %v", this.connection, err)
+		} else {
+			this.logger.Error("Unable to connect to zookeeper [%s], retrying in %s: %v", this.connection, delay, err)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+			if expires {
+				return ErrorConnectDeadline
+			}
+
+		case <-shutdown:
+			timer.Stop()
+			return ErrorConnectAbandoned
+
+		case <-this.closeSignal:
+			timer.Stop()
+			return ErrorClosed
+		}
+
+		if err = this.startConnection(); err != nil {
+			return err
+		}
+	}
+}
+
+func (this *curatorDiscovery) Run(waitGroup *sync.WaitGroup, shutdown <-chan struct{}) (err error) {
+	this.once.Do(func() {
+		if this.closed() {
+			err = ErrorClosed
+			return
+		}
+
+		this.logger.Info("Discovery client starting")
+		atomic.StoreUint32(&this.starting, 1)
+		defer atomic.StoreUint32(&this.starting, 0)
+		if err = this.connect(shutdown); err != nil {
+			return
+		}
+
+		this.zookeeperClient = &curatorClient{connection: this.curatorConnection, acls: this.acls, readOnly: this.readOnly}
+		if this.readRateLimiter != nil {
+			this.zookeeperClient = &rateLimitedClient{this.zookeeperClient, this.readRateLimiter}
+		}
+
+		defer func() {
+			if err != nil {
+				this.closeConnection()
+			}
+		}()
+
+		if err = this.maintainRegistrations(); err != nil {
+			return
+		}
+
+		if err = this.initializeWatchers(); err != nil {
+			return
+		}
+
+		this.curatorEvents = make(chan curator.CuratorEvent, 10)
+		this.curatorConnection.CuratorListenable().AddListener(this)
+		if !atomic.CompareAndSwapUint32(&this.state, discoveryStateNotStarted, discoveryStateRunning) {
+			// Close was called while starting up
+			this.curatorConnection.CuratorListenable().RemoveListener(this)
+			if this.registrationManager != nil {
+				this.curatorConnection.ConnectionStateListenable().RemoveListener(this.registrationManager)
+				this.registrationManager.deregisterAll()
+			}
+
+			this.serviceWatcherSet.stop()
+			err = ErrorClosed
+			return
+		}
+
+		// AddService only initializes the services it adds once this discovery is running
+		this.initializeAddedWatchers()
+
+		waitGroup.Add(2)
+		go this.monitor(waitGroup, shutdown)
+		go this.pollWatches(waitGroup, shutdown)
+		if this.resyncInterval > 0 {
+			waitGroup.Add(1)
+			go this.resyncWatches(waitGroup, shutdown)
+		}
+
+		if this.watchLossThreshold > 0 {
+			waitGroup.Add(1)
+			go this.checkWatches(waitGroup, shutdown)
+		}
+	})
+
+	if err == nil && this.closed() {
+		err = ErrorClosed
+	}
+
+	return
+}
+
+func (this *curatorDiscovery) Close() error {
+	this.closeOnce.Do(func() {
+		this.logger.Info("Discovery client closing")
+		wasRunning := atomic.SwapUint32(&this.state, discoveryStateClosed) == discoveryStateRunning
+
+		// deregister while the curator connection is still open
+		if wasRunning {
+			this.closeError = this.Deregister()
+		} else {
+			this.serviceWatcherSet.stop()
+		}
+
+		// abandon any reads in progress, including those made from within listeners
+		this.cancel()
+		close(this.closeSignal)
+		if len(this.expvarName) > 0 {
+			defaultExpvarRegistry.unpublish(this.expvarName, this)
+		}
+	})
+
+	return this.closeError
+}
+
 // DiscoveryBuilder provides a configurable DiscoveryFactory implementation.  This type
 // also implements a standard JSON configuration.
 type DiscoveryBuilder struct {
 	// Connection is the Curator connection string.  It's a comma-delimited
-	// list of zookeeper server nodes
+	// list of zookeeper server nodes, and is required unless a CuratorConnection is supplied
 	Connection string `json:"connection"`
 
+	// ConnectTimeout is how long to wait for a connection to the zookeeper ensemble before the
+	// attempt is abandoned and retried.  If this value is not supplied, DefaultConnectTimeout is used.
+	ConnectTimeout string `json:"connectTimeout"`
+
+	// SessionTimeout is the zookeeper session timeout requested by each connection.  The ensemble
+	// bounds the timeout it grants, by default to between 2 and 20 times its tickTime, so the
+	// Discovery's SessionTimeout method reports the value actually negotiated.  If this value is
+	// not supplied, DefaultSessionTimeout is used.
+	SessionTimeout string `json:"sessionTimeout"`
+
+	// ConnectRetryInitialDelay, if supplied, makes Run abandon each connection attempt after the
+	// ConnectTimeout and retry with a new connection, waiting this long before the first retry.
+	// The delay doubles after each failed attempt, up to the ConnectRetryMaxDelay.  If neither this
+	// value nor the ConnectDeadline is supplied, Run waits for curator to connect indefinitely.
+	ConnectRetryInitialDelay string `json:"connectRetryInitialDelay"`
+
+	// ConnectRetryMaxDelay is the upper bound on the delay between connection attempts.  If this
+	// value is not supplied, DefaultConnectRetryMaxDelay is used instead.
+	ConnectRetryMaxDelay string `json:"connectRetryMaxDelay"`
+
+	// ConnectDeadline, if supplied, is the overall time allowed for connecting to zookeeper, across
+	// all attempts.  If no connection is established in time, Run returns ErrorConnectDeadline.
+	// Supplying only this value retries connections with DefaultConnectRetryInitialDelay.
+	ConnectDeadline string `json:"connectDeadline"`
+
+	// CuratorConnection, if supplied, is an externally managed connection that Discovery instances
+	// produced by this builder use in place of one made from the Connection, so that an application
+	// can share a single zookeeper session.  The connection is started by Run if it has not been
+	// already, but the caller retains ownership: it is never closed by a Discovery, and must outlive
+	// every Discovery that uses it.  The Connection, ConnectTimeout, SessionTimeout,
+	// ConnectRetryInitialDelay, ConnectRetryMaxDelay, and authentication of this builder do not
+	// apply to it.
+	CuratorConnection discovery.Conn `json:"-"`
+
 	// BasePath is the parent znode path for all registrations and watches
 	// for Discovery instances produced by this builder
 	BasePath string `json:"basePath"`
 
+	// WatchBasePaths, if supplied, are the parent znode paths beneath which watched services are
+	// read, in place of the BasePath.  The instances of each watched service are merged across all
+	// of these paths, in order, so that listeners see a single combined Instances.  This allows, for
+	// example, one Discovery to watch a service registered in several datacenters.  Registrations
+	// are always made beneath the BasePath.
+	WatchBasePaths []string `json:"watchBasePaths"`
+
+	// AuthScheme is the zookeeper authentication scheme, e.g. "digest", used to authenticate each
+	// connection to zookeeper before any other operation.  It must be supplied with AuthCredentials.
+	AuthScheme string `json:"authScheme"`
+
+	// AuthCredentials are the credentials for the AuthScheme, e.g. "user:password" for "digest"
+	AuthCredentials string `json:"authCredentials"`
+
+	// ACLs are applied to each znode created by a Discovery, including service paths, their parents,
+	// and registrations.  With digest authentication, a single ACL with the "auth" scheme restricts
+	// these znodes to the authenticated user.  If this value is not supplied, created znodes are
+	// open to everyone.
+	ACLs []ACL `json:"acls"`
+
 	// Registrations holds any service instances that are maintained in zookeeper
 	// under the BasePath.
 	Registrations Instances `json:"registrations"`
 
+	// ReadOnly, if true, guarantees that Discovery instances produced by this builder never create,
+	// modify, or delete a znode.  Register and DeregisterInstances return ErrorReadOnly, and the
+	// ServicePathMode defaults to ServicePathRequire, since ServicePathCreate is not allowed.  Nor are
+	// any Registrations.  Writes made directly through the CuratorConnection are not prevented.
+	ReadOnly bool `json:"readOnly"`
+
 	// Watches contains the names of services, registered under the BasePath,
 	// to listen for changes
 	Watches []string `json:"watches"`
 
+	// WatchPaths, if supplied, maps the names of further services to watch to the full znode path
+	// of each, e.g. {"foo": "/discovery/v2/foo"}, for services which are not registered beneath the
+	// BasePath or WatchBasePaths.  A service named here is watched only at its configured path, even
+	// if it is also among the Watches.  New rejects two services that would be watched at the same
+	// path with a ServicePathCollisionError.
+	WatchPaths map[string]string `json:"watchPaths"`
+
 	// WatchPollInterval is the polling interval for any watched services.
 	// Polling is used in addition to setting watches if this value is set.
 	// If this value is not supplied, DefaultWatchPollInterval is used instead.
 	//
-	// This value is ignored if there are no Watches set.
+	// Polling only occurs while at least one service is watched.
 	WatchPollInterval string `json:"watchPollInterval"`
+
+	// ResyncInterval is the interval at which every watched service is re-read and its watch
+	// re-set, independently of polling.  Listeners are only notified if the services have changed.
+	// Since zookeeper watches are one-shot, this guards against watch events that are missed,
+	// e.g. across session expirations.  If this value is not supplied, no resync is done.
+	ResyncInterval string `json:"resyncInterval"`
+
+	// ReconnectJitter is the upper bound of a random delay before each watched service is re-read
+	// once a disrupted zookeeper session is re-established.  The services of one Discovery are
+	// staggered across this interval, which keeps a large number of clients from re-reading every
+	// service at the instant an ensemble recovers.  The initial reads made by Run are not delayed.
+	// If this value is not supplied, services are re-read immediately after reconnecting.
+	ReconnectJitter string `json:"reconnectJitter"`
+
+	// WatchLossThreshold is how long a watched service may be without a zookeeper watch before a
+	// warning is logged.  A watch is absent between firing and being set again, so it is normally
+	// only absent briefly, but a watch which cannot be set leaves the cached services silently stale.
+	// Warnings escalate to errors each time the time without a watch doubles.  The watch generation
+	// and the time of the last watch are always reported by Metrics and the StatusHandler.  If this
+	// value is not supplied, no warnings are logged.
+	WatchLossThreshold string `json:"watchLossThreshold"`
+
+	// WatchRetryInitialDelay is the delay before the first attempt to re-establish a watch that
+	// could not be set, e.g. during a zookeeper leader election.  Subsequent attempts back off
+	// exponentially.  If this value is not supplied, DefaultWatchRetryInitialDelay is used instead.
+	WatchRetryInitialDelay string `json:"watchRetryInitialDelay"`
+
+	// WatchRetryMaxDelay is the maximum delay between attempts to re-establish a watch.
+	// If this value is not supplied, DefaultWatchRetryMaxDelay is used instead.
+	WatchRetryMaxDelay string `json:"watchRetryMaxDelay"`
+
+	// WatchRetryMaxAttempts is the maximum number of attempts to re-establish a watch.  If this
+	// value is not supplied, attempts continue until the watch is set or the Discovery shuts down.
+	WatchRetryMaxAttempts int `json:"watchRetryMaxAttempts"`
+
+	// WatchDebounceWindow is the time to wait after a watched service changes before reading and
+	// dispatching its services.  Any further changes within the window are coalesced into a single
+	// read, which reduces load on zookeeper when many instances change at once, e.g. during a rolling
+	// restart.  If this value is not supplied, every change is read and dispatched immediately.
+	WatchDebounceWindow string `json:"watchDebounceWindow"`
+
+	// AggregateWindow is the time to wait after any watched service changes before delivering the
+	// snapshots of every service to each AggregateListener.  Changes to other services within the
+	// window are included in the same delivery, so that a deploy touching many services doesn't
+	// rebuild the aggregate view once per service.  If this value is not supplied, the
+	// DefaultAggregateWindow is used, while a window of "0" delivers as soon as possible.
+	AggregateWindow string `json:"aggregateWindow"`
+
+	// DispatchUnchanged, when true, causes every snapshot read from zookeeper to be dispatched to
+	// listeners.  By default, a snapshot whose membership is the same as the previous snapshot is
+	// not dispatched, since zookeeper watches can fire for events that don't change membership.
+	DispatchUnchanged bool `json:"dispatchUnchanged"`
+
+	// SuppressEquivalent, when true, treats a snapshot as unchanged if its instances are equivalent
+	// to those of the previous snapshot, as determined by Instances.EquivalentTo, rather than if they
+	// have the same Ids.  An endpoint registered again with a new Id, but with the same address, ports,
+	// and payload, then causes no dispatch, which spares listeners such as connection pools from churn.
+	// This has no effect if DispatchUnchanged is true.
+	SuppressEquivalent bool `json:"suppressEquivalent"`
+
+	// FetchConcurrency is the maximum number of child znodes read concurrently when fetching
+	// the instances of a watched service.  If this value is not supplied, DefaultFetchConcurrency
+	// is used instead.
+	FetchConcurrency int `json:"fetchConcurrency"`
+
+	// FetchTimeout is how long the data of a single child znode may take to read, e.g. during a
+	// zookeeper disk stall.  A child which takes longer is skipped, like a child whose data cannot be
+	// read, so that it does not hold up the rest of the service.  Each such child is counted in
+	// Metrics.FetchTimeouts and reported to the InstanceError function with ErrorFetchTimeout.  If
+	// this value is not supplied, DefaultFetchTimeout is used instead.  Zero disables the timeout.
+	FetchTimeout string `json:"fetchTimeout"`
+
+	// LogSampleSize is the maximum number of child znode ids included in the summary logged, at
+	// the info level, each time a watched service is read.  The complete list of ids, along with a
+	// message for each child znode, is only logged at the debug level, while a child which cannot be
+	// read or deserialized is always logged individually.  If this value is not supplied,
+	// DefaultLogSampleSize is used instead.
+	LogSampleSize int `json:"logSampleSize"`
+
+	// EventHistorySize is the number of the most recent events dispatched for each watched service
+	// which are kept for Discovery.History and the StatusHandler, e.g. to analyze what was seen
+	// during an incident.  Each event is recorded by instance id, and at most MaxEventRecordKeys ids
+	// are kept for the instances it added or removed, so the history of a service takes bounded memory.
+	// If this value is not supplied, no history is kept.
+	EventHistorySize int `json:"eventHistorySize"`
+
+	// ReadBatchSize, when greater than one, is the maximum number of child znodes whose data is read
+	// in a single zookeeper round trip, for clients which support multi-reads.  If a batch cannot be
+	// read, its children are read one at a time, so a child which cannot be read is still skipped on
+	// its own.  Batches are not used with WatchInstanceData, or when the client does not support them.
+	// If this value is not supplied, each child znode is read with its own round trip.
+	ReadBatchSize int `json:"readBatchSize"`
+
+	// ReadRateLimit is the maximum number of zookeeper operations per second performed on behalf
+	// of all watched services, including each read of a child znode.  Watch events that arrive
+	// while reads are throttled are coalesced, so a flapping service cannot queue unbounded reads.
+	// The time spent throttled is reported by AggregateMetrics.  If this value is not supplied,
+	// reads are not rate limited.
+	ReadRateLimit float64 `json:"readRateLimit"`
+
+	// ReadRateBurst is the number of operations that may exceed the ReadRateLimit in a burst.
+	// If this value is not supplied, it defaults to one second's worth of operations.
+	ReadRateBurst int `json:"readRateBurst"`
+
+	// AsyncDispatch, when true, causes each listener to receive events on its own goroutine
+	// through a bounded queue.  A slow listener will then not delay delivery to other listeners.
+	// By default, listeners are invoked synchronously.
+	AsyncDispatch bool `json:"asyncDispatch"`
+
+	// DispatchQueueSize is the maximum number of events queued for each listener when AsyncDispatch
+	// is set.  If this value is not supplied, DefaultDispatchQueueSize is used instead.
+	DispatchQueueSize int `json:"dispatchQueueSize"`
+
+	// DispatchQueueFull is the policy applied when a listener's queue is full, either
+	// DispatchQueueFullBlock or DispatchQueueFullDropOldest.  If this value is not supplied,
+	// DispatchQueueFullBlock is used.
+	//
+	// This value is ignored if AsyncDispatch is not set.
+	DispatchQueueFull string `json:"dispatchQueueFull"`
+
+	// DispatchExecutor, if supplied, runs the delivery of events to listeners, e.g. on a shared
+	// WorkerPoolExecutor or on an application's own event loop.  Each listener is given its own
+	// serial Executor over this one, as with NewSerialExecutor, so that every listener still
+	// receives events one at a time and in order.  This value cannot be combined with AsyncDispatch.
+	// If this value is not supplied, listeners are invoked as with SynchronousExecutor.
+	DispatchExecutor Executor `json:"-"`
+
+	// DuplicateListener is the policy applied when a listener is added which is already registered
+	// for the same service, or pattern, in the same group, either DuplicateListenerIgnore or
+	// DuplicateListenerError.  If this value is not supplied, DuplicateListenerIgnore is used, so
+	// that an accidental second registration does not deliver every event twice.
+	//
+	// Listeners are identical when they are ==.  A listener whose dynamic type is not comparable,
+	// such as a ListenerFunc, can never be detected as a duplicate, so each of its registrations is
+	// distinct and is identified only by the Registration returned for it.  Register a pointer to
+	// such a listener, e.g. a *ListenerFunc, for duplicates to be detected.
+	DuplicateListener string `json:"duplicateListener"`
+
+	// ListenerTimeout is how long a listener may take to handle an event before it is reported as
+	// slow.  Each slow invocation is logged, identifying the service and the listener, and is counted
+	// in Metrics.SlowListeners.  Listeners are never interrupted, so with synchronous dispatch a slow
+	// listener still delays every other listener.  With AsyncDispatch, an event for a listener whose
+	// queue has been full for the whole timeout replaces that listener's oldest queued event rather
+	// than blocking delivery to other listeners.  If this value is not supplied, listeners are not timed.
+	ListenerTimeout string `json:"listenerTimeout"`
+
+	// ServicePathMode determines what happens when the znode of a watched service does not exist:
+	// ServicePathCreate creates it, ServicePathRequire fails initialization, and ServicePathWaitForCreation
+	// waits for it to be created before watching the service.  If this value is not supplied,
+	// ServicePathCreate is used.
+	ServicePathMode string `json:"servicePathMode"`
+
+	// ServicePathModes overrides the ServicePathMode for individual services, by service name
+	ServicePathModes map[string]string `json:"servicePathModes"`
+
+	// LenientInitialization, when true, allows Run to succeed even if some watched services cannot
+	// be read, e.g. because a service path is missing or broken.  Each failure is logged, and the
+	// service is retried in the background using the WatchRetry backoff, while every other service is
+	// watched normally.  Services which are still being retried are reported by Metrics.PendingInitializations.
+	// The same applies to services added by AddService.  By default, any such failure causes Run or
+	// AddService to fail.
+	LenientInitialization bool `json:"lenientInitialization"`
+
+	// StaleInstanceThreshold is the age, measured from each instance's registration time, beyond which
+	// an instance is considered stale.  Stale instances may be zombies left by crashed processes whose
+	// sessions were never cleaned up.  They are reported in InstanceEvent.Stale and counted in
+	// Metrics.StaleInstances, but are otherwise treated like any other instance.  If this value is not
+	// supplied, instances are never considered stale.
+	StaleInstanceThreshold string `json:"staleInstanceThreshold"`
+
+	// InstanceSerializer is used both to read watched instances and to write registrations.
+	// If this value is not supplied, a discovery.JsonInstanceSerializer is used.
+	InstanceSerializer discovery.InstanceSerializer `json:"-"`
+
+	// RegistrationValidator, if supplied, checks each of the Registrations before it is written to
+	// zookeeper, both when first registered and when restored after a session expires.  A failed
+	// check fails Run with the validator's error.  See RequirePayloadKeys for an example.
+	RegistrationValidator RegistrationValidator `json:"-"`
+
+	// InstanceError, if supplied, is invoked for each watched child znode that is skipped
+	// because its data could not be read or deserialized
+	InstanceError InstanceErrorFunc `json:"-"`
+
+	// WatchInstanceData, when true, sets a data watch on each instance's znode in addition to the
+	// child watch on each service.  Changes to an instance's data, such as an updated payload, are
+	// then dispatched as they happen, and are reported in InstanceEvent.Updated.  This is off by
+	// default, since it adds one zookeeper watch per instance.
+	WatchInstanceData bool `json:"watchInstanceData"`
+
+	// InstanceFilter, if supplied, is applied to each watched ServiceInstance after it is read.
+	// Instances for which it returns false, e.g. instances that are draining, never reach the
+	// cache or any listener.  The number of instances filtered out is reported by Metrics.
+	InstanceFilter InstanceFilter `json:"-"`
+
+	// VersionConstraint, if supplied, restricts each watched service to the instances whose payload
+	// holds a supported version.  Like the InstanceFilter, excluded instances never reach the cache
+	// or any listener, and their number is reported by Metrics as VersionExcludedInstances.
+	VersionConstraint *VersionConstraint `json:"versionConstraint,omitempty"`
+
+	// WarmStartSnapshot, if supplied, is read by New as a snapshot written by Discovery.SnapshotTo.
+	// Each watched service in the snapshot is available immediately, both to FetchServices and to
+	// listeners, even before Run is called.  The first successful read from zookeeper replaces the
+	// snapshot and dispatches any changes.  A snapshot in an unsupported format causes New to fail
+	// with ErrorSnapshotVersion.
+	WarmStartSnapshot io.Reader `json:"-"`
+
+	// ExpvarName, if supplied, is the expvar name under which New publishes the ExpvarSnapshot of
+	// the Discovery, for diagnostics without Prometheus.  Each Discovery in a process must have
+	// its own name, so New fails with ErrorExpvarNameInUse if another Discovery that has not been
+	// closed, or anything else, has already published the name.  See PublishExpvar.
+	ExpvarName string `json:"expvarName"`
+
+	// Tracer, if supplied, observes each read of a service from zookeeper and each delivery of an
+	// event to a listener.  Use oteltrace.NewTracer to record these as OpenTelemetry spans.
+	Tracer Tracer `json:"-"`
+
+	// ListenerMiddleware, if supplied, decorates every listener registered with Discovery instances
+	// produced by this builder, e.g. with LoggingMiddleware, MetricsMiddleware, or FilterMiddleware.
+	// The first middleware is the outermost.  Listeners are still identified by the listener as
+	// registered, so the same listener is passed to RemoveListener.  Connection state and watched
+	// services listeners are not decorated.
+	ListenerMiddleware []ListenerMiddleware `json:"-"`
+
+	// Logger, if supplied, is used by the Discovery instead of the zk.Logger passed to New
+	Logger Logger `json:"-"`
+}
+
+// parseInterval parses a configured interval, which may be either a valid time.Duration
+// string or an integral number of seconds.  If the value is empty, the defaultValue is returned.
+func parseInterval(value string, defaultValue time.Duration) (time.Duration, bool) {
+	if len(value) > 0 {
+		if interval, err := time.ParseDuration(value); err == nil {
+			return interval, true
+		} else if seconds, err := strconv.Atoi(value); err == nil {
+			return time.Duration(seconds) * time.Second, true
+		}
+
+		return -1, false
+	}
+
+	return defaultValue, true
+}
+
+// connectTimeout is an internal helper method that returns the timeout for connecting to
+// zookeeper.  A zero timeout is replaced by DefaultConnectTimeout.
+func (this *DiscoveryBuilder) connectTimeout() (time.Duration, error) {
+	if timeout, ok := parseInterval(this.ConnectTimeout, DefaultConnectTimeout); ok && timeout >= 0 {
+		if timeout == 0 {
+			timeout = DefaultConnectTimeout
+		}
+
+		return timeout, nil
+	}
+
+	return -1, ErrorInvalidConnectTimeout
+}
+
+// sessionTimeout is an internal helper method that returns the zookeeper session timeout to
+// request.  A zero timeout is replaced by DefaultSessionTimeout.
+func (this *DiscoveryBuilder) sessionTimeout() (time.Duration, error) {
+	if timeout, ok := parseInterval(this.SessionTimeout, DefaultSessionTimeout); ok && timeout >= 0 {
+		if timeout == 0 {
+			timeout = DefaultSessionTimeout
+		}
+
+		return timeout, nil
+	}
+
+	return -1, ErrorInvalidSessionTimeout
+}
+
+// connectRetryOptions is an internal helper method that returns the backoff policy and overall
+// deadline used when connecting to zookeeper.  If no retry is configured, nil is returned.
+// A zero deadline means connections are retried indefinitely.
+func (this *DiscoveryBuilder) connectRetryOptions() (*retryOptions, time.Duration, error) {
+	if len(this.ConnectRetryInitialDelay) == 0 && len(this.ConnectRetryMaxDelay) == 0 && len(this.ConnectDeadline) == 0 {
+		return nil, 0, nil
+	}
+
+	var options retryOptions
+	var initialOk, maxOk bool
+	options.initialDelay, initialOk = parseInterval(this.ConnectRetryInitialDelay, DefaultConnectRetryInitialDelay)
+	options.maxDelay, maxOk = parseInterval(this.ConnectRetryMaxDelay, DefaultConnectRetryMaxDelay)
+	deadline, deadlineOk := parseInterval(this.ConnectDeadline, 0)
+	if !initialOk || !maxOk || !deadlineOk || options.initialDelay <= 0 || options.maxDelay < options.initialDelay || deadline < 0 {
+		return nil, 0, ErrorInvalidConnectRetry
+	}
+
+	return &options, deadline, nil
 }
 
 // watchPollInterval is an internal help method that returns the appropriate
 // interval for polling zookeeper.
 func (this *DiscoveryBuilder) watchPollInterval() (time.Duration, error) {
-	if len(this.WatchPollInterval) > 0 {
-		if interval, err := time.ParseDuration(this.WatchPollInterval); err == nil {
-			return interval, nil
-		} else if seconds, err := strconv.Atoi(this.WatchPollInterval); err == nil {
-			return time.Duration(seconds) * time.Second, nil
+	if interval, ok := parseInterval(this.WatchPollInterval, DefaultWatchPollInterval); ok {
+		return interval, nil
+	}
+
+	return -1, ErrorInvalidWatchPollInterval
+}
+
+// reconnectJitter is an internal helper method that returns the upper bound of the delay
+// before each watched service is re-read after reconnection.  Zero disables the jitter.
+func (this *DiscoveryBuilder) reconnectJitter() (time.Duration, error) {
+	if jitter, ok := parseInterval(this.ReconnectJitter, 0); ok && jitter >= 0 {
+		return jitter, nil
+	}
+
+	return -1, ErrorInvalidReconnectJitter
+}
+
+// watchLossThreshold is an internal helper method that returns how long a watched service may
+// be without a watch before a warning is logged.  Zero disables the warnings.
+func (this *DiscoveryBuilder) watchLossThreshold() (time.Duration, error) {
+	if threshold, ok := parseInterval(this.WatchLossThreshold, 0); ok && threshold >= 0 {
+		return threshold, nil
+	}
+
+	return -1, ErrorInvalidWatchLossThreshold
+}
+
+// resyncInterval is an internal helper method that returns the interval between resyncs
+// of watched services.  A zero interval disables resyncing.
+func (this *DiscoveryBuilder) resyncInterval() (time.Duration, error) {
+	if interval, ok := parseInterval(this.ResyncInterval, 0); ok && interval >= 0 {
+		return interval, nil
+	}
+
+	return -1, ErrorInvalidResyncInterval
+}
+
+// watchDebounceWindow is an internal helper method that returns the window during which
+// changes to a watched service are coalesced
+func (this *DiscoveryBuilder) watchDebounceWindow() (time.Duration, error) {
+	if window, ok := parseInterval(this.WatchDebounceWindow, 0); ok && window >= 0 {
+		return window, nil
+	}
+
+	return -1, ErrorInvalidWatchDebounceWindow
+}
+
+// aggregateWindow is an internal helper method that returns the window during which changes to
+// any watched service are coalesced before being delivered to each AggregateListener
+func (this *DiscoveryBuilder) aggregateWindow() (time.Duration, error) {
+	if window, ok := parseInterval(this.AggregateWindow, DefaultAggregateWindow); ok && window >= 0 {
+		return window, nil
+	}
+
+	return -1, ErrorInvalidAggregateWindow
+}
+
+// staleInstanceThreshold is an internal helper method that returns the age beyond which
+// instances are stale.  A zero threshold disables staleness.
+func (this *DiscoveryBuilder) staleInstanceThreshold() (time.Duration, error) {
+	if threshold, ok := parseInterval(this.StaleInstanceThreshold, 0); ok && threshold >= 0 {
+		return threshold, nil
+	}
+
+	return -1, ErrorInvalidStaleThreshold
+}
+
+// readRateLimiter is an internal helper method that returns the rateLimiter shared by every
+// watcher, or nil if reads are not rate limited
+func (this *DiscoveryBuilder) readRateLimiter() (*rateLimiter, error) {
+	if this.ReadRateLimit < 0 || this.ReadRateBurst < 0 {
+		return nil, ErrorInvalidReadRateLimit
+	} else if this.ReadRateLimit == 0 {
+		return nil, nil
+	}
+
+	return newRateLimiter(this.ReadRateLimit, this.ReadRateBurst), nil
+}
+
+// readBatchSize is an internal helper method that returns the maximum number of child znodes
+// read in a single round trip.  Zero or one disables batching.
+func (this *DiscoveryBuilder) readBatchSize() (int, error) {
+	if this.ReadBatchSize < 0 {
+		return -1, ErrorInvalidReadBatchSize
+	}
+
+	return this.ReadBatchSize, nil
+}
+
+// fetchTimeout is an internal helper method that returns how long the data of each child znode
+// may take to read.  Zero disables the timeout.
+func (this *DiscoveryBuilder) fetchTimeout() (time.Duration, error) {
+	if timeout, ok := parseInterval(this.FetchTimeout, DefaultFetchTimeout); ok && timeout >= 0 {
+		return timeout, nil
+	}
+
+	return -1, ErrorInvalidFetchTimeout
+}
+
+// logSampleSize is an internal helper method that returns the maximum number of child znode ids
+// included in the summary of each read
+func (this *DiscoveryBuilder) logSampleSize() (int, error) {
+	if this.LogSampleSize < 0 {
+		return -1, ErrorInvalidLogSampleSize
+	} else if this.LogSampleSize == 0 {
+		return DefaultLogSampleSize, nil
+	}
+
+	return this.LogSampleSize, nil
+}
+
+// eventHistorySize is an internal helper method that returns the number of events kept for each
+// watched service.  Zero disables the history.
+func (this *DiscoveryBuilder) eventHistorySize() (int, error) {
+	if this.EventHistorySize < 0 {
+		return -1, ErrorInvalidEventHistorySize
+	}
+
+	return this.EventHistorySize, nil
+}
+
+// servicePathModes is an internal helper method that returns how a missing service path is
+// treated by default, along with any overrides by service name
+func (this *DiscoveryBuilder) servicePathModes() (servicePathMode, map[string]servicePathMode, error) {
+	pathMode, err := this.parseServicePathMode(this.ServicePathMode)
+	if err != nil {
+		return pathMode, nil, err
+	}
+
+	pathModes := make(map[string]servicePathMode, len(this.ServicePathModes))
+	for serviceName, value := range this.ServicePathModes {
+		if pathModes[serviceName], err = this.parseServicePathMode(value); err != nil {
+			return pathMode, nil, err
+		}
+	}
+
+	return pathMode, pathModes, nil
+}
+
+// parseServicePathMode is an internal helper method that parses a configured ServicePathMode.
+// When this builder is ReadOnly, an empty value is ServicePathRequire, and ServicePathCreate
+// is an error.
+func (this *DiscoveryBuilder) parseServicePathMode(value string) (servicePathMode, error) {
+	if this.ReadOnly {
+		switch value {
+		case "":
+			return servicePathRequire, nil
+		case ServicePathCreate:
+			return servicePathRequire, ErrorReadOnlyServicePathMode
 		}
+	}
+
+	return parseServicePathMode(value)
+}
+
+// authInfos is an internal helper method that returns the authentication added to each
+// zookeeper connection, if any
+func (this *DiscoveryBuilder) authInfos() ([]curator.AuthInfo, error) {
+	if len(this.AuthScheme) == 0 && len(this.AuthCredentials) == 0 {
+		return nil, nil
+	} else if len(this.AuthScheme) == 0 || len(this.AuthCredentials) == 0 {
+		return nil, ErrorInvalidAuth
+	}
+
+	return []curator.AuthInfo{{Scheme: this.AuthScheme, Auth: []byte(this.AuthCredentials)}}, nil
+}
+
+// watchRetryOptions is an internal helper method that returns the backoff policy
+// used when re-establishing watches.
+func (this *DiscoveryBuilder) watchRetryOptions() (options retryOptions, err error) {
+	var initialOk, maxOk bool
+	options.initialDelay, initialOk = parseInterval(this.WatchRetryInitialDelay, DefaultWatchRetryInitialDelay)
+	options.maxDelay, maxOk = parseInterval(this.WatchRetryMaxDelay, DefaultWatchRetryMaxDelay)
+	if !initialOk || !maxOk || options.initialDelay <= 0 || options.maxDelay < options.initialDelay {
+		err = ErrorInvalidWatchRetryDelay
+		return
+	}
+
+	options.maxAttempts = this.WatchRetryMaxAttempts
+	return
+}
+
+// dispatchOptions is an internal helper method that returns the options
+// controlling how events are delivered to listeners.
+func (this *DiscoveryBuilder) dispatchOptions() (dispatchOptions, error) {
+	options := dispatchOptions{
+		async:              this.AsyncDispatch,
+		queueSize:          this.DispatchQueueSize,
+		dispatchUnchanged:  this.DispatchUnchanged,
+		suppressEquivalent: this.SuppressEquivalent,
+		middleware:         ChainListenerMiddleware(this.ListenerMiddleware...),
+		executor:           this.DispatchExecutor,
+		tracer:             this.Tracer,
+	}
+
+	if options.async && options.executor != nil {
+		return options, ErrorInvalidDispatchExecutor
+	}
+
+	listenerTimeout, ok := parseInterval(this.ListenerTimeout, 0)
+	if !ok || listenerTimeout < 0 {
+		return options, ErrorInvalidListenerTimeout
+	}
 
-		return -1, ErrorInvalidWatchPollInterval
+	options.listenerTimeout = listenerTimeout
+
+	if options.queueSize < 1 {
+		options.queueSize = DefaultDispatchQueueSize
+	}
+
+	switch this.DispatchQueueFull {
+	case "", DispatchQueueFullBlock:
+	case DispatchQueueFullDropOldest:
+		options.dropOldest = true
+	default:
+		return options, ErrorInvalidDispatchQueueFull
+	}
+
+	switch this.DuplicateListener {
+	case "", DuplicateListenerIgnore:
+	case DuplicateListenerError:
+		options.rejectDuplicates = true
+	default:
+		return options, ErrorInvalidDuplicateListener
 	}
 
-	return DefaultWatchPollInterval, nil
+	return options, nil
 }
 
 // New creates a distinct Discovery instance from this DiscoveryBuilder.  Changes
 // to this builder will not affect the newly created Discovery instance, and vice versa.
-func (this *DiscoveryBuilder) New(logger zk.Logger) (discovery Discovery, err error) {
+// The given zk.Logger is adapted via NewZkLogger unless this builder has a Logger.
+// This builder is checked with Validate first, and no Discovery is created if it is invalid.
+func (this *DiscoveryBuilder) New(zkLogger zk.Logger) (discovery Discovery, err error) {
+	if err = this.Validate(); err != nil {
+		return
+	}
+
+	logger := this.Logger
+	if logger == nil {
+		logger = NewZkLogger(zkLogger)
+	}
+
 	registrations := make(Instances, len(this.Registrations))
 	for index := 0; index < len(registrations); index++ {
 		clone := *this.Registrations[index]
@@ -356,22 +1912,244 @@ func (this *DiscoveryBuilder) New(logger zk.Logger) (discovery Discovery, err er
 
 	watches := make([]string, len(this.Watches))
 	copy(watches, this.Watches)
+	watchPathNames := make([]string, 0, len(this.WatchPaths))
+	for serviceName := range this.WatchPaths {
+		watchPathNames = append(watchPathNames, serviceName)
+	}
+
+	// sorting makes the reported collisions, if any, the same every time
+	sort.Strings(watchPathNames)
+	watches = append(watches, watchPathNames...)
+
+	connectTimeout, err := this.connectTimeout()
+	if err != nil {
+		return
+	}
+
+	sessionTimeout, err := this.sessionTimeout()
+	if err != nil {
+		return
+	}
+
+	connectRetry, connectDeadline, err := this.connectRetryOptions()
+	if err != nil {
+		return
+	}
+
+	watchPollInterval, err := this.watchPollInterval()
+	if err != nil {
+		return
+	}
+
+	dispatchOptions, err := this.dispatchOptions()
+	if err != nil {
+		return
+	}
+
+	watchRetryOptions, err := this.watchRetryOptions()
+	if err != nil {
+		return
+	}
+
+	resyncInterval, err := this.resyncInterval()
+	if err != nil {
+		return
+	}
+
+	reconnectJitter, err := this.reconnectJitter()
+	if err != nil {
+		return
+	}
+
+	watchLossThreshold, err := this.watchLossThreshold()
+	if err != nil {
+		return
+	}
+
+	watchDebounceWindow, err := this.watchDebounceWindow()
+	if err != nil {
+		return
+	}
+
+	readRateLimiter, err := this.readRateLimiter()
+	if err != nil {
+		return
+	}
+
+	readBatchSize, err := this.readBatchSize()
+	if err != nil {
+		return
+	}
+
+	fetchTimeout, err := this.fetchTimeout()
+	if err != nil {
+		return
+	}
+
+	logSampleSize, err := this.logSampleSize()
+	if err != nil {
+		return
+	}
+
+	eventHistorySize, err := this.eventHistorySize()
+	if err != nil {
+		return
+	}
+
+	staleInstanceThreshold, err := this.staleInstanceThreshold()
+	if err != nil {
+		return
+	}
+
+	aggregateWindow, err := this.aggregateWindow()
+	if err != nil {
+		return
+	}
+
+	servicePathMode, servicePathModes, err := this.servicePathModes()
+	if err != nil {
+		return
+	}
+
+	if err = this.VersionConstraint.validate(); err != nil {
+		return
+	}
+
+	authInfos, err := this.authInfos()
+	if err != nil {
+		return
+	}
+
+	acls, err := parseACLs(this.ACLs)
+	if err != nil {
+		return
+	}
+
+	fetchConcurrency := this.FetchConcurrency
+	if fetchConcurrency < 1 {
+		fetchConcurrency = DefaultFetchConcurrency
+	}
+
+	basePath, err := normalizeBasePath(this.BasePath)
+	if err != nil {
+		return
+	}
 
-	var watchPollInterval time.Duration
-	if len(watches) > 0 {
-		if watchPollInterval, err = this.watchPollInterval(); err != nil {
+	rootContext, cancel := context.WithCancel(context.Background())
+	watcherOptions := watcherOptions{
+		rootContext:        rootContext,
+		dispatch:           dispatchOptions,
+		retry:              watchRetryOptions,
+		fetchConcurrency:   fetchConcurrency,
+		readBatchSize:      readBatchSize,
+		fetchTimeout:       fetchTimeout,
+		logSampleSize:      logSampleSize,
+		debounceWindow:     watchDebounceWindow,
+		aggregateWindow:    aggregateWindow,
+		instanceSerializer: this.InstanceSerializer,
+		instanceError:      this.InstanceError,
+		instanceFilter:     this.InstanceFilter,
+		versionConstraint:  this.VersionConstraint,
+		watchData:          this.WatchInstanceData,
+		tracer:             this.Tracer,
+		eventHistorySize:   eventHistorySize,
+		staleThreshold:     staleInstanceThreshold,
+		lenient:            this.LenientInitialization,
+		pathMode:           servicePathMode,
+		pathModes:          servicePathModes,
+		servicePaths:       this.WatchPaths,
+		coalesceReads:      readRateLimiter != nil,
+	}
+
+	watchBasePaths := []string{basePath}
+	if len(this.WatchBasePaths) > 0 {
+		watchBasePaths = make([]string, len(this.WatchBasePaths))
+		copy(watchBasePaths, this.WatchBasePaths)
+	}
+
+	serviceWatcherSet, err := newServiceWatcherSet(logger, watches, watchBasePaths, watcherOptions)
+	if err != nil {
+		cancel()
+		return
+	}
+
+	warmStarted := false
+	if this.WarmStartSnapshot != nil {
+		var services map[string]Instances
+		if services, err = readSnapshot(this.WarmStartSnapshot); err != nil {
+			cancel()
 			return
 		}
+
+		warmStarted = serviceWatcherSet.warmStart(services) > 0
 	}
 
-	discovery = &curatorDiscovery{
-		connection:        this.Connection,
-		basePath:          this.BasePath,
-		registrations:     registrations,
-		serviceWatcherSet: newServiceWatcherSet(logger, this.Watches, this.BasePath),
-		watchPollInterval: watchPollInterval,
-		logger:            logger,
+	created := &curatorDiscovery{
+		connection:         this.Connection,
+		connectTimeout:     connectTimeout,
+		sessionTimeout:     sessionTimeout,
+		connectRetry:       connectRetry,
+		connectDeadline:    connectDeadline,
+		basePath:           basePath,
+		registrations:      registrations,
+		serviceWatcherSet:  serviceWatcherSet,
+		watchPollInterval:  watchPollInterval,
+		resyncInterval:     resyncInterval,
+		reconnectJitter:    reconnectJitter,
+		watchLossThreshold: watchLossThreshold,
+		random:             rand.New(rand.NewSource(time.Now().UnixNano())).Float64,
+		readRateLimiter:    readRateLimiter,
+		logger:             logger,
+		instanceSerializer: this.InstanceSerializer,
+		authInfos:          authInfos,
+		acls:               acls,
+
+		ownsConnection:         this.CuratorConnection == nil,
+		curatorConnection:      this.CuratorConnection,
+		registrationValidator:  this.RegistrationValidator,
+		readOnly:               this.ReadOnly,
+		connectionStateMonitor: newConnectionStateMonitor(logger),
+		closeSignal:            make(chan struct{}),
+		cancel:                 cancel,
+		warmStarted:            warmStarted,
+		expvarName:             this.ExpvarName,
 	}
 
+	if len(this.ExpvarName) > 0 {
+		if err = PublishExpvar(this.ExpvarName, created); err != nil {
+			cancel()
+			return
+		}
+	}
+
+	discovery = created
 	return
 }
+
+// NewAsync is like New, except that the new Discovery is also started in the background, so
+// that this method returns without waiting for zookeeper.  The returned channel receives the
+// result of Run, once the connection and initial watches are established or Run has failed,
+// and is then closed.  Until then, FetchServices returns ErrorServiceNotReady.  Supplying a
+// ConnectDeadline bounds how long the result can take.
+func (this *DiscoveryBuilder) NewAsync(zkLogger zk.Logger, waitGroup *sync.WaitGroup, shutdown <-chan struct{}) (Discovery, <-chan error, error) {
+	discovery, err := this.New(zkLogger)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return discovery, startAsync(discovery.(*curatorDiscovery), waitGroup, shutdown), nil
+}
+
+// startAsync runs the given Discovery in the background, returning the channel on which
+// the result of Run is delivered
+func startAsync(discovery *curatorDiscovery, waitGroup *sync.WaitGroup, shutdown <-chan struct{}) <-chan error {
+	// mark the Discovery as starting before Run does, so that no fetch observes it as not running
+	atomic.StoreUint32(&discovery.starting, 1)
+	ready := make(chan error, 1)
+	go func() {
+		ready <- discovery.Run(waitGroup, shutdown)
+		close(ready)
+	}()
+
+	return ready
+}
@@ -2,12 +2,17 @@ package service
 
 import (
 	"fmt"
+	"github.com/foursquare/curator.go"
+	"github.com/samuel/go-zookeeper/zk"
+	"github.com/stretchr/testify/assert"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 const (
+	testConnection  = "localhost:2181"
 	testBasePath    = "/test/region/flavor"
 	testServiceName = "myService"
 	testAddress     = "fabric-cd.webpa.comcast.net"
@@ -194,3 +199,359 @@ func TestTolerateDisconnection(t *testing.T) {
 		t.Fatalf("Unexpected service instance from discovery listener")
 	}
 }
+
+func TestCloseBeforeRun(t *testing.T) {
+	assert := assert.New(t)
+
+	builder := &DiscoveryBuilder{Connection: testConnection, BasePath: testBasePath, Watches: []string{testServiceName}}
+	discovery, err := builder.New(&testLogger{t})
+	if !assert.Nil(err) {
+		return
+	}
+
+	assert.Nil(discovery.Close())
+	assert.Nil(discovery.Close())
+
+	instances, err := discovery.FetchServices(testServiceName)
+	assert.Nil(instances)
+	assert.Equal(ErrorClosed, err)
+
+	registration, err := discovery.AddListener(testServiceName, ListenerFunc(func(string, Instances) {}))
+	assert.Nil(registration)
+	assert.Equal(ErrorClosed, err)
+
+	assert.Equal(ErrorClosed, discovery.AddService("another"))
+
+	instances, err = discovery.WaitForInitialSnapshot(testServiceName, time.Second)
+	assert.Nil(instances)
+	assert.Equal(ErrorClosed, err)
+	assert.False(discovery.Connected())
+
+	shutdown := make(chan struct{})
+	defer close(shutdown)
+	assert.Equal(ErrorClosed, discovery.Run(&sync.WaitGroup{}, shutdown))
+	assert.Equal(ErrorClosed, discovery.Run(&sync.WaitGroup{}, shutdown))
+}
+
+// unreachableDialer is a curator.ZookeeperDialer whose connections never establish a session.
+// It counts the connections dialed.
+type unreachableDialer struct {
+	dials int32
+}
+
+func (this *unreachableDialer) Dial(connString string, sessionTimeout time.Duration, canBeReadOnly bool) (curator.ZookeeperConnection, <-chan zk.Event, error) {
+	atomic.AddInt32(&this.dials, 1)
+	return newFakeZookeeperConnection(), nil, nil
+}
+
+func (this *unreachableDialer) dialCount() int {
+	return int(atomic.LoadInt32(&this.dials))
+}
+
+// newUnreachableDiscovery creates a Discovery from the given builder that connects via an unreachableDialer
+func newUnreachableDiscovery(t *testing.T, builder *DiscoveryBuilder) (*curatorDiscovery, *unreachableDialer) {
+	builder.Connection = testConnection
+	builder.BasePath = testBasePath
+	builder.Watches = []string{testServiceName}
+	discovery, err := builder.New(&testLogger{t})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dialer := &unreachableDialer{}
+	discovery.(*curatorDiscovery).zookeeperDialer = dialer
+	return discovery.(*curatorDiscovery), dialer
+}
+
+func TestConnectDeadline(t *testing.T) {
+	assert := assert.New(t)
+	discovery, dialer := newUnreachableDiscovery(t, &DiscoveryBuilder{
+		ConnectTimeout:           "20ms",
+		ConnectRetryInitialDelay: "10ms",
+		ConnectRetryMaxDelay:     "20ms",
+		ConnectDeadline:          "250ms",
+	})
+
+	defer discovery.Close()
+
+	result := make(chan error, 1)
+	shutdown := make(chan struct{})
+	defer close(shutdown)
+	started := time.Now()
+	go func() {
+		result <- discovery.Run(&sync.WaitGroup{}, shutdown)
+	}()
+
+	// while connecting, services are not ready rather than empty
+	assert.Eventually(func() bool {
+		_, err := discovery.FetchServices(testServiceName)
+		return err == ErrorServiceNotReady
+	}, time.Second, time.Millisecond)
+
+	select {
+	case err := <-result:
+		assert.Equal(ErrorConnectDeadline, err)
+		assert.True(time.Since(started) >= 250*time.Millisecond)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not honor the ConnectDeadline")
+	}
+
+	assert.True(dialer.dialCount() > 1, "connections should have been retried")
+	assert.False(discovery.Connected())
+	_, err := discovery.FetchServices(testServiceName)
+	assert.Equal(ErrorNotRunning, err)
+}
+
+func TestCloseWhileConnecting(t *testing.T) {
+	assert := assert.New(t)
+	discovery, dialer := newUnreachableDiscovery(t, &DiscoveryBuilder{
+		ConnectTimeout:           "10ms",
+		ConnectRetryInitialDelay: "1h",
+		ConnectRetryMaxDelay:     "1h",
+	})
+
+	result := make(chan error, 1)
+	shutdown := make(chan struct{})
+	defer close(shutdown)
+	go func() {
+		result <- discovery.Run(&sync.WaitGroup{}, shutdown)
+	}()
+
+	assert.Eventually(func() bool { return dialer.dialCount() > 0 }, time.Second, time.Millisecond)
+	assert.Nil(discovery.Close())
+	select {
+	case err := <-result:
+		assert.Equal(ErrorClosed, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not abandon connecting")
+	}
+
+	assert.Equal(1, dialer.dialCount())
+}
+
+func TestNewAsync(t *testing.T) {
+	assert := assert.New(t)
+	discovery, _ := newUnreachableDiscovery(t, &DiscoveryBuilder{
+		ConnectTimeout:           "20ms",
+		ConnectRetryInitialDelay: "10ms",
+		ConnectDeadline:          "100ms",
+	})
+
+	defer discovery.Close()
+	ready := startAsync(discovery, &sync.WaitGroup{}, nil)
+
+	// services are not ready from the moment the Discovery is returned
+	instances, err := discovery.FetchServices(testServiceName)
+	assert.Nil(instances)
+	assert.Equal(ErrorServiceNotReady, err)
+
+	select {
+	case err := <-ready:
+		assert.Equal(ErrorConnectDeadline, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the result of Run was not delivered")
+	}
+
+	_, ok := <-ready
+	assert.False(ok)
+
+	asyncDiscovery, ready, err := (&DiscoveryBuilder{Connection: testConnection, ConnectDeadline: "not a duration"}).NewAsync(&testLogger{t}, &sync.WaitGroup{}, nil)
+	assert.Nil(asyncDiscovery)
+	assert.Nil(ready)
+	assert.NotNil(err)
+}
+
+func TestSuppliedCuratorConnection(t *testing.T) {
+	assert := assert.New(t)
+
+	var testData = []struct {
+		started bool
+	}{
+		{false},
+		{true},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		curatorConnection := newCuratorConnection(testConnection, 0, 0, nil, nil, newFakeZookeeperConnection())
+		if record.started {
+			assert.Nil(curatorConnection.Start())
+		}
+
+		listenable := curatorConnection.ConnectionStateListenable()
+		initial := listenable.Len()
+
+		// the supplied connection replaces the Connection
+		builder := &DiscoveryBuilder{
+			CuratorConnection: curatorConnection,
+			BasePath:          testBasePath,
+			Watches:           []string{testServiceName},
+			ConnectDeadline:   "50ms",
+		}
+
+		discovery, err := builder.New(&testLogger{t})
+		if !assert.Nil(err) {
+			continue
+		}
+
+		assert.Nil(discovery.CuratorConnection())
+		shutdown := make(chan struct{})
+		assert.Equal(ErrorConnectDeadline, discovery.Run(&sync.WaitGroup{}, shutdown))
+		close(shutdown)
+		assert.Nil(discovery.Close())
+		assert.Nil(discovery.CuratorConnection())
+
+		// the connection was started as needed, but remains open and is no longer observed
+		assert.True(curatorConnection.Started())
+		assert.Equal(initial, listenable.Len())
+		assert.Nil(curatorConnection.Close())
+	}
+}
+
+func TestRecoverServicesWithJitter(t *testing.T) {
+	assert := assert.New(t)
+
+	client := newFakeZookeeperClient()
+	for _, serviceName := range []string{"a", "b"} {
+		client.addInstance(testBasePath+"/"+serviceName, newTestInstance("1", "localhost", 1234))
+	}
+
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{"a", "b"}, []string{testBasePath}, watcherOptions{})
+	defer serviceWatcherSet.stop()
+	if !assert.Nil(serviceWatcherSet.initialize(client)) {
+		return
+	}
+
+	cachedIds := func(serviceName string) []string {
+		serviceWatcher, _ := serviceWatcherSet.findByName(serviceName)
+		instances, _ := serviceWatcher.cachedInstances()
+		return instanceIds(instances)
+	}
+
+	discovery := &curatorDiscovery{
+		serviceWatcherSet: serviceWatcherSet,
+		logger:            &testLogger{t},
+		reconnectJitter:   200 * time.Millisecond,
+		random:            func() float64 { return 0.5 },
+	}
+
+	refreshed := make(chan string, 2)
+	for _, serviceName := range []string{"a", "b"} {
+		serviceWatcher, _ := serviceWatcherSet.findByName(serviceName)
+		serviceWatcher.addListener(ListenerFunc(func(serviceName string, instances Instances) {
+			if len(instances) > 1 {
+				refreshed <- serviceName
+			}
+		}))
+
+		client.addInstance(testBasePath+"/"+serviceName, newTestInstance("2", "localhost", 1234))
+	}
+
+	// the services are refreshed in the background, staggered across the jitter
+	started := time.Now()
+	discovery.recoverServices()
+	discovery.recoverServices()
+	assert.Equal([]string{"1"}, cachedIds("a"))
+	assert.Equal([]string{"1"}, cachedIds("b"))
+
+	// with a random value of 0.5, the two services are refreshed at 50ms and 150ms
+	var elapsed []time.Duration
+	var order []string
+	for len(order) < 2 {
+		select {
+		case serviceName := <-refreshed:
+			elapsed = append(elapsed, time.Since(started))
+			order = append(order, serviceName)
+		case <-time.After(5 * time.Second):
+			t.Fatal("The services were not refreshed")
+		}
+	}
+
+	assert.ElementsMatch([]string{"a", "b"}, order)
+	assert.True(elapsed[0] >= 50*time.Millisecond, elapsed[0].String())
+	assert.True(elapsed[1] >= 150*time.Millisecond, elapsed[1].String())
+	select {
+	case serviceName := <-refreshed:
+		assert.Fail("A service was refreshed twice", serviceName)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// without jitter, the services are refreshed before recoverServices returns
+	discovery.reconnectJitter = 0
+	client.addInstance(testBasePath+"/a", newTestInstance("3", "localhost", 1234))
+	discovery.recoverServices()
+	assert.Equal([]string{"1", "2", "3"}, cachedIds("a"))
+}
+
+func TestAddServiceDuringStartup(t *testing.T) {
+	assert := assert.New(t)
+
+	client := &orderRecordingClient{fakeZookeeperClient: newFakeZookeeperClient()}
+	for _, serviceName := range []string{"a", "b"} {
+		client.addInstance(testBasePath+"/"+serviceName, newTestInstance("1", "localhost", 1234))
+	}
+
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{"a"}, []string{testBasePath}, watcherOptions{})
+	defer serviceWatcherSet.stop()
+
+	discovery := &curatorDiscovery{
+		serviceWatcherSet: serviceWatcherSet,
+		logger:            &testLogger{t},
+		zookeeperClient:   client,
+	}
+
+	if !assert.Nil(discovery.initializeWatchers()) {
+		return
+	}
+
+	// a service added after the watchers were initialized, but before discovery is running,
+	// is not initialized by AddService
+	assert.Nil(discovery.AddService("b"))
+	added, _ := serviceWatcherSet.findByName("b")
+	_, initialized := added.cachedInstances()
+	assert.False(initialized)
+
+	atomic.StoreUint32(&discovery.state, discoveryStateRunning)
+	discovery.initializeAddedWatchers()
+	instances, initialized := added.cachedInstances()
+	assert.True(initialized)
+	assert.Equal([]string{"1"}, instanceIds(instances))
+
+	// each service was watched exactly once
+	assert.Equal([]string{testBasePath + "/a", testBasePath + "/b"}, client.watched)
+}
+
+func TestDiscoveryBuilderWatchPaths(t *testing.T) {
+	assert := assert.New(t)
+
+	builder := &DiscoveryBuilder{
+		Connection: testConnection,
+		BasePath:   "/services",
+		Watches:    []string{"alpha", "bravo"},
+		WatchPaths: map[string]string{"bravo": "/discovery/v2/bravo", "charlie": "/discovery/v2/charlie"},
+	}
+
+	discovery, err := builder.New(&testLogger{t})
+	if assert.Nil(err) {
+		serviceWatcherSet := discovery.(*curatorDiscovery).serviceWatcherSet
+		assert.Equal([]string{"alpha", "bravo", "charlie"}, serviceWatcherSet.cloneServiceNames())
+		for serviceName, expectedPath := range map[string]string{
+			"alpha":   "/services/alpha",
+			"bravo":   "/discovery/v2/bravo",
+			"charlie": "/discovery/v2/charlie",
+		} {
+			serviceWatcher, ok := serviceWatcherSet.findByName(serviceName)
+			if assert.True(ok, serviceName) {
+				assert.Equal(expectedPath, serviceWatcher.servicePath)
+			}
+		}
+
+		discovery.Close()
+	}
+
+	// two services watched at the same path are rejected when building
+	builder.WatchPaths["charlie"] = "/services/alpha"
+	discovery, err = builder.New(&testLogger{t})
+	assert.Nil(discovery)
+	assert.Equal(ServicePathCollisionError{"/services/alpha", []string{"alpha", "charlie"}}, err)
+}
@@ -0,0 +1,370 @@
+package service
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DispatchQueueFullBlock is the DispatchQueueFull policy that blocks dispatching
+	// until the listener's queue has room
+	DispatchQueueFullBlock = "block"
+
+	// DispatchQueueFullDropOldest is the DispatchQueueFull policy that discards the oldest
+	// queued event in favor of the newest event
+	DispatchQueueFullDropOldest = "dropOldest"
+
+	// DuplicateListenerIgnore is the DuplicateListener policy under which adding a listener that
+	// is already registered does nothing, and returns the existing Registration
+	DuplicateListenerIgnore = "ignore"
+
+	// DuplicateListenerError is the DuplicateListener policy under which adding a listener that
+	// is already registered fails with ErrorAlreadyRegistered
+	DuplicateListenerError = "error"
+
+	// DefaultDispatchQueueSize is the number of events that can be queued for each
+	// listener when asynchronous dispatch is used
+	DefaultDispatchQueueSize = 10
+)
+
+// dispatchOptions holds the configuration for how events are delivered to listeners
+type dispatchOptions struct {
+	async      bool
+	queueSize  int
+	dropOldest bool
+
+	// dispatchUnchanged disables the suppression of snapshots that don't change membership
+	dispatchUnchanged bool
+
+	// suppressEquivalent determines membership by equivalence rather than by instance Id
+	suppressEquivalent bool
+
+	// middleware, when set, decorates each listener
+	middleware ListenerMiddleware
+
+	// listenerTimeout is how long a listener may take to handle an event before it is reported
+	// as slow.  Zero disables slow listener detection.
+	listenerTimeout time.Duration
+
+	// executor, when set, runs synchronous deliveries through a serial Executor per listener
+	executor Executor
+
+	// tracer, when set, observes each delivery to a listener
+	tracer Tracer
+
+	// rejectDuplicates causes a listener that is already registered to be refused with
+	// ErrorAlreadyRegistered, rather than returning its existing Registration
+	rejectDuplicates bool
+}
+
+// sendDroppingOldest sends an event on a buffered channel without blocking.  If the channel
+// is full, the oldest buffered events are discarded to make room.  Callers must ensure that
+// no other goroutine is sending on the channel concurrently.
+func sendDroppingOldest(events chan ServiceEvent, event ServiceEvent) {
+	for {
+		select {
+		case events <- event:
+			return
+		default:
+			// a receiver may have drained the channel in the meantime,
+			// so don't block when discarding the oldest event
+			select {
+			case <-events:
+			default:
+			}
+		}
+	}
+}
+
+// dispatchEvent is a single event awaiting delivery to a listener
+type dispatchEvent struct {
+	serviceName string
+	event       InstanceEvent
+}
+
+// invokeListener calls InstancesChanged on the given listener if it is an InstancesListener,
+// or ServicesChanged otherwise, recovering from any panic.  A panicking listener is logged
+// along with its stack trace, and does not prevent other listeners from receiving events.
+func invokeListener(logger Logger, listener Listener, serviceName string, event InstanceEvent) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("Listener %T panicked while handling [%s] services: %v\n%s", listener, serviceName, r, debug.Stack())
+		}
+	}()
+
+	notifyListener(listener, serviceName, event)
+}
+
+// notifyListener passes an event to a listener, via InstancesChanged if the listener is an InstancesListener
+func notifyListener(listener Listener, serviceName string, event InstanceEvent) {
+	if instancesListener, ok := listener.(InstancesListener); ok {
+		instancesListener.InstancesChanged(serviceName, event)
+	} else {
+		listener.ServicesChanged(serviceName, event.Current)
+	}
+}
+
+// listenerLabel identifies a listener in log messages.  A listener which implements
+// fmt.Stringer is identified by its String method, and any other listener by its type.
+func listenerLabel(listener Listener) string {
+	if stringer, ok := listener.(fmt.Stringer); ok {
+		return stringer.String()
+	}
+
+	return fmt.Sprintf("%T", listener)
+}
+
+// listenerQueue delivers events to a single listener on a dedicated goroutine.
+// Events are delivered in the order in which they are enqueued.  Only one goroutine
+// may enqueue events at a time.
+type listenerQueue struct {
+	closeOnce  sync.Once
+	done       chan struct{}
+	dropOldest bool
+	events     chan dispatchEvent
+
+	// timeout bounds how long a blocked enqueue waits for the listener to take an event
+	timeout time.Duration
+}
+
+// newListenerQueue creates a listenerQueue and starts the goroutine which delivers
+// events to the given entry's listener
+func newListenerQueue(entry *listenerEntry, options dispatchOptions) *listenerQueue {
+	queueSize := options.queueSize
+	if queueSize < 1 {
+		queueSize = DefaultDispatchQueueSize
+	}
+
+	queue := &listenerQueue{
+		done:       make(chan struct{}),
+		dropOldest: options.dropOldest,
+		events:     make(chan dispatchEvent, queueSize),
+		timeout:    options.listenerTimeout,
+	}
+
+	go func() {
+		for {
+			select {
+			case <-queue.done:
+				return
+			case event := <-queue.events:
+				if !queue.isClosed() {
+					entry.invoke(event.serviceName, event.event)
+				}
+			}
+		}
+	}()
+
+	return queue
+}
+
+func (this *listenerQueue) isClosed() bool {
+	select {
+	case <-this.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// enqueue adds an event to this queue.  If the queue is full, this method either blocks
+// or drops the oldest queued event, depending on how this queue was configured.  A blocked
+// enqueue is abandoned if this queue is closed.  When a listener timeout is configured, a
+// blocked enqueue waits at most that long, since a listener which hasn't taken an event for
+// the whole timeout is stuck.  The oldest queued event is then dropped instead, so that other
+// listeners continue to receive events.
+func (this *listenerQueue) enqueue(event dispatchEvent) {
+	if this.isClosed() {
+		return
+	}
+
+	if this.dropOldest {
+		this.enqueueDroppingOldest(event)
+	} else if this.timeout > 0 {
+		timer := time.NewTimer(this.timeout)
+		defer timer.Stop()
+		select {
+		case this.events <- event:
+		case <-this.done:
+		case <-timer.C:
+			this.enqueueDroppingOldest(event)
+		}
+	} else {
+		select {
+		case this.events <- event:
+		case <-this.done:
+		}
+	}
+}
+
+// enqueueDroppingOldest adds an event to this queue without blocking, discarding the oldest
+// queued events to make room.  This is the same approach as sendDroppingOldest.
+func (this *listenerQueue) enqueueDroppingOldest(event dispatchEvent) {
+	for {
+		select {
+		case this.events <- event:
+			return
+		default:
+			select {
+			case <-this.events:
+			default:
+			}
+		}
+	}
+}
+
+// close stops this queue.  Any events still queued are discarded.  This method is idempotent
+// and never blocks, so it is safe to call from the listener itself.
+func (this *listenerQueue) close() {
+	this.closeOnce.Do(func() {
+		close(this.done)
+	})
+}
+
+// listenerEntry is the internal record of a registered listener
+type listenerEntry struct {
+	logger    Logger
+	listener  Listener
+	group     string
+	cancelled uint32
+
+	// handler receives the events, and is the listener decorated by any middleware.  The listener
+	// itself identifies this entry.
+	handler Listener
+
+	// once is set for a listener which is removed after its first event, and fired is set
+	// once that event has been claimed
+	once  bool
+	fired uint32
+
+	// deliveryMutex serializes deliveries to this entry, so that the last-known Instances
+	// replayed when the listener is added always precede any dispatched event
+	deliveryMutex sync.Mutex
+
+	// timeout is how long an invocation may take before the listener is reported as slow,
+	// and metrics, which may be nil, counts those invocations
+	timeout time.Duration
+	metrics *watcherMetrics
+
+	// tracer, which may be nil, observes each invocation
+	tracer Tracer
+
+	// queue is nil unless AsyncDispatch is used, in which case executor is nil.  Otherwise,
+	// the listener is invoked through the executor.
+	queue    *listenerQueue
+	executor Executor
+}
+
+// newListenerEntry creates the entry for a listener, starting a listenerQueue if
+// the options call for asynchronous dispatch
+func newListenerEntry(logger Logger, listener Listener, options dispatchOptions, metrics *watcherMetrics) *listenerEntry {
+	entry := &listenerEntry{
+		logger:   logger,
+		listener: listener,
+		handler:  listener,
+		timeout:  options.listenerTimeout,
+		metrics:  metrics,
+		tracer:   options.tracer,
+		executor: SynchronousExecutor,
+	}
+
+	if options.middleware != nil {
+		entry.handler = options.middleware(listener)
+	}
+
+	if options.async {
+		entry.queue = newListenerQueue(entry, options)
+		entry.executor = nil
+	} else if options.executor != nil {
+		entry.executor = NewSerialExecutor(options.executor)
+	}
+
+	return entry
+}
+
+// invoke delivers an event directly to the listener.  If a timeout is configured and the
+// listener has not returned when it elapses, a warning is logged and the slow listener is
+// counted.  The listener itself cannot be interrupted, so it is left to finish.
+func (this *listenerEntry) invoke(serviceName string, event InstanceEvent) {
+	if this.timeout > 0 {
+		timer := time.AfterFunc(this.timeout, func() {
+			this.logger.Error(
+				"Slow listener: %s has not finished handling [%s] services after %s",
+				listenerLabel(this.listener), serviceName, this.timeout,
+			)
+
+			if this.metrics != nil {
+				atomic.AddUint64(&this.metrics.slowListeners, 1)
+			}
+		})
+
+		defer timer.Stop()
+	}
+
+	if this.tracer != nil {
+		defer this.tracer.StartDispatch(serviceName, listenerLabel(this.listener), event.Sequence)()
+	}
+
+	invokeListener(this.logger, this.handler, serviceName, event)
+	if this.once {
+		this.cancel()
+	}
+}
+
+// deliver either invokes the listener through this entry's executor or enqueues the event.
+// Nothing is delivered once this entry has been cancelled.
+func (this *listenerEntry) deliver(serviceName string, event InstanceEvent) {
+	this.deliveryMutex.Lock()
+	defer this.deliveryMutex.Unlock()
+	this.deliverLocked(serviceName, event)
+}
+
+// deliverLocked is the unsynchronized portion of deliver.  Callers must hold the deliveryMutex.
+func (this *listenerEntry) deliverLocked(serviceName string, event InstanceEvent) {
+	if this.isCancelled() {
+		return
+	} else if this.once && !atomic.CompareAndSwapUint32(&this.fired, 0, 1) {
+		return
+	}
+
+	if this.queue != nil {
+		this.queue.enqueue(dispatchEvent{serviceName, event})
+	} else {
+		this.executor.Execute(func() {
+			// an executor may run the task after this entry has been cancelled
+			if !this.isCancelled() {
+				this.invoke(serviceName, event)
+			}
+		})
+	}
+}
+
+func (this *listenerEntry) isCancelled() bool {
+	return atomic.LoadUint32(&this.cancelled) != 0
+}
+
+// cancel marks this entry as cancelled and releases any resources associated with it.
+// This method does not require any locks, which makes it safe to call from within a
+// listener callback.  It is idempotent.
+func (this *listenerEntry) cancel() {
+	atomic.StoreUint32(&this.cancelled, 1)
+	if this.queue != nil {
+		this.queue.close()
+	}
+}
+
+// listenerRegistration is the Registration implementation for a listener added to a serviceWatcher
+type listenerRegistration struct {
+	entry *listenerEntry
+}
+
+var _ Registration = (*listenerRegistration)(nil)
+
+// Cancel marks the listener's entry as cancelled.  The serviceWatcher prunes cancelled
+// entries the next time its listeners are modified or dispatched to.
+func (this *listenerRegistration) Cancel() {
+	this.entry.cancel()
+}
@@ -0,0 +1,387 @@
+package service
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// blockingListener is a Listener that blocks each invocation until released
+type blockingListener struct {
+	release  chan struct{}
+	received chan string
+}
+
+func newBlockingListener() *blockingListener {
+	return &blockingListener{
+		release:  make(chan struct{}),
+		received: make(chan string, 100),
+	}
+}
+
+func (this *blockingListener) ServicesChanged(serviceName string, instances Instances) {
+	<-this.release
+	this.received <- instances[0].Id
+}
+
+func testEventWithId(id string) dispatchEvent {
+	instances := testInstancesWithIds(id)
+	return dispatchEvent{testServiceName, InstanceEvent{Added: instances, Current: instances}}
+}
+
+func TestAsyncDispatchPreservesOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	listener := newBlockingListener()
+	close(listener.release)
+	serviceWatcher := &serviceWatcher{
+		serviceName:     testServiceName,
+		logger:          &testLogger{t},
+		dispatchOptions: dispatchOptions{async: true, queueSize: 5},
+	}
+
+	serviceWatcher.addListener(listener)
+	for index := 0; index < 50; index++ {
+		serviceWatcher.dispatch(testInstancesWithIds(strconv.Itoa(index)))
+	}
+
+	for index := 0; index < 50; index++ {
+		select {
+		case id := <-listener.received:
+			assert.Equal(strconv.Itoa(index), id)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Event %d was not delivered", index)
+		}
+	}
+
+	serviceWatcher.removeAllListeners()
+}
+
+func TestAsyncDispatchDoesNotBlockOtherListeners(t *testing.T) {
+	slow := newBlockingListener()
+	defer close(slow.release)
+
+	fast := newBlockingListener()
+	close(fast.release)
+
+	serviceWatcher := &serviceWatcher{
+		serviceName:     testServiceName,
+		logger:          &testLogger{t},
+		dispatchOptions: dispatchOptions{async: true, queueSize: 1, dropOldest: true},
+	}
+
+	serviceWatcher.addListener(slow)
+	serviceWatcher.addListener(fast)
+	defer serviceWatcher.removeAllListeners()
+
+	for index := 0; index < 5; index++ {
+		serviceWatcher.dispatch(testInstancesWithIds(strconv.Itoa(index)))
+		select {
+		case <-fast.received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("The fast listener was blocked by the slow listener")
+		}
+	}
+}
+
+func TestListenerQueueDropOldest(t *testing.T) {
+	assert := assert.New(t)
+
+	listener := newBlockingListener()
+	queue := newListenerQueue(&listenerEntry{logger: &testLogger{t}, listener: listener, handler: listener}, dispatchOptions{async: true, queueSize: 2, dropOldest: true})
+
+	// the first event is taken by the delivery goroutine, which then blocks
+	queue.enqueue(testEventWithId("first"))
+	time.Sleep(100 * time.Millisecond)
+
+	for index := 0; index < 10; index++ {
+		queue.enqueue(testEventWithId(strconv.Itoa(index)))
+	}
+
+	close(listener.release)
+
+	var delivered []string
+	for index := 0; index < 3; index++ {
+		select {
+		case id := <-listener.received:
+			delivered = append(delivered, id)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected events were not delivered")
+		}
+	}
+
+	assert.Equal([]string{"first", "8", "9"}, delivered)
+	queue.close()
+	queue.close()
+}
+
+func TestListenerQueueBlocksWhenFull(t *testing.T) {
+	listener := newBlockingListener()
+	queue := newListenerQueue(&listenerEntry{logger: &testLogger{t}, listener: listener, handler: listener}, dispatchOptions{async: true, queueSize: 1})
+	defer queue.close()
+
+	queue.enqueue(testEventWithId("first"))
+	time.Sleep(100 * time.Millisecond)
+	queue.enqueue(testEventWithId("second"))
+
+	enqueued := make(chan struct{})
+	go func() {
+		queue.enqueue(testEventWithId("third"))
+		close(enqueued)
+	}()
+
+	select {
+	case <-enqueued:
+		t.Fatalf("Enqueue should block when the queue is full")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(listener.release)
+	select {
+	case <-enqueued:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Enqueue did not unblock after the listener drained the queue")
+	}
+}
+
+func TestDispatchRecoversFromPanickingListener(t *testing.T) {
+	for _, async := range []bool{false, true} {
+		t.Logf("async=%t", async)
+		assert := assert.New(t)
+
+		received := make(chan string, 10)
+		serviceWatcher := &serviceWatcher{
+			serviceName:     testServiceName,
+			logger:          &testLogger{t},
+			dispatchOptions: dispatchOptions{async: async},
+		}
+
+		serviceWatcher.addListener(ListenerFunc(func(serviceName string, instances Instances) {
+			panic("deliberate panic from a test listener")
+		}))
+
+		serviceWatcher.addListener(ListenerFunc(func(serviceName string, instances Instances) {
+			received <- instances[0].Id
+		}))
+
+		for _, id := range []string{"first", "second"} {
+			serviceWatcher.dispatch(testInstancesWithIds(id))
+			select {
+			case actual := <-received:
+				assert.Equal(id, actual)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("The second listener did not receive the %s event", id)
+			}
+		}
+
+		serviceWatcher.removeAllListeners()
+	}
+}
+
+// namedListener is a Listener which identifies itself in log messages
+type namedListener struct {
+	ListenerFunc
+}
+
+func (this namedListener) String() string {
+	return "named"
+}
+
+func TestListenerLabel(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("*service.blockingListener", listenerLabel(newBlockingListener()))
+	assert.Equal("service.ListenerFunc", listenerLabel(ListenerFunc(func(string, Instances) {})))
+	assert.Equal("named", listenerLabel(namedListener{}))
+}
+
+// waitForSlowListeners waits until the watcher has counted the expected number of slow listeners
+func waitForSlowListeners(t *testing.T, serviceWatcher *serviceWatcher, expected uint64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for serviceWatcher.metricsSnapshot().SlowListeners < expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d slow listeners, but only %d were counted", expected, serviceWatcher.metricsSnapshot().SlowListeners)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSlowListenerIsReported(t *testing.T) {
+	for _, async := range []bool{false, true} {
+		t.Logf("async=%t", async)
+		assert := assert.New(t)
+
+		listener := newBlockingListener()
+		serviceWatcher := &serviceWatcher{
+			serviceName:     testServiceName,
+			logger:          &testLogger{t},
+			dispatchOptions: dispatchOptions{async: async, listenerTimeout: 20 * time.Millisecond},
+		}
+
+		serviceWatcher.addListener(listener)
+		dispatched := make(chan struct{})
+		go func() {
+			serviceWatcher.dispatch(testInstancesWithIds("first"))
+			close(dispatched)
+		}()
+
+		waitForSlowListeners(t, serviceWatcher, 1)
+		close(listener.release)
+		<-dispatched
+		select {
+		case id := <-listener.received:
+			assert.Equal("first", id)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("The slow listener did not finish")
+		}
+
+		// a listener that finishes within the timeout is not counted
+		serviceWatcher.dispatch(testInstancesWithIds("second"))
+		<-listener.received
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(uint64(1), serviceWatcher.metricsSnapshot().SlowListeners)
+		serviceWatcher.removeAllListeners()
+	}
+}
+
+func TestSlowListenerDoesNotBlockAsyncDispatch(t *testing.T) {
+	assert := assert.New(t)
+	slow := newBlockingListener()
+	fast := newBlockingListener()
+	close(fast.release)
+
+	serviceWatcher := &serviceWatcher{
+		serviceName:     testServiceName,
+		logger:          &testLogger{t},
+		dispatchOptions: dispatchOptions{async: true, queueSize: 1, listenerTimeout: 20 * time.Millisecond},
+	}
+
+	serviceWatcher.addListener(slow)
+	serviceWatcher.addListener(fast)
+	defer serviceWatcher.removeAllListeners()
+
+	// with the block policy, the slow listener's full queue would otherwise stall every dispatch
+	for index := 0; index < 5; index++ {
+		serviceWatcher.dispatch(testInstancesWithIds(strconv.Itoa(index)))
+		select {
+		case id := <-fast.received:
+			assert.Equal(strconv.Itoa(index), id)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("The fast listener was blocked by the slow listener")
+		}
+	}
+
+	waitForSlowListeners(t, serviceWatcher, 1)
+
+	// the slow listener receives the event it was handling, then the most recent event
+	close(slow.release)
+	var delivered []string
+	for index := 0; index < 2; index++ {
+		select {
+		case id := <-slow.received:
+			delivered = append(delivered, id)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected events were not delivered to the slow listener")
+		}
+	}
+
+	assert.Equal([]string{"0", "4"}, delivered)
+}
+
+func TestListenerTimeoutOption(t *testing.T) {
+	assert := assert.New(t)
+
+	var testData = []struct {
+		builder         DiscoveryBuilder
+		expectedTimeout time.Duration
+		expectedError   error
+	}{
+		{DiscoveryBuilder{}, 0, nil},
+		{DiscoveryBuilder{ListenerTimeout: "250ms"}, 250 * time.Millisecond, nil},
+		{DiscoveryBuilder{ListenerTimeout: "5"}, 5 * time.Second, nil},
+		{DiscoveryBuilder{ListenerTimeout: "-1s"}, 0, ErrorInvalidListenerTimeout},
+		{DiscoveryBuilder{ListenerTimeout: "eventually"}, 0, ErrorInvalidListenerTimeout},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		options, err := record.builder.dispatchOptions()
+		assert.Equal(record.expectedError, err)
+		if err == nil {
+			assert.Equal(record.expectedTimeout, options.listenerTimeout)
+		}
+	}
+}
+
+func TestDuplicateListenerOption(t *testing.T) {
+	assert := assert.New(t)
+
+	var testData = []struct {
+		builder                  DiscoveryBuilder
+		expectedRejectDuplicates bool
+		expectedError            error
+	}{
+		{DiscoveryBuilder{}, false, nil},
+		{DiscoveryBuilder{DuplicateListener: DuplicateListenerIgnore}, false, nil},
+		{DiscoveryBuilder{DuplicateListener: DuplicateListenerError}, true, nil},
+		{DiscoveryBuilder{DuplicateListener: "sometimes"}, false, ErrorInvalidDuplicateListener},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		options, err := record.builder.dispatchOptions()
+		assert.Equal(record.expectedError, err)
+		if err == nil {
+			assert.Equal(record.expectedRejectDuplicates, options.rejectDuplicates)
+		}
+	}
+}
+
+func TestRevisionsFollowDispatchOrder(t *testing.T) {
+	for _, async := range []bool{false, true} {
+		t.Logf("async=%t", async)
+		assert := assert.New(t)
+
+		received := make(chan InstanceEvent, 100)
+		serviceWatcher := &serviceWatcher{
+			serviceName:     testServiceName,
+			logger:          &testLogger{t},
+			dispatchOptions: dispatchOptions{async: async, queueSize: 100},
+		}
+
+		serviceWatcher.addListener(InstancesListenerFunc(func(serviceName string, event InstanceEvent) {
+			received <- event
+		}))
+
+		_, _, initialized := serviceWatcher.cachedRevision()
+		assert.False(initialized)
+
+		for index := 0; index < 20; index++ {
+			instances := testInstancesWithIds(strconv.Itoa(index))
+			serviceWatcher.dispatch(instances)
+
+			cached, revision, initialized := serviceWatcher.cachedRevision()
+			assert.True(initialized)
+			assert.Equal(instances, cached)
+			assert.Equal(uint64(index+1), revision)
+		}
+
+		// a snapshot with unchanged membership keeps its revision
+		serviceWatcher.dispatch(testInstancesWithIds("19"))
+		_, revision, _ := serviceWatcher.cachedRevision()
+		assert.Equal(uint64(20), revision)
+
+		for index := 0; index < 20; index++ {
+			select {
+			case event := <-received:
+				assert.Equal(uint64(index+1), event.Sequence)
+				assert.Equal(strconv.Itoa(index), event.Current[0].Id)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Event %d was not delivered", index)
+			}
+		}
+
+		serviceWatcher.removeAllListeners()
+	}
+}
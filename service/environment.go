@@ -0,0 +1,335 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"github.com/foursquare/fsgo/net/discovery"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultEnvironmentPrefix is the prefix of the environment variables read by
+	// NewDiscoveryBuilderFromEnvironment when no prefix is supplied
+	DefaultEnvironmentPrefix = "DISCOVERY"
+)
+
+var (
+	ErrorNoSuitableAddress = errors.New("No non-loopback IPv4 address could be detected")
+)
+
+// instanceOptions holds the configuration applied by InstanceOptions
+type instanceOptions struct {
+	interfaceName string
+	useHostname   bool
+	address       string
+	sslPort       *int
+	payload       *string
+}
+
+// InstanceOption configures how NewInstanceFromEnvironment builds a ServiceInstance
+type InstanceOption func(*instanceOptions)
+
+// WithInterface restricts address detection to the network interface with the given name, e.g. "eth0"
+func WithInterface(interfaceName string) InstanceOption {
+	return func(options *instanceOptions) {
+		options.interfaceName = interfaceName
+	}
+}
+
+// WithHostname uses the host name reported by the operating system as the address,
+// rather than detecting an IP address
+func WithHostname() InstanceOption {
+	return func(options *instanceOptions) {
+		options.useHostname = true
+	}
+}
+
+// WithAddress uses the given address as is, bypassing any detection
+func WithAddress(address string) InstanceOption {
+	return func(options *instanceOptions) {
+		options.address = address
+	}
+}
+
+// WithSslPort sets the SslPort of the ServiceInstance
+func WithSslPort(sslPort int) InstanceOption {
+	return func(options *instanceOptions) {
+		options.sslPort = &sslPort
+	}
+}
+
+// WithPayload sets the Payload of the ServiceInstance
+func WithPayload(payload string) InstanceOption {
+	return func(options *instanceOptions) {
+		options.payload = &payload
+	}
+}
+
+// selectAddress returns the first non-loopback IPv4 address among the given addresses
+func selectAddress(addresses []net.Addr) (string, bool) {
+	for _, address := range addresses {
+		var ip net.IP
+		switch value := address.(type) {
+		case *net.IPNet:
+			ip = value.IP
+		case *net.IPAddr:
+			ip = value.IP
+		}
+
+		if ip != nil && !ip.IsLoopback() && ip.To4() != nil {
+			return ip.String(), true
+		}
+	}
+
+	return "", false
+}
+
+// detectAddress returns the primary non-loopback IPv4 address of this host.  If interfaceName
+// is not empty, only that interface is considered.  Otherwise, the first interface that is up
+// and has a suitable address is used.
+func detectAddress(interfaceName string) (string, error) {
+	if len(interfaceName) > 0 {
+		networkInterface, err := net.InterfaceByName(interfaceName)
+		if err != nil {
+			return "", errors.New(
+				fmt.Sprintf("Unable to obtain network interface %s: %v", interfaceName, err),
+			)
+		}
+
+		addresses, err := networkInterface.Addrs()
+		if err != nil {
+			return "", errors.New(
+				fmt.Sprintf("Unable to obtain addresses for network interface %s: %v", interfaceName, err),
+			)
+		}
+
+		if address, ok := selectAddress(addresses); ok {
+			return address, nil
+		}
+
+		return "", errors.New(
+			fmt.Sprintf("Network interface %s has no non-loopback IPv4 address", interfaceName),
+		)
+	}
+
+	networkInterfaces, err := net.Interfaces()
+	if err != nil {
+		return "", errors.New(
+			fmt.Sprintf("Unable to obtain network interfaces: %v", err),
+		)
+	}
+
+	for _, networkInterface := range networkInterfaces {
+		if networkInterface.Flags&net.FlagUp == 0 || networkInterface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		// skip interfaces whose addresses cannot be read, since another interface may be suitable
+		if addresses, err := networkInterface.Addrs(); err == nil {
+			if address, ok := selectAddress(addresses); ok {
+				return address, nil
+			}
+		}
+	}
+
+	return "", ErrorNoSuitableAddress
+}
+
+// NewInstanceFromEnvironment creates a ServiceInstance for this host, suitable for registration.
+// By default, the address is the first non-loopback IPv4 address of any network interface that
+// is up.  If no such address exists, an error is returned rather than falling back to loopback.
+// The options can restrict detection to a particular interface, use the host name instead, or
+// supply the address directly.  When more than one of these options is given, WithAddress takes
+// precedence over WithHostname, which takes precedence over WithInterface.
+func NewInstanceFromEnvironment(serviceName string, port int, options ...InstanceOption) (*discovery.ServiceInstance, error) {
+	configuration := &instanceOptions{}
+	for _, option := range options {
+		option(configuration)
+	}
+
+	address := configuration.address
+	if len(address) == 0 {
+		var err error
+		if configuration.useHostname {
+			if address, err = os.Hostname(); err != nil {
+				return nil, errors.New(
+					fmt.Sprintf("Unable to obtain the host name: %v", err),
+				)
+			}
+		} else if address, err = detectAddress(configuration.interfaceName); err != nil {
+			return nil, err
+		}
+	}
+
+	return discovery.NewServiceInstance(
+		serviceName,
+		address,
+		&port,
+		configuration.sslPort,
+		configuration.payload,
+	), nil
+}
+
+// environment reads the environment variables for a single prefix, recording the
+// problems with any invalid values
+type environment struct {
+	prefix string
+	lookup func(string) (string, bool)
+	errors EnvironmentError
+}
+
+// name returns the full name of the environment variable with the given suffix
+func (this *environment) name(suffix string) string {
+	return this.prefix + "_" + suffix
+}
+
+// get returns the trimmed value of the environment variable with the given suffix.
+// Variables that are unset or blank are treated the same.
+func (this *environment) get(suffix string) (string, bool) {
+	value, ok := this.lookup(this.name(suffix))
+	value = strings.TrimSpace(value)
+	return value, ok && len(value) > 0
+}
+
+// invalid records a problem with the environment variable with the given suffix
+func (this *environment) invalid(suffix, value, reason string) {
+	this.errors = append(this.errors, EnvironmentVariableError{this.name(suffix), value, reason})
+}
+
+// port returns the value of the environment variable with the given suffix as a port number
+func (this *environment) port(suffix string) (int, bool) {
+	value, ok := this.get(suffix)
+	if !ok {
+		return 0, false
+	}
+
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		this.invalid(suffix, value, "must be a port number between 1 and 65535")
+		return 0, false
+	}
+
+	return port, true
+}
+
+// registration builds the ServiceInstance described by the REGISTER_* variables, if any
+func (this *environment) registration() *discovery.ServiceInstance {
+	serviceName, hasName := this.get("REGISTER_NAME")
+	port, hasPort := this.port("REGISTER_PORT")
+
+	var options []InstanceOption
+	if address, ok := this.get("REGISTER_ADDRESS"); ok {
+		options = append(options, WithAddress(address))
+	}
+
+	if sslPort, ok := this.port("REGISTER_SSL_PORT"); ok {
+		options = append(options, WithSslPort(sslPort))
+	}
+
+	if !hasName {
+		return nil
+	} else if reason := validateZnodeName(serviceName); len(reason) > 0 {
+		this.invalid("REGISTER_NAME", serviceName, reason)
+		return nil
+	} else if !hasPort {
+		// an invalid port has already been recorded
+		if _, ok := this.get("REGISTER_PORT"); !ok {
+			this.invalid("REGISTER_PORT", "", "is required when "+this.name("REGISTER_NAME")+" is set")
+		}
+
+		return nil
+	}
+
+	registration, err := NewInstanceFromEnvironment(serviceName, port, options...)
+	if err != nil {
+		this.invalid("REGISTER_NAME", serviceName, err.Error())
+		return nil
+	}
+
+	return registration
+}
+
+// NewDiscoveryBuilderFromEnvironment creates a DiscoveryBuilder from environment variables, each
+// named with the given prefix followed by an underscore.  If prefix is empty, DefaultEnvironmentPrefix
+// is used.  With the default prefix, the following variables are read:
+//
+//	DISCOVERY_SERVERS            the zookeeper connection string, e.g. "zk1:2181,zk2:2181"
+//	DISCOVERY_BASE_PATH          the BasePath
+//	DISCOVERY_WATCHES            a comma-separated list of service names to watch
+//	DISCOVERY_CONNECT_TIMEOUT    the ConnectTimeout, as a time.Duration or integral seconds
+//	DISCOVERY_SESSION_TIMEOUT    the SessionTimeout, as a time.Duration or integral seconds
+//	DISCOVERY_REGISTER_NAME      the name of a service instance to register for this host
+//	DISCOVERY_REGISTER_PORT      the port of the registration, required with DISCOVERY_REGISTER_NAME
+//	DISCOVERY_REGISTER_SSL_PORT  the optional SSL port of the registration
+//	DISCOVERY_REGISTER_ADDRESS   the address of the registration, detected as with
+//	                             NewInstanceFromEnvironment if not set
+//
+// Variables that are unset or blank leave the corresponding field unset.  Every variable is
+// validated, and an EnvironmentError describing all invalid values is returned.  The returned
+// builder can be modified further before calling New, e.g. to override or add to the environment.
+func NewDiscoveryBuilderFromEnvironment(prefix string) (*DiscoveryBuilder, error) {
+	return newDiscoveryBuilderFromEnvironment(prefix, os.LookupEnv)
+}
+
+// newDiscoveryBuilderFromEnvironment is the internal implementation of
+// NewDiscoveryBuilderFromEnvironment, reading variables with the given lookup function
+func newDiscoveryBuilderFromEnvironment(prefix string, lookup func(string) (string, bool)) (*DiscoveryBuilder, error) {
+	if len(prefix) == 0 {
+		prefix = DefaultEnvironmentPrefix
+	}
+
+	environment := &environment{prefix: prefix, lookup: lookup}
+	builder := &DiscoveryBuilder{}
+
+	if servers, ok := environment.get("SERVERS"); ok {
+		builder.Connection = servers
+	}
+
+	if basePath, ok := environment.get("BASE_PATH"); ok {
+		if _, err := normalizeBasePath(basePath); err != nil {
+			environment.invalid("BASE_PATH", basePath, err.Error())
+		} else {
+			builder.BasePath = basePath
+		}
+	}
+
+	if watches, ok := environment.get("WATCHES"); ok {
+		for _, serviceName := range strings.Split(watches, ",") {
+			builder.Watches = append(builder.Watches, strings.TrimSpace(serviceName))
+		}
+
+		if err := validateServiceNames(builder.Watches); err != nil {
+			environment.invalid("WATCHES", watches, err.Error())
+			builder.Watches = nil
+		}
+	}
+
+	if connectTimeout, ok := environment.get("CONNECT_TIMEOUT"); ok {
+		if timeout, valid := parseInterval(connectTimeout, 0); !valid || timeout <= 0 {
+			environment.invalid("CONNECT_TIMEOUT", connectTimeout, "must be a positive time.Duration or integral seconds value")
+		} else {
+			builder.ConnectTimeout = connectTimeout
+		}
+	}
+
+	if sessionTimeout, ok := environment.get("SESSION_TIMEOUT"); ok {
+		if timeout, valid := parseInterval(sessionTimeout, 0); !valid || timeout <= 0 {
+			environment.invalid("SESSION_TIMEOUT", sessionTimeout, "must be a positive time.Duration or integral seconds value")
+		} else {
+			builder.SessionTimeout = sessionTimeout
+		}
+	}
+
+	if registration := environment.registration(); registration != nil {
+		builder.Registrations = Instances{registration}
+	}
+
+	if err := environment.errors.errorOrNil(); err != nil {
+		return nil, err
+	}
+
+	return builder, nil
+}
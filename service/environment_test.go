@@ -0,0 +1,218 @@
+package service
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSelectAddress(t *testing.T) {
+	var testData = []struct {
+		addresses       []net.Addr
+		expectedAddress string
+		expectedOk      bool
+	}{
+		{nil, "", false},
+		{
+			[]net.Addr{&net.IPNet{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(8, 32)}},
+			"",
+			false,
+		},
+		{
+			[]net.Addr{
+				&net.IPNet{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(8, 32)},
+				&net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)},
+				&net.IPNet{IP: net.ParseIP("10.1.2.3"), Mask: net.CIDRMask(8, 32)},
+				&net.IPNet{IP: net.ParseIP("192.168.1.1"), Mask: net.CIDRMask(24, 32)},
+			},
+			"10.1.2.3",
+			true,
+		},
+		{
+			[]net.Addr{&net.IPAddr{IP: net.ParseIP("172.16.0.5")}},
+			"172.16.0.5",
+			true,
+		},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+		address, ok := selectAddress(record.addresses)
+		assert.Equal(record.expectedAddress, address)
+		assert.Equal(record.expectedOk, ok)
+	}
+}
+
+func TestNewInstanceFromEnvironmentWithAddress(t *testing.T) {
+	assert := assert.New(t)
+
+	serviceInstance, err := NewInstanceFromEnvironment(
+		testServiceName,
+		8080,
+		WithInterface("no-such-interface"),
+		WithHostname(),
+		WithAddress("service.example.com"),
+		WithSslPort(8443),
+		WithPayload(`{"weight": 2}`),
+	)
+
+	assert.Nil(err)
+	if assert.NotNil(serviceInstance) {
+		assert.Equal(testServiceName, serviceInstance.Name)
+		assert.NotEmpty(serviceInstance.Id)
+		assert.Equal("service.example.com", serviceInstance.Address)
+		assert.Equal(8080, *serviceInstance.Port)
+		assert.Equal(8443, *serviceInstance.SslPort)
+		assert.Equal(`{"weight": 2}`, *serviceInstance.Payload)
+	}
+}
+
+func TestNewInstanceFromEnvironmentWithHostname(t *testing.T) {
+	assert := assert.New(t)
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Skipf("No host name available: %v", err)
+	}
+
+	serviceInstance, err := NewInstanceFromEnvironment(testServiceName, 8080, WithHostname())
+	assert.Nil(err)
+	if assert.NotNil(serviceInstance) {
+		assert.Equal(hostname, serviceInstance.Address)
+		assert.Nil(serviceInstance.SslPort)
+		assert.Nil(serviceInstance.Payload)
+	}
+}
+
+func TestNewInstanceFromEnvironmentDetectsAddress(t *testing.T) {
+	assert := assert.New(t)
+
+	serviceInstance, err := NewInstanceFromEnvironment(testServiceName, 8080)
+	if err == ErrorNoSuitableAddress {
+		t.Skip("This host has no non-loopback IPv4 address")
+	}
+
+	assert.Nil(err)
+	if assert.NotNil(serviceInstance) {
+		ip := net.ParseIP(serviceInstance.Address)
+		if assert.NotNil(ip) {
+			assert.NotNil(ip.To4())
+			assert.False(ip.IsLoopback())
+		}
+	}
+
+	serviceInstance, err = NewInstanceFromEnvironment(testServiceName, 8080, WithInterface("no-such-interface"))
+	assert.Nil(serviceInstance)
+	assert.NotNil(err)
+}
+
+// environmentLookup returns a lookup function over the given variables, in place of os.LookupEnv
+func environmentLookup(variables map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := variables[name]
+		return value, ok
+	}
+}
+
+func TestNewDiscoveryBuilderFromEnvironment(t *testing.T) {
+	assert := assert.New(t)
+
+	builder, err := newDiscoveryBuilderFromEnvironment("", environmentLookup(map[string]string{
+		"DISCOVERY_SERVERS":           "zk1:2181,zk2:2181",
+		"DISCOVERY_BASE_PATH":         testBasePath,
+		"DISCOVERY_WATCHES":           "foo, bar ,baz",
+		"DISCOVERY_CONNECT_TIMEOUT":   "5s",
+		"DISCOVERY_SESSION_TIMEOUT":   "30",
+		"DISCOVERY_REGISTER_NAME":     testServiceName,
+		"DISCOVERY_REGISTER_PORT":     "8080",
+		"DISCOVERY_REGISTER_SSL_PORT": "8443",
+		"DISCOVERY_REGISTER_ADDRESS":  "service.example.com",
+		"OTHER_SERVERS":               "ignored:2181",
+	}))
+
+	assert.Nil(err)
+	if assert.NotNil(builder) {
+		assert.Equal("zk1:2181,zk2:2181", builder.Connection)
+		assert.Equal(testBasePath, builder.BasePath)
+		assert.Equal([]string{"foo", "bar", "baz"}, builder.Watches)
+		assert.Equal("5s", builder.ConnectTimeout)
+		assert.Equal("30", builder.SessionTimeout)
+		if assert.Len(builder.Registrations, 1) {
+			registration := builder.Registrations[0]
+			assert.Equal(testServiceName, registration.Name)
+			assert.Equal("service.example.com", registration.Address)
+			assert.Equal(8080, *registration.Port)
+			assert.Equal(8443, *registration.SslPort)
+		}
+
+		// programmatic overrides compose with the environment
+		builder.Watches = append(builder.Watches, "qux")
+		builder.ConnectTimeout = "10s"
+		connectTimeout, err := builder.connectTimeout()
+		assert.Equal(10*time.Second, connectTimeout)
+		assert.Nil(err)
+	}
+}
+
+func TestNewDiscoveryBuilderFromEnvironmentPrefix(t *testing.T) {
+	assert := assert.New(t)
+
+	builder, err := newDiscoveryBuilderFromEnvironment("MYAPP", environmentLookup(map[string]string{
+		"DISCOVERY_SERVERS": "ignored:2181",
+		"MYAPP_SERVERS":     "zk:2181",
+		"MYAPP_WATCHES":     "  ",
+	}))
+
+	assert.Nil(err)
+	if assert.NotNil(builder) {
+		assert.Equal(DiscoveryBuilder{Connection: "zk:2181"}, *builder)
+	}
+}
+
+func TestNewDiscoveryBuilderFromEnvironmentErrors(t *testing.T) {
+	var testData = []struct {
+		variables     map[string]string
+		expectedNames []string
+	}{
+		{
+			map[string]string{
+				"DISCOVERY_BASE_PATH":         "relative",
+				"DISCOVERY_WATCHES":           "foo,,bar",
+				"DISCOVERY_CONNECT_TIMEOUT":   "soon",
+				"DISCOVERY_REGISTER_NAME":     testServiceName,
+				"DISCOVERY_REGISTER_PORT":     "http",
+				"DISCOVERY_REGISTER_SSL_PORT": "70000",
+			},
+			[]string{"DISCOVERY_BASE_PATH", "DISCOVERY_WATCHES", "DISCOVERY_CONNECT_TIMEOUT", "DISCOVERY_REGISTER_PORT", "DISCOVERY_REGISTER_SSL_PORT"},
+		},
+		{
+			map[string]string{"DISCOVERY_CONNECT_TIMEOUT": "0"},
+			[]string{"DISCOVERY_CONNECT_TIMEOUT"},
+		},
+		{
+			map[string]string{"DISCOVERY_SESSION_TIMEOUT": "-5s"},
+			[]string{"DISCOVERY_SESSION_TIMEOUT"},
+		},
+		{
+			map[string]string{"DISCOVERY_REGISTER_NAME": testServiceName},
+			[]string{"DISCOVERY_REGISTER_PORT"},
+		},
+		{
+			map[string]string{"DISCOVERY_REGISTER_NAME": "a/b", "DISCOVERY_REGISTER_PORT": "8080"},
+			[]string{"DISCOVERY_REGISTER_NAME"},
+		},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+		builder, err := newDiscoveryBuilderFromEnvironment(DefaultEnvironmentPrefix, environmentLookup(record.variables))
+		assert.Nil(builder)
+		if environmentError, ok := err.(EnvironmentError); assert.True(ok) {
+			assert.Equal(record.expectedNames, environmentError.Names())
+		}
+	}
+}
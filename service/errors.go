@@ -0,0 +1,353 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/foursquare/fsgo/net/discovery"
+)
+
+// InstanceError associates an error with the ServiceInstance that caused it
+type InstanceError struct {
+	Instance *discovery.ServiceInstance
+	Err      error
+}
+
+func (this InstanceError) Error() string {
+	return fmt.Sprintf("%s [%s]: %v", this.Instance.Id, this.Instance.Name, this.Err)
+}
+
+// Unwrap returns the underlying error, so that errors.Is and errors.As see through an InstanceError
+func (this InstanceError) Unwrap() error {
+	return this.Err
+}
+
+// InstanceErrorFunc is invoked for each child znode that a watcher skips because its data
+// could not be read or deserialized.  The data is nil if the znode could not be read.
+// Since child znodes are read concurrently, this function must be safe for concurrent use.
+type InstanceErrorFunc func(servicePath, childId string, data []byte, err error)
+
+// aggregateError is implemented by each error which aggregates the errors from a batch, such as
+// MultiError, so that they are all formatted and matched in the same way
+type aggregateError interface {
+	error
+	len() int
+	errorAt(index int) error
+}
+
+// joinErrors formats an aggregateError as the count and description, followed by each error in
+// order, e.g. "2 error(s) occurred: ...; ..."
+func joinErrors(description string, aggregate aggregateError) string {
+	var output bytes.Buffer
+	output.WriteString(fmt.Sprintf("%d %s: ", aggregate.len(), description))
+	for index := 0; index < aggregate.len(); index++ {
+		if index > 0 {
+			output.WriteString("; ")
+		}
+
+		output.WriteString(aggregate.errorAt(index).Error())
+	}
+
+	return output.String()
+}
+
+// anyErrorIs tests whether any of the aggregated errors is the target.  This allows errors.Is to
+// see through an aggregateError, since Unwrap cannot return several errors before Go 1.20.
+func anyErrorIs(aggregate aggregateError, target error) bool {
+	for index := 0; index < aggregate.len(); index++ {
+		if errors.Is(aggregate.errorAt(index), target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// anyErrorAs finds the first of the aggregated errors which matches the target, as with errors.As
+func anyErrorAs(aggregate aggregateError, target interface{}) bool {
+	for index := 0; index < aggregate.len(); index++ {
+		if errors.As(aggregate.errorAt(index), target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// aggregateOrNil returns the aggregateError, or nil if it is empty
+func aggregateOrNil(aggregate aggregateError) error {
+	if aggregate.len() > 0 {
+		return aggregate
+	}
+
+	return nil
+}
+
+// MultiError aggregates the errors from a batch operation over Instances.  Batch
+// operations attempt every ServiceInstance rather than failing on the first error,
+// and return a MultiError describing everything that failed.
+type MultiError []InstanceError
+
+func (this MultiError) Error() string {
+	return joinErrors("error(s) occurred", this)
+}
+
+func (this MultiError) Is(target error) bool {
+	return anyErrorIs(this, target)
+}
+
+func (this MultiError) As(target interface{}) bool {
+	return anyErrorAs(this, target)
+}
+
+func (this MultiError) len() int {
+	return len(this)
+}
+
+func (this MultiError) errorAt(index int) error {
+	return this[index]
+}
+
+// Instances returns the ServiceInstance of each failure, in order, e.g. to retry them
+func (this MultiError) Instances() Instances {
+	instances := make(Instances, len(this))
+	for index, instanceError := range this {
+		instances[index] = instanceError.Instance
+	}
+
+	return instances
+}
+
+// errorOrNil returns this MultiError as an error, or nil if it is empty.  This avoids
+// the problem of a nil MultiError being returned as a non-nil error interface.
+func (this MultiError) errorOrNil() error {
+	return aggregateOrNil(this)
+}
+
+// ServiceNameError describes why a service name cannot be watched
+type ServiceNameError struct {
+	Name   string
+	Reason string
+}
+
+func (this ServiceNameError) Error() string {
+	return fmt.Sprintf("%q: %s", this.Name, this.Reason)
+}
+
+// ServiceNamesError aggregates the problems with every invalid service name in a batch,
+// rather than only the first
+type ServiceNamesError []ServiceNameError
+
+func (this ServiceNamesError) Error() string {
+	return joinErrors("invalid service name(s)", this)
+}
+
+func (this ServiceNamesError) Is(target error) bool {
+	return anyErrorIs(this, target)
+}
+
+func (this ServiceNamesError) As(target interface{}) bool {
+	return anyErrorAs(this, target)
+}
+
+func (this ServiceNamesError) len() int {
+	return len(this)
+}
+
+func (this ServiceNamesError) errorAt(index int) error {
+	return this[index]
+}
+
+// errorOrNil returns this ServiceNamesError as an error, or nil if it is empty
+func (this ServiceNamesError) errorOrNil() error {
+	return aggregateOrNil(this)
+}
+
+// ReadOnlyError describes a zookeeper write which was refused because the Discovery is read-only
+type ReadOnlyError struct {
+	Operation string
+	Path      string
+}
+
+func (this ReadOnlyError) Error() string {
+	return fmt.Sprintf("Cannot %s %s: %v", this.Operation, this.Path, ErrorReadOnly)
+}
+
+// Unwrap returns ErrorReadOnly, so that errors.Is sees through a ReadOnlyError
+func (this ReadOnlyError) Unwrap() error {
+	return ErrorReadOnly
+}
+
+// ServicePathCollisionError describes two watched services which would be read from the same
+// zookeeper path, e.g. a service with a configured path beneath the base path of another service
+type ServicePathCollisionError struct {
+	Path         string
+	ServiceNames []string
+}
+
+func (this ServicePathCollisionError) Error() string {
+	return fmt.Sprintf("Services %q would both be watched at %s: %v", this.ServiceNames, this.Path, ErrorServicePathCollision)
+}
+
+// Unwrap returns ErrorServicePathCollision, so that errors.Is sees through a ServicePathCollisionError
+func (this ServicePathCollisionError) Unwrap() error {
+	return ErrorServicePathCollision
+}
+
+// ServiceError associates an error with the name of the watched service that caused it
+type ServiceError struct {
+	Name string
+	Err  error
+}
+
+func (this ServiceError) Error() string {
+	return fmt.Sprintf("[%s]: %v", this.Name, this.Err)
+}
+
+// Unwrap returns the underlying error, so that errors.Is and errors.As see through a ServiceError
+func (this ServiceError) Unwrap() error {
+	return this.Err
+}
+
+// ServicesError aggregates the errors from a batch operation over watched services.  Every
+// service is attempted, and a ServicesError describes each one that failed.
+type ServicesError []ServiceError
+
+func (this ServicesError) Error() string {
+	return joinErrors("service(s) failed", this)
+}
+
+func (this ServicesError) Is(target error) bool {
+	return anyErrorIs(this, target)
+}
+
+func (this ServicesError) As(target interface{}) bool {
+	return anyErrorAs(this, target)
+}
+
+func (this ServicesError) len() int {
+	return len(this)
+}
+
+func (this ServicesError) errorAt(index int) error {
+	return this[index]
+}
+
+// Names returns the name of each failed service, in order
+func (this ServicesError) Names() []string {
+	names := make([]string, len(this))
+	for index, serviceError := range this {
+		names[index] = serviceError.Name
+	}
+
+	return names
+}
+
+// errorOrNil returns this ServicesError as an error, or nil if it is empty
+func (this ServicesError) errorOrNil() error {
+	return aggregateOrNil(this)
+}
+
+// EnvironmentVariableError describes why the value of an environment variable is invalid
+type EnvironmentVariableError struct {
+	Name   string
+	Value  string
+	Reason string
+}
+
+func (this EnvironmentVariableError) Error() string {
+	return fmt.Sprintf("%s=%q: %s", this.Name, this.Value, this.Reason)
+}
+
+// EnvironmentError aggregates the problems with every invalid environment variable used
+// to configure a DiscoveryBuilder, rather than only the first
+type EnvironmentError []EnvironmentVariableError
+
+func (this EnvironmentError) Error() string {
+	return joinErrors("invalid environment variable(s)", this)
+}
+
+func (this EnvironmentError) Is(target error) bool {
+	return anyErrorIs(this, target)
+}
+
+func (this EnvironmentError) As(target interface{}) bool {
+	return anyErrorAs(this, target)
+}
+
+func (this EnvironmentError) len() int {
+	return len(this)
+}
+
+func (this EnvironmentError) errorAt(index int) error {
+	return this[index]
+}
+
+// Names returns the name of each invalid environment variable, in order
+func (this EnvironmentError) Names() []string {
+	names := make([]string, len(this))
+	for index, variableError := range this {
+		names[index] = variableError.Name
+	}
+
+	return names
+}
+
+// errorOrNil returns this EnvironmentError as an error, or nil if it is empty
+func (this EnvironmentError) errorOrNil() error {
+	return aggregateOrNil(this)
+}
+
+// FieldError associates an error with the DiscoveryBuilder field that caused it
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (this FieldError) Error() string {
+	return fmt.Sprintf("%s: %v", this.Field, this.Err)
+}
+
+// Unwrap returns the underlying error, so that errors.Is and errors.As see through a FieldError
+func (this FieldError) Unwrap() error {
+	return this.Err
+}
+
+// ValidationError aggregates the problems with every invalid field of a DiscoveryBuilder,
+// rather than only the first
+type ValidationError []FieldError
+
+func (this ValidationError) Error() string {
+	return joinErrors("invalid field(s)", this)
+}
+
+func (this ValidationError) Is(target error) bool {
+	return anyErrorIs(this, target)
+}
+
+func (this ValidationError) As(target interface{}) bool {
+	return anyErrorAs(this, target)
+}
+
+func (this ValidationError) len() int {
+	return len(this)
+}
+
+func (this ValidationError) errorAt(index int) error {
+	return this[index]
+}
+
+// Fields returns the name of each invalid field, in order
+func (this ValidationError) Fields() []string {
+	fields := make([]string, len(this))
+	for index, fieldError := range this {
+		fields[index] = fieldError.Field
+	}
+
+	return fields
+}
+
+// errorOrNil returns this ValidationError as an error, or nil if it is empty
+func (this ValidationError) errorOrNil() error {
+	return aggregateOrNil(this)
+}
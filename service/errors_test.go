@@ -0,0 +1,32 @@
+package service
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestAggregateErrors(t *testing.T) {
+	assert := assert.New(t)
+	expected := errors.New("expected")
+	unexpected := errors.New("unexpected")
+
+	var testData = []struct {
+		aggregate error
+		is        error
+		as        interface{}
+	}{
+		{MultiError{{Instance: newTestInstance("1", "localhost", 1234), Err: expected}}, expected, new(InstanceError)},
+		{ServiceNamesError{{Name: "a/b", Reason: "must not contain '/'"}}, ServiceNameError{Name: "a/b", Reason: "must not contain '/'"}, new(ServiceNameError)},
+		{ServicesError{{Name: "test", Err: expected}}, expected, new(ServiceError)},
+		{EnvironmentError{{Name: "TEST", Value: "x", Reason: "expected"}}, EnvironmentVariableError{Name: "TEST", Value: "x", Reason: "expected"}, new(EnvironmentVariableError)},
+		{ValidationError{{Field: "Connection", Err: ErrorNoConnection}}, ErrorNoConnection, new(FieldError)},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert.True(errors.Is(record.aggregate, record.is))
+		assert.False(errors.Is(record.aggregate, unexpected))
+		assert.True(errors.As(record.aggregate, record.as))
+	}
+}
@@ -0,0 +1,152 @@
+package service
+
+import (
+	"sync"
+)
+
+// Executor runs the tasks through which events are delivered to listeners.  An Executor may
+// run each task immediately, on another goroutine, or on an application's own event loop.
+// Tasks submitted for any one listener are always submitted one at a time, in order, and each
+// must eventually be run for that listener to receive further events.
+type Executor interface {
+	Execute(task func())
+}
+
+// ExecutorFunc is a function type that implements Executor, e.g. to post tasks to an
+// existing event loop
+type ExecutorFunc func(task func())
+
+func (this ExecutorFunc) Execute(task func()) {
+	this(task)
+}
+
+// SynchronousExecutor is an Executor which runs each task on the calling goroutine before
+// returning.  This is how listeners are invoked when no other Executor is configured.
+var SynchronousExecutor Executor = ExecutorFunc(func(task func()) { task() })
+
+// WorkerPoolExecutor is an Executor which runs tasks on a fixed number of goroutines.
+// Tasks are queued until a worker is free, and Execute blocks while the queue is full.
+type WorkerPoolExecutor struct {
+	tasks     chan func()
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+var _ Executor = (*WorkerPoolExecutor)(nil)
+
+// NewWorkerPoolExecutor starts a WorkerPoolExecutor with the given number of workers, each of
+// which is at least one, and room to queue queueSize tasks.
+func NewWorkerPoolExecutor(workers, queueSize int) *WorkerPoolExecutor {
+	if workers < 1 {
+		workers = 1
+	}
+
+	if queueSize < 0 {
+		queueSize = 0
+	}
+
+	pool := &WorkerPoolExecutor{
+		tasks: make(chan func(), queueSize),
+		done:  make(chan struct{}),
+	}
+
+	for worker := 0; worker < workers; worker++ {
+		go pool.work()
+	}
+
+	return pool
+}
+
+// work runs tasks until this pool is closed, then runs whatever tasks remain queued
+func (this *WorkerPoolExecutor) work() {
+	for {
+		select {
+		case task := <-this.tasks:
+			task()
+		case <-this.done:
+			for {
+				select {
+				case task := <-this.tasks:
+					task()
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Execute queues a task for the next free worker.  Tasks submitted after Close are discarded.
+// A call blocked on a full queue returns, discarding its task, when this pool is closed.
+func (this *WorkerPoolExecutor) Execute(task func()) {
+	select {
+	case <-this.done:
+		return
+	default:
+	}
+
+	select {
+	case this.tasks <- task:
+	case <-this.done:
+	}
+}
+
+// Close stops this pool from accepting tasks.  Tasks that are already queued are still run,
+// after which the workers exit.  This method does not wait for the workers, so it is safe to
+// call from within a task.  It is idempotent.
+func (this *WorkerPoolExecutor) Close() {
+	this.closeOnce.Do(func() {
+		close(this.done)
+	})
+}
+
+// serialExecutor runs the tasks submitted to it one at a time, in the order in which they were
+// submitted, by handing them to a delegate Executor in batches.  Submitting a task never blocks
+// on the tasks ahead of it, so the queue is unbounded.
+type serialExecutor struct {
+	delegate Executor
+
+	mutex   sync.Mutex
+	tasks   []func()
+	running bool
+}
+
+// NewSerialExecutor returns an Executor which runs tasks in order, one at a time, using the
+// given delegate.  This allows a concurrent Executor, such as a WorkerPoolExecutor, to be shared
+// by many listeners while each listener still receives its events one at a time, in order.
+// Every listener is given its own serial Executor over the configured DispatchExecutor.
+func NewSerialExecutor(delegate Executor) Executor {
+	return &serialExecutor{delegate: delegate}
+}
+
+func (this *serialExecutor) Execute(task func()) {
+	this.mutex.Lock()
+	this.tasks = append(this.tasks, task)
+	if this.running {
+		this.mutex.Unlock()
+		return
+	}
+
+	this.running = true
+	this.mutex.Unlock()
+	this.delegate.Execute(this.drain)
+}
+
+// drain runs queued tasks until none remain
+func (this *serialExecutor) drain() {
+	for {
+		this.mutex.Lock()
+		if len(this.tasks) == 0 {
+			this.running = false
+			this.mutex.Unlock()
+			return
+		}
+
+		task := this.tasks[0]
+		this.tasks[0] = nil
+		this.tasks = this.tasks[1:]
+		this.mutex.Unlock()
+
+		task()
+	}
+}
@@ -0,0 +1,212 @@
+package service
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSynchronousExecutor(t *testing.T) {
+	ran := false
+	SynchronousExecutor.Execute(func() { ran = true })
+	assert.True(t, ran)
+}
+
+func TestWorkerPoolExecutor(t *testing.T) {
+	assert := assert.New(t)
+
+	const workers = 3
+	pool := NewWorkerPoolExecutor(workers, 10)
+	release := make(chan struct{})
+	var running, maxRunning int32
+	waitGroup := &sync.WaitGroup{}
+	for index := 0; index < 10; index++ {
+		waitGroup.Add(1)
+		pool.Execute(func() {
+			defer waitGroup.Done()
+			current := atomic.AddInt32(&running, 1)
+			for {
+				previous := atomic.LoadInt32(&maxRunning)
+				if current <= previous || atomic.CompareAndSwapInt32(&maxRunning, previous, current) {
+					break
+				}
+			}
+
+			<-release
+			atomic.AddInt32(&running, -1)
+		})
+	}
+
+	// every worker is busy, and the remaining tasks are queued
+	assert.Eventually(func() bool { return atomic.LoadInt32(&running) == workers }, time.Second, time.Millisecond)
+	close(release)
+	waitGroup.Wait()
+	assert.Equal(int32(workers), atomic.LoadInt32(&maxRunning))
+
+	// tasks queued before Close still run, while later tasks are discarded
+	blocked := make(chan struct{})
+	finished := make(chan string, 10)
+	for index := 0; index < workers; index++ {
+		pool.Execute(func() { <-blocked })
+	}
+
+	pool.Execute(func() { finished <- "queued" })
+	pool.Close()
+	pool.Close()
+	pool.Execute(func() { finished <- "discarded" })
+	close(blocked)
+
+	select {
+	case task := <-finished:
+		assert.Equal("queued", task)
+	case <-time.After(5 * time.Second):
+		t.Fatal("The queued task did not run")
+	}
+
+	select {
+	case task := <-finished:
+		assert.Fail("A task submitted after Close ran", task)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWorkerPoolExecutorCloseWithBlockedExecute(t *testing.T) {
+	pool := NewWorkerPoolExecutor(1, 0)
+	release := make(chan struct{})
+	closed := make(chan struct{})
+	pool.Execute(func() {
+		<-release
+		pool.Close()
+		close(closed)
+	})
+
+	// the only worker is busy and there is no queue, so this Execute blocks until Close
+	executed := make(chan struct{})
+	go func() {
+		pool.Execute(func() {})
+		close(executed)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close deadlocked with a blocked Execute")
+	}
+
+	select {
+	case <-executed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Execute did not return after Close")
+	}
+}
+
+func TestSerialExecutor(t *testing.T) {
+	assert := assert.New(t)
+
+	pool := NewWorkerPoolExecutor(4, 0)
+	defer pool.Close()
+
+	var testData = []struct {
+		delegate Executor
+	}{
+		{SynchronousExecutor},
+		{pool},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		serial := NewSerialExecutor(record.delegate)
+		var running int32
+		var order []int
+		done := make(chan struct{})
+		for index := 0; index < 100; index++ {
+			index := index
+			serial.Execute(func() {
+				assert.Equal(int32(1), atomic.AddInt32(&running, 1), "tasks ran concurrently")
+				order = append(order, index)
+				atomic.AddInt32(&running, -1)
+				if index == 99 {
+					close(done)
+				}
+			})
+		}
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("The tasks did not run")
+		}
+
+		if assert.Len(order, 100) {
+			for index, value := range order {
+				assert.Equal(index, value)
+			}
+		}
+	}
+}
+
+func TestDispatchExecutor(t *testing.T) {
+	assert := assert.New(t)
+
+	pool := NewWorkerPoolExecutor(4, 0)
+	defer pool.Close()
+
+	var posted int32
+	executor := ExecutorFunc(func(task func()) {
+		atomic.AddInt32(&posted, 1)
+		pool.Execute(task)
+	})
+
+	serviceWatcher := &serviceWatcher{
+		serviceName:     testServiceName,
+		logger:          &testLogger{t},
+		dispatchOptions: dispatchOptions{executor: executor},
+	}
+
+	// each listener receives every event, in order, even though the pool runs concurrently
+	listeners := []*blockingListener{newBlockingListener(), newBlockingListener()}
+	for _, listener := range listeners {
+		close(listener.release)
+		serviceWatcher.addListener(listener)
+	}
+
+	for index := 0; index < 50; index++ {
+		serviceWatcher.dispatch(testInstancesWithIds(strconv.Itoa(index)))
+	}
+
+	for _, listener := range listeners {
+		for index := 0; index < 50; index++ {
+			select {
+			case id := <-listener.received:
+				assert.Equal(strconv.Itoa(index), id)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Event %d was not delivered", index)
+			}
+		}
+	}
+
+	assert.True(atomic.LoadInt32(&posted) > 0)
+	serviceWatcher.removeAllListeners()
+}
+
+func TestDispatchExecutorOption(t *testing.T) {
+	assert := assert.New(t)
+
+	options, err := (&DiscoveryBuilder{DispatchExecutor: SynchronousExecutor}).dispatchOptions()
+	assert.Nil(err)
+	assert.NotNil(options.executor)
+
+	_, err = (&DiscoveryBuilder{DispatchExecutor: SynchronousExecutor, AsyncDispatch: true}).dispatchOptions()
+	assert.Equal(ErrorInvalidDispatchExecutor, err)
+
+	err = (&DiscoveryBuilder{Connection: testConnection, DispatchExecutor: SynchronousExecutor, AsyncDispatch: true}).Validate()
+	if validationError, ok := err.(ValidationError); assert.True(ok) {
+		assert.Equal([]string{"DispatchExecutor"}, validationError.Fields())
+	}
+}
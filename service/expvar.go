@@ -0,0 +1,169 @@
+package service
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"github.com/foursquare/curator.go"
+	"sync"
+	"time"
+)
+
+var (
+	ErrorExpvarNameInUse = errors.New("The expvar name is already published by something else")
+)
+
+// ExpvarSnapshot is the value published under expvar for a Discovery.  It is computed from
+// counters and cached state only, so it is cheap enough to be read as often as expvar is polled.
+type ExpvarSnapshot struct {
+	// Connected reports whether the Discovery is connected to zookeeper
+	Connected bool `json:"connected"`
+
+	// ConnectionState is the most recent curator connection state, e.g. "CONNECTED", when the
+	// Discovery tracks it
+	ConnectionState string `json:"connectionState,omitempty"`
+
+	// Services holds the snapshot of each watched service, by name
+	Services map[string]ExpvarServiceSnapshot `json:"services"`
+}
+
+// ExpvarServiceSnapshot describes a single watched service within an ExpvarSnapshot
+type ExpvarServiceSnapshot struct {
+	// Instances is the number of instances in the last-known set of services
+	Instances int `json:"instances"`
+
+	// LastEvent is the time at which the services were most recently dispatched, if ever
+	LastEvent *time.Time `json:"lastEvent,omitempty"`
+
+	// FetchErrors is the total number of reads from zookeeper that failed
+	FetchErrors uint64 `json:"fetchErrors"`
+
+	// FetchTimeouts is the total number of child znodes skipped because of the FetchTimeout
+	FetchTimeouts uint64 `json:"fetchTimeouts"`
+}
+
+// connectionStateReporter is implemented by each Discovery in this package which tracks the
+// curator connection state
+type connectionStateReporter interface {
+	connectionState() curator.ConnectionState
+}
+
+// NewExpvarSnapshot computes the ExpvarSnapshot of the given Discovery
+func NewExpvarSnapshot(discovery Discovery) ExpvarSnapshot {
+	snapshot := ExpvarSnapshot{
+		Connected: discovery.Connected(),
+		Services:  make(map[string]ExpvarServiceSnapshot),
+	}
+
+	if reporter, ok := discovery.(connectionStateReporter); ok {
+		snapshot.ConnectionState = reporter.connectionState().String()
+	}
+
+	for _, serviceName := range discovery.ServiceNames() {
+		metrics, err := discovery.Metrics(serviceName)
+		if err != nil {
+			// the service was removed after the names were obtained
+			continue
+		}
+
+		serviceSnapshot := ExpvarServiceSnapshot{
+			Instances:     metrics.Instances,
+			FetchErrors:   metrics.FetchErrors,
+			FetchTimeouts: metrics.FetchTimeouts,
+		}
+
+		if !metrics.LastDispatch.IsZero() {
+			serviceSnapshot.LastEvent = &metrics.LastDispatch
+		}
+
+		snapshot.Services[serviceName] = serviceSnapshot
+	}
+
+	return snapshot
+}
+
+// expvarRegistry tracks the names which this package has published under expvar.  expvar
+// offers no way to remove or replace a variable, so each name is published once, as a function
+// which looks up whichever Discovery currently owns the name.
+type expvarRegistry struct {
+	mutex       sync.Mutex
+	published   map[string]bool
+	discoveries map[string]Discovery
+}
+
+var defaultExpvarRegistry = &expvarRegistry{
+	published:   make(map[string]bool),
+	discoveries: make(map[string]Discovery),
+}
+
+// PublishExpvar publishes the ExpvarSnapshot of the given Discovery under the given expvar name.
+// The variable is published on the first use of each name, rather than when this package is
+// loaded.  Publishing the same Discovery again is harmless, but a name which is already published
+// for another Discovery that has not been closed, or by something other than this package, results
+// in ErrorExpvarNameInUse rather than the panic of expvar.Publish.  Once the Discovery is closed,
+// the name may be reused, and until then the variable is null.
+func PublishExpvar(name string, discovery Discovery) error {
+	return defaultExpvarRegistry.publish(name, discovery)
+}
+
+func (this *expvarRegistry) publish(name string, discovery Discovery) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if existing, ok := this.discoveries[name]; ok {
+		if existing != discovery {
+			return ErrorExpvarNameInUse
+		}
+
+		return nil
+	}
+
+	if !this.published[name] {
+		if err := publishExpvarFunc(name, expvar.Func(func() interface{} { return this.snapshot(name) })); err != nil {
+			return err
+		}
+
+		this.published[name] = true
+	}
+
+	this.discoveries[name] = discovery
+	return nil
+}
+
+// unpublish releases the given name, if it is owned by the given Discovery
+func (this *expvarRegistry) unpublish(name string, discovery Discovery) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.discoveries[name] == discovery {
+		delete(this.discoveries, name)
+	}
+}
+
+// snapshot returns the ExpvarSnapshot for the Discovery which owns the given name, or nil if
+// the name is not currently owned
+func (this *expvarRegistry) snapshot(name string) interface{} {
+	this.mutex.Lock()
+	discovery, ok := this.discoveries[name]
+	this.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+
+	return NewExpvarSnapshot(discovery)
+}
+
+// publishExpvarFunc publishes a variable, converting the panic expvar raises for a name that
+// is already in use, e.g. one published concurrently by another package, into an error
+func publishExpvarFunc(name string, variable expvar.Var) (err error) {
+	if expvar.Get(name) != nil {
+		return ErrorExpvarNameInUse
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprintf("Unable to publish expvar %s: %v", name, r))
+		}
+	}()
+
+	expvar.Publish(name, variable)
+	return nil
+}
@@ -0,0 +1,117 @@
+package service
+
+import (
+	"encoding/json"
+	"expvar"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// readExpvar decodes the published value of the given expvar name
+func readExpvar(t *testing.T, name string) *ExpvarSnapshot {
+	variable := expvar.Get(name)
+	if variable == nil {
+		t.Fatalf("The expvar %s was not published", name)
+	}
+
+	var snapshot *ExpvarSnapshot
+	if err := json.Unmarshal([]byte(variable.String()), &snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	return snapshot
+}
+
+func TestNewExpvarSnapshot(t *testing.T) {
+	assert := assert.New(t)
+
+	static := mustNewStaticDiscovery(t, map[string]Instances{"foo": testInstancesWithIds("1", "2")})
+	assert.Nil(static.AddService("bar"))
+
+	snapshot := NewExpvarSnapshot(static)
+	assert.False(snapshot.Connected)
+	assert.Empty(snapshot.ConnectionState)
+	assert.Len(snapshot.Services, 2)
+	assert.Equal(ExpvarServiceSnapshot{}, snapshot.Services["bar"])
+
+	foo := snapshot.Services["foo"]
+	assert.Equal(2, foo.Instances)
+	if assert.NotNil(foo.LastEvent) {
+		assert.WithinDuration(time.Now(), *foo.LastEvent, time.Minute)
+	}
+}
+
+func TestPublishExpvar(t *testing.T) {
+	assert := assert.New(t)
+	name := "discovery-" + t.Name()
+
+	first := mustNewStaticDiscovery(t, map[string]Instances{"foo": testInstancesWithIds("1")})
+	second := mustNewStaticDiscovery(t, nil)
+
+	assert.Nil(PublishExpvar(name, first))
+	assert.Nil(PublishExpvar(name, first))
+	assert.Equal(ErrorExpvarNameInUse, PublishExpvar(name, second))
+
+	snapshot := readExpvar(t, name)
+	if assert.NotNil(snapshot) {
+		assert.Equal(1, snapshot.Services["foo"].Instances)
+	}
+
+	// once released, the name is null until another Discovery publishes it
+	defaultExpvarRegistry.unpublish(name, second)
+	assert.NotNil(readExpvar(t, name))
+	defaultExpvarRegistry.unpublish(name, first)
+	assert.Nil(readExpvar(t, name))
+
+	assert.Nil(PublishExpvar(name, second))
+	defer defaultExpvarRegistry.unpublish(name, second)
+	snapshot = readExpvar(t, name)
+	if assert.NotNil(snapshot) {
+		assert.Empty(snapshot.Services)
+	}
+
+	// a name published by something else is never replaced
+	other := "other-" + t.Name()
+	if expvar.Get(other) == nil {
+		expvar.NewInt(other)
+	}
+
+	assert.Equal(ErrorExpvarNameInUse, PublishExpvar(other, first))
+}
+
+func TestDiscoveryBuilderExpvarName(t *testing.T) {
+	assert := assert.New(t)
+
+	builder := DiscoveryBuilder{
+		Connection: testConnection,
+		BasePath:   testBasePath,
+		Watches:    []string{testServiceName},
+		ExpvarName: "discovery-" + t.Name(),
+	}
+
+	first, err := builder.New(&testLogger{t})
+	if !assert.Nil(err) {
+		return
+	}
+
+	snapshot := readExpvar(t, builder.ExpvarName)
+	if assert.NotNil(snapshot) {
+		assert.False(snapshot.Connected)
+		assert.Equal("UNKNOWN", snapshot.ConnectionState)
+		assert.Contains(snapshot.Services, testServiceName)
+	}
+
+	second, err := builder.New(&testLogger{t})
+	assert.Nil(second)
+	assert.Equal(ErrorExpvarNameInUse, err)
+
+	// closing a Discovery releases its name
+	assert.Nil(first.Close())
+	assert.Nil(readExpvar(t, builder.ExpvarName))
+
+	second, err = builder.New(&testLogger{t})
+	if assert.Nil(err) {
+		second.Close()
+	}
+}
@@ -0,0 +1,255 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultFilePollInterval = time.Duration(5 * time.Second)
+)
+
+var (
+	ErrorNoFilePath              = errors.New("The Path of the services file must be supplied")
+	ErrorInvalidFilePollInterval = errors.New("The PollInterval must be a positive time.Duration or integral seconds value")
+)
+
+// FileDiscoveryBuilder configures a FileDiscovery.  Like DiscoveryBuilder, this type also
+// implements a standard JSON configuration.
+type FileDiscoveryBuilder struct {
+	// Path is the location of the services file, a JSON document which maps each service name
+	// to an array of its instances, e.g. {"foo": [{"name": "foo", "id": "1", ...}]}
+	Path string `json:"path"`
+
+	// PollInterval is how often the services file is checked for changes.  If this value is
+	// not supplied, DefaultFilePollInterval is used instead.
+	PollInterval string `json:"pollInterval"`
+
+	// InstanceError, if supplied, is invoked whenever the services file cannot be read or parsed
+	// during a reload, or holds an invalid service name.  It receives the Path, an empty child
+	// id, the contents of the file, if they could be read, and the error.  The previously loaded
+	// services remain in effect.
+	InstanceError InstanceErrorFunc `json:"-"`
+
+	// Logger, if supplied, is used by the FileDiscovery.  By default, nothing is logged.
+	Logger Logger `json:"-"`
+}
+
+func (this *FileDiscoveryBuilder) pollInterval() (time.Duration, error) {
+	if pollInterval, ok := parseInterval(this.PollInterval, DefaultFilePollInterval); ok && pollInterval > 0 {
+		return pollInterval, nil
+	}
+
+	return 0, ErrorInvalidFilePollInterval
+}
+
+// New creates a FileDiscovery which watches every service in the services file.  The file is
+// read before this method returns, and a file which cannot be read or parsed is an error.
+func (this *FileDiscoveryBuilder) New() (*FileDiscovery, error) {
+	if len(this.Path) == 0 {
+		return nil, ErrorNoFilePath
+	}
+
+	pollInterval, err := this.pollInterval()
+	if err != nil {
+		return nil, err
+	}
+
+	logger := this.Logger
+	if logger == nil {
+		logger = NopLogger{}
+	}
+
+	contents, services, err := readServicesFile(this.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	static, err := NewStaticDiscovery(services)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileDiscovery{
+		StaticDiscovery: static,
+		path:            this.Path,
+		pollInterval:    pollInterval,
+		instanceError:   this.InstanceError,
+		logger:          logger,
+		contents:        contents,
+		services:        services,
+		closeSignal:     make(chan struct{}),
+	}, nil
+}
+
+// readServicesFile reads and parses the services file at the given path.  A file holding an
+// invalid service name is rejected with a ServiceNamesError, so that a reload dispatches either
+// every service in the file or none of them.  The raw contents are returned along with any error,
+// so that they can be reported.
+func readServicesFile(path string) ([]byte, map[string]Instances, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	services := make(map[string]Instances)
+	if err := json.Unmarshal(contents, &services); err != nil {
+		return contents, nil, errors.New(
+			fmt.Sprintf("Unable to parse the services file %s: %s", path, err),
+		)
+	}
+
+	serviceNames := make([]string, 0, len(services))
+	for serviceName := range services {
+		serviceNames = append(serviceNames, serviceName)
+	}
+
+	sort.Strings(serviceNames)
+	if err := validateServiceNames(serviceNames); err != nil {
+		return contents, nil, err
+	}
+
+	return contents, services, nil
+}
+
+// FileDiscovery is a Discovery whose services are read from a JSON file, e.g. one maintained by
+// configuration management where no zookeeper ensemble is available.  While running, the file is
+// polled for changes, and each service whose instances differ from those previously loaded is
+// dispatched to its listeners.  A service which is removed from the file remains watched, but
+// with no instances.  A file which cannot be read or parsed leaves the previous services in place.
+//
+// Apart from Run, which starts polling, and Close, which stops it, a FileDiscovery behaves as a
+// StaticDiscovery.  In particular, SetInstances may be used to override a service until the
+// service next changes in the file.
+type FileDiscovery struct {
+	*StaticDiscovery
+
+	path          string
+	pollInterval  time.Duration
+	instanceError InstanceErrorFunc
+	logger        Logger
+
+	// reloadMutex serializes reloads, and guards the contents and services last loaded
+	reloadMutex sync.Mutex
+	contents    []byte
+	services    map[string]Instances
+
+	once        sync.Once
+	closeOnce   sync.Once
+	closeSignal chan struct{}
+}
+
+var _ Discovery = (*FileDiscovery)(nil)
+
+// Path returns the location of the services file
+func (this *FileDiscovery) Path() string {
+	return this.path
+}
+
+// Reload reads the services file immediately, rather than waiting for the next poll, and
+// dispatches any services that changed.  If the file cannot be read or parsed, or holds an invalid
+// service name, the error is returned and reported to the InstanceError function, and the previous
+// services are kept.
+func (this *FileDiscovery) Reload() error {
+	this.reloadMutex.Lock()
+	defer this.reloadMutex.Unlock()
+
+	contents, services, err := readServicesFile(this.path)
+	if err != nil {
+		return this.reloadFailed(contents, err)
+	}
+
+	if bytes.Equal(contents, this.contents) {
+		return nil
+	}
+
+	// services removed from the file are dispatched as empty, so that listeners drop their instances
+	serviceNames := make([]string, 0, len(services)+len(this.services))
+	for serviceName := range services {
+		serviceNames = append(serviceNames, serviceName)
+	}
+
+	for serviceName := range this.services {
+		if _, ok := services[serviceName]; !ok {
+			serviceNames = append(serviceNames, serviceName)
+		}
+	}
+
+	sort.Strings(serviceNames)
+	for _, serviceName := range serviceNames {
+		instances, previous := services[serviceName], this.services[serviceName]
+		if _, ok := this.services[serviceName]; ok && reflect.DeepEqual(instances, previous) {
+			continue
+		}
+
+		this.logger.Info("Reloaded [%s] with %d instance(s) from %s", serviceName, len(instances), this.path)
+		if err := this.SetInstances(serviceName, instances); err != nil {
+			return this.reloadFailed(contents, err)
+		}
+	}
+
+	this.contents = contents
+	this.services = services
+	return nil
+}
+
+// reloadFailed logs an error which prevented a reload and reports it to the InstanceError
+// function, if any, returning the error
+func (this *FileDiscovery) reloadFailed(contents []byte, err error) error {
+	this.logger.Error("Unable to reload services from %s: %s", this.path, err)
+	if this.instanceError != nil {
+		this.instanceError(this.path, "", contents, err)
+	}
+
+	return err
+}
+
+// Run starts polling the services file for changes.  It is idempotent.  If this FileDiscovery
+// has been closed, ErrorClosed is returned.
+func (this *FileDiscovery) Run(waitGroup *sync.WaitGroup, shutdown <-chan struct{}) error {
+	if err := this.StaticDiscovery.Run(waitGroup, shutdown); err != nil {
+		return err
+	}
+
+	this.once.Do(func() {
+		waitGroup.Add(1)
+		go this.poll(waitGroup, shutdown)
+	})
+
+	return nil
+}
+
+// poll reloads the services file on an interval
+func (this *FileDiscovery) poll(waitGroup *sync.WaitGroup, shutdown <-chan struct{}) {
+	defer waitGroup.Done()
+
+	ticker := time.NewTicker(this.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-shutdown:
+			return
+		case <-this.closeSignal:
+			return
+		case <-ticker.C:
+			this.Reload()
+		}
+	}
+}
+
+// Close stops polling the services file and removes every listener.  Close is idempotent.
+func (this *FileDiscovery) Close() error {
+	this.closeOnce.Do(func() {
+		close(this.closeSignal)
+	})
+
+	return this.StaticDiscovery.Close()
+}
@@ -0,0 +1,205 @@
+package service
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeServicesFile writes the given services as a services file, failing the test on error
+func writeServicesFile(t *testing.T, path string, services map[string]Instances) {
+	contents, err := json.Marshal(services)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTempDirectory creates a temporary directory for services files, failing the test on error.
+// Callers must remove the directory.
+func newTempDirectory(t *testing.T) string {
+	directory, err := ioutil.TempDir("", "services")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return directory
+}
+
+func TestFileDiscoveryBuilderInvalid(t *testing.T) {
+	directory := newTempDirectory(t)
+	defer os.RemoveAll(directory)
+	path := filepath.Join(directory, "services.json")
+	writeServicesFile(t, path, nil)
+
+	var testData = []struct {
+		builder       FileDiscoveryBuilder
+		expectedError error
+	}{
+		{FileDiscoveryBuilder{}, ErrorNoFilePath},
+		{FileDiscoveryBuilder{Path: path, PollInterval: "0s"}, ErrorInvalidFilePollInterval},
+		{FileDiscoveryBuilder{Path: path, PollInterval: "-1"}, ErrorInvalidFilePollInterval},
+		{FileDiscoveryBuilder{Path: path, PollInterval: "invalid"}, ErrorInvalidFilePollInterval},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		fileDiscovery, err := record.builder.New()
+		assert.Nil(t, fileDiscovery)
+		assert.Equal(t, record.expectedError, err)
+	}
+}
+
+func TestFileDiscoveryBuilderUnreadable(t *testing.T) {
+	assert := assert.New(t)
+	directory := newTempDirectory(t)
+	defer os.RemoveAll(directory)
+
+	builder := FileDiscoveryBuilder{Path: filepath.Join(directory, "nosuch.json")}
+	fileDiscovery, err := builder.New()
+	assert.Nil(fileDiscovery)
+	assert.True(os.IsNotExist(err))
+
+	builder.Path = filepath.Join(directory, "invalid.json")
+	assert.Nil(ioutil.WriteFile(builder.Path, []byte("not json"), 0644))
+	fileDiscovery, err = builder.New()
+	assert.Nil(fileDiscovery)
+	assert.NotNil(err)
+}
+
+func TestFileDiscoveryReload(t *testing.T) {
+	assert := assert.New(t)
+
+	directory := newTempDirectory(t)
+	defer os.RemoveAll(directory)
+	path := filepath.Join(directory, "services.json")
+	writeServicesFile(t, path, map[string]Instances{
+		"foo": testInstancesWithIds("1", "2"),
+		"bar": testInstancesWithIds("3"),
+	})
+
+	var (
+		errorPath  string
+		errorCount int
+	)
+
+	builder := FileDiscoveryBuilder{
+		Path: path,
+		InstanceError: func(servicePath, childId string, data []byte, err error) {
+			errorPath = servicePath
+			errorCount++
+		},
+	}
+
+	fileDiscovery, err := builder.New()
+	if !assert.Nil(err) {
+		return
+	}
+
+	defer fileDiscovery.Close()
+	assert.Equal(path, fileDiscovery.Path())
+	assert.ElementsMatch([]string{"bar", "foo"}, fileDiscovery.ServiceNames())
+
+	var events []InstanceEvent
+	_, err = fileDiscovery.AddListener("foo", InstancesListenerFunc(func(serviceName string, event InstanceEvent) {
+		events = append(events, event)
+	}))
+
+	assert.Nil(err)
+	assert.Len(events, 1)
+
+	// an unchanged file dispatches nothing
+	assert.Nil(fileDiscovery.Reload())
+	assert.Len(events, 1)
+
+	// a changed instance is dispatched as updated, even though the membership is the same
+	changed := testInstancesWithIds("1", "2")
+	changed[1].Address = "changed.com"
+	writeServicesFile(t, path, map[string]Instances{"foo": changed, "bar": testInstancesWithIds("3")})
+	assert.Nil(fileDiscovery.Reload())
+	if assert.Len(events, 2) {
+		assert.Equal([]string{"2"}, instanceIds(events[1].Updated))
+		assert.Equal("changed.com", events[1].Current[1].Address)
+	}
+
+	// a parse error keeps the previous services and is reported
+	assert.Nil(ioutil.WriteFile(path, []byte("{"), 0644))
+	assert.NotNil(fileDiscovery.Reload())
+	assert.Equal(path, errorPath)
+	assert.Equal(1, errorCount)
+	assert.Len(events, 2)
+
+	instances, err := fileDiscovery.FetchServices("foo")
+	assert.Equal("changed.com", instances[1].Address)
+	assert.Nil(err)
+
+	// an invalid service name rejects the whole file, and is reported
+	writeServicesFile(t, path, map[string]Instances{"foo": testInstancesWithIds("5"), "bad/name": testInstancesWithIds("6")})
+	err = fileDiscovery.Reload()
+	_, isServiceNamesError := err.(ServiceNamesError)
+	assert.True(isServiceNamesError)
+	assert.Equal(2, errorCount)
+	assert.Len(events, 2)
+	assert.False(fileDiscovery.IsWatching("bad/name"))
+
+	// a service removed from the file has no instances, and a new service is watched
+	writeServicesFile(t, path, map[string]Instances{"foo": changed, "baz": testInstancesWithIds("4")})
+	assert.Nil(fileDiscovery.Reload())
+	assert.Len(events, 2)
+
+	instances, err = fileDiscovery.FetchServices("bar")
+	assert.Equal(Instances{}, instances)
+	assert.Nil(err)
+
+	instances, err = fileDiscovery.FetchServices("baz")
+	assert.Equal([]string{"4"}, instanceIds(instances))
+	assert.Nil(err)
+}
+
+func TestFileDiscoveryPolling(t *testing.T) {
+	assert := assert.New(t)
+
+	directory := newTempDirectory(t)
+	defer os.RemoveAll(directory)
+	path := filepath.Join(directory, "services.json")
+	writeServicesFile(t, path, map[string]Instances{"foo": testInstancesWithIds("1")})
+
+	builder := FileDiscoveryBuilder{Path: path, PollInterval: "10ms"}
+	fileDiscovery, err := builder.New()
+	if !assert.Nil(err) {
+		return
+	}
+
+	received := make(chan Instances, 10)
+	_, err = fileDiscovery.AddListener("foo", ListenerFunc(func(serviceName string, instances Instances) {
+		received <- instances
+	}))
+
+	assert.Nil(err)
+	assert.Equal([]string{"1"}, instanceIds(<-received))
+
+	waitGroup := &sync.WaitGroup{}
+	shutdown := make(chan struct{})
+	assert.Nil(fileDiscovery.Run(waitGroup, shutdown))
+	assert.Nil(fileDiscovery.Run(waitGroup, shutdown))
+
+	writeServicesFile(t, path, map[string]Instances{"foo": testInstancesWithIds("1", "2")})
+	select {
+	case instances := <-received:
+		assert.Equal([]string{"1", "2"}, instanceIds(instances))
+	case <-time.After(5 * time.Second):
+		assert.Fail("The changed services file was not dispatched")
+	}
+
+	assert.Nil(fileDiscovery.Close())
+	waitGroup.Wait()
+	assert.Equal(ErrorClosed, fileDiscovery.Run(waitGroup, shutdown))
+}
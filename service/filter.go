@@ -0,0 +1,28 @@
+package service
+
+import (
+	"github.com/foursquare/fsgo/net/discovery"
+)
+
+// InstanceFilter decides whether a ServiceInstance that was read successfully should be
+// watched.  Instances for which the filter returns false are excluded from the cache and are
+// never dispatched to listeners.  Since child znodes are read concurrently, an InstanceFilter
+// must be safe for concurrent use.
+type InstanceFilter func(serviceInstance *discovery.ServiceInstance) bool
+
+// PayloadFlagFilter returns an InstanceFilter which accepts instances whose JSON payload has
+// the named boolean field set to true, e.g. an "enabled" flag that registrants clear in order
+// to drain traffic without deregistering.  Instances without a payload, or whose payload lacks
+// a boolean value for the field, are accepted only if defaultValue is true.
+func PayloadFlagFilter(field string, defaultValue bool) InstanceFilter {
+	return func(serviceInstance *discovery.ServiceInstance) bool {
+		var payload map[string]interface{}
+		if err := DecodePayload(serviceInstance, &payload); err == nil {
+			if flag, ok := payload[field].(bool); ok {
+				return flag
+			}
+		}
+
+		return defaultValue
+	}
+}
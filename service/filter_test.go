@@ -0,0 +1,53 @@
+package service
+
+import (
+	"github.com/foursquare/fsgo/net/discovery"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestPayloadFlagFilter(t *testing.T) {
+	var testData = []struct {
+		serviceInstance *discovery.ServiceInstance
+		defaultValue    bool
+		expected        bool
+	}{
+		{newTestInstanceWithPayload("1", `{"enabled": true}`), false, true},
+		{newTestInstanceWithPayload("2", `{"enabled": false}`), true, false},
+		{newTestInstanceWithPayload("3", `{"enabled": "false"}`), true, true},
+		{newTestInstanceWithPayload("4", `{"other": false}`), true, true},
+		{newTestInstanceWithPayload("5", `{"other": false}`), false, false},
+		{newTestInstanceWithPayload("6", `not json`), true, true},
+		{newTestInstance("7", "localhost", 1234), true, true},
+		{newTestInstance("8", "localhost", 1234), false, false},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+		assert.Equal(record.expected, PayloadFlagFilter("enabled", record.defaultValue)(record.serviceInstance))
+	}
+}
+
+func TestFetchServicesWithInstanceFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	client := newFakeZookeeperClient()
+	servicePath := testBasePath + "/" + testServiceName
+	client.addInstance(servicePath, newTestInstanceWithPayload("1", `{"enabled": true}`))
+	client.addInstance(servicePath, newTestInstanceWithPayload("2", `{"enabled": false}`))
+	client.addInstance(servicePath, newTestInstance("3", "localhost", 1234))
+	client.set(servicePath+"/4", []byte("not json"))
+
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, watcherOptions{instanceFilter: PayloadFlagFilter("enabled", true)})
+	serviceWatcher, _ := serviceWatcherSet.findByName(testServiceName)
+	serviceWatcher.client = client
+
+	instances, err := serviceWatcher.readServices(serviceWatcher.context)
+	assert.Nil(err)
+	assert.Equal([]string{"1", "3"}, instanceIds(instances))
+
+	metrics := serviceWatcher.metricsSnapshot()
+	assert.Equal(1, metrics.FilteredInstances)
+	assert.Equal(1, metrics.SkippedInstances)
+}
@@ -0,0 +1,187 @@
+// Package grpcresolver provides a gRPC resolver.Builder which resolves targets to the instances
+// of services watched by a service.Discovery, e.g. "discovery:///service-name".
+package grpcresolver
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Comcast/golang-discovery-client/service"
+	"google.golang.org/grpc/resolver"
+	"strings"
+	"sync"
+)
+
+const (
+	// DefaultScheme is the target scheme handled by a Builder unless WithScheme is used
+	DefaultScheme = "discovery"
+)
+
+var (
+	ErrorNoServiceName = errors.New("The target must name a service, e.g. discovery:///service-name")
+)
+
+// Option configures a Builder
+type Option func(*Builder)
+
+// WithScheme sets the target scheme handled by a Builder
+func WithScheme(scheme string) Option {
+	return func(builder *Builder) {
+		builder.scheme = scheme
+	}
+}
+
+// WithPortSelector sets how a Builder chooses the port of each instance.  For example,
+// service.PreferSslPort uses the SslPort of instances that have one.  By default, only
+// the Port is used.
+func WithPortSelector(selectPort service.PortSelector) Option {
+	return func(builder *Builder) {
+		builder.selectPort = selectPort
+	}
+}
+
+// Builder is a resolver.Builder backed by a service.Discovery.  Each target names a single
+// watched service, and resolves to the addresses of that service's instances as they change.
+// Instances without an address or a chosen port are omitted.
+type Builder struct {
+	discovery  service.Discovery
+	scheme     string
+	selectPort service.PortSelector
+}
+
+var _ resolver.Builder = (*Builder)(nil)
+
+// NewBuilder creates a Builder which resolves targets using the given Discovery.  The Builder
+// can be passed to grpc.WithResolvers, or registered globally with resolver.Register.
+func NewBuilder(discovery service.Discovery, options ...Option) *Builder {
+	builder := &Builder{
+		discovery:  discovery,
+		scheme:     DefaultScheme,
+		selectPort: service.PlainPort,
+	}
+
+	for _, option := range options {
+		option(builder)
+	}
+
+	return builder
+}
+
+func (this *Builder) Scheme() string {
+	return this.scheme
+}
+
+// Build starts resolving the service named by the target's path.  The service must already
+// be watched by the Discovery, or an error is returned.  If the service has been
+// read, its addresses are pushed to the ClientConn before this method returns.
+func (this *Builder) Build(target resolver.Target, clientConn resolver.ClientConn, options resolver.BuildOptions) (resolver.Resolver, error) {
+	serviceName, err := targetServiceName(target)
+	if err != nil {
+		return nil, err
+	}
+
+	discoveryResolver := &discoveryResolver{
+		discovery:   this.discovery,
+		serviceName: serviceName,
+		selectPort:  this.selectPort,
+		clientConn:  clientConn,
+	}
+
+	registration, err := this.discovery.AddListener(serviceName, discoveryResolver)
+	if err != nil {
+		return nil, errors.New(
+			fmt.Sprintf("Unable to resolve service [%s]: %v", serviceName, err),
+		)
+	}
+
+	discoveryResolver.setRegistration(registration)
+	return discoveryResolver, nil
+}
+
+// targetServiceName extracts the service name from a target such as "discovery:///service-name"
+func targetServiceName(target resolver.Target) (string, error) {
+	serviceName := strings.TrimPrefix(target.URL.Path, "/")
+	if len(serviceName) == 0 {
+		serviceName = target.URL.Opaque
+	}
+
+	if len(serviceName) == 0 || strings.Contains(serviceName, "/") {
+		return "", ErrorNoServiceName
+	}
+
+	return serviceName, nil
+}
+
+// discoveryResolver is the resolver.Resolver for a single service.  It is the Listener which
+// pushes each change of the service's instances into the ClientConn.
+type discoveryResolver struct {
+	discovery   service.Discovery
+	serviceName string
+	selectPort  service.PortSelector
+	clientConn  resolver.ClientConn
+
+	mutex        sync.Mutex
+	closed       bool
+	registration service.Registration
+}
+
+var _ resolver.Resolver = (*discoveryResolver)(nil)
+var _ service.Listener = (*discoveryResolver)(nil)
+
+// setRegistration records the listener's registration, cancelling it if this resolver
+// was closed while the listener was being added
+func (this *discoveryResolver) setRegistration(registration service.Registration) {
+	this.mutex.Lock()
+	closed := this.closed
+	this.registration = registration
+	this.mutex.Unlock()
+
+	if closed {
+		registration.Cancel()
+	}
+}
+
+// ServicesChanged pushes the addresses of the given instances to the ClientConn.  An empty
+// set of instances is pushed as an empty address list, which gRPC reports as unavailable.
+func (this *discoveryResolver) ServicesChanged(serviceName string, instances service.Instances) {
+	addresses := instances.AddressesWithPort(this.selectPort)
+	state := resolver.State{Addresses: make([]resolver.Address, len(addresses))}
+	for index, address := range addresses {
+		state.Addresses[index] = resolver.Address{Addr: address}
+	}
+
+	// no lock is held while pushing, since gRPC may call ResolveNow from within UpdateState
+	if !this.isClosed() {
+		this.clientConn.UpdateState(state)
+	}
+}
+
+func (this *discoveryResolver) isClosed() bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.closed
+}
+
+// ResolveNow pushes the last-known instances of the service again.  Only the
+// Discovery's cache is consulted.
+func (this *discoveryResolver) ResolveNow(options resolver.ResolveNowOptions) {
+	if instances, err := this.discovery.FetchServices(this.serviceName); err == nil {
+		this.ServicesChanged(this.serviceName, instances)
+	}
+}
+
+// Close removes this resolver's listener.  No updates are pushed afterward.
+func (this *discoveryResolver) Close() {
+	this.mutex.Lock()
+	if this.closed {
+		this.mutex.Unlock()
+		return
+	}
+
+	this.closed = true
+	registration := this.registration
+	this.mutex.Unlock()
+
+	if registration != nil {
+		registration.Cancel()
+	}
+}
@@ -0,0 +1,184 @@
+package grpcresolver
+
+import (
+	"github.com/Comcast/golang-discovery-client/service"
+	"github.com/Comcast/golang-discovery-client/service/servicetest"
+	"github.com/foursquare/fsgo/net/discovery"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+// testClientConn is a resolver.ClientConn which records each State pushed to it
+type testClientConn struct {
+	mutex  sync.Mutex
+	states []resolver.State
+}
+
+func (this *testClientConn) UpdateState(state resolver.State) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.states = append(this.states, state)
+	return nil
+}
+
+func (this *testClientConn) ReportError(err error)                   {}
+func (this *testClientConn) NewAddress(addresses []resolver.Address) {}
+func (this *testClientConn) NewServiceConfig(serviceConfig string)   {}
+func (this *testClientConn) ParseServiceConfig(serviceConfigJSON string) *serviceconfig.ParseResult {
+	return nil
+}
+
+// addresses returns the addresses of each recorded State
+func (this *testClientConn) addresses() [][]string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	var addresses [][]string
+	for _, state := range this.states {
+		stateAddresses := []string{}
+		for _, address := range state.Addresses {
+			stateAddresses = append(stateAddresses, address.Addr)
+		}
+
+		addresses = append(addresses, stateAddresses)
+	}
+
+	return addresses
+}
+
+func newTestInstance(id, address string, port, sslPort int) *discovery.ServiceInstance {
+	serviceInstance := &discovery.ServiceInstance{Name: "test", Id: id, Address: address, Port: &port}
+	if sslPort > 0 {
+		serviceInstance.SslPort = &sslPort
+	}
+
+	return serviceInstance
+}
+
+func newTestTarget(t *testing.T, target string) resolver.Target {
+	parsed, err := url.Parse(target)
+	if err != nil {
+		t.Fatalf("Unable to parse target %s: %v", target, err)
+	}
+
+	return resolver.Target{URL: *parsed}
+}
+
+func TestTargetServiceName(t *testing.T) {
+	var testData = []struct {
+		target        resolver.Target
+		expectedName  string
+		expectedError error
+	}{
+		{newTestTarget(t, "discovery:///test"), "test", nil},
+		{newTestTarget(t, "discovery://authority/test"), "test", nil},
+		{newTestTarget(t, "discovery:test"), "test", nil},
+		{newTestTarget(t, "discovery:///"), "", ErrorNoServiceName},
+		{newTestTarget(t, "discovery:///nested/test"), "", ErrorNoServiceName},
+		{resolver.Target{}, "", ErrorNoServiceName},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+		serviceName, err := targetServiceName(record.target)
+		assert.Equal(record.expectedName, serviceName)
+		assert.Equal(record.expectedError, err)
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	assert := assert.New(t)
+
+	mock := servicetest.NewMockDiscovery("test")
+	mock.SetInstances("test", service.Instances{newTestInstance("1", "host1.com", 8080, 8443)})
+
+	builder := NewBuilder(mock)
+	assert.Equal(DefaultScheme, builder.Scheme())
+
+	clientConn := &testClientConn{}
+	discoveryResolver, err := builder.Build(newTestTarget(t, "discovery:///test"), clientConn, resolver.BuildOptions{})
+	if !assert.Nil(err) {
+		return
+	}
+
+	assert.Equal(1, mock.ListenerCount("test"))
+
+	// the last-known instances are pushed immediately, followed by each change
+	assert.Nil(mock.SetInstances("test", service.Instances{
+		newTestInstance("1", "host1.com", 8080, 8443),
+		newTestInstance("2", "host2.com", 9090, 0),
+	}))
+
+	// an empty set of instances is pushed as an empty address list
+	assert.Nil(mock.SetInstances("test", service.Instances{}))
+
+	discoveryResolver.ResolveNow(resolver.ResolveNowOptions{})
+	assert.Equal(
+		[][]string{
+			{"host1.com:8080"},
+			{"host1.com:8080", "host2.com:9090"},
+			{},
+			{},
+		},
+		clientConn.addresses(),
+	)
+
+	discoveryResolver.Close()
+	discoveryResolver.Close()
+	assert.Equal(0, mock.ListenerCount("test"))
+	assert.Nil(mock.SetInstances("test", service.Instances{newTestInstance("3", "host3.com", 8080, 0)}))
+	discoveryResolver.ResolveNow(resolver.ResolveNowOptions{})
+	assert.Len(clientConn.addresses(), 4)
+}
+
+func TestBuilderOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	mock := servicetest.NewMockDiscovery("test")
+	mock.SetInstances("test", service.Instances{
+		newTestInstance("1", "host1.com", 8080, 8443),
+		newTestInstance("2", "host2.com", 9090, 0),
+	})
+
+	builder := NewBuilder(mock, WithScheme("custom"), WithPortSelector(service.PreferSslPort))
+	assert.Equal("custom", builder.Scheme())
+
+	clientConn := &testClientConn{}
+	discoveryResolver, err := builder.Build(newTestTarget(t, "custom:///test"), clientConn, resolver.BuildOptions{})
+	if !assert.Nil(err) {
+		return
+	}
+
+	defer discoveryResolver.Close()
+	assert.Equal([][]string{{"host1.com:8443", "host2.com:9090"}}, clientConn.addresses())
+}
+
+func TestBuilderErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	mock := servicetest.NewMockDiscovery("test")
+	builder := NewBuilder(mock)
+
+	discoveryResolver, err := builder.Build(newTestTarget(t, "discovery:///"), &testClientConn{}, resolver.BuildOptions{})
+	assert.Nil(discoveryResolver)
+	assert.Equal(ErrorNoServiceName, err)
+
+	discoveryResolver, err = builder.Build(newTestTarget(t, "discovery:///nosuch"), &testClientConn{}, resolver.BuildOptions{})
+	assert.Nil(discoveryResolver)
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "nosuch")
+	}
+
+	// a service that has not been read pushes nothing until it is
+	clientConn := &testClientConn{}
+	discoveryResolver, err = builder.Build(newTestTarget(t, "discovery:///test"), clientConn, resolver.BuildOptions{})
+	if assert.Nil(err) {
+		defer discoveryResolver.Close()
+		discoveryResolver.ResolveNow(resolver.ResolveNowOptions{})
+		assert.Empty(clientConn.addresses())
+	}
+}
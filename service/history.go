@@ -0,0 +1,123 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// MaxEventRecordKeys is the maximum number of added, and of removed, instance ids kept by each
+// EventRecord.  Together with the EventHistorySize, it bounds the memory used by the history of a
+// service no matter how many instances the service has.
+const MaxEventRecordKeys = 100
+
+// EventRecord summarizes a single event dispatched for a service, as kept by the history
+// returned from Discovery.History.  Instances are recorded by id rather than in full.
+type EventRecord struct {
+	// Timestamp is the time at which the event was dispatched
+	Timestamp time.Time `json:"timestamp"`
+
+	// Revision is the InstanceEvent.Sequence of the event
+	Revision uint64 `json:"revision"`
+
+	// InstanceCount is the number of instances in the service after the event
+	InstanceCount int `json:"instanceCount"`
+
+	// AddedCount is the total number of instances added by the event, which may exceed the
+	// number of ids in Added
+	AddedCount int `json:"addedCount"`
+
+	// Added holds the ids of at most MaxEventRecordKeys of the instances added by the event
+	Added []string `json:"added,omitempty"`
+
+	// RemovedCount is the total number of instances removed by the event, which may exceed the
+	// number of ids in Removed
+	RemovedCount int `json:"removedCount"`
+
+	// Removed holds the ids of at most MaxEventRecordKeys of the instances removed by the event
+	Removed []string `json:"removed,omitempty"`
+
+	// Pinned is the InstanceEvent.Pinned of the event
+	Pinned bool `json:"pinned,omitempty"`
+}
+
+// newEventRecord summarizes the given event
+func newEventRecord(timestamp time.Time, event InstanceEvent) EventRecord {
+	return EventRecord{
+		Timestamp:     timestamp,
+		Revision:      event.Sequence,
+		InstanceCount: len(event.Current),
+		AddedCount:    len(event.Added),
+		Added:         recordKeys(event.Added),
+		RemovedCount:  len(event.Removed),
+		Removed:       recordKeys(event.Removed),
+		Pinned:        event.Pinned,
+	}
+}
+
+// recordKeys returns the ids of at most MaxEventRecordKeys of the given instances, or nil
+// if there are none
+func recordKeys(instances Instances) []string {
+	count := len(instances)
+	if count > MaxEventRecordKeys {
+		count = MaxEventRecordKeys
+	}
+
+	if count == 0 {
+		return nil
+	}
+
+	keys := make([]string, count)
+	for index := range keys {
+		keys[index] = instances[index].Id
+	}
+
+	return keys
+}
+
+// eventHistory is a fixed-size ring buffer of the most recent EventRecords of a service.
+// A nil eventHistory records nothing, which is how history is disabled.
+type eventHistory struct {
+	mutex   sync.Mutex
+	records []EventRecord
+	next    int
+	full    bool
+}
+
+// newEventHistory creates an eventHistory which holds the given number of records, or returns
+// nil if size is not positive
+func newEventHistory(size int) *eventHistory {
+	if size < 1 {
+		return nil
+	}
+
+	return &eventHistory{records: make([]EventRecord, size)}
+}
+
+// add records the given EventRecord, replacing the oldest record once this history is full
+func (this *eventHistory) add(record EventRecord) {
+	if this == nil {
+		return
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.records[this.next] = record
+	this.next = (this.next + 1) % len(this.records)
+	this.full = this.full || this.next == 0
+}
+
+// snapshot returns a copy of the records in this history, oldest first.  A nil history
+// returns nil.
+func (this *eventHistory) snapshot() []EventRecord {
+	if this == nil {
+		return nil
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if !this.full {
+		return append([]EventRecord{}, this.records[:this.next]...)
+	}
+
+	return append(append(make([]EventRecord, 0, len(this.records)), this.records[this.next:]...), this.records[:this.next]...)
+}
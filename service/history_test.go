@@ -0,0 +1,170 @@
+package service
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestEventHistory(t *testing.T) {
+	var testData = []struct {
+		size              int
+		records           int
+		expectedRevisions []uint64
+	}{
+		{1, 0, []uint64{}},
+		{1, 1, []uint64{1}},
+		{1, 3, []uint64{3}},
+		{3, 2, []uint64{1, 2}},
+		{3, 3, []uint64{1, 2, 3}},
+		{3, 4, []uint64{2, 3, 4}},
+		{3, 10, []uint64{8, 9, 10}},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+		history := newEventHistory(record.size)
+		for revision := 1; revision <= record.records; revision++ {
+			history.add(EventRecord{Revision: uint64(revision)})
+		}
+
+		revisions := []uint64{}
+		for _, eventRecord := range history.snapshot() {
+			revisions = append(revisions, eventRecord.Revision)
+		}
+
+		assert.Equal(record.expectedRevisions, revisions)
+		assert.Len(history.records, record.size)
+	}
+}
+
+func TestDisabledEventHistory(t *testing.T) {
+	assert := assert.New(t)
+
+	history := newEventHistory(0)
+	assert.Nil(history)
+	history.add(EventRecord{Revision: 1})
+	assert.Nil(history.snapshot())
+}
+
+func TestNewEventRecord(t *testing.T) {
+	assert := assert.New(t)
+
+	many := make(Instances, MaxEventRecordKeys+5)
+	for index := range many {
+		many[index] = newTestInstance(fmt.Sprintf("%03d", index), "host.com", 8080)
+	}
+
+	timestamp := time.Now()
+	eventRecord := newEventRecord(timestamp, InstanceEvent{
+		Added:    many,
+		Removed:  testInstancesWithIds("old"),
+		Current:  many,
+		Sequence: 7,
+	})
+
+	assert.Equal(timestamp, eventRecord.Timestamp)
+	assert.Equal(uint64(7), eventRecord.Revision)
+	assert.Equal(len(many), eventRecord.InstanceCount)
+	assert.Equal(len(many), eventRecord.AddedCount)
+	assert.Equal(instanceIds(many[:MaxEventRecordKeys]), eventRecord.Added)
+	assert.Equal(1, eventRecord.RemovedCount)
+	assert.Equal([]string{"old"}, eventRecord.Removed)
+
+	eventRecord = newEventRecord(timestamp, InstanceEvent{Current: Instances{}, Sequence: 8})
+	assert.Equal(0, eventRecord.AddedCount)
+	assert.Nil(eventRecord.Added)
+	assert.Nil(eventRecord.Removed)
+}
+
+func TestDispatchRecordsHistory(t *testing.T) {
+	assert := assert.New(t)
+
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, watcherOptions{eventHistorySize: 2})
+	defer serviceWatcherSet.stop()
+	serviceWatcher, _ := serviceWatcherSet.findByName(testServiceName)
+
+	serviceWatcher.dispatch(testInstancesWithIds("1", "2"))
+	serviceWatcher.dispatch(testInstancesWithIds("1", "2"))
+	serviceWatcher.dispatch(testInstancesWithIds("2", "3"))
+	serviceWatcher.dispatch(testInstancesWithIds("3"))
+
+	// the unchanged snapshot is not an event, and the oldest event has been replaced
+	history := serviceWatcher.history.snapshot()
+	if assert.Len(history, 2) {
+		assert.Equal(uint64(2), history[0].Revision)
+		assert.Equal(2, history[0].InstanceCount)
+		assert.Equal([]string{"3"}, history[0].Added)
+		assert.Equal([]string{"1"}, history[0].Removed)
+
+		assert.Equal(uint64(3), history[1].Revision)
+		assert.Equal(1, history[1].InstanceCount)
+		assert.Nil(history[1].Added)
+		assert.Equal([]string{"2"}, history[1].Removed)
+		assert.False(history[1].Timestamp.Before(history[0].Timestamp))
+	}
+
+	assert.Equal(history, serviceWatcher.serviceStatus().History)
+}
+
+func TestDiscoveryHistory(t *testing.T) {
+	assert := assert.New(t)
+
+	builder := &DiscoveryBuilder{
+		Connection:       testConnection,
+		BasePath:         testBasePath,
+		Watches:          []string{testServiceName},
+		EventHistorySize: 10,
+	}
+
+	discovery, err := builder.New(&testLogger{t})
+	if !assert.Nil(err) {
+		return
+	}
+
+	defer discovery.Close()
+	assert.Empty(discovery.History(testServiceName))
+	assert.Nil(discovery.History("nosuch"))
+
+	serviceWatcher, _ := discovery.(*curatorDiscovery).serviceWatcherSet.findByName(testServiceName)
+	serviceWatcher.dispatch(testInstancesWithIds("1"))
+	history := discovery.History(testServiceName)
+	if assert.Len(history, 1) {
+		assert.Equal([]string{"1"}, history[0].Added)
+	}
+
+	// the history is a copy
+	history[0].Revision = 100
+	assert.Equal(uint64(1), discovery.History(testServiceName)[0].Revision)
+
+	builder.EventHistorySize = 0
+	discovery, err = builder.New(&testLogger{t})
+	if assert.Nil(err) {
+		defer discovery.Close()
+		serviceWatcher, _ = discovery.(*curatorDiscovery).serviceWatcherSet.findByName(testServiceName)
+		serviceWatcher.dispatch(testInstancesWithIds("1"))
+		assert.Nil(discovery.History(testServiceName))
+	}
+}
+
+func TestEventHistorySize(t *testing.T) {
+	var testData = []struct {
+		builder       DiscoveryBuilder
+		expectedSize  int
+		expectedError error
+	}{
+		{DiscoveryBuilder{}, 0, nil},
+		{DiscoveryBuilder{EventHistorySize: 100}, 100, nil},
+		{DiscoveryBuilder{EventHistorySize: -1}, -1, ErrorInvalidEventHistorySize},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+		size, err := record.builder.eventHistorySize()
+		assert.Equal(record.expectedSize, size)
+		assert.Equal(record.expectedError, err)
+	}
+}
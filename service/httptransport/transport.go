@@ -0,0 +1,227 @@
+// Package httptransport provides an http.RoundTripper which load balances requests across the
+// instances of a service watched by a service.Discovery.
+package httptransport
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Comcast/golang-discovery-client/service"
+	"github.com/foursquare/fsgo/net/discovery"
+	"io"
+	"net/http"
+	"strings"
+	"syscall"
+)
+
+const (
+	// maxSelections is the number of times the Selector is consulted for a usable instance
+	// before a request fails with ErrorNoInstances
+	maxSelections = 3
+)
+
+var (
+	ErrorNoInstances = errors.New("No instances of the service are available")
+)
+
+// Option configures a Transport
+type Option func(*Transport)
+
+// WithSelector sets how a Transport chooses an instance for each request.  By default,
+// instances are chosen with a service.RoundRobin.
+func WithSelector(selector service.Selector) Option {
+	return func(transport *Transport) {
+		transport.selector = selector
+	}
+}
+
+// WithBase sets the http.RoundTripper which actually sends requests.  By default,
+// http.DefaultTransport is used.
+func WithBase(base http.RoundTripper) Option {
+	return func(transport *Transport) {
+		transport.base = base
+	}
+}
+
+// WithPortSelector sets how a Transport chooses the port of each instance.  By default, the
+// port is chosen by the request's scheme:  https requests prefer the SslPort, and all other
+// requests use the Port.
+func WithPortSelector(selectPort service.PortSelector) Option {
+	return func(transport *Transport) {
+		transport.selectPort = selectPort
+	}
+}
+
+// Transport is an http.RoundTripper which sends each request to an instance of a single
+// watched service.  The host and port of each request's URL are replaced with those of the
+// chosen instance, so requests can be built against any placeholder host, e.g.
+// "http://service-name/path".  If an instance refuses the connection, the request is retried
+// once against a different instance, provided its body can be replayed via GetBody.
+//
+// A Transport is a Listener for its service, and is safe for concurrent use.
+type Transport struct {
+	serviceName  string
+	selector     service.Selector
+	base         http.RoundTripper
+	selectPort   service.PortSelector
+	registration service.Registration
+}
+
+var _ http.RoundTripper = (*Transport)(nil)
+var _ service.Listener = (*Transport)(nil)
+
+// NewTransport creates a Transport which sends requests to instances of the named service.  The
+// service must already be watched by the Discovery, or an error is returned.  Close should be
+// called once the Transport is no longer used.
+func NewTransport(serviceDiscovery service.Discovery, serviceName string, options ...Option) (*Transport, error) {
+	transport := &Transport{
+		serviceName: serviceName,
+		base:        http.DefaultTransport,
+	}
+
+	for _, option := range options {
+		option(transport)
+	}
+
+	if transport.selector == nil {
+		transport.selector = service.NewRoundRobin(nil)
+	}
+
+	if transport.base == nil {
+		transport.base = http.DefaultTransport
+	}
+
+	registration, err := serviceDiscovery.AddListener(serviceName, transport)
+	if err != nil {
+		return nil, errors.New(
+			fmt.Sprintf("Unable to balance requests across service [%s]: %v", serviceName, err),
+		)
+	}
+
+	transport.registration = registration
+	return transport, nil
+}
+
+// ServiceName returns the name of the service this Transport sends requests to
+func (this *Transport) ServiceName() string {
+	return this.serviceName
+}
+
+// ServicesChanged replaces the instances this Transport chooses from
+func (this *Transport) ServicesChanged(serviceName string, instances service.Instances) {
+	this.selector.ServicesChanged(serviceName, instances)
+}
+
+// RoundTrip sends the request to an instance of this Transport's service.  If no instance is
+// available, ErrorNoInstances is returned.  The request itself is never modified.
+func (this *Transport) RoundTrip(request *http.Request) (*http.Response, error) {
+	serviceInstance, address, err := this.selectInstance(request.URL.Scheme, nil)
+	if err != nil {
+		closeBody(request.Body)
+		return nil, err
+	}
+
+	response, err := this.base.RoundTrip(rewrite(request, address, request.Body))
+	if err == nil || !isConnectionRefused(err) {
+		return response, err
+	}
+
+	body, replayable := replayBody(request)
+	if !replayable {
+		return nil, err
+	}
+
+	_, retryAddress, selectErr := this.selectInstance(request.URL.Scheme, serviceInstance)
+	if selectErr != nil {
+		closeBody(body)
+		return nil, err
+	}
+
+	return this.base.RoundTrip(rewrite(request, retryAddress, body))
+}
+
+// CloseIdleConnections closes the idle connections of the base RoundTripper, if it supports
+// doing so
+func (this *Transport) CloseIdleConnections() {
+	if closer, ok := this.base.(interface {
+		CloseIdleConnections()
+	}); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+// Close removes this Transport's listener.  Requests may still be sent afterward, but they
+// go to the last-known instances of the service.
+func (this *Transport) Close() error {
+	this.registration.Cancel()
+	return nil
+}
+
+// selectInstance chooses an instance with a usable address, skipping the excluded instance.
+// The Selector is consulted at most maxSelections times.
+func (this *Transport) selectInstance(scheme string, excluded *discovery.ServiceInstance) (*discovery.ServiceInstance, string, error) {
+	selectPort := this.selectPort
+	if selectPort == nil {
+		if strings.EqualFold(scheme, "https") {
+			selectPort = service.PreferSslPort
+		} else {
+			selectPort = service.PlainPort
+		}
+	}
+
+	for selection := 0; selection < maxSelections; selection++ {
+		serviceInstance := this.selector.Next()
+		if serviceInstance == nil {
+			break
+		} else if excluded != nil && serviceInstance.Id == excluded.Id {
+			continue
+		}
+
+		if addresses := (service.Instances{serviceInstance}).AddressesWithPort(selectPort); len(addresses) > 0 {
+			return serviceInstance, addresses[0], nil
+		}
+	}
+
+	return nil, "", ErrorNoInstances
+}
+
+// rewrite produces a copy of the request addressed to the given host and port.  A Host header
+// which merely repeats the original URL's host is dropped, so that the instance's address is sent.
+func rewrite(request *http.Request, address string, body io.ReadCloser) *http.Request {
+	rewritten := request.Clone(request.Context())
+	rewritten.Body = body
+	rewritten.URL.Host = address
+	if request.Host == request.URL.Host {
+		rewritten.Host = ""
+	}
+
+	return rewritten
+}
+
+// replayBody produces a fresh copy of the request's body for a retry.  If the request has a
+// body that cannot be replayed, this function returns false.
+func replayBody(request *http.Request) (io.ReadCloser, bool) {
+	if request.Body == nil || request.Body == http.NoBody {
+		return request.Body, true
+	} else if request.GetBody == nil {
+		return nil, false
+	}
+
+	body, err := request.GetBody()
+	if err != nil {
+		return nil, false
+	}
+
+	return body, true
+}
+
+func closeBody(body io.ReadCloser) {
+	if body != nil {
+		body.Close()
+	}
+}
+
+// isConnectionRefused tests if an error resulted from an instance refusing the connection,
+// in which case the request was never sent
+func isConnectionRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
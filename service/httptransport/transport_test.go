@@ -0,0 +1,273 @@
+package httptransport
+
+import (
+	"github.com/Comcast/golang-discovery-client/service"
+	"github.com/Comcast/golang-discovery-client/service/servicetest"
+	"github.com/foursquare/fsgo/net/discovery"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// newTestServer starts a server which responds with its name and the request's host and body
+func newTestServer(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		body, _ := ioutil.ReadAll(request.Body)
+		response.Write([]byte(name + " " + request.Host + " " + string(body)))
+	}))
+}
+
+// newServerInstance creates an instance which refers to the given server
+func newServerInstance(t *testing.T, id string, server *httptest.Server) *discovery.ServiceInstance {
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return newAddressInstance(t, id, serverURL.Host)
+}
+
+// newRefusingInstance creates an instance which refers to a port that nothing listens on
+func newRefusingInstance(t *testing.T, id string) *discovery.ServiceInstance {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	address := listener.Addr().String()
+	listener.Close()
+	return newAddressInstance(t, id, address)
+}
+
+func newAddressInstance(t *testing.T, id, address string) *discovery.ServiceInstance {
+	host, portValue, err := net.SplitHostPort(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port, err := strconv.Atoi(portValue)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &discovery.ServiceInstance{Name: "test", Id: id, Address: host, Port: &port}
+}
+
+// get sends a GET through the transport, returning the response body
+func get(transport http.RoundTripper, target string) (string, error) {
+	client := &http.Client{Transport: transport}
+	response, err := client.Get(target)
+	if err != nil {
+		return "", err
+	}
+
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	return string(body), err
+}
+
+func TestTransportRoundRobin(t *testing.T) {
+	assert := assert.New(t)
+	first := newTestServer("first")
+	defer first.Close()
+	second := newTestServer("second")
+	defer second.Close()
+
+	mock := servicetest.NewMockDiscovery("test")
+	mock.SetInstances("test", service.Instances{newServerInstance(t, "1", first), newServerInstance(t, "2", second)})
+
+	transport, err := NewTransport(mock, "test")
+	if !assert.Nil(err) {
+		return
+	}
+
+	defer transport.Close()
+	assert.Equal("test", transport.ServiceName())
+
+	var names []string
+	for repeat := 0; repeat < 4; repeat++ {
+		body, err := get(transport, "http://test/path")
+		if assert.Nil(err) {
+			names = append(names, strings.Fields(body)[0])
+		}
+	}
+
+	assert.Equal([]string{"first", "second", "first", "second"}, names)
+
+	// the placeholder host is not sent as the Host header
+	body, err := get(transport, "http://test/path")
+	assert.Nil(err)
+	assert.NotContains(body, " test ")
+}
+
+func TestTransportUpdates(t *testing.T) {
+	assert := assert.New(t)
+	first := newTestServer("first")
+	defer first.Close()
+	second := newTestServer("second")
+	defer second.Close()
+
+	mock := servicetest.NewMockDiscovery("test")
+	transport, err := NewTransport(mock, "test")
+	if !assert.Nil(err) {
+		return
+	}
+
+	_, err = get(transport, "http://test/")
+	assert.Contains(err.Error(), ErrorNoInstances.Error())
+
+	assert.Nil(mock.SetInstances("test", service.Instances{newServerInstance(t, "1", first)}))
+	body, err := get(transport, "http://test/")
+	assert.Nil(err)
+	assert.True(strings.HasPrefix(body, "first "))
+
+	assert.Nil(mock.SetInstances("test", service.Instances{newServerInstance(t, "2", second)}))
+	body, err = get(transport, "http://test/")
+	assert.Nil(err)
+	assert.True(strings.HasPrefix(body, "second "))
+
+	// once closed, the last-known instances are still used
+	assert.Nil(transport.Close())
+	assert.Nil(mock.SetInstances("test", service.Instances{}))
+	body, err = get(transport, "http://test/")
+	assert.Nil(err)
+	assert.True(strings.HasPrefix(body, "second "))
+}
+
+func TestTransportRetriesRefusedConnections(t *testing.T) {
+	assert := assert.New(t)
+	server := newTestServer("server")
+	defer server.Close()
+
+	mock := servicetest.NewMockDiscovery("test")
+	mock.SetInstances("test", service.Instances{newRefusingInstance(t, "refusing"), newServerInstance(t, "1", server)})
+
+	transport, err := NewTransport(mock, "test")
+	if !assert.Nil(err) {
+		return
+	}
+
+	defer transport.Close()
+
+	// the first request goes to the refusing instance, and the body is replayed on retry
+	response, err := (&http.Client{Transport: transport}).Post("http://test/", "text/plain", strings.NewReader("payload"))
+	if assert.Nil(err) {
+		body, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		assert.True(strings.HasPrefix(string(body), "server "))
+		assert.True(strings.HasSuffix(string(body), " payload"))
+	}
+
+	// a body which cannot be replayed is not retried
+	request, _ := http.NewRequest(http.MethodPost, "http://test/", ioutil.NopCloser(strings.NewReader("payload")))
+	_, err = transport.RoundTrip(request)
+	assert.NotNil(err)
+	assert.True(isConnectionRefused(err))
+}
+
+func TestTransportDoesNotRetrySameInstance(t *testing.T) {
+	assert := assert.New(t)
+	mock := servicetest.NewMockDiscovery("test")
+	mock.SetInstances("test", service.Instances{newRefusingInstance(t, "refusing")})
+
+	transport, err := NewTransport(mock, "test")
+	if !assert.Nil(err) {
+		return
+	}
+
+	defer transport.Close()
+	_, err = get(transport, "http://test/")
+	assert.NotNil(err)
+	assert.NotContains(err.Error(), ErrorNoInstances.Error())
+}
+
+func TestTransportSelectInstance(t *testing.T) {
+	assert := assert.New(t)
+	sslPort := 8443
+	port := 8080
+	secure := &discovery.ServiceInstance{Id: "1", Address: "secure.com", Port: &port, SslPort: &sslPort}
+	noPort := &discovery.ServiceInstance{Id: "2", Address: "noport.com"}
+
+	var testData = []struct {
+		instances       service.Instances
+		scheme          string
+		selectPort      service.PortSelector
+		excluded        *discovery.ServiceInstance
+		expectedAddress string
+		expectedError   error
+	}{
+		{nil, "http", nil, nil, "", ErrorNoInstances},
+		{service.Instances{secure}, "http", nil, nil, "secure.com:8080", nil},
+		{service.Instances{secure}, "https", nil, nil, "secure.com:8443", nil},
+		{service.Instances{secure}, "HTTPS", nil, nil, "secure.com:8443", nil},
+		{service.Instances{secure}, "https", service.PlainPort, nil, "secure.com:8080", nil},
+		{service.Instances{secure}, "http", nil, secure, "", ErrorNoInstances},
+		{service.Instances{noPort}, "http", nil, nil, "", ErrorNoInstances},
+		{service.Instances{noPort, secure}, "http", nil, nil, "secure.com:8080", nil},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		mock := servicetest.NewMockDiscovery()
+		mock.SetInstances("test", record.instances)
+		transport, err := NewTransport(mock, "test", WithPortSelector(record.selectPort))
+		if !assert.Nil(err) {
+			continue
+		}
+
+		_, address, err := transport.selectInstance(record.scheme, record.excluded)
+		assert.Equal(record.expectedAddress, address)
+		assert.Equal(record.expectedError, err)
+	}
+}
+
+func TestTransportOptions(t *testing.T) {
+	assert := assert.New(t)
+	mock := servicetest.NewMockDiscovery("test")
+
+	_, err := NewTransport(mock, "nosuch")
+	assert.NotNil(err)
+
+	weightedRandom := service.NewWeightedRandom(nil, 1, nil)
+	var sent *http.Request
+	base := roundTripperFunc(func(request *http.Request) (*http.Response, error) {
+		sent = request
+		return &http.Response{StatusCode: http.StatusNoContent, Body: http.NoBody}, nil
+	})
+
+	transport, err := NewTransport(mock, "test", WithSelector(weightedRandom), WithBase(base))
+	if !assert.Nil(err) {
+		return
+	}
+
+	assert.Nil(mock.SetInstances("test", service.Instances{newAddressInstance(t, "1", "10.0.0.1:8080")}))
+	assert.Equal("1", weightedRandom.Next().Id)
+
+	request, _ := http.NewRequest(http.MethodGet, "http://test/path?query=1", nil)
+	request.Host = "virtual.example.com"
+	response, err := transport.RoundTrip(request)
+	if assert.Nil(err) {
+		assert.Equal(http.StatusNoContent, response.StatusCode)
+		assert.Equal("10.0.0.1:8080", sent.URL.Host)
+		assert.Equal("/path", sent.URL.Path)
+		assert.Equal("query=1", sent.URL.RawQuery)
+		assert.Equal("virtual.example.com", sent.Host)
+
+		// the original request is not modified
+		assert.Equal("test", request.URL.Host)
+	}
+
+	transport.CloseIdleConnections()
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(request *http.Request) (*http.Response, error) {
+	return f(request)
+}
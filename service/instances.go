@@ -2,9 +2,16 @@ package service
 
 import (
 	"bytes"
-	"errors"
+	"encoding/json"
 	"fmt"
 	"github.com/foursquare/fsgo/net/discovery"
+	"net"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Instances is a custom slice type that stores ServiceInstances.
@@ -17,6 +24,20 @@ func (this Instances) Len() int {
 	return len(this)
 }
 
+// clone returns a deep copy of this Instances.  Each ServiceInstance is copied, so that
+// modifications to the clone do not affect the original.
+func (this Instances) clone() Instances {
+	clone := make(Instances, len(this))
+	for index, serviceInstance := range this {
+		if serviceInstance != nil {
+			instanceClone := *serviceInstance
+			clone[index] = &instanceClone
+		}
+	}
+
+	return clone
+}
+
 // String outputs a string representation of this Instances, useful for debugging.
 // This method follows pointers to make the debug output more useful.
 func (this Instances) String() string {
@@ -36,28 +57,62 @@ func (this Instances) String() string {
 	return output.String()
 }
 
-// RegisterWith registers each instance in this slice with the supplied service discovery.
+// RegisterWith registers each instance in this slice with the supplied Registrar, which is
+// typically a *discovery.ServiceDiscovery or the result of NewRegistrar.
 // This method normalizes each ServiceInstance, using the discovery API to create a new instance
 // with internal data members set (e.g. timestamps).
-func (this Instances) RegisterWith(serviceDiscovery *discovery.ServiceDiscovery) error {
+//
+// Every instance is attempted, even if earlier instances fail.  If any instance could not be
+// registered, a MultiError is returned describing each failure.  The failed instances are the
+// originals from this slice, so MultiError.Instances can be passed to RegisterWith again.
+func (this Instances) RegisterWith(registrar Registrar) error {
+	if isReadOnly(registrar) {
+		return ErrorReadOnly
+	}
+
+	var failures MultiError
 	for _, original := range this {
-		normalized := discovery.NewServiceInstance(
-			original.Name,
-			original.Address,
-			original.Port,
-			original.SslPort,
-			original.Payload,
-		)
+		if err := registrar.Register(normalizeInstance(original)); err != nil {
+			failures = append(failures, InstanceError{original, err})
+		}
+	}
+
+	return failures.errorOrNil()
+}
 
-		err := serviceDiscovery.Register(normalized)
-		if err != nil {
-			return errors.New(
-				fmt.Sprintf("Error while registering service instance %v: %v", normalized, err),
-			)
+// DeregisterFrom unregisters each instance in this slice from the supplied Registrar.
+// Every instance is attempted, even if earlier instances fail.  If any instance could not be
+// unregistered, a MultiError is returned describing each failure.
+func (this Instances) DeregisterFrom(registrar Registrar) error {
+	if isReadOnly(registrar) {
+		return ErrorReadOnly
+	}
+
+	return deregisterAll(registrar, this)
+}
+
+// deregisterAll unregisters each instance from the given registrar, collecting any errors
+func deregisterAll(registrar Registrar, instances Instances) error {
+	var failures MultiError
+	for _, serviceInstance := range instances {
+		if err := registrar.Unregister(serviceInstance); err != nil {
+			failures = append(failures, InstanceError{serviceInstance, err})
 		}
 	}
 
-	return nil
+	return failures.errorOrNil()
+}
+
+// normalizeInstance uses the discovery API to create a new ServiceInstance from an original,
+// which sets internal data members such as the Id and registration timestamp.
+func normalizeInstance(original *discovery.ServiceInstance) *discovery.ServiceInstance {
+	return discovery.NewServiceInstance(
+		original.Name,
+		original.Address,
+		original.Port,
+		original.SslPort,
+		original.Payload,
+	)
 }
 
 // ToKeys maps each ServiceInstance onto a string key via keyFunc, then
@@ -75,3 +130,404 @@ func (this Instances) ToKeyMap(keyFunc KeyFunc, output KeyMap) {
 		output[keyFunc(serviceInstance)] = serviceInstance
 	}
 }
+
+// PortSelector chooses which port of a ServiceInstance to use, returning nil if the
+// instance has no suitable port
+type PortSelector func(*discovery.ServiceInstance) *int
+
+// PreferSslPort is a PortSelector which chooses the SslPort when set, and the Port otherwise
+func PreferSslPort(serviceInstance *discovery.ServiceInstance) *int {
+	if serviceInstance.SslPort != nil {
+		return serviceInstance.SslPort
+	}
+
+	return serviceInstance.Port
+}
+
+var _ PortSelector = PreferSslPort
+
+// PlainPort is a PortSelector which only ever chooses the Port
+func PlainPort(serviceInstance *discovery.ServiceInstance) *int {
+	return serviceInstance.Port
+}
+
+var _ PortSelector = PlainPort
+
+// Addresses returns the "host:port" address of each ServiceInstance, using the SslPort
+// when it is set.  This is the same as AddressesWithPort(PreferSslPort).
+func (this Instances) Addresses() []string {
+	return this.AddressesWithPort(PreferSslPort)
+}
+
+// AddressesWithPort returns the "host:port" address of each ServiceInstance, using the port
+// chosen by selectPort.  ServiceInstances without an address or a chosen port are skipped.
+// The addresses are in the same order as this Instances, so sorting this Instances first,
+// e.g. with Sort(ByAddress), produces a deterministic result.
+func (this Instances) AddressesWithPort(selectPort PortSelector) []string {
+	addresses := make([]string, 0, len(this))
+	for _, serviceInstance := range this {
+		if address, ok := joinAddress(serviceInstance, selectPort); ok {
+			addresses = append(addresses, address)
+		}
+	}
+
+	return addresses
+}
+
+// URLs returns a URL with the given scheme, e.g. "http", for each ServiceInstance.  For the
+// "https" scheme the SslPort is used when set, and for every other scheme only the Port is
+// used.  ServiceInstances are skipped and ordered as with AddressesWithPort.
+func (this Instances) URLs(scheme string) []*url.URL {
+	selectPort := PortSelector(PlainPort)
+	if strings.EqualFold(scheme, "https") {
+		selectPort = PreferSslPort
+	}
+
+	urls := make([]*url.URL, 0, len(this))
+	for _, serviceInstance := range this {
+		if address, ok := joinAddress(serviceInstance, selectPort); ok {
+			urls = append(urls, &url.URL{Scheme: scheme, Host: address})
+		}
+	}
+
+	return urls
+}
+
+// joinAddress forms the "host:port" address of a ServiceInstance.  IPv6 addresses are
+// bracketed.  If the instance has no address or no chosen port, this function returns false.
+func joinAddress(serviceInstance *discovery.ServiceInstance, selectPort PortSelector) (string, bool) {
+	if serviceInstance == nil || len(serviceInstance.Address) == 0 {
+		return "", false
+	}
+
+	port := selectPort(serviceInstance)
+	if port == nil {
+		return "", false
+	}
+
+	return net.JoinHostPort(serviceInstance.Address, strconv.Itoa(*port)), true
+}
+
+// Filter returns a new Instances containing only those ServiceInstances for which
+// the predicate returns true.  The original ordering is preserved, and this Instances
+// is not modified.  A nil predicate matches every ServiceInstance, which means that
+// Filter(nil) simply returns a copy.
+func (this Instances) Filter(predicate func(*discovery.ServiceInstance) bool) Instances {
+	filtered := make(Instances, 0, len(this))
+	for _, serviceInstance := range this {
+		if predicate == nil || predicate(serviceInstance) {
+			filtered = append(filtered, serviceInstance)
+		}
+	}
+
+	return filtered
+}
+
+// OlderThan returns a new Instances containing only those ServiceInstances which registered
+// before the cutoff, according to their RegistrationTimeUTC.  ServiceInstances without a
+// registration time are never included.  Order is preserved, and this Instances is not modified.
+func (this Instances) OlderThan(cutoff time.Time) Instances {
+	cutoffMillis := cutoff.UnixNano() / int64(time.Millisecond)
+	return this.Filter(func(serviceInstance *discovery.ServiceInstance) bool {
+		return serviceInstance != nil &&
+			serviceInstance.RegistrationTimeUTC > 0 &&
+			serviceInstance.RegistrationTimeUTC < cutoffMillis
+	})
+}
+
+// Dedupe returns a new Instances containing only the first ServiceInstance for each key, as
+// determined by keyFunc.  Order is preserved, and this Instances is not modified.  If keyFunc
+// is nil, ServiceInstances are keyed by their address and port, with the address compared
+// case-insensitively.  Nil elements are dropped.
+func (this Instances) Dedupe(keyFunc KeyFunc) Instances {
+	if keyFunc == nil {
+		keyFunc = normalizedSpec
+	}
+
+	deduped := make(Instances, 0, len(this))
+	seen := make(map[string]bool, len(this))
+	for _, serviceInstance := range this {
+		if serviceInstance == nil {
+			continue
+		}
+
+		key := keyFunc(serviceInstance)
+		if !seen[key] {
+			seen[key] = true
+			deduped = append(deduped, serviceInstance)
+		}
+	}
+
+	return deduped
+}
+
+// GroupBy partitions this Instances by the key that keyFunc produces for each ServiceInstance.
+// Each group preserves the original order, and this Instances is not modified.  If keyFunc is
+// nil, ServiceInstances are grouped by their Name.  ServiceInstances whose key is empty are
+// grouped under the empty string, and nil elements are dropped.
+func (this Instances) GroupBy(keyFunc KeyFunc) map[string]Instances {
+	if keyFunc == nil {
+		keyFunc = InstanceName
+	}
+
+	groups := make(map[string]Instances)
+	for _, serviceInstance := range this {
+		if serviceInstance == nil {
+			continue
+		}
+
+		key := keyFunc(serviceInstance)
+		groups[key] = append(groups[key], serviceInstance)
+	}
+
+	return groups
+}
+
+// Diff compares this Instances against a previous Instances, returning the ServiceInstances
+// that were added and the ServiceInstances that were removed.  ServiceInstances are matched
+// using the supplied keyFunc, which defaults to InstanceId if nil.  The added Instances are
+// in the same order as this Instances, and the removed Instances are in the same order as
+// the previous Instances.  Nil elements in either Instances are ignored.
+func (this Instances) Diff(previous Instances, keyFunc KeyFunc) (added Instances, removed Instances) {
+	if keyFunc == nil {
+		keyFunc = InstanceId
+	}
+
+	currentKeys := make(map[string]bool, len(this))
+	for _, serviceInstance := range this {
+		if serviceInstance != nil {
+			currentKeys[keyFunc(serviceInstance)] = true
+		}
+	}
+
+	previousKeys := make(map[string]bool, len(previous))
+	for _, serviceInstance := range previous {
+		if serviceInstance != nil {
+			key := keyFunc(serviceInstance)
+			previousKeys[key] = true
+			if !currentKeys[key] {
+				removed = append(removed, serviceInstance)
+			}
+		}
+	}
+
+	for _, serviceInstance := range this {
+		if serviceInstance != nil && !previousKeys[keyFunc(serviceInstance)] {
+			added = append(added, serviceInstance)
+		}
+	}
+
+	return
+}
+
+// updatedFrom returns the ServiceInstances in this Instances whose Id is also present in the
+// previous Instances, but whose data differs.  Nil elements in either Instances are ignored.
+func (this Instances) updatedFrom(previous Instances) (updated Instances) {
+	previousById := make(map[string]*discovery.ServiceInstance, len(previous))
+	for _, serviceInstance := range previous {
+		if serviceInstance != nil {
+			previousById[serviceInstance.Id] = serviceInstance
+		}
+	}
+
+	for _, serviceInstance := range this {
+		if serviceInstance != nil {
+			if previousInstance, ok := previousById[serviceInstance.Id]; ok && !reflect.DeepEqual(previousInstance, serviceInstance) {
+				updated = append(updated, serviceInstance)
+			}
+		}
+	}
+
+	return
+}
+
+// Equal tests whether this Instances and another Instances contain the same ServiceInstances,
+// as determined by keyFunc.  Order is not significant, but the number of ServiceInstances
+// with each key is.  If keyFunc is nil, InstanceId is used.  Nil elements are ignored.
+func (this Instances) Equal(other Instances, keyFunc KeyFunc) bool {
+	if keyFunc == nil {
+		keyFunc = InstanceId
+	}
+
+	counts := make(map[string]int, len(this))
+	for _, serviceInstance := range this {
+		if serviceInstance != nil {
+			counts[keyFunc(serviceInstance)]++
+		}
+	}
+
+	for _, serviceInstance := range other {
+		if serviceInstance != nil {
+			key := keyFunc(serviceInstance)
+			if counts[key] == 0 {
+				return false
+			}
+
+			counts[key]--
+		}
+	}
+
+	for _, count := range counts {
+		if count != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// InstanceEquivalent tests whether two ServiceInstances describe the same logical endpoint: the same
+// Name, Address, Port, SslPort, and Payload.  Fields which change whenever an endpoint is registered
+// again, such as the Id and RegistrationTimeUTC, are ignored, as are the ServiceType and UriSpec.
+// Payloads are equivalent if their text is the same, or if both are JSON with deeply equal values,
+// so that the formatting and key order of JSON payloads is not significant.  Two nil instances are
+// equivalent, but a nil instance is not equivalent to any other.
+func InstanceEquivalent(a, b *discovery.ServiceInstance) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return a.Name == b.Name &&
+		a.Address == b.Address &&
+		equalPorts(a.Port, b.Port) &&
+		equalPorts(a.SslPort, b.SslPort) &&
+		equivalentPayloads(a.Payload, b.Payload)
+}
+
+// equalPorts tests whether two optional ports are both unset or are the same port
+func equalPorts(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return *a == *b
+}
+
+// equivalentPayloads tests whether two optional payloads are both unset, have the same text,
+// or are JSON with deeply equal values
+func equivalentPayloads(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	} else if *a == *b {
+		return true
+	}
+
+	var aValue, bValue interface{}
+	if json.Unmarshal([]byte(*a), &aValue) != nil || json.Unmarshal([]byte(*b), &bValue) != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(aValue, bValue)
+}
+
+// EquivalentTo tests whether this Instances and another Instances contain the same logical
+// endpoints, matching ServiceInstances with InstanceEquivalent.  Unlike Equal, this is unaffected
+// by an endpoint being registered again with a new Id.  Order is not significant, but the number
+// of equivalent ServiceInstances is.  Nil elements are ignored.
+func (this Instances) EquivalentTo(other Instances) bool {
+	unmatched := make(map[string]Instances, len(this))
+	for _, serviceInstance := range this {
+		if serviceInstance != nil {
+			key := AddressPortKey(serviceInstance)
+			unmatched[key] = append(unmatched[key], serviceInstance)
+		}
+	}
+
+	for _, serviceInstance := range other {
+		if serviceInstance == nil {
+			continue
+		}
+
+		key := AddressPortKey(serviceInstance)
+		candidates := unmatched[key]
+		matched := false
+		for index, candidate := range candidates {
+			if InstanceEquivalent(candidate, serviceInstance) {
+				unmatched[key] = append(candidates[:index:index], candidates[index+1:]...)
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	for _, candidates := range unmatched {
+		if len(candidates) > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// LessFunc defines the function signature for comparators which order ServiceInstances
+type LessFunc func(a, b *discovery.ServiceInstance) bool
+
+// ById is a LessFunc which orders ServiceInstances by their unique identifiers
+func ById(a, b *discovery.ServiceInstance) bool {
+	return a.Id < b.Id
+}
+
+var _ LessFunc = ById
+
+// ByAddress is a LessFunc which orders ServiceInstances by address, then by port.
+// ServiceInstances without a port sort before those with one.
+func ByAddress(a, b *discovery.ServiceInstance) bool {
+	if a.Address != b.Address {
+		return a.Address < b.Address
+	} else if a.Port == nil || b.Port == nil {
+		return a.Port == nil && b.Port != nil
+	}
+
+	return *a.Port < *b.Port
+}
+
+var _ LessFunc = ByAddress
+
+// ByRegistrationTime is a LessFunc which orders ServiceInstances from the oldest registration
+// to the newest
+func ByRegistrationTime(a, b *discovery.ServiceInstance) bool {
+	return a.RegistrationTimeUTC < b.RegistrationTimeUTC
+}
+
+var _ LessFunc = ByRegistrationTime
+
+// instancesSorter adapts an Instances and a LessFunc to sort.Interface
+type instancesSorter struct {
+	instances Instances
+	less      LessFunc
+}
+
+func (this instancesSorter) Len() int {
+	return len(this.instances)
+}
+
+func (this instancesSorter) Less(i, j int) bool {
+	return this.less(this.instances[i], this.instances[j])
+}
+
+func (this instancesSorter) Swap(i, j int) {
+	this.instances[i], this.instances[j] = this.instances[j], this.instances[i]
+}
+
+// Sort returns a sorted copy of this Instances, leaving this Instances unmodified.
+// The sort is stable, so ServiceInstances which compare as equal keep their relative
+// order.  If less is nil, ById is used.
+func (this Instances) Sort(less func(a, b *discovery.ServiceInstance) bool) Instances {
+	sorted := make(Instances, len(this))
+	copy(sorted, this)
+	sorted.SortInPlace(less)
+	return sorted
+}
+
+// SortInPlace is like Sort, except that this Instances is sorted directly.
+func (this Instances) SortInPlace(less func(a, b *discovery.ServiceInstance) bool) {
+	if less == nil {
+		less = ById
+	}
+
+	sort.Stable(instancesSorter{this, less})
+}
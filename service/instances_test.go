@@ -0,0 +1,472 @@
+package service
+
+import (
+	"github.com/foursquare/fsgo/net/discovery"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func newTestInstance(id, address string, port int) *discovery.ServiceInstance {
+	return &discovery.ServiceInstance{
+		Name:    testServiceName,
+		Id:      id,
+		Address: address,
+		Port:    &port,
+	}
+}
+
+func hasSslPort(serviceInstance *discovery.ServiceInstance) bool {
+	return serviceInstance != nil && serviceInstance.SslPort != nil
+}
+
+func TestFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	secure := newTestInstance("1", "localhost", 1234)
+	secure.SslPort = &sslPort
+	insecure := newTestInstance("2", "foobar.com", 1234)
+	alsoSecure := newTestInstance("3", "124.56.7.8", 1234)
+	alsoSecure.SslPort = &sslPort
+
+	var testData = []struct {
+		instances Instances
+		predicate func(*discovery.ServiceInstance) bool
+		expected  Instances
+	}{
+		{Instances{}, hasSslPort, Instances{}},
+		{nil, hasSslPort, Instances{}},
+		{Instances{secure, alsoSecure}, hasSslPort, Instances{secure, alsoSecure}},
+		{Instances{insecure}, hasSslPort, Instances{}},
+		{Instances{secure, insecure, alsoSecure}, hasSslPort, Instances{secure, alsoSecure}},
+		{Instances{nil, secure, nil, insecure}, hasSslPort, Instances{secure}},
+		{Instances{insecure, nil, secure}, nil, Instances{insecure, nil, secure}},
+	}
+
+	for _, record := range testData {
+		var original Instances
+		if record.instances != nil {
+			original = make(Instances, len(record.instances))
+			copy(original, record.instances)
+		}
+
+		actual := record.instances.Filter(record.predicate)
+		assert.NotNil(actual)
+		assert.Equal(record.expected, actual)
+		assert.Equal(original, record.instances)
+	}
+}
+
+func TestFilterReturnsCopy(t *testing.T) {
+	assert := assert.New(t)
+
+	instances := Instances{newTestInstance("1", "localhost", 1234)}
+	filtered := instances.Filter(nil)
+	filtered[0] = nil
+
+	assert.NotNil(instances[0])
+}
+
+func TestDiff(t *testing.T) {
+	assert := assert.New(t)
+
+	first := newTestInstance("1", "localhost", 1234)
+	second := newTestInstance("2", "foobar.com", 1234)
+	third := newTestInstance("3", "124.56.7.8", 1234)
+	secondReregistered := newTestInstance("4", "foobar.com", 1234)
+
+	var testData = []struct {
+		current         Instances
+		previous        Instances
+		keyFunc         KeyFunc
+		expectedAdded   Instances
+		expectedRemoved Instances
+	}{
+		{nil, nil, nil, nil, nil},
+		{Instances{first, second}, nil, nil, Instances{first, second}, nil},
+		{nil, Instances{first, second}, nil, nil, Instances{first, second}},
+		{Instances{first, second}, Instances{second, first}, nil, nil, nil},
+		{Instances{third, first, second}, Instances{second}, nil, Instances{third, first}, nil},
+		{Instances{first}, Instances{third, second, first}, nil, nil, Instances{third, second}},
+		{Instances{first, third}, Instances{second, first}, InstanceId, Instances{third}, Instances{second}},
+		{Instances{nil, first}, Instances{first, nil}, nil, nil, nil},
+
+		// a reregistered instance has a new id but the same address
+		{Instances{first, secondReregistered}, Instances{first, second}, nil, Instances{secondReregistered}, Instances{second}},
+		{Instances{first, secondReregistered}, Instances{first, second}, Spec, nil, nil},
+	}
+
+	for _, record := range testData {
+		added, removed := record.current.Diff(record.previous, record.keyFunc)
+		assert.Equal(record.expectedAdded, added)
+		assert.Equal(record.expectedRemoved, removed)
+	}
+}
+
+func TestUpdatedFrom(t *testing.T) {
+	assert := assert.New(t)
+
+	first := newTestInstance("1", "localhost", 1234)
+	second := newTestInstance("2", "foobar.com", 1234)
+	secondMoved := newTestInstance("2", "foobar.com", 5678)
+	secondCopy := newTestInstance("2", "foobar.com", 1234)
+
+	var testData = []struct {
+		current         Instances
+		previous        Instances
+		expectedUpdated Instances
+	}{
+		{nil, nil, nil},
+		{Instances{first, second}, nil, nil},
+		{Instances{first, second}, Instances{second, first}, nil},
+		{Instances{first, secondCopy}, Instances{first, second}, nil},
+		{Instances{first, secondMoved}, Instances{first, second}, Instances{secondMoved}},
+		{Instances{secondMoved}, Instances{first, second}, Instances{secondMoved}},
+		{Instances{nil, secondMoved}, Instances{second, nil}, Instances{secondMoved}},
+	}
+
+	for _, record := range testData {
+		assert.Equal(record.expectedUpdated, record.current.updatedFrom(record.previous))
+	}
+}
+
+func TestAddresses(t *testing.T) {
+	assert := assert.New(t)
+
+	sslPort := 8443
+	secure := newTestInstance("1", "secure.com", 8080)
+	secure.SslPort = &sslPort
+	plain := newTestInstance("2", "plain.com", 8080)
+	sslOnly := &discovery.ServiceInstance{Id: "3", Address: "sslonly.com", SslPort: &sslPort}
+	noPort := &discovery.ServiceInstance{Id: "4", Address: "noport.com"}
+	noAddress := newTestInstance("5", "", 8080)
+	ipv6 := newTestInstance("6", "::1", 8080)
+
+	instances := Instances{secure, plain, nil, sslOnly, noPort, noAddress, ipv6}
+	assert.Equal([]string{"secure.com:8443", "plain.com:8080", "sslonly.com:8443", "[::1]:8080"}, instances.Addresses())
+	assert.Equal([]string{"secure.com:8080", "plain.com:8080", "[::1]:8080"}, instances.AddressesWithPort(PlainPort))
+	assert.Equal([]string{}, Instances{}.Addresses())
+	assert.Equal([]string{}, Instances(nil).Addresses())
+
+	sorted := Instances{plain, secure}.Sort(ByAddress)
+	assert.Equal([]string{"plain.com:8080", "secure.com:8443"}, sorted.Addresses())
+}
+
+func TestURLs(t *testing.T) {
+	assert := assert.New(t)
+
+	sslPort := 8443
+	secure := newTestInstance("1", "secure.com", 8080)
+	secure.SslPort = &sslPort
+	sslOnly := &discovery.ServiceInstance{Id: "2", Address: "sslonly.com", SslPort: &sslPort}
+	noPort := &discovery.ServiceInstance{Id: "3", Address: "noport.com"}
+
+	var testData = []struct {
+		scheme   string
+		expected []string
+	}{
+		{"http", []string{"http://secure.com:8080"}},
+		{"https", []string{"https://secure.com:8443", "https://sslonly.com:8443"}},
+		{"HTTPS", []string{"HTTPS://secure.com:8443", "HTTPS://sslonly.com:8443"}},
+		{"ws", []string{"ws://secure.com:8080"}},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		actual := []string{}
+		for _, serviceURL := range (Instances{secure, nil, sslOnly, noPort}).URLs(record.scheme) {
+			actual = append(actual, serviceURL.String())
+		}
+
+		assert.Equal(record.expected, actual)
+	}
+}
+
+func TestClone(t *testing.T) {
+	assert := assert.New(t)
+
+	original := Instances{newTestInstance("1", "localhost", 1234), nil}
+	clone := original.clone()
+	assert.Equal(original, clone)
+
+	clone[0].Address = "changed"
+	assert.Equal("localhost", original[0].Address)
+	assert.Nil(clone[1])
+
+	assert.Equal(Instances{}, Instances(nil).clone())
+}
+
+func TestDedupe(t *testing.T) {
+	assert := assert.New(t)
+
+	first := newTestInstance("1", "foobar.com", 1234)
+	second := newTestInstance("2", "localhost", 1234)
+	firstMixedCase := newTestInstance("3", "FooBar.COM", 1234)
+	firstOtherPort := newTestInstance("4", "foobar.com", 5678)
+	noPort := &discovery.ServiceInstance{Id: "5", Address: "foobar.com"}
+	noPortUpperCase := &discovery.ServiceInstance{Id: "6", Address: "FOOBAR.COM"}
+
+	var testData = []struct {
+		instances Instances
+		keyFunc   KeyFunc
+		expected  Instances
+	}{
+		{nil, nil, Instances{}},
+		{Instances{first, second}, nil, Instances{first, second}},
+		{Instances{first, second, firstMixedCase}, nil, Instances{first, second}},
+		{Instances{firstMixedCase, first, second}, nil, Instances{firstMixedCase, second}},
+		{Instances{first, firstOtherPort}, nil, Instances{first, firstOtherPort}},
+		{Instances{noPort, first, noPortUpperCase}, nil, Instances{noPort, first}},
+		{Instances{nil, first, nil, first}, nil, Instances{first}},
+
+		// Spec is case-sensitive, so mixed-case hostnames are not duplicates
+		{Instances{first, firstMixedCase}, Spec, Instances{first, firstMixedCase}},
+		{Instances{first, firstMixedCase, firstOtherPort}, InstanceId, Instances{first, firstMixedCase, firstOtherPort}},
+	}
+
+	for _, record := range testData {
+		actual := record.instances.Dedupe(record.keyFunc)
+		assert.Equal(record.expected, actual)
+	}
+}
+
+func TestGroupBy(t *testing.T) {
+	assert := assert.New(t)
+
+	east := newTestInstanceWithPayload("1", `{"region": "east"}`)
+	east.Name = "a"
+	west := newTestInstanceWithPayload("2", `{"region": "west"}`)
+	west.Name = "b"
+	eastAgain := newTestInstanceWithPayload("3", `{"region": "east"}`)
+	eastAgain.Name = "a"
+	noRegion := newTestInstanceWithPayload("4", `{"zone": "1a"}`)
+	noRegion.Name = "b"
+	noPayload := newTestInstance("5", "localhost", 1234)
+	noPayload.Name = ""
+
+	var testData = []struct {
+		instances Instances
+		keyFunc   KeyFunc
+		expected  map[string]Instances
+	}{
+		{nil, nil, map[string]Instances{}},
+		{Instances{nil}, nil, map[string]Instances{}},
+		{
+			Instances{east, west, nil, eastAgain, noRegion},
+			nil,
+			map[string]Instances{"a": {east, eastAgain}, "b": {west, noRegion}},
+		},
+		{
+			Instances{east, noPayload},
+			nil,
+			map[string]Instances{"a": {east}, "": {noPayload}},
+		},
+		{
+			Instances{noRegion, east, west, eastAgain, noPayload},
+			PayloadFieldKey("region"),
+			map[string]Instances{"east": {east, eastAgain}, "west": {west}, "": {noRegion, noPayload}},
+		},
+		{
+			Instances{east, west, eastAgain},
+			func(*discovery.ServiceInstance) string { return "" },
+			map[string]Instances{"": {east, west, eastAgain}},
+		},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		original := append(Instances(nil), record.instances...)
+		assert.Equal(record.expected, record.instances.GroupBy(record.keyFunc))
+		assert.Equal(original, record.instances)
+	}
+}
+
+func TestSort(t *testing.T) {
+	assert := assert.New(t)
+
+	first := newTestInstance("c", "foobar.com", 1234)
+	first.RegistrationTimeUTC = 300
+	second := newTestInstance("a", "localhost", 1234)
+	second.RegistrationTimeUTC = 100
+	third := newTestInstance("b", "foobar.com", 80)
+	third.RegistrationTimeUTC = 200
+	noPort := &discovery.ServiceInstance{Id: "d", Address: "foobar.com", RegistrationTimeUTC: 200}
+
+	original := Instances{first, second, third, noPort}
+
+	var testData = []struct {
+		less     LessFunc
+		expected Instances
+	}{
+		{nil, Instances{second, third, first, noPort}},
+		{ById, Instances{second, third, first, noPort}},
+		{ByAddress, Instances{noPort, third, first, second}},
+
+		// third and noPort have the same registration time, so their order is preserved
+		{ByRegistrationTime, Instances{second, third, noPort, first}},
+	}
+
+	for _, record := range testData {
+		actual := original.Sort(record.less)
+		assert.Equal(record.expected, actual)
+		assert.Equal(Instances{first, second, third, noPort}, original)
+	}
+
+	assert.Equal(Instances{}, Instances(nil).Sort(ById))
+}
+
+func TestSortInPlace(t *testing.T) {
+	assert := assert.New(t)
+
+	first := newTestInstance("b", "localhost", 1234)
+	second := newTestInstance("a", "localhost", 1234)
+	instances := Instances{first, second}
+
+	instances.SortInPlace(ByAddress)
+	assert.Equal(Instances{first, second}, instances)
+
+	instances.SortInPlace(ById)
+	assert.Equal(Instances{second, first}, instances)
+}
+
+func TestEqual(t *testing.T) {
+	assert := assert.New(t)
+
+	first := newTestInstance("1", "localhost", 1234)
+	second := newTestInstance("2", "foobar.com", 1234)
+	secondReregistered := newTestInstance("3", "foobar.com", 1234)
+
+	var testData = []struct {
+		left     Instances
+		right    Instances
+		keyFunc  KeyFunc
+		expected bool
+	}{
+		{nil, nil, nil, true},
+		{nil, Instances{}, nil, true},
+		{Instances{first}, nil, nil, false},
+		{nil, Instances{first}, nil, false},
+		{Instances{first, second}, Instances{first, second}, nil, true},
+		{Instances{first, second}, Instances{second, first}, nil, true},
+		{Instances{first, second}, Instances{first}, nil, false},
+		{Instances{first, first}, Instances{first, second}, nil, false},
+		{Instances{first, nil}, Instances{nil, nil, first}, nil, true},
+		{Instances{first, second}, Instances{secondReregistered, first}, nil, false},
+		{Instances{first, second}, Instances{secondReregistered, first}, InstanceId, false},
+		{Instances{first, second}, Instances{secondReregistered, first}, Spec, true},
+	}
+
+	for _, record := range testData {
+		assert.Equal(record.expected, record.left.Equal(record.right, record.keyFunc))
+		assert.Equal(record.expected, record.right.Equal(record.left, record.keyFunc))
+	}
+}
+
+func TestInstanceEquivalent(t *testing.T) {
+	assert := assert.New(t)
+
+	withPayload := func(serviceInstance *discovery.ServiceInstance, payload string) *discovery.ServiceInstance {
+		serviceInstance.Payload = &payload
+		return serviceInstance
+	}
+
+	withSslPort := func(serviceInstance *discovery.ServiceInstance, sslPort int) *discovery.ServiceInstance {
+		serviceInstance.SslPort = &sslPort
+		return serviceInstance
+	}
+
+	reregistered := newTestInstance("2", "localhost", 1234)
+	reregistered.RegistrationTimeUTC = 1000
+
+	var testData = []struct {
+		a        *discovery.ServiceInstance
+		b        *discovery.ServiceInstance
+		expected bool
+	}{
+		{nil, nil, true},
+		{newTestInstance("1", "localhost", 1234), nil, false},
+		{newTestInstance("1", "localhost", 1234), newTestInstance("1", "localhost", 1234), true},
+		{newTestInstance("1", "localhost", 1234), reregistered, true},
+		{newTestInstance("1", "localhost", 1234), newTestInstance("1", "otherhost", 1234), false},
+		{newTestInstance("1", "localhost", 1234), newTestInstance("1", "localhost", 1235), false},
+		{newTestInstance("1", "localhost", 1234), &discovery.ServiceInstance{Name: testServiceName, Id: "1", Address: "localhost"}, false},
+		{withSslPort(newTestInstance("1", "localhost", 1234), 443), withSslPort(newTestInstance("2", "localhost", 1234), 443), true},
+		{withSslPort(newTestInstance("1", "localhost", 1234), 443), withSslPort(newTestInstance("2", "localhost", 1234), 8443), false},
+		{withSslPort(newTestInstance("1", "localhost", 1234), 443), newTestInstance("2", "localhost", 1234), false},
+		{withPayload(newTestInstance("1", "localhost", 1234), `{"a": 1, "b": [true]}`), withPayload(newTestInstance("2", "localhost", 1234), `{"b":[true],"a":1}`), true},
+		{withPayload(newTestInstance("1", "localhost", 1234), `{"a": 1}`), withPayload(newTestInstance("2", "localhost", 1234), `{"a": 2}`), false},
+		{withPayload(newTestInstance("1", "localhost", 1234), "plain"), withPayload(newTestInstance("2", "localhost", 1234), "plain"), true},
+		{withPayload(newTestInstance("1", "localhost", 1234), "plain"), withPayload(newTestInstance("2", "localhost", 1234), "plain "), false},
+		{withPayload(newTestInstance("1", "localhost", 1234), "{}"), newTestInstance("2", "localhost", 1234), false},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert.Equal(record.expected, InstanceEquivalent(record.a, record.b))
+		assert.Equal(record.expected, InstanceEquivalent(record.b, record.a))
+	}
+}
+
+func TestEquivalentTo(t *testing.T) {
+	assert := assert.New(t)
+
+	first := newTestInstance("1", "localhost", 1234)
+	second := newTestInstance("2", "foobar.com", 1234)
+	secondReregistered := newTestInstance("3", "foobar.com", 1234)
+	secondMoved := newTestInstance("2", "foobar.com", 1235)
+
+	var testData = []struct {
+		left     Instances
+		right    Instances
+		expected bool
+	}{
+		{nil, nil, true},
+		{nil, Instances{}, true},
+		{Instances{first}, nil, false},
+		{Instances{first, second}, Instances{second, first}, true},
+		{Instances{first, second}, Instances{secondReregistered, first}, true},
+		{Instances{first, second}, Instances{secondMoved, first}, false},
+		{Instances{first, second}, Instances{first}, false},
+		{Instances{second, second}, Instances{second, secondReregistered}, true},
+		{Instances{second, first}, Instances{second, secondReregistered}, false},
+		{Instances{first, nil}, Instances{nil, nil, first}, true},
+	}
+
+	for _, record := range testData {
+		assert.Equal(record.expected, record.left.EquivalentTo(record.right))
+		assert.Equal(record.expected, record.right.EquivalentTo(record.left))
+	}
+}
+
+func TestInstancesOlderThan(t *testing.T) {
+	assert := assert.New(t)
+
+	registeredAt := func(id string, millis int64) *discovery.ServiceInstance {
+		serviceInstance := newTestInstance(id, "localhost", 8080)
+		serviceInstance.RegistrationTimeUTC = millis
+		return serviceInstance
+	}
+
+	old := registeredAt("old", 1000)
+	recent := registeredAt("recent", 5000)
+	unknown := registeredAt("unknown", 0)
+	cutoff := time.Unix(3, 0)
+
+	var testData = []struct {
+		instances Instances
+		cutoff    time.Time
+		expected  Instances
+	}{
+		{nil, cutoff, Instances{}},
+		{Instances{recent}, cutoff, Instances{}},
+		{Instances{old, recent}, cutoff, Instances{old}},
+		{Instances{recent, nil, old, unknown}, cutoff, Instances{old}},
+		{Instances{old, recent}, time.Unix(5, 0), Instances{old}},
+		{Instances{recent, old}, time.Unix(5, int64(time.Millisecond)), Instances{recent, old}},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert.Equal(record.expected, record.instances.OlderThan(record.cutoff))
+	}
+}
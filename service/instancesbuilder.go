@@ -0,0 +1,209 @@
+package service
+
+import (
+	"github.com/foursquare/fsgo/net/discovery"
+	"sync"
+)
+
+// InstancesBuilder accumulates ServiceInstances by key, e.g. to merge the instances of several
+// watched services or to augment watched instances with statically configured ones.  Adding an
+// instance replaces any instance with the same key.  An InstancesBuilder is safe for concurrent use.
+type InstancesBuilder struct {
+	keyFunc KeyFunc
+	less    LessFunc
+
+	mutex     sync.RWMutex
+	instances KeyMap
+}
+
+// NewInstancesBuilder creates an empty InstancesBuilder which keys instances with the given
+// KeyFunc and orders built Instances with the given LessFunc.  If keyFunc is nil, InstanceId is
+// used, and if less is nil, ById is used.
+func NewInstancesBuilder(keyFunc KeyFunc, less LessFunc) *InstancesBuilder {
+	if keyFunc == nil {
+		keyFunc = InstanceId
+	}
+
+	if less == nil {
+		less = ById
+	}
+
+	return &InstancesBuilder{
+		keyFunc:   keyFunc,
+		less:      less,
+		instances: make(KeyMap),
+	}
+}
+
+// Key returns the key under which the given ServiceInstance is, or would be, stored
+func (this *InstancesBuilder) Key(serviceInstance *discovery.ServiceInstance) string {
+	return this.keyFunc(serviceInstance)
+}
+
+// Add stores the given ServiceInstance, replacing any with the same key.  A nil instance is ignored.
+func (this *InstancesBuilder) Add(serviceInstance *discovery.ServiceInstance) {
+	if serviceInstance == nil {
+		return
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.instances[this.keyFunc(serviceInstance)] = serviceInstance
+}
+
+// AddAll stores each of the given instances, as Add does, all at once
+func (this *InstancesBuilder) AddAll(instances Instances) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for _, serviceInstance := range instances {
+		if serviceInstance != nil {
+			this.instances[this.keyFunc(serviceInstance)] = serviceInstance
+		}
+	}
+}
+
+// Remove discards the ServiceInstance with the given key, returning true if there was one
+func (this *InstancesBuilder) Remove(key string) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if _, ok := this.instances[key]; ok {
+		delete(this.instances, key)
+		return true
+	}
+
+	return false
+}
+
+// Len returns the number of stored instances
+func (this *InstancesBuilder) Len() int {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return len(this.instances)
+}
+
+// Build returns a sorted copy of the stored instances.  Each ServiceInstance is copied, so the
+// result may be freely modified without affecting this builder or any other built Instances.
+func (this *InstancesBuilder) Build() Instances {
+	this.mutex.RLock()
+	instances := make(Instances, 0, len(this.instances))
+	for _, serviceInstance := range this.instances {
+		instances = append(instances, serviceInstance)
+	}
+
+	this.mutex.RUnlock()
+	instances = instances.clone()
+	instances.SortInPlace(this.less)
+	return instances
+}
+
+// MergeSource identifies a watched service whose instances are merged by MergeServices
+type MergeSource struct {
+	Discovery   Discovery
+	ServiceName string
+}
+
+// mergeListener replaces the contribution of one MergeSource to a merge each time the
+// source's instances change
+type mergeListener struct {
+	merge *instancesMerge
+	index int
+}
+
+func (this *mergeListener) ServicesChanged(serviceName string, instances Instances) {
+	this.merge.update(this.index, instances)
+}
+
+// instancesMerge tracks what each MergeSource has contributed to an InstancesBuilder
+type instancesMerge struct {
+	builder     *InstancesBuilder
+	serviceName string
+	downstream  Listener
+
+	mutex         sync.Mutex
+	contributions []KeyMap
+	initialized   []bool
+	registrations []Registration
+}
+
+// update replaces the instances contributed by the source at the given index, then dispatches
+// the merged instances once every source has contributed.  An instance is only removed from the
+// builder when no other source still contributes an instance with its key.
+func (this *instancesMerge) update(index int, instances Instances) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	contribution := make(KeyMap, len(instances))
+	for _, serviceInstance := range instances {
+		if serviceInstance != nil {
+			contribution[this.builder.Key(serviceInstance)] = serviceInstance
+		}
+	}
+
+	for key := range this.contributions[index] {
+		if _, ok := contribution[key]; !ok {
+			this.builder.Remove(key)
+			for other, otherContribution := range this.contributions {
+				if serviceInstance, ok := otherContribution[key]; ok && other != index {
+					this.builder.Add(serviceInstance)
+					break
+				}
+			}
+		}
+	}
+
+	this.builder.AddAll(contribution.Instances())
+	this.contributions[index] = contribution
+	this.initialized[index] = true
+	for _, initialized := range this.initialized {
+		if !initialized {
+			return
+		}
+	}
+
+	this.downstream.ServicesChanged(this.serviceName, this.builder.Build())
+}
+
+// Cancel removes the listener from every source
+func (this *instancesMerge) Cancel() {
+	this.mutex.Lock()
+	registrations := this.registrations
+	this.registrations = nil
+	this.mutex.Unlock()
+	for _, registration := range registrations {
+		registration.Cancel()
+	}
+}
+
+// MergeServices adds a listener to each of the given sources which accumulates their instances
+// in the given builder.  Whenever a source's instances change, its previous instances are
+// replaced, and the built Instances are dispatched to the downstream Listener under the given
+// service name.  Nothing is dispatched until every source has delivered its instances.  The
+// builder may also hold instances which were added directly, e.g. statically configured ones,
+// and these are left in place unless a source contributes, then removes, an instance with the
+// same key.  Events are dispatched to the downstream Listener one at a time.
+//
+// The returned Registration removes the listener from every source.  If any listener cannot
+// be added, those already added are removed and the error is returned.
+func MergeServices(builder *InstancesBuilder, serviceName string, downstream Listener, sources ...MergeSource) (Registration, error) {
+	merge := &instancesMerge{
+		builder:       builder,
+		serviceName:   serviceName,
+		downstream:    downstream,
+		contributions: make([]KeyMap, len(sources)),
+		initialized:   make([]bool, len(sources)),
+	}
+
+	for index, source := range sources {
+		registration, err := source.Discovery.AddListener(source.ServiceName, &mergeListener{merge, index})
+		if err != nil {
+			merge.Cancel()
+			return nil, err
+		}
+
+		merge.mutex.Lock()
+		merge.registrations = append(merge.registrations, registration)
+		merge.mutex.Unlock()
+	}
+
+	return merge, nil
+}
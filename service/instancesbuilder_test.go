@@ -0,0 +1,167 @@
+package service
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func TestInstancesBuilder(t *testing.T) {
+	assert := assert.New(t)
+
+	builder := NewInstancesBuilder(nil, nil)
+	assert.Equal(Instances{}, builder.Build())
+
+	second := newTestInstance("2", "host.com", 8081)
+	builder.Add(second)
+	builder.Add(nil)
+	builder.AddAll(Instances{newTestInstance("3", "host.com", 8082), nil, newTestInstance("1", "host.com", 8080)})
+	assert.Equal(3, builder.Len())
+
+	built := builder.Build()
+	assert.Equal([]string{"1", "2", "3"}, instanceIds(built))
+	assert.Equal(*second, *built[1])
+	assert.False(second == built[1])
+
+	// the built Instances are copies
+	built[1].Address = "modified.com"
+	assert.Equal("host.com", builder.Build()[1].Address)
+
+	// an instance with the same key is replaced
+	builder.Add(newTestInstance("2", "replaced.com", 8081))
+	assert.Equal("replaced.com", builder.Build()[1].Address)
+
+	assert.True(builder.Remove("2"))
+	assert.False(builder.Remove("2"))
+	assert.Equal([]string{"1", "3"}, instanceIds(builder.Build()))
+}
+
+func TestInstancesBuilderKeyAndOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	builder := NewInstancesBuilder(AddressPortKey, ByAddress)
+	builder.AddAll(Instances{
+		newTestInstance("1", "b.com", 8080),
+		newTestInstance("2", "a.com", 8080),
+		newTestInstance("3", "b.com", 8080),
+	})
+
+	assert.Equal("a.com:8080", builder.Key(newTestInstance("4", "a.com", 8080)))
+	assert.Equal([]string{"2", "3"}, instanceIds(builder.Build()))
+	assert.True(builder.Remove("b.com:8080"))
+	assert.Equal([]string{"2"}, instanceIds(builder.Build()))
+}
+
+func TestInstancesBuilderConcurrency(t *testing.T) {
+	assert := assert.New(t)
+
+	builder := NewInstancesBuilder(nil, nil)
+	waitGroup := &sync.WaitGroup{}
+	for worker := 0; worker < 4; worker++ {
+		waitGroup.Add(1)
+		go func(worker int) {
+			defer waitGroup.Done()
+			for index := 0; index < 50; index++ {
+				id := fmt.Sprintf("%d-%02d", worker, index)
+				builder.Add(newTestInstance(id, "host.com", 8080))
+				builder.Build()
+				if index%2 == 0 {
+					builder.Remove(id)
+				}
+			}
+		}(worker)
+	}
+
+	waitGroup.Wait()
+	assert.Equal(100, builder.Len())
+}
+
+func TestMergeServices(t *testing.T) {
+	assert := assert.New(t)
+
+	newDiscovery := func(serviceNames ...string) *curatorDiscovery {
+		builder := &DiscoveryBuilder{Connection: testConnection, BasePath: testBasePath, Watches: serviceNames}
+		discovery, err := builder.New(&testLogger{t})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return discovery.(*curatorDiscovery)
+	}
+
+	dispatch := func(discovery *curatorDiscovery, serviceName string, instances Instances) {
+		serviceWatcher, _ := discovery.serviceWatcherSet.findByName(serviceName)
+		serviceWatcher.dispatch(instances)
+	}
+
+	first := newDiscovery("foo")
+	second := newDiscovery("foo", "bar")
+	builder := NewInstancesBuilder(nil, nil)
+	static := newTestInstance("static", "static.com", 8080)
+	builder.Add(static)
+
+	var merged []Instances
+	registration, err := MergeServices(
+		builder,
+		"merged",
+		ListenerFunc(func(serviceName string, instances Instances) {
+			assert.Equal("merged", serviceName)
+			merged = append(merged, instances)
+		}),
+		MergeSource{first, "foo"},
+		MergeSource{second, "foo"},
+		MergeSource{second, "bar"},
+	)
+
+	if !assert.Nil(err) || !assert.NotNil(registration) {
+		return
+	}
+
+	// nothing is dispatched until every source has delivered its instances
+	dispatch(first, "foo", testInstancesWithIds("1"))
+	dispatch(second, "foo", Instances{newTestInstance("2", "host.com", 8080), newTestInstance("shared", "host.com", 8081)})
+	assert.Empty(merged)
+
+	dispatch(second, "bar", Instances{newTestInstance("3", "host.com", 8082), newTestInstance("shared", "bar.com", 8081)})
+	if assert.Len(merged, 1) {
+		assert.Equal([]string{"1", "2", "3", "shared", "static"}, instanceIds(merged[0]))
+	}
+
+	// a source's previous instances are replaced, but an instance still contributed by another
+	// source is kept, as is an instance which was added directly
+	dispatch(second, "foo", Instances{})
+	if assert.Len(merged, 2) {
+		assert.Equal([]string{"1", "3", "shared", "static"}, instanceIds(merged[1]))
+		assert.Equal("bar.com", merged[1][2].Address)
+	}
+
+	registration.Cancel()
+	dispatch(first, "foo", Instances{})
+	assert.Len(merged, 2)
+}
+
+func TestMergeServicesError(t *testing.T) {
+	assert := assert.New(t)
+
+	builder := &DiscoveryBuilder{Connection: testConnection, BasePath: testBasePath, Watches: []string{"foo"}}
+	discovery, err := builder.New(&testLogger{t})
+	if !assert.Nil(err) {
+		return
+	}
+
+	registration, err := MergeServices(
+		NewInstancesBuilder(nil, nil),
+		"merged",
+		ListenerFunc(func(serviceName string, instances Instances) {}),
+		MergeSource{discovery, "foo"},
+		MergeSource{discovery, "nosuch"},
+	)
+
+	assert.Nil(registration)
+	assert.Equal(ErrorNoSuchService, err)
+
+	// the listener added to the first source was removed
+	serviceWatcher, _ := discovery.(*curatorDiscovery).serviceWatcherSet.findByName("foo")
+	assert.Equal(0, serviceWatcher.removeAllListeners())
+}
@@ -1,8 +1,26 @@
 package service
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/foursquare/fsgo/net/discovery"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// KeySeparator is the separator ComposeKeyFunc places between sub-keys
+const KeySeparator = "|"
+
+// MergePolicy determines which ServiceInstance KeyMap.Merge keeps when both KeyMaps have the same key
+type MergePolicy int
+
+const (
+	// KeepExisting is the MergePolicy which keeps the ServiceInstance already in the KeyMap
+	KeepExisting MergePolicy = iota
+
+	// Overwrite is the MergePolicy which replaces the ServiceInstance already in the KeyMap
+	Overwrite
 )
 
 // KeyFunc defines the function signature for functions which can map
@@ -36,11 +54,262 @@ func InstanceId(serviceInstance *discovery.ServiceInstance) string {
 
 var _ KeyFunc = InstanceId
 
+// InstanceName is a KeyFunc which maps a service instance to the name of its service
+func InstanceName(serviceInstance *discovery.ServiceInstance) string {
+	return serviceInstance.Name
+}
+
+var _ KeyFunc = InstanceName
+
+// AddressPortKey is a KeyFunc which maps a ServiceInstance onto "address:port".  If the
+// instance has no Port, only the address is used.
+func AddressPortKey(serviceInstance *discovery.ServiceInstance) string {
+	if serviceInstance.Port != nil {
+		return fmt.Sprintf("%s:%d", serviceInstance.Address, *serviceInstance.Port)
+	}
+
+	return serviceInstance.Address
+}
+
+var _ KeyFunc = AddressPortKey
+
+// SecureAddressPortKey is like AddressPortKey, except that the SslPort is preferred when set
+func SecureAddressPortKey(serviceInstance *discovery.ServiceInstance) string {
+	if serviceInstance.SslPort != nil {
+		return fmt.Sprintf("%s:%d", serviceInstance.Address, *serviceInstance.SslPort)
+	}
+
+	return AddressPortKey(serviceInstance)
+}
+
+var _ KeyFunc = SecureAddressPortKey
+
+// HostnameKey is a KeyFunc which maps a ServiceInstance onto just its address
+func HostnameKey(serviceInstance *discovery.ServiceInstance) string {
+	return serviceInstance.Address
+}
+
+var _ KeyFunc = HostnameKey
+
+// PayloadFieldKey returns a KeyFunc which treats a ServiceInstance's payload as a JSON object
+// and maps the instance onto the named top-level field.  String fields are used as is, while
+// other values are used in their JSON form.  If there is no payload, the payload is not a JSON
+// object, or the field is missing, the key is the empty string.
+func PayloadFieldKey(field string) KeyFunc {
+	return func(serviceInstance *discovery.ServiceInstance) string {
+		if serviceInstance.Payload == nil {
+			return ""
+		}
+
+		var payload map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(*serviceInstance.Payload), &payload); err != nil {
+			return ""
+		}
+
+		value, ok := payload[field]
+		if !ok {
+			return ""
+		}
+
+		var text string
+		if err := json.Unmarshal(value, &text); err == nil {
+			return text
+		}
+
+		return string(value)
+	}
+}
+
+// ComposeKeyFunc returns a KeyFunc which joins the keys produced by each of the given
+// KeyFuncs, in order, with KeySeparator
+func ComposeKeyFunc(keyFuncs ...KeyFunc) KeyFunc {
+	return func(serviceInstance *discovery.ServiceInstance) string {
+		keys := make([]string, len(keyFuncs))
+		for index, keyFunc := range keyFuncs {
+			keys[index] = keyFunc(serviceInstance)
+		}
+
+		return strings.Join(keys, KeySeparator)
+	}
+}
+
+// normalizedSpec is a KeyFunc which maps a ServiceInstance onto its Spec() with the address
+// lowercased, since hostnames are case-insensitive
+func normalizedSpec(serviceInstance *discovery.ServiceInstance) string {
+	address := strings.ToLower(serviceInstance.Address)
+	if serviceInstance.Port != nil {
+		return fmt.Sprintf("%s:%d", address, *serviceInstance.Port)
+	}
+
+	return address
+}
+
+var _ KeyFunc = normalizedSpec
+
 // Keys defines the method set for types which can receive the output of a KeyFunc
 type Keys interface {
 	Add(string)
 }
 
+// KeyCollection is a set of keys which can also be queried and modified.  KeySet is the standard
+// implementation, and SynchronizedKeys makes any KeyCollection safe for concurrent use.
+type KeyCollection interface {
+	Keys
+
+	// Contains tests if the key is present in this set
+	Contains(string) bool
+
+	// Remove removes the key from this set, returning false if it was not present
+	Remove(string) bool
+
+	// Len returns the number of keys in this set
+	Len() int
+
+	// Snapshot returns a sorted copy of the keys in this set
+	Snapshot() []string
+}
+
+// KeySet is a simple KeyCollection implementation backed by a map.  A KeySet must be created with make,
+// or via NewKeySet, and is not safe for concurrent use.
+type KeySet map[string]struct{}
+
+var _ KeyCollection = KeySet(nil)
+
+// NewKeySet creates a KeySet containing the given keys
+func NewKeySet(keys ...string) KeySet {
+	keySet := make(KeySet, len(keys))
+	for _, key := range keys {
+		keySet[key] = struct{}{}
+	}
+
+	return keySet
+}
+
+func (this KeySet) Add(key string) {
+	this[key] = struct{}{}
+}
+
+func (this KeySet) Contains(key string) bool {
+	_, ok := this[key]
+	return ok
+}
+
+func (this KeySet) Remove(key string) bool {
+	if _, ok := this[key]; ok {
+		delete(this, key)
+		return true
+	}
+
+	return false
+}
+
+func (this KeySet) Len() int {
+	return len(this)
+}
+
+func (this KeySet) Snapshot() []string {
+	keys := make([]string, 0, len(this))
+	for key := range this {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// SynchronizedKeys guards another KeyCollection with a sync.RWMutex, so that a single
+// KeyCollection can be shared by goroutines, e.g. listeners for different services
+type SynchronizedKeys struct {
+	mutex sync.RWMutex
+	keys  KeyCollection
+}
+
+var _ KeyCollection = (*SynchronizedKeys)(nil)
+
+// NewSynchronizedKeys wraps the given KeyCollection, which must not be used directly afterward.
+// If keys is nil, an empty KeySet is used.
+func NewSynchronizedKeys(keys KeyCollection) *SynchronizedKeys {
+	if keys == nil {
+		keys = make(KeySet)
+	}
+
+	return &SynchronizedKeys{keys: keys}
+}
+
+func (this *SynchronizedKeys) Add(key string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.keys.Add(key)
+}
+
+func (this *SynchronizedKeys) Contains(key string) bool {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return this.keys.Contains(key)
+}
+
+func (this *SynchronizedKeys) Remove(key string) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.keys.Remove(key)
+}
+
+func (this *SynchronizedKeys) Len() int {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return this.keys.Len()
+}
+
+func (this *SynchronizedKeys) Snapshot() []string {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return this.keys.Snapshot()
+}
+
 // KeyMap is a convenient map type which can store both the result of a KeyFunc
 // and the associated ServiceInstance
 type KeyMap map[string]*discovery.ServiceInstance
+
+// Keys returns the keys of this KeyMap as a sorted slice
+func (this KeyMap) Keys() []string {
+	keys := make([]string, 0, len(this))
+	for key := range this {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// Instances returns the ServiceInstances in this KeyMap, ordered by their keys
+func (this KeyMap) Instances() Instances {
+	instances := make(Instances, 0, len(this))
+	for _, key := range this.Keys() {
+		instances = append(instances, this[key])
+	}
+
+	return instances
+}
+
+// Merge adds each entry of the other KeyMap to this KeyMap.  When both have the same key,
+// the policy determines which ServiceInstance is kept.
+func (this KeyMap) Merge(other KeyMap, policy MergePolicy) {
+	for key, serviceInstance := range other {
+		if _, exists := this[key]; !exists || policy == Overwrite {
+			this[key] = serviceInstance
+		}
+	}
+}
+
+// Filter returns a new KeyMap containing only the entries of this KeyMap for which the
+// predicate returns true.  This KeyMap is not modified.
+func (this KeyMap) Filter(predicate func(string, *discovery.ServiceInstance) bool) KeyMap {
+	filtered := make(KeyMap, len(this))
+	for key, serviceInstance := range this {
+		if predicate(key, serviceInstance) {
+			filtered[key] = serviceInstance
+		}
+	}
+
+	return filtered
+}
@@ -3,6 +3,8 @@ package service
 import (
 	"github.com/foursquare/fsgo/net/discovery"
 	"github.com/stretchr/testify/assert"
+	"strconv"
+	"sync"
 	"testing"
 )
 
@@ -57,3 +59,263 @@ func TestInstanceId(t *testing.T) {
 		assert.Equal(record.serviceInstance.Id, actual)
 	}
 }
+
+func TestInstanceName(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, record := range testData {
+		actual := InstanceName(&record.serviceInstance)
+		assert.Equal(record.serviceInstance.Name, actual)
+	}
+}
+
+func TestAddressKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	var testData = []struct {
+		serviceInstance              discovery.ServiceInstance
+		expectedAddressPortKey       string
+		expectedSecureAddressPortKey string
+		expectedHostnameKey          string
+	}{
+		{discovery.ServiceInstance{Address: "localhost", Port: &port}, "localhost:1234", "localhost:1234", "localhost"},
+		{discovery.ServiceInstance{Address: "foobar.com", SslPort: &sslPort}, "foobar.com", "foobar.com:2345", "foobar.com"},
+		{discovery.ServiceInstance{Address: "124.56.7.8", Port: &port, SslPort: &sslPort}, "124.56.7.8:1234", "124.56.7.8:2345", "124.56.7.8"},
+		{discovery.ServiceInstance{Address: "localhost"}, "localhost", "localhost", "localhost"},
+		{discovery.ServiceInstance{}, "", "", ""},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert.Equal(record.expectedAddressPortKey, AddressPortKey(&record.serviceInstance))
+		assert.Equal(record.expectedSecureAddressPortKey, SecureAddressPortKey(&record.serviceInstance))
+		assert.Equal(record.expectedHostnameKey, HostnameKey(&record.serviceInstance))
+	}
+}
+
+func TestPayloadFieldKey(t *testing.T) {
+	assert := assert.New(t)
+
+	payload := func(value string) *string {
+		return &value
+	}
+
+	var testData = []struct {
+		payload  *string
+		field    string
+		expected string
+	}{
+		{nil, "region", ""},
+		{payload(""), "region", ""},
+		{payload("not json"), "region", ""},
+		{payload(`["region"]`), "region", ""},
+		{payload(`{"zone": "east"}`), "region", ""},
+		{payload(`{"region": "us-east-1", "zone": "east"}`), "region", "us-east-1"},
+		{payload(`{"region": "us-east-1", "zone": "east"}`), "zone", "east"},
+		{payload(`{"weight": 10}`), "weight", "10"},
+		{payload(`{"tags": {"canary": true}}`), "tags", `{"canary": true}`},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		serviceInstance := discovery.ServiceInstance{Address: "localhost", Port: &port, Payload: record.payload}
+		assert.Equal(record.expected, PayloadFieldKey(record.field)(&serviceInstance))
+	}
+}
+
+func TestComposeKeyFunc(t *testing.T) {
+	assert := assert.New(t)
+
+	region := `{"region": "us-east-1"}`
+	var testData = []struct {
+		serviceInstance discovery.ServiceInstance
+		keyFuncs        []KeyFunc
+		expected        string
+	}{
+		{discovery.ServiceInstance{Id: "1", Address: "localhost", Port: &port}, nil, ""},
+		{discovery.ServiceInstance{Id: "1", Address: "localhost", Port: &port}, []KeyFunc{InstanceId}, "1"},
+		{discovery.ServiceInstance{Id: "1", Address: "localhost", Port: &port}, []KeyFunc{InstanceId, AddressPortKey}, "1|localhost:1234"},
+		{
+			discovery.ServiceInstance{Id: "2", Address: "foobar.com", SslPort: &sslPort, Payload: &region},
+			[]KeyFunc{PayloadFieldKey("region"), SecureAddressPortKey, HostnameKey},
+			"us-east-1|foobar.com:2345|foobar.com",
+		},
+		{discovery.ServiceInstance{Id: "3", Address: "localhost"}, []KeyFunc{PayloadFieldKey("region"), AddressPortKey}, "|localhost"},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert.Equal(record.expected, ComposeKeyFunc(record.keyFuncs...)(&record.serviceInstance))
+	}
+}
+
+func TestKeyMapKeysAndInstances(t *testing.T) {
+	assert := assert.New(t)
+
+	first := &discovery.ServiceInstance{Id: "1", Address: "first.com"}
+	second := &discovery.ServiceInstance{Id: "2", Address: "second.com"}
+	var testData = []struct {
+		keyMap            KeyMap
+		expectedKeys      []string
+		expectedInstances Instances
+	}{
+		{nil, []string{}, Instances{}},
+		{KeyMap{}, []string{}, Instances{}},
+		{KeyMap{"a": first}, []string{"a"}, Instances{first}},
+		{KeyMap{"b": first, "a": second}, []string{"a", "b"}, Instances{second, first}},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert.Equal(record.expectedKeys, record.keyMap.Keys())
+		assert.Equal(record.expectedInstances, record.keyMap.Instances())
+	}
+}
+
+func TestKeyMapMerge(t *testing.T) {
+	assert := assert.New(t)
+
+	existing := &discovery.ServiceInstance{Id: "1", Address: "existing.com"}
+	replacement := &discovery.ServiceInstance{Id: "1", Address: "replacement.com"}
+	added := &discovery.ServiceInstance{Id: "2", Address: "added.com"}
+	var testData = []struct {
+		keyMap   KeyMap
+		other    KeyMap
+		policy   MergePolicy
+		expected KeyMap
+	}{
+		{KeyMap{}, nil, KeepExisting, KeyMap{}},
+		{KeyMap{"1": existing}, KeyMap{}, Overwrite, KeyMap{"1": existing}},
+		{KeyMap{}, KeyMap{"1": replacement}, KeepExisting, KeyMap{"1": replacement}},
+		{KeyMap{"1": existing}, KeyMap{"1": replacement, "2": added}, KeepExisting, KeyMap{"1": existing, "2": added}},
+		{KeyMap{"1": existing}, KeyMap{"1": replacement, "2": added}, Overwrite, KeyMap{"1": replacement, "2": added}},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		record.keyMap.Merge(record.other, record.policy)
+		assert.Equal(record.expected, record.keyMap)
+	}
+}
+
+func TestKeyMapFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	first := &discovery.ServiceInstance{Id: "1", Address: "first.com"}
+	second := &discovery.ServiceInstance{Id: "2", Address: "second.com"}
+	keyMap := KeyMap{"a": first, "b": second}
+
+	var testData = []struct {
+		predicate func(string, *discovery.ServiceInstance) bool
+		expected  KeyMap
+	}{
+		{func(string, *discovery.ServiceInstance) bool { return true }, KeyMap{"a": first, "b": second}},
+		{func(string, *discovery.ServiceInstance) bool { return false }, KeyMap{}},
+		{func(key string, _ *discovery.ServiceInstance) bool { return key == "a" }, KeyMap{"a": first}},
+		{func(_ string, serviceInstance *discovery.ServiceInstance) bool { return serviceInstance.Id == "2" }, KeyMap{"b": second}},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert.Equal(record.expected, keyMap.Filter(record.predicate))
+	}
+
+	// the original is not modified
+	assert.Equal(KeyMap{"a": first, "b": second}, keyMap)
+}
+
+func TestKeySet(t *testing.T) {
+	assert := assert.New(t)
+
+	var testData = []struct {
+		keys             KeyCollection
+		add              []string
+		remove           []string
+		expectedRemoved  []bool
+		expectedSnapshot []string
+	}{
+		{make(KeySet), nil, nil, nil, []string{}},
+		{NewKeySet(), []string{"b", "a", "b"}, nil, nil, []string{"a", "b"}},
+		{NewKeySet("a", "b"), []string{"c"}, []string{"b", "nosuch"}, []bool{true, false}, []string{"a", "c"}},
+		{NewSynchronizedKeys(nil), []string{"b", "a"}, []string{"a"}, []bool{true}, []string{"b"}},
+		{NewSynchronizedKeys(NewKeySet("a")), []string{"b"}, []string{"a", "a"}, []bool{true, false}, []string{"b"}},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		for _, key := range record.add {
+			record.keys.Add(key)
+			assert.True(record.keys.Contains(key))
+		}
+
+		for index, key := range record.remove {
+			assert.Equal(record.expectedRemoved[index], record.keys.Remove(key))
+			assert.False(record.keys.Contains(key))
+		}
+
+		assert.Equal(len(record.expectedSnapshot), record.keys.Len())
+		assert.Equal(record.expectedSnapshot, record.keys.Snapshot())
+	}
+}
+
+func TestKeySetToKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	instances := Instances{
+		&discovery.ServiceInstance{Id: "2", Address: "second.com"},
+		&discovery.ServiceInstance{Id: "1", Address: "first.com"},
+	}
+
+	keySet := make(KeySet)
+	instances.ToKeys(InstanceId, keySet)
+	assert.Equal([]string{"1", "2"}, keySet.Snapshot())
+
+	// the snapshot is a copy
+	snapshot := keySet.Snapshot()
+	snapshot[0] = "modified"
+	assert.True(keySet.Contains("1"))
+
+	// any type with an Add method can receive keys
+	var keyList testKeyList
+	instances.ToKeys(InstanceId, &keyList)
+	assert.Equal(testKeyList{"2", "1"}, keyList)
+}
+
+// testKeyList is a Keys which only supports Add
+type testKeyList []string
+
+func (this *testKeyList) Add(key string) {
+	*this = append(*this, key)
+}
+
+func TestSynchronizedKeysConcurrency(t *testing.T) {
+	assert := assert.New(t)
+	keys := NewSynchronizedKeys(nil)
+
+	var waitGroup sync.WaitGroup
+	for goroutine := 0; goroutine < 10; goroutine++ {
+		waitGroup.Add(1)
+		go func(goroutine int) {
+			defer waitGroup.Done()
+			for index := 0; index < 100; index++ {
+				key := strconv.Itoa(goroutine*100 + index)
+				keys.Add(key)
+				keys.Contains(key)
+				keys.Contains(strconv.Itoa(index))
+				keys.Len()
+				if index%10 == 0 {
+					keys.Snapshot()
+				}
+
+				if index%2 == 0 {
+					keys.Remove(key)
+				}
+			}
+		}(goroutine)
+	}
+
+	waitGroup.Wait()
+	assert.Equal(500, keys.Len())
+	assert.True(keys.Contains("1"))
+	assert.False(keys.Contains("0"))
+}
@@ -0,0 +1,374 @@
+package service
+
+import (
+	"errors"
+	"github.com/foursquare/curator.go"
+	"github.com/foursquare/fsgo/net/discovery"
+	"github.com/samuel/go-zookeeper/zk"
+	"path"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// leaderNodePrefix begins the name of each candidate's znode beneath an election path.  Zookeeper
+	// appends a zero-padded sequence number, so the names sort in the order they were created.
+	leaderNodePrefix = "candidate-"
+
+	// DefaultLeaderRetryDelay is how long a LeaderElector waits before trying again after a
+	// zookeeper operation fails
+	DefaultLeaderRetryDelay = time.Duration(5 * time.Second)
+)
+
+var (
+	ErrorInvalidElectionPath = errors.New("The election path must be an absolute zookeeper path other than the root")
+)
+
+// LeaderListener is notified as a LeaderElector gains and loses leadership.  Both methods are
+// invoked on the elector's own goroutine, one at a time and in alternation, beginning with
+// OnElected.  A LeaderElector which is elected always resigns before Close returns.
+type LeaderListener interface {
+	// OnElected is called when this candidate becomes the leader, e.g. to start a background job
+	OnElected()
+
+	// OnResigned is called when this candidate is no longer the leader, either because it was
+	// closed or because its zookeeper connection was suspended or lost.  The job started by
+	// OnElected should be stopped, since another candidate may be elected at any time.
+	OnResigned()
+}
+
+// LeaderFuncs is a LeaderListener made up of functions, either of which may be nil
+type LeaderFuncs struct {
+	Elected  func()
+	Resigned func()
+}
+
+var _ LeaderListener = LeaderFuncs{}
+
+func (this LeaderFuncs) OnElected() {
+	if this.Elected != nil {
+		this.Elected()
+	}
+}
+
+func (this LeaderFuncs) OnResigned() {
+	if this.Resigned != nil {
+		this.Resigned()
+	}
+}
+
+// electionClient is the subset of zookeeper operations used by a LeaderElector.  As with
+// zookeeperClient, this allows elections to be exercised without a live zookeeper ensemble.
+type electionClient interface {
+	// createCandidate creates an ephemeral, sequential znode beginning with the given path,
+	// including any parents, and returns the path of the created znode
+	createCandidate(path string) (string, error)
+
+	// children returns the names of the child znodes of the given path
+	children(path string) ([]string, error)
+
+	// watchExists tests whether a znode exists at the given path, and if so, arranges for the
+	// given function to be called once the znode is deleted or changed
+	watchExists(path string, changed func()) (bool, error)
+
+	// delete removes the znode at the given path
+	delete(path string) error
+}
+
+// curatorElectionClient is the electionClient implementation backed by a curator connection.
+// Znodes are created with the ACLs of the connection's curator.ACLProvider.
+type curatorElectionClient struct {
+	connection discovery.Conn
+}
+
+var _ electionClient = (*curatorElectionClient)(nil)
+
+func (this *curatorElectionClient) createCandidate(path string) (string, error) {
+	return this.connection.Create().
+		CreatingParentsIfNeeded().
+		WithMode(curator.EPHEMERAL_SEQUENTIAL).
+		ForPath(path)
+}
+
+func (this *curatorElectionClient) children(path string) ([]string, error) {
+	return this.connection.GetChildren().ForPath(path)
+}
+
+func (this *curatorElectionClient) watchExists(path string, changed func()) (bool, error) {
+	stat, err := this.connection.CheckExists().
+		UsingWatcher(curator.NewWatcher(func(event *zk.Event) { changed() })).
+		ForPath(path)
+
+	return stat != nil, err
+}
+
+func (this *curatorElectionClient) delete(path string) error {
+	return this.connection.Delete().ForPath(path)
+}
+
+// LeaderElector elects a single leader from among the candidates which share an election path,
+// e.g. so that exactly one instance of a service runs a background job.  Each candidate creates
+// an ephemeral, sequential znode beneath the election path, and the candidate with the lowest
+// sequence number is the leader.  Every other candidate watches only the znode immediately
+// before its own, so that a change in leadership wakes a single candidate.
+//
+// A LeaderElector shares the curator connection of the Discovery which created it.  Leadership
+// is resigned as soon as that connection is suspended or lost, since the candidate's znode may
+// expire along with the session.  Once reconnected, the candidate rejoins the election, keeping
+// its znode if the session survived.
+type LeaderElector struct {
+	client       electionClient
+	listenable   curator.ConnectionStateListenable
+	logger       Logger
+	electionPath string
+	listener     LeaderListener
+	retryDelay   time.Duration
+
+	// leader is set while this candidate is the leader
+	leader uint32
+
+	// mutex guards the connection state, which is changed by curator and read by run
+	mutex        sync.Mutex
+	disconnected bool
+
+	// wake is signalled whenever the election should be checked, while closeSignal is closed
+	// by Close and done is closed once run has resigned and removed this candidate's znode
+	wake        chan struct{}
+	closeSignal chan struct{}
+	closeOnce   sync.Once
+	closeError  error
+	done        chan struct{}
+
+	// nodePath is the path of this candidate's znode, or empty if none has been created.  It is
+	// only accessed by run.
+	nodePath string
+}
+
+var _ curator.ConnectionStateListener = (*LeaderElector)(nil)
+
+// NewLeaderElector creates a LeaderElector which joins the election at the given path using the
+// curator connection and logger of the given Discovery, which must be running.  The listener is
+// notified as this candidate is elected and resigns.  Close must be called to leave the election.
+//
+// A Discovery which is ReadOnly cannot join an election, since that requires creating a znode.
+func NewLeaderElector(discovery Discovery, electionPath string, listener LeaderListener) (*LeaderElector, error) {
+	normalized, err := normalizeBasePath(electionPath)
+	if err != nil || len(normalized) == 0 {
+		return nil, ErrorInvalidElectionPath
+	}
+
+	var logger Logger = NopLogger{}
+	if curatorDiscovery, ok := discovery.(*curatorDiscovery); ok {
+		if curatorDiscovery.readOnly {
+			return nil, ErrorReadOnly
+		}
+
+		logger = curatorDiscovery.logger
+	}
+
+	connection := discovery.CuratorConnection()
+	if connection == nil {
+		return nil, ErrorNotRunning
+	}
+
+	elector := newLeaderElector(&curatorElectionClient{connection}, logger, normalized, listener)
+	elector.listenable = connection.ConnectionStateListenable()
+	elector.listenable.AddListener(elector)
+	elector.start()
+	return elector, nil
+}
+
+// newLeaderElector is the internal constructor for a LeaderElector, which must then be started
+func newLeaderElector(client electionClient, logger Logger, electionPath string, listener LeaderListener) *LeaderElector {
+	return &LeaderElector{
+		client:       client,
+		logger:       logger,
+		electionPath: electionPath,
+		listener:     listener,
+		retryDelay:   DefaultLeaderRetryDelay,
+		wake:         make(chan struct{}, 1),
+		closeSignal:  make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+}
+
+// start begins checking the election on a separate goroutine
+func (this *LeaderElector) start() {
+	this.signal()
+	go this.run()
+}
+
+// ElectionPath returns the path beneath which the candidates' znodes are created
+func (this *LeaderElector) ElectionPath() string {
+	return this.electionPath
+}
+
+// IsLeader tests whether this candidate is currently the leader
+func (this *LeaderElector) IsLeader() bool {
+	return atomic.LoadUint32(&this.leader) != 0
+}
+
+// Close leaves the election, resigning if this candidate is the leader and deleting its znode.
+// Close blocks until the listener has resigned, so it must not be called from the listener.
+// Subsequent calls return the same result.
+func (this *LeaderElector) Close() error {
+	this.closeOnce.Do(func() {
+		if this.listenable != nil {
+			this.listenable.RemoveListener(this)
+		}
+
+		close(this.closeSignal)
+		<-this.done
+	})
+
+	return this.closeError
+}
+
+// StateChanged resigns leadership as soon as the zookeeper connection is suspended or lost, and
+// checks the election again once the connection is restored
+func (this *LeaderElector) StateChanged(client curator.CuratorFramework, newState curator.ConnectionState) {
+	this.mutex.Lock()
+	switch newState {
+	case curator.SUSPENDED, curator.LOST:
+		this.disconnected = true
+
+	case curator.CONNECTED, curator.RECONNECTED:
+		this.disconnected = false
+	}
+
+	this.mutex.Unlock()
+	this.signal()
+}
+
+// signal wakes run to check the election, unless it has already been woken
+func (this *LeaderElector) signal() {
+	select {
+	case this.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (this *LeaderElector) isDisconnected() bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.disconnected
+}
+
+// run checks the election each time this elector is woken, until it is closed
+func (this *LeaderElector) run() {
+	defer close(this.done)
+	for {
+		select {
+		case <-this.closeSignal:
+			this.leave()
+			return
+
+		case <-this.wake:
+			if this.isDisconnected() {
+				this.logger.Error("Zookeeper connection suspended.  Resigning leadership of %s until reconnected.", this.electionPath)
+				this.resign()
+			} else if err := this.check(); err != nil {
+				this.logger.Error("Error while checking the election at %s, retrying in %s: %v", this.electionPath, this.retryDelay, err)
+				this.resign()
+				time.AfterFunc(this.retryDelay, this.signal)
+			}
+		}
+	}
+}
+
+// check creates this candidate's znode if necessary, then either takes leadership or watches the
+// znode of the preceding candidate
+func (this *LeaderElector) check() error {
+	for {
+		if len(this.nodePath) == 0 {
+			nodePath, err := this.client.createCandidate(this.electionPath + "/" + leaderNodePrefix)
+			if err != nil {
+				return err
+			}
+
+			this.logger.Info("Joined the election at %s as %s", this.electionPath, nodePath)
+			this.nodePath = nodePath
+		}
+
+		children, err := this.client.children(this.electionPath)
+		if err != nil {
+			return err
+		}
+
+		candidates := make([]string, 0, len(children))
+		for _, child := range children {
+			if strings.HasPrefix(child, leaderNodePrefix) {
+				candidates = append(candidates, child)
+			}
+		}
+
+		sort.Strings(candidates)
+		index := sort.SearchStrings(candidates, path.Base(this.nodePath))
+		if index == len(candidates) || candidates[index] != path.Base(this.nodePath) {
+			// the znode expired along with a previous session, so a new one is needed
+			this.logger.Info("Candidate %s no longer exists, rejoining the election", this.nodePath)
+			this.nodePath = ""
+			this.resign()
+			continue
+		} else if index == 0 {
+			this.elect()
+			return nil
+		}
+
+		// a candidate which is not first cannot be the leader, e.g. after rejoining
+		this.resign()
+		predecessor := this.electionPath + "/" + candidates[index-1]
+		if exists, err := this.client.watchExists(predecessor, this.signal); err != nil {
+			return err
+		} else if exists {
+			this.logger.Debug("Candidate %s is waiting on %s", this.nodePath, predecessor)
+			return nil
+		}
+	}
+}
+
+// leave resigns and deletes this candidate's znode, if any
+func (this *LeaderElector) leave() {
+	this.resign()
+	if len(this.nodePath) > 0 {
+		if err := this.client.delete(this.nodePath); err != nil && err != zk.ErrNoNode {
+			this.logger.Error("Error while deleting candidate %s: %v", this.nodePath, err)
+			this.closeError = err
+		} else {
+			this.logger.Info("Left the election at %s", this.electionPath)
+		}
+
+		this.nodePath = ""
+	}
+}
+
+// elect notifies the listener if this candidate has just become the leader
+func (this *LeaderElector) elect() {
+	if atomic.CompareAndSwapUint32(&this.leader, 0, 1) {
+		this.logger.Info("Candidate %s elected leader of %s", this.nodePath, this.electionPath)
+		this.invoke(this.listener.OnElected)
+	}
+}
+
+// resign notifies the listener if this candidate was the leader
+func (this *LeaderElector) resign() {
+	if atomic.CompareAndSwapUint32(&this.leader, 1, 0) {
+		this.logger.Info("Resigned leadership of %s", this.electionPath)
+		this.invoke(this.listener.OnResigned)
+	}
+}
+
+// invoke calls a single listener method, recovering from any panic
+func (this *LeaderElector) invoke(callback func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			this.logger.Error("Leader listener %T panicked: %v\n%s", this.listener, r, debug.Stack())
+		}
+	}()
+
+	callback()
+}
@@ -0,0 +1,283 @@
+package service
+
+import (
+	"errors"
+	"github.com/foursquare/curator.go"
+	"github.com/samuel/go-zookeeper/zk"
+	"github.com/stretchr/testify/assert"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeElectionClient is an in-memory electionClient shared by the candidates of a test
+type fakeElectionClient struct {
+	mutex       sync.Mutex
+	znodes      map[string]bool
+	watches     map[string][]func()
+	sequence    int
+	createError error
+}
+
+var _ electionClient = (*fakeElectionClient)(nil)
+
+func newFakeElectionClient() *fakeElectionClient {
+	return &fakeElectionClient{
+		znodes:  make(map[string]bool),
+		watches: make(map[string][]func()),
+	}
+}
+
+func (this *fakeElectionClient) createCandidate(znodePath string) (string, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if err := this.createError; err != nil {
+		this.createError = nil
+		return "", err
+	}
+
+	created := znodePath + strings.Repeat("0", 9) + string(rune('0'+this.sequence))
+	this.sequence++
+	this.znodes[created] = true
+	return created, nil
+}
+
+func (this *fakeElectionClient) children(parent string) ([]string, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	var children []string
+	for znodePath := range this.znodes {
+		if path.Dir(znodePath) == parent {
+			children = append(children, path.Base(znodePath))
+		}
+	}
+
+	// zookeeper returns children in no particular order
+	sort.Sort(sort.Reverse(sort.StringSlice(children)))
+	return children, nil
+}
+
+func (this *fakeElectionClient) watchExists(znodePath string, changed func()) (bool, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if !this.znodes[znodePath] {
+		return false, nil
+	}
+
+	this.watches[znodePath] = append(this.watches[znodePath], changed)
+	return true, nil
+}
+
+func (this *fakeElectionClient) delete(znodePath string) error {
+	this.mutex.Lock()
+	if !this.znodes[znodePath] {
+		this.mutex.Unlock()
+		return zk.ErrNoNode
+	}
+
+	delete(this.znodes, znodePath)
+	watches := this.watches[znodePath]
+	delete(this.watches, znodePath)
+	this.mutex.Unlock()
+
+	for _, changed := range watches {
+		changed()
+	}
+
+	return nil
+}
+
+func (this *fakeElectionClient) candidates() []string {
+	children, _ := this.children(testElectionPath)
+	sort.Strings(children)
+	return children
+}
+
+const testElectionPath = "/test/election"
+
+// recordingLeaderListener sends "elected" or "resigned" to its channel for each notification
+type recordingLeaderListener chan string
+
+func (this recordingLeaderListener) OnElected() {
+	this <- "elected"
+}
+
+func (this recordingLeaderListener) OnResigned() {
+	this <- "resigned"
+}
+
+// expectLeadership waits for the next notification, which must be the expected one
+func expectLeadership(t *testing.T, listener recordingLeaderListener, expected string) {
+	select {
+	case notification := <-listener:
+		assert.Equal(t, expected, notification)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The listener was not notified: expected %s", expected)
+	}
+}
+
+// expectNoLeadership checks that the listener is not notified for a short while
+func expectNoLeadership(t *testing.T, listener recordingLeaderListener) {
+	select {
+	case notification := <-listener:
+		t.Errorf("Unexpected notification: %s", notification)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func startTestLeaderElector(t *testing.T, client electionClient) (*LeaderElector, recordingLeaderListener) {
+	listener := make(recordingLeaderListener, 10)
+	elector := newLeaderElector(client, &testLogger{t}, testElectionPath, listener)
+	elector.retryDelay = 10 * time.Millisecond
+	elector.start()
+	return elector, listener
+}
+
+func TestLeaderElection(t *testing.T) {
+	assert := assert.New(t)
+	client := newFakeElectionClient()
+
+	first, firstListener := startTestLeaderElector(t, client)
+	expectLeadership(t, firstListener, "elected")
+	assert.True(first.IsLeader())
+	assert.Equal(testElectionPath, first.ElectionPath())
+
+	second, secondListener := startTestLeaderElector(t, client)
+	expectNoLeadership(t, secondListener)
+	assert.False(second.IsLeader())
+	third, thirdListener := startTestLeaderElector(t, client)
+	expectNoLeadership(t, thirdListener)
+	assert.Equal([]string{"candidate-0000000000", "candidate-0000000001", "candidate-0000000002"}, client.candidates())
+
+	// a candidate which leaves before being elected only wakes its successor
+	assert.Nil(second.Close())
+	expectNoLeadership(t, secondListener)
+	expectNoLeadership(t, thirdListener)
+	assert.True(first.IsLeader())
+
+	// closing resigns and removes the candidate, electing the next one
+	assert.Nil(first.Close())
+	expectLeadership(t, firstListener, "resigned")
+	assert.False(first.IsLeader())
+	expectLeadership(t, thirdListener, "elected")
+	assert.True(third.IsLeader())
+	assert.Equal([]string{"candidate-0000000002"}, client.candidates())
+
+	assert.Nil(third.Close())
+	assert.Nil(third.Close())
+	expectLeadership(t, thirdListener, "resigned")
+	assert.Empty(client.candidates())
+}
+
+func TestLeaderElectionConnectionLoss(t *testing.T) {
+	assert := assert.New(t)
+	client := newFakeElectionClient()
+
+	elector, listener := startTestLeaderElector(t, client)
+	defer elector.Close()
+	expectLeadership(t, listener, "elected")
+
+	// leadership is resigned while suspended, and regained if the session survives
+	elector.StateChanged(nil, curator.SUSPENDED)
+	expectLeadership(t, listener, "resigned")
+	assert.False(elector.IsLeader())
+	elector.StateChanged(nil, curator.RECONNECTED)
+	expectLeadership(t, listener, "elected")
+	assert.Equal([]string{"candidate-0000000000"}, client.candidates())
+
+	// when the session is lost, the candidate's znode expires and a new one is created
+	elector.StateChanged(nil, curator.LOST)
+	expectLeadership(t, listener, "resigned")
+	client.delete(testElectionPath + "/candidate-0000000000")
+	other, otherListener := startTestLeaderElector(t, client)
+	defer other.Close()
+	expectLeadership(t, otherListener, "elected")
+
+	elector.StateChanged(nil, curator.CONNECTED)
+	expectNoLeadership(t, listener)
+	assert.Equal([]string{"candidate-0000000001", "candidate-0000000002"}, client.candidates())
+}
+
+func TestLeaderElectionRetry(t *testing.T) {
+	client := newFakeElectionClient()
+	client.createError = errors.New("expected")
+
+	// the failed creation is retried after the retry delay
+	elector, listener := startTestLeaderElector(t, client)
+	expectLeadership(t, listener, "elected")
+	assert.Nil(t, elector.Close())
+	expectLeadership(t, listener, "resigned")
+}
+
+func TestLeaderElectionPanic(t *testing.T) {
+	assert := assert.New(t)
+	client := newFakeElectionClient()
+
+	elector := newLeaderElector(client, &testLogger{t}, testElectionPath, LeaderFuncs{
+		Elected: func() { panic("expected") },
+	})
+
+	elector.start()
+	for !elector.IsLeader() {
+		time.Sleep(time.Millisecond)
+	}
+
+	assert.Nil(elector.Close())
+	assert.False(elector.IsLeader())
+}
+
+func TestNewLeaderElector(t *testing.T) {
+	assert := assert.New(t)
+	listener := LeaderFuncs{}
+
+	for _, electionPath := range []string{"", "/", "relative", "/a//b"} {
+		elector, err := NewLeaderElector(mustNewStaticDiscovery(t, nil), electionPath, listener)
+		assert.Nil(elector)
+		assert.Equal(ErrorInvalidElectionPath, err, electionPath)
+	}
+
+	elector, err := NewLeaderElector(mustNewStaticDiscovery(t, nil), testElectionPath, listener)
+	assert.Nil(elector)
+	assert.Equal(ErrorNotRunning, err)
+
+	builder := &DiscoveryBuilder{Connection: testConnection, Watches: []string{testServiceName}, ReadOnly: true}
+	discovery, err := builder.New(&testLogger{t})
+	if assert.Nil(err) {
+		defer discovery.Close()
+		elector, err = NewLeaderElector(discovery, testElectionPath, listener)
+		assert.Nil(elector)
+		assert.Equal(ErrorReadOnly, err)
+	}
+}
+
+func TestCuratorElectionClient(t *testing.T) {
+	assert := assert.New(t)
+	connection := newFakeZookeeperConnection()
+	curatorConnection := startCuratorConnection(t, DiscoveryBuilder{}, connection)
+	defer curatorConnection.Close()
+
+	client := &curatorElectionClient{curatorConnection}
+	first, err := client.createCandidate(testElectionPath + "/" + leaderNodePrefix)
+	assert.Nil(err)
+	assert.Equal(testElectionPath+"/candidate-0000000000", first)
+
+	second, err := client.createCandidate(testElectionPath + "/" + leaderNodePrefix)
+	assert.Nil(err)
+	assert.Equal(testElectionPath+"/candidate-0000000001", second)
+
+	children, err := client.children(testElectionPath)
+	assert.Nil(err)
+	assert.Equal([]string{"candidate-0000000000", "candidate-0000000001"}, children)
+
+	exists, err := client.watchExists(first, func() {})
+	assert.True(exists)
+	assert.Nil(err)
+
+	assert.Nil(client.delete(first))
+	exists, err = client.watchExists(first, func() {})
+	assert.False(exists)
+	assert.Nil(err)
+}
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const (
+	DefaultDeregisterTimeout = time.Duration(10 * time.Second)
+)
+
+var (
+	ErrorDeregisterTimeout = errors.New("Timed out waiting for service instances to be deregistered")
+)
+
+// RunRegistered implements the usual lifecycle of a service's registrations: it registers the given
+// instances with a running Discovery, blocks until the context is done, then deregisters them.  The
+// registrations are maintained by the Discovery while this function blocks, so they are restored if
+// the zookeeper session expires.  To deregister on SIGTERM, pass a context which is cancelled by the
+// signal, e.g. one from signal.NotifyContext.  The Discovery itself is left running and open.
+//
+// Deregistration is bounded by DefaultDeregisterTimeout.  See RunRegisteredTimeout.
+func RunRegistered(ctx context.Context, discovery Discovery, instances Instances) error {
+	return RunRegisteredTimeout(ctx, discovery, instances, DefaultDeregisterTimeout)
+}
+
+// RunRegisteredTimeout is like RunRegistered, but bounds deregistration by the given timeout rather
+// than DefaultDeregisterTimeout.  A nonpositive timeout waits for deregistration indefinitely.
+//
+// The error from deregistration, if any, is returned once the context is done, and ErrorDeregisterTimeout
+// is returned if the timeout elapses first.  If the instances cannot all be registered, any which
+// were registered are deregistered and the registration error is returned without waiting for the
+// context.  If the context is done before anything is registered, its error is returned.
+func RunRegisteredTimeout(ctx context.Context, discovery Discovery, instances Instances, timeout time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	registered, err := discovery.Register(instances)
+	if err != nil {
+		deregisterWithin(discovery, registered, timeout)
+		return err
+	}
+
+	<-ctx.Done()
+	return deregisterWithin(discovery, registered, timeout)
+}
+
+// deregisterWithin deregisters the given instances, giving up after the given timeout, if positive
+func deregisterWithin(discovery Discovery, instances Instances, timeout time.Duration) error {
+	if len(instances) == 0 {
+		return nil
+	} else if timeout <= 0 {
+		return discovery.DeregisterInstances(instances)
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- discovery.DeregisterInstances(instances)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		return ErrorDeregisterTimeout
+	}
+}
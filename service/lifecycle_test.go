@@ -0,0 +1,148 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+// registeringDiscovery is a Discovery which records registrations in memory
+type registeringDiscovery struct {
+	Discovery
+
+	mutex         sync.Mutex
+	registered    map[string]bool
+	registerError error
+
+	// deregistered, if not nil, is received from before deregistering
+	deregistered    chan struct{}
+	deregisterError error
+}
+
+func newRegisteringDiscovery() *registeringDiscovery {
+	return &registeringDiscovery{registered: make(map[string]bool)}
+}
+
+func (this *registeringDiscovery) Register(instances Instances) (Instances, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	registered := Instances{}
+	for _, serviceInstance := range instances {
+		if this.registerError != nil && serviceInstance.Address == "fail.com" {
+			return registered, this.registerError
+		}
+
+		normalized := normalizeInstance(serviceInstance)
+		this.registered[normalized.Id] = true
+		registered = append(registered, normalized)
+	}
+
+	return registered, nil
+}
+
+func (this *registeringDiscovery) DeregisterInstances(instances Instances) error {
+	if this.deregistered != nil {
+		<-this.deregistered
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for _, serviceInstance := range instances {
+		delete(this.registered, serviceInstance.Id)
+	}
+
+	return this.deregisterError
+}
+
+func (this *registeringDiscovery) registeredCount() int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return len(this.registered)
+}
+
+func TestRunRegistered(t *testing.T) {
+	assert := assert.New(t)
+
+	discovery := newRegisteringDiscovery()
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- RunRegistered(ctx, discovery, Instances{newTestInstance("", "localhost", 1234), newTestInstance("", "localhost", 1235)})
+	}()
+
+	assert.Eventually(func() bool { return discovery.registeredCount() == 2 }, 5*time.Second, time.Millisecond)
+	select {
+	case err := <-result:
+		assert.Fail("RunRegistered returned before the context was done", "%v", err)
+	default:
+	}
+
+	cancel()
+	select {
+	case err := <-result:
+		assert.Nil(err)
+		assert.Equal(0, discovery.registeredCount())
+	case <-time.After(5 * time.Second):
+		assert.Fail("RunRegistered did not return")
+	}
+}
+
+func TestRunRegisteredErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	// nothing is registered once the context is done
+	discovery := newRegisteringDiscovery()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(context.Canceled, RunRegistered(ctx, discovery, Instances{newTestInstance("", "localhost", 1234)}))
+	assert.Equal(0, discovery.registeredCount())
+
+	// a failed registration returns at once, without leaving the other instances registered
+	discovery.registerError = errors.New("expected")
+	err := RunRegistered(context.Background(), discovery, Instances{newTestInstance("", "localhost", 1234), newTestInstance("", "fail.com", 1235)})
+	assert.Equal(discovery.registerError, err)
+	assert.Equal(0, discovery.registeredCount())
+
+	// the error from deregistration is returned
+	discovery = newRegisteringDiscovery()
+	discovery.deregisterError = errors.New("expected")
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	assert.Equal(discovery.deregisterError, RunRegistered(ctx, discovery, Instances{newTestInstance("", "localhost", 1234)}))
+}
+
+func TestRunRegisteredTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	discovery := newRegisteringDiscovery()
+	discovery.deregistered = make(chan struct{})
+	defer close(discovery.deregistered)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	assert.Equal(ErrorDeregisterTimeout, RunRegisteredTimeout(ctx, discovery, Instances{newTestInstance("", "localhost", 1234)}, 10*time.Millisecond))
+}
+
+func TestDiscoveryRegisterNotRunning(t *testing.T) {
+	assert := assert.New(t)
+
+	builder := &DiscoveryBuilder{Connection: testConnection, Watches: []string{testServiceName}}
+	discovery, err := builder.New(&testLogger{t})
+	if !assert.Nil(err) {
+		return
+	}
+
+	defer discovery.Close()
+	registered, err := discovery.Register(Instances{newTestInstance("", "localhost", 1234)})
+	assert.Nil(registered)
+	assert.Equal(ErrorNotRunning, err)
+	assert.Nil(discovery.DeregisterInstances(Instances{newTestInstance("1", "localhost", 1234)}))
+
+	static := mustNewStaticDiscovery(t, nil)
+	_, err = static.Register(Instances{newTestInstance("", "localhost", 1234)})
+	assert.Equal(ErrorRegistrationUnsupported, err)
+	assert.Nil(static.DeregisterInstances(nil))
+}
@@ -1,17 +1,184 @@
 package service
 
+import (
+	"reflect"
+	"sync"
+)
+
 // Listener receives notifications when the set of watched services has changed.
 type Listener interface {
 	// ServicesChanged is invoked anytime a Watcher notices that the set of services
-	// with a given name has changed.
+	// with a given name has changed.  The given Instances are never nil.  Once a service has
+	// been read, each listener receives at least one event, even if the service has no instances,
+	// so an empty Instances means that the service exists but has no instances.
 	ServicesChanged(serviceName string, instances Instances)
 }
 
-// ListenerFunc is the function type that corresponds to Listener
-type ListenerFunc func(string, Instances)
+const (
+	// DefaultListenerGroup is the group of every listener added via AddListener or AddListenerForServices
+	DefaultListenerGroup = ""
+)
+
+// Registration represents a listener that was added to a Discovery
+type Registration interface {
+	// Cancel removes the listener.  Once Cancel returns, the listener receives no further events,
+	// except for an event that may already be in progress.  This method is idempotent, and it is
+	// safe to call from within the listener's own ServicesChanged method.
+	Cancel()
+}
+
+// ListenerFunc is the function type that corresponds to Listener, allowing closures
+// to be registered directly in the same way as http.HandlerFunc.
+//
+// Function values are not comparable, so a ListenerFunc cannot be removed by passing it to
+// RemoveListener.  Use the Registration returned by AddListener instead, or register a pointer
+// to the ListenerFunc to remove it by identity:
+//
+//	listener := ListenerFunc(func(serviceName string, instances Instances) { ... })
+//	discovery.AddListener(serviceName, &listener)
+//	discovery.RemoveListener(serviceName, &listener)
+type ListenerFunc func(serviceName string, instances Instances)
 
 var _ Listener = (ListenerFunc)(nil)
+var _ Listener = (*ListenerFunc)(nil)
 
+// ServicesChanged simply invokes this function
 func (f ListenerFunc) ServicesChanged(serviceName string, instances Instances) {
 	f(serviceName, instances)
 }
+
+// InstanceEvent describes a change to the set of services with a given name, along with
+// the ServiceInstances that were added and removed relative to the previous event.
+type InstanceEvent struct {
+	// Added holds the ServiceInstances in Current which were not present previously
+	Added Instances
+
+	// Removed holds the previously present ServiceInstances which are not in Current
+	Removed Instances
+
+	// Updated holds the ServiceInstances in Current whose data changed while they remained
+	// present, e.g. a new payload.  It is only populated when instance data is watched.
+	Updated Instances
+
+	// Current is the complete set of services, as would be passed to ServicesChanged.  It is
+	// never nil, although it is empty when the service has no instances.
+	Current Instances
+
+	// Annotated describes where and when each ServiceInstance in Current was read, in the same
+	// order as Current.  Plain Listeners, which receive only Current, never see annotations.
+	Annotated AnnotatedInstances
+
+	// Stale holds the ServiceInstances in Current which registered longer ago than the configured
+	// StaleInstanceThreshold, and so may have been left behind by crashed processes.  Stale
+	// instances remain in Current.  This is empty unless a StaleInstanceThreshold is configured.
+	Stale Instances
+
+	// Pinned is set when Current is a set of instances pinned via Discovery.PinInstances, rather
+	// than what was read from zookeeper.  The event which unpins a service is not Pinned.
+	Pinned bool
+
+	// Sequence increases by one with each change dispatched for a service.  A listener can
+	// detect events that were dropped, e.g. by DispatchQueueFullDropOldest, by a gap in
+	// the sequence.  The Sequence is also the revision of Current, as returned by
+	// Discovery.FetchRevision, so events and pulled Instances can be ordered against each other.
+	Sequence uint64
+}
+
+// InstancesListener is a Listener which also receives the Instances added and removed by
+// each change.  When a listener implements this interface, InstancesChanged is invoked in
+// place of ServicesChanged.
+type InstancesListener interface {
+	Listener
+
+	// InstancesChanged is invoked anytime a Watcher notices that the set of services
+	// with a given name has changed.  The first event delivered to a listener reports
+	// every current ServiceInstance as added.
+	InstancesChanged(serviceName string, event InstanceEvent)
+}
+
+// InstancesListenerFunc is the function type that corresponds to InstancesListener.  Like
+// ListenerFunc, an InstancesListenerFunc cannot be removed by passing it to RemoveListener.
+type InstancesListenerFunc func(serviceName string, event InstanceEvent)
+
+var _ InstancesListener = (InstancesListenerFunc)(nil)
+var _ InstancesListener = (*InstancesListenerFunc)(nil)
+
+// ServicesChanged invokes this function with an event containing only the current Instances.
+// Discovery never calls this method, since it calls InstancesChanged instead.
+func (f InstancesListenerFunc) ServicesChanged(serviceName string, instances Instances) {
+	f(serviceName, InstanceEvent{Current: instances})
+}
+
+// InstancesChanged simply invokes this function
+func (f InstancesListenerFunc) InstancesChanged(serviceName string, event InstanceEvent) {
+	f(serviceName, event)
+}
+
+// sameListener tests whether two listeners are identical.  Unlike ==, this function
+// does not panic when a listener's dynamic type is not comparable, e.g. a ListenerFunc.
+// Such listeners are never considered identical to anything.
+func sameListener(left, right Listener) bool {
+	leftType := reflect.TypeOf(left)
+	if leftType != reflect.TypeOf(right) || (leftType != nil && !leftType.Comparable()) {
+		return false
+	}
+
+	return left == right
+}
+
+// ServiceEvent describes a single change to the set of services with a given name
+type ServiceEvent struct {
+	ServiceName string
+	Instances   Instances
+}
+
+// ChannelListener is a Listener which delivers each change as a ServiceEvent on a channel,
+// for use in select-driven code.  A ChannelListener never blocks the dispatcher: when its
+// channel is full, the oldest event is dropped in favor of the newest, since stale snapshots
+// of services are worthless.
+type ChannelListener struct {
+	mutex  sync.Mutex
+	closed bool
+	events chan ServiceEvent
+}
+
+var _ Listener = (*ChannelListener)(nil)
+
+// NewChannelListener creates a ChannelListener whose channel holds up to buffer events.
+// A nonpositive buffer is treated as 1.  The returned channel is the same as that returned
+// by the listener's Events method.
+func NewChannelListener(buffer int) (*ChannelListener, <-chan ServiceEvent) {
+	if buffer < 1 {
+		buffer = 1
+	}
+
+	listener := &ChannelListener{
+		events: make(chan ServiceEvent, buffer),
+	}
+
+	return listener, listener.events
+}
+
+// Events returns the channel on which this listener delivers events
+func (this *ChannelListener) Events() <-chan ServiceEvent {
+	return this.events
+}
+
+func (this *ChannelListener) ServicesChanged(serviceName string, instances Instances) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if !this.closed {
+		sendDroppingOldest(this.events, ServiceEvent{serviceName, instances})
+	}
+}
+
+// Close closes the events channel.  Any events received afterward are discarded.
+// This method is idempotent.
+func (this *ChannelListener) Close() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if !this.closed {
+		this.closed = true
+		close(this.events)
+	}
+}
@@ -0,0 +1,479 @@
+package service
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestChannelListener(t *testing.T) {
+	assert := assert.New(t)
+
+	listener, events := NewChannelListener(2)
+	assert.Equal(events, listener.Events())
+
+	instances := testInstancesWithIds("1")
+	listener.ServicesChanged(testServiceName, instances)
+	assert.Equal(ServiceEvent{testServiceName, instances}, <-events)
+
+	// a full channel keeps only the newest events
+	for index := 0; index < 10; index++ {
+		listener.ServicesChanged(testServiceName, testInstancesWithIds(strconv.Itoa(index)))
+	}
+
+	assert.Equal("8", (<-events).Instances[0].Id)
+	assert.Equal("9", (<-events).Instances[0].Id)
+
+	listener.ServicesChanged(testServiceName, instances)
+	listener.Close()
+	listener.Close()
+	listener.ServicesChanged(testServiceName, instances)
+
+	event, ok := <-events
+	assert.True(ok)
+	assert.Equal(ServiceEvent{testServiceName, instances}, event)
+
+	_, ok = <-events
+	assert.False(ok)
+}
+
+func TestChannelListenerMinimumBuffer(t *testing.T) {
+	listener, events := NewChannelListener(0)
+	listener.ServicesChanged(testServiceName, testInstancesWithIds("1"))
+	listener.ServicesChanged(testServiceName, testInstancesWithIds("2"))
+	assert.Equal(t, "2", (<-events).Instances[0].Id)
+}
+
+func TestChannelListenerConcurrentClose(t *testing.T) {
+	listener, events := NewChannelListener(1)
+	waitGroup := &sync.WaitGroup{}
+	for index := 0; index < 10; index++ {
+		waitGroup.Add(2)
+		go func() {
+			defer waitGroup.Done()
+			listener.ServicesChanged(testServiceName, Instances{})
+		}()
+
+		go func() {
+			defer waitGroup.Done()
+			listener.Close()
+		}()
+	}
+
+	waitGroup.Wait()
+	for range events {
+	}
+}
+
+func TestListenerFunc(t *testing.T) {
+	assert := assert.New(t)
+
+	var actualServiceName string
+	var actualInstances Instances
+	listener := ListenerFunc(func(serviceName string, instances Instances) {
+		actualServiceName = serviceName
+		actualInstances = instances
+	})
+
+	instances := testInstancesWithIds("1")
+	listener.ServicesChanged(testServiceName, instances)
+	assert.Equal(testServiceName, actualServiceName)
+	assert.Equal(instances, actualInstances)
+}
+
+func TestInstancesListenerFunc(t *testing.T) {
+	assert := assert.New(t)
+
+	var events []InstanceEvent
+	listener := InstancesListenerFunc(func(serviceName string, event InstanceEvent) {
+		assert.Equal(testServiceName, serviceName)
+		events = append(events, event)
+	})
+
+	instances := testInstancesWithIds("1")
+	event := InstanceEvent{Added: instances, Current: instances, Sequence: 5}
+	listener.InstancesChanged(testServiceName, event)
+	listener.ServicesChanged(testServiceName, instances)
+	assert.Equal([]InstanceEvent{event, InstanceEvent{Current: instances}}, events)
+}
+
+func TestAddAndRemoveListenerFunc(t *testing.T) {
+	assert := assert.New(t)
+
+	serviceWatcher := &serviceWatcher{serviceName: testServiceName, logger: &testLogger{t}}
+	dispatchCount := 0
+	listener := ListenerFunc(func(serviceName string, instances Instances) {
+		dispatchCount++
+	})
+
+	// a bare ListenerFunc can be registered, but not removed by identity
+	serviceWatcher.addListener(listener)
+	assert.False(serviceWatcher.removeListener(listener))
+	serviceWatcher.dispatch(testInstancesWithIds("1"))
+	assert.Equal(1, dispatchCount)
+	serviceWatcher.removeAllListeners()
+
+	// the listener receives the last-known instances when it is added
+	serviceWatcher.addListener(&listener)
+	assert.Equal(2, dispatchCount)
+	serviceWatcher.dispatch(testInstancesWithIds("2"))
+	assert.Equal(3, dispatchCount)
+
+	other := ListenerFunc(func(serviceName string, instances Instances) {})
+	assert.False(serviceWatcher.removeListener(&other))
+	assert.True(serviceWatcher.removeListener(&listener))
+	assert.False(serviceWatcher.removeListener(&listener))
+
+	serviceWatcher.dispatch(testInstancesWithIds("3"))
+	assert.Equal(3, dispatchCount)
+}
+
+func TestRemoveAllListenersAndListenerCount(t *testing.T) {
+	assert := assert.New(t)
+
+	serviceWatcher := &serviceWatcher{serviceName: testServiceName, logger: &testLogger{t}}
+	assert.Equal(0, serviceWatcher.listenerCount())
+	assert.Equal(0, serviceWatcher.removeAllListeners())
+
+	dispatchCount := 0
+	listener := ListenerFunc(func(serviceName string, instances Instances) {
+		dispatchCount++
+	})
+
+	serviceWatcher.addListener(listener)
+	serviceWatcher.addGroupListener("library", listener)
+	registration, _ := serviceWatcher.addListener(listener)
+	registration.Cancel()
+	assert.Equal(2, serviceWatcher.listenerCount())
+
+	assert.Equal(2, serviceWatcher.removeAllListeners())
+	assert.Equal(0, serviceWatcher.listenerCount())
+	serviceWatcher.dispatch(testInstancesWithIds("1"))
+	assert.Equal(0, dispatchCount)
+}
+
+func TestListenerRemovesItselfDuringDispatch(t *testing.T) {
+	assert := assert.New(t)
+
+	serviceWatcher := &serviceWatcher{serviceName: testServiceName, logger: &testLogger{t}}
+	var calls []string
+	var first, second Registration
+	first, _ = serviceWatcher.addListener(ListenerFunc(func(serviceName string, instances Instances) {
+		calls = append(calls, "first")
+		first.Cancel()
+	}))
+
+	second, _ = serviceWatcher.addListener(ListenerFunc(func(serviceName string, instances Instances) {
+		calls = append(calls, "second")
+	}))
+
+	serviceWatcher.addListener(ListenerFunc(func(serviceName string, instances Instances) {
+		calls = append(calls, "third")
+
+		// cancelling a listener that has already been delivered to does not affect this dispatch
+		second.Cancel()
+	}))
+
+	serviceWatcher.dispatch(testInstancesWithIds("1"))
+	assert.Equal([]string{"first", "second", "third"}, calls)
+	assert.Equal(1, serviceWatcher.listenerCount())
+
+	calls = nil
+	serviceWatcher.dispatch(testInstancesWithIds("2"))
+	assert.Equal([]string{"third"}, calls)
+}
+
+func TestListenersModifyListenersDuringDispatch(t *testing.T) {
+	assert := assert.New(t)
+
+	serviceWatcher := &serviceWatcher{serviceName: testServiceName, logger: &testLogger{t}}
+	var oneShotEvents, addedEvents []uint64
+	var oneShot, added InstancesListenerFunc
+	oneShot = InstancesListenerFunc(func(serviceName string, event InstanceEvent) {
+		oneShotEvents = append(oneShotEvents, event.Sequence)
+
+		// removing itself by identity, and adding another listener, must not deadlock
+		assert.True(serviceWatcher.removeListener(&oneShot))
+		serviceWatcher.addListener(&added)
+		assert.Equal(1, serviceWatcher.listenerCount())
+	})
+
+	added = InstancesListenerFunc(func(serviceName string, event InstanceEvent) {
+		addedEvents = append(addedEvents, event.Sequence)
+	})
+
+	serviceWatcher.addListener(&oneShot)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serviceWatcher.dispatch(testInstancesWithIds("1"))
+		serviceWatcher.dispatch(testInstancesWithIds("2"))
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Listeners which modify listeners deadlocked the dispatch")
+	}
+
+	// the added listener receives the last-known instances once, then only subsequent events
+	assert.Equal([]uint64{1}, oneShotEvents)
+	assert.Equal([]uint64{1, 2}, addedEvents)
+	assert.Equal(1, serviceWatcher.removeAllListeners())
+}
+
+func TestAddListenerWaitsForReplay(t *testing.T) {
+	assert := assert.New(t)
+
+	serviceWatcher := &serviceWatcher{serviceName: testServiceName, logger: &testLogger{t}}
+	serviceWatcher.dispatch(testInstancesWithIds("1"))
+
+	// the replay blocks until a dispatch is underway, which must not reach the listener first
+	replaying := make(chan struct{})
+	release := make(chan struct{})
+	var mutex sync.Mutex
+	var sequences []uint64
+	listener := InstancesListenerFunc(func(serviceName string, event InstanceEvent) {
+		mutex.Lock()
+		sequences = append(sequences, event.Sequence)
+		first := len(sequences) == 1
+		mutex.Unlock()
+		if first {
+			close(replaying)
+			<-release
+		}
+	})
+
+	added := make(chan struct{})
+	go func() {
+		defer close(added)
+		serviceWatcher.addListener(listener)
+	}()
+
+	<-replaying
+	dispatched := make(chan struct{})
+	go func() {
+		defer close(dispatched)
+		serviceWatcher.dispatch(testInstancesWithIds("2"))
+	}()
+
+	close(release)
+	<-added
+	<-dispatched
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal([]uint64{1, 2}, sequences)
+}
+
+func TestOnceListener(t *testing.T) {
+	assert := assert.New(t)
+
+	serviceWatcher := &serviceWatcher{serviceName: testServiceName, logger: &testLogger{t}}
+	serviceWatcher.dispatch(testInstancesWithIds("1"))
+
+	var events []InstanceEvent
+	serviceWatcher.addOnceListener(DefaultListenerGroup, InstancesListenerFunc(func(serviceName string, event InstanceEvent) {
+		events = append(events, event)
+	}))
+
+	// the last-known instances are not delivered, only the next change
+	assert.Empty(events)
+	assert.Equal(1, serviceWatcher.listenerCount())
+	serviceWatcher.dispatch(testInstancesWithIds("2"))
+	serviceWatcher.dispatch(testInstancesWithIds("3"))
+	if assert.Len(events, 1) {
+		assert.Equal(uint64(2), events[0].Sequence)
+		assert.Equal([]string{"2"}, instanceIds(events[0].Current))
+	}
+
+	assert.Equal(0, serviceWatcher.listenerCount())
+
+	// cancelling beforehand means the listener is never invoked
+	invoked := false
+	registration, _ := serviceWatcher.addOnceListener(DefaultListenerGroup, ListenerFunc(func(serviceName string, instances Instances) {
+		invoked = true
+	}))
+
+	registration.Cancel()
+
+	serviceWatcher.dispatch(testInstancesWithIds("4"))
+	assert.False(invoked)
+}
+
+func TestOnceListenerConcurrentDispatch(t *testing.T) {
+	var testData = []dispatchOptions{
+		{},
+		{async: true, queueSize: 5},
+		{async: true, queueSize: 1, dropOldest: true},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+		serviceWatcher := &serviceWatcher{
+			serviceName:     testServiceName,
+			logger:          &testLogger{t},
+			dispatchOptions: record,
+		}
+
+		var invocations int32
+		invoked := make(chan struct{}, 100)
+		serviceWatcher.addOnceListener(DefaultListenerGroup, ListenerFunc(func(serviceName string, instances Instances) {
+			atomic.AddInt32(&invocations, 1)
+			invoked <- struct{}{}
+		}))
+
+		var waitGroup sync.WaitGroup
+		for index := 0; index < 50; index++ {
+			waitGroup.Add(1)
+			go func(id string) {
+				defer waitGroup.Done()
+				serviceWatcher.dispatch(testInstancesWithIds(id))
+			}(strconv.Itoa(index))
+		}
+
+		waitGroup.Wait()
+		select {
+		case <-invoked:
+		case <-time.After(5 * time.Second):
+			t.Fatal("The once listener was never invoked")
+		}
+
+		// allow any erroneous extra invocations to surface
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(int32(1), atomic.LoadInt32(&invocations))
+		serviceWatcher.stop()
+	}
+}
+
+func TestSameListener(t *testing.T) {
+	assert := assert.New(t)
+
+	function := ListenerFunc(func(string, Instances) {})
+	channelListener, _ := NewChannelListener(1)
+	otherChannelListener, _ := NewChannelListener(1)
+
+	assert.False(sameListener(function, function))
+	assert.True(sameListener(&function, &function))
+	assert.True(sameListener(channelListener, channelListener))
+	assert.False(sameListener(channelListener, otherChannelListener))
+	assert.False(sameListener(channelListener, &function))
+	assert.False(sameListener(nil, channelListener))
+	assert.True(sameListener(nil, nil))
+}
+
+func TestDuplicateListener(t *testing.T) {
+	for _, rejectDuplicates := range []bool{false, true} {
+		t.Logf("rejectDuplicates: %t", rejectDuplicates)
+		assert := assert.New(t)
+
+		serviceWatcher := &serviceWatcher{
+			serviceName:     testServiceName,
+			logger:          &testLogger{t},
+			dispatchOptions: dispatchOptions{rejectDuplicates: rejectDuplicates},
+		}
+
+		listener := &serviceNameRecorder{}
+		registration, err := serviceWatcher.addListener(listener)
+		assert.NotNil(registration)
+		assert.Nil(err)
+
+		duplicate, err := serviceWatcher.addListener(listener)
+		if rejectDuplicates {
+			assert.Nil(duplicate)
+			assert.Equal(ErrorAlreadyRegistered, err)
+		} else {
+			assert.Equal(registration, duplicate)
+			assert.Nil(err)
+		}
+
+		// the same listener may still be registered in another group, or as a once listener
+		_, err = serviceWatcher.addGroupListener("library", listener)
+		assert.Nil(err)
+		_, err = serviceWatcher.addOnceListener(DefaultListenerGroup, listener)
+		assert.Nil(err)
+		_, err = serviceWatcher.addOnceListener(DefaultListenerGroup, listener)
+		assert.Equal(rejectDuplicates, err == ErrorAlreadyRegistered)
+
+		// listeners which are not comparable are distinguished only by their registrations
+		function := ListenerFunc(func(string, Instances) {})
+		first, err := serviceWatcher.addListener(function)
+		assert.Nil(err)
+		second, err := serviceWatcher.addListener(function)
+		assert.Nil(err)
+		assert.False(first == second)
+		assert.Equal(5, serviceWatcher.listenerCount())
+
+		serviceWatcher.dispatch(testInstancesWithIds("1"))
+		assert.Equal([]string{testServiceName, testServiceName, testServiceName}, listener.take())
+
+		// once cancelled, the listener may be registered again
+		registration.Cancel()
+		_, err = serviceWatcher.addListener(listener)
+		assert.Nil(err)
+		assert.Equal(4, serviceWatcher.listenerCount())
+	}
+}
+
+func TestRegistrationCancel(t *testing.T) {
+	assert := assert.New(t)
+
+	serviceWatcher := &serviceWatcher{serviceName: testServiceName, logger: &testLogger{t}}
+	dispatchCount := 0
+	registration, _ := serviceWatcher.addListener(ListenerFunc(func(serviceName string, instances Instances) {
+		dispatchCount++
+	}))
+
+	serviceWatcher.dispatch(testInstancesWithIds("1"))
+	assert.Equal(1, dispatchCount)
+
+	registration.Cancel()
+	registration.Cancel()
+	serviceWatcher.dispatch(testInstancesWithIds("2"))
+	assert.Equal(1, dispatchCount)
+	assert.Empty(serviceWatcher.listeners)
+}
+
+func TestRegistrationCancelFromListener(t *testing.T) {
+	for _, async := range []bool{false, true} {
+		assert := assert.New(t)
+
+		serviceWatcher := &serviceWatcher{
+			serviceName:     testServiceName,
+			logger:          &testLogger{t},
+			dispatchOptions: dispatchOptions{async: async, queueSize: 1},
+		}
+
+		received := make(chan string, 10)
+		var registration Registration
+		registered := make(chan struct{})
+		registration, _ = serviceWatcher.addListener(ListenerFunc(func(serviceName string, instances Instances) {
+			<-registered
+			received <- instances[0].Id
+			registration.Cancel()
+		}))
+
+		close(registered)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for index := 0; index < 5; index++ {
+				serviceWatcher.dispatch(testInstancesWithIds(strconv.Itoa(index)))
+			}
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Cancelling from within a listener deadlocked (async=%t)", async)
+		}
+
+		assert.Equal("0", <-received)
+		time.Sleep(100 * time.Millisecond)
+		assert.Empty(received)
+	}
+}
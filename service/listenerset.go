@@ -0,0 +1,126 @@
+package service
+
+import (
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+)
+
+// listenerSetEntry is the internal record of a listener registered with a listenerSet
+type listenerSetEntry struct {
+	listener  interface{}
+	cancelled uint32
+}
+
+func (this *listenerSetEntry) isCancelled() bool {
+	return atomic.LoadUint32(&this.cancelled) != 0
+}
+
+func (this *listenerSetEntry) cancel() {
+	atomic.StoreUint32(&this.cancelled, 1)
+}
+
+// listenerSet is the collection of listeners behind each of the monitors which fan events out to
+// application listeners, such as the connectionStateMonitor.  Its mutex is never held during
+// callbacks, which allows listeners to add or cancel registrations from within a callback.
+// Serializing deliveries is left to each monitor.
+type listenerSet struct {
+	logger Logger
+
+	// kind describes the listeners in log messages, e.g. "Connection state"
+	kind string
+
+	mutex   sync.Mutex
+	entries []*listenerSetEntry
+}
+
+func newListenerSet(logger Logger, kind string) *listenerSet {
+	return &listenerSet{
+		logger: logger,
+		kind:   kind,
+	}
+}
+
+// add registers a listener, returning the Registration which cancels it
+func (this *listenerSet) add(listener interface{}) Registration {
+	entry := &listenerSetEntry{listener: listener}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.entries = append(this.entries, entry)
+	return &listenerSetRegistration{this, entry}
+}
+
+// remove marks the given entry as cancelled and removes it from this set
+func (this *listenerSet) remove(entry *listenerSetEntry) {
+	entry.cancel()
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for index, candidate := range this.entries {
+		if candidate == entry {
+			this.entries = append(this.entries[:index:index], this.entries[index+1:]...)
+			return
+		}
+	}
+}
+
+// clear cancels and removes every entry
+func (this *listenerSet) clear() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for _, entry := range this.entries {
+		entry.cancel()
+	}
+
+	this.entries = nil
+}
+
+// len returns the number of registered listeners
+func (this *listenerSet) len() int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return len(this.entries)
+}
+
+// snapshot returns the current entries, which may be delivered to without holding the mutex
+func (this *listenerSet) snapshot() []*listenerSetEntry {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.entries
+}
+
+// each calls the given function with each listener that has not been cancelled
+func (this *listenerSet) each(call func(listener interface{})) {
+	for _, entry := range this.snapshot() {
+		this.invoke(entry, call)
+	}
+}
+
+// invoke calls the given function with the entry's listener, unless the entry has been cancelled,
+// recovering from any panic
+func (this *listenerSet) invoke(entry *listenerSetEntry, call func(listener interface{})) {
+	if entry.isCancelled() {
+		return
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			this.logger.Error("%s listener %T panicked: %v\n%s", this.kind, entry.listener, r, debug.Stack())
+		}
+	}()
+
+	call(entry.listener)
+}
+
+// listenerSetRegistration is the Registration implementation for a listener in a listenerSet
+type listenerSetRegistration struct {
+	listeners *listenerSet
+	entry     *listenerSetEntry
+}
+
+var _ Registration = (*listenerSetRegistration)(nil)
+
+// Cancel removes the listener.  No events are delivered to the listener after this method
+// returns, unless Cancel is called from another goroutine while an event is being delivered.
+func (this *listenerSetRegistration) Cancel() {
+	this.listeners.remove(this.entry)
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestListenerSet(t *testing.T) {
+	assert := assert.New(t)
+	listeners := newListenerSet(&testLogger{t}, "Test")
+
+	var calls []string
+	first := listeners.add("first")
+	listeners.add("panics")
+	listeners.add("last")
+	assert.Equal(3, listeners.len())
+
+	// a panicking listener does not prevent delivery to the others
+	deliver := func() {
+		listeners.each(func(listener interface{}) {
+			if listener == "panics" {
+				panic("expected")
+			}
+
+			calls = append(calls, listener.(string))
+		})
+	}
+
+	deliver()
+	assert.Equal([]string{"first", "last"}, calls)
+
+	// a cancelled listener receives nothing, even from a snapshot taken beforehand
+	snapshot := listeners.snapshot()
+	first.Cancel()
+	first.Cancel()
+	assert.Equal(2, listeners.len())
+	for _, entry := range snapshot {
+		listeners.invoke(entry, func(listener interface{}) {
+			calls = append(calls, listener.(string))
+		})
+	}
+
+	assert.Equal([]string{"first", "last", "panics", "last"}, calls)
+
+	listeners.clear()
+	assert.Equal(0, listeners.len())
+	for _, entry := range snapshot {
+		assert.True(entry.isCancelled())
+	}
+
+	deliver()
+	assert.Len(calls, 4)
+}
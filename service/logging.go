@@ -0,0 +1,78 @@
+package service
+
+import (
+	"fmt"
+	"github.com/samuel/go-zookeeper/zk"
+	"log"
+)
+
+// Logger is the leveled logging interface used by this package.  Debug messages are very
+// chatty, e.g. one per child znode read, while Error messages indicate that something, such
+// as a watch, could not be established.
+type Logger interface {
+	Debug(format string, parameters ...interface{})
+	Info(format string, parameters ...interface{})
+	Error(format string, parameters ...interface{})
+}
+
+// NewZkLogger adapts a zk.Logger, which has no notion of levels, to a Logger.  Each message
+// is prefixed with its level.  If the supplied zk.Logger is nil, zk.DefaultLogger is used.
+func NewZkLogger(logger zk.Logger) Logger {
+	if logger == nil {
+		logger = zk.DefaultLogger
+	}
+
+	return &zkLogger{logger}
+}
+
+// zkLogger is the Logger returned by NewZkLogger
+type zkLogger struct {
+	logger zk.Logger
+}
+
+func (this *zkLogger) Debug(format string, parameters ...interface{}) {
+	this.logger.Printf("[DEBUG] "+format, parameters...)
+}
+
+func (this *zkLogger) Info(format string, parameters ...interface{}) {
+	this.logger.Printf("[INFO] "+format, parameters...)
+}
+
+func (this *zkLogger) Error(format string, parameters ...interface{}) {
+	this.logger.Printf("[ERROR] "+format, parameters...)
+}
+
+// NewStdLogger adapts a standard library log.Logger to a Logger.  When debug is false,
+// Debug messages are discarded.  Each message is prefixed with its level.
+func NewStdLogger(logger *log.Logger, debug bool) Logger {
+	return &stdLogger{logger, debug}
+}
+
+// stdLogger is the Logger returned by NewStdLogger
+type stdLogger struct {
+	logger *log.Logger
+	debug  bool
+}
+
+func (this *stdLogger) Debug(format string, parameters ...interface{}) {
+	if this.debug {
+		this.logger.Output(2, "[DEBUG] "+fmt.Sprintf(format, parameters...))
+	}
+}
+
+func (this *stdLogger) Info(format string, parameters ...interface{}) {
+	this.logger.Output(2, "[INFO] "+fmt.Sprintf(format, parameters...))
+}
+
+func (this *stdLogger) Error(format string, parameters ...interface{}) {
+	this.logger.Output(2, "[ERROR] "+fmt.Sprintf(format, parameters...))
+}
+
+// NopLogger is a Logger that discards every message
+type NopLogger struct{}
+
+var _ Logger = NopLogger{}
+
+func (this NopLogger) Debug(format string, parameters ...interface{}) {}
+func (this NopLogger) Info(format string, parameters ...interface{})  {}
+func (this NopLogger) Error(format string, parameters ...interface{}) {}
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"testing"
+)
+
+// recordingLogger is a zk.Logger which records each formatted message
+type recordingLogger struct {
+	messages []string
+}
+
+func (this *recordingLogger) Printf(format string, parameters ...interface{}) {
+	this.messages = append(this.messages, fmt.Sprintf(format, parameters...))
+}
+
+func TestZkLogger(t *testing.T) {
+	assert := assert.New(t)
+
+	recorder := &recordingLogger{}
+	logger := NewZkLogger(recorder)
+	logger.Debug("debug %d", 1)
+	logger.Info("info %d", 2)
+	logger.Error("error %d", 3)
+	assert.Equal([]string{"[DEBUG] debug 1", "[INFO] info 2", "[ERROR] error 3"}, recorder.messages)
+
+	assert.NotNil(NewZkLogger(nil))
+}
+
+func TestStdLogger(t *testing.T) {
+	assert := assert.New(t)
+
+	var testData = []struct {
+		debug    bool
+		expected string
+	}{
+		{true, "[DEBUG] debug 1\n[INFO] info 2\n[ERROR] error 3\n"},
+		{false, "[INFO] info 2\n[ERROR] error 3\n"},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		var output bytes.Buffer
+		logger := NewStdLogger(log.New(&output, "", 0), record.debug)
+		logger.Debug("debug %d", 1)
+		logger.Info("info %d", 2)
+		logger.Error("error %d", 3)
+		assert.Equal(record.expected, output.String())
+	}
+}
+
+func TestBuilderLogger(t *testing.T) {
+	assert := assert.New(t)
+
+	recorder := &recordingLogger{}
+	builder := &DiscoveryBuilder{Connection: testConnection, Watches: []string{testServiceName}}
+	discovery, err := builder.New(recorder)
+	if assert.Nil(err) {
+		assert.Equal(recorder, discovery.(*curatorDiscovery).logger.(*zkLogger).logger)
+		assert.NotEmpty(recorder.messages)
+	}
+
+	builder.Logger = NopLogger{}
+	discovery, err = builder.New(recorder)
+	if assert.Nil(err) {
+		assert.Equal(NopLogger{}, discovery.(*curatorDiscovery).logger)
+	}
+}
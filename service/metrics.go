@@ -0,0 +1,351 @@
+package service
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// dispatchDurationBounds are the upper bounds of the buckets used to track dispatch durations
+var dispatchDurationBounds = [...]time.Duration{
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+}
+
+// DurationHistogram is a snapshot of a distribution of durations
+type DurationHistogram struct {
+	// Bounds are the inclusive upper bounds of the buckets, in increasing order
+	Bounds []time.Duration
+
+	// Counts holds the cumulative number of observations less than or equal to each bound
+	Counts []uint64
+
+	// Count is the total number of observations, including those larger than every bound
+	Count uint64
+
+	// Sum is the total of all observed durations
+	Sum time.Duration
+}
+
+// add accumulates another histogram with the same bounds into this one
+func (this *DurationHistogram) add(other DurationHistogram) {
+	if other.Bounds == nil {
+		return
+	} else if this.Bounds == nil {
+		this.Bounds = other.Bounds
+		this.Counts = make([]uint64, len(other.Counts))
+	}
+
+	for index, count := range other.Counts {
+		this.Counts[index] += count
+	}
+
+	this.Count += other.Count
+	this.Sum += other.Sum
+}
+
+// newDispatchDurationHistogram creates an empty histogram with the buckets used for dispatch durations
+func newDispatchDurationHistogram() DurationHistogram {
+	return DurationHistogram{
+		Bounds: dispatchDurationBounds[:],
+		Counts: make([]uint64, len(dispatchDurationBounds)),
+	}
+}
+
+// observe adds a single duration to this histogram
+func (this *DurationHistogram) observe(duration time.Duration) {
+	for index, bound := range this.Bounds {
+		if duration <= bound {
+			this.Counts[index]++
+		}
+	}
+
+	this.Count++
+	this.Sum += duration
+}
+
+// Metrics is a snapshot of what a Discovery has observed for one or more watched services
+type Metrics struct {
+	// Instances is the number of instances in the last-known set of services
+	Instances int
+
+	// Dispatches is the total number of times the services were broadcast to listeners.
+	// Snapshots which are suppressed because membership did not change are not counted.
+	Dispatches uint64
+
+	// LastDispatch is the time at which the services were most recently broadcast to listeners,
+	// or zero if they never have been.  When aggregated, this is the latest such time.
+	LastDispatch time.Time
+
+	// SlowListeners is the total number of times a listener did not finish handling an event
+	// within the ListenerTimeout
+	SlowListeners uint64
+
+	// FetchErrors is the total number of reads from zookeeper that failed
+	FetchErrors uint64
+
+	// FetchTimeouts is the total number of child znodes skipped because their data could not be
+	// read within the FetchTimeout
+	FetchTimeouts uint64
+
+	// Rewatches is the total number of times a watch was re-established after a failed read
+	Rewatches uint64
+
+	// SkippedInstances is the number of child znodes skipped during the most recent read
+	// because their data could not be read or deserialized
+	SkippedInstances int
+
+	// FilteredInstances is the number of instances excluded from the most recent read by the
+	// InstanceFilter, e.g. because they are draining.  These instances were read successfully,
+	// which distinguishes them from SkippedInstances.
+	FilteredInstances int
+
+	// VersionExcludedInstances is the number of instances excluded from the most recent read by
+	// the VersionConstraint, because their payload did not hold an accepted version
+	VersionExcludedInstances int
+
+	// StaleInstances is the number of instances in the last-known set of services which registered
+	// longer ago than the StaleInstanceThreshold.  These instances are still dispatched.
+	StaleInstances int
+
+	// PendingInitializations is the number of base paths whose initial read failed and is being
+	// retried in the background.  This is only ever nonzero when LenientInitialization is set.
+	PendingInitializations int
+
+	// LastFetchLatency is the duration of the most recent read from zookeeper
+	LastFetchLatency time.Duration
+
+	// MaxFetchLatency is the longest duration of any read from zookeeper
+	MaxFetchLatency time.Duration
+
+	// WatchGeneration is the total number of times a watch was successfully set on the service
+	// path.  A generation which stops increasing while the service changes indicates a lost watch.
+	WatchGeneration uint64
+
+	// LastWatchSet is the time at which a watch was most recently set on the service path, or
+	// zero if none has been.  When aggregated, this is the earliest such time across all services.
+	LastWatchSet time.Time
+
+	// Unwatched is how long the service path has been without a watch, e.g. because a watch
+	// fired and could not be set again.  This is zero while a watch is set.
+	Unwatched time.Duration
+
+	// ThrottledTime is the total time zookeeper operations spent waiting on the ReadRateLimit.
+	// Since the limit is shared by every watched service, this is only reported by AggregateMetrics.
+	ThrottledTime time.Duration
+
+	// DispatchDuration is the distribution of the time taken to broadcast services to listeners.
+	// With asynchronous dispatch, this is only the time taken to queue each event.
+	DispatchDuration DurationHistogram
+}
+
+// add accumulates another Metrics into this one.  Counts are summed, while the latencies
+// reflect the worst case across all services.
+func (this *Metrics) add(other Metrics) {
+	this.Instances += other.Instances
+	this.Dispatches += other.Dispatches
+	if other.LastDispatch.After(this.LastDispatch) {
+		this.LastDispatch = other.LastDispatch
+	}
+
+	this.SlowListeners += other.SlowListeners
+	this.FetchErrors += other.FetchErrors
+	this.FetchTimeouts += other.FetchTimeouts
+	this.Rewatches += other.Rewatches
+	this.SkippedInstances += other.SkippedInstances
+	this.FilteredInstances += other.FilteredInstances
+	this.VersionExcludedInstances += other.VersionExcludedInstances
+	this.StaleInstances += other.StaleInstances
+	this.PendingInitializations += other.PendingInitializations
+	if other.LastFetchLatency > this.LastFetchLatency {
+		this.LastFetchLatency = other.LastFetchLatency
+	}
+
+	if other.MaxFetchLatency > this.MaxFetchLatency {
+		this.MaxFetchLatency = other.MaxFetchLatency
+	}
+
+	this.WatchGeneration += other.WatchGeneration
+	if !other.LastWatchSet.IsZero() && (this.LastWatchSet.IsZero() || other.LastWatchSet.Before(this.LastWatchSet)) {
+		this.LastWatchSet = other.LastWatchSet
+	}
+
+	if other.Unwatched > this.Unwatched {
+		this.Unwatched = other.Unwatched
+	}
+
+	this.ThrottledTime += other.ThrottledTime
+	this.DispatchDuration.add(other.DispatchDuration)
+}
+
+// watcherMetrics holds the counters for a single serviceWatcher.  Every field is accessed
+// atomically, so updating metrics never contends with dispatching.
+type watcherMetrics struct {
+	instances        int64
+	dispatches       uint64
+	slowListeners    uint64
+	fetchErrors      uint64
+	fetchTimeouts    uint64
+	rewatches        uint64
+	skipped          int64
+	filtered         int64
+	versionExcluded  int64
+	stale            int64
+	lastFetchLatency int64
+	maxFetchLatency  int64
+
+	// watchGeneration counts the watches successfully set on the service path.  lastWatchSet is
+	// the time of the most recent one, and unwatchedSince is the time from which the path has been
+	// without a watch, or zero while a watch is set.  Both times are nanoseconds since the epoch.
+	watchGeneration uint64
+	lastWatchSet    int64
+	unwatchedSince  int64
+
+	// dispatchBuckets are the non-cumulative counts of dispatch durations for each bound,
+	// with a final bucket for durations exceeding every bound
+	dispatchBuckets [len(dispatchDurationBounds) + 1]uint64
+	dispatchSum     int64
+
+	// lastDispatch is the time of the most recent broadcast, in nanoseconds since the epoch
+	lastDispatch int64
+
+	// lastSuccess is the time of the most recent successful read, in nanoseconds since the epoch
+	lastSuccess int64
+
+	// lastFailure holds the fetchFailure describing the most recent failed read, if any
+	lastFailure atomic.Value
+}
+
+// fetchFailure describes a failed read from zookeeper
+type fetchFailure struct {
+	message   string
+	timestamp time.Time
+}
+
+// recordFetch records the outcome of a read from zookeeper
+func (this *watcherMetrics) recordFetch(latency time.Duration, err error) {
+	if err != nil {
+		atomic.AddUint64(&this.fetchErrors, 1)
+		this.lastFailure.Store(fetchFailure{err.Error(), time.Now()})
+	} else {
+		atomic.StoreInt64(&this.lastSuccess, time.Now().UnixNano())
+	}
+
+	atomic.StoreInt64(&this.lastFetchLatency, int64(latency))
+	for {
+		current := atomic.LoadInt64(&this.maxFetchLatency)
+		if int64(latency) <= current || atomic.CompareAndSwapInt64(&this.maxFetchLatency, current, int64(latency)) {
+			return
+		}
+	}
+}
+
+// lastFetch returns the time of the most recent successful read and the most recent failure.
+// The time is zero if no read has succeeded, and the failure is false if no read has failed.
+func (this *watcherMetrics) lastFetch() (time.Time, fetchFailure, bool) {
+	var lastSuccess time.Time
+	if nanos := atomic.LoadInt64(&this.lastSuccess); nanos != 0 {
+		lastSuccess = time.Unix(0, nanos)
+	}
+
+	failure, failed := this.lastFailure.Load().(fetchFailure)
+	return lastSuccess, failure, failed
+}
+
+// recordWatchSet records that a watch was successfully set on the service path
+func (this *watcherMetrics) recordWatchSet() {
+	atomic.AddUint64(&this.watchGeneration, 1)
+	atomic.StoreInt64(&this.lastWatchSet, time.Now().UnixNano())
+	atomic.StoreInt64(&this.unwatchedSince, 0)
+}
+
+// recordWatchLost records that the service path is without a watch, either because the watch
+// fired or because it could not be set.  The earliest such time is kept until a watch is set.
+func (this *watcherMetrics) recordWatchLost() {
+	atomic.CompareAndSwapInt64(&this.unwatchedSince, 0, time.Now().UnixNano())
+}
+
+// watchState returns the watch generation, the time the most recent watch was set, and the
+// time from which the service path has been without a watch.  Either time is zero if it does
+// not apply.
+func (this *watcherMetrics) watchState() (uint64, time.Time, time.Time) {
+	var lastWatchSet, unwatchedSince time.Time
+	if nanos := atomic.LoadInt64(&this.lastWatchSet); nanos != 0 {
+		lastWatchSet = time.Unix(0, nanos)
+	}
+
+	if nanos := atomic.LoadInt64(&this.unwatchedSince); nanos != 0 {
+		unwatchedSince = time.Unix(0, nanos)
+	}
+
+	return atomic.LoadUint64(&this.watchGeneration), lastWatchSet, unwatchedSince
+}
+
+// recordDispatch records the time taken to broadcast services to listeners
+func (this *watcherMetrics) recordDispatch(duration time.Duration) {
+	bucket := len(dispatchDurationBounds)
+	for index, bound := range dispatchDurationBounds {
+		if duration <= bound {
+			bucket = index
+			break
+		}
+	}
+
+	atomic.AddUint64(&this.dispatchBuckets[bucket], 1)
+	atomic.AddInt64(&this.dispatchSum, int64(duration))
+}
+
+// dispatchDuration returns a snapshot of the dispatch duration histogram
+func (this *watcherMetrics) dispatchDuration() DurationHistogram {
+	histogram := DurationHistogram{
+		Bounds: dispatchDurationBounds[:],
+		Counts: make([]uint64, len(dispatchDurationBounds)),
+		Sum:    time.Duration(atomic.LoadInt64(&this.dispatchSum)),
+	}
+
+	for index := range this.dispatchBuckets {
+		histogram.Count += atomic.LoadUint64(&this.dispatchBuckets[index])
+		if index < len(histogram.Counts) {
+			histogram.Counts[index] = histogram.Count
+		}
+	}
+
+	return histogram
+}
+
+// snapshot returns the current values of these counters
+func (this *watcherMetrics) snapshot() Metrics {
+	watchGeneration, lastWatchSet, unwatchedSince := this.watchState()
+	var unwatched time.Duration
+	if !unwatchedSince.IsZero() {
+		unwatched = time.Since(unwatchedSince)
+	}
+
+	var lastDispatch time.Time
+	if nanos := atomic.LoadInt64(&this.lastDispatch); nanos != 0 {
+		lastDispatch = time.Unix(0, nanos)
+	}
+
+	return Metrics{
+		Instances:                int(atomic.LoadInt64(&this.instances)),
+		Dispatches:               atomic.LoadUint64(&this.dispatches),
+		LastDispatch:             lastDispatch,
+		SlowListeners:            atomic.LoadUint64(&this.slowListeners),
+		FetchErrors:              atomic.LoadUint64(&this.fetchErrors),
+		FetchTimeouts:            atomic.LoadUint64(&this.fetchTimeouts),
+		Rewatches:                atomic.LoadUint64(&this.rewatches),
+		SkippedInstances:         int(atomic.LoadInt64(&this.skipped)),
+		FilteredInstances:        int(atomic.LoadInt64(&this.filtered)),
+		VersionExcludedInstances: int(atomic.LoadInt64(&this.versionExcluded)),
+		StaleInstances:           int(atomic.LoadInt64(&this.stale)),
+		LastFetchLatency:         time.Duration(atomic.LoadInt64(&this.lastFetchLatency)),
+		MaxFetchLatency:          time.Duration(atomic.LoadInt64(&this.maxFetchLatency)),
+		WatchGeneration:          watchGeneration,
+		LastWatchSet:             lastWatchSet,
+		Unwatched:                unwatched,
+		DispatchDuration:         this.dispatchDuration(),
+	}
+}
@@ -0,0 +1,193 @@
+// Package metrics exports the metrics of a service.Discovery to Prometheus.
+package metrics
+
+import (
+	"github.com/Comcast/golang-discovery-client/service"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// Namespace is the Prometheus namespace of every metric reported by a Collector
+	Namespace = "discovery"
+
+	// ServiceLabel is the label which holds the watched service name
+	ServiceLabel = "service"
+)
+
+// Collector is a prometheus.Collector which reports the Metrics of each service watched
+// by a service.Discovery, along with the time spent throttled across all services.  Values
+// are read from the Discovery each time Prometheus collects, so they always agree with the
+// Discovery's own Metrics.
+type Collector struct {
+	discovery service.Discovery
+
+	instances        *prometheus.Desc
+	filtered         *prometheus.Desc
+	versionExcluded  *prometheus.Desc
+	stale            *prometheus.Desc
+	pending          *prometheus.Desc
+	rewatches        *prometheus.Desc
+	watchGeneration  *prometheus.Desc
+	unwatched        *prometheus.Desc
+	fetchErrors      *prometheus.Desc
+	fetchTimeouts    *prometheus.Desc
+	slowListeners    *prometheus.Desc
+	dispatchDuration *prometheus.Desc
+	throttled        *prometheus.Desc
+}
+
+var _ prometheus.Collector = (*Collector)(nil)
+
+// NewCollector creates a Collector for the given Discovery.  The constLabels, which may be nil,
+// are attached to every metric.  They are necessary to distinguish the Collectors of multiple
+// Discovery instances registered with the same prometheus.Registerer.
+func NewCollector(discovery service.Discovery, constLabels prometheus.Labels) *Collector {
+	variableLabels := []string{ServiceLabel}
+	return &Collector{
+		discovery: discovery,
+		instances: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "", "instances"),
+			"The number of instances in the last-known set of services",
+			variableLabels,
+			constLabels,
+		),
+		filtered: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "", "filtered_instances"),
+			"The number of instances excluded by the instance filter during the last read",
+			variableLabels,
+			constLabels,
+		),
+		versionExcluded: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "", "version_excluded_instances"),
+			"The number of instances excluded by the version constraint during the last read",
+			variableLabels,
+			constLabels,
+		),
+		stale: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "", "stale_instances"),
+			"The number of instances in the last-known set of services which registered longer ago than the stale instance threshold",
+			variableLabels,
+			constLabels,
+		),
+		pending: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "", "pending_initializations"),
+			"The number of base paths whose initial read failed and is being retried in the background",
+			variableLabels,
+			constLabels,
+		),
+		rewatches: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "", "watch_reestablished_total"),
+			"The number of times a watch was re-established after a failed read",
+			variableLabels,
+			constLabels,
+		),
+		watchGeneration: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "", "watch_set_total"),
+			"The number of times a watch was successfully set on the service path",
+			variableLabels,
+			constLabels,
+		),
+		unwatched: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "", "unwatched_seconds"),
+			"How long the service path has been without a watch, which is zero while a watch is set",
+			variableLabels,
+			constLabels,
+		),
+		fetchErrors: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "", "fetch_errors_total"),
+			"The number of reads from zookeeper that failed",
+			variableLabels,
+			constLabels,
+		),
+		fetchTimeouts: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "", "fetch_timeouts_total"),
+			"The number of instances skipped because their data could not be read within the fetch timeout",
+			variableLabels,
+			constLabels,
+		),
+		slowListeners: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "", "slow_listeners_total"),
+			"The number of times a listener did not finish handling an event within the listener timeout",
+			variableLabels,
+			constLabels,
+		),
+		dispatchDuration: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "", "dispatch_duration_seconds"),
+			"The time taken to broadcast services to listeners",
+			variableLabels,
+			constLabels,
+		),
+		throttled: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "", "throttled_seconds_total"),
+			"The time zookeeper operations spent waiting on the read rate limit",
+			nil,
+			constLabels,
+		),
+	}
+}
+
+func (this *Collector) Describe(descriptions chan<- *prometheus.Desc) {
+	descriptions <- this.instances
+	descriptions <- this.filtered
+	descriptions <- this.versionExcluded
+	descriptions <- this.stale
+	descriptions <- this.pending
+	descriptions <- this.rewatches
+	descriptions <- this.watchGeneration
+	descriptions <- this.unwatched
+	descriptions <- this.fetchErrors
+	descriptions <- this.fetchTimeouts
+	descriptions <- this.slowListeners
+	descriptions <- this.dispatchDuration
+	descriptions <- this.throttled
+}
+
+func (this *Collector) Collect(metrics chan<- prometheus.Metric) {
+	for _, serviceName := range this.discovery.ServiceNames() {
+		serviceMetrics, err := this.discovery.Metrics(serviceName)
+		if err != nil {
+			// the service was removed after the names were obtained
+			continue
+		}
+
+		metrics <- prometheus.MustNewConstMetric(this.instances, prometheus.GaugeValue, float64(serviceMetrics.Instances), serviceName)
+		metrics <- prometheus.MustNewConstMetric(this.filtered, prometheus.GaugeValue, float64(serviceMetrics.FilteredInstances), serviceName)
+		metrics <- prometheus.MustNewConstMetric(this.versionExcluded, prometheus.GaugeValue, float64(serviceMetrics.VersionExcludedInstances), serviceName)
+		metrics <- prometheus.MustNewConstMetric(this.stale, prometheus.GaugeValue, float64(serviceMetrics.StaleInstances), serviceName)
+		metrics <- prometheus.MustNewConstMetric(this.pending, prometheus.GaugeValue, float64(serviceMetrics.PendingInitializations), serviceName)
+		metrics <- prometheus.MustNewConstMetric(this.rewatches, prometheus.CounterValue, float64(serviceMetrics.Rewatches), serviceName)
+		metrics <- prometheus.MustNewConstMetric(this.watchGeneration, prometheus.CounterValue, float64(serviceMetrics.WatchGeneration), serviceName)
+		metrics <- prometheus.MustNewConstMetric(this.unwatched, prometheus.GaugeValue, serviceMetrics.Unwatched.Seconds(), serviceName)
+		metrics <- prometheus.MustNewConstMetric(this.fetchErrors, prometheus.CounterValue, float64(serviceMetrics.FetchErrors), serviceName)
+		metrics <- prometheus.MustNewConstMetric(this.fetchTimeouts, prometheus.CounterValue, float64(serviceMetrics.FetchTimeouts), serviceName)
+		metrics <- prometheus.MustNewConstMetric(this.slowListeners, prometheus.CounterValue, float64(serviceMetrics.SlowListeners), serviceName)
+
+		histogram := serviceMetrics.DispatchDuration
+		buckets := make(map[float64]uint64, len(histogram.Bounds))
+		for index, bound := range histogram.Bounds {
+			buckets[bound.Seconds()] = histogram.Counts[index]
+		}
+
+		metrics <- prometheus.MustNewConstHistogram(this.dispatchDuration, histogram.Count, histogram.Sum.Seconds(), buckets, serviceName)
+	}
+
+	metrics <- prometheus.MustNewConstMetric(this.throttled, prometheus.CounterValue, this.discovery.AggregateMetrics().ThrottledTime.Seconds())
+}
+
+// Register creates a Collector for the given Discovery and registers it.  If an equivalent
+// Collector has already been registered, that Collector is returned instead of an error, so
+// registering more than once is harmless.
+func Register(registerer prometheus.Registerer, discovery service.Discovery, constLabels prometheus.Labels) (*Collector, error) {
+	collector := NewCollector(discovery, constLabels)
+	if err := registerer.Register(collector); err != nil {
+		if alreadyRegistered, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			if existing, ok := alreadyRegistered.ExistingCollector.(*Collector); ok {
+				return existing, nil
+			}
+		}
+
+		return nil, err
+	}
+
+	return collector, nil
+}
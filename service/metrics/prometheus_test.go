@@ -0,0 +1,109 @@
+package metrics
+
+import (
+	"github.com/Comcast/golang-discovery-client/service"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/samuel/go-zookeeper/zk"
+	"github.com/stretchr/testify/assert"
+	"sort"
+	"testing"
+)
+
+func newTestDiscovery(t *testing.T, watches ...string) service.Discovery {
+	builder := &service.DiscoveryBuilder{Connection: "localhost:2181", BasePath: "/test", Watches: watches}
+	discovery, err := builder.New(zk.DefaultLogger)
+	if err != nil {
+		t.Fatalf("Unable to create Discovery: %v", err)
+	}
+
+	return discovery
+}
+
+func TestCollector(t *testing.T) {
+	assert := assert.New(t)
+
+	discovery := newTestDiscovery(t, "first", "second")
+	registry := prometheus.NewPedanticRegistry()
+	collector, err := Register(registry, discovery, prometheus.Labels{"client": "test"})
+	if !assert.Nil(err) || !assert.NotNil(collector) {
+		return
+	}
+
+	families, err := registry.Gather()
+	if !assert.Nil(err) {
+		return
+	}
+
+	names := []string{}
+	for _, family := range families {
+		names = append(names, family.GetName())
+		if family.GetName() == "discovery_throttled_seconds_total" {
+			// the rate limit is shared by all services, so there is no service label
+			if assert.Len(family.GetMetric(), 1) {
+				assert.Equal(0.0, family.GetMetric()[0].GetCounter().GetValue())
+			}
+
+			continue
+		}
+
+		if assert.Len(family.GetMetric(), 2) {
+			for _, metric := range family.GetMetric() {
+				labels := make(map[string]string)
+				for _, label := range metric.GetLabel() {
+					labels[label.GetName()] = label.GetValue()
+				}
+
+				assert.Equal("test", labels["client"])
+				assert.Contains([]string{"first", "second"}, labels[ServiceLabel])
+			}
+		}
+	}
+
+	sort.Strings(names)
+	assert.Equal(
+		[]string{
+			"discovery_dispatch_duration_seconds",
+			"discovery_fetch_errors_total",
+			"discovery_fetch_timeouts_total",
+			"discovery_filtered_instances",
+			"discovery_instances",
+			"discovery_pending_initializations",
+			"discovery_slow_listeners_total",
+			"discovery_stale_instances",
+			"discovery_throttled_seconds_total",
+			"discovery_unwatched_seconds",
+			"discovery_version_excluded_instances",
+			"discovery_watch_reestablished_total",
+			"discovery_watch_set_total",
+		},
+		names,
+	)
+
+	histogram := families[0].GetMetric()[0].GetHistogram()
+	if assert.NotNil(histogram) {
+		assert.Len(histogram.GetBucket(), 6)
+		assert.Equal(uint64(0), histogram.GetSampleCount())
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	assert := assert.New(t)
+
+	discovery := newTestDiscovery(t, "first")
+	registry := prometheus.NewRegistry()
+	first, err := Register(registry, discovery, prometheus.Labels{"client": "first"})
+	assert.NotNil(first)
+	assert.Nil(err)
+
+	assert.NotPanics(func() {
+		second, err := Register(registry, discovery, prometheus.Labels{"client": "first"})
+		assert.True(first == second)
+		assert.Nil(err)
+	})
+
+	// collectors for different Discovery instances are distinguished by their constant labels
+	other, err := Register(registry, newTestDiscovery(t, "first"), prometheus.Labels{"client": "other"})
+	assert.NotNil(other)
+	assert.Nil(err)
+	assert.False(first == other)
+}
@@ -0,0 +1,227 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// withoutDispatchDuration clears the histogram from a Metrics, for tests that don't involve dispatching
+func withoutDispatchDuration(metrics Metrics) Metrics {
+	metrics.DispatchDuration = DurationHistogram{}
+	return metrics
+}
+
+func TestWatcherMetricsRecordFetch(t *testing.T) {
+	assert := assert.New(t)
+
+	var testData = []struct {
+		latency  time.Duration
+		err      error
+		expected Metrics
+	}{
+		{
+			latency:  2 * time.Millisecond,
+			expected: Metrics{LastFetchLatency: 2 * time.Millisecond, MaxFetchLatency: 2 * time.Millisecond},
+		},
+		{
+			latency:  5 * time.Millisecond,
+			err:      errors.New("expected"),
+			expected: Metrics{FetchErrors: 1, LastFetchLatency: 5 * time.Millisecond, MaxFetchLatency: 5 * time.Millisecond},
+		},
+		{
+			latency:  time.Millisecond,
+			expected: Metrics{FetchErrors: 1, LastFetchLatency: time.Millisecond, MaxFetchLatency: 5 * time.Millisecond},
+		},
+	}
+
+	metrics := &watcherMetrics{}
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		metrics.recordFetch(record.latency, record.err)
+		assert.Equal(record.expected, withoutDispatchDuration(metrics.snapshot()))
+	}
+}
+
+func TestMetricsAdd(t *testing.T) {
+	assert := assert.New(t)
+
+	var aggregate Metrics
+	aggregate.add(Metrics{Instances: 2, Dispatches: 3, FetchErrors: 1, SkippedInstances: 1, LastFetchLatency: time.Second, MaxFetchLatency: 2 * time.Second})
+	aggregate.add(Metrics{Instances: 1, Dispatches: 4, FilteredInstances: 2, LastFetchLatency: 3 * time.Second, MaxFetchLatency: 3 * time.Second})
+	assert.Equal(
+		Metrics{Instances: 3, Dispatches: 7, FetchErrors: 1, SkippedInstances: 1, FilteredInstances: 2, LastFetchLatency: 3 * time.Second, MaxFetchLatency: 3 * time.Second},
+		aggregate,
+	)
+}
+
+func TestServiceWatcherMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	client := newFakeZookeeperClient()
+	servicePath := testBasePath + "/" + testServiceName
+	client.addInstance(servicePath, newTestInstance("1", "host.com", 8080))
+	client.addInstance(servicePath, newTestInstance("2", "host.com", 8081))
+	client.set(servicePath+"/garbage", []byte("this is not json"))
+
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, watcherOptions{})
+	serviceWatcher, _ := serviceWatcherSet.findByName(testServiceName)
+	serviceWatcher.client = client
+
+	for repeat := 0; repeat < 2; repeat++ {
+		instances, err := serviceWatcher.readServices(context.Background())
+		assert.Nil(err)
+		serviceWatcher.dispatch(instances)
+	}
+
+	metrics := serviceWatcher.metrics.snapshot()
+	assert.Equal(2, metrics.Instances)
+	assert.Equal(uint64(1), metrics.Dispatches)
+	assert.Equal(uint64(0), metrics.FetchErrors)
+	assert.Equal(1, metrics.SkippedInstances)
+	assert.True(metrics.MaxFetchLatency >= metrics.LastFetchLatency)
+
+	client.failNext(fakeWatchChildren, servicePath, errors.New("expected"))
+	_, err := serviceWatcher.readServicesAndWatch(context.Background())
+	assert.NotNil(err)
+	assert.Equal(uint64(1), serviceWatcher.metrics.snapshot().FetchErrors)
+
+	// reads abandoned due to cancellation are not failures
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = serviceWatcher.readServices(cancelled)
+	assert.Equal(context.Canceled, err)
+	assert.Equal(uint64(1), serviceWatcher.metrics.snapshot().FetchErrors)
+}
+
+func TestDiscoveryMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	builder := &DiscoveryBuilder{Connection: testConnection, BasePath: testBasePath, Watches: []string{"first", "second"}}
+	discovery, err := builder.New(&testLogger{t})
+	if !assert.Nil(err) {
+		return
+	}
+
+	metrics, err := discovery.Metrics("first")
+	assert.Equal(Metrics{}, withoutDispatchDuration(metrics))
+	assert.Equal(uint64(0), metrics.DispatchDuration.Count)
+	assert.Nil(err)
+
+	metrics, err = discovery.Metrics("nosuch")
+	assert.Equal(Metrics{}, metrics)
+	assert.Equal(ErrorNoSuchService, err)
+
+	aggregate := discovery.AggregateMetrics()
+	assert.Equal(Metrics{}, withoutDispatchDuration(aggregate))
+	assert.Equal(dispatchDurationBounds[:], aggregate.DispatchDuration.Bounds)
+}
+
+func TestWatcherMetricsRecordDispatch(t *testing.T) {
+	assert := assert.New(t)
+
+	metrics := &watcherMetrics{}
+	for _, duration := range []time.Duration{50 * time.Microsecond, time.Millisecond, 20 * time.Millisecond, time.Minute} {
+		metrics.recordDispatch(duration)
+	}
+
+	histogram := metrics.dispatchDuration()
+	assert.Equal(dispatchDurationBounds[:], histogram.Bounds)
+	assert.Equal([]uint64{1, 2, 2, 3, 3, 3}, histogram.Counts)
+	assert.Equal(uint64(4), histogram.Count)
+	assert.Equal(time.Minute+21*time.Millisecond+50*time.Microsecond, histogram.Sum)
+
+	var aggregate Metrics
+	aggregate.add(Metrics{DispatchDuration: histogram})
+	aggregate.add(Metrics{DispatchDuration: histogram})
+	assert.Equal([]uint64{2, 4, 4, 6, 6, 6}, aggregate.DispatchDuration.Counts)
+	assert.Equal(uint64(8), aggregate.DispatchDuration.Count)
+	assert.Equal(2*histogram.Sum, aggregate.DispatchDuration.Sum)
+
+	// aggregating must not modify the histograms being added
+	assert.Equal([]uint64{1, 2, 2, 3, 3, 3}, histogram.Counts)
+}
+
+func TestWatcherMetricsWatchState(t *testing.T) {
+	assert := assert.New(t)
+
+	metrics := &watcherMetrics{}
+	watchGeneration, lastWatchSet, unwatchedSince := metrics.watchState()
+	assert.Equal(uint64(0), watchGeneration)
+	assert.True(lastWatchSet.IsZero())
+	assert.True(unwatchedSince.IsZero())
+
+	// the earliest loss is kept until a watch is set
+	metrics.recordWatchLost()
+	_, _, unwatchedSince = metrics.watchState()
+	assert.False(unwatchedSince.IsZero())
+	metrics.recordWatchLost()
+	_, _, stillUnwatchedSince := metrics.watchState()
+	assert.Equal(unwatchedSince, stillUnwatchedSince)
+	assert.True(metrics.snapshot().Unwatched > 0)
+
+	for expected := uint64(1); expected <= 2; expected++ {
+		metrics.recordWatchSet()
+		watchGeneration, lastWatchSet, unwatchedSince = metrics.watchState()
+		assert.Equal(expected, watchGeneration)
+		assert.False(lastWatchSet.IsZero())
+		assert.True(unwatchedSince.IsZero())
+
+		snapshot := metrics.snapshot()
+		assert.Equal(expected, snapshot.WatchGeneration)
+		assert.Equal(lastWatchSet, snapshot.LastWatchSet)
+		assert.Equal(time.Duration(0), snapshot.Unwatched)
+	}
+}
+
+func TestMetricsAddWatchState(t *testing.T) {
+	assert := assert.New(t)
+
+	earlier := time.Date(2017, time.July, 14, 2, 40, 0, 0, time.UTC)
+	later := earlier.Add(time.Minute)
+
+	var aggregate Metrics
+	aggregate.add(Metrics{WatchGeneration: 2, LastWatchSet: later})
+	aggregate.add(Metrics{})
+	aggregate.add(Metrics{WatchGeneration: 3, LastWatchSet: earlier, Unwatched: time.Second})
+	aggregate.add(Metrics{WatchGeneration: 1, LastWatchSet: later, Unwatched: time.Millisecond})
+	assert.Equal(Metrics{WatchGeneration: 6, LastWatchSet: earlier, Unwatched: time.Second}, aggregate)
+}
+
+func TestServiceWatcherWatchGeneration(t *testing.T) {
+	assert := assert.New(t)
+
+	client := newFakeZookeeperClient()
+	servicePath := testBasePath + "/" + testServiceName
+	client.addInstance(servicePath, newTestInstance("1", "host.com", 8080))
+
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, watcherOptions{debounceWindow: time.Hour})
+	defer serviceWatcherSet.stop()
+	serviceWatcher, _ := serviceWatcherSet.findByName(testServiceName)
+	serviceWatcher.client = client
+
+	_, err := serviceWatcher.readServicesAndWatch(context.Background())
+	assert.Nil(err)
+	assert.Equal(uint64(1), serviceWatcher.metrics.snapshot().WatchGeneration)
+
+	// with a debounce window, the watch is set again as soon as it fires
+	serviceWatcher.childrenChanged()
+	metrics := serviceWatcher.metrics.snapshot()
+	assert.Equal(uint64(2), metrics.WatchGeneration)
+	assert.Equal(time.Duration(0), metrics.Unwatched)
+
+	client.failNext(fakeWatchChildren, servicePath, errors.New("expected"))
+	_, err = serviceWatcher.readServicesAndWatch(context.Background())
+	assert.NotNil(err)
+	metrics = serviceWatcher.metrics.snapshot()
+	assert.Equal(uint64(2), metrics.WatchGeneration)
+	assert.True(metrics.Unwatched > 0)
+
+	serviceStatus := serviceWatcher.serviceStatus()
+	assert.Equal(uint64(2), serviceStatus.WatchGeneration)
+	if assert.NotNil(serviceStatus.LastWatchSet) && assert.NotNil(serviceStatus.UnwatchedSince) {
+		assert.False(serviceStatus.UnwatchedSince.Before(*serviceStatus.LastWatchSet))
+	}
+}
@@ -0,0 +1,214 @@
+package service
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// ListenerMiddleware decorates a Listener, returning a Listener which typically does something
+// before or after delegating each event to the given Listener, e.g. logging or filtering.  A
+// middleware must not return nil.  See ChainListenerMiddleware for composing middlewares, and the
+// DiscoveryBuilder's ListenerMiddleware for applying them to every registered listener.
+type ListenerMiddleware func(Listener) Listener
+
+// ChainListenerMiddleware composes the given middlewares into one.  The first middleware is the
+// outermost, so it sees each event first and the listener sees it last.  Nil middlewares are ignored.
+func ChainListenerMiddleware(middlewares ...ListenerMiddleware) ListenerMiddleware {
+	return func(listener Listener) Listener {
+		return ApplyListenerMiddleware(listener, middlewares...)
+	}
+}
+
+// ApplyListenerMiddleware decorates a listener with the given middlewares, of which the first is the
+// outermost.  Since the result is a new Listener, it is the result which must be passed to
+// RemoveListener, rather than the original listener.
+func ApplyListenerMiddleware(listener Listener, middlewares ...ListenerMiddleware) Listener {
+	for index := len(middlewares) - 1; index >= 0; index-- {
+		if middlewares[index] != nil {
+			listener = middlewares[index](listener)
+		}
+	}
+
+	return listener
+}
+
+// middlewareListener is the InstancesListener produced by the middlewares in this package.  Each
+// event is passed to handle, which is responsible for delegating to the next listener.
+type middlewareListener struct {
+	name   string
+	next   Listener
+	handle func(serviceName string, event InstanceEvent)
+}
+
+var _ InstancesListener = (*middlewareListener)(nil)
+
+func (this *middlewareListener) ServicesChanged(serviceName string, instances Instances) {
+	this.InstancesChanged(serviceName, InstanceEvent{Current: instances})
+}
+
+func (this *middlewareListener) InstancesChanged(serviceName string, event InstanceEvent) {
+	this.handle(serviceName, event)
+}
+
+// String labels this listener in log messages by the middleware and the listener it decorates
+func (this *middlewareListener) String() string {
+	return this.name + "(" + listenerLabel(this.next) + ")"
+}
+
+// LoggingMiddleware returns a ListenerMiddleware which logs each event handled by a listener,
+// with the name of the service, the counts of current, added, removed, and updated instances,
+// and the time the listener took.
+func LoggingMiddleware(logger Logger) ListenerMiddleware {
+	return func(next Listener) Listener {
+		listener := &middlewareListener{name: "logging", next: next}
+		listener.handle = func(serviceName string, event InstanceEvent) {
+			start := time.Now()
+			notifyListener(next, serviceName, event)
+			logger.Info(
+				"Listener %s handled [%s] services in %s [sequence=%d, instances=%d, added=%d, removed=%d, updated=%d]",
+				listenerLabel(next), serviceName, time.Since(start),
+				event.Sequence, len(event.Current), len(event.Added), len(event.Removed), len(event.Updated),
+			)
+		}
+
+		return listener
+	}
+}
+
+// FilterMiddleware returns a ListenerMiddleware which removes the ServiceInstances rejected by the
+// given filter from each event before the listener sees it.  The Current, Added, Removed, Updated,
+// Stale, and Annotated instances are all filtered, so that they remain consistent.  An event is
+// still delivered when the filter removes every change it describes.
+func FilterMiddleware(filter InstanceFilter) ListenerMiddleware {
+	return func(next Listener) Listener {
+		if filter == nil {
+			return next
+		}
+
+		listener := &middlewareListener{name: "filter", next: next}
+		listener.handle = func(serviceName string, event InstanceEvent) {
+			notifyListener(next, serviceName, filterEvent(event, filter))
+		}
+
+		return listener
+	}
+}
+
+// filterEvent returns a copy of the given event containing only the instances accepted by the filter
+func filterEvent(event InstanceEvent, filter InstanceFilter) InstanceEvent {
+	filtered := event
+	filtered.Current = event.Current.Filter(filter)
+	filtered.Added = filterInstances(event.Added, filter)
+	filtered.Removed = filterInstances(event.Removed, filter)
+	filtered.Updated = filterInstances(event.Updated, filter)
+	filtered.Stale = filterInstances(event.Stale, filter)
+	if event.Annotated != nil {
+		filtered.Annotated = make(AnnotatedInstances, 0, len(event.Annotated))
+		for _, annotated := range event.Annotated {
+			if filter(annotated.Instance) {
+				filtered.Annotated = append(filtered.Annotated, annotated)
+			}
+		}
+	}
+
+	return filtered
+}
+
+// filterInstances is like Instances.Filter, except that nil Instances remain nil
+func filterInstances(instances Instances, filter InstanceFilter) Instances {
+	if instances == nil {
+		return nil
+	}
+
+	return instances.Filter(filter)
+}
+
+// ListenerMetrics accumulates the events observed by MetricsMiddleware, by service name.  A single
+// ListenerMetrics may be shared by the middleware of many listeners, and is safe for concurrent use.
+type ListenerMetrics struct {
+	mutex    sync.Mutex
+	services map[string]*ListenerStats
+}
+
+// ListenerStats is a snapshot of the events handled by listeners for a single service
+type ListenerStats struct {
+	// Events is the number of events handled
+	Events uint64
+
+	// Added, Removed, and Updated are the total numbers of instances in each kind of change
+	Added   uint64
+	Removed uint64
+	Updated uint64
+
+	// Instances is the number of current instances in the most recent event
+	Instances int
+
+	// Duration is the distribution of the time taken to handle each event
+	Duration DurationHistogram
+}
+
+// NewListenerMetrics creates an empty ListenerMetrics
+func NewListenerMetrics() *ListenerMetrics {
+	return &ListenerMetrics{services: make(map[string]*ListenerStats)}
+}
+
+// MetricsMiddleware returns a ListenerMiddleware which records each event handled by a listener,
+// along with the time the listener took, in the given ListenerMetrics
+func MetricsMiddleware(metrics *ListenerMetrics) ListenerMiddleware {
+	return func(next Listener) Listener {
+		listener := &middlewareListener{name: "metrics", next: next}
+		listener.handle = func(serviceName string, event InstanceEvent) {
+			start := time.Now()
+			notifyListener(next, serviceName, event)
+			metrics.record(serviceName, event, time.Since(start))
+		}
+
+		return listener
+	}
+}
+
+// record accumulates a handled event
+func (this *ListenerMetrics) record(serviceName string, event InstanceEvent, duration time.Duration) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	stats, ok := this.services[serviceName]
+	if !ok {
+		stats = &ListenerStats{Duration: newDispatchDurationHistogram()}
+		this.services[serviceName] = stats
+	}
+
+	stats.Events++
+	stats.Added += uint64(len(event.Added))
+	stats.Removed += uint64(len(event.Removed))
+	stats.Updated += uint64(len(event.Updated))
+	stats.Instances = len(event.Current)
+	stats.Duration.observe(duration)
+}
+
+// ServiceNames returns the sorted names of the services for which events have been recorded
+func (this *ListenerMetrics) ServiceNames() []string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	serviceNames := make([]string, 0, len(this.services))
+	for serviceName := range this.services {
+		serviceNames = append(serviceNames, serviceName)
+	}
+
+	sort.Strings(serviceNames)
+	return serviceNames
+}
+
+// Stats returns a snapshot of the events recorded for the given service, and false if there are none
+func (this *ListenerMetrics) Stats(serviceName string) (ListenerStats, bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	stats, ok := this.services[serviceName]
+	if !ok {
+		return ListenerStats{}, false
+	}
+
+	snapshot := *stats
+	snapshot.Duration.Counts = append([]uint64(nil), stats.Duration.Counts...)
+	return snapshot, true
+}
@@ -0,0 +1,195 @@
+package service
+
+import (
+	"github.com/foursquare/fsgo/net/discovery"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tracingMiddleware returns a middleware which appends its name to the trace as each event passes
+func tracingMiddleware(name string, trace *[]string) ListenerMiddleware {
+	return func(next Listener) Listener {
+		return InstancesListenerFunc(func(serviceName string, event InstanceEvent) {
+			*trace = append(*trace, name)
+			notifyListener(next, serviceName, event)
+		})
+	}
+}
+
+func TestChainListenerMiddleware(t *testing.T) {
+	assert := assert.New(t)
+
+	var trace []string
+	listener := ListenerFunc(func(serviceName string, instances Instances) {
+		trace = append(trace, "listener")
+	})
+
+	chain := ChainListenerMiddleware(tracingMiddleware("first", &trace), nil, tracingMiddleware("second", &trace))
+	chain(listener).ServicesChanged(testServiceName, Instances{})
+	assert.Equal([]string{"first", "second", "listener"}, trace)
+
+	// chains compose with other middlewares
+	trace = nil
+	ApplyListenerMiddleware(listener, tracingMiddleware("outer", &trace), chain).ServicesChanged(testServiceName, Instances{})
+	assert.Equal([]string{"outer", "first", "second", "listener"}, trace)
+
+	// without middleware, the listener is unchanged
+	plain := &ChannelListener{}
+	assert.True(plain == ApplyListenerMiddleware(plain))
+	assert.True(plain == ChainListenerMiddleware()(plain))
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+	assert := assert.New(t)
+
+	recorder := &recordingLogger{}
+	var received InstanceEvent
+	listener := LoggingMiddleware(NewZkLogger(recorder))(InstancesListenerFunc(func(serviceName string, event InstanceEvent) {
+		received = event
+	}))
+
+	event := InstanceEvent{
+		Added:    testInstancesWithIds("2"),
+		Removed:  testInstancesWithIds("3", "4"),
+		Current:  testInstancesWithIds("1", "2"),
+		Sequence: 5,
+	}
+
+	listener.(InstancesListener).InstancesChanged(testServiceName, event)
+	assert.Equal(event, received)
+	if assert.Len(recorder.messages, 1) {
+		message := recorder.messages[0]
+		assert.Contains(message, "[INFO]")
+		assert.Contains(message, "["+testServiceName+"]")
+		assert.Contains(message, "sequence=5, instances=2, added=1, removed=2, updated=0")
+	}
+
+	assert.True(strings.HasPrefix(listenerLabel(listener), "logging("))
+}
+
+func TestFilterMiddleware(t *testing.T) {
+	assert := assert.New(t)
+
+	instances := testInstancesWithIds("1", "2", "3")
+	even := func(serviceInstance *discovery.ServiceInstance) bool {
+		return *serviceInstance.Port%2 == 0
+	}
+
+	var received InstanceEvent
+	listener := FilterMiddleware(even)(InstancesListenerFunc(func(serviceName string, event InstanceEvent) {
+		received = event
+	}))
+
+	listener.(InstancesListener).InstancesChanged(testServiceName, InstanceEvent{
+		Added:     instances[1:],
+		Current:   instances,
+		Annotated: NewAnnotatedInstances(instances),
+		Sequence:  7,
+	})
+
+	// ports are 1234, 1235, and 1236
+	assert.Equal([]string{"1", "3"}, instanceIds(received.Current))
+	assert.Equal([]string{"3"}, instanceIds(received.Added))
+	assert.Nil(received.Removed)
+	assert.Nil(received.Updated)
+	if assert.Len(received.Annotated, 2) {
+		assert.Equal("1", received.Annotated[0].ChildId)
+		assert.Equal("3", received.Annotated[1].ChildId)
+	}
+
+	assert.Equal(uint64(7), received.Sequence)
+
+	// plain listeners receive the filtered instances
+	var current Instances
+	FilterMiddleware(even)(ListenerFunc(func(serviceName string, instances Instances) {
+		current = instances
+	})).ServicesChanged(testServiceName, instances)
+	assert.Equal([]string{"1", "3"}, instanceIds(current))
+
+	plain := &ChannelListener{}
+	assert.True(plain == FilterMiddleware(nil)(plain))
+}
+
+func TestMetricsMiddleware(t *testing.T) {
+	assert := assert.New(t)
+
+	metrics := NewListenerMetrics()
+	listener := MetricsMiddleware(metrics)(ListenerFunc(func(serviceName string, instances Instances) {
+		if serviceName == "slow" {
+			time.Sleep(2 * time.Millisecond)
+		}
+	})).(InstancesListener)
+
+	_, ok := metrics.Stats("foo")
+	assert.False(ok)
+
+	listener.InstancesChanged("foo", InstanceEvent{Added: testInstancesWithIds("1", "2"), Current: testInstancesWithIds("1", "2")})
+	listener.InstancesChanged("foo", InstanceEvent{Removed: testInstancesWithIds("1"), Updated: testInstancesWithIds("2"), Current: testInstancesWithIds("2")})
+	listener.InstancesChanged("slow", InstanceEvent{Current: Instances{}})
+
+	assert.Equal([]string{"foo", "slow"}, metrics.ServiceNames())
+	stats, ok := metrics.Stats("foo")
+	assert.True(ok)
+	assert.Equal(uint64(2), stats.Events)
+	assert.Equal(uint64(2), stats.Added)
+	assert.Equal(uint64(1), stats.Removed)
+	assert.Equal(uint64(1), stats.Updated)
+	assert.Equal(1, stats.Instances)
+	assert.Equal(uint64(2), stats.Duration.Count)
+	assert.Len(stats.Duration.Counts, len(dispatchDurationBounds))
+
+	stats, _ = metrics.Stats("slow")
+	assert.Equal(uint64(1), stats.Duration.Count)
+	assert.True(stats.Duration.Sum >= 2*time.Millisecond)
+	assert.Equal(uint64(0), stats.Duration.Counts[1])
+	assert.Equal(uint64(1), stats.Duration.Counts[len(stats.Duration.Counts)-1])
+
+	// the snapshot is a copy
+	stats.Duration.Counts[0] = 100
+	stats, _ = metrics.Stats("slow")
+	assert.Equal(uint64(0), stats.Duration.Counts[0])
+}
+
+func TestListenerMiddlewareOption(t *testing.T) {
+	assert := assert.New(t)
+
+	builder := &DiscoveryBuilder{ListenerMiddleware: []ListenerMiddleware{FilterMiddleware(func(serviceInstance *discovery.ServiceInstance) bool {
+		return serviceInstance.Id != "2"
+	})}}
+
+	options, err := builder.dispatchOptions()
+	if !assert.Nil(err) {
+		return
+	}
+
+	serviceWatcher := &serviceWatcher{
+		serviceName:     testServiceName,
+		logger:          &testLogger{t},
+		dispatchOptions: options,
+	}
+
+	var received []Instances
+	listenerFunc := ListenerFunc(func(serviceName string, instances Instances) {
+		received = append(received, instances)
+	})
+
+	listener := &listenerFunc
+
+	_, err = serviceWatcher.addListener(listener)
+	assert.Nil(err)
+	serviceWatcher.dispatch(testInstancesWithIds("1", "2"))
+
+	// the listener as registered still identifies it
+	registration, err := serviceWatcher.addListener(listener)
+	assert.Nil(err)
+	assert.Len(serviceWatcher.listeners, 1)
+	assert.True(strings.HasPrefix(listenerLabel(registration.(*listenerRegistration).entry.handler), "filter("))
+	assert.True(serviceWatcher.removeListener(listener))
+	serviceWatcher.dispatch(testInstancesWithIds("3"))
+
+	if assert.Len(received, 1) {
+		assert.Equal([]string{"1"}, instanceIds(received[0]))
+	}
+}
@@ -0,0 +1,120 @@
+// Package oteltrace records the reads and dispatches of a service.Discovery as OpenTelemetry
+// spans.  It is a separate package so that only applications which use OpenTelemetry depend on it.
+//
+//	builder.Tracer = oteltrace.NewTracer(tracerProvider)
+package oteltrace
+
+import (
+	"context"
+	"github.com/Comcast/golang-discovery-client/service"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+)
+
+const (
+	// InstrumentationName identifies the spans created by a Tracer
+	InstrumentationName = "github.com/Comcast/golang-discovery-client/service"
+
+	// ReadSpanName is the name of the span for a read of a service's children
+	ReadSpanName = "discovery.readServices"
+
+	// ReadAndWatchSpanName is the name of the span for a read of a service's children which
+	// also sets a watch
+	ReadAndWatchSpanName = "discovery.readServicesAndWatch"
+
+	// DispatchSpanName is the name of the span for the delivery of an event to a listener
+	DispatchSpanName = "discovery.dispatch"
+)
+
+const (
+	// ServiceNameKey is the attribute which holds the name of the service
+	ServiceNameKey = attribute.Key("discovery.service.name")
+
+	// ServicePathKey is the attribute which holds the zookeeper path of the service
+	ServicePathKey = attribute.Key("discovery.service.path")
+
+	// ChildCountKey is the attribute which holds the number of children read
+	ChildCountKey = attribute.Key("discovery.children")
+
+	// InstanceCountKey is the attribute which holds the number of instances the children yielded
+	InstanceCountKey = attribute.Key("discovery.instances")
+
+	// ListenerKey is the attribute which holds the label of a listener
+	ListenerKey = attribute.Key("discovery.listener")
+
+	// SequenceKey is the attribute which holds the sequence of a dispatched event
+	SequenceKey = attribute.Key("discovery.sequence")
+
+	// DurationKey is the attribute which holds how long a listener took, in seconds
+	DurationKey = attribute.Key("discovery.duration")
+)
+
+// Tracer is a service.Tracer which creates OpenTelemetry spans
+type Tracer struct {
+	tracer trace.Tracer
+}
+
+var _ service.Tracer = (*Tracer)(nil)
+
+// NewTracer creates a Tracer whose spans are created by the given TracerProvider.  If the
+// TracerProvider is nil, the global TracerProvider is used.
+func NewTracer(provider trace.TracerProvider) *Tracer {
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+
+	return &Tracer{
+		tracer: provider.Tracer(InstrumentationName),
+	}
+}
+
+// StartRead starts a client span for a read, which ends with the number of children and instances
+// read.  A failed read sets the span's status to an error.
+func (this *Tracer) StartRead(ctx context.Context, serviceName, servicePath string, watch bool) (context.Context, func(children, instances int, err error)) {
+	spanName := ReadSpanName
+	if watch {
+		spanName = ReadAndWatchSpanName
+	}
+
+	ctx, span := this.tracer.Start(
+		ctx,
+		spanName,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(ServiceNameKey.String(serviceName), ServicePathKey.String(servicePath)),
+	)
+
+	return ctx, func(children, instances int, err error) {
+		span.SetAttributes(ChildCountKey.Int(children), InstanceCountKey.Int(instances))
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+
+		span.End()
+	}
+}
+
+// StartDispatch starts an internal span for the delivery of an event to a listener, which ends
+// with how long the listener took
+func (this *Tracer) StartDispatch(serviceName, listener string, sequence uint64) func() {
+	start := time.Now()
+	_, span := this.tracer.Start(
+		context.Background(),
+		DispatchSpanName,
+		trace.WithTimestamp(start),
+		trace.WithAttributes(
+			ServiceNameKey.String(serviceName),
+			ListenerKey.String(listener),
+			SequenceKey.Int64(int64(sequence)),
+		),
+	)
+
+	return func() {
+		end := time.Now()
+		span.SetAttributes(DurationKey.Float64(end.Sub(start).Seconds()))
+		span.End(trace.WithTimestamp(end))
+	}
+}
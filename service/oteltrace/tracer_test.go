@@ -0,0 +1,88 @@
+package oteltrace
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"testing"
+)
+
+// newRecordedTracer creates a Tracer whose ended spans are recorded
+func newRecordedTracer() (*Tracer, *tracetest.SpanRecorder) {
+	recorder := tracetest.NewSpanRecorder()
+	return NewTracer(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))), recorder
+}
+
+// attributes collects the attributes of a span by key
+func attributes(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	values := make(map[attribute.Key]attribute.Value)
+	for _, keyValue := range span.Attributes() {
+		values[keyValue.Key] = keyValue.Value
+	}
+
+	return values
+}
+
+func TestStartRead(t *testing.T) {
+	var testData = []struct {
+		watch          bool
+		err            error
+		expectedName   string
+		expectedStatus codes.Code
+	}{
+		{false, nil, ReadSpanName, codes.Unset},
+		{true, nil, ReadAndWatchSpanName, codes.Unset},
+		{true, errors.New("expected"), ReadAndWatchSpanName, codes.Error},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+		tracer, recorder := newRecordedTracer()
+
+		ctx, end := tracer.StartRead(context.Background(), "foo", "/base/foo", record.watch)
+		assert.True(trace.SpanContextFromContext(ctx).IsValid())
+		assert.Empty(recorder.Ended())
+		end(3, 2, record.err)
+
+		spans := recorder.Ended()
+		if assert.Len(spans, 1) {
+			span := spans[0]
+			assert.Equal(record.expectedName, span.Name())
+			assert.Equal(trace.SpanKindClient, span.SpanKind())
+			assert.Equal(record.expectedStatus, span.Status().Code)
+
+			values := attributes(span)
+			assert.Equal("foo", values[ServiceNameKey].AsString())
+			assert.Equal("/base/foo", values[ServicePathKey].AsString())
+			assert.Equal(int64(3), values[ChildCountKey].AsInt64())
+			assert.Equal(int64(2), values[InstanceCountKey].AsInt64())
+		}
+	}
+}
+
+func TestStartDispatch(t *testing.T) {
+	assert := assert.New(t)
+	tracer, recorder := newRecordedTracer()
+
+	end := tracer.StartDispatch("foo", "listener", 7)
+	assert.Empty(recorder.Ended())
+	end()
+
+	spans := recorder.Ended()
+	if assert.Len(spans, 1) {
+		span := spans[0]
+		assert.Equal(DispatchSpanName, span.Name())
+
+		values := attributes(span)
+		assert.Equal("foo", values[ServiceNameKey].AsString())
+		assert.Equal("listener", values[ListenerKey].AsString())
+		assert.Equal(int64(7), values[SequenceKey].AsInt64())
+		assert.Equal(span.EndTime().Sub(span.StartTime()).Seconds(), values[DurationKey].AsFloat64())
+	}
+}
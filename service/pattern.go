@@ -0,0 +1,173 @@
+package service
+
+import (
+	"path"
+	"sync"
+)
+
+// patternListener is a Listener registered for every service whose name matches a glob
+// pattern, including services added after the listener
+type patternListener struct {
+	group    string
+	pattern  string
+	listener Listener
+	set      *serviceWatcherSet
+
+	mutex         sync.Mutex
+	cancelled     bool
+	registrations map[*serviceWatcher]Registration
+}
+
+var _ Registration = (*patternListener)(nil)
+
+// matches tests whether this listener's pattern matches the given service name.  The
+// pattern is validated when this listener is created, so errors are not possible here.
+func (this *patternListener) matches(serviceName string) bool {
+	matched, _ := path.Match(this.pattern, serviceName)
+	return matched
+}
+
+// attach adds this listener to the given watcher.  Listener callbacks can occur during
+// attach, so no locks are held while the listener is added.  If the same listener is already
+// registered with the watcher in this group, e.g. directly via AddGroupListener, that
+// registration is left in charge, and this listener does not attach to the watcher.
+func (this *patternListener) attach(serviceWatcher *serviceWatcher) {
+	registration, duplicate := serviceWatcher.addEntry(this.group, this.listener, false)
+	if duplicate {
+		serviceWatcher.logger.Debug("Listener %s is already registered for [%s]", listenerLabel(this.listener), serviceWatcher.serviceName)
+		return
+	}
+
+	this.mutex.Lock()
+	if this.cancelled {
+		this.mutex.Unlock()
+		registration.Cancel()
+		return
+	}
+
+	this.registrations[serviceWatcher] = registration
+	this.mutex.Unlock()
+}
+
+// detach forgets the registration for a watcher that has been removed from the set
+func (this *patternListener) detach(serviceWatcher *serviceWatcher) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	delete(this.registrations, serviceWatcher)
+}
+
+// Cancel removes this listener from every watcher to which it was attached, and prevents
+// it from being attached to services added afterward.  This method is idempotent.
+func (this *patternListener) Cancel() {
+	this.mutex.Lock()
+	if this.cancelled {
+		this.mutex.Unlock()
+		return
+	}
+
+	this.cancelled = true
+	registrations := this.registrations
+	this.registrations = nil
+	this.mutex.Unlock()
+
+	this.set.removePatternListener(this)
+	for _, registration := range registrations {
+		registration.Cancel()
+	}
+}
+
+// addPatternListener registers a listener in the given group for every service in this set whose
+// name matches the given glob pattern, as defined by path.Match, and for every matching service
+// added afterward.  An invalid pattern results in path.ErrBadPattern.  If the same listener is
+// already registered with the same group and pattern, the existing Registration is returned, or
+// ErrorAlreadyRegistered if duplicates are rejected.
+func (this *serviceWatcherSet) addPatternListener(group, pattern string, listener Listener) (Registration, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+
+	patternListener := &patternListener{
+		group:         group,
+		pattern:       pattern,
+		listener:      listener,
+		set:           this,
+		registrations: make(map[*serviceWatcher]Registration),
+	}
+
+	// the existing watchers are captured under the same lock that makes the pattern
+	// visible to add, so that each service is attached exactly once
+	this.mutex.Lock()
+	for _, candidate := range this.patternListeners {
+		if candidate.group == group && candidate.pattern == pattern && sameListener(candidate.listener, listener) {
+			this.mutex.Unlock()
+			if this.options.dispatch.rejectDuplicates {
+				return nil, ErrorAlreadyRegistered
+			}
+
+			return candidate, nil
+		}
+	}
+
+	this.patternListeners = append(this.patternListeners, patternListener)
+	var matching []*serviceWatcher
+	for serviceName, serviceWatcher := range this.byName {
+		if patternListener.matches(serviceName) {
+			matching = append(matching, serviceWatcher)
+		}
+	}
+
+	this.mutex.Unlock()
+
+	for _, serviceWatcher := range matching {
+		patternListener.attach(serviceWatcher)
+	}
+
+	return patternListener, nil
+}
+
+// removePatternListener removes a pattern listener so that it is not attached to services added later
+func (this *serviceWatcherSet) removePatternListener(patternListener *patternListener) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for index, candidate := range this.patternListeners {
+		if candidate == patternListener {
+			this.patternListeners = append(this.patternListeners[:index:index], this.patternListeners[index+1:]...)
+			return
+		}
+	}
+}
+
+// closeGroup removes every listener in the given group from every watcher in this set.  The
+// group's pattern listeners are cancelled first, so that they are not attached to services
+// added afterward.
+func (this *serviceWatcherSet) closeGroup(group string) {
+	this.mutex.Lock()
+	var patternListeners []*patternListener
+	for _, patternListener := range this.patternListeners {
+		if patternListener.group == group {
+			patternListeners = append(patternListeners, patternListener)
+		}
+	}
+
+	this.mutex.Unlock()
+	for _, patternListener := range patternListeners {
+		patternListener.Cancel()
+	}
+
+	for _, serviceWatcher := range this.watchers() {
+		serviceWatcher.removeGroupListeners(group)
+	}
+}
+
+// matchingPatternListeners returns the pattern listeners whose patterns match the given
+// service name.  Callers must hold the mutex.
+func (this *serviceWatcherSet) matchingPatternListeners(serviceName string) []*patternListener {
+	var matching []*patternListener
+	for _, patternListener := range this.patternListeners {
+		if patternListener.matches(serviceName) {
+			matching = append(matching, patternListener)
+		}
+	}
+
+	return matching
+}
@@ -0,0 +1,197 @@
+package service
+
+import (
+	"github.com/stretchr/testify/assert"
+	"path"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// serviceNameRecorder is a Listener which records the name of each service it is notified about
+type serviceNameRecorder struct {
+	mutex        sync.Mutex
+	serviceNames []string
+}
+
+func (this *serviceNameRecorder) ServicesChanged(serviceName string, instances Instances) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.serviceNames = append(this.serviceNames, serviceName)
+}
+
+// take returns the recorded service names in sorted order, then clears them
+func (this *serviceNameRecorder) take() []string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	serviceNames := this.serviceNames
+	this.serviceNames = nil
+	sort.Strings(serviceNames)
+	return serviceNames
+}
+
+func dispatchToAll(serviceWatcherSet *serviceWatcherSet, id string) {
+	for _, serviceWatcher := range serviceWatcherSet.watchers() {
+		serviceWatcher.dispatch(testInstancesWithIds(id))
+	}
+}
+
+func TestAddPatternListener(t *testing.T) {
+	assert := assert.New(t)
+
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{"user-api", "user-db", "billing"}, []string{testBasePath}, watcherOptions{})
+	defer serviceWatcherSet.stop()
+
+	// services that have already been read are replayed to a new listener
+	userApi, _ := serviceWatcherSet.findByName("user-api")
+	userApi.dispatch(testInstancesWithIds("initial"))
+
+	users := &serviceNameRecorder{}
+	usersRegistration, err := serviceWatcherSet.addPatternListener(DefaultListenerGroup, "user-*", users)
+	assert.Nil(err)
+	assert.Equal([]string{"user-api"}, users.take())
+
+	everything := &serviceNameRecorder{}
+	everythingRegistration, err := serviceWatcherSet.addPatternListener(DefaultListenerGroup, "*", everything)
+	assert.Nil(err)
+	assert.Equal([]string{"user-api"}, everything.take())
+
+	dispatchToAll(serviceWatcherSet, "first")
+	assert.Equal([]string{"user-api", "user-db"}, users.take())
+	assert.Equal([]string{"billing", "user-api", "user-db"}, everything.take())
+
+	// services added later are matched as well
+	_, added, err := serviceWatcherSet.add("user-web")
+	assert.True(added)
+	assert.Nil(err)
+	_, added, err = serviceWatcherSet.add("inventory")
+	assert.True(added)
+	assert.Nil(err)
+	dispatchToAll(serviceWatcherSet, "second")
+	assert.Equal([]string{"user-api", "user-db", "user-web"}, users.take())
+	assert.Equal([]string{"billing", "inventory", "user-api", "user-db", "user-web"}, everything.take())
+
+	// removed services are detached
+	serviceWatcherSet.remove("user-db")
+	assert.Len(usersRegistration.(*patternListener).registrations, 2)
+	assert.Len(everythingRegistration.(*patternListener).registrations, 4)
+
+	// cancelling detaches the listener from every service, including those added later
+	usersRegistration.Cancel()
+	usersRegistration.Cancel()
+	_, added, err = serviceWatcherSet.add("user-admin")
+	assert.True(added)
+	assert.Nil(err)
+	dispatchToAll(serviceWatcherSet, "third")
+	assert.Empty(users.take())
+	assert.Equal([]string{"billing", "inventory", "user-admin", "user-api", "user-web"}, everything.take())
+	assert.Len(serviceWatcherSet.patternListeners, 1)
+
+	everythingRegistration.Cancel()
+	dispatchToAll(serviceWatcherSet, "fourth")
+	assert.Empty(everything.take())
+	assert.Empty(serviceWatcherSet.patternListeners)
+}
+
+func TestAddPatternListenerBadPattern(t *testing.T) {
+	assert := assert.New(t)
+
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, watcherOptions{})
+	registration, err := serviceWatcherSet.addPatternListener(DefaultListenerGroup, "[", &serviceNameRecorder{})
+	assert.Nil(registration)
+	assert.Equal(path.ErrBadPattern, err)
+	assert.Empty(serviceWatcherSet.patternListeners)
+}
+
+func TestDuplicatePatternListener(t *testing.T) {
+	for _, rejectDuplicates := range []bool{false, true} {
+		t.Logf("rejectDuplicates: %t", rejectDuplicates)
+		assert := assert.New(t)
+
+		options := watcherOptions{dispatch: dispatchOptions{rejectDuplicates: rejectDuplicates}}
+		serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{"first", "second"}, []string{testBasePath}, options)
+		listener := &serviceNameRecorder{}
+		registration, err := serviceWatcherSet.addPatternListener(DefaultListenerGroup, "*", listener)
+		assert.Nil(err)
+
+		duplicate, err := serviceWatcherSet.addPatternListener(DefaultListenerGroup, "*", listener)
+		if rejectDuplicates {
+			assert.Nil(duplicate)
+			assert.Equal(ErrorAlreadyRegistered, err)
+		} else {
+			assert.Equal(registration, duplicate)
+			assert.Nil(err)
+		}
+
+		// a different pattern is a different registration, but is not attached twice to the same service
+		_, err = serviceWatcherSet.addPatternListener(DefaultListenerGroup, "f*", listener)
+		assert.Nil(err)
+		assert.Len(serviceWatcherSet.patternListeners, 2)
+
+		dispatchToAll(serviceWatcherSet, "1")
+		assert.Equal([]string{"first", "second"}, listener.take())
+		serviceWatcherSet.stop()
+	}
+}
+
+func TestListenerGroups(t *testing.T) {
+	assert := assert.New(t)
+
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{"first", "second"}, []string{testBasePath}, watcherOptions{})
+	defer serviceWatcherSet.stop()
+	first, _ := serviceWatcherSet.findByName("first")
+	second, _ := serviceWatcherSet.findByName("second")
+
+	// the same listener is registered by the default group and by two libraries
+	shared := &serviceNameRecorder{}
+	first.addListener(shared)
+	first.addGroupListener("library-a", shared)
+	first.addGroupListener("library-b", shared)
+
+	// the pattern does not register libraryA with second again, since it is already registered there
+	libraryA := &serviceNameRecorder{}
+	second.addGroupListener("library-a", libraryA)
+	_, err := serviceWatcherSet.addPatternListener("library-a", "*", libraryA)
+	assert.Nil(err)
+
+	libraryB := &serviceNameRecorder{}
+	second.addGroupListener("library-b", libraryB)
+
+	// every group receives every event
+	dispatchToAll(serviceWatcherSet, "1")
+	assert.Equal([]string{"first", "first", "first"}, shared.take())
+	assert.Equal([]string{"first", "second"}, libraryA.take())
+	assert.Equal([]string{"second"}, libraryB.take())
+
+	// removal by identity only affects the default group
+	assert.True(first.removeListener(shared))
+	assert.False(first.removeListener(shared))
+	dispatchToAll(serviceWatcherSet, "2")
+	assert.Equal([]string{"first", "first"}, shared.take())
+	assert.Equal([]string{"first", "second"}, libraryA.take())
+	assert.Equal([]string{"second"}, libraryB.take())
+
+	// bulk removal only affects the given group, including listeners added by pattern
+	assert.Equal(1, second.removeGroupListeners("library-a"))
+	assert.Equal(0, second.removeGroupListeners("library-a"))
+	dispatchToAll(serviceWatcherSet, "3")
+	assert.Equal([]string{"first"}, libraryA.take())
+	assert.Equal([]string{"second"}, libraryB.take())
+	assert.Equal([]string{"first", "first"}, shared.take())
+
+	// closing a group detaches everything it registered, including from services added later
+	serviceWatcherSet.closeGroup("library-a")
+	_, added, err := serviceWatcherSet.add("third")
+	assert.True(added)
+	assert.Nil(err)
+	dispatchToAll(serviceWatcherSet, "4")
+	assert.Empty(libraryA.take())
+	assert.Equal([]string{"second"}, libraryB.take())
+	assert.Equal([]string{"first"}, shared.take())
+	assert.Empty(serviceWatcherSet.patternListeners)
+
+	serviceWatcherSet.closeGroup("library-b")
+	dispatchToAll(serviceWatcherSet, "5")
+	assert.Empty(libraryB.take())
+	assert.Empty(shared.take())
+}
@@ -0,0 +1,60 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/foursquare/fsgo/net/discovery"
+	"reflect"
+)
+
+var (
+	ErrorInvalidPayloadTarget = errors.New("Payloads can only be mapped into a non-nil pointer to a slice")
+)
+
+// DecodePayload unmarshals the JSON payload of the given ServiceInstance into out, which
+// must be a pointer as with json.Unmarshal.  If the instance has no payload, out is left
+// unchanged and no error is returned.  Any error identifies the instance by its Id.
+func DecodePayload(serviceInstance *discovery.ServiceInstance, out interface{}) error {
+	if serviceInstance == nil || serviceInstance.Payload == nil || len(*serviceInstance.Payload) == 0 {
+		return nil
+	}
+
+	if err := json.Unmarshal([]byte(*serviceInstance.Payload), out); err != nil {
+		return errors.New(
+			fmt.Sprintf("Unable to decode the payload of service instance %s: %v", serviceInstance.Id, err),
+		)
+	}
+
+	return nil
+}
+
+// MapPayloads decodes the payload of each ServiceInstance, as with DecodePayload, into a new
+// slice which is stored through out.  The out parameter must be a pointer to a slice, e.g.
+// *[]MyPayload or *[]*MyPayload.  The resulting slice is in the same order as this Instances,
+// and ServiceInstances without a payload produce zero values.  Pointer elements are allocated
+// as needed.  If any payload cannot be decoded, out is not modified.
+func (this Instances) MapPayloads(out interface{}) error {
+	target := reflect.ValueOf(out)
+	if target.Kind() != reflect.Ptr || target.IsNil() || target.Elem().Kind() != reflect.Slice {
+		return ErrorInvalidPayloadTarget
+	}
+
+	sliceType := target.Elem().Type()
+	elementType := sliceType.Elem()
+	payloads := reflect.MakeSlice(sliceType, len(this), len(this))
+	for index, serviceInstance := range this {
+		element := payloads.Index(index)
+		if elementType.Kind() == reflect.Ptr {
+			element.Set(reflect.New(elementType.Elem()))
+			element = element.Elem()
+		}
+
+		if err := DecodePayload(serviceInstance, element.Addr().Interface()); err != nil {
+			return err
+		}
+	}
+
+	target.Elem().Set(payloads)
+	return nil
+}
@@ -0,0 +1,91 @@
+package service
+
+import (
+	"github.com/foursquare/fsgo/net/discovery"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+type testPayload struct {
+	Weight int    `json:"weight"`
+	Zone   string `json:"zone"`
+}
+
+func newTestInstanceWithPayload(id, payload string) *discovery.ServiceInstance {
+	serviceInstance := newTestInstance(id, "localhost", 1234)
+	serviceInstance.Payload = &payload
+	return serviceInstance
+}
+
+func TestDecodePayload(t *testing.T) {
+	var testData = []struct {
+		serviceInstance *discovery.ServiceInstance
+		expected        testPayload
+		expectError     bool
+	}{
+		{nil, testPayload{Zone: "unchanged"}, false},
+		{newTestInstance("1", "localhost", 1234), testPayload{Zone: "unchanged"}, false},
+		{newTestInstanceWithPayload("2", ""), testPayload{Zone: "unchanged"}, false},
+		{newTestInstanceWithPayload("3", `{"weight": 5, "zone": "east"}`), testPayload{5, "east"}, false},
+		{newTestInstanceWithPayload("4", `{"weight": 5}`), testPayload{5, "unchanged"}, false},
+		{newTestInstanceWithPayload("5", `not json`), testPayload{Zone: "unchanged"}, true},
+		{newTestInstanceWithPayload("6", `{"weight": "heavy"}`), testPayload{Zone: "unchanged"}, true},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+		actual := testPayload{Zone: "unchanged"}
+		err := DecodePayload(record.serviceInstance, &actual)
+		if record.expectError {
+			if assert.NotNil(err) {
+				assert.Contains(err.Error(), record.serviceInstance.Id)
+			}
+		} else {
+			assert.Nil(err)
+			assert.Equal(record.expected, actual)
+		}
+	}
+}
+
+func TestMapPayloads(t *testing.T) {
+	assert := assert.New(t)
+
+	instances := Instances{
+		newTestInstanceWithPayload("1", `{"weight": 1, "zone": "east"}`),
+		newTestInstance("2", "localhost", 1234),
+		newTestInstanceWithPayload("3", `{"weight": 3, "zone": "west"}`),
+	}
+
+	var values []testPayload
+	assert.Nil(instances.MapPayloads(&values))
+	assert.Equal([]testPayload{{1, "east"}, {}, {3, "west"}}, values)
+
+	var pointers []*testPayload
+	assert.Nil(instances.MapPayloads(&pointers))
+	assert.Equal([]*testPayload{{1, "east"}, {}, {3, "west"}}, pointers)
+
+	var maps []map[string]interface{}
+	assert.Nil(instances.MapPayloads(&maps))
+	assert.Equal(3, len(maps))
+	assert.Equal("east", maps[0]["zone"])
+	assert.Nil(maps[1])
+
+	var empty []testPayload
+	assert.Nil(Instances{}.MapPayloads(&empty))
+	assert.Equal([]testPayload{}, empty)
+
+	// a failed decode leaves the output untouched
+	invalid := append(instances, newTestInstanceWithPayload("bad", `{"weight": "heavy"}`))
+	err := invalid.MapPayloads(&values)
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "bad")
+	}
+
+	assert.Equal([]testPayload{{1, "east"}, {}, {3, "west"}}, values)
+
+	assert.Equal(ErrorInvalidPayloadTarget, instances.MapPayloads(nil))
+	assert.Equal(ErrorInvalidPayloadTarget, instances.MapPayloads(values))
+	assert.Equal(ErrorInvalidPayloadTarget, instances.MapPayloads(&testPayload{}))
+	assert.Equal(ErrorInvalidPayloadTarget, instances.MapPayloads((*[]testPayload)(nil)))
+}
@@ -0,0 +1,142 @@
+package service
+
+// pinRequest is a pending call to pin or unpin a serviceWatcher
+type pinRequest struct {
+	pinning bool
+	pinned  Instances
+}
+
+// pin replaces the last-known Instances of this watcher with the given Instances, which are
+// dispatched to every listener in a Pinned event, even if they are unchanged.  Until unpin is
+// called, the Instances read from zookeeper are cached without being dispatched.  Pinning a
+// pinned watcher replaces its pinned Instances.  This method does nothing if this watcher has
+// been stopped.
+//
+// If a dispatch is in progress, e.g. when a listener pins its own service, the pinned Instances
+// are applied once that dispatch has been delivered, before it completes.  Otherwise they are
+// applied before this method returns.
+func (this *serviceWatcher) pin(pinned Instances) {
+	if pinned == nil {
+		pinned = Instances{}
+	}
+
+	this.requestPinning(pinRequest{pinning: true, pinned: pinned})
+}
+
+// unpin removes the pinned Instances of this watcher, dispatching the Instances most recently
+// read from zookeeper, if any.  A watcher which is not pinned is unaffected.  As with pin, this
+// is deferred until the dispatch in progress, if any, has been delivered.
+func (this *serviceWatcher) unpin() {
+	this.requestPinning(pinRequest{pinning: false})
+}
+
+// requestPinning queues the given request.  If no dispatch is in progress, the request is applied
+// immediately.  Otherwise, the dispatch in progress applies it as it releases the dispatchMutex,
+// so that a listener may pin or unpin without waiting on the dispatch which invoked it.
+func (this *serviceWatcher) requestPinning(request pinRequest) {
+	this.pinMutex.Lock()
+	this.pinRequests = append(this.pinRequests, request)
+	if this.dispatching > 0 {
+		this.pinMutex.Unlock()
+		return
+	}
+
+	this.dispatching++
+	this.pinMutex.Unlock()
+	this.dispatchMutex.Lock()
+	this.unlockDispatch()
+}
+
+// lockDispatch acquires the dispatchMutex, recording that a dispatch is in progress so that
+// pin requests made meanwhile are left for unlockDispatch to apply
+func (this *serviceWatcher) lockDispatch() {
+	this.pinMutex.Lock()
+	this.dispatching++
+	this.pinMutex.Unlock()
+	this.dispatchMutex.Lock()
+}
+
+// unlockDispatch applies any queued pin requests, in order, then releases the dispatchMutex.
+// Callers must hold the dispatchMutex, having acquired it through lockDispatch or requestPinning.
+func (this *serviceWatcher) unlockDispatch() {
+	for {
+		this.pinMutex.Lock()
+		if len(this.pinRequests) == 0 {
+			this.dispatching--
+			this.pinMutex.Unlock()
+			break
+		}
+
+		request := this.pinRequests[0]
+		this.pinRequests = this.pinRequests[1:]
+		this.pinMutex.Unlock()
+		this.applyPinning(request)
+	}
+
+	this.dispatchMutex.Unlock()
+}
+
+// applyPinning pins or unpins this watcher, delivering the resulting event.  Callers must hold
+// the dispatchMutex.
+func (this *serviceWatcher) applyPinning(request pinRequest) {
+	this.listenerMutex.Lock()
+	if this.isStopped() || (!request.pinning && !this.pinning) {
+		this.listenerMutex.Unlock()
+		return
+	}
+
+	if request.pinning {
+		this.logger.Info("Pinning [%s] to %d instance(s)", this.serviceName, len(request.pinned))
+	} else {
+		this.logger.Info("Unpinning [%s]", this.serviceName)
+	}
+
+	pending := this.preparePinning(request.pinning, request.pinned)
+	this.listenerMutex.Unlock()
+	this.deliver(pending)
+}
+
+// preparePinning pins or unpins this watcher, returning the event which replaces the pinned or
+// last-known Instances with the other, or nil if nothing is to be delivered.  Callers must hold
+// both the dispatchMutex and the listenerMutex, as with prepareDispatch.
+func (this *serviceWatcher) preparePinning(pinning bool, pinned Instances) *pendingDispatch {
+	previous, current := this.instances, this.instances
+	if this.pinning {
+		previous = this.pinned
+	}
+
+	if pinning {
+		current = pinned
+	} else if !this.initialized {
+		// nothing has been read from zookeeper, so there is nothing to restore
+		this.instancesMutex.Lock()
+		this.pinning, this.pinned, this.pinnedAnnotated = false, nil, nil
+		this.instancesMutex.Unlock()
+		return nil
+	}
+
+	revision := this.sequence + 1
+	annotated := this.annotate(current, revision)
+	this.instancesMutex.Lock()
+	this.pinning = pinning
+	if pinning {
+		this.pinned, this.pinnedAnnotated = current, annotated
+	} else {
+		this.pinned, this.pinnedAnnotated = nil, nil
+		this.annotated = annotated
+	}
+
+	this.sequence = revision
+	this.instancesMutex.Unlock()
+
+	added, removed := current.Diff(previous, InstanceId)
+	return this.preparePending(InstanceEvent{
+		Added:     added,
+		Removed:   removed,
+		Current:   current,
+		Annotated: annotated,
+		Stale:     this.staleInstances(current),
+		Pinned:    pinning,
+		Sequence:  revision,
+	})
+}
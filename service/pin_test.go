@@ -0,0 +1,227 @@
+package service
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// pinnedEvent summarizes an InstanceEvent for comparison in tests
+type pinnedEvent struct {
+	ids      []string
+	pinned   bool
+	sequence uint64
+}
+
+// recordPinnedEvents returns a listener which records each event it receives
+func recordPinnedEvents(events *[]pinnedEvent) InstancesListenerFunc {
+	return InstancesListenerFunc(func(serviceName string, event InstanceEvent) {
+		*events = append(*events, pinnedEvent{instanceIds(event.Current), event.Pinned, event.Sequence})
+	})
+}
+
+func TestServiceWatcherPin(t *testing.T) {
+	assert := assert.New(t)
+
+	options := watcherOptions{eventHistorySize: 10}
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, options)
+	defer serviceWatcherSet.stop()
+	serviceWatcher, _ := serviceWatcherSet.findByName(testServiceName)
+
+	var events []pinnedEvent
+	serviceWatcher.addListener(recordPinnedEvents(&events))
+	serviceWatcher.dispatch(testInstancesWithIds("1", "2", "3"))
+	serviceWatcher.unpin()
+
+	// pinning dispatches the pinned instances, which replace the cached instances
+	serviceWatcher.pin(testInstancesWithIds("2"))
+	instances, revision, ok := serviceWatcher.cachedRevision()
+	assert.True(ok)
+	assert.Equal([]string{"2"}, instanceIds(instances))
+	assert.Equal(uint64(2), revision)
+
+	// instances read while pinned are cached silently
+	serviceWatcher.dispatch(testInstancesWithIds("1", "2", "3", "4"))
+	serviceWatcher.dispatch(testInstancesWithIds("1", "2", "4"))
+	instances, revision, _ = serviceWatcher.cachedRevision()
+	assert.Equal([]string{"2"}, instanceIds(instances))
+	assert.Equal(uint64(2), revision)
+
+	// a listener added while pinned receives the pinned instances
+	var late []pinnedEvent
+	serviceWatcher.addListener(recordPinnedEvents(&late))
+	assert.Equal([]pinnedEvent{{[]string{"2"}, true, 2}}, late)
+
+	// pinning again replaces the pinned instances, even if unchanged
+	serviceWatcher.pin(testInstancesWithIds("2"))
+	serviceWatcher.pin(nil)
+
+	// unpinning dispatches the instances most recently read
+	serviceWatcher.unpin()
+	serviceWatcher.unpin()
+	instances, revision, _ = serviceWatcher.cachedRevision()
+	assert.Equal([]string{"1", "2", "4"}, instanceIds(instances))
+	assert.Equal(uint64(5), revision)
+
+	assert.Equal(
+		[]pinnedEvent{
+			{[]string{"1", "2", "3"}, false, 1},
+			{[]string{"2"}, true, 2},
+			{[]string{"2"}, true, 3},
+			{[]string{}, true, 4},
+			{[]string{"1", "2", "4"}, false, 5},
+		},
+		events,
+	)
+
+	history := serviceWatcher.history.snapshot()
+	if assert.Len(history, 5) {
+		assert.True(history[1].Pinned)
+		assert.Equal(1, history[1].InstanceCount)
+		assert.Equal(2, history[1].RemovedCount)
+		assert.False(history[4].Pinned)
+		assert.Equal(3, history[4].AddedCount)
+	}
+
+	// dispatching resumes once unpinned
+	serviceWatcher.dispatch(testInstancesWithIds("1"))
+	assert.Equal(pinnedEvent{[]string{"1"}, false, 6}, events[len(events)-1])
+}
+
+func TestServiceWatcherPinBeforeRead(t *testing.T) {
+	assert := assert.New(t)
+
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, watcherOptions{})
+	defer serviceWatcherSet.stop()
+	serviceWatcher, _ := serviceWatcherSet.findByName(testServiceName)
+
+	var events []pinnedEvent
+	serviceWatcher.addListener(recordPinnedEvents(&events))
+	serviceWatcher.pin(testInstancesWithIds("1"))
+	instances, ok := serviceWatcher.cachedInstances()
+	assert.True(ok)
+	assert.Equal([]string{"1"}, instanceIds(instances))
+
+	// nothing has been read, so unpinning dispatches nothing and the service is no longer ready
+	serviceWatcher.unpin()
+	_, ok = serviceWatcher.cachedInstances()
+	assert.False(ok)
+	assert.Equal([]pinnedEvent{{[]string{"1"}, true, 1}}, events)
+
+	// a stopped watcher cannot be pinned
+	serviceWatcher.stop()
+	serviceWatcher.pin(testInstancesWithIds("2"))
+	serviceWatcher.unpin()
+	assert.Len(events, 1)
+}
+
+func TestDiscoveryPinInstances(t *testing.T) {
+	assert := assert.New(t)
+
+	static := mustNewStaticDiscovery(t, map[string]Instances{testServiceName: testInstancesWithIds("1", "2")})
+	var events []pinnedEvent
+	_, err := static.AddListener(testServiceName, recordPinnedEvents(&events))
+	assert.Nil(err)
+
+	assert.Equal(ErrorNoSuchService, static.PinInstances("unwatched", testInstancesWithIds("1")))
+	static.Unpin("unwatched")
+	static.Unpin(testServiceName)
+
+	// the pinned instances are copied, so later changes by the caller have no effect
+	pinned := testInstancesWithIds("3")
+	assert.Nil(static.PinInstances(testServiceName, pinned))
+	pinned[0].Address = "changed"
+	instances, err := static.FetchServices(testServiceName)
+	assert.Nil(err)
+	if assert.Len(instances, 1) {
+		assert.Equal("3", instances[0].Id)
+		assert.Equal("localhost", instances[0].Address)
+	}
+
+	assert.Nil(static.SetInstances(testServiceName, testInstancesWithIds("1", "2", "4")))
+	instances, _ = static.FetchServices(testServiceName)
+	assert.Equal([]string{"3"}, instanceIds(instances))
+
+	static.Unpin(testServiceName)
+	instances, _ = static.FetchServices(testServiceName)
+	assert.Equal([]string{"1", "2", "4"}, instanceIds(instances))
+	assert.Equal(
+		[]pinnedEvent{
+			{[]string{"1", "2"}, false, 1},
+			{[]string{"3"}, true, 2},
+			{[]string{"1", "2", "4"}, false, 3},
+		},
+		events,
+	)
+
+	assert.Nil(static.Close())
+	assert.Equal(ErrorClosed, static.PinInstances(testServiceName, nil))
+
+	builder := &DiscoveryBuilder{Connection: testConnection, Watches: []string{testServiceName}}
+	discovery, err := builder.New(&testLogger{t})
+	if assert.Nil(err) {
+		defer discovery.Close()
+		assert.Equal(ErrorNoSuchService, discovery.PinInstances("unwatched", nil))
+		assert.Nil(discovery.PinInstances(testServiceName, testInstancesWithIds("1")))
+		discovery.Unpin(testServiceName)
+	}
+}
+
+func TestDiscoveryPinInstancesFromListener(t *testing.T) {
+	assert := assert.New(t)
+
+	static := mustNewStaticDiscovery(t, map[string]Instances{testServiceName: testInstancesWithIds("1", "2", "3")})
+	var events []pinnedEvent
+	_, err := static.AddListener(testServiceName, recordPinnedEvents(&events))
+	assert.Nil(err)
+
+	// a service which drops below the threshold is pinned to its last healthy instances from
+	// within the listener, and an empty pin is refused by unpinning from within another listener
+	healthy := testInstancesWithIds("1", "2", "3")
+	_, err = static.AddListener(testServiceName, NewThresholdListener(2, 2, ThresholdFuncs{
+		BelowThreshold: func(serviceName string, count int) {
+			assert.Nil(static.PinInstances(serviceName, healthy))
+		},
+	}))
+
+	assert.Nil(err)
+	_, err = static.AddListener(testServiceName, InstancesListenerFunc(func(serviceName string, event InstanceEvent) {
+		if event.Pinned && len(event.Current) == 0 {
+			static.Unpin(serviceName)
+		}
+	}))
+
+	assert.Nil(err)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.Nil(static.SetInstances(testServiceName, testInstancesWithIds("1")))
+
+		// the pin is applied before the dispatch which triggered it completes
+		instances, _ := static.FetchServices(testServiceName)
+		assert.Equal([]string{"1", "2", "3"}, instanceIds(instances))
+
+		assert.Nil(static.SetInstances(testServiceName, testInstancesWithIds("1", "2", "3", "4")))
+		assert.Nil(static.PinInstances(testServiceName, nil))
+		instances, _ = static.FetchServices(testServiceName)
+		assert.Equal([]string{"1", "2", "3", "4"}, instanceIds(instances))
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		assert.Fail("PinInstances called from a listener did not return")
+		return
+	}
+
+	assert.Equal(
+		[]pinnedEvent{
+			{[]string{"1", "2", "3"}, false, 1},
+			{[]string{"1"}, false, 2},
+			{[]string{"1", "2", "3"}, true, 3},
+			{[]string{}, true, 4},
+			{[]string{"1", "2", "3", "4"}, false, 5},
+		},
+		events,
+	)
+}
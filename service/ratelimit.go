@@ -0,0 +1,179 @@
+package service
+
+import (
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rateLimiter is a token bucket that limits the rate of zookeeper operations.  Tokens
+// accumulate at a fixed rate up to the burst size, and each operation takes one token.
+// A rateLimiter is safe for concurrent use.
+type rateLimiter struct {
+	// throttled is the total time, in nanoseconds, spent waiting for tokens.  It is first so
+	// that it is aligned for atomic access on 32-bit platforms.
+	throttled int64
+
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	// now returns the current time, and is replaced in tests
+	now func() time.Time
+}
+
+// newRateLimiter creates a rateLimiter which allows the given number of operations per second,
+// with bursts of up to the given size.  The bucket starts full.  A nonpositive burst defaults
+// to the rate, rounded up, so that one second's worth of operations can proceed at once.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = int(math.Ceil(rate))
+	}
+
+	return &rateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+		now:    time.Now,
+	}
+}
+
+// reserve takes a token, returning how long the caller must wait before the token is
+// available.  Tokens may be reserved in advance, which leaves the bucket in debt.
+func (this *rateLimiter) reserve() time.Duration {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	now := this.now()
+	if elapsed := now.Sub(this.last); elapsed > 0 {
+		this.tokens = math.Min(this.burst, this.tokens+elapsed.Seconds()*this.rate)
+		this.last = now
+	}
+
+	this.tokens--
+	if this.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-this.tokens / this.rate * float64(time.Second))
+}
+
+// cancel returns a reserved token that was never used
+func (this *rateLimiter) cancel() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.tokens = math.Min(this.burst, this.tokens+1)
+}
+
+// wait blocks until a token is available.  If the context is done first, the token
+// is returned to the bucket and the context's error is returned.
+func (this *rateLimiter) wait(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	delay := this.reserve()
+	if delay <= 0 {
+		return nil
+	}
+
+	start := time.Now()
+	defer func() {
+		atomic.AddInt64(&this.throttled, int64(time.Since(start)))
+	}()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		this.cancel()
+		return ctx.Err()
+	}
+}
+
+// throttledTime returns the total time spent waiting for tokens
+func (this *rateLimiter) throttledTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&this.throttled))
+}
+
+// rateLimitedClient is a zookeeperClient which takes a token from a rateLimiter before each
+// operation.  A single rateLimiter is shared by every watcher of a Discovery.
+type rateLimitedClient struct {
+	client  zookeeperClient
+	limiter *rateLimiter
+}
+
+var _ zookeeperClient = (*rateLimitedClient)(nil)
+
+func (this *rateLimitedClient) children(ctx context.Context, path string) ([]string, error) {
+	if err := this.limiter.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	return this.client.children(ctx, path)
+}
+
+func (this *rateLimitedClient) watchChildren(ctx context.Context, path string) ([]string, error) {
+	if err := this.limiter.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	return this.client.watchChildren(ctx, path)
+}
+
+func (this *rateLimitedClient) data(ctx context.Context, path string) ([]byte, error) {
+	if err := this.limiter.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	return this.client.data(ctx, path)
+}
+
+// dataBatch takes a single token for the whole batch, since it is a single zookeeper operation.
+// The wrapped client must be a batchReader, which batchReaderOf ensures.
+func (this *rateLimitedClient) dataBatch(ctx context.Context, paths []string) ([][]byte, error) {
+	if err := this.limiter.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	return this.client.(batchReader).dataBatch(ctx, paths)
+}
+
+func (this *rateLimitedClient) watchData(ctx context.Context, path string) ([]byte, error) {
+	if err := this.limiter.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	return this.client.watchData(ctx, path)
+}
+
+func (this *rateLimitedClient) ensurePath(ctx context.Context, path string) error {
+	if err := this.limiter.wait(ctx); err != nil {
+		return err
+	}
+
+	return this.client.ensurePath(ctx, path)
+}
+
+func (this *rateLimitedClient) exists(ctx context.Context, path string) (bool, error) {
+	if err := this.limiter.wait(ctx); err != nil {
+		return false, err
+	}
+
+	return this.client.exists(ctx, path)
+}
+
+func (this *rateLimitedClient) watchExists(ctx context.Context, path string) (bool, error) {
+	if err := this.limiter.wait(ctx); err != nil {
+		return false, err
+	}
+
+	return this.client.watchExists(ctx, path)
+}
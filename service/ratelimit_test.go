@@ -0,0 +1,188 @@
+package service
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// fakeClock is a manually advanced clock for rateLimiter tests
+type fakeClock struct {
+	current time.Time
+}
+
+func (this *fakeClock) now() time.Time {
+	return this.current
+}
+
+func TestNewRateLimiter(t *testing.T) {
+	var testData = []struct {
+		rate          float64
+		burst         int
+		expectedBurst float64
+	}{
+		{10, 5, 5},
+		{10, 0, 10},
+		{2.5, 0, 3},
+		{0.5, -1, 1},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+		limiter := newRateLimiter(record.rate, record.burst)
+		assert.Equal(record.expectedBurst, limiter.burst)
+		assert.Equal(record.expectedBurst, limiter.tokens)
+	}
+}
+
+func TestRateLimiterReserve(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := &fakeClock{time.Now()}
+	limiter := newRateLimiter(10, 2)
+	limiter.now = clock.now
+	limiter.last = clock.current
+
+	// the bucket starts full, then each reservation waits a further tenth of a second
+	assert.Equal(time.Duration(0), limiter.reserve())
+	assert.Equal(time.Duration(0), limiter.reserve())
+	assert.Equal(100*time.Millisecond, limiter.reserve())
+	assert.Equal(200*time.Millisecond, limiter.reserve())
+
+	// unused reservations are returned
+	limiter.cancel()
+	assert.Equal(200*time.Millisecond, limiter.reserve())
+
+	// tokens accumulate over time, but never beyond the burst
+	clock.current = clock.current.Add(time.Minute)
+	assert.Equal(time.Duration(0), limiter.reserve())
+	assert.Equal(time.Duration(0), limiter.reserve())
+	assert.Equal(100*time.Millisecond, limiter.reserve())
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	assert := assert.New(t)
+
+	limiter := newRateLimiter(100, 1)
+	assert.Nil(limiter.wait(context.Background()))
+	assert.Equal(time.Duration(0), limiter.throttledTime())
+
+	start := time.Now()
+	assert.Nil(limiter.wait(context.Background()))
+	assert.True(time.Since(start) >= 5*time.Millisecond)
+	assert.True(limiter.throttledTime() > 0)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(context.Canceled, limiter.wait(cancelled))
+
+	slow := newRateLimiter(0.1, 1)
+	assert.Nil(slow.wait(context.Background()))
+	expired, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(context.DeadlineExceeded, slow.wait(expired))
+	assert.True(slow.throttledTime() >= 10*time.Millisecond)
+}
+
+func TestRateLimitedClient(t *testing.T) {
+	assert := assert.New(t)
+
+	fake := newFakeZookeeperClient()
+	servicePath := testBasePath + "/" + testServiceName
+	fake.addInstance(servicePath, newTestInstance("1", "host.com", 8080))
+	client := &rateLimitedClient{fake, newRateLimiter(0.1, 4)}
+
+	assert.Nil(client.ensurePath(context.Background(), servicePath))
+	childIds, err := client.watchChildren(context.Background(), servicePath)
+	assert.Equal([]string{"1"}, childIds)
+	assert.Nil(err)
+
+	data, err := client.data(context.Background(), servicePath+"/1")
+	assert.NotEmpty(data)
+	assert.Nil(err)
+
+	data, err = client.watchData(context.Background(), servicePath+"/1")
+	assert.NotEmpty(data)
+	assert.Nil(err)
+
+	// the bucket is empty, so an operation gives up when its context is done
+	expired, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	childIds, err = client.children(expired, servicePath)
+	assert.Nil(childIds)
+	assert.Equal(context.DeadlineExceeded, err)
+	assert.Equal(1, fake.watches())
+}
+
+func TestReadRateLimiter(t *testing.T) {
+	var testData = []struct {
+		builder       DiscoveryBuilder
+		expectLimiter bool
+		expectedError error
+	}{
+		{DiscoveryBuilder{}, false, nil},
+		{DiscoveryBuilder{ReadRateBurst: 10}, false, nil},
+		{DiscoveryBuilder{ReadRateLimit: 50}, true, nil},
+		{DiscoveryBuilder{ReadRateLimit: 50, ReadRateBurst: 10}, true, nil},
+		{DiscoveryBuilder{ReadRateLimit: -1}, false, ErrorInvalidReadRateLimit},
+		{DiscoveryBuilder{ReadRateLimit: 50, ReadRateBurst: -1}, false, ErrorInvalidReadRateLimit},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+		limiter, err := record.builder.readRateLimiter()
+		assert.Equal(record.expectLimiter, limiter != nil)
+		assert.Equal(record.expectedError, err)
+	}
+}
+
+func TestThrottledReadsCoalesce(t *testing.T) {
+	assert := assert.New(t)
+
+	fake := newFakeZookeeperClient()
+	servicePath := testBasePath + "/" + testServiceName
+	client := &rateLimitedClient{fake, newRateLimiter(20, 2)}
+
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, watcherOptions{coalesceReads: true})
+	defer serviceWatcherSet.stop()
+
+	serviceWatcher, _ := serviceWatcherSet.findByName(testServiceName)
+	dispatched := make(chan Instances, 10)
+	serviceWatcher.addListener(ListenerFunc(func(serviceName string, instances Instances) {
+		dispatched <- instances
+	}))
+
+	assert.Nil(serviceWatcher.initialize(client))
+	assert.Empty(<-dispatched)
+
+	// the events arrive faster than reads are allowed, and none of them block
+	start := time.Now()
+	for index := 0; index < 10; index++ {
+		fake.addInstance(servicePath, newTestInstance(strconv.Itoa(index), "host.com", 8080+index))
+		serviceWatcher.childrenChanged()
+	}
+
+	assert.True(time.Since(start) < 50*time.Millisecond)
+
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case instances := <-dispatched:
+			if len(instances) < 10 {
+				continue
+			}
+		case <-timeout:
+			assert.Fail("The coalesced services were not dispatched")
+			return
+		}
+
+		break
+	}
+
+	// one update may already be in progress when the events begin, and at most one more waits for it
+	assert.True(fake.watches() <= 3, "watches: %d", fake.watches())
+}
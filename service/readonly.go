@@ -0,0 +1,29 @@
+package service
+
+import (
+	"github.com/foursquare/fsgo/net/discovery"
+)
+
+// NewReadOnlyRegistrar returns a Registrar which never writes to zookeeper, and fails every
+// registration and deregistration with ErrorReadOnly.  RegisterWith and DeregisterFrom return
+// ErrorReadOnly for this Registrar without attempting any instance.
+func NewReadOnlyRegistrar() Registrar {
+	return readOnlyRegistrar{}
+}
+
+// readOnlyRegistrar is the Registrar returned by NewReadOnlyRegistrar
+type readOnlyRegistrar struct{}
+
+func (this readOnlyRegistrar) Register(serviceInstance *discovery.ServiceInstance) error {
+	return ErrorReadOnly
+}
+
+func (this readOnlyRegistrar) Unregister(serviceInstance *discovery.ServiceInstance) error {
+	return ErrorReadOnly
+}
+
+// isReadOnly tests if the given Registrar refuses all writes
+func isReadOnly(registrar Registrar) bool {
+	_, ok := registrar.(readOnlyRegistrar)
+	return ok
+}
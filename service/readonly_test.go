@@ -0,0 +1,103 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestReadOnlyRegistrar(t *testing.T) {
+	assert := assert.New(t)
+
+	registrar := NewReadOnlyRegistrar()
+	instances := Instances{newTestInstance("1", "localhost", 1234)}
+	assert.Equal(ErrorReadOnly, instances.RegisterWith(registrar))
+	assert.Equal(ErrorReadOnly, instances.DeregisterFrom(registrar))
+	assert.Equal(ErrorReadOnly, registrar.Register(instances[0]))
+	assert.Equal(ErrorReadOnly, registrar.Unregister(instances[0]))
+}
+
+func TestReadOnlyNeverWrites(t *testing.T) {
+	assert := assert.New(t)
+	connection := newFakeZookeeperConnection()
+	curatorConnection := startCuratorConnection(t, DiscoveryBuilder{}, connection)
+	defer curatorConnection.Close()
+
+	// the watched service is registered by someone else beforehand
+	servicePath := testBasePath + "/" + testServiceName
+	if !assert.Nil(NewRegistrar(curatorConnection, testBasePath, nil).Register(newTestInstance("1", "localhost", 1234))) {
+		return
+	}
+
+	connection.mutex.Lock()
+	connection.operations = nil
+	connection.mutex.Unlock()
+
+	builder := DiscoveryBuilder{ReadOnly: true, ServicePathModes: map[string]string{"pending": ServicePathWaitForCreation}}
+	pathMode, pathModes, err := builder.servicePathModes()
+	if !assert.Nil(err) {
+		return
+	}
+
+	options := watcherOptions{pathMode: pathMode, pathModes: pathModes}
+	client := &curatorClient{connection: curatorConnection, readOnly: true}
+
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName, "pending"}, []string{testBasePath}, options)
+	defer serviceWatcherSet.stop()
+	assert.Nil(serviceWatcherSet.initialize(client))
+	serviceWatcher, _ := serviceWatcherSet.findByName(testServiceName)
+	instances, ok := serviceWatcher.cachedInstances()
+	assert.True(ok)
+	assert.Equal([]string{"1"}, instanceIds(instances))
+
+	// a missing path is required rather than created
+	missing := mustNewServiceWatcherSet(t, &testLogger{t}, []string{"missing"}, []string{testBasePath}, options)
+	defer missing.stop()
+	err = missing.initialize(client)
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "does not exist")
+	}
+
+	// writes fail fast, describing what was refused
+	err = client.ensurePath(context.Background(), servicePath)
+	assert.True(errors.Is(err, ErrorReadOnly))
+	assert.Equal(ReadOnlyError{Operation: "create", Path: servicePath}, err)
+	assert.Contains(err.Error(), servicePath)
+	assert.Equal(ErrorReadOnly, instances.DeregisterFrom(NewReadOnlyRegistrar()))
+
+	operations := connection.recorded()
+	assert.NotEmpty(operations)
+	for _, operation := range operations {
+		for _, write := range []string{"create ", "set ", "delete "} {
+			assert.False(strings.HasPrefix(operation, write), operation)
+		}
+	}
+}
+
+func TestReadOnlyDiscovery(t *testing.T) {
+	assert := assert.New(t)
+
+	builder := &DiscoveryBuilder{Connection: testConnection, Watches: []string{testServiceName}, ReadOnly: true}
+	discovery, err := builder.New(&testLogger{t})
+	if !assert.Nil(err) {
+		return
+	}
+
+	defer discovery.Close()
+	registered, err := discovery.Register(Instances{newTestInstance("", "localhost", 1234)})
+	assert.Nil(registered)
+	assert.Equal(ErrorReadOnly, err)
+	assert.Equal(ErrorReadOnly, discovery.DeregisterInstances(Instances{newTestInstance("1", "localhost", 1234)}))
+	assert.Nil(discovery.Deregister())
+
+	builder.Registrations = Instances{newTestInstance("", "localhost", 1234)}
+	_, err = builder.New(&testLogger{t})
+	assert.True(errors.Is(err, ErrorReadOnlyRegistrations))
+
+	builder.Registrations = nil
+	builder.ServicePathMode = ServicePathCreate
+	_, err = builder.New(&testLogger{t})
+	assert.True(errors.Is(err, ErrorReadOnlyServicePathMode))
+}
@@ -0,0 +1,268 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"github.com/foursquare/curator.go"
+	"github.com/foursquare/fsgo/net/discovery"
+	"github.com/samuel/go-zookeeper/zk"
+	"sync"
+)
+
+// Registrar is the subset of discovery.ServiceDiscovery used to maintain registrations
+type Registrar interface {
+	Register(*discovery.ServiceInstance) error
+	Unregister(*discovery.ServiceInstance) error
+}
+
+var _ Registrar = (*discovery.ServiceDiscovery)(nil)
+
+// NewRegistrar creates a Registrar which writes instances beneath basePath using the given
+// serializer.  Unlike discovery.ServiceDiscovery, which always writes JSON, this allows
+// registrations to use the same InstanceSerializer as a Discovery that reads them.  If
+// serializer is nil, a discovery.JsonInstanceSerializer is used.  Znodes are created with the
+// ACLs of the connection's curator.ACLProvider.
+func NewRegistrar(connection discovery.Conn, basePath string, serializer discovery.InstanceSerializer) Registrar {
+	if serializer == nil {
+		serializer = &discovery.JsonInstanceSerializer{}
+	}
+
+	return &curatorRegistrar{
+		connection: connection,
+		basePath:   basePath,
+		serializer: serializer,
+	}
+}
+
+// curatorRegistrar is the Registrar implementation returned by NewRegistrar.  It stores
+// instances at the same paths as discovery.ServiceDiscovery.
+type curatorRegistrar struct {
+	connection discovery.Conn
+	basePath   string
+	serializer discovery.InstanceSerializer
+}
+
+func (this *curatorRegistrar) instancePath(serviceInstance *discovery.ServiceInstance) string {
+	return curator.JoinPath(this.basePath, serviceInstance.Name, serviceInstance.Id)
+}
+
+// Register serializes the given instance and creates its znode.  DYNAMIC instances are
+// stored in ephemeral znodes, while all others are persistent.
+func (this *curatorRegistrar) Register(serviceInstance *discovery.ServiceInstance) error {
+	data, err := this.serializer.Serialize(serviceInstance)
+	if err != nil {
+		return err
+	}
+
+	createMode := curator.PERSISTENT
+	if serviceInstance.ServiceType == discovery.DYNAMIC {
+		createMode = curator.EPHEMERAL
+	}
+
+	_, err = this.connection.Create().
+		CreatingParentsIfNeeded().
+		WithMode(createMode).
+		ForPathWithData(this.instancePath(serviceInstance), data)
+
+	return err
+}
+
+// Unregister deletes the znode for the given instance
+func (this *curatorRegistrar) Unregister(serviceInstance *discovery.ServiceInstance) error {
+	return this.connection.Delete().ForPath(this.instancePath(serviceInstance))
+}
+
+// RegistrationValidator checks a ServiceInstance before it is written to zookeeper.  A non-nil
+// error prevents the registration, and is returned in place of any zookeeper error.
+type RegistrationValidator func(serviceInstance *discovery.ServiceInstance) error
+
+// RequirePayloadKeys returns a RegistrationValidator which requires each ServiceInstance to
+// have a JSON object payload containing every one of the given keys with a non-null value.
+func RequirePayloadKeys(keys ...string) RegistrationValidator {
+	return func(serviceInstance *discovery.ServiceInstance) error {
+		if serviceInstance.Payload == nil || len(*serviceInstance.Payload) == 0 {
+			return errors.New(
+				fmt.Sprintf("The service instance %s [%s] has no payload", serviceInstance.Id, serviceInstance.Name),
+			)
+		}
+
+		var payload map[string]interface{}
+		if err := DecodePayload(serviceInstance, &payload); err != nil {
+			return err
+		}
+
+		var missing []string
+		for _, key := range keys {
+			if payload[key] == nil {
+				missing = append(missing, key)
+			}
+		}
+
+		if len(missing) > 0 {
+			return errors.New(
+				fmt.Sprintf("The payload of service instance %s [%s] is missing %v", serviceInstance.Id, serviceInstance.Name, missing),
+			)
+		}
+
+		return nil
+	}
+}
+
+// NewValidatingRegistrar returns a Registrar which checks each ServiceInstance with the given
+// validator before registering it with the delegate.  Passing the result to RegisterWith
+// validates every instance in the batch.  Unregistering is never validated.
+func NewValidatingRegistrar(delegate Registrar, validator RegistrationValidator) Registrar {
+	return &validatingRegistrar{delegate, validator}
+}
+
+// validatingRegistrar is the Registrar implementation returned by NewValidatingRegistrar
+type validatingRegistrar struct {
+	delegate  Registrar
+	validator RegistrationValidator
+}
+
+func (this *validatingRegistrar) Register(serviceInstance *discovery.ServiceInstance) error {
+	if err := this.validator(serviceInstance); err != nil {
+		return err
+	}
+
+	return this.delegate.Register(serviceInstance)
+}
+
+func (this *validatingRegistrar) Unregister(serviceInstance *discovery.ServiceInstance) error {
+	return this.delegate.Unregister(serviceInstance)
+}
+
+// registrationManager maintains a set of registered ServiceInstances.  Since registrations
+// are ephemeral znodes, they vanish when a zookeeper session expires.  A registrationManager
+// listens for connection state changes and re-registers every managed instance once a new
+// session is established.
+type registrationManager struct {
+	logger    Logger
+	registrar Registrar
+
+	mutex       sync.Mutex
+	registered  Instances
+	sessionLost bool
+}
+
+var _ curator.ConnectionStateListener = (*registrationManager)(nil)
+
+func newRegistrationManager(logger Logger, registrar Registrar) *registrationManager {
+	return &registrationManager{
+		logger:    logger,
+		registrar: registrar,
+	}
+}
+
+// register normalizes and registers each of the given instances, adding them to the
+// set of managed registrations.
+func (this *registrationManager) register(instances Instances) error {
+	_, err := this.add(instances)
+	return err
+}
+
+// add is like register, but also returns copies of the instances which were registered, with
+// the Ids assigned to them.  When an instance fails, the instances registered before it are
+// returned along with the error, and remain managed.
+func (this *registrationManager) add(instances Instances) (Instances, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	added := make(Instances, 0, len(instances))
+	for _, original := range instances {
+		normalized := normalizeInstance(original)
+		if err := this.registrar.Register(normalized); err != nil {
+			return added, errors.New(
+				fmt.Sprintf("Error while registering service instance %v: %v", normalized, err),
+			)
+		}
+
+		this.registered = append(this.registered, normalized)
+		clone := *normalized
+		added = append(added, &clone)
+	}
+
+	return added, nil
+}
+
+// deregister removes the managed registration with the same Id as the given instance.
+// If no such registration exists, this method returns false.
+func (this *registrationManager) deregister(serviceInstance *discovery.ServiceInstance) (bool, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for index, candidate := range this.registered {
+		if candidate.Id == serviceInstance.Id {
+			this.registered = append(this.registered[:index], this.registered[index+1:]...)
+			return true, this.registrar.Unregister(candidate)
+		}
+	}
+
+	return false, nil
+}
+
+// deregisterEach removes the managed registration with the same Id as each of the given
+// instances, attempting each even if some fail.  Instances which are not managed are ignored.
+func (this *registrationManager) deregisterEach(instances Instances) error {
+	var failures MultiError
+	for _, serviceInstance := range instances {
+		if _, err := this.deregister(serviceInstance); err != nil {
+			failures = append(failures, InstanceError{serviceInstance, err})
+		}
+	}
+
+	return failures.errorOrNil()
+}
+
+// deregisterAll removes every managed registration, attempting each even if some fail.
+// No registrations are managed after this method returns, regardless of errors.
+func (this *registrationManager) deregisterAll() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	registered := this.registered
+	this.registered = nil
+	return deregisterAll(this.registrar, registered)
+}
+
+// registrations returns copies of the managed ServiceInstances
+func (this *registrationManager) registrations() Instances {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	registrations := make(Instances, len(this.registered))
+	for index, serviceInstance := range this.registered {
+		clone := *serviceInstance
+		registrations[index] = &clone
+	}
+
+	return registrations
+}
+
+// reregisterAll registers each managed instance again, preserving its Id.  Callers must
+// hold the mutex.
+func (this *registrationManager) reregisterAll() {
+	for _, serviceInstance := range this.registered {
+		err := this.registrar.Register(serviceInstance)
+		if err == zk.ErrNodeExists {
+			this.logger.Info("Registration %s [%s] already exists", serviceInstance.Id, serviceInstance.Name)
+		} else if err != nil {
+			this.logger.Error("Error while re-registering %s [%s]: %v", serviceInstance.Id, serviceInstance.Name, err)
+		} else {
+			this.logger.Info("Re-registered %s [%s] at %s", serviceInstance.Id, serviceInstance.Name, serviceInstance.Spec())
+		}
+	}
+}
+
+// StateChanged tracks session loss, re-registering all managed instances when a connection
+// is established after the previous session was lost.
+func (this *registrationManager) StateChanged(client curator.CuratorFramework, newState curator.ConnectionState) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	switch {
+	case newState == curator.LOST:
+		this.logger.Error("Zookeeper session lost.  Registrations will be restored on reconnection.")
+		this.sessionLost = true
+
+	case (newState == curator.CONNECTED || newState == curator.RECONNECTED) && this.sessionLost:
+		this.sessionLost = false
+		this.reregisterAll()
+	}
+}
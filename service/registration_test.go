@@ -0,0 +1,378 @@
+package service
+
+import (
+	"errors"
+	"github.com/foursquare/curator.go"
+	"github.com/foursquare/fsgo/net/discovery"
+	"github.com/samuel/go-zookeeper/zk"
+	"github.com/stretchr/testify/assert"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// fakeRegistrar simulates the ephemeral znodes created by registrations
+type fakeRegistrar struct {
+	mutex         sync.Mutex
+	znodes        map[string]*discovery.ServiceInstance
+	registerCount int
+	registerError error
+}
+
+func newFakeRegistrar() *fakeRegistrar {
+	return &fakeRegistrar{znodes: make(map[string]*discovery.ServiceInstance)}
+}
+
+func (this *fakeRegistrar) Register(serviceInstance *discovery.ServiceInstance) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.registerCount++
+	if this.registerError != nil {
+		return this.registerError
+	}
+
+	if _, ok := this.znodes[serviceInstance.Id]; ok {
+		return zk.ErrNodeExists
+	}
+
+	this.znodes[serviceInstance.Id] = serviceInstance
+	return nil
+}
+
+func (this *fakeRegistrar) Unregister(serviceInstance *discovery.ServiceInstance) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if _, ok := this.znodes[serviceInstance.Id]; !ok {
+		return zk.ErrNoNode
+	}
+
+	delete(this.znodes, serviceInstance.Id)
+	return nil
+}
+
+// expireSession removes all ephemeral znodes, as zookeeper does when a session expires
+func (this *fakeRegistrar) expireSession() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.znodes = make(map[string]*discovery.ServiceInstance)
+}
+
+func (this *fakeRegistrar) ids() []string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	ids := make([]string, 0, len(this.znodes))
+	for id := range this.znodes {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+	return ids
+}
+
+func TestRegistrationManagerReregistersAfterSessionLoss(t *testing.T) {
+	assert := assert.New(t)
+
+	registrar := newFakeRegistrar()
+	manager := newRegistrationManager(&testLogger{t}, registrar)
+	err := manager.register(Instances{
+		newTestInstance("", "localhost", 1234),
+		newTestInstance("", "foobar.com", 1234),
+	})
+
+	if !assert.Nil(err) {
+		return
+	}
+
+	registrations := manager.registrations()
+	assert.Len(registrations, 2)
+	expectedIds := instanceIds(registrations)
+	sort.Strings(expectedIds)
+	assert.Equal(expectedIds, registrar.ids())
+
+	// a suspension that doesn't lose the session should not reregister
+	manager.StateChanged(nil, curator.SUSPENDED)
+	manager.StateChanged(nil, curator.RECONNECTED)
+	assert.Equal(2, registrar.registerCount)
+
+	registrar.expireSession()
+	manager.StateChanged(nil, curator.SUSPENDED)
+	manager.StateChanged(nil, curator.LOST)
+	assert.Empty(registrar.ids())
+
+	manager.StateChanged(nil, curator.RECONNECTED)
+	assert.Equal(expectedIds, registrar.ids())
+	assert.Equal(4, registrar.registerCount)
+
+	// subsequent connection events should not reregister again
+	manager.StateChanged(nil, curator.RECONNECTED)
+	assert.Equal(4, registrar.registerCount)
+}
+
+func TestRegistrationManagerDeregister(t *testing.T) {
+	assert := assert.New(t)
+
+	registrar := newFakeRegistrar()
+	manager := newRegistrationManager(&testLogger{t}, registrar)
+	assert.Nil(manager.register(Instances{newTestInstance("", "localhost", 1234)}))
+
+	registrations := manager.registrations()
+	if !assert.Len(registrations, 1) {
+		return
+	}
+
+	ok, err := manager.deregister(registrations[0])
+	assert.True(ok)
+	assert.Nil(err)
+	assert.Empty(manager.registrations())
+	assert.Empty(registrar.ids())
+
+	ok, err = manager.deregister(registrations[0])
+	assert.False(ok)
+	assert.Nil(err)
+
+	// deregistered instances are not restored after session loss
+	manager.StateChanged(nil, curator.LOST)
+	manager.StateChanged(nil, curator.RECONNECTED)
+	assert.Empty(registrar.ids())
+}
+
+func TestRegistrationManagerRegisterError(t *testing.T) {
+	assert := assert.New(t)
+
+	registrar := newFakeRegistrar()
+	registrar.registerError = errors.New("expected")
+	manager := newRegistrationManager(&testLogger{t}, registrar)
+
+	assert.NotNil(manager.register(Instances{newTestInstance("", "localhost", 1234)}))
+	assert.Empty(manager.registrations())
+}
+
+func TestRegistrationManagerAdd(t *testing.T) {
+	assert := assert.New(t)
+
+	registrar := &failingRegistrar{failures: map[string]bool{"third.com": true}}
+	manager := newRegistrationManager(&testLogger{t}, registrar)
+	added, err := manager.add(Instances{
+		newTestInstance("", "first.com", 1234),
+		newTestInstance("", "second.com", 1235),
+		newTestInstance("", "third.com", 1236),
+		newTestInstance("", "fourth.com", 1237),
+	})
+
+	// the instances registered before the failure are returned, with their ids
+	assert.NotNil(err)
+	if assert.Len(added, 2) {
+		assert.Equal("first.com", added[0].Address)
+		assert.Equal("second.com", added[1].Address)
+		assert.Equal(instanceIds(added), instanceIds(manager.registrations()))
+		assert.NotEmpty(added[0].Id)
+	}
+
+	// the copies are independent of the managed registrations
+	added[0].Address = "changed.com"
+	assert.Equal("first.com", manager.registrations()[0].Address)
+}
+
+func TestRegistrationManagerDeregisterEach(t *testing.T) {
+	assert := assert.New(t)
+
+	registrar := newFakeRegistrar()
+	manager := newRegistrationManager(&testLogger{t}, registrar)
+	first, err := manager.add(Instances{newTestInstance("", "localhost", 1234), newTestInstance("", "localhost", 1235)})
+	assert.Nil(err)
+	second, err := manager.add(Instances{newTestInstance("", "localhost", 1236)})
+	assert.Nil(err)
+
+	assert.Nil(manager.deregisterEach(first))
+	assert.Equal(instanceIds(second), instanceIds(manager.registrations()))
+	assert.Equal(instanceIds(second), registrar.ids())
+
+	// instances which are no longer registered are ignored
+	assert.Nil(manager.deregisterEach(first))
+
+	registrar.expireSession()
+	err = manager.deregisterEach(second)
+	if multiError, ok := err.(MultiError); assert.True(ok) && assert.Len(multiError, 1) {
+		assert.Equal(second[0].Id, multiError[0].Instance.Id)
+	}
+
+	assert.Empty(manager.registrations())
+}
+
+// failingRegistrar fails to unregister specific instance ids, and fails to register specific
+// addresses since registered instances are normalized with new ids.  Every attempt is recorded.
+type failingRegistrar struct {
+	attempts []string
+	failures map[string]bool
+}
+
+func (this *failingRegistrar) Register(serviceInstance *discovery.ServiceInstance) error {
+	this.attempts = append(this.attempts, serviceInstance.Address)
+	if this.failures[serviceInstance.Address] {
+		return errors.New("expected")
+	}
+
+	return nil
+}
+
+func (this *failingRegistrar) Unregister(serviceInstance *discovery.ServiceInstance) error {
+	this.attempts = append(this.attempts, serviceInstance.Id)
+	if this.failures[serviceInstance.Id] {
+		return errors.New("expected")
+	}
+
+	return nil
+}
+
+func TestDeregisterAllAttemptsEveryInstance(t *testing.T) {
+	assert := assert.New(t)
+
+	registrar := &failingRegistrar{failures: map[string]bool{"1": true, "3": true}}
+	instances := Instances{
+		newTestInstance("1", "localhost", 1234),
+		newTestInstance("2", "localhost", 1235),
+		newTestInstance("3", "localhost", 1236),
+		newTestInstance("4", "localhost", 1237),
+	}
+
+	err := deregisterAll(registrar, instances)
+	assert.Equal([]string{"1", "2", "3", "4"}, registrar.attempts)
+	if multiError, ok := err.(MultiError); assert.True(ok) && assert.Len(multiError, 2) {
+		assert.Equal(instances[0], multiError[0].Instance)
+		assert.Equal(instances[2], multiError[1].Instance)
+		assert.Contains(multiError.Error(), "2 error(s)")
+	}
+
+	registrar = &failingRegistrar{}
+	assert.Nil(deregisterAll(registrar, instances))
+	assert.Nil(deregisterAll(registrar, nil))
+}
+
+func TestRegisterWithAttemptsEveryInstance(t *testing.T) {
+	assert := assert.New(t)
+
+	registrar := &failingRegistrar{failures: map[string]bool{"first.com": true, "third.com": true}}
+	instances := Instances{
+		newTestInstance("1", "first.com", 1234),
+		newTestInstance("2", "second.com", 1235),
+		newTestInstance("3", "third.com", 1236),
+	}
+
+	err := instances.RegisterWith(registrar)
+	assert.Equal([]string{"first.com", "second.com", "third.com"}, registrar.attempts)
+	if multiError, ok := err.(MultiError); assert.True(ok) && assert.Len(multiError, 2) {
+		// the originals are reported, so that they can be registered again
+		assert.Equal(Instances{instances[0], instances[2]}, multiError.Instances())
+		assert.Contains(multiError.Error(), "2 error(s)")
+		assert.Equal("expected", errors.Unwrap(multiError[0]).Error())
+
+		registrar.failures = nil
+		assert.Nil(multiError.Instances().RegisterWith(registrar))
+		assert.Equal([]string{"first.com", "second.com", "third.com", "first.com", "third.com"}, registrar.attempts)
+	}
+
+	assert.Nil(Instances{}.RegisterWith(registrar))
+}
+
+func TestRegistrationManagerDeregisterAll(t *testing.T) {
+	assert := assert.New(t)
+
+	registrar := newFakeRegistrar()
+	manager := newRegistrationManager(&testLogger{t}, registrar)
+	assert.Nil(manager.register(Instances{
+		newTestInstance("", "localhost", 1234),
+		newTestInstance("", "foobar.com", 1234),
+	}))
+
+	// simulate one registration that has already vanished
+	registrar.znodes = map[string]*discovery.ServiceInstance{}
+	registrations := manager.registrations()
+	assert.Nil(registrar.Register(registrations[1]))
+
+	err := manager.deregisterAll()
+	if multiError, ok := err.(MultiError); assert.True(ok) && assert.Len(multiError, 1) {
+		assert.Equal(registrations[0].Id, multiError[0].Instance.Id)
+	}
+
+	assert.Empty(registrar.ids())
+	assert.Empty(manager.registrations())
+}
+
+func TestRequirePayloadKeys(t *testing.T) {
+	assert := assert.New(t)
+	validator := RequirePayloadKeys("version", "region")
+
+	var testData = []struct {
+		serviceInstance *discovery.ServiceInstance
+		expectedError   string
+	}{
+		{newTestInstance("1", "localhost", 1234), "has no payload"},
+		{newTestInstanceWithPayload("2", ""), "has no payload"},
+		{newTestInstanceWithPayload("3", "not json"), "Unable to decode"},
+		{newTestInstanceWithPayload("4", `["version", "region"]`), "Unable to decode"},
+		{newTestInstanceWithPayload("5", `{"version": 2}`), "missing [region]"},
+		{newTestInstanceWithPayload("6", `{"version": null, "region": "east"}`), "missing [version]"},
+		{newTestInstanceWithPayload("7", `{}`), "missing [version region]"},
+		{newTestInstanceWithPayload("8", `{"version": 2, "region": "east", "extra": true}`), ""},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		err := validator(record.serviceInstance)
+		if len(record.expectedError) > 0 {
+			if assert.NotNil(err) {
+				assert.Contains(err.Error(), record.expectedError)
+			}
+		} else {
+			assert.Nil(err)
+		}
+	}
+}
+
+func TestValidatingRegistrar(t *testing.T) {
+	assert := assert.New(t)
+
+	rejected := false
+	validationError := errors.New("expected")
+	delegate := newFakeRegistrar()
+	registrar := NewValidatingRegistrar(delegate, func(serviceInstance *discovery.ServiceInstance) error {
+		if serviceInstance.Address == "invalid.com" || rejected {
+			return validationError
+		}
+
+		return nil
+	})
+
+	instances := Instances{
+		newTestInstance("1", "valid.com", 1234),
+		newTestInstance("2", "invalid.com", 1234),
+	}
+
+	// RegisterWith fails only the instances that don't pass validation
+	err := instances.RegisterWith(registrar)
+	if multiError, ok := err.(MultiError); assert.True(ok) && assert.Len(multiError, 1) {
+		assert.Equal(Instances{instances[1]}, multiError.Instances())
+		assert.Equal(validationError, errors.Unwrap(multiError[0]))
+	}
+
+	assert.Equal(1, delegate.registerCount)
+	assert.Len(delegate.ids(), 1)
+	delegate.expireSession()
+
+	// the registration manager validates both initial registrations and re-registrations
+	manager := newRegistrationManager(&testLogger{t}, registrar)
+	err = manager.register(instances)
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), validationError.Error())
+	}
+
+	assert.Len(manager.registrations(), 1)
+	assert.Len(delegate.ids(), 1)
+
+	rejected = true
+	delegate.expireSession()
+	manager.StateChanged(nil, curator.LOST)
+	manager.StateChanged(nil, curator.RECONNECTED)
+	assert.Empty(delegate.ids())
+	assert.Equal(2, delegate.registerCount)
+}
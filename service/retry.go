@@ -0,0 +1,78 @@
+package service
+
+import (
+	"time"
+)
+
+const (
+	// DefaultWatchRetryInitialDelay is the delay before the first attempt to re-establish a watch
+	DefaultWatchRetryInitialDelay = time.Duration(1 * time.Second)
+
+	// DefaultWatchRetryMaxDelay is the upper bound on the delay between attempts to re-establish a watch
+	DefaultWatchRetryMaxDelay = time.Duration(1 * time.Minute)
+
+	// DefaultConnectRetryInitialDelay is the delay before the first retry of a failed zookeeper connection
+	DefaultConnectRetryInitialDelay = time.Duration(1 * time.Second)
+
+	// DefaultConnectRetryMaxDelay is the upper bound on the delay between zookeeper connection attempts
+	DefaultConnectRetryMaxDelay = time.Duration(30 * time.Second)
+)
+
+// retryOptions describes an exponential backoff policy
+type retryOptions struct {
+	initialDelay time.Duration
+	maxDelay     time.Duration
+
+	// maxAttempts is the maximum number of attempts.  A nonpositive value means retry forever.
+	maxAttempts int
+}
+
+// backoff produces the successive delays for an exponential backoff policy.
+// A backoff is not safe for concurrent use.
+type backoff struct {
+	options  retryOptions
+	attempts int
+	delay    time.Duration
+}
+
+func newBackoff(options retryOptions) *backoff {
+	return &backoff{
+		options: options,
+		delay:   options.initialDelay,
+	}
+}
+
+// next returns the delay to wait before the next attempt.  If no more attempts are
+// allowed, this method returns false.
+func (this *backoff) next() (time.Duration, bool) {
+	if this.options.maxAttempts > 0 && this.attempts >= this.options.maxAttempts {
+		return 0, false
+	}
+
+	delay := this.delay
+	this.attempts++
+	this.delay *= 2
+	if this.delay > this.options.maxDelay {
+		this.delay = this.options.maxDelay
+	}
+
+	if delay > this.options.maxDelay {
+		delay = this.options.maxDelay
+	}
+
+	return delay, true
+}
+
+// jitterDelays returns count delays spread across [0, maxJitter).  Each delay falls at a random
+// point within its own equal share of the interval, so that the delays are staggered relative to
+// each other while the set as a whole is still randomized.  The random function must return
+// values in [0, 1), as rand.Float64 does.
+func jitterDelays(count int, maxJitter time.Duration, random func() float64) []time.Duration {
+	delays := make([]time.Duration, count)
+	share := float64(maxJitter) / float64(count)
+	for index := range delays {
+		delays[index] = time.Duration((float64(index) + random()) * share)
+	}
+
+	return delays
+}
@@ -0,0 +1,170 @@
+package service
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	var testData = []struct {
+		options        retryOptions
+		expectedDelays []time.Duration
+	}{
+		{
+			retryOptions{initialDelay: time.Second, maxDelay: 10 * time.Second, maxAttempts: 6},
+			[]time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second},
+		},
+		{
+			retryOptions{initialDelay: time.Second, maxDelay: time.Second, maxAttempts: 2},
+			[]time.Duration{time.Second, time.Second},
+		},
+		{
+			retryOptions{initialDelay: 5 * time.Second, maxDelay: time.Second, maxAttempts: 1},
+			[]time.Duration{time.Second},
+		},
+	}
+
+	for _, record := range testData {
+		backoff := newBackoff(record.options)
+		for _, expected := range record.expectedDelays {
+			actual, ok := backoff.next()
+			assert.True(ok)
+			assert.Equal(expected, actual)
+		}
+
+		_, ok := backoff.next()
+		assert.False(ok)
+	}
+}
+
+func TestBackoffUnlimitedAttempts(t *testing.T) {
+	assert := assert.New(t)
+
+	backoff := newBackoff(retryOptions{initialDelay: time.Millisecond, maxDelay: time.Second})
+	for attempt := 0; attempt < 1000; attempt++ {
+		delay, ok := backoff.next()
+		assert.True(ok)
+		assert.True(delay <= time.Second)
+	}
+}
+
+func TestWatchRetryOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	options, err := (&DiscoveryBuilder{}).watchRetryOptions()
+	assert.Nil(err)
+	assert.Equal(retryOptions{DefaultWatchRetryInitialDelay, DefaultWatchRetryMaxDelay, 0}, options)
+
+	options, err = (&DiscoveryBuilder{WatchRetryInitialDelay: "250ms", WatchRetryMaxDelay: "30", WatchRetryMaxAttempts: 5}).watchRetryOptions()
+	assert.Nil(err)
+	assert.Equal(retryOptions{250 * time.Millisecond, 30 * time.Second, 5}, options)
+
+	for _, builder := range []DiscoveryBuilder{
+		{WatchRetryInitialDelay: "not a duration"},
+		{WatchRetryMaxDelay: "not a duration"},
+		{WatchRetryInitialDelay: "-1s"},
+		{WatchRetryInitialDelay: "10s", WatchRetryMaxDelay: "1s"},
+	} {
+		_, err = builder.watchRetryOptions()
+		assert.Equal(ErrorInvalidWatchRetryDelay, err)
+	}
+}
+
+func TestConnectRetryOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	options, deadline, err := (&DiscoveryBuilder{}).connectRetryOptions()
+	assert.Nil(options)
+	assert.Zero(deadline)
+	assert.Nil(err)
+
+	options, deadline, err = (&DiscoveryBuilder{ConnectDeadline: "1m"}).connectRetryOptions()
+	if assert.NotNil(options) {
+		assert.Equal(retryOptions{DefaultConnectRetryInitialDelay, DefaultConnectRetryMaxDelay, 0}, *options)
+	}
+
+	assert.Equal(time.Minute, deadline)
+	assert.Nil(err)
+
+	options, deadline, err = (&DiscoveryBuilder{ConnectRetryInitialDelay: "250ms", ConnectRetryMaxDelay: "5"}).connectRetryOptions()
+	if assert.NotNil(options) {
+		assert.Equal(retryOptions{250 * time.Millisecond, 5 * time.Second, 0}, *options)
+	}
+
+	assert.Zero(deadline)
+	assert.Nil(err)
+
+	for _, builder := range []DiscoveryBuilder{
+		{ConnectRetryInitialDelay: "not a duration"},
+		{ConnectRetryMaxDelay: "not a duration"},
+		{ConnectDeadline: "not a duration"},
+		{ConnectRetryInitialDelay: "0s"},
+		{ConnectDeadline: "-1s"},
+		{ConnectRetryInitialDelay: "10s", ConnectRetryMaxDelay: "1s"},
+	} {
+		_, _, err = builder.connectRetryOptions()
+		assert.Equal(ErrorInvalidConnectRetry, err)
+	}
+}
+
+func TestJitterDelays(t *testing.T) {
+	assert := assert.New(t)
+
+	var testData = []struct {
+		count     int
+		random    float64
+		maxJitter time.Duration
+		expected  []time.Duration
+	}{
+		{0, 0.5, time.Second, []time.Duration{}},
+		{1, 0.0, time.Second, []time.Duration{0}},
+		{1, 0.5, time.Second, []time.Duration{500 * time.Millisecond}},
+		{4, 0.0, time.Second, []time.Duration{0, 250 * time.Millisecond, 500 * time.Millisecond, 750 * time.Millisecond}},
+		{4, 0.5, time.Second, []time.Duration{125 * time.Millisecond, 375 * time.Millisecond, 625 * time.Millisecond, 875 * time.Millisecond}},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		random := record.random
+		assert.Equal(record.expected, jitterDelays(record.count, record.maxJitter, func() float64 { return random }))
+	}
+
+	// every delay falls within its own share of the interval
+	delays := jitterDelays(10, time.Second, rand.Float64)
+	for index, delay := range delays {
+		assert.True(delay >= time.Duration(index)*100*time.Millisecond, "%d: %s", index, delay)
+		assert.True(delay < time.Duration(index+1)*100*time.Millisecond, "%d: %s", index, delay)
+	}
+}
+
+func TestReconnectJitter(t *testing.T) {
+	assert := assert.New(t)
+
+	var testData = []struct {
+		value       string
+		expected    time.Duration
+		expectError bool
+	}{
+		{"", 0, false},
+		{"0", 0, false},
+		{"250ms", 250 * time.Millisecond, false},
+		{"30", 30 * time.Second, false},
+		{"-1s", -1, true},
+		{"not a duration", -1, true},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		jitter, err := (&DiscoveryBuilder{ReconnectJitter: record.value}).reconnectJitter()
+		assert.Equal(record.expected, jitter)
+		if record.expectError {
+			assert.Equal(ErrorInvalidReconnectJitter, err)
+		} else {
+			assert.Nil(err)
+		}
+	}
+}
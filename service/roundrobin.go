@@ -0,0 +1,83 @@
+package service
+
+import (
+	"github.com/foursquare/fsgo/net/discovery"
+	"sync"
+)
+
+// Selector chooses one instance of a service for each call to Next, from the instances most
+// recently passed to its ServicesChanged method.  Next returns nil when there are no instances.
+// RoundRobin and WeightedRandom are Selectors.  Implementations must be safe for concurrent use.
+type Selector interface {
+	Listener
+	Next() *discovery.ServiceInstance
+}
+
+// RoundRobin selects service instances in turn from a snapshot of Instances.  A RoundRobin
+// is also a Listener, so it can be added to a Discovery to keep its snapshot current.
+// A RoundRobin is safe for concurrent use.
+type RoundRobin struct {
+	mutex     sync.Mutex
+	instances Instances
+	next      int
+}
+
+var _ Selector = (*RoundRobin)(nil)
+
+// NewRoundRobin creates a RoundRobin which selects from a copy of the given Instances
+func NewRoundRobin(instances Instances) *RoundRobin {
+	roundRobin := &RoundRobin{}
+	roundRobin.Update(instances)
+	return roundRobin
+}
+
+// Next returns the next instance in turn.  If there are no instances, this method returns nil.
+func (this *RoundRobin) Next() *discovery.ServiceInstance {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if len(this.instances) == 0 {
+		return nil
+	}
+
+	serviceInstance := this.instances[this.next]
+	this.next = (this.next + 1) % len(this.instances)
+	return serviceInstance
+}
+
+// Update replaces the instances this RoundRobin selects from.  If the instance that would have
+// been returned next is still present, as determined by InstanceId, it is still returned next.
+// Otherwise, selection continues from the same position in the new instances.
+func (this *RoundRobin) Update(instances Instances) {
+	updated := make(Instances, 0, len(instances))
+	for _, serviceInstance := range instances {
+		if serviceInstance != nil {
+			updated = append(updated, serviceInstance)
+		}
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	next := this.next
+	if len(this.instances) > 0 {
+		nextId := this.instances[this.next].Id
+		for index, serviceInstance := range updated {
+			if serviceInstance.Id == nextId {
+				next = index
+				break
+			}
+		}
+	}
+
+	if len(updated) > 0 {
+		this.next = next % len(updated)
+	} else {
+		this.next = 0
+	}
+
+	this.instances = updated
+}
+
+// ServicesChanged updates this RoundRobin with the new instances
+func (this *RoundRobin) ServicesChanged(serviceName string, instances Instances) {
+	this.Update(instances)
+}
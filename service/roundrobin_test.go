@@ -0,0 +1,120 @@
+package service
+
+import (
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+// nextIds returns the Ids of the next count instances selected by a RoundRobin
+func nextIds(roundRobin *RoundRobin, count int) []string {
+	ids := make([]string, 0, count)
+	for repeat := 0; repeat < count; repeat++ {
+		if serviceInstance := roundRobin.Next(); serviceInstance != nil {
+			ids = append(ids, serviceInstance.Id)
+		} else {
+			ids = append(ids, "")
+		}
+	}
+
+	return ids
+}
+
+func TestRoundRobinNext(t *testing.T) {
+	assert := assert.New(t)
+
+	var testData = []struct {
+		instances Instances
+		expected  []string
+	}{
+		{nil, []string{"", ""}},
+		{Instances{}, []string{"", ""}},
+		{Instances{nil}, []string{"", ""}},
+		{Instances{newTestInstance("a", "host.com", 80)}, []string{"a", "a", "a"}},
+		{
+			Instances{newTestInstance("a", "host.com", 80), nil, newTestInstance("b", "host.com", 81), newTestInstance("c", "host.com", 82)},
+			[]string{"a", "b", "c", "a", "b"},
+		},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert.Equal(record.expected, nextIds(NewRoundRobin(record.instances), len(record.expected)))
+	}
+}
+
+func TestRoundRobinUpdate(t *testing.T) {
+	assert := assert.New(t)
+
+	a := newTestInstance("a", "host.com", 80)
+	b := newTestInstance("b", "host.com", 81)
+	c := newTestInstance("c", "host.com", 82)
+	d := newTestInstance("d", "host.com", 83)
+
+	var testData = []struct {
+		initial  Instances
+		advance  int
+		updated  Instances
+		expected []string
+	}{
+		// the next instance is preserved even when it moves
+		{Instances{a, b, c}, 1, Instances{d, c, b, a}, []string{"b", "a", "d", "c"}},
+		{Instances{a, b, c}, 2, Instances{c, d}, []string{"c", "d", "c"}},
+
+		// when the next instance is removed, selection continues from the same position
+		{Instances{a, b, c}, 1, Instances{a, c, d}, []string{"c", "d", "a"}},
+		{Instances{a, b, c}, 2, Instances{a, b}, []string{"a", "b"}},
+
+		// empty sets
+		{Instances{a, b, c}, 1, Instances{}, []string{"", ""}},
+		{Instances{}, 1, Instances{a, b}, []string{"a", "b", "a"}},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		roundRobin := NewRoundRobin(record.initial)
+		nextIds(roundRobin, record.advance)
+		roundRobin.ServicesChanged(testServiceName, record.updated)
+		assert.Equal(record.expected, nextIds(roundRobin, len(record.expected)))
+	}
+}
+
+func TestRoundRobinIsolation(t *testing.T) {
+	assert := assert.New(t)
+
+	instances := Instances{newTestInstance("a", "host.com", 80), newTestInstance("b", "host.com", 81)}
+	roundRobin := NewRoundRobin(instances)
+	instances[0] = newTestInstance("changed", "host.com", 80)
+	assert.Equal([]string{"a", "b"}, nextIds(roundRobin, 2))
+}
+
+func TestRoundRobinConcurrency(t *testing.T) {
+	assert := assert.New(t)
+
+	roundRobin := NewRoundRobin(Instances{newTestInstance("a", "host.com", 80)})
+	updates := []Instances{
+		{newTestInstance("a", "host.com", 80), newTestInstance("b", "host.com", 81)},
+		{},
+		{newTestInstance("c", "host.com", 82)},
+	}
+
+	waitGroup := &sync.WaitGroup{}
+	waitGroup.Add(2)
+	go func() {
+		defer waitGroup.Done()
+		for repeat := 0; repeat < 1000; repeat++ {
+			roundRobin.Update(updates[repeat%len(updates)])
+		}
+	}()
+
+	go func() {
+		defer waitGroup.Done()
+		for repeat := 0; repeat < 1000; repeat++ {
+			if serviceInstance := roundRobin.Next(); serviceInstance != nil {
+				assert.Contains([]string{"a", "b", "c"}, serviceInstance.Id)
+			}
+		}
+	}()
+
+	waitGroup.Wait()
+}
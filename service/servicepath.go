@@ -0,0 +1,129 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+const (
+	// ServicePathCreate is the ServicePathMode which creates the znode of each watched service,
+	// including any parents, if it does not exist.  This is the default.
+	ServicePathCreate = "create"
+
+	// ServicePathRequire is the ServicePathMode which requires the znode of each watched service
+	// to exist already.  A missing znode fails initialization, and nothing is ever created, which
+	// suits clients whose zookeeper ACLs forbid creation.
+	ServicePathRequire = "require"
+
+	// ServicePathWaitForCreation is the ServicePathMode which waits for the znode of each watched
+	// service to be created by someone else.  The service is not initialized until then, and is
+	// read and watched as soon as its znode appears.  Nothing is ever created.
+	ServicePathWaitForCreation = "waitForCreation"
+)
+
+// servicePathMode is the parsed form of a ServicePathMode
+type servicePathMode int
+
+const (
+	servicePathCreate servicePathMode = iota
+	servicePathRequire
+	servicePathWaitForCreation
+)
+
+// parseServicePathMode parses a configured ServicePathMode.  An empty value is ServicePathCreate.
+func parseServicePathMode(value string) (servicePathMode, error) {
+	switch value {
+	case "", ServicePathCreate:
+		return servicePathCreate, nil
+	case ServicePathRequire:
+		return servicePathRequire, nil
+	case ServicePathWaitForCreation:
+		return servicePathWaitForCreation, nil
+	default:
+		return servicePathCreate, ErrorInvalidServicePathMode
+	}
+}
+
+// preparePath readies this watcher's service path for reading, according to its servicePathMode.
+// If the path does not exist yet and this watcher waits for its creation, this method returns false.
+func (this *serviceWatcher) preparePath() (bool, error) {
+	switch this.pathMode {
+	case servicePathRequire:
+		this.logger.Debug("Checking that %s exists ...", this.servicePath)
+		exists, err := this.client.exists(this.context, this.servicePath)
+		if err != nil {
+			return false, errors.New(
+				fmt.Sprintf("Error during initialization while checking path %s: %v", this.servicePath, err),
+			)
+		} else if !exists {
+			return false, errors.New(
+				fmt.Sprintf("Error during initialization: path %s does not exist", this.servicePath),
+			)
+		}
+
+		return true, nil
+
+	case servicePathWaitForCreation:
+		return this.watchForCreation()
+
+	default:
+		this.logger.Debug("Ensuring %s exists ...", this.servicePath)
+		if err := this.client.ensurePath(this.context, this.servicePath); err != nil {
+			return false, errors.New(
+				fmt.Sprintf("Error during initialization while ensuring path %s: %v", this.servicePath, err),
+			)
+		}
+
+		return true, nil
+	}
+}
+
+// watchForCreation sets a zookeeper watch on the existence of this watcher's service path, which
+// fires when the path is created.  If the path already exists, this method returns true, unless the
+// creation was handled concurrently by pathCreated.
+func (this *serviceWatcher) watchForCreation() (bool, error) {
+	// the flag is set before the watch, so that an event arriving immediately is not missed
+	atomic.StoreUint32(&this.awaitingCreation, 1)
+	exists, err := this.client.watchExists(this.context, this.servicePath)
+	if err != nil {
+		atomic.StoreUint32(&this.awaitingCreation, 0)
+		return false, errors.New(
+			fmt.Sprintf("Error during initialization while watching for the creation of path %s: %v", this.servicePath, err),
+		)
+	} else if !exists {
+		this.logger.Info("Waiting for %s to be created", this.servicePath)
+		return false, nil
+	}
+
+	return atomic.CompareAndSwapUint32(&this.awaitingCreation, 1, 0), nil
+}
+
+// isAwaitingCreation tests if this watcher is waiting for its service path to be created
+func (this *serviceWatcher) isAwaitingCreation() bool {
+	return atomic.LoadUint32(&this.awaitingCreation) != 0
+}
+
+// pathCreated handles the creation of this watcher's service path.  If this watcher was waiting
+// for it, the services are read along with a watch and dispatched, as initialize would have done.
+// Otherwise, this method does nothing, e.g. when a removed service's watch fires.
+func (this *serviceWatcher) pathCreated() {
+	if this.isStopped() || !atomic.CompareAndSwapUint32(&this.awaitingCreation, 1, 0) {
+		return
+	}
+
+	this.logger.Info("Path %s was created", this.servicePath)
+	this.readAndDispatch()
+}
+
+// recheckCreation re-sets the watch on the existence of this watcher's service path, since
+// watches do not survive the expiration of a zookeeper session.  If the path was created in
+// the meantime, it is handled by pathCreated.
+func (this *serviceWatcher) recheckCreation() {
+	exists, err := this.client.watchExists(this.context, this.servicePath)
+	if err != nil {
+		this.logger.Error("Error while watching for the creation of path %s: %v", this.servicePath, err)
+	} else if exists {
+		this.pathCreated()
+	}
+}
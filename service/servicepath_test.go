@@ -0,0 +1,222 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestServicePathModes(t *testing.T) {
+	assert := assert.New(t)
+
+	var testData = []struct {
+		builder           DiscoveryBuilder
+		expectedPathMode  servicePathMode
+		expectedPathModes map[string]servicePathMode
+		expectedError     error
+	}{
+		{DiscoveryBuilder{}, servicePathCreate, map[string]servicePathMode{}, nil},
+		{DiscoveryBuilder{ServicePathMode: ServicePathCreate}, servicePathCreate, map[string]servicePathMode{}, nil},
+		{DiscoveryBuilder{ServicePathMode: ServicePathRequire}, servicePathRequire, map[string]servicePathMode{}, nil},
+		{DiscoveryBuilder{ServicePathMode: ServicePathWaitForCreation}, servicePathWaitForCreation, map[string]servicePathMode{}, nil},
+		{
+			DiscoveryBuilder{ServicePathMode: ServicePathRequire, ServicePathModes: map[string]string{"optional": ServicePathWaitForCreation}},
+			servicePathRequire,
+			map[string]servicePathMode{"optional": servicePathWaitForCreation},
+			nil,
+		},
+		{DiscoveryBuilder{ServicePathMode: "sometimes"}, servicePathCreate, nil, ErrorInvalidServicePathMode},
+		{DiscoveryBuilder{ServicePathModes: map[string]string{"optional": "sometimes"}}, servicePathCreate, nil, ErrorInvalidServicePathMode},
+		{DiscoveryBuilder{ReadOnly: true}, servicePathRequire, map[string]servicePathMode{}, nil},
+		{
+			DiscoveryBuilder{ReadOnly: true, ServicePathModes: map[string]string{"optional": ServicePathWaitForCreation, "default": ""}},
+			servicePathRequire,
+			map[string]servicePathMode{"optional": servicePathWaitForCreation, "default": servicePathRequire},
+			nil,
+		},
+		{DiscoveryBuilder{ReadOnly: true, ServicePathMode: ServicePathCreate}, servicePathRequire, nil, ErrorReadOnlyServicePathMode},
+		{DiscoveryBuilder{ReadOnly: true, ServicePathModes: map[string]string{"optional": ServicePathCreate}}, servicePathRequire, nil, ErrorReadOnlyServicePathMode},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		pathMode, pathModes, err := record.builder.servicePathModes()
+		assert.Equal(record.expectedPathMode, pathMode)
+		assert.Equal(record.expectedPathModes, pathModes)
+		assert.Equal(record.expectedError, err)
+	}
+
+	options := watcherOptions{pathMode: servicePathRequire, pathModes: map[string]servicePathMode{"optional": servicePathCreate}}
+	assert.Equal(servicePathRequire, options.servicePathMode("required"))
+	assert.Equal(servicePathCreate, options.servicePathMode("optional"))
+}
+
+func TestServicePathCreate(t *testing.T) {
+	assert := assert.New(t)
+
+	client := newFakeZookeeperClient()
+	servicePath := testBasePath + "/" + testServiceName
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, watcherOptions{})
+	defer serviceWatcherSet.stop()
+
+	assert.Nil(serviceWatcherSet.initialize(client))
+	exists, err := client.exists(context.Background(), servicePath)
+	assert.Nil(err)
+	assert.True(exists)
+
+	serviceWatcher, _ := serviceWatcherSet.findByName(testServiceName)
+	instances, ok := serviceWatcher.cachedInstances()
+	assert.True(ok)
+	assert.Empty(instances)
+}
+
+func TestServicePathRequire(t *testing.T) {
+	assert := assert.New(t)
+
+	client := newFakeZookeeperClient()
+	servicePath := testBasePath + "/" + testServiceName
+	options := watcherOptions{pathMode: servicePathRequire}
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, options)
+	defer serviceWatcherSet.stop()
+
+	// a missing path fails initialization, and is not created
+	err := serviceWatcherSet.initialize(client)
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), servicePath)
+		assert.Contains(err.Error(), "does not exist")
+	}
+
+	exists, _ := client.exists(context.Background(), servicePath)
+	assert.False(exists)
+
+	client.failNext(fakeExists, servicePath, errors.New("expected"))
+	err = serviceWatcherSet.initialize(client)
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "expected")
+	}
+
+	client.addInstance(servicePath, newTestInstance("1", "host.com", 8080))
+	assert.Nil(serviceWatcherSet.initialize(client))
+	serviceWatcher, _ := serviceWatcherSet.findByName(testServiceName)
+	instances, ok := serviceWatcher.cachedInstances()
+	assert.True(ok)
+	assert.Equal([]string{"1"}, instanceIds(instances))
+}
+
+func TestServicePathWaitForCreation(t *testing.T) {
+	assert := assert.New(t)
+
+	client := newFakeZookeeperClient()
+	servicePath := testBasePath + "/" + testServiceName
+	options := watcherOptions{pathMode: servicePathWaitForCreation}
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, options)
+	defer serviceWatcherSet.stop()
+	client.watchWith(serviceWatcherSet)
+
+	serviceWatcher, _ := serviceWatcherSet.findByName(testServiceName)
+	received := make(chan Instances, 10)
+	serviceWatcher.addListener(ListenerFunc(func(serviceName string, instances Instances) {
+		received <- instances
+	}))
+
+	// initialization succeeds without reading or creating anything
+	assert.Nil(serviceWatcherSet.initialize(client))
+	assert.True(serviceWatcher.isAwaitingCreation())
+	assert.True(client.isExistWatched(servicePath))
+	assert.False(client.isWatched(servicePath))
+	_, ok := serviceWatcher.cachedInstances()
+	assert.False(ok)
+	exists, _ := client.exists(context.Background(), servicePath)
+	assert.False(exists)
+
+	// the service is read and watched once its path is created
+	client.addInstance(servicePath, newTestInstance("1", "host.com", 8080))
+	select {
+	case instances := <-received:
+		assert.Equal([]string{"1"}, instanceIds(instances))
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The service was not read after its path was created")
+	}
+
+	assert.False(serviceWatcher.isAwaitingCreation())
+	assert.True(client.isWatched(servicePath))
+
+	// the service is then watched as usual
+	client.addInstance(servicePath, newTestInstance("2", "host.com", 8081))
+	select {
+	case instances := <-received:
+		assert.Equal([]string{"1", "2"}, instanceIds(instances))
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The service was not watched after its path was created")
+	}
+}
+
+func TestServicePathWaitForExistingPath(t *testing.T) {
+	assert := assert.New(t)
+
+	client := newFakeZookeeperClient()
+	servicePath := testBasePath + "/" + testServiceName
+	client.addInstance(servicePath, newTestInstance("1", "host.com", 8080))
+
+	options := watcherOptions{pathMode: servicePathWaitForCreation}
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, options)
+	defer serviceWatcherSet.stop()
+
+	assert.Nil(serviceWatcherSet.initialize(client))
+	serviceWatcher, _ := serviceWatcherSet.findByName(testServiceName)
+	assert.False(serviceWatcher.isAwaitingCreation())
+	instances, ok := serviceWatcher.cachedInstances()
+	assert.True(ok)
+	assert.Equal([]string{"1"}, instanceIds(instances))
+
+	client.failNext(fakeWatchExists, servicePath, errors.New("expected"))
+	_, err := serviceWatcher.watchForCreation()
+	assert.NotNil(err)
+	assert.False(serviceWatcher.isAwaitingCreation())
+}
+
+func TestServicePathRecheckCreation(t *testing.T) {
+	assert := assert.New(t)
+
+	client := newFakeZookeeperClient()
+	servicePath := testBasePath + "/" + testServiceName
+	options := watcherOptions{pathMode: servicePathWaitForCreation}
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, options)
+	defer serviceWatcherSet.stop()
+
+	assert.Nil(serviceWatcherSet.initialize(client))
+	serviceWatcher, _ := serviceWatcherSet.findByName(testServiceName)
+
+	// without a watch handler, the creation event is lost, as with an expired session
+	client.addInstance(servicePath, newTestInstance("1", "host.com", 8080))
+	assert.True(serviceWatcher.isAwaitingCreation())
+
+	serviceWatcher.recheckCreation()
+	assert.False(serviceWatcher.isAwaitingCreation())
+	instances, ok := serviceWatcher.cachedInstances()
+	assert.True(ok)
+	assert.Equal([]string{"1"}, instanceIds(instances))
+}
+
+func TestServicePathCreatedAfterRemoval(t *testing.T) {
+	assert := assert.New(t)
+
+	client := newFakeZookeeperClient()
+	servicePath := testBasePath + "/" + testServiceName
+	options := watcherOptions{pathMode: servicePathWaitForCreation}
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, options)
+	client.watchWith(serviceWatcherSet)
+
+	assert.Nil(serviceWatcherSet.initialize(client))
+	serviceWatcher, _ := serviceWatcherSet.findByName(testServiceName)
+	serviceWatcherSet.remove(testServiceName)
+
+	// the outstanding watch fires for a service that is no longer watched
+	client.addInstance(servicePath, newTestInstance("1", "host.com", 8080))
+	serviceWatcher.pathCreated()
+	_, ok := serviceWatcher.cachedInstances()
+	assert.False(ok)
+	assert.False(client.isWatched(servicePath))
+}
@@ -0,0 +1,333 @@
+// Package servicetest provides an in-memory service.Discovery for unit testing listeners
+// and other code which consumes discovered services, without a zookeeper ensemble.
+package servicetest
+
+import (
+	"github.com/Comcast/golang-discovery-client/service"
+	"github.com/foursquare/fsgo/net/discovery"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	mockStateNotStarted = iota
+	mockStateRunning
+	mockStateClosed
+)
+
+// mockConnectionRegistration is a ConnectionStateListener registered with a MockDiscovery
+type mockConnectionRegistration struct {
+	mock     *MockDiscovery
+	listener service.ConnectionStateListener
+}
+
+func (this *mockConnectionRegistration) Cancel() {
+	this.mock.removeConnectionRegistration(this)
+}
+
+// MockDiscovery is a service.Discovery whose services are injected by a test.  Services are held
+// and dispatched by a service.StaticDiscovery, so listeners, pattern listeners, pinning, and
+// subscriptions behave exactly as they do for a real Discovery.  Each call to SetInstances
+// dispatches the given Instances at once, which makes the sequence of events deterministic.
+//
+// In addition, a test controls the connection to zookeeper, the registrations, and the history
+// of each service.  A MockDiscovery is safe for concurrent use, and listeners may call back into
+// it, e.g. to fetch services or cancel their registration.
+type MockDiscovery struct {
+	*service.StaticDiscovery
+
+	// connectionMutex serializes the delivery of connection state changes, so that listeners
+	// observe them in order
+	connectionMutex sync.Mutex
+
+	// mutex guards all other state.  It is never held during listener callbacks.
+	mutex                   sync.Mutex
+	state                   int
+	connected               bool
+	sessionTimeout          time.Duration
+	curatorConnection       discovery.Conn
+	connectionListeners     []*mockConnectionRegistration
+	previousConnectionState service.ConnectionStateEvent
+	registrations           service.Instances
+	history                 map[string][]service.EventRecord
+}
+
+var _ service.Discovery = (*MockDiscovery)(nil)
+
+// NewMockDiscovery creates a MockDiscovery which watches the given services.  None of the
+// services have been read, and the mock reports that it is connected.
+func NewMockDiscovery(serviceNames ...string) *MockDiscovery {
+	static, err := service.NewStaticDiscovery(nil)
+	if err != nil {
+		// no services are supplied, so there is nothing to reject
+		panic(err)
+	}
+
+	mock := &MockDiscovery{
+		StaticDiscovery: static,
+		connected:       true,
+		history:         make(map[string][]service.EventRecord),
+	}
+
+	for _, serviceName := range serviceNames {
+		mock.AddService(serviceName)
+	}
+
+	return mock
+}
+
+// SetHistory injects the records returned by History for the given service, watching the
+// service if necessary.  A MockDiscovery never records history itself.
+func (this *MockDiscovery) SetHistory(serviceName string, history []service.EventRecord) error {
+	if err := this.AddService(serviceName); err != nil {
+		return err
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.history[serviceName] = append([]service.EventRecord(nil), history...)
+	return nil
+}
+
+// History returns the records injected via SetHistory for the given service
+func (this *MockDiscovery) History(serviceName string) []service.EventRecord {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if history := this.history[serviceName]; len(history) > 0 && this.IsWatching(serviceName) {
+		return append([]service.EventRecord(nil), history...)
+	}
+
+	return nil
+}
+
+// SetConnected sets the value returned by Connected
+func (this *MockDiscovery) SetConnected(connected bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.connected = connected
+}
+
+func (this *MockDiscovery) Connected() bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.connected && this.state != mockStateClosed
+}
+
+// SetSessionTimeout sets the value returned by SessionTimeout, which is zero by default
+func (this *MockDiscovery) SetSessionTimeout(sessionTimeout time.Duration) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.sessionTimeout = sessionTimeout
+}
+
+// SessionTimeout returns the value set via SetSessionTimeout
+func (this *MockDiscovery) SessionTimeout() time.Duration {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.sessionTimeout
+}
+
+// SetCuratorConnection sets the value returned by CuratorConnection.  As with a real Discovery,
+// nil is returned whenever this mock is not running.
+func (this *MockDiscovery) SetCuratorConnection(curatorConnection discovery.Conn) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.curatorConnection = curatorConnection
+}
+
+func (this *MockDiscovery) CuratorConnection() discovery.Conn {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.state != mockStateRunning {
+		return nil
+	}
+
+	return this.curatorConnection
+}
+
+func (this *MockDiscovery) BlockUntilConnected() error {
+	return nil
+}
+
+func (this *MockDiscovery) BlockUntilConnectedTimeout(maxWaitTime time.Duration) error {
+	return nil
+}
+
+func (this *MockDiscovery) AddConnectionStateListener(listener service.ConnectionStateListener) service.Registration {
+	registration := &mockConnectionRegistration{mock: this, listener: listener}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.connectionListeners = append(this.connectionListeners, registration)
+	return registration
+}
+
+func (this *MockDiscovery) removeConnectionRegistration(registration *mockConnectionRegistration) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for index, candidate := range this.connectionListeners {
+		if candidate == registration {
+			this.connectionListeners = append(this.connectionListeners[:index:index], this.connectionListeners[index+1:]...)
+			return
+		}
+	}
+}
+
+// ChangeConnectionState delivers a ConnectionStateEvent for the given state to every
+// ConnectionStateListener.  The event's PreviousState is the state of the prior call.
+func (this *MockDiscovery) ChangeConnectionState(state service.ConnectionStateEvent) {
+	this.connectionMutex.Lock()
+	defer this.connectionMutex.Unlock()
+
+	this.mutex.Lock()
+	state.PreviousState = this.previousConnectionState.State
+	if state.Timestamp.IsZero() {
+		state.Timestamp = time.Now()
+	}
+
+	this.previousConnectionState = state
+	listeners := this.connectionListeners
+	this.mutex.Unlock()
+
+	for _, registration := range listeners {
+		registration.listener.ConnectionStateChanged(state)
+	}
+}
+
+// StatusHandler renders the injected state of this mock in the same format as a real Discovery
+func (this *MockDiscovery) StatusHandler() http.Handler {
+	return service.NewStatusHandler(this.status)
+}
+
+func (this *MockDiscovery) status(serviceNames []string) (service.Status, error) {
+	if len(serviceNames) == 0 {
+		serviceNames = this.ServiceNames()
+	}
+
+	this.mutex.Lock()
+	status := service.Status{
+		Connected:       this.connected && this.state != mockStateClosed,
+		ConnectionState: this.previousConnectionState.State.String(),
+		Services:        make(map[string]service.ServiceStatus),
+	}
+
+	if this.sessionTimeout > 0 {
+		status.SessionTimeout = this.sessionTimeout.String()
+	}
+
+	this.mutex.Unlock()
+	for _, serviceName := range serviceNames {
+		instances, err := this.FetchServices(serviceName)
+		if err != nil && err != service.ErrorServiceNotReady {
+			return service.Status{}, err
+		}
+
+		status.Services[serviceName] = service.ServiceStatus{
+			Initialized:   err == nil,
+			InstanceCount: len(instances),
+			Instances:     service.NewInstanceStatuses(instances),
+			History:       this.History(serviceName),
+		}
+	}
+
+	return status, nil
+}
+
+// SetRegistrations sets the Instances returned by Registrations
+func (this *MockDiscovery) SetRegistrations(registrations service.Instances) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.registrations = registrations
+}
+
+func (this *MockDiscovery) Registrations() service.Instances {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return cloneInstances(this.registrations)
+}
+
+// cloneInstances copies each ServiceInstance, as Registrations does for a real Discovery
+func cloneInstances(instances service.Instances) service.Instances {
+	clone := make(service.Instances, len(instances))
+	for index, serviceInstance := range instances {
+		if serviceInstance != nil {
+			instanceClone := *serviceInstance
+			clone[index] = &instanceClone
+		}
+	}
+
+	return clone
+}
+
+func (this *MockDiscovery) Deregister() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.registrations = nil
+	return nil
+}
+
+// Register adds copies of the given instances to the Registrations of this mock, each with a
+// new Id as with a real Discovery.  The copies are returned.  Unlike a real Discovery, a mock
+// need not be running, although service.ErrorClosed is returned once it is closed.
+func (this *MockDiscovery) Register(instances service.Instances) (service.Instances, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.state == mockStateClosed {
+		return nil, service.ErrorClosed
+	}
+
+	registered := make(service.Instances, 0, len(instances))
+	for _, original := range instances {
+		registered = append(registered, discovery.NewServiceInstance(original.Name, original.Address, original.Port, original.SslPort, original.Payload))
+	}
+
+	this.registrations = append(this.registrations, registered...)
+	return cloneInstances(registered), nil
+}
+
+// DeregisterInstances removes the Registrations with the same Ids as the given instances
+func (this *MockDiscovery) DeregisterInstances(instances service.Instances) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	ids := make(map[string]bool, len(instances))
+	for _, serviceInstance := range instances {
+		ids[serviceInstance.Id] = true
+	}
+
+	remaining := make(service.Instances, 0, len(this.registrations))
+	for _, serviceInstance := range this.registrations {
+		if !ids[serviceInstance.Id] {
+			remaining = append(remaining, serviceInstance)
+		}
+	}
+
+	this.registrations = remaining
+	return nil
+}
+
+// Run marks this mock as running.  No goroutines are started, so the WaitGroup is not used.
+func (this *MockDiscovery) Run(waitGroup *sync.WaitGroup, shutdown <-chan struct{}) error {
+	if err := this.StaticDiscovery.Run(waitGroup, shutdown); err != nil {
+		return err
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.state == mockStateClosed {
+		return service.ErrorClosed
+	}
+
+	this.state = mockStateRunning
+	return nil
+}
+
+// Close removes every listener and deregisters all registrations.  Afterward, methods
+// return service.ErrorClosed just as with a real Discovery.
+func (this *MockDiscovery) Close() error {
+	this.mutex.Lock()
+	this.state = mockStateClosed
+	this.connectionListeners = nil
+	this.registrations = nil
+	this.mutex.Unlock()
+	return this.StaticDiscovery.Close()
+}
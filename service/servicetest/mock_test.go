@@ -0,0 +1,604 @@
+package servicetest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/Comcast/golang-discovery-client/service"
+	"github.com/foursquare/curator.go"
+	"github.com/foursquare/fsgo/net/discovery"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testInstances(ids ...string) service.Instances {
+	instances := make(service.Instances, 0, len(ids))
+	for _, id := range ids {
+		port := 8080
+		serviceInstance := discovery.NewServiceInstance("test", "localhost", &port, nil, nil)
+		serviceInstance.Id = id
+		serviceInstance.RegistrationTimeUTC = 0
+		instances = append(instances, serviceInstance)
+	}
+
+	return instances
+}
+
+type eventRecorder struct {
+	mutex  sync.Mutex
+	events []service.InstanceEvent
+}
+
+func (this *eventRecorder) ServicesChanged(serviceName string, instances service.Instances) {
+	this.InstancesChanged(serviceName, service.InstanceEvent{Current: instances})
+}
+
+func (this *eventRecorder) InstancesChanged(serviceName string, event service.InstanceEvent) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.events = append(this.events, event)
+}
+
+func (this *eventRecorder) recorded() []service.InstanceEvent {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return append([]service.InstanceEvent(nil), this.events...)
+}
+
+func TestMockDiscoverySetInstances(t *testing.T) {
+	assert := assert.New(t)
+	mock := NewMockDiscovery("a", "b")
+	assert.Equal([]string{"a", "b"}, mock.ServiceNames())
+	assert.Equal(2, mock.ServiceCount())
+
+	_, err := mock.FetchServices("a")
+	assert.Equal(service.ErrorServiceNotReady, err)
+
+	listener := &eventRecorder{}
+	registration, err := mock.AddListener("a", listener)
+	assert.Nil(err)
+	assert.Equal(1, mock.ListenerCount("a"))
+	assert.Equal(0, mock.ListenerCount("b"))
+
+	// setting instances dispatches them at once
+	assert.Nil(mock.SetInstances("a", testInstances("1", "2")))
+	assert.Nil(mock.SetInstances("a", testInstances("2", "3")))
+	instances, revision, err := mock.FetchRevision("a")
+	assert.Nil(err)
+	assert.Equal(testInstances("2", "3"), instances)
+	assert.Equal(uint64(2), revision)
+
+	events := listener.recorded()
+	if assert.Equal(2, len(events)) {
+		assert.Equal(testInstances("1", "2"), events[0].Added)
+		assert.Empty(events[0].Removed)
+		assert.Equal(uint64(1), events[0].Sequence)
+
+		assert.Equal(testInstances("3"), events[1].Added)
+		assert.Equal(testInstances("1"), events[1].Removed)
+		assert.Equal(testInstances("2", "3"), events[1].Current)
+		assert.Equal(uint64(2), events[1].Sequence)
+	}
+
+	// plain listeners receive the current instances
+	var plainInstances service.Instances
+	plain := service.ListenerFunc(func(serviceName string, instances service.Instances) {
+		plainInstances = instances
+	})
+
+	_, err = mock.AddListener("a", plain)
+	assert.Nil(err)
+	assert.Equal(testInstances("2", "3"), plainInstances)
+
+	registration.Cancel()
+	assert.Equal(1, mock.ListenerCount("a"))
+	assert.Nil(mock.SetInstances("a", testInstances("4")))
+	assert.Equal(2, len(listener.recorded()))
+	assert.Equal(testInstances("4"), plainInstances)
+
+	metrics, err := mock.Metrics("a")
+	assert.Nil(err)
+	assert.Equal(1, metrics.Instances)
+}
+
+func TestMockDiscoveryReplay(t *testing.T) {
+	assert := assert.New(t)
+	mock := NewMockDiscovery()
+	mock.SetInstances("a", testInstances("1"))
+
+	listener := &eventRecorder{}
+	_, err := mock.AddListener("a", listener)
+	assert.Nil(err)
+
+	events := listener.recorded()
+	if assert.Equal(1, len(events)) {
+		assert.Equal(testInstances("1"), events[0].Added)
+		assert.Equal(testInstances("1"), events[0].Current)
+		assert.Equal(uint64(1), events[0].Sequence)
+	}
+
+	_, err = mock.AddListener("nosuch", listener)
+	assert.Equal(service.ErrorNoSuchService, err)
+}
+
+func TestMockDiscoveryNilInstances(t *testing.T) {
+	assert := assert.New(t)
+	mock := NewMockDiscovery()
+	mock.SetInstances("a", nil)
+
+	listener := &eventRecorder{}
+	_, err := mock.AddListener("a", listener)
+	assert.Nil(err)
+
+	events := listener.recorded()
+	if assert.Equal(1, len(events)) {
+		assert.Equal(service.Instances{}, events[0].Current)
+	}
+
+	instances, err := mock.FetchServices("a")
+	assert.Equal(service.Instances{}, instances)
+	assert.Nil(err)
+}
+
+func TestMockDiscoveryDuplicateListener(t *testing.T) {
+	assert := assert.New(t)
+	mock := NewMockDiscovery("a")
+	mock.SetInstances("a", testInstances("1"))
+
+	listener := &eventRecorder{}
+	registration, err := mock.AddListener("a", listener)
+	assert.Nil(err)
+
+	duplicate, err := mock.AddListener("a", listener)
+	assert.Equal(registration, duplicate)
+	assert.Nil(err)
+	assert.Equal(1, mock.ListenerCount("a"))
+	assert.Equal(1, len(listener.recorded()))
+}
+
+func TestMockDiscoveryPatternListeners(t *testing.T) {
+	assert := assert.New(t)
+	mock := NewMockDiscovery("api-east", "api-west", "db")
+
+	_, err := mock.AddListenerForServices("[", &eventRecorder{})
+	assert.NotNil(err)
+
+	listener := &eventRecorder{}
+	registration, err := mock.AddListenerForServices("api-*", listener)
+	assert.Nil(err)
+	assert.Equal(1, mock.ListenerCount("api-east"))
+	assert.Equal(1, mock.ListenerCount("api-west"))
+	assert.Equal(0, mock.ListenerCount("db"))
+
+	// services added afterward are matched as well
+	assert.Nil(mock.AddService("api-north"))
+	assert.Equal(1, mock.ListenerCount("api-north"))
+
+	assert.Nil(mock.SetInstances("api-north", testInstances("1")))
+	assert.Nil(mock.SetInstances("db", testInstances("2")))
+	assert.Equal(1, len(listener.recorded()))
+
+	// removing a service leaves pattern listeners in place
+	assert.Nil(mock.RemoveService("api-north"))
+	assert.Equal(service.ErrorNoSuchService, mock.RemoveService("api-north"))
+	assert.Equal(1, mock.ListenerCount("api-east"))
+
+	registration.Cancel()
+	assert.Equal(0, mock.ListenerCount("api-east"))
+}
+
+func TestMockDiscoveryRemoveListener(t *testing.T) {
+	assert := assert.New(t)
+	mock := NewMockDiscovery("a")
+
+	listener := &eventRecorder{}
+	_, err := mock.AddListener("a", listener)
+	assert.Nil(err)
+
+	// functions are not comparable, so they must be removed via their Registration
+	function := service.ListenerFunc(func(string, service.Instances) {})
+	_, err = mock.AddListener("a", function)
+	assert.Nil(err)
+
+	mock.RemoveListener("a", function)
+	mock.RemoveListener("a", listener)
+	assert.Equal(1, mock.ListenerCount("a"))
+
+	assert.Nil(mock.RemoveService("a"))
+	assert.Equal(0, mock.ListenerCount("a"))
+}
+
+func TestMockDiscoveryListenerGroups(t *testing.T) {
+	assert := assert.New(t)
+	mock := NewMockDiscovery("a", "b")
+
+	listener := &eventRecorder{}
+	_, err := mock.AddListener("a", listener)
+	assert.Nil(err)
+	_, err = mock.AddGroupListener("library", "a", listener)
+	assert.Nil(err)
+	_, err = mock.AddGroupListenerForServices("library", "*", &eventRecorder{})
+	assert.Nil(err)
+	_, err = mock.AddGroupListener("library", "nosuch", listener)
+	assert.Equal(service.ErrorNoSuchService, err)
+
+	// removal by identity only affects the default group
+	mock.RemoveListener("a", listener)
+	assert.Equal(2, mock.ListenerCount("a"))
+
+	// bulk removal leaves the pattern registration in place for other services
+	assert.Equal(2, mock.RemoveGroupListeners("library", "a"))
+	assert.Equal(0, mock.ListenerCount("a"))
+	assert.Equal(1, mock.ListenerCount("b"))
+	assert.Equal(0, mock.RemoveGroupListeners("library", "nosuch"))
+
+	_, err = mock.AddListener("b", listener)
+	assert.Nil(err)
+	mock.CloseGroup("library")
+	assert.Equal(1, mock.ListenerCount("b"))
+}
+
+func TestMockDiscoveryRemoveAllListeners(t *testing.T) {
+	assert := assert.New(t)
+	mock := NewMockDiscovery("a", "b")
+
+	listener := &eventRecorder{}
+	_, err := mock.AddListener("a", listener)
+	assert.Nil(err)
+	_, err = mock.AddGroupListener("library", "a", listener)
+	assert.Nil(err)
+	_, err = mock.AddListenerForServices("*", &eventRecorder{})
+	assert.Nil(err)
+
+	assert.Equal(3, mock.ListenerCount("a"))
+	assert.Equal(1, mock.ListenerCount("b"))
+	assert.Equal(0, mock.ListenerCount("nosuch"))
+
+	assert.Equal(3, mock.RemoveAllListeners("a"))
+	assert.Equal(0, mock.RemoveAllListeners("a"))
+	assert.Equal(0, mock.ListenerCount("a"))
+	assert.Equal(1, mock.ListenerCount("b"))
+}
+
+func TestMockDiscoveryOnceListener(t *testing.T) {
+	assert := assert.New(t)
+	mock := NewMockDiscovery("a")
+	mock.SetInstances("a", testInstances("1"))
+
+	listener := &eventRecorder{}
+	_, err := mock.AddOnceListener("a", listener)
+	assert.Nil(err)
+	assert.Empty(listener.events)
+	_, err = mock.AddOnceListener("nosuch", listener)
+	assert.Equal(service.ErrorNoSuchService, err)
+
+	assert.Nil(mock.SetInstances("a", testInstances("2")))
+	assert.Nil(mock.SetInstances("a", testInstances("3")))
+	assert.Len(listener.events, 1)
+	assert.Equal(0, mock.ListenerCount("a"))
+}
+
+func TestMockDiscoveryWaitForInitialSnapshot(t *testing.T) {
+	assert := assert.New(t)
+	mock := NewMockDiscovery("a")
+
+	_, err := mock.WaitForInitialSnapshot("a", 10*time.Millisecond)
+	assert.Equal(service.ErrorInitialSnapshotTimeout, err)
+
+	_, err = mock.WaitForInitialSnapshot("nosuch", time.Second)
+	assert.Equal(service.ErrorNoSuchService, err)
+
+	go mock.SetInstances("a", testInstances("1"))
+	instances, err := mock.WaitForInitialSnapshotContext(context.Background(), "a")
+	assert.Nil(err)
+	assert.Equal(testInstances("1"), instances)
+}
+
+func TestMockDiscoveryConnectionState(t *testing.T) {
+	assert := assert.New(t)
+	mock := NewMockDiscovery()
+	assert.True(mock.Connected())
+	mock.SetConnected(false)
+	assert.False(mock.Connected())
+	assert.Equal(time.Duration(0), mock.SessionTimeout())
+	mock.SetSessionTimeout(30 * time.Second)
+	assert.Equal(30*time.Second, mock.SessionTimeout())
+
+	var events []service.ConnectionStateEvent
+	registration := mock.AddConnectionStateListener(service.ConnectionStateListenerFunc(func(event service.ConnectionStateEvent) {
+		events = append(events, event)
+	}))
+
+	mock.ChangeConnectionState(service.ConnectionStateEvent{State: curator.CONNECTED})
+	mock.ChangeConnectionState(service.ConnectionStateEvent{State: curator.SUSPENDED})
+	registration.Cancel()
+	mock.ChangeConnectionState(service.ConnectionStateEvent{State: curator.RECONNECTED})
+
+	if assert.Equal(2, len(events)) {
+		assert.Equal(curator.CONNECTED, events[0].State)
+		assert.Equal(curator.UNKNOWN, events[0].PreviousState)
+		assert.False(events[0].Timestamp.IsZero())
+		assert.Equal(curator.SUSPENDED, events[1].State)
+		assert.Equal(curator.CONNECTED, events[1].PreviousState)
+	}
+}
+
+func TestMockDiscoveryCuratorConnection(t *testing.T) {
+	assert := assert.New(t)
+	mock := NewMockDiscovery()
+	curatorConnection := curator.NewClient("localhost:2181", curator.NewRetryOneTime(time.Second))
+	mock.SetCuratorConnection(curatorConnection)
+	assert.Nil(mock.CuratorConnection())
+
+	assert.Nil(mock.Run(&sync.WaitGroup{}, nil))
+	assert.Equal(curatorConnection, mock.CuratorConnection())
+
+	assert.Nil(mock.Close())
+	assert.Nil(mock.CuratorConnection())
+}
+
+func TestMockDiscoverySnapshotTo(t *testing.T) {
+	assert := assert.New(t)
+	mock := NewMockDiscovery("a", "b")
+	mock.SetInstances("a", testInstances("1"))
+
+	var output bytes.Buffer
+	assert.Nil(mock.SnapshotTo(&output))
+
+	var document struct {
+		Version  int                          `json:"version"`
+		Services map[string]service.Instances `json:"services"`
+	}
+
+	assert.Nil(json.Unmarshal(output.Bytes(), &document))
+	assert.Equal(service.SnapshotVersion, document.Version)
+	assert.Equal(1, len(document.Services))
+	assert.Equal("1", document.Services["a"][0].Id)
+}
+
+func TestMockDiscoveryClose(t *testing.T) {
+	assert := assert.New(t)
+	mock := NewMockDiscovery("a")
+	mock.SetInstances("a", testInstances("1"))
+	mock.SetRegistrations(testInstances("r"))
+	assert.Equal(testInstances("r"), mock.Registrations())
+	assert.Nil(mock.Run(&sync.WaitGroup{}, nil))
+
+	_, err := mock.AddListener("a", &eventRecorder{})
+	assert.Nil(err)
+
+	assert.Nil(mock.Close())
+	assert.False(mock.Connected())
+	assert.Equal(0, mock.ListenerCount("a"))
+	assert.Empty(mock.Registrations())
+
+	_, err = mock.FetchServices("a")
+	assert.Equal(service.ErrorClosed, err)
+	_, err = mock.AddListener("a", &eventRecorder{})
+	assert.Equal(service.ErrorClosed, err)
+	assert.Equal(service.ErrorClosed, mock.AddService("b"))
+	assert.Equal(service.ErrorClosed, mock.Run(&sync.WaitGroup{}, nil))
+}
+
+func TestMockDiscoveryConcurrency(t *testing.T) {
+	mock := NewMockDiscovery("a")
+	listener := &eventRecorder{}
+
+	var waitGroup sync.WaitGroup
+	for index := 0; index < 10; index++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			registration, _ := mock.AddListener("a", listener)
+			mock.SetInstances("a", testInstances("1"))
+			mock.FetchServices("a")
+			mock.ListenerCount("a")
+			registration.Cancel()
+		}()
+	}
+
+	waitGroup.Wait()
+	assert.Equal(t, 0, mock.ListenerCount("a"))
+}
+
+func TestMockDiscoveryStatusHandler(t *testing.T) {
+	assert := assert.New(t)
+	mock := NewMockDiscovery("a", "b")
+	mock.SetInstances("a", testInstances("1", "2"))
+	mock.SetSessionTimeout(40 * time.Second)
+
+	response := httptest.NewRecorder()
+	mock.StatusHandler().ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/?service=a", nil))
+	assert.Equal(http.StatusOK, response.Code)
+
+	var status service.Status
+	assert.Nil(json.Unmarshal(response.Body.Bytes(), &status))
+	assert.True(status.Connected)
+	assert.Equal("40s", status.SessionTimeout)
+	if assert.Len(status.Services, 1) {
+		assert.True(status.Services["a"].Initialized)
+		assert.Equal(2, status.Services["a"].InstanceCount)
+	}
+
+	response = httptest.NewRecorder()
+	mock.StatusHandler().ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/?service=nosuch", nil))
+	assert.Equal(http.StatusNotFound, response.Code)
+}
+
+func TestMockDiscoveryHistory(t *testing.T) {
+	assert := assert.New(t)
+	mock := NewMockDiscovery("a")
+	assert.Nil(mock.History("a"))
+	assert.Nil(mock.History("nosuch"))
+
+	history := []service.EventRecord{{Revision: 1, InstanceCount: 1, AddedCount: 1, Added: []string{"1"}}}
+	mock.SetHistory("a", history)
+	mock.SetHistory("b", history)
+	assert.Equal(history, mock.History("a"))
+	assert.Equal([]string{"a", "b"}, mock.ServiceNames())
+
+	response := httptest.NewRecorder()
+	mock.StatusHandler().ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/?service=a", nil))
+	var status service.Status
+	if assert.Nil(json.Unmarshal(response.Body.Bytes(), &status)) {
+		assert.Equal(history[0].Added, status.Services["a"].History[0].Added)
+	}
+}
+
+func TestMockDiscoverySubscribe(t *testing.T) {
+	assert := assert.New(t)
+	mock := NewMockDiscovery("a")
+	_, err := mock.Subscribe("nosuch")
+	assert.Equal(service.ErrorNoSuchService, err)
+
+	subscription, err := mock.Subscribe("a")
+	if !assert.Nil(err) {
+		return
+	}
+
+	defer subscription.Close()
+	assert.Nil(mock.SetInstances("a", testInstances("1")))
+	assert.Nil(mock.SetInstances("a", testInstances("1", "2")))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	event, err := subscription.Next(ctx)
+	assert.Nil(err)
+	assert.Equal(uint64(2), event.Sequence)
+	assert.Len(event.Added, 2)
+	assert.Len(event.Current, 2)
+}
+
+func TestMockDiscoveryRegister(t *testing.T) {
+	assert := assert.New(t)
+	mock := NewMockDiscovery()
+	mock.SetRegistrations(testInstances("configured"))
+
+	registered, err := mock.Register(testInstances("", ""))
+	assert.Nil(err)
+	if assert.Len(registered, 2) {
+		assert.NotEmpty(registered[0].Id)
+		assert.NotEqual(registered[0].Id, registered[1].Id)
+	}
+
+	assert.Len(mock.Registrations(), 3)
+	assert.Nil(mock.DeregisterInstances(registered))
+	if assert.Len(mock.Registrations(), 1) {
+		assert.Equal("configured", mock.Registrations()[0].Id)
+	}
+
+	assert.Nil(mock.Close())
+	_, err = mock.Register(testInstances(""))
+	assert.Equal(service.ErrorClosed, err)
+}
+
+func TestMockDiscoveryWatchedServices(t *testing.T) {
+	assert := assert.New(t)
+	mock := NewMockDiscovery("b", "a")
+	assert.Equal([]string{"a", "b"}, mock.ServiceNames())
+	assert.True(mock.IsWatching("a"))
+	assert.False(mock.IsWatching("c"))
+
+	var events []service.WatchedServicesEvent
+	registration := mock.AddWatchedServicesListener(service.WatchedServicesListenerFunc(func(event service.WatchedServicesEvent) {
+		events = append(events, event)
+	}))
+
+	assert.Nil(mock.AddService("c"))
+	mock.SetInstances("c", testInstances("1"))
+	mock.SetInstances("d", testInstances("2"))
+	assert.Nil(mock.RemoveService("a"))
+	assert.Equal(
+		[]service.WatchedServicesEvent{
+			{Added: []string{"c"}, Current: []string{"a", "b", "c"}},
+			{Added: []string{"d"}, Current: []string{"a", "b", "c", "d"}},
+			{Removed: []string{"a"}, Current: []string{"b", "c", "d"}},
+		},
+		events,
+	)
+
+	registration.Cancel()
+	assert.Nil(mock.RemoveService("b"))
+	assert.Len(events, 3)
+}
+
+func TestMockDiscoveryAggregateListener(t *testing.T) {
+	assert := assert.New(t)
+	mock := NewMockDiscovery("a", "b")
+
+	var mutex sync.Mutex
+	var latest map[string]service.Instances
+	registration := mock.AddAggregateListener(service.AggregateListenerFunc(func(snapshots map[string]service.Instances) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		latest = snapshots
+	}))
+
+	delivered := func(expected map[string]service.Instances) func() bool {
+		return func() bool {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return reflect.DeepEqual(expected, latest)
+		}
+	}
+
+	// as with a real Discovery, snapshots are coalesced and delivered on another goroutine
+	assert.Nil(mock.SetInstances("a", testInstances("1")))
+	assert.Nil(mock.SetInstances("b", testInstances("2", "3")))
+	assert.Eventually(
+		delivered(map[string]service.Instances{"a": testInstances("1"), "b": testInstances("2", "3")}),
+		5*time.Second,
+		time.Millisecond,
+	)
+
+	registration.Cancel()
+	assert.Nil(mock.SetInstances("a", testInstances("4")))
+	time.Sleep(50 * time.Millisecond)
+	assert.True(delivered(map[string]service.Instances{"a": testInstances("1"), "b": testInstances("2", "3")})())
+}
+
+func TestMockDiscoveryPinInstances(t *testing.T) {
+	assert := assert.New(t)
+	mock := NewMockDiscovery("a")
+	recorder := &eventRecorder{}
+	_, err := mock.AddListener("a", recorder)
+	assert.Nil(err)
+
+	assert.Equal(service.ErrorNoSuchService, mock.PinInstances("unwatched", testInstances("1")))
+	assert.Nil(mock.SetInstances("a", testInstances("1", "2")))
+
+	// the pinned instances are delivered and fetched until unpinned, and setting instances delivers nothing
+	assert.Nil(mock.PinInstances("a", testInstances("2")))
+	assert.Nil(mock.SetInstances("a", testInstances("1", "2", "3")))
+	instances, err := mock.FetchServices("a")
+	assert.Nil(err)
+	assert.Equal(testInstances("2"), instances)
+
+	late := &eventRecorder{}
+	_, err = mock.AddListener("a", late)
+	assert.Nil(err)
+	if events := late.recorded(); assert.Len(events, 1) {
+		assert.True(events[0].Pinned)
+		assert.Equal(testInstances("2"), events[0].Current)
+	}
+
+	mock.Unpin("a")
+	mock.Unpin("a")
+	instances, _ = mock.FetchServices("a")
+	assert.Equal(testInstances("1", "2", "3"), instances)
+
+	events := recorder.recorded()
+	if assert.Len(events, 3) {
+		assert.False(events[0].Pinned)
+		assert.True(events[1].Pinned)
+		assert.Equal(testInstances("1"), events[1].Removed)
+		assert.False(events[2].Pinned)
+		assert.Equal(testInstances("1", "3"), events[2].Added)
+		assert.Equal(testInstances("1", "2", "3"), events[2].Current)
+	}
+}
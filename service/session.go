@@ -0,0 +1,63 @@
+package service
+
+import (
+	"encoding/binary"
+	"github.com/samuel/go-zookeeper/zk"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// connectResponseHeaderLength is the length of the start of a zookeeper connect response that
+// holds the negotiated session timeout: the frame length, the protocol version, then the timeout
+// in milliseconds, each a big-endian 32-bit integer
+const connectResponseHeaderLength = 12
+
+// negotiatedTimeout records the session timeout most recently granted by a zookeeper server.
+// The zookeeper client does not expose the negotiated timeout, so it is read from the connect
+// response of each connection made by the zk.Dialer returned by dialer.
+type negotiatedTimeout struct {
+	milliseconds int64
+}
+
+// get returns the negotiated session timeout, or zero if no session has been established
+func (this *negotiatedTimeout) get() time.Duration {
+	return time.Duration(atomic.LoadInt64(&this.milliseconds)) * time.Millisecond
+}
+
+// dialer returns a zk.Dialer which dials with the given dialer, and records the session timeout
+// from the connect response received over each connection
+func (this *negotiatedTimeout) dialer(dial zk.Dialer) zk.Dialer {
+	return func(network, address string, timeout time.Duration) (net.Conn, error) {
+		conn, err := dial(network, address, timeout)
+		if err != nil {
+			return nil, err
+		}
+
+		return &negotiatingConn{Conn: conn, negotiated: this}, nil
+	}
+}
+
+// negotiatingConn is a net.Conn which decodes the session timeout from the connect response, the
+// first frame sent by the server.  Reads are made by a single goroutine of the zookeeper client.
+type negotiatingConn struct {
+	net.Conn
+	negotiated   *negotiatedTimeout
+	header       [connectResponseHeaderLength]byte
+	headerLength int
+}
+
+func (this *negotiatingConn) Read(p []byte) (int, error) {
+	n, err := this.Conn.Read(p)
+	if this.headerLength < connectResponseHeaderLength && n > 0 {
+		this.headerLength += copy(this.header[this.headerLength:], p[:n])
+		if this.headerLength == connectResponseHeaderLength {
+			// an expired session is reported with a timeout of zero, and leaves the last value alone
+			if milliseconds := int32(binary.BigEndian.Uint32(this.header[8:])); milliseconds > 0 {
+				atomic.StoreInt64(&this.negotiated.milliseconds, int64(milliseconds))
+			}
+		}
+	}
+
+	return n, err
+}
@@ -0,0 +1,156 @@
+package service
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// connectResponse encodes the start of a zookeeper connect response with the given timeout
+func connectResponse(milliseconds int32) []byte {
+	response := make([]byte, connectResponseHeaderLength+8)
+	binary.BigEndian.PutUint32(response, uint32(len(response)-4))
+	binary.BigEndian.PutUint32(response[8:], uint32(milliseconds))
+	return response
+}
+
+func TestNegotiatedTimeout(t *testing.T) {
+	var testData = []struct {
+		responses       [][]byte
+		chunkSize       int
+		expectedTimeout time.Duration
+	}{
+		{[][]byte{}, 4, 0},
+		{[][]byte{connectResponse(40000)}, 4, 40 * time.Second},
+		{[][]byte{connectResponse(40000)}, 1, 40 * time.Second},
+		{[][]byte{connectResponse(40000)}, 100, 40 * time.Second},
+		{[][]byte{connectResponse(40000)[:10]}, 4, 0},
+		{[][]byte{connectResponse(0)}, 4, 0},
+		{[][]byte{connectResponse(40000), connectResponse(6000)}, 4, 6 * time.Second},
+		{[][]byte{connectResponse(40000), connectResponse(0)}, 4, 40 * time.Second},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+		negotiated := &negotiatedTimeout{}
+		for _, response := range record.responses {
+			client, server := net.Pipe()
+			go func(response []byte) {
+				server.Write(response)
+				server.Close()
+			}(response)
+
+			conn, err := negotiated.dialer(func(network, address string, timeout time.Duration) (net.Conn, error) {
+				return client, nil
+			})("tcp", testConnection, time.Second)
+
+			if assert.Nil(err) {
+				buffer := make([]byte, record.chunkSize)
+				read := []byte{}
+				for {
+					n, err := conn.Read(buffer)
+					read = append(read, buffer[:n]...)
+					if err == io.EOF {
+						break
+					}
+				}
+
+				// the response is passed through unchanged
+				assert.Equal(response, read)
+				conn.Close()
+			}
+		}
+
+		assert.Equal(record.expectedTimeout, negotiated.get())
+	}
+}
+
+func TestNegotiatedTimeoutDialError(t *testing.T) {
+	assert := assert.New(t)
+
+	expected := errors.New("expected")
+	negotiated := &negotiatedTimeout{}
+	conn, err := negotiated.dialer(func(network, address string, timeout time.Duration) (net.Conn, error) {
+		return nil, expected
+	})("tcp", testConnection, time.Second)
+
+	assert.Nil(conn)
+	assert.Equal(expected, err)
+}
+
+func TestSessionTimeout(t *testing.T) {
+	var testData = []struct {
+		builder         DiscoveryBuilder
+		expectedTimeout time.Duration
+		expectedError   error
+	}{
+		{DiscoveryBuilder{}, DefaultSessionTimeout, nil},
+		{DiscoveryBuilder{SessionTimeout: "0"}, DefaultSessionTimeout, nil},
+		{DiscoveryBuilder{SessionTimeout: "30"}, 30 * time.Second, nil},
+		{DiscoveryBuilder{SessionTimeout: "4500ms"}, 4500 * time.Millisecond, nil},
+		{DiscoveryBuilder{SessionTimeout: "-1s"}, -1, ErrorInvalidSessionTimeout},
+		{DiscoveryBuilder{SessionTimeout: "forever"}, -1, ErrorInvalidSessionTimeout},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+		timeout, err := record.builder.sessionTimeout()
+		assert.Equal(record.expectedTimeout, timeout)
+		assert.Equal(record.expectedError, err)
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	var testData = []struct {
+		builder         DiscoveryBuilder
+		expectedTimeout time.Duration
+		expectedError   error
+	}{
+		{DiscoveryBuilder{}, DefaultConnectTimeout, nil},
+		{DiscoveryBuilder{ConnectTimeout: "0"}, DefaultConnectTimeout, nil},
+		{DiscoveryBuilder{ConnectTimeout: "5s"}, 5 * time.Second, nil},
+		{DiscoveryBuilder{ConnectTimeout: "-1s"}, -1, ErrorInvalidConnectTimeout},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+		timeout, err := record.builder.connectTimeout()
+		assert.Equal(record.expectedTimeout, timeout)
+		assert.Equal(record.expectedError, err)
+	}
+}
+
+func TestDiscoverySessionTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	builder := &DiscoveryBuilder{Connection: testConnection, Watches: []string{testServiceName}, SessionTimeout: "30s"}
+	discovery, err := builder.New(&testLogger{t})
+	if !assert.Nil(err) {
+		return
+	}
+
+	defer discovery.Close()
+	assert.Equal(30*time.Second, discovery.(*curatorDiscovery).sessionTimeout)
+
+	// nothing is known until a session is negotiated
+	assert.Equal(time.Duration(0), discovery.SessionTimeout())
+	status, err := discovery.(*curatorDiscovery).status(nil)
+	assert.Nil(err)
+	assert.Empty(status.SessionTimeout)
+
+	discovery.(*curatorDiscovery).negotiatedSessionTimeout.milliseconds = 40000
+	assert.Equal(40*time.Second, discovery.SessionTimeout())
+	status, err = discovery.(*curatorDiscovery).status(nil)
+	assert.Nil(err)
+	assert.Equal("40s", status.SessionTimeout)
+
+	static := mustNewStaticDiscovery(t, nil)
+	assert.Equal(time.Duration(0), static.SessionTimeout())
+}
@@ -0,0 +1,75 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// SnapshotVersion is the version of the format written by Discovery.SnapshotTo.  Snapshots
+	// with any other version are rejected when warm starting.
+	SnapshotVersion = 1
+)
+
+var (
+	ErrorSnapshotVersion = errors.New(fmt.Sprintf("The snapshot is not in a supported format.  Only version %d is supported.", SnapshotVersion))
+)
+
+// snapshot is the JSON document that holds the last-known Instances of each watched service
+type snapshot struct {
+	Version  int                  `json:"version"`
+	Services map[string]Instances `json:"services"`
+}
+
+// readSnapshot decodes a snapshot, rejecting any snapshot with an unsupported version
+func readSnapshot(reader io.Reader) (map[string]Instances, error) {
+	var document snapshot
+	if err := json.NewDecoder(reader).Decode(&document); err != nil {
+		return nil, errors.New(
+			fmt.Sprintf("Unable to read the snapshot: %v", err),
+		)
+	} else if document.Version != SnapshotVersion {
+		return nil, ErrorSnapshotVersion
+	}
+
+	return document.Services, nil
+}
+
+// writeSnapshot encodes the last-known Instances of every service in this set which has
+// been read.  Services which have not been read are omitted.
+func (this *serviceWatcherSet) writeSnapshot(writer io.Writer) error {
+	document := snapshot{
+		Version:  SnapshotVersion,
+		Services: make(map[string]Instances),
+	}
+
+	for _, serviceWatcher := range this.watchers() {
+		if instances, ok := serviceWatcher.cachedInstances(); ok {
+			document.Services[serviceWatcher.serviceName] = instances
+		}
+	}
+
+	return json.NewEncoder(writer).Encode(&document)
+}
+
+// warmStart dispatches the snapshot Instances of each watched service, so that the services
+// are available before they are read from zookeeper.  Services in the snapshot which are not
+// watched are ignored.  This method returns the number of services that were warm started.
+func (this *serviceWatcherSet) warmStart(services map[string]Instances) int {
+	count := 0
+	for serviceName, instances := range services {
+		if serviceWatcher, ok := this.findByName(serviceName); ok {
+			if instances == nil {
+				instances = Instances{}
+			}
+
+			this.logger.Info("Warm starting [%s] with %d instance(s)", serviceName, len(instances))
+			serviceWatcher.dispatch(instances)
+			count++
+		}
+	}
+
+	return count
+}
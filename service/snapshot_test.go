@@ -0,0 +1,127 @@
+package service
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestWriteAndReadSnapshot(t *testing.T) {
+	assert := assert.New(t)
+
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{"first", "second", "unread"}, []string{testBasePath}, watcherOptions{})
+	first, _ := serviceWatcherSet.findByName("first")
+	first.dispatch(Instances{newTestInstance("1", "host.com", 8080), newTestInstance("2", "host.com", 8081)})
+	second, _ := serviceWatcherSet.findByName("second")
+	second.dispatch(Instances{})
+
+	var buffer bytes.Buffer
+	assert.Nil(serviceWatcherSet.writeSnapshot(&buffer))
+
+	services, err := readSnapshot(&buffer)
+	assert.Nil(err)
+	assert.Len(services, 2)
+	assert.Equal([]string{"1", "2"}, instanceIds(services["first"]))
+	assert.Equal(8081, *services["first"][1].Port)
+	assert.Empty(services["second"])
+	assert.NotContains(services, "unread")
+}
+
+func TestReadSnapshotRejectsIncompatibleFormats(t *testing.T) {
+	var testData = []struct {
+		document      string
+		expectedError error
+	}{
+		{`{"version": 2, "services": {}}`, ErrorSnapshotVersion},
+		{`{"services": {}}`, ErrorSnapshotVersion},
+		{`[]`, nil},
+		{`not json`, nil},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+		services, err := readSnapshot(strings.NewReader(record.document))
+		assert.Nil(services)
+		if assert.NotNil(err) && record.expectedError != nil {
+			assert.Equal(record.expectedError, err)
+		}
+	}
+}
+
+func TestWarmStart(t *testing.T) {
+	assert := assert.New(t)
+
+	document := `{"version": 1, "services": {"first": [{"name": "first", "id": "1", "address": "host.com", "port": 8080}], "unwatched": []}}`
+	builder := &DiscoveryBuilder{
+		Connection:        testConnection,
+		BasePath:          testBasePath,
+		Watches:           []string{"first", "second"},
+		WarmStartSnapshot: strings.NewReader(document),
+	}
+
+	discovery, err := builder.New(&testLogger{t})
+	if !assert.Nil(err) {
+		return
+	}
+
+	defer discovery.Close()
+
+	// warm started services are available before Run
+	instances, err := discovery.FetchServices("first")
+	assert.Nil(err)
+	assert.Equal([]string{"1"}, instanceIds(instances))
+
+	_, err = discovery.FetchServices("second")
+	assert.Equal(ErrorServiceNotReady, err)
+
+	_, revision, err := discovery.FetchRevision("first")
+	assert.Nil(err)
+	assert.Equal(uint64(1), revision)
+
+	var events []InstanceEvent
+	_, err = discovery.AddListener("first", InstancesListenerFunc(func(serviceName string, event InstanceEvent) {
+		events = append(events, event)
+	}))
+
+	assert.Nil(err)
+	if assert.Len(events, 1) {
+		assert.Equal([]string{"1"}, instanceIds(events[0].Current))
+	}
+
+	// the first live read replaces the snapshot and dispatches the delta
+	serviceWatcher, _ := discovery.(*curatorDiscovery).serviceWatcherSet.findByName("first")
+	serviceWatcher.dispatch(Instances{newTestInstance("2", "host.com", 8081)})
+	if assert.Len(events, 2) {
+		assert.Equal([]string{"2"}, instanceIds(events[1].Added))
+		assert.Equal([]string{"1"}, instanceIds(events[1].Removed))
+	}
+
+	instances, revision, err = discovery.FetchRevision("first")
+	assert.Nil(err)
+	assert.Equal([]string{"2"}, instanceIds(instances))
+	assert.Equal(events[len(events)-1].Sequence, revision)
+
+	var buffer bytes.Buffer
+	assert.Nil(discovery.SnapshotTo(&buffer))
+	services, err := readSnapshot(&buffer)
+	assert.Nil(err)
+	assert.Len(services, 1)
+	assert.Equal([]string{"2"}, instanceIds(services["first"]))
+}
+
+func TestWarmStartWithIncompatibleSnapshot(t *testing.T) {
+	assert := assert.New(t)
+
+	builder := &DiscoveryBuilder{
+		Connection:        testConnection,
+		BasePath:          testBasePath,
+		Watches:           []string{"first"},
+		WarmStartSnapshot: strings.NewReader(`{"version": 99}`),
+	}
+
+	discovery, err := builder.New(&testLogger{t})
+	assert.Nil(discovery)
+	assert.Equal(ErrorSnapshotVersion, err)
+}
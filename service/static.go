@@ -0,0 +1,444 @@
+package service
+
+import (
+	"context"
+	"github.com/foursquare/fsgo/net/discovery"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cachedDiscovery implements Discovery over a serviceWatcherSet whose watchers are dispatched
+// directly rather than read from zookeeper.  Its services are held and dispatched by the same
+// watchers that the zookeeper-based Discovery uses, so listeners observe the same events,
+// revisions, and ordering guarantees.
+type cachedDiscovery struct {
+	closed                 uint32
+	serviceWatcherSet      *serviceWatcherSet
+	connectionStateMonitor *connectionStateMonitor
+}
+
+// newCachedDiscovery creates a cachedDiscovery with a watcher for each of the given services,
+// none of which have been dispatched
+func newCachedDiscovery(serviceNames []string) (*cachedDiscovery, error) {
+	// as with watched instance data, instances whose data changed are dispatched even if the membership is unchanged
+	serviceWatcherSet, err := newServiceWatcherSet(NopLogger{}, serviceNames, []string{""}, watcherOptions{watchData: true})
+	if err != nil {
+		return nil, err
+	}
+
+	return &cachedDiscovery{
+		serviceWatcherSet:      serviceWatcherSet,
+		connectionStateMonitor: newConnectionStateMonitor(NopLogger{}),
+	}, nil
+}
+
+func (this *cachedDiscovery) isClosed() bool {
+	return atomic.LoadUint32(&this.closed) != 0
+}
+
+// setInstances replaces the Instances of the given service, watching the service if necessary,
+// and dispatches them to every listener of the service
+func (this *cachedDiscovery) setInstances(serviceName string, instances Instances) error {
+	if this.isClosed() {
+		return ErrorClosed
+	}
+
+	serviceWatcher, _, err := this.serviceWatcherSet.add(serviceName)
+	if err != nil {
+		return err
+	}
+
+	if instances == nil {
+		instances = Instances{}
+	}
+
+	serviceWatcher.dispatch(instances.clone())
+	return nil
+}
+
+// StaticDiscovery is a Discovery whose services are supplied by the application rather than
+// read from zookeeper, e.g. to run against a fixed set of instances during local development.
+// Services are held and dispatched by the same watchers that the zookeeper-based Discovery
+// uses, so listeners observe the same events, revisions, and ordering guarantees.
+//
+// A StaticDiscovery never connects to zookeeper.  It is usable as soon as it is created, and
+// Run does nothing.  A StaticDiscovery is safe for concurrent use.
+type StaticDiscovery struct {
+	*cachedDiscovery
+}
+
+var _ Discovery = (*StaticDiscovery)(nil)
+
+// NewStaticDiscovery creates a StaticDiscovery which watches each of the given services.  The
+// Instances of each service are dispatched immediately, so that they can be fetched, and so
+// that every listener receives them as soon as it is added.  A nil Instances is treated as an
+// empty one.  An invalid service name is rejected with a ServiceNamesError.
+func NewStaticDiscovery(services map[string]Instances) (*StaticDiscovery, error) {
+	serviceNames := make([]string, 0, len(services))
+	for serviceName := range services {
+		serviceNames = append(serviceNames, serviceName)
+	}
+
+	sort.Strings(serviceNames)
+	cached, err := newCachedDiscovery(serviceNames)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, serviceName := range serviceNames {
+		if err := cached.setInstances(serviceName, services[serviceName]); err != nil {
+			return nil, err
+		}
+	}
+
+	return &StaticDiscovery{cached}, nil
+}
+
+// SetInstances replaces the Instances of the given service, watching the service if necessary,
+// and dispatches them to every listener of the service.  Instances whose data changed are
+// reported in InstanceEvent.Updated, as with WatchInstanceData, and nothing is dispatched if
+// neither the membership nor any instance has changed.  A nil Instances is treated as an empty
+// one.  If this StaticDiscovery has been closed, ErrorClosed is returned.
+func (this *StaticDiscovery) SetInstances(serviceName string, instances Instances) error {
+	return this.setInstances(serviceName, instances)
+}
+
+// Connected always returns false, since a cachedDiscovery never connects to zookeeper
+func (this *cachedDiscovery) Connected() bool {
+	return false
+}
+
+func (this *cachedDiscovery) ServiceCount() int {
+	return this.serviceWatcherSet.serviceCount()
+}
+
+func (this *cachedDiscovery) ServiceNames() []string {
+	return this.serviceWatcherSet.cloneServiceNames()
+}
+
+func (this *cachedDiscovery) IsWatching(serviceName string) bool {
+	return this.serviceWatcherSet.isWatching(serviceName)
+}
+
+func (this *cachedDiscovery) AddWatchedServicesListener(listener WatchedServicesListener) Registration {
+	return this.serviceWatcherSet.watchedServices.addListener(listener)
+}
+
+func (this *cachedDiscovery) AddAggregateListener(listener AggregateListener) Registration {
+	return this.serviceWatcherSet.aggregates.addListener(listener)
+}
+
+func (this *cachedDiscovery) FetchServices(serviceName string) (Instances, error) {
+	instances, _, err := this.FetchRevision(serviceName)
+	return instances, err
+}
+
+// FetchRevision returns the Instances most recently dispatched for the given service.  A service
+// which was added via AddService returns ErrorServiceNotReady until its Instances are dispatched.
+func (this *cachedDiscovery) FetchRevision(serviceName string) (Instances, uint64, error) {
+	if this.isClosed() {
+		return nil, 0, ErrorClosed
+	}
+
+	serviceWatcher, ok := this.serviceWatcherSet.findByName(serviceName)
+	if !ok {
+		return nil, 0, ErrorNoSuchService
+	}
+
+	instances, revision, ok := serviceWatcher.cachedRevision()
+	if !ok {
+		return nil, 0, ErrorServiceNotReady
+	}
+
+	return instances.clone(), revision, nil
+}
+
+func (this *cachedDiscovery) PinInstances(serviceName string, pinned Instances) error {
+	if this.isClosed() {
+		return ErrorClosed
+	}
+
+	serviceWatcher, ok := this.serviceWatcherSet.findByName(serviceName)
+	if !ok {
+		return ErrorNoSuchService
+	}
+
+	serviceWatcher.pin(pinned.clone())
+	return nil
+}
+
+// Unpin removes the Instances pinned for the given service, immediately dispatching the
+// Instances most recently set for it
+func (this *cachedDiscovery) Unpin(serviceName string) {
+	if serviceWatcher, ok := this.serviceWatcherSet.findByName(serviceName); ok {
+		serviceWatcher.unpin()
+	}
+}
+
+func (this *cachedDiscovery) SnapshotTo(writer io.Writer) error {
+	return this.serviceWatcherSet.writeSnapshot(writer)
+}
+
+// InstanceBasePath returns the empty string for every known instance, since these instances
+// do not live beneath any base path
+func (this *cachedDiscovery) InstanceBasePath(serviceInstance *discovery.ServiceInstance) (string, bool) {
+	if serviceInstance == nil {
+		return "", false
+	}
+
+	if serviceWatcher, ok := this.serviceWatcherSet.findByName(serviceInstance.Name); ok {
+		return serviceWatcher.instanceBasePath(serviceInstance.Id)
+	}
+
+	return "", false
+}
+
+func (this *cachedDiscovery) StatusHandler() http.Handler {
+	return NewStatusHandler(this.status)
+}
+
+// status produces the Status of the named services, or of every watched service
+func (this *cachedDiscovery) status(serviceNames []string) (Status, error) {
+	serviceStatuses, err := this.serviceWatcherSet.serviceStatuses(serviceNames)
+	if err != nil {
+		return Status{}, err
+	}
+
+	return Status{
+		Connected:       false,
+		ConnectionState: this.connectionStateMonitor.currentState().String(),
+		Services:        serviceStatuses,
+	}, nil
+}
+
+func (this *cachedDiscovery) WaitForInitialSnapshot(serviceName string, timeout time.Duration) (Instances, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	instances, err := this.WaitForInitialSnapshotContext(ctx, serviceName)
+	if err == context.DeadlineExceeded {
+		err = ErrorInitialSnapshotTimeout
+	}
+
+	return instances, err
+}
+
+// WaitForInitialSnapshotContext returns immediately for services whose Instances have been
+// dispatched.  For a service added via AddService, it waits for the first dispatch.
+func (this *cachedDiscovery) WaitForInitialSnapshotContext(ctx context.Context, serviceName string) (Instances, error) {
+	if this.isClosed() {
+		return nil, ErrorClosed
+	}
+
+	serviceWatcher, ok := this.serviceWatcherSet.findByName(serviceName)
+	if !ok {
+		return nil, ErrorNoSuchService
+	}
+
+	instances, err := serviceWatcher.waitForInitialized(ctx)
+	if err == ErrorNoSuchService && this.isClosed() {
+		return nil, ErrorClosed
+	} else if err != nil {
+		return nil, err
+	}
+
+	return instances.clone(), nil
+}
+
+// SkippedInstances always returns zero for a watched service, since nothing is deserialized
+func (this *cachedDiscovery) SkippedInstances(serviceName string) (int, error) {
+	if _, ok := this.serviceWatcherSet.findByName(serviceName); ok {
+		return 0, nil
+	}
+
+	return 0, ErrorNoSuchService
+}
+
+// History always returns nil, since no history is kept for services which are not read from zookeeper
+func (this *cachedDiscovery) History(serviceName string) []EventRecord {
+	return nil
+}
+
+func (this *cachedDiscovery) Metrics(serviceName string) (Metrics, error) {
+	if serviceWatcher, ok := this.serviceWatcherSet.findByName(serviceName); ok {
+		return serviceWatcher.metricsSnapshot(), nil
+	}
+
+	return Metrics{}, ErrorNoSuchService
+}
+
+func (this *cachedDiscovery) AggregateMetrics() Metrics {
+	var aggregate Metrics
+	for _, serviceWatcher := range this.serviceWatcherSet.watchers() {
+		aggregate.add(serviceWatcher.metricsSnapshot())
+	}
+
+	return aggregate
+}
+
+func (this *cachedDiscovery) AddListener(serviceName string, listener Listener) (Registration, error) {
+	return this.AddGroupListener(DefaultListenerGroup, serviceName, listener)
+}
+
+func (this *cachedDiscovery) Subscribe(serviceName string) (*Subscription, error) {
+	return NewSubscription(this, serviceName)
+}
+
+func (this *cachedDiscovery) AddOnceListener(serviceName string, listener Listener) (Registration, error) {
+	if this.isClosed() {
+		return nil, ErrorClosed
+	}
+
+	if serviceWatcher, ok := this.serviceWatcherSet.findByName(serviceName); ok {
+		return serviceWatcher.addOnceListener(DefaultListenerGroup, listener)
+	}
+
+	return nil, ErrorNoSuchService
+}
+
+func (this *cachedDiscovery) AddListenerForServices(pattern string, listener Listener) (Registration, error) {
+	return this.AddGroupListenerForServices(DefaultListenerGroup, pattern, listener)
+}
+
+func (this *cachedDiscovery) RemoveListener(serviceName string, listener Listener) {
+	if serviceWatcher, ok := this.serviceWatcherSet.findByName(serviceName); ok {
+		serviceWatcher.removeListener(listener)
+	}
+}
+
+func (this *cachedDiscovery) RemoveAllListeners(serviceName string) int {
+	if serviceWatcher, ok := this.serviceWatcherSet.findByName(serviceName); ok {
+		return serviceWatcher.removeAllListeners()
+	}
+
+	return 0
+}
+
+func (this *cachedDiscovery) ListenerCount(serviceName string) int {
+	if serviceWatcher, ok := this.serviceWatcherSet.findByName(serviceName); ok {
+		return serviceWatcher.listenerCount()
+	}
+
+	return 0
+}
+
+func (this *cachedDiscovery) AddGroupListener(group, serviceName string, listener Listener) (Registration, error) {
+	if this.isClosed() {
+		return nil, ErrorClosed
+	}
+
+	if serviceWatcher, ok := this.serviceWatcherSet.findByName(serviceName); ok {
+		return serviceWatcher.addGroupListener(group, listener)
+	}
+
+	return nil, ErrorNoSuchService
+}
+
+func (this *cachedDiscovery) AddGroupListenerForServices(group, pattern string, listener Listener) (Registration, error) {
+	if this.isClosed() {
+		return nil, ErrorClosed
+	}
+
+	return this.serviceWatcherSet.addPatternListener(group, pattern, listener)
+}
+
+func (this *cachedDiscovery) RemoveGroupListeners(group, serviceName string) int {
+	if serviceWatcher, ok := this.serviceWatcherSet.findByName(serviceName); ok {
+		return serviceWatcher.removeGroupListeners(group)
+	}
+
+	return 0
+}
+
+func (this *cachedDiscovery) CloseGroup(group string) {
+	this.serviceWatcherSet.closeGroup(group)
+}
+
+// AddConnectionStateListener registers a listener which is never invoked, since a
+// cachedDiscovery has no zookeeper connection
+func (this *cachedDiscovery) AddConnectionStateListener(listener ConnectionStateListener) Registration {
+	return this.connectionStateMonitor.addListener(listener)
+}
+
+// CuratorConnection always returns nil
+func (this *cachedDiscovery) CuratorConnection() discovery.Conn {
+	return nil
+}
+
+// SessionTimeout always returns zero, since a cachedDiscovery never connects to zookeeper
+func (this *cachedDiscovery) SessionTimeout() time.Duration {
+	return 0
+}
+
+// BlockUntilConnected always returns ErrorNotRunning, since a cachedDiscovery never connects
+func (this *cachedDiscovery) BlockUntilConnected() error {
+	return ErrorNotRunning
+}
+
+// BlockUntilConnectedTimeout always returns ErrorNotRunning, since a cachedDiscovery never connects
+func (this *cachedDiscovery) BlockUntilConnectedTimeout(maxWaitTime time.Duration) error {
+	return ErrorNotRunning
+}
+
+// AddService watches the given service without any Instances.  The service is not ready
+// until its Instances are dispatched, e.g. via StaticDiscovery.SetInstances.
+func (this *cachedDiscovery) AddService(serviceName string) error {
+	if this.isClosed() {
+		return ErrorClosed
+	}
+
+	_, _, err := this.serviceWatcherSet.add(serviceName)
+	return err
+}
+
+func (this *cachedDiscovery) RemoveService(serviceName string) error {
+	if _, ok := this.serviceWatcherSet.remove(serviceName); !ok {
+		return ErrorNoSuchService
+	}
+
+	return nil
+}
+
+// Registrations always returns an empty Instances, since nothing is registered in zookeeper
+func (this *cachedDiscovery) Registrations() Instances {
+	return Instances{}
+}
+
+// Deregister does nothing
+func (this *cachedDiscovery) Deregister() error {
+	return nil
+}
+
+// Register always fails with ErrorRegistrationUnsupported, since nothing is registered in zookeeper
+func (this *cachedDiscovery) Register(instances Instances) (Instances, error) {
+	return nil, ErrorRegistrationUnsupported
+}
+
+// DeregisterInstances does nothing
+func (this *cachedDiscovery) DeregisterInstances(instances Instances) error {
+	return nil
+}
+
+// Run does nothing, since a cachedDiscovery is usable as soon as it is created.  If this
+// cachedDiscovery has been closed, ErrorClosed is returned.
+func (this *cachedDiscovery) Run(waitGroup *sync.WaitGroup, shutdown <-chan struct{}) error {
+	if this.isClosed() {
+		return ErrorClosed
+	}
+
+	return nil
+}
+
+// Close removes every listener.  Afterward, FetchServices, AddListener, and any further
+// dispatch return ErrorClosed.  Close is idempotent.
+func (this *cachedDiscovery) Close() error {
+	if atomic.CompareAndSwapUint32(&this.closed, 0, 1) {
+		this.serviceWatcherSet.stop()
+	}
+
+	return nil
+}
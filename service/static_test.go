@@ -0,0 +1,154 @@
+package service
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestStaticDiscovery(t *testing.T) {
+	assert := assert.New(t)
+
+	static, err := NewStaticDiscovery(map[string]Instances{
+		"foo": testInstancesWithIds("1", "2"),
+		"bar": nil,
+	})
+
+	if !assert.Nil(err) || !assert.NotNil(static) {
+		return
+	}
+
+	assert.Nil(static.Run(nil, nil))
+	assert.False(static.Connected())
+	assert.Equal(2, static.ServiceCount())
+	assert.ElementsMatch([]string{"bar", "foo"}, static.ServiceNames())
+
+	instances, revision, err := static.FetchRevision("foo")
+	assert.Equal([]string{"1", "2"}, instanceIds(instances))
+	assert.Equal(uint64(1), revision)
+	assert.Nil(err)
+
+	instances, err = static.FetchServices("bar")
+	assert.Equal(Instances{}, instances)
+	assert.Nil(err)
+
+	instances, err = static.FetchServices("nosuch")
+	assert.Nil(instances)
+	assert.Equal(ErrorNoSuchService, err)
+
+	// each new listener immediately receives the static snapshot
+	var events []InstanceEvent
+	registration, err := static.AddListener("foo", InstancesListenerFunc(func(serviceName string, event InstanceEvent) {
+		assert.Equal("foo", serviceName)
+		events = append(events, event)
+	}))
+
+	assert.Nil(err)
+	if assert.Len(events, 1) {
+		assert.Equal([]string{"1", "2"}, instanceIds(events[0].Current))
+		assert.Equal(uint64(1), events[0].Sequence)
+	}
+
+	// setting the instances dispatches them, unless the membership is unchanged
+	assert.Nil(static.SetInstances("foo", testInstancesWithIds("2", "3")))
+	assert.Nil(static.SetInstances("foo", testInstancesWithIds("2", "3")))
+	if assert.Len(events, 2) {
+		assert.Equal([]string{"3"}, instanceIds(events[1].Added))
+		assert.Equal([]string{"1"}, instanceIds(events[1].Removed))
+		assert.Equal(uint64(2), events[1].Sequence)
+	}
+
+	instances, revision, err = static.FetchRevision("foo")
+	assert.Equal([]string{"2", "3"}, instanceIds(instances))
+	assert.Equal(uint64(2), revision)
+	assert.Nil(err)
+
+	registration.Cancel()
+	assert.Nil(static.SetInstances("foo", Instances{}))
+	assert.Len(events, 2)
+	assert.Equal(0, static.ListenerCount("foo"))
+
+	metrics, err := static.Metrics("foo")
+	assert.Equal(0, metrics.Instances)
+	assert.Equal(uint64(3), metrics.Dispatches)
+	assert.Nil(err)
+}
+
+func TestStaticDiscoveryAddService(t *testing.T) {
+	assert := assert.New(t)
+
+	static, err := NewStaticDiscovery(nil)
+	if !assert.Nil(err) {
+		return
+	}
+
+	assert.Nil(static.AddService("foo"))
+	instances, err := static.FetchServices("foo")
+	assert.Nil(instances)
+	assert.Equal(ErrorServiceNotReady, err)
+
+	var pattern []string
+	_, err = static.AddListenerForServices("*", ListenerFunc(func(serviceName string, instances Instances) {
+		pattern = append(pattern, serviceName)
+	}))
+
+	assert.Nil(err)
+	assert.Empty(pattern)
+
+	waited := make(chan Instances, 1)
+	go func() {
+		instances, _ := static.WaitForInitialSnapshot("foo", time.Minute)
+		waited <- instances
+	}()
+
+	assert.Nil(static.SetInstances("foo", testInstancesWithIds("1")))
+	assert.Equal([]string{"1"}, instanceIds(<-waited))
+
+	// setting the instances of an unwatched service watches it
+	assert.Nil(static.SetInstances("bar", testInstancesWithIds("2")))
+	assert.Equal([]string{"foo", "bar"}, pattern)
+	assert.Equal(2, static.ServiceCount())
+
+	var snapshot bytes.Buffer
+	assert.Nil(static.SnapshotTo(&snapshot))
+	services, err := readSnapshot(&snapshot)
+	assert.Nil(err)
+	assert.Len(services, 2)
+
+	assert.Nil(static.RemoveService("bar"))
+	assert.Equal(ErrorNoSuchService, static.RemoveService("bar"))
+	assert.NotNil(static.SetInstances("invalid/name", nil))
+}
+
+func TestStaticDiscoveryClose(t *testing.T) {
+	assert := assert.New(t)
+
+	static, err := NewStaticDiscovery(map[string]Instances{"foo": testInstancesWithIds("1")})
+	if !assert.Nil(err) {
+		return
+	}
+
+	_, err = static.AddListener("foo", ListenerFunc(func(serviceName string, instances Instances) {}))
+	assert.Nil(err)
+
+	assert.Nil(static.Close())
+	assert.Nil(static.Close())
+	assert.Equal(0, static.ListenerCount("foo"))
+	assert.Equal(ErrorClosed, static.Run(nil, nil))
+	assert.Equal(ErrorClosed, static.SetInstances("foo", nil))
+
+	_, err = static.FetchServices("foo")
+	assert.Equal(ErrorClosed, err)
+
+	_, err = static.AddListener("foo", ListenerFunc(func(serviceName string, instances Instances) {}))
+	assert.Equal(ErrorClosed, err)
+}
+
+func TestNewStaticDiscoveryInvalidServiceName(t *testing.T) {
+	assert := assert.New(t)
+
+	static, err := NewStaticDiscovery(map[string]Instances{"invalid/name": nil})
+	assert.Nil(static)
+	assert.NotNil(err)
+}
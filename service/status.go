@@ -0,0 +1,216 @@
+package service
+
+import (
+	"encoding/json"
+	"github.com/foursquare/fsgo/net/discovery"
+	"net/http"
+	"time"
+)
+
+const (
+	// StatusServiceParameter is the query parameter which restricts a status handler to the
+	// named services.  It may be repeated.
+	StatusServiceParameter = "service"
+)
+
+// Status is the JSON document rendered by a Discovery's StatusHandler.  It describes what
+// the Discovery currently believes, as read from its in-memory cache.
+type Status struct {
+	// Connected reports whether the zookeeper connection is currently established
+	Connected bool `json:"connected"`
+
+	// ConnectionState is the most recent curator connection state, e.g. "CONNECTED"
+	ConnectionState string `json:"connectionState"`
+
+	// SessionTimeout is the zookeeper session timeout negotiated by the connection, e.g. "40s",
+	// and is omitted if it is not known
+	SessionTimeout string `json:"sessionTimeout,omitempty"`
+
+	// Services holds the status of each watched service, by name
+	Services map[string]ServiceStatus `json:"services"`
+}
+
+// ServiceStatus describes the last-known state of a single watched service
+type ServiceStatus struct {
+	// Initialized reports whether the service's instances are known, either because the
+	// service has been read or because it was warm started
+	Initialized bool `json:"initialized"`
+
+	// InstanceCount is the number of instances in the last-known set of services
+	InstanceCount int `json:"instanceCount"`
+
+	// Instances describes each instance in the last-known set of services
+	Instances []InstanceStatus `json:"instances"`
+
+	// LastRead is the time of the most recent successful read from zookeeper, if any
+	LastRead *time.Time `json:"lastRead,omitempty"`
+
+	// LastError is the error from the most recent failed read from zookeeper, if any.
+	// A failure is reported even when later reads have succeeded.
+	LastError string `json:"lastError,omitempty"`
+
+	// LastErrorTime is the time of the most recent failed read from zookeeper, if any
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+
+	// WatchGeneration is the number of times a watch was successfully set on the service path
+	WatchGeneration uint64 `json:"watchGeneration"`
+
+	// LastWatchSet is the time at which a watch was most recently set on the service path, if any
+	LastWatchSet *time.Time `json:"lastWatchSet,omitempty"`
+
+	// UnwatchedSince is the time from which the service path has been without a watch, if it is
+	// currently without one
+	UnwatchedSince *time.Time `json:"unwatchedSince,omitempty"`
+
+	// History holds the most recent events dispatched for the service, oldest first, when an
+	// EventHistorySize is configured
+	History []EventRecord `json:"history,omitempty"`
+}
+
+// InstanceStatus describes a single ServiceInstance
+type InstanceStatus struct {
+	Id               string    `json:"id"`
+	Address          string    `json:"address"`
+	Port             *int      `json:"port,omitempty"`
+	SslPort          *int      `json:"sslPort,omitempty"`
+	RegistrationTime time.Time `json:"registrationTime"`
+}
+
+// NewInstanceStatuses describes each ServiceInstance in the given Instances.  Nil elements are skipped.
+func NewInstanceStatuses(instances Instances) []InstanceStatus {
+	statuses := make([]InstanceStatus, 0, len(instances))
+	for _, serviceInstance := range instances {
+		if serviceInstance != nil {
+			statuses = append(statuses, newInstanceStatus(serviceInstance))
+		}
+	}
+
+	return statuses
+}
+
+func newInstanceStatus(serviceInstance *discovery.ServiceInstance) InstanceStatus {
+	// curator records the registration time in milliseconds since the epoch
+	return InstanceStatus{
+		Id:               serviceInstance.Id,
+		Address:          serviceInstance.Address,
+		Port:             serviceInstance.Port,
+		SslPort:          serviceInstance.SslPort,
+		RegistrationTime: time.Unix(0, serviceInstance.RegistrationTimeUTC*int64(time.Millisecond)).UTC(),
+	}
+}
+
+// StatusFunc produces the Status of the given services, or of every watched service when no
+// names are given.  If any of the named services is not watched, ErrorNoSuchService is returned.
+type StatusFunc func(serviceNames []string) (Status, error)
+
+// NewStatusHandler returns an http.Handler which renders the Status produced by the given
+// function as JSON.  The services may be restricted with one or more StatusServiceParameter
+// query parameters, e.g. "?service=foo&service=bar".  A request for a service that is not
+// watched results in a 404.  Only GET and HEAD requests are allowed.
+func NewStatusHandler(statusFunc StatusFunc) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodGet && request.Method != http.MethodHead {
+			response.Header().Set("Allow", "GET, HEAD")
+			http.Error(response, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		status, err := statusFunc(request.URL.Query()[StatusServiceParameter])
+		if err == ErrorNoSuchService {
+			http.Error(response, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(response, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response.Header().Set("Content-Type", "application/json")
+		response.WriteHeader(http.StatusOK)
+		if request.Method == http.MethodGet {
+			encoder := json.NewEncoder(response)
+			encoder.SetIndent("", "  ")
+			encoder.Encode(&status)
+		}
+	})
+}
+
+// serviceStatus describes this watcher's last-known services.  Only the in-memory cache and
+// metrics are consulted, never zookeeper.  For a watcher with more than one base path, the
+// most recent read and failure of any base path are reported, along with the total watch
+// generation and the watch state of the most neglected base path.
+func (this *serviceWatcher) serviceStatus() ServiceStatus {
+	instances, initialized := this.cachedInstances()
+	serviceStatus := ServiceStatus{
+		Initialized:   initialized,
+		InstanceCount: len(instances),
+		Instances:     NewInstanceStatuses(instances),
+		History:       this.history.snapshot(),
+	}
+
+	for _, pathWatcher := range this.pathWatchers() {
+		lastSuccess, failure, failed := pathWatcher.metrics.lastFetch()
+		if !lastSuccess.IsZero() && (serviceStatus.LastRead == nil || lastSuccess.After(*serviceStatus.LastRead)) {
+			serviceStatus.LastRead = &lastSuccess
+		}
+
+		if failed && (serviceStatus.LastErrorTime == nil || failure.timestamp.After(*serviceStatus.LastErrorTime)) {
+			serviceStatus.LastError = failure.message
+			serviceStatus.LastErrorTime = &failure.timestamp
+		}
+
+		watchGeneration, lastWatchSet, unwatchedSince := pathWatcher.metrics.watchState()
+		serviceStatus.WatchGeneration += watchGeneration
+		if !lastWatchSet.IsZero() && (serviceStatus.LastWatchSet == nil || lastWatchSet.Before(*serviceStatus.LastWatchSet)) {
+			serviceStatus.LastWatchSet = &lastWatchSet
+		}
+
+		if !unwatchedSince.IsZero() && (serviceStatus.UnwatchedSince == nil || unwatchedSince.Before(*serviceStatus.UnwatchedSince)) {
+			serviceStatus.UnwatchedSince = &unwatchedSince
+		}
+	}
+
+	return serviceStatus
+}
+
+// serviceStatuses produces the ServiceStatus of the named services, or of every service in this set
+func (this *serviceWatcherSet) serviceStatuses(serviceNames []string) (map[string]ServiceStatus, error) {
+	serviceStatuses := make(map[string]ServiceStatus)
+	if len(serviceNames) == 0 {
+		for _, serviceWatcher := range this.watchers() {
+			serviceStatuses[serviceWatcher.serviceName] = serviceWatcher.serviceStatus()
+		}
+
+		return serviceStatuses, nil
+	}
+
+	for _, serviceName := range serviceNames {
+		serviceWatcher, ok := this.findByName(serviceName)
+		if !ok {
+			return nil, ErrorNoSuchService
+		}
+
+		serviceStatuses[serviceName] = serviceWatcher.serviceStatus()
+	}
+
+	return serviceStatuses, nil
+}
+
+// status produces the Status of the named services, or of every watched service
+func (this *curatorDiscovery) status(serviceNames []string) (Status, error) {
+	serviceStatuses, err := this.serviceWatcherSet.serviceStatuses(serviceNames)
+	if err != nil {
+		return Status{}, err
+	}
+
+	status := Status{
+		Connected:       this.Connected(),
+		ConnectionState: this.connectionStateMonitor.currentState().String(),
+		Services:        serviceStatuses,
+	}
+
+	if sessionTimeout := this.SessionTimeout(); sessionTimeout > 0 {
+		status.SessionTimeout = sessionTimeout.String()
+	}
+
+	return status, nil
+}
@@ -0,0 +1,131 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewInstanceStatuses(t *testing.T) {
+	assert := assert.New(t)
+
+	sslPort := 8443
+	serviceInstance := newTestInstance("1", "host.com", 8080)
+	serviceInstance.SslPort = &sslPort
+	serviceInstance.RegistrationTimeUTC = 1500000000123
+
+	statuses := NewInstanceStatuses(Instances{serviceInstance, nil})
+	if assert.Len(statuses, 1) {
+		assert.Equal("1", statuses[0].Id)
+		assert.Equal("host.com", statuses[0].Address)
+		assert.Equal(8080, *statuses[0].Port)
+		assert.Equal(8443, *statuses[0].SslPort)
+		assert.Equal(time.Date(2017, time.July, 14, 2, 40, 0, 123000000, time.UTC), statuses[0].RegistrationTime)
+	}
+
+	assert.Equal([]InstanceStatus{}, NewInstanceStatuses(nil))
+}
+
+func TestServiceStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, watcherOptions{})
+	defer serviceWatcherSet.stop()
+	serviceWatcher, _ := serviceWatcherSet.findByName(testServiceName)
+
+	serviceStatus := serviceWatcher.serviceStatus()
+	assert.False(serviceStatus.Initialized)
+	assert.Equal(0, serviceStatus.InstanceCount)
+	assert.Nil(serviceStatus.LastRead)
+	assert.Empty(serviceStatus.LastError)
+	assert.Nil(serviceStatus.LastErrorTime)
+	assert.Equal(uint64(0), serviceStatus.WatchGeneration)
+	assert.Nil(serviceStatus.LastWatchSet)
+	assert.Nil(serviceStatus.UnwatchedSince)
+
+	serviceWatcher.metrics.recordFetch(time.Millisecond, nil)
+	serviceWatcher.dispatch(Instances{newTestInstance("1", "host.com", 8080)})
+	serviceStatus = serviceWatcher.serviceStatus()
+	assert.True(serviceStatus.Initialized)
+	assert.Equal(1, serviceStatus.InstanceCount)
+	assert.Len(serviceStatus.Instances, 1)
+	assert.NotNil(serviceStatus.LastRead)
+	assert.Empty(serviceStatus.LastError)
+
+	// a failure is reported alongside the last successful read
+	serviceWatcher.metrics.recordFetch(time.Millisecond, errors.New("expected"))
+	serviceStatus = serviceWatcher.serviceStatus()
+	assert.NotNil(serviceStatus.LastRead)
+	assert.Equal("expected", serviceStatus.LastError)
+	if assert.NotNil(serviceStatus.LastErrorTime) {
+		assert.False(serviceStatus.LastErrorTime.Before(*serviceStatus.LastRead))
+	}
+}
+
+func TestStatusHandler(t *testing.T) {
+	builder := &DiscoveryBuilder{Connection: testConnection, BasePath: testBasePath, Watches: []string{"first", "second"}}
+	discovery, err := builder.New(&testLogger{t})
+	if err != nil {
+		t.Fatalf("Unable to create Discovery: %v", err)
+	}
+
+	defer discovery.Close()
+	serviceWatcher, _ := discovery.(*curatorDiscovery).serviceWatcherSet.findByName("first")
+	serviceWatcher.dispatch(Instances{newTestInstance("1", "host.com", 8080)})
+	handler := discovery.StatusHandler()
+
+	var testData = []struct {
+		method           string
+		target           string
+		expectedCode     int
+		expectedServices []string
+	}{
+		{http.MethodGet, "/", http.StatusOK, []string{"first", "second"}},
+		{http.MethodGet, "/?service=first", http.StatusOK, []string{"first"}},
+		{http.MethodGet, "/?service=first&service=second", http.StatusOK, []string{"first", "second"}},
+		{http.MethodGet, "/?service=nosuch", http.StatusNotFound, nil},
+		{http.MethodGet, "/?service=first&service=nosuch", http.StatusNotFound, nil},
+		{http.MethodHead, "/", http.StatusOK, nil},
+		{http.MethodPost, "/", http.StatusMethodNotAllowed, nil},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, httptest.NewRequest(record.method, record.target, nil))
+		assert.Equal(record.expectedCode, response.Code)
+		if record.expectedServices == nil {
+			if record.method == http.MethodHead {
+				assert.Equal(0, response.Body.Len())
+			}
+
+			continue
+		}
+
+		assert.Equal("application/json", response.Header().Get("Content-Type"))
+		var status Status
+		if !assert.Nil(json.Unmarshal(response.Body.Bytes(), &status)) {
+			continue
+		}
+
+		assert.False(status.Connected)
+		assert.Equal("UNKNOWN", status.ConnectionState)
+		assert.Len(status.Services, len(record.expectedServices))
+		for _, serviceName := range record.expectedServices {
+			assert.Contains(status.Services, serviceName)
+		}
+
+		if first, ok := status.Services["first"]; ok {
+			assert.True(first.Initialized)
+			assert.Equal(1, first.InstanceCount)
+			if assert.Len(first.Instances, 1) {
+				assert.Equal("1", first.Instances[0].Id)
+			}
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var (
+	ErrorSubscriptionClosed = errors.New("The subscription has been closed")
+)
+
+// Subscription is a pull-style alternative to a Listener, for consumers which would rather ask
+// for the next change to a service than receive callbacks, e.g. when bridging into another event
+// system with its own threading.  A Subscription never blocks the dispatcher: events which arrive
+// before Next is called are coalesced into a single event describing every change since the event
+// last returned by Next.
+//
+// A Subscription is safe for concurrent use, although each event is returned by only one call to Next.
+type Subscription struct {
+	serviceName  string
+	registration Registration
+
+	// signal holds a token whenever an event may be pending, and closed is closed by Close
+	signal    chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// mutex guards the pending event and the last event returned by Next
+	mutex        sync.Mutex
+	pending      *InstanceEvent
+	current      Instances
+	lastSequence uint64
+}
+
+// NewSubscription subscribes to the given service of a Discovery.  The subscription is registered
+// as a listener before this function returns, and a Discovery delivers the last-known Instances to
+// each new listener, so no event is missed between creation and the first call to Next.  Any error
+// from registering the listener, e.g. ErrorNoSuchService, is returned as is.
+//
+// Implementations of Discovery use this function for their Subscribe method.
+func NewSubscription(discovery Discovery, serviceName string) (*Subscription, error) {
+	subscription := &Subscription{
+		serviceName: serviceName,
+		signal:      make(chan struct{}, 1),
+		closed:      make(chan struct{}),
+	}
+
+	registration, err := discovery.AddListener(serviceName, subscriptionListener{subscription})
+	if err != nil {
+		return nil, err
+	}
+
+	subscription.registration = registration
+	return subscription, nil
+}
+
+// ServiceName returns the name of the service to which this Subscription is subscribed
+func (this *Subscription) ServiceName() string {
+	return this.serviceName
+}
+
+// Next blocks until there is an event newer than the one last returned, then returns it.  The
+// first event describes every instance known when the subscription was created as added, unless
+// the service had yet to be read, in which case the first event is the first read.  When several
+// events have arrived since the last call, they are returned as one: Added and Removed are relative
+// to the Current of the event last returned, and Sequence is that of the newest event, so a gap
+// in the Sequence reveals that events were coalesced.
+//
+// If the context is done first, its error is returned.  Once this Subscription is closed,
+// ErrorSubscriptionClosed is returned.
+func (this *Subscription) Next(ctx context.Context) (InstanceEvent, error) {
+	for {
+		select {
+		case <-this.closed:
+			return InstanceEvent{}, ErrorSubscriptionClosed
+		default:
+		}
+
+		if event, ok := this.take(); ok {
+			return event, nil
+		}
+
+		select {
+		case <-this.signal:
+		case <-this.closed:
+			return InstanceEvent{}, ErrorSubscriptionClosed
+		case <-ctx.Done():
+			return InstanceEvent{}, ctx.Err()
+		}
+	}
+}
+
+// Close cancels this Subscription's listener, and causes any blocked or subsequent calls to
+// Next to return ErrorSubscriptionClosed.  This method is idempotent.
+func (this *Subscription) Close() {
+	this.closeOnce.Do(func() {
+		this.registration.Cancel()
+		close(this.closed)
+	})
+}
+
+// take removes and returns the pending event, if any
+func (this *Subscription) take() (InstanceEvent, bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.pending == nil {
+		return InstanceEvent{}, false
+	}
+
+	event := *this.pending
+	this.pending = nil
+	this.current = event.Current
+	this.lastSequence = event.Sequence
+	return event, true
+}
+
+// changed records an event delivered by the Discovery, coalescing it with any pending event
+func (this *Subscription) changed(event InstanceEvent) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.lastSequence > 0 && event.Sequence <= this.lastSequence {
+		// already returned, e.g. the last-known Instances delivered again
+		return
+	}
+
+	if this.pending != nil {
+		// the coalesced event describes the changes since the event last returned by Next
+		updated := len(this.pending.Updated) > 0 || len(event.Updated) > 0
+		event.Added, event.Removed = event.Current.Diff(this.current, InstanceId)
+		event.Updated = nil
+		if updated {
+			event.Updated = event.Current.updatedFrom(this.current)
+		}
+	}
+
+	this.pending = &event
+	select {
+	case this.signal <- struct{}{}:
+	default:
+	}
+}
+
+// subscriptionListener is the InstancesListener registered on behalf of a Subscription
+type subscriptionListener struct {
+	subscription *Subscription
+}
+
+var _ InstancesListener = subscriptionListener{}
+
+func (this subscriptionListener) ServicesChanged(serviceName string, instances Instances) {
+	this.InstancesChanged(serviceName, InstanceEvent{Current: instances})
+}
+
+func (this subscriptionListener) InstancesChanged(serviceName string, event InstanceEvent) {
+	this.subscription.changed(event)
+}
+
+// String labels this listener in log messages
+func (this subscriptionListener) String() string {
+	return "subscription(" + this.subscription.serviceName + ")"
+}
@@ -0,0 +1,144 @@
+package service
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// nextEvent calls Next with a timeout, so that a missing event fails rather than hangs the test
+func nextEvent(subscription *Subscription) (InstanceEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return subscription.Next(ctx)
+}
+
+func TestSubscription(t *testing.T) {
+	assert := assert.New(t)
+
+	static := mustNewStaticDiscovery(t, map[string]Instances{"foo": testInstancesWithIds("1", "2")})
+	subscription, err := static.Subscribe("foo")
+	if !assert.Nil(err) {
+		return
+	}
+
+	defer subscription.Close()
+	assert.Equal("foo", subscription.ServiceName())
+	assert.Equal(1, static.ListenerCount("foo"))
+
+	// the current snapshot is delivered first
+	event, err := nextEvent(subscription)
+	assert.Nil(err)
+	assert.Equal(uint64(1), event.Sequence)
+	assert.Equal([]string{"1", "2"}, instanceIds(event.Added))
+	assert.Equal([]string{"1", "2"}, instanceIds(event.Current))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = subscription.Next(ctx)
+	assert.Equal(context.DeadlineExceeded, err)
+
+	// events which arrive between calls are coalesced relative to the last event returned
+	assert.Nil(static.SetInstances("foo", Instances{testInstancesWithIds("1", "2")[0], newTestInstance("3", "localhost", 1236)}))
+	assert.Nil(static.SetInstances("foo", Instances{testInstancesWithIds("1", "2")[0], newTestInstance("4", "localhost", 1237)}))
+	event, err = nextEvent(subscription)
+	assert.Nil(err)
+	assert.Equal(uint64(3), event.Sequence)
+	assert.Equal([]string{"4"}, instanceIds(event.Added))
+	assert.Equal([]string{"2"}, instanceIds(event.Removed))
+	assert.Empty(event.Updated)
+	assert.Equal([]string{"1", "4"}, instanceIds(event.Current))
+
+	// a blocked call returns as soon as an event arrives
+	events := make(chan InstanceEvent, 1)
+	go func() {
+		event, _ := nextEvent(subscription)
+		events <- event
+	}()
+
+	assert.Nil(static.SetInstances("foo", testInstancesWithIds("5")))
+	select {
+	case event = <-events:
+		assert.Equal(uint64(4), event.Sequence)
+		assert.Equal([]string{"5"}, instanceIds(event.Added))
+		assert.Equal([]string{"1", "4"}, instanceIds(event.Removed))
+	case <-time.After(5 * time.Second):
+		assert.Fail("Next did not return")
+	}
+
+	subscription.Close()
+	subscription.Close()
+	assert.Equal(0, static.ListenerCount("foo"))
+	_, err = subscription.Next(context.Background())
+	assert.Equal(ErrorSubscriptionClosed, err)
+}
+
+func TestSubscriptionCoalescesUpdates(t *testing.T) {
+	assert := assert.New(t)
+
+	static := mustNewStaticDiscovery(t, map[string]Instances{"foo": testInstancesWithIds("1", "2")})
+	subscription, err := static.Subscribe("foo")
+	if !assert.Nil(err) {
+		return
+	}
+
+	defer subscription.Close()
+	_, err = nextEvent(subscription)
+	assert.Nil(err)
+
+	// the port of "2" changes as "3" is added, then "1" is replaced by "4"
+	assert.Nil(static.SetInstances("foo", testInstancesWithIds("1", "3", "2")))
+	assert.Nil(static.SetInstances("foo", testInstancesWithIds("3", "4", "2")))
+	event, err := nextEvent(subscription)
+	assert.Nil(err)
+	assert.Equal([]string{"3", "4"}, instanceIds(event.Added))
+	assert.Equal([]string{"1"}, instanceIds(event.Removed))
+	assert.Equal([]string{"2"}, instanceIds(event.Updated))
+}
+
+func TestSubscriptionBeforeFirstRead(t *testing.T) {
+	assert := assert.New(t)
+
+	static := mustNewStaticDiscovery(t, nil)
+	_, err := static.Subscribe("foo")
+	assert.Equal(ErrorNoSuchService, err)
+
+	assert.Nil(static.AddService("foo"))
+	subscription, err := static.Subscribe("foo")
+	if !assert.Nil(err) {
+		return
+	}
+
+	defer subscription.Close()
+	assert.Nil(static.SetInstances("foo", testInstancesWithIds("1")))
+	event, err := nextEvent(subscription)
+	assert.Nil(err)
+	assert.Equal(uint64(1), event.Sequence)
+	assert.Equal([]string{"1"}, instanceIds(event.Added))
+}
+
+func TestSubscriptionCloseUnblocksNext(t *testing.T) {
+	assert := assert.New(t)
+
+	static := mustNewStaticDiscovery(t, nil)
+	assert.Nil(static.AddService("foo"))
+	subscription, err := static.Subscribe("foo")
+	if !assert.Nil(err) {
+		return
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := subscription.Next(context.Background())
+		errs <- err
+	}()
+
+	subscription.Close()
+	select {
+	case err = <-errs:
+		assert.Equal(ErrorSubscriptionClosed, err)
+	case <-time.After(5 * time.Second):
+		assert.Fail("Next did not return")
+	}
+}
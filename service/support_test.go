@@ -29,6 +29,16 @@ func ConnectionString(testCluster *zk.TestCluster) string {
 	return buffer.String()
 }
 
+// mustNewServiceWatcherSet creates a serviceWatcherSet, failing the test if the set is invalid
+func mustNewServiceWatcherSet(tb testing.TB, logger Logger, serviceNames []string, basePaths []string, options watcherOptions) *serviceWatcherSet {
+	serviceWatcherSet, err := newServiceWatcherSet(logger, serviceNames, basePaths, options)
+	if err != nil {
+		tb.Fatalf("Unable to create serviceWatcherSet: %v", err)
+	}
+
+	return serviceWatcherSet
+}
+
 type testLogger struct {
 	t *testing.T
 }
@@ -37,6 +47,18 @@ func (l *testLogger) Printf(format string, parameters ...interface{}) {
 	l.t.Logf(format, parameters...)
 }
 
+func (l *testLogger) Debug(format string, parameters ...interface{}) {
+	l.t.Logf("[DEBUG] "+format, parameters...)
+}
+
+func (l *testLogger) Info(format string, parameters ...interface{}) {
+	l.t.Logf("[INFO] "+format, parameters...)
+}
+
+func (l *testLogger) Error(format string, parameters ...interface{}) {
+	l.t.Logf("[ERROR] "+format, parameters...)
+}
+
 // ClusterTest represents a test which uses a zookeeper test cluster in isolation.
 type ClusterTest struct {
 	t           *testing.T
@@ -98,3 +120,23 @@ func (this *ClusterTest) NewDiscovery(t *testing.T, configuration string) Discov
 		return discovery
 	}
 }
+
+// testInstancesWithIds returns an Instances with one instance per id
+func testInstancesWithIds(ids ...string) Instances {
+	instances := make(Instances, 0, len(ids))
+	for index, id := range ids {
+		instances = append(instances, newTestInstance(id, "localhost", 1234+index))
+	}
+
+	return instances
+}
+
+// instanceIds returns the Id of each ServiceInstance, in order
+func instanceIds(instances Instances) []string {
+	ids := make([]string, len(instances))
+	for index, serviceInstance := range instances {
+		ids[index] = serviceInstance.Id
+	}
+
+	return ids
+}
@@ -0,0 +1,117 @@
+package service
+
+import (
+	"sync"
+)
+
+// ThresholdHandler is notified as the number of instances of a service crosses a ThresholdListener's
+// minimum, e.g. to page an operator.  Both methods are called from within the listener, so they
+// should not block for long.
+type ThresholdHandler interface {
+	// OnBelowThreshold is called when the count of instances drops below the minimum
+	OnBelowThreshold(serviceName string, count int)
+
+	// OnRecovered is called when the count of a service that was below the minimum climbs back to
+	// at least the minimum plus the hysteresis
+	OnRecovered(serviceName string, count int)
+}
+
+// ThresholdFuncs is a ThresholdHandler made up of functions, either of which may be nil
+type ThresholdFuncs struct {
+	BelowThreshold func(serviceName string, count int)
+	Recovered      func(serviceName string, count int)
+}
+
+var _ ThresholdHandler = ThresholdFuncs{}
+
+func (this ThresholdFuncs) OnBelowThreshold(serviceName string, count int) {
+	if this.BelowThreshold != nil {
+		this.BelowThreshold(serviceName, count)
+	}
+}
+
+func (this ThresholdFuncs) OnRecovered(serviceName string, count int) {
+	if this.Recovered != nil {
+		this.Recovered(serviceName, count)
+	}
+}
+
+// ThresholdListener is a Listener which tracks whether each service it receives has too few
+// instances.  The ThresholdHandler is notified once when a service's count drops below the
+// minimum, and once more when the count recovers to at least the minimum plus the hysteresis.
+// Counts which flap across the minimum in between, e.g. while instances restart during a deploy,
+// produce no further notifications.  A service whose first snapshot is already below the minimum
+// is reported immediately.
+//
+// A single ThresholdListener may be registered for several services, e.g. with
+// AddListenerForServices, since each service is tracked separately.  It is safe for concurrent use.
+type ThresholdListener struct {
+	minimum    int
+	hysteresis int
+	handler    ThresholdHandler
+
+	// mutex guards the names of the services which are currently below the minimum
+	mutex sync.Mutex
+	below map[string]bool
+}
+
+var _ Listener = (*ThresholdListener)(nil)
+
+// NewThresholdListener creates a ThresholdListener which notifies the given handler as services
+// drop below the minimum count of instances and recover.  A negative hysteresis is treated as zero,
+// in which case a service recovers as soon as it is no longer below the minimum.
+func NewThresholdListener(minimum, hysteresis int, handler ThresholdHandler) *ThresholdListener {
+	if hysteresis < 0 {
+		hysteresis = 0
+	}
+
+	return &ThresholdListener{
+		minimum:    minimum,
+		hysteresis: hysteresis,
+		handler:    handler,
+		below:      make(map[string]bool),
+	}
+}
+
+// Minimum returns the count of instances below which a service is reported
+func (this *ThresholdListener) Minimum() int {
+	return this.minimum
+}
+
+// RecoveryCount returns the count of instances at which a service below the minimum is recovered
+func (this *ThresholdListener) RecoveryCount() int {
+	return this.minimum + this.hysteresis
+}
+
+// IsBelowThreshold tests whether the given service was last reported below the minimum
+func (this *ThresholdListener) IsBelowThreshold(serviceName string) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.below[serviceName]
+}
+
+// ServicesChanged compares the count of instances to the thresholds, notifying the handler if the
+// service has crossed into or out of the below-threshold state
+func (this *ThresholdListener) ServicesChanged(serviceName string, instances Instances) {
+	count := len(instances)
+	this.mutex.Lock()
+	below := this.below[serviceName]
+	switch {
+	case !below && count < this.minimum:
+		this.below[serviceName] = true
+	case below && count >= this.RecoveryCount():
+		delete(this.below, serviceName)
+	default:
+		this.mutex.Unlock()
+		return
+	}
+
+	this.mutex.Unlock()
+
+	// a service's snapshots are dispatched one at a time, so its notifications remain in order
+	if below {
+		this.handler.OnRecovered(serviceName, count)
+	} else {
+		this.handler.OnBelowThreshold(serviceName, count)
+	}
+}
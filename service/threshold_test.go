@@ -0,0 +1,99 @@
+package service
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// recordingThresholdHandler records each notification as "below" or "recovered" with the service and count
+type recordingThresholdHandler struct {
+	notifications []string
+}
+
+func (this *recordingThresholdHandler) OnBelowThreshold(serviceName string, count int) {
+	this.notifications = append(this.notifications, fmt.Sprintf("below %s %d", serviceName, count))
+}
+
+func (this *recordingThresholdHandler) OnRecovered(serviceName string, count int) {
+	this.notifications = append(this.notifications, fmt.Sprintf("recovered %s %d", serviceName, count))
+}
+
+func TestThresholdListener(t *testing.T) {
+	var testData = []struct {
+		minimum               int
+		hysteresis            int
+		counts                []int
+		expectedNotifications []string
+		expectedBelow         bool
+	}{
+		{3, 1, nil, nil, false},
+		{3, 1, []int{5, 4, 3}, nil, false},
+		{3, 1, []int{2}, []string{"below test 2"}, true},
+		{3, 1, []int{5, 2, 3, 4}, []string{"below test 2", "recovered test 4"}, false},
+		{3, 1, []int{5, 0, 6, 1, 3}, []string{"below test 0", "recovered test 6", "below test 1"}, true},
+
+		// flapping across the minimum is reported once until the count recovers past the hysteresis
+		{3, 2, []int{3, 2, 3, 2, 4, 2, 3, 4, 2}, []string{"below test 2"}, true},
+		{3, 2, []int{3, 2, 3, 2, 4, 2, 5, 4, 2, 3, 2}, []string{"below test 2", "recovered test 5", "below test 2"}, true},
+
+		// without hysteresis, every crossing is reported
+		{3, 0, []int{3, 2, 3, 2}, []string{"below test 2", "recovered test 3", "below test 2"}, true},
+		{3, -1, []int{2, 3}, []string{"below test 2", "recovered test 3"}, false},
+		{0, 1, []int{0, 0}, nil, false},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+		handler := &recordingThresholdHandler{}
+		listener := NewThresholdListener(record.minimum, record.hysteresis, handler)
+		for _, count := range record.counts {
+			instances := make(Instances, count)
+			listener.ServicesChanged("test", instances)
+		}
+
+		assert.Equal(record.expectedNotifications, handler.notifications)
+		assert.Equal(record.expectedBelow, listener.IsBelowThreshold("test"))
+	}
+}
+
+func TestThresholdListenerServices(t *testing.T) {
+	assert := assert.New(t)
+
+	var below, recovered []string
+	listener := NewThresholdListener(2, 1, ThresholdFuncs{
+		BelowThreshold: func(serviceName string, count int) {
+			below = append(below, serviceName)
+		},
+		Recovered: func(serviceName string, count int) {
+			recovered = append(recovered, serviceName)
+		},
+	})
+
+	assert.Equal(2, listener.Minimum())
+	assert.Equal(3, listener.RecoveryCount())
+
+	// each service is tracked separately, including when registered by pattern
+	static := mustNewStaticDiscovery(t, map[string]Instances{
+		"first":  testInstancesWithIds("1"),
+		"second": testInstancesWithIds("1", "2"),
+	})
+
+	registration, err := static.AddListenerForServices("*", listener)
+	if !assert.Nil(err) {
+		return
+	}
+
+	defer registration.Cancel()
+	assert.Equal([]string{"first"}, below)
+	assert.True(listener.IsBelowThreshold("first"))
+	assert.False(listener.IsBelowThreshold("second"))
+
+	assert.Nil(static.SetInstances("second", testInstancesWithIds("1")))
+	assert.Nil(static.SetInstances("first", testInstancesWithIds("1", "2", "3")))
+	assert.Equal([]string{"first", "second"}, below)
+	assert.Equal([]string{"first"}, recovered)
+	assert.False(listener.IsBelowThreshold("first"))
+	assert.True(listener.IsBelowThreshold("second"))
+}
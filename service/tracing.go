@@ -0,0 +1,34 @@
+package service
+
+import (
+	"context"
+)
+
+// Tracer observes each read of a service from zookeeper and each delivery of an event to a
+// listener, e.g. to record them as tracing spans.  This package does not depend on any tracing
+// library.  The oteltrace package provides a Tracer backed by an OpenTelemetry TracerProvider.
+//
+// Implementations must be safe for concurrent use, and should return quickly, since they are
+// invoked on the paths that read and dispatch services.
+type Tracer interface {
+	// StartRead is invoked as the children of a service path are about to be read.  watch is set
+	// when a watch is also being set on the path.  The returned context is used for the read, and
+	// the returned function is invoked once the read completes, with the number of children read,
+	// the number of instances they yielded, and the error, if any.
+	StartRead(ctx context.Context, serviceName, servicePath string, watch bool) (context.Context, func(children, instances int, err error))
+
+	// StartDispatch is invoked as an event for a service is about to be delivered to a listener,
+	// identified by its label as in log messages.  The returned function is invoked once the
+	// listener returns.
+	StartDispatch(serviceName, listener string, sequence uint64) func()
+}
+
+// startRead begins tracing a read of this watcher's service path.  Without a Tracer, the given
+// context is returned along with a function that does nothing.
+func (this *serviceWatcher) startRead(ctx context.Context, watch bool) (context.Context, func(children, instances int, err error)) {
+	if this.tracer == nil {
+		return ctx, func(int, int, error) {}
+	}
+
+	return this.tracer.StartRead(ctx, this.serviceName, this.servicePath, watch)
+}
@@ -0,0 +1,130 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+// tracedRead records a read observed by a recordingTracer
+type tracedRead struct {
+	serviceName string
+	servicePath string
+	watch       bool
+	children    int
+	instances   int
+	err         error
+	ended       bool
+}
+
+// tracedDispatch records a delivery observed by a recordingTracer
+type tracedDispatch struct {
+	serviceName string
+	listener    string
+	sequence    uint64
+	ended       bool
+}
+
+// recordingTracer is a Tracer which records everything it observes
+type recordingTracer struct {
+	mutex      sync.Mutex
+	reads      []*tracedRead
+	dispatches []*tracedDispatch
+}
+
+var _ Tracer = (*recordingTracer)(nil)
+
+func (this *recordingTracer) StartRead(ctx context.Context, serviceName, servicePath string, watch bool) (context.Context, func(children, instances int, err error)) {
+	read := &tracedRead{serviceName: serviceName, servicePath: servicePath, watch: watch}
+	this.mutex.Lock()
+	this.reads = append(this.reads, read)
+	this.mutex.Unlock()
+
+	return ctx, func(children, instances int, err error) {
+		this.mutex.Lock()
+		defer this.mutex.Unlock()
+		read.children, read.instances, read.err, read.ended = children, instances, err, true
+	}
+}
+
+func (this *recordingTracer) StartDispatch(serviceName, listener string, sequence uint64) func() {
+	dispatch := &tracedDispatch{serviceName: serviceName, listener: listener, sequence: sequence}
+	this.mutex.Lock()
+	this.dispatches = append(this.dispatches, dispatch)
+	this.mutex.Unlock()
+
+	return func() {
+		this.mutex.Lock()
+		defer this.mutex.Unlock()
+		dispatch.ended = true
+	}
+}
+
+func TestTraceReads(t *testing.T) {
+	assert := assert.New(t)
+
+	client := newFakeZookeeperClient()
+	servicePath := testBasePath + "/" + testServiceName
+	client.addInstance(servicePath, newTestInstance("1", "host.com", 8080))
+	client.addInstance(servicePath, newTestInstance("2", "host.com", 8081))
+	client.set(servicePath+"/garbage", []byte("this is not json"))
+
+	tracer := &recordingTracer{}
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, watcherOptions{tracer: tracer})
+	defer serviceWatcherSet.stop()
+	serviceWatcher, _ := serviceWatcherSet.findByName(testServiceName)
+	serviceWatcher.client = client
+
+	_, err := serviceWatcher.readServicesAndWatch(context.Background())
+	assert.Nil(err)
+	_, err = serviceWatcher.readServices(context.Background())
+	assert.Nil(err)
+
+	expected := errors.New("expected")
+	client.failNext(fakeChildren, servicePath, expected)
+	_, err = serviceWatcher.readServices(context.Background())
+	assert.NotNil(err)
+
+	assert.Equal(
+		[]*tracedRead{
+			{testServiceName, servicePath, true, 3, 2, nil, true},
+			{testServiceName, servicePath, false, 3, 2, nil, true},
+			{testServiceName, servicePath, false, 0, 0, err, true},
+		},
+		tracer.reads,
+	)
+}
+
+func TestTraceDispatches(t *testing.T) {
+	assert := assert.New(t)
+
+	tracer := &recordingTracer{}
+	serviceWatcher := &serviceWatcher{
+		serviceName:     testServiceName,
+		logger:          &testLogger{t},
+		dispatchOptions: dispatchOptions{tracer: tracer},
+	}
+
+	var traced []tracedDispatch
+	serviceWatcher.addListener(namedListener{func(serviceName string, instances Instances) {
+		// the delivery is traced while the listener runs
+		traced = append(traced, *tracer.dispatches[len(tracer.dispatches)-1])
+	}})
+
+	serviceWatcher.dispatch(testInstancesWithIds("1"))
+	serviceWatcher.dispatch(testInstancesWithIds("2"))
+	assert.Equal(
+		[]tracedDispatch{
+			{testServiceName, "named", 1, false},
+			{testServiceName, "named", 2, false},
+		},
+		traced,
+	)
+
+	if assert.Len(tracer.dispatches, 2) {
+		assert.True(tracer.dispatches[0].ended)
+		assert.True(tracer.dispatches[1].ended)
+	}
+}
@@ -0,0 +1,274 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"github.com/foursquare/fsgo/net/discovery"
+	"net"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// illegalZnodeRune tests whether a rune is disallowed in a zookeeper path
+func illegalZnodeRune(r rune) bool {
+	return r == 0 ||
+		(r > 0 && r < 0x20) ||
+		(r >= 0x7F && r <= 0x9F) ||
+		(r >= 0xD800 && r <= 0xF8FF) ||
+		(r >= 0xFFF0 && r <= 0xFFFF)
+}
+
+// validateZnodeName checks a single element of a zookeeper path, returning a description
+// of the problem or the empty string if the name is valid
+func validateZnodeName(name string) string {
+	switch {
+	case len(name) == 0:
+		return "must not be empty"
+	case name == "." || name == "..":
+		return "must not be a relative path element"
+	case strings.Contains(name, "/"):
+		return "must not contain '/'"
+	case strings.IndexFunc(name, illegalZnodeRune) >= 0:
+		return "contains characters that zookeeper does not allow"
+	case strings.TrimFunc(name, unicode.IsSpace) != name:
+		return "must not begin or end with whitespace"
+	}
+
+	return ""
+}
+
+// validateServiceNames checks each of the given service names, returning a ServiceNamesError
+// describing every invalid name
+func validateServiceNames(serviceNames []string) error {
+	var serviceNamesError ServiceNamesError
+	for _, serviceName := range serviceNames {
+		if reason := validateZnodeName(serviceName); len(reason) > 0 {
+			serviceNamesError = append(serviceNamesError, ServiceNameError{serviceName, reason})
+		}
+	}
+
+	return serviceNamesError.errorOrNil()
+}
+
+// normalizeBasePath validates a base path and removes any trailing slashes, so that service
+// paths can be formed by appending "/" and the service name.  An empty base path, or "/",
+// places services at the root.
+func normalizeBasePath(basePath string) (string, error) {
+	normalized := strings.TrimRight(basePath, "/")
+	if len(normalized) == 0 {
+		return normalized, nil
+	} else if normalized[0] != '/' {
+		return "", errors.New(
+			fmt.Sprintf("The base path %q must begin with '/'", basePath),
+		)
+	}
+
+	for _, element := range strings.Split(normalized[1:], "/") {
+		if reason := validateZnodeName(element); len(reason) > 0 {
+			return "", errors.New(
+				fmt.Sprintf("The base path %q is invalid: element %q %s", basePath, element, reason),
+			)
+		}
+	}
+
+	return normalized, nil
+}
+
+// normalizeServicePaths validates the configured path of each named service, returning a copy
+// with each path normalized.  The root is not a valid service path.
+func normalizeServicePaths(servicePaths map[string]string) (map[string]string, error) {
+	normalized := make(map[string]string, len(servicePaths))
+	for serviceName, servicePath := range servicePaths {
+		if err := validateServiceNames([]string{serviceName}); err != nil {
+			return nil, err
+		}
+
+		value, err := normalizeBasePath(servicePath)
+		if err != nil {
+			return nil, ServiceError{serviceName, err}
+		} else if len(value) == 0 {
+			return nil, ServiceError{serviceName, ErrorInvalidWatchPath}
+		}
+
+		normalized[serviceName] = value
+	}
+
+	return normalized, nil
+}
+
+// parentPath returns the parent of a normalized, absolute path, which is empty for the root
+func parentPath(servicePath string) string {
+	return servicePath[:strings.LastIndex(servicePath, "/")]
+}
+
+// validPort tests whether a port number can be used in a zookeeper connection or registration
+func validPort(port int) bool {
+	return port > 0 && port <= 65535
+}
+
+// validateConnection checks a curator connection string, which is a comma-delimited list of
+// host:port pairs optionally followed by a chroot path, e.g. "zk1:2181,zk2:2181/app".  The port
+// may be omitted, in which case zookeeper's default is used.
+func validateConnection(connection string) error {
+	servers := connection
+	if chrootIndex := strings.Index(connection, "/"); chrootIndex >= 0 {
+		servers = connection[:chrootIndex]
+		if _, err := normalizeBasePath(connection[chrootIndex:]); err != nil {
+			return err
+		}
+	}
+
+	if len(strings.TrimSpace(servers)) == 0 {
+		return ErrorNoConnection
+	}
+
+	for _, server := range strings.Split(servers, ",") {
+		server = strings.TrimSpace(server)
+		host, port := server, ""
+		if strings.Contains(server, ":") {
+			var err error
+			if host, port, err = net.SplitHostPort(server); err != nil {
+				return errors.New(
+					fmt.Sprintf("The server %q is not a valid host:port pair: %v", server, err),
+				)
+			}
+		}
+
+		if len(host) == 0 {
+			return errors.New(
+				fmt.Sprintf("The server %q has no host", server),
+			)
+		} else if len(port) > 0 {
+			if number, err := strconv.Atoi(port); err != nil || !validPort(number) {
+				return errors.New(
+					fmt.Sprintf("The server %q does not have a port between 1 and 65535", server),
+				)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateRegistration checks that a ServiceInstance can be registered
+func validateRegistration(registration *discovery.ServiceInstance) error {
+	switch {
+	case registration == nil:
+		return ErrorInvalidRegistration
+	case len(validateZnodeName(registration.Name)) > 0:
+		return errors.New(
+			fmt.Sprintf("%v: the name %q %s", ErrorInvalidRegistration, registration.Name, validateZnodeName(registration.Name)),
+		)
+	case len(registration.Address) == 0:
+		return errors.New(
+			fmt.Sprintf("%v: %s has no address", ErrorInvalidRegistration, registration.Name),
+		)
+	case registration.Port == nil && registration.SslPort == nil:
+		return errors.New(
+			fmt.Sprintf("%v: %s has no port", ErrorInvalidRegistration, registration.Name),
+		)
+	case registration.Port != nil && !validPort(*registration.Port):
+		return errors.New(
+			fmt.Sprintf("%v: %s has port %d", ErrorInvalidRegistration, registration.Name, *registration.Port),
+		)
+	case registration.SslPort != nil && !validPort(*registration.SslPort):
+		return errors.New(
+			fmt.Sprintf("%v: %s has SSL port %d", ErrorInvalidRegistration, registration.Name, *registration.SslPort),
+		)
+	}
+
+	return nil
+}
+
+// Validate checks every field of this builder, returning a ValidationError that names each
+// invalid field, or nil if the builder can be used to create a Discovery.  Unless there is a
+// CuratorConnection, the Connection must list at least one server.  The base paths must begin
+// with "/", watched service names must be legal znode names, registrations must have ports
+// between 1 and 65535, and every interval must be a valid, nonnegative duration.  New calls
+// this method automatically.
+func (this *DiscoveryBuilder) Validate() error {
+	var validationError ValidationError
+	check := func(field string, err error) {
+		if err != nil {
+			validationError = append(validationError, FieldError{field, err})
+		}
+	}
+
+	if this.CuratorConnection == nil {
+		check("Connection", validateConnection(this.Connection))
+	}
+
+	_, err := normalizeBasePath(this.BasePath)
+	check("BasePath", err)
+	for index, watchBasePath := range this.WatchBasePaths {
+		_, err = normalizeBasePath(watchBasePath)
+		check(fmt.Sprintf("WatchBasePaths[%d]", index), err)
+	}
+
+	check("Watches", validateServiceNames(this.Watches))
+	_, err = normalizeServicePaths(this.WatchPaths)
+	check("WatchPaths", err)
+	for index, registration := range this.Registrations {
+		check(fmt.Sprintf("Registrations[%d]", index), validateRegistration(registration))
+	}
+
+	if this.ReadOnly && len(this.Registrations) > 0 {
+		check("Registrations", ErrorReadOnlyRegistrations)
+	}
+
+	_, err = this.connectTimeout()
+	check("ConnectTimeout", err)
+	_, err = this.sessionTimeout()
+	check("SessionTimeout", err)
+	_, _, err = this.connectRetryOptions()
+	check("ConnectRetryInitialDelay", err)
+	_, err = this.watchPollInterval()
+	check("WatchPollInterval", err)
+	_, err = this.resyncInterval()
+	check("ResyncInterval", err)
+	_, err = this.reconnectJitter()
+	check("ReconnectJitter", err)
+	_, err = this.watchLossThreshold()
+	check("WatchLossThreshold", err)
+	_, err = this.watchRetryOptions()
+	check("WatchRetryInitialDelay", err)
+	_, err = this.watchDebounceWindow()
+	check("WatchDebounceWindow", err)
+	_, err = this.aggregateWindow()
+	check("AggregateWindow", err)
+	_, err = this.staleInstanceThreshold()
+	check("StaleInstanceThreshold", err)
+	switch _, err = this.dispatchOptions(); err {
+	case ErrorInvalidDispatchQueueFull:
+		check("DispatchQueueFull", err)
+	case ErrorInvalidDispatchExecutor:
+		check("DispatchExecutor", err)
+	case ErrorInvalidDuplicateListener:
+		check("DuplicateListener", err)
+	default:
+		check("ListenerTimeout", err)
+	}
+
+	_, err = this.readRateLimiter()
+	check("ReadRateLimit", err)
+	_, err = this.readBatchSize()
+	check("ReadBatchSize", err)
+
+	_, err = this.logSampleSize()
+	check("LogSampleSize", err)
+
+	_, err = this.eventHistorySize()
+	check("EventHistorySize", err)
+	_, err = this.fetchTimeout()
+	check("FetchTimeout", err)
+	_, _, err = this.servicePathModes()
+	check("ServicePathMode", err)
+	check("VersionConstraint", this.VersionConstraint.validate())
+	_, err = this.authInfos()
+	check("AuthScheme", err)
+	_, err = parseACLs(this.ACLs)
+	check("ACLs", err)
+
+	return validationError.errorOrNil()
+}
@@ -0,0 +1,223 @@
+package service
+
+import (
+	"errors"
+	"github.com/foursquare/fsgo/net/discovery"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestValidateServiceNames(t *testing.T) {
+	var testData = []struct {
+		serviceNames  []string
+		expectedError error
+	}{
+		{nil, nil},
+		{[]string{"service", "another-service", "with.dots", "ünïcode"}, nil},
+		{
+			[]string{"", "valid", "a/b", " leading", "trailing\t", ".", "..", "nul\x00", "bell\a"},
+			ServiceNamesError{
+				{"", "must not be empty"},
+				{"a/b", "must not contain '/'"},
+				{" leading", "must not begin or end with whitespace"},
+				{"trailing\t", "contains characters that zookeeper does not allow"},
+				{".", "must not be a relative path element"},
+				{"..", "must not be a relative path element"},
+				{"nul\x00", "contains characters that zookeeper does not allow"},
+				{"bell\a", "contains characters that zookeeper does not allow"},
+			},
+		},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+		assert.Equal(record.expectedError, validateServiceNames(record.serviceNames))
+	}
+}
+
+func TestServiceNamesError(t *testing.T) {
+	assert := assert.New(t)
+
+	err := ServiceNamesError{{"", "must not be empty"}, {"a/b", "must not contain '/'"}}
+	assert.Equal(`2 invalid service name(s): "": must not be empty; "a/b": must not contain '/'`, err.Error())
+	assert.Nil(ServiceNamesError{}.errorOrNil())
+}
+
+func TestNormalizeBasePath(t *testing.T) {
+	var testData = []struct {
+		basePath         string
+		expectedBasePath string
+		expectError      bool
+	}{
+		{"", "", false},
+		{"/", "", false},
+		{"/discovery", "/discovery", false},
+		{"/test/discovery/", "/test/discovery", false},
+		{"/test/discovery//", "/test/discovery", false},
+		{"discovery", "", true},
+		{"/test//discovery", "", true},
+		{"/test/../discovery", "", true},
+		{"/test/ discovery", "", true},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+		basePath, err := normalizeBasePath(record.basePath)
+		assert.Equal(record.expectedBasePath, basePath)
+		assert.Equal(record.expectError, err != nil)
+	}
+}
+
+func TestNewServiceWatcherSetValidation(t *testing.T) {
+	assert := assert.New(t)
+
+	serviceWatcherSet, err := newServiceWatcherSet(&testLogger{t}, []string{"valid", "", "a/b"}, []string{testBasePath}, watcherOptions{})
+	assert.Nil(serviceWatcherSet)
+	if assert.IsType(ServiceNamesError{}, err) {
+		assert.Len(err, 2)
+	}
+
+	serviceWatcherSet, err = newServiceWatcherSet(&testLogger{t}, []string{"valid"}, []string{"relative"}, watcherOptions{})
+	assert.Nil(serviceWatcherSet)
+	assert.NotNil(err)
+
+	serviceWatcherSet, err = newServiceWatcherSet(&testLogger{t}, []string{"valid"}, []string{testBasePath + "/"}, watcherOptions{})
+	assert.Nil(err)
+	if assert.NotNil(serviceWatcherSet) {
+		serviceWatcher, ok := serviceWatcherSet.findByName("valid")
+		assert.True(ok)
+		assert.Equal(testBasePath+"/valid", serviceWatcher.servicePath)
+	}
+}
+
+func TestValidateConnection(t *testing.T) {
+	var testData = []struct {
+		connection  string
+		expectError bool
+	}{
+		{"localhost:2181", false},
+		{"zk1:2181,zk2:2181, zk3:2181", false},
+		{"zk1,zk2", false},
+		{"[::1]:2181", false},
+		{"zk1:2181,zk2:2181/app/chroot", false},
+		{"", true},
+		{"  ", true},
+		{"/chroot", true},
+		{"zk1:2181,", true},
+		{":2181", true},
+		{"zk1:http", true},
+		{"zk1:0", true},
+		{"zk1:65536", true},
+		{"zk1:2181:2182", true},
+		{"zk1:2181/bad//chroot", true},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+		err := validateConnection(record.connection)
+		if record.expectError {
+			assert.NotNil(err)
+		} else {
+			assert.Nil(err)
+		}
+	}
+}
+
+func TestValidateRegistration(t *testing.T) {
+	port, sslPort, badPort := 8080, 8443, 70000
+	var testData = []struct {
+		registration *discovery.ServiceInstance
+		expectError  bool
+	}{
+		{discovery.NewServiceInstance(testServiceName, testAddress, &port, nil, nil), false},
+		{discovery.NewServiceInstance(testServiceName, testAddress, nil, &sslPort, nil), false},
+		{discovery.NewServiceInstance(testServiceName, testAddress, &port, &sslPort, nil), false},
+		{nil, true},
+		{discovery.NewServiceInstance("", testAddress, &port, nil, nil), true},
+		{discovery.NewServiceInstance("a/b", testAddress, &port, nil, nil), true},
+		{discovery.NewServiceInstance(testServiceName, "", &port, nil, nil), true},
+		{discovery.NewServiceInstance(testServiceName, testAddress, nil, nil, nil), true},
+		{discovery.NewServiceInstance(testServiceName, testAddress, &badPort, nil, nil), true},
+		{discovery.NewServiceInstance(testServiceName, testAddress, &port, &badPort, nil), true},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+		err := validateRegistration(record.registration)
+		if record.expectError {
+			if assert.NotNil(err) {
+				assert.True(strings.HasPrefix(err.Error(), ErrorInvalidRegistration.Error()))
+			}
+		} else {
+			assert.Nil(err)
+		}
+	}
+}
+
+func TestDiscoveryBuilderValidate(t *testing.T) {
+	assert := assert.New(t)
+	port := testPort
+
+	valid := DiscoveryBuilder{
+		Connection:    testConnection,
+		BasePath:      testBasePath,
+		Watches:       []string{testServiceName},
+		Registrations: Instances{discovery.NewServiceInstance(testServiceName, testAddress, &port, nil, nil)},
+	}
+
+	assert.Nil(valid.Validate())
+
+	invalid := DiscoveryBuilder{
+		BasePath:          "relative",
+		WatchBasePaths:    []string{"/valid", "also/relative"},
+		Watches:           []string{testServiceName, "a/b"},
+		WatchPaths:        map[string]string{"root": "/"},
+		Registrations:     Instances{discovery.NewServiceInstance(testServiceName, testAddress, nil, nil, nil)},
+		ConnectTimeout:    "-1s",
+		ConnectDeadline:   "soon",
+		WatchPollInterval: "often",
+		DispatchQueueFull: "sometimes",
+		AuthScheme:        "digest",
+	}
+
+	err := invalid.Validate()
+	if validationError, ok := err.(ValidationError); assert.True(ok) {
+		assert.Equal(
+			[]string{
+				"Connection",
+				"BasePath",
+				"WatchBasePaths[1]",
+				"Watches",
+				"WatchPaths",
+				"Registrations[0]",
+				"ConnectTimeout",
+				"ConnectRetryInitialDelay",
+				"WatchPollInterval",
+				"DispatchQueueFull",
+				"AuthScheme",
+			},
+			validationError.Fields(),
+		)
+	}
+
+	assert.True(errors.Is(err, ErrorNoConnection))
+	assert.True(errors.Is(err, ErrorInvalidConnectTimeout))
+	assert.True(errors.Is(err, ErrorInvalidConnectRetry))
+	assert.True(errors.Is(err, ErrorInvalidAuth))
+	assert.False(errors.Is(err, ErrorClosed))
+
+	var fieldError FieldError
+	if assert.True(errors.As(err, &fieldError)) {
+		assert.Equal("Connection", fieldError.Field)
+	}
+
+	// New refuses to create a Discovery from an invalid builder
+	discovery, err := invalid.New(nil)
+	assert.Nil(discovery)
+	assert.Equal(invalid.Validate(), err)
+}
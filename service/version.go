@@ -0,0 +1,88 @@
+package service
+
+import (
+	"github.com/foursquare/fsgo/net/discovery"
+	"strconv"
+)
+
+// VersionConstraint restricts watched instances to those registered with a supported version in
+// a field of their JSON payload, e.g. an "apiVersion" that registrants change during an
+// incompatible protocol migration.  A string value must equal one of the Accepted versions
+// exactly, while a numeric value is compared in its shortest decimal form, so that 2 matches "2".
+//
+// Instances without a payload, whose payload is not a JSON object, or whose payload has no value
+// for the field are considered to be missing the version.  Since older registrants will not have
+// the field, these are accepted only when IncludeMissing is true.
+type VersionConstraint struct {
+	// Field is the name of the payload field which holds the version
+	Field string `json:"field"`
+
+	// Accepted are the versions a consumer supports
+	Accepted []string `json:"accepted"`
+
+	// IncludeMissing determines whether instances without a version are accepted
+	IncludeMissing bool `json:"includeMissing"`
+}
+
+// WithVersionConstraint creates a VersionConstraint which accepts instances whose payload field
+// holds one of the given versions, and which excludes instances that are missing the field.  Set
+// IncludeMissing on the result to accept those instances as well.
+//
+// Supply the result as the DiscoveryBuilder's VersionConstraint to apply it to every watched
+// service, or use FilterMiddleware(constraint.Accepts) to apply it to a single listener.
+func WithVersionConstraint(field string, accepted ...string) *VersionConstraint {
+	return &VersionConstraint{
+		Field:    field,
+		Accepted: accepted,
+	}
+}
+
+// Accepts tests whether the given ServiceInstance satisfies this constraint.  A nil
+// VersionConstraint accepts every instance.
+func (this *VersionConstraint) Accepts(serviceInstance *discovery.ServiceInstance) bool {
+	if this == nil {
+		return true
+	}
+
+	version, ok := this.version(serviceInstance)
+	if !ok {
+		return this.IncludeMissing
+	}
+
+	for _, accepted := range this.Accepted {
+		if version == accepted {
+			return true
+		}
+	}
+
+	return false
+}
+
+// version returns the version of the given instance as a string, and false if it has none
+func (this *VersionConstraint) version(serviceInstance *discovery.ServiceInstance) (string, bool) {
+	var payload map[string]interface{}
+	if err := DecodePayload(serviceInstance, &payload); err != nil {
+		return "", false
+	}
+
+	switch value := payload[this.Field].(type) {
+	case string:
+		return value, true
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), true
+	case nil:
+		return "", false
+	default:
+		// a version such as true or {} is present, but can never be accepted
+		return "", true
+	}
+}
+
+// validate checks that a non-nil constraint names a field and accepts at least one version
+func (this *VersionConstraint) validate() error {
+	if this != nil && (len(this.Field) == 0 || len(this.Accepted) == 0) {
+		return ErrorInvalidVersionConstraint
+	}
+
+	return nil
+}
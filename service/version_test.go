@@ -0,0 +1,125 @@
+package service
+
+import (
+	"errors"
+	"github.com/foursquare/fsgo/net/discovery"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestVersionConstraint(t *testing.T) {
+	var testData = []struct {
+		serviceInstance *discovery.ServiceInstance
+		includeMissing  bool
+		expected        bool
+	}{
+		{newTestInstanceWithPayload("1", `{"apiVersion": "v2"}`), false, true},
+		{newTestInstanceWithPayload("2", `{"apiVersion": "v3"}`), false, true},
+		{newTestInstanceWithPayload("3", `{"apiVersion": "v1"}`), true, false},
+		{newTestInstanceWithPayload("4", `{"apiVersion": 2}`), false, true},
+		{newTestInstanceWithPayload("5", `{"apiVersion": 2.5}`), false, false},
+		{newTestInstanceWithPayload("6", `{"apiVersion": true}`), true, false},
+		{newTestInstanceWithPayload("7", `{"apiVersion": null}`), true, true},
+		{newTestInstanceWithPayload("8", `{"other": "v2"}`), true, true},
+		{newTestInstanceWithPayload("9", `{"other": "v2"}`), false, false},
+		{newTestInstanceWithPayload("10", `not json`), true, true},
+		{newTestInstanceWithPayload("11", `not json`), false, false},
+		{newTestInstance("12", "localhost", 1234), true, true},
+		{newTestInstance("13", "localhost", 1234), false, false},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+		constraint := WithVersionConstraint("apiVersion", "v2", "v3", "2")
+		constraint.IncludeMissing = record.includeMissing
+		assert.Equal(record.expected, constraint.Accepts(record.serviceInstance))
+	}
+
+	var constraint *VersionConstraint
+	assert.True(t, constraint.Accepts(newTestInstanceWithPayload("1", `{"apiVersion": "v1"}`)))
+}
+
+func TestVersionConstraintValidate(t *testing.T) {
+	var testData = []struct {
+		constraint    *VersionConstraint
+		expectedError error
+	}{
+		{nil, nil},
+		{WithVersionConstraint("apiVersion", "v2"), nil},
+		{WithVersionConstraint("apiVersion"), ErrorInvalidVersionConstraint},
+		{WithVersionConstraint("", "v2"), ErrorInvalidVersionConstraint},
+		{&VersionConstraint{IncludeMissing: true}, ErrorInvalidVersionConstraint},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+		builder := DiscoveryBuilder{Connection: testConnection, VersionConstraint: record.constraint}
+		err := builder.Validate()
+		if record.expectedError == nil {
+			assert.Nil(err)
+		} else if validationError, ok := err.(ValidationError); assert.True(ok) {
+			assert.Equal([]string{"VersionConstraint"}, validationError.Fields())
+			assert.True(errors.Is(err, record.expectedError))
+		}
+	}
+}
+
+func TestFetchServicesWithVersionConstraint(t *testing.T) {
+	assert := assert.New(t)
+
+	client := newFakeZookeeperClient()
+	servicePath := testBasePath + "/" + testServiceName
+	client.addInstance(servicePath, newTestInstanceWithPayload("1", `{"apiVersion": "v2", "enabled": true}`))
+	client.addInstance(servicePath, newTestInstanceWithPayload("2", `{"apiVersion": "v1", "enabled": true}`))
+	client.addInstance(servicePath, newTestInstanceWithPayload("3", `{"apiVersion": "v1", "enabled": false}`))
+	client.addInstance(servicePath, newTestInstance("4", "localhost", 1234))
+
+	options := watcherOptions{
+		instanceFilter:    PayloadFlagFilter("enabled", true),
+		versionConstraint: &VersionConstraint{Field: "apiVersion", Accepted: []string{"v2"}, IncludeMissing: true},
+	}
+
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, options)
+	serviceWatcher, _ := serviceWatcherSet.findByName(testServiceName)
+	serviceWatcher.client = client
+
+	instances, err := serviceWatcher.readServices(serviceWatcher.context)
+	assert.Nil(err)
+	assert.Equal([]string{"1", "4"}, instanceIds(instances))
+
+	// instances rejected by the InstanceFilter are not also counted against the version
+	metrics := serviceWatcher.metricsSnapshot()
+	assert.Equal(1, metrics.FilteredInstances)
+	assert.Equal(1, metrics.VersionExcludedInstances)
+
+	// old registrants can be excluded as well
+	options.versionConstraint.IncludeMissing = false
+	serviceWatcherSet = mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, options)
+	serviceWatcher, _ = serviceWatcherSet.findByName(testServiceName)
+	serviceWatcher.client = client
+
+	instances, err = serviceWatcher.readServices(serviceWatcher.context)
+	assert.Nil(err)
+	assert.Equal([]string{"1"}, instanceIds(instances))
+	assert.Equal(2, serviceWatcher.metricsSnapshot().VersionExcludedInstances)
+}
+
+func TestVersionConstraintListener(t *testing.T) {
+	assert := assert.New(t)
+
+	var current Instances
+	constraint := WithVersionConstraint("apiVersion", "v2")
+	listener := FilterMiddleware(constraint.Accepts)(ListenerFunc(func(serviceName string, instances Instances) {
+		current = instances
+	}))
+
+	listener.ServicesChanged(testServiceName, Instances{
+		newTestInstanceWithPayload("1", `{"apiVersion": "v2"}`),
+		newTestInstanceWithPayload("2", `{"apiVersion": "v1"}`),
+		newTestInstance("3", "localhost", 1234),
+	})
+
+	assert.Equal([]string{"1"}, instanceIds(current))
+}
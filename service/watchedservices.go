@@ -0,0 +1,104 @@
+package service
+
+import (
+	"sort"
+	"sync"
+)
+
+// WatchedServicesEvent describes a change to the set of services watched by a Discovery
+type WatchedServicesEvent struct {
+	// Added holds the names of the services which began to be watched, in sorted order
+	Added []string
+
+	// Removed holds the names of the services which are no longer watched, in sorted order
+	Removed []string
+
+	// Current holds the names of every watched service after the change, in sorted order
+	Current []string
+}
+
+// WatchedServicesListener receives changes to the set of watched services, e.g. via AddService
+// and RemoveService.  Events are delivered one at a time, in the order in which they occurred.
+type WatchedServicesListener interface {
+	WatchedServicesChanged(event WatchedServicesEvent)
+}
+
+// WatchedServicesListenerFunc is a function type that implements WatchedServicesListener
+type WatchedServicesListenerFunc func(event WatchedServicesEvent)
+
+func (this WatchedServicesListenerFunc) WatchedServicesChanged(event WatchedServicesEvent) {
+	this(event)
+}
+
+// watchedServicesMonitor delivers changes to the set of services watched by a serviceWatcherSet
+type watchedServicesMonitor struct {
+	// dispatchMutex serializes the delivery of events, and guards the names last delivered
+	dispatchMutex sync.Mutex
+	delivered     []string
+
+	listeners *listenerSet
+}
+
+func newWatchedServicesMonitor(logger Logger, serviceNames []string) *watchedServicesMonitor {
+	return &watchedServicesMonitor{
+		delivered: serviceNames,
+		listeners: newListenerSet(logger, "Watched services"),
+	}
+}
+
+// addListener registers a listener for all subsequent changes
+func (this *watchedServicesMonitor) addListener(listener WatchedServicesListener) Registration {
+	return this.listeners.add(listener)
+}
+
+// changed delivers an event describing how the given function's sorted service names differ from
+// those last delivered.  The names are read while the dispatchMutex is held, so that concurrent
+// changes are delivered in order and the last event always describes the current set.
+func (this *watchedServicesMonitor) changed(serviceNames func() []string) {
+	this.dispatchMutex.Lock()
+	defer this.dispatchMutex.Unlock()
+
+	current := serviceNames()
+	added, removed := diffServiceNames(current, this.delivered)
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+
+	this.delivered = current
+	event := WatchedServicesEvent{
+		Added:   added,
+		Removed: removed,
+		Current: current,
+	}
+
+	this.listeners.each(func(listener interface{}) {
+		listener.(WatchedServicesListener).WatchedServicesChanged(event)
+	})
+}
+
+// diffServiceNames returns the names in current but not previous, and those in previous but not
+// current, each in sorted order
+func diffServiceNames(current, previous []string) (added, removed []string) {
+	currentSet := make(map[string]bool, len(current))
+	for _, serviceName := range current {
+		currentSet[serviceName] = true
+	}
+
+	previousSet := make(map[string]bool, len(previous))
+	for _, serviceName := range previous {
+		previousSet[serviceName] = true
+		if !currentSet[serviceName] {
+			removed = append(removed, serviceName)
+		}
+	}
+
+	for _, serviceName := range current {
+		if !previousSet[serviceName] {
+			added = append(added, serviceName)
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(removed)
+	return
+}
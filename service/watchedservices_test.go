@@ -0,0 +1,101 @@
+package service
+
+import (
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func TestDiffServiceNames(t *testing.T) {
+	var testData = []struct {
+		current         []string
+		previous        []string
+		expectedAdded   []string
+		expectedRemoved []string
+	}{
+		{nil, nil, nil, nil},
+		{[]string{"a", "b"}, []string{"a", "b"}, nil, nil},
+		{[]string{"a", "c"}, []string{"a", "b"}, []string{"c"}, []string{"b"}},
+		{[]string{"c", "b"}, nil, []string{"b", "c"}, nil},
+		{nil, []string{"b", "a"}, nil, []string{"a", "b"}},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		added, removed := diffServiceNames(record.current, record.previous)
+		assert.Equal(t, record.expectedAdded, added)
+		assert.Equal(t, record.expectedRemoved, removed)
+	}
+}
+
+func TestWatchedServicesListener(t *testing.T) {
+	assert := assert.New(t)
+
+	builder := &DiscoveryBuilder{Connection: testConnection, BasePath: testBasePath, Watches: []string{"foo", "bar"}}
+	discovery, err := builder.New(&testLogger{t})
+	if !assert.Nil(err) {
+		return
+	}
+
+	assert.Equal([]string{"bar", "foo"}, discovery.ServiceNames())
+	assert.True(discovery.IsWatching("foo"))
+	assert.False(discovery.IsWatching("baz"))
+
+	var events []WatchedServicesEvent
+	registration := discovery.AddWatchedServicesListener(WatchedServicesListenerFunc(func(event WatchedServicesEvent) {
+		events = append(events, event)
+	}))
+
+	assert.Nil(discovery.AddService("baz"))
+	assert.Nil(discovery.AddService("baz"))
+	assert.Nil(discovery.AddService("alpha"))
+	assert.Nil(discovery.RemoveService("foo"))
+	assert.Equal([]string{"alpha", "bar", "baz"}, discovery.ServiceNames())
+	assert.True(discovery.IsWatching("baz"))
+	assert.False(discovery.IsWatching("foo"))
+
+	assert.Equal(
+		[]WatchedServicesEvent{
+			{Added: []string{"baz"}, Current: []string{"bar", "baz", "foo"}},
+			{Added: []string{"alpha"}, Current: []string{"alpha", "bar", "baz", "foo"}},
+			{Removed: []string{"foo"}, Current: []string{"alpha", "bar", "baz"}},
+		},
+		events,
+	)
+
+	registration.Cancel()
+	assert.Nil(discovery.RemoveService("bar"))
+	assert.Len(events, 3)
+}
+
+func TestWatchedServicesListenerConcurrency(t *testing.T) {
+	assert := assert.New(t)
+
+	static, err := NewStaticDiscovery(nil)
+	if !assert.Nil(err) {
+		return
+	}
+
+	var last WatchedServicesEvent
+	static.AddWatchedServicesListener(WatchedServicesListenerFunc(func(event WatchedServicesEvent) {
+		last = event
+	}))
+
+	waitGroup := &sync.WaitGroup{}
+	for _, serviceName := range []string{"a", "b", "c", "d", "e", "f"} {
+		waitGroup.Add(1)
+		go func(serviceName string) {
+			defer waitGroup.Done()
+			static.AddService(serviceName)
+			if serviceName > "c" {
+				static.RemoveService(serviceName)
+			}
+		}(serviceName)
+	}
+
+	waitGroup.Wait()
+
+	// the last event always describes the current services
+	assert.Equal([]string{"a", "b", "c"}, static.ServiceNames())
+	assert.Equal([]string{"a", "b", "c"}, last.Current)
+}
@@ -1,42 +1,365 @@
 package service
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"github.com/foursquare/curator.go"
 	"github.com/foursquare/fsgo/net/discovery"
-	"github.com/samuel/go-zookeeper/zk"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // serviceWatcher holds meta data about one particular service that's being
 // observed for changes.  This type also implements a simple API for interacting
 // with Zookeeper.
 type serviceWatcher struct {
-	curatorConnection  discovery.Conn
+	// metrics is first so that its 64-bit counters are aligned for atomic access on 32-bit platforms
+	metrics watcherMetrics
+
+	client             zookeeperClient
 	instanceSerializer discovery.InstanceSerializer
+	basePath           string
 	servicePath        string
 	serviceName        string
-	logger             zk.Logger
+	logger             Logger
+	dispatchOptions    dispatchOptions
+	retryOptions       retryOptions
+	fetchConcurrency   int
+	readBatchSize      int
+	fetchTimeout       time.Duration
+	logSampleSize      int
+	instanceError      InstanceErrorFunc
+	instanceFilter     InstanceFilter
+	versionConstraint  *VersionConstraint
+	debounceWindow     time.Duration
+	watchData          bool
+	coalesceReads      bool
+	tracer             Tracer
+	stopped            uint32
+	rewatching         uint32
+	resyncing          uint32
+
+	// refreshPending is set while a jittered refresh after reconnection is waiting to begin
+	refreshPending uint32
+
+	// staleThreshold is the age beyond which an instance is reported as stale, or zero if
+	// instances are never stale.  now returns the current time, and is replaced in tests.
+	staleThreshold time.Duration
+	now            func() time.Time
+
+	// watchLossWarnings is the number of warnings logged since this watcher's path was last
+	// watched.  It is only accessed by the goroutine which checks for lost watches.
+	watchLossWarnings int
+
+	// initializationPending is set while a failed initialization is retried in the background
+	initializationPending uint32
+
+	// initializeClaimed is set while this watcher is being, or has been, initialized by its
+	// serviceWatcherSet, so that a service added while discovery starts is initialized only once
+	initializeClaimed uint32
+
+	// pathMode determines how initialization treats a missing service path, and awaitingCreation
+	// is set while a servicePathWaitForCreation watcher is waiting for its path to be created
+	pathMode         servicePathMode
+	awaitingCreation uint32
 
+	// updatePending is set while a debounced or coalesced update is waiting to begin
+	updatePending uint32
+
+	// updateMutex serializes debounced and coalesced updates, so that an older read is never dispatched
+	// after a newer one
+	updateMutex sync.Mutex
+
+	// dataWatches holds the child ids which currently have a data watch set, so that each
+	// child has at most one outstanding data watch.  It is only used when watchData is set.
+	dataWatchMutex sync.Mutex
+	dataWatches    map[string]bool
+
+	// context is cancelled when this watcher is stopped, which abandons any reads in progress
+	context context.Context
+	cancel  context.CancelFunc
+
+	// dispatchMutex serializes dispatches, so that every listener observes the same sequence of
+	// snapshots.  It is acquired before the listenerMutex and is held while listener callbacks run.
+	// The listenerMutex is not, so that listeners may add and remove listeners, including themselves.
+	dispatchMutex sync.Mutex
 	listenerMutex sync.Mutex
-	listeners     []Listener
+	listeners     []*listenerEntry
+
+	// pinRequests holds the calls to pin or unpin made while a dispatch is in progress, which
+	// are applied in order before the dispatchMutex is released.  dispatching counts the callers
+	// holding or waiting on the dispatchMutex.  See requestPinning.
+	pinMutex    sync.Mutex
+	pinRequests []pinRequest
+	dispatching int
+
+	// instances is the last-known set of services, which is only valid once initialized is set.
+	// These fields are only modified while holding the dispatchMutex, the listenerMutex, and the
+	// instancesMutex, so that listeners always observe a consistent sequence of snapshots while
+	// readers of the cache never wait on listener callbacks.
+	instancesMutex sync.RWMutex
+	instances      Instances
+	annotated      AnnotatedInstances
+	initialized    bool
+
+	// sequence is the revision of the last-known set of services, which is the Sequence of the
+	// last dispatched InstanceEvent.  It is modified along with the instances, under both mutexes.
+	sequence uint64
+
+	// pinned replaces the last-known set of services while pinning is set, both in the cache and
+	// in dispatched events.  The instances read meanwhile are cached without being dispatched, and
+	// without advancing the sequence.  These fields are modified along with the instances.
+	pinning         bool
+	pinned          Instances
+	pinnedAnnotated AnnotatedInstances
+
+	// initializedSignal is closed once the first set of services has been read
+	initializedSignal chan struct{}
+
+	// fetched holds the time at which each ServiceInstance in the last-known set was read, and
+	// possibly instances read since, from which instances are annotated
+	fetchedMutex sync.Mutex
+	fetched      map[*discovery.ServiceInstance]time.Time
+
+	// sources holds one serviceWatcher per base path when a service is watched beneath more
+	// than one base path.  This watcher then never reads from zookeeper itself.  Instead, it
+	// merges the snapshots of its sources and dispatches the result to its own listeners.
+	sources    []*serviceWatcher
+	mergeMutex sync.Mutex
+
+	// history records each event dispatched to this watcher's listeners, or is nil when no
+	// history is kept.  Only the watcher which holds a service's listeners keeps a history.
+	history *eventHistory
+
+	// dispatched, if set, is called after each event is delivered to this watcher's listeners.
+	// It is set on the watcher which holds a service's listeners by the serviceWatcherSet.
+	dispatched func()
+}
+
+// pathWatchers returns the watchers which read from zookeeper on behalf of this watcher
+func (this *serviceWatcher) pathWatchers() []*serviceWatcher {
+	if len(this.sources) > 0 {
+		return this.sources
+	}
+
+	return []*serviceWatcher{this}
+}
+
+// mergeSources dispatches the combined snapshots of this watcher's sources, in base path
+// order.  Nothing is dispatched until every source has read its services.
+func (this *serviceWatcher) mergeSources() {
+	this.mergeMutex.Lock()
+	defer this.mergeMutex.Unlock()
+
+	merged := Instances{}
+	for _, source := range this.sources {
+		instances, ok := source.cachedInstances()
+		if !ok {
+			return
+		}
+
+		merged = append(merged, instances...)
+	}
+
+	this.dispatch(merged)
+}
+
+// metricsSnapshot returns the Metrics for this watcher.  A merging watcher reports the fetch
+// metrics of its sources along with its own instance and dispatch metrics.
+func (this *serviceWatcher) metricsSnapshot() Metrics {
+	snapshot := this.metrics.snapshot()
+	for _, source := range this.sources {
+		fetchMetrics := source.metrics.snapshot()
+		fetchMetrics.Instances = 0
+		fetchMetrics.StaleInstances = 0
+		fetchMetrics.Dispatches = 0
+		fetchMetrics.LastDispatch = time.Time{}
+		fetchMetrics.DispatchDuration = DurationHistogram{}
+		snapshot.add(fetchMetrics)
+	}
+
+	for _, pathWatcher := range this.pathWatchers() {
+		if pathWatcher.isInitializationPending() {
+			snapshot.PendingInitializations++
+		}
+	}
+
+	return snapshot
+}
+
+// instanceBasePath returns the base path beneath which the ServiceInstance with the given
+// Id was last read
+func (this *serviceWatcher) instanceBasePath(instanceId string) (string, bool) {
+	for _, pathWatcher := range this.pathWatchers() {
+		instances, _ := pathWatcher.cachedInstances()
+		for _, serviceInstance := range instances {
+			if serviceInstance != nil && serviceInstance.Id == instanceId {
+				return pathWatcher.basePath, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// cachedInstances returns the last-known Instances for this service.  If no services have
+// been read yet, this method returns false.
+func (this *serviceWatcher) cachedInstances() (Instances, bool) {
+	instances, _, initialized := this.cachedRevision()
+	return instances, initialized
+}
+
+// cachedRevision returns the last-known Instances for this service along with their revision.
+// If no services have been read yet, this method returns false.
+func (this *serviceWatcher) cachedRevision() (Instances, uint64, bool) {
+	this.instancesMutex.RLock()
+	defer this.instancesMutex.RUnlock()
+	if this.pinning {
+		return this.pinned, this.sequence, true
+	}
+
+	return this.instances, this.sequence, this.initialized
+}
+
+// waitForInitialized blocks until the first set of services has been read, returning the
+// last-known Instances.  If the given context is done first, its error is returned.  If this
+// watcher is stopped first, ErrorNoSuchService is returned.
+func (this *serviceWatcher) waitForInitialized(ctx context.Context) (Instances, error) {
+	if instances, ok := this.cachedInstances(); ok {
+		return instances, nil
+	}
+
+	select {
+	case <-this.initializedSignal:
+		instances, _ := this.cachedInstances()
+		return instances, nil
+	case <-this.context.Done():
+		return nil, ErrorNoSuchService
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// addListener appends a listener in the DefaultListenerGroup to this watcher.  See addGroupListener.
+func (this *serviceWatcher) addListener(listener Listener) (Registration, error) {
+	return this.addGroupListener(DefaultListenerGroup, listener)
+}
+
+// addGroupListener appends a listener in the given group to this watcher.  If this watcher has
+// already read its services, the new listener immediately receives the last-known Instances.
+// The returned Registration can be used to remove the listener.
+//
+// If the same listener is already registered in the given group, it is not added again.  Instead,
+// the existing Registration is returned, or ErrorAlreadyRegistered if duplicates are rejected.
+//
+// The last-known Instances are delivered without holding the listenerMutex, so this method
+// may be called from within a listener.  The new entry's deliveryMutex is held instead, so
+// that any dispatch which reaches the new listener waits until it has the last-known Instances.
+func (this *serviceWatcher) addGroupListener(group string, listener Listener) (Registration, error) {
+	return this.checkDuplicate(this.addEntry(group, listener, false))
+}
+
+// addOnceListener appends a listener in the given group which is removed after the next
+// dispatched event.  The last-known Instances are not delivered to it, and the listener is
+// invoked at most once, even if dispatches race.  Duplicates are handled as for addGroupListener.
+func (this *serviceWatcher) addOnceListener(group string, listener Listener) (Registration, error) {
+	return this.checkDuplicate(this.addEntry(group, listener, true))
+}
+
+// checkDuplicate applies the duplicate listener policy to the result of addEntry
+func (this *serviceWatcher) checkDuplicate(registration *listenerRegistration, duplicate bool) (Registration, error) {
+	if duplicate {
+		if this.dispatchOptions.rejectDuplicates {
+			return nil, ErrorAlreadyRegistered
+		}
+
+		this.logger.Debug("Listener %s is already registered for [%s]", listenerLabel(registration.entry.listener), this.serviceName)
+	}
+
+	return registration, nil
 }
 
-// addListener appends a listener to this watcher
-func (this *serviceWatcher) addListener(listener Listener) {
+// addEntry is the common implementation of addGroupListener and addOnceListener.  If the listener
+// is already registered, nothing is added, and the existing registration is returned along with true.
+func (this *serviceWatcher) addEntry(group string, listener Listener, once bool) (*listenerRegistration, bool) {
 	this.listenerMutex.Lock()
-	defer this.listenerMutex.Unlock()
-	this.listeners = append(this.listeners, listener)
+	this.pruneListeners()
+	if existing := this.findEntry(group, listener, once); existing != nil {
+		this.listenerMutex.Unlock()
+		return &listenerRegistration{existing}, true
+	}
+
+	entry := newListenerEntry(this.logger, listener, this.dispatchOptions, &this.metrics)
+	entry.group = group
+	entry.once = once
+	this.listeners = append(this.listeners, entry)
+	registration := &listenerRegistration{entry}
+	if !(this.initialized || this.pinning) || once {
+		this.listenerMutex.Unlock()
+		return registration, false
+	}
+
+	instances, annotated := this.instances, this.annotated
+	if this.pinning {
+		instances, annotated = this.pinned, this.pinnedAnnotated
+	}
+
+	event := InstanceEvent{
+		Added:     instances,
+		Current:   instances,
+		Annotated: annotated,
+		Stale:     this.staleInstances(instances),
+		Pinned:    this.pinning,
+		Sequence:  this.sequence,
+	}
+
+	entry.deliveryMutex.Lock()
+	defer entry.deliveryMutex.Unlock()
+	this.listenerMutex.Unlock()
+	entry.deliverLocked(this.serviceName, event)
+	return registration, false
+}
+
+// findEntry returns the active entry for the given listener in the given group, or nil if there
+// is none.  Listeners which are not comparable are never found.  Callers must hold the listenerMutex.
+func (this *serviceWatcher) findEntry(group string, listener Listener, once bool) *listenerEntry {
+	for _, candidate := range this.listeners {
+		if !candidate.isCancelled() && candidate.group == group && candidate.once == once && sameListener(candidate.listener, listener) {
+			return candidate
+		}
+	}
+
+	return nil
 }
 
-// removeListener removes a listener to this watcher
+// pruneListeners removes any cancelled entries.  Callers must hold the listenerMutex.
+func (this *serviceWatcher) pruneListeners() {
+	active := this.listeners[:0]
+	for _, entry := range this.listeners {
+		if !entry.isCancelled() {
+			active = append(active, entry)
+		}
+	}
+
+	// clear the tail so that pruned entries can be garbage collected
+	for index := len(active); index < len(this.listeners); index++ {
+		this.listeners[index] = nil
+	}
+
+	this.listeners = active
+}
+
+// removeListener removes a listener in the DefaultListenerGroup from this watcher.  Listeners
+// whose dynamic types are not comparable, such as a ListenerFunc, cannot be removed this way.
 func (this *serviceWatcher) removeListener(listener Listener) bool {
 	this.listenerMutex.Lock()
 	defer this.listenerMutex.Unlock()
-	for index, candidate := range this.listeners {
-		if candidate == listener {
-			this.listeners = append(this.listeners[:index], this.listeners[index+1:]...)
+	for _, candidate := range this.listeners {
+		if !candidate.isCancelled() && candidate.group == DefaultListenerGroup && sameListener(candidate.listener, listener) {
+			candidate.cancel()
+			this.pruneListeners()
 			return true
 		}
 	}
@@ -44,14 +367,407 @@ func (this *serviceWatcher) removeListener(listener Listener) bool {
 	return false
 }
 
-// dispatch broadcasts the given service Instances to all listeners associated
-// with this watcher
-func (this *serviceWatcher) dispatch(instances Instances) {
+// removeGroupListeners removes every listener in the given group from this watcher,
+// returning the number of listeners removed
+func (this *serviceWatcher) removeGroupListeners(group string) int {
+	this.listenerMutex.Lock()
+	defer this.listenerMutex.Unlock()
+	removed := 0
+	for _, entry := range this.listeners {
+		if !entry.isCancelled() && entry.group == group {
+			entry.cancel()
+			removed++
+		}
+	}
+
+	this.pruneListeners()
+	return removed
+}
+
+// removeAllListeners removes every listener from this watcher, stopping any
+// asynchronous dispatch, and returns the number of listeners removed
+func (this *serviceWatcher) removeAllListeners() int {
 	this.listenerMutex.Lock()
 	defer this.listenerMutex.Unlock()
-	for _, listener := range this.listeners {
-		listener.ServicesChanged(this.serviceName, instances)
+	removed := 0
+	for _, entry := range this.listeners {
+		if !entry.isCancelled() {
+			entry.cancel()
+			removed++
+		}
+	}
+
+	this.listeners = nil
+	return removed
+}
+
+// listenerCount returns the number of listeners registered with this watcher which
+// have not been removed
+func (this *serviceWatcher) listenerCount() int {
+	this.listenerMutex.Lock()
+	defer this.listenerMutex.Unlock()
+	count := 0
+	for _, entry := range this.listeners {
+		if !entry.isCancelled() {
+			count++
+		}
+	}
+
+	return count
+}
+
+// stop permanently halts dispatching for this watcher and removes all listeners.
+// Any outstanding zookeeper watch is simply allowed to fire, since a stopped
+// watcher will not dispatch the results.
+func (this *serviceWatcher) stop() {
+	if atomic.CompareAndSwapUint32(&this.stopped, 0, 1) {
+		if this.cancel != nil {
+			this.cancel()
+		}
+
+		this.removeAllListeners()
+		for _, source := range this.sources {
+			source.stop()
+		}
+	}
+}
+
+func (this *serviceWatcher) isStopped() bool {
+	return atomic.LoadUint32(&this.stopped) != 0
+}
+
+// pendingDispatch is an event, along with the listeners that receive it, which is prepared
+// while holding the listenerMutex and delivered after releasing it
+type pendingDispatch struct {
+	event     InstanceEvent
+	listeners []*listenerEntry
+}
+
+// dispatch records the given service Instances as the last-known set, then broadcasts them
+// to all listeners associated with this watcher.  Unless configured otherwise, the broadcast
+// is skipped when the given Instances have the same membership as the last-known set.  The
+// first dispatch is always broadcast, even when there are no instances, and nil Instances are
+// dispatched as empty.  While pinned, the given Instances are cached but not broadcast.  This
+// method does nothing if this watcher has been stopped.
+//
+// Listeners are invoked without holding the listenerMutex.  A listener added during a dispatch
+// receives only subsequent events, while a listener removed during a dispatch may still
+// receive the event in flight.
+func (this *serviceWatcher) dispatch(instances Instances) {
+	this.lockDispatch()
+	defer this.unlockDispatch()
+	this.listenerMutex.Lock()
+	pending := this.prepareDispatch(instances)
+	this.listenerMutex.Unlock()
+	this.deliver(pending)
+}
+
+// prepareDispatch records the given service Instances as the last-known set, returning the
+// event to deliver to a snapshot of the current listeners, or nil if nothing is to be delivered.
+// Callers must hold both the dispatchMutex and the listenerMutex, and must then release the
+// listenerMutex before passing the result to deliver.
+func (this *serviceWatcher) prepareDispatch(instances Instances) *pendingDispatch {
+	if this.isStopped() {
+		return nil
+	}
+
+	// listeners must be able to tell a service without instances from one that has not been read
+	if instances == nil {
+		instances = Instances{}
+	}
+
+	// when data is watched, instances whose data changed are dispatched even if the membership is unchanged
+	var updated Instances
+	if this.watchData && this.initialized {
+		updated = instances.updatedFrom(this.instances)
+	}
+
+	unchanged := this.initialized && !this.dispatchOptions.dispatchUnchanged
+	if unchanged && this.dispatchOptions.suppressEquivalent {
+		unchanged = this.instances.EquivalentTo(instances)
+	} else if unchanged {
+		unchanged = this.instances.Equal(instances, InstanceId) && len(updated) == 0
+	}
+
+	// while pinned, the instances read are only cached, to be dispatched once unpinned
+	unchanged = unchanged || this.pinning
+	added, removed := instances.Diff(this.instances, InstanceId)
+	stale := this.staleInstances(instances)
+	atomic.StoreInt64(&this.metrics.instances, int64(len(instances)))
+	atomic.StoreInt64(&this.metrics.stale, int64(len(stale)))
+
+	revision := this.sequence
+	if !unchanged {
+		revision++
+	}
+
+	annotated := this.annotate(instances, revision)
+	if len(this.sources) == 0 {
+		this.retainFetched(instances)
+	}
+
+	// the revision advances along with the cache, so that FetchRevision never observes a revision
+	// without its instances.  A suppressed snapshot keeps the revision of the same membership.
+	this.instancesMutex.Lock()
+	this.instances = instances
+	this.annotated = annotated
+	this.sequence = revision
+
+	if !this.initialized {
+		this.initialized = true
+		if this.initializedSignal != nil {
+			close(this.initializedSignal)
+		}
+	}
+
+	this.instancesMutex.Unlock()
+
+	if this.pinning {
+		this.logger.Debug("[%s] is pinned.  Caching %d instance(s) without dispatching.", this.serviceName, len(instances))
+		return nil
+	} else if unchanged {
+		this.logger.Debug("Membership of [%s] is unchanged.  Skipping dispatch.", this.serviceName)
+		return nil
+	}
+
+	return this.preparePending(InstanceEvent{
+		Added:     added,
+		Removed:   removed,
+		Updated:   updated,
+		Current:   instances,
+		Annotated: annotated,
+		Stale:     stale,
+		Sequence:  this.sequence,
+	})
+}
+
+// preparePending records the given event in the history, returning it along with a snapshot of
+// the current listeners.  Callers must hold both the dispatchMutex and the listenerMutex.
+func (this *serviceWatcher) preparePending(event InstanceEvent) *pendingDispatch {
+	this.history.add(newEventRecord(time.Now(), event))
+
+	// listeners are delivered to from a snapshot, so that the iteration is unaffected by any
+	// changes to the listener slice made while callbacks are in progress
+	this.pruneListeners()
+	listeners := make([]*listenerEntry, len(this.listeners))
+	copy(listeners, this.listeners)
+	return &pendingDispatch{event: event, listeners: listeners}
+}
+
+// deliver invokes each listener of a prepared dispatch.  Callers must hold the dispatchMutex,
+// but not the listenerMutex.  A nil pendingDispatch is ignored.
+func (this *serviceWatcher) deliver(pending *pendingDispatch) {
+	if pending == nil {
+		return
+	}
+
+	atomic.AddUint64(&this.metrics.dispatches, 1)
+	start := time.Now()
+	atomic.StoreInt64(&this.metrics.lastDispatch, start.UnixNano())
+	for _, entry := range pending.listeners {
+		entry.deliver(this.serviceName, pending.event)
+	}
+
+	this.metrics.recordDispatch(time.Since(start))
+	if this.dispatched != nil {
+		this.dispatched()
+	}
+}
+
+// staleInstances returns the given instances which registered longer ago than this watcher's
+// staleThreshold, or nil if instances are never stale
+func (this *serviceWatcher) staleInstances(instances Instances) Instances {
+	if this.staleThreshold <= 0 {
+		return nil
+	}
+
+	now := time.Now
+	if this.now != nil {
+		now = this.now
+	}
+
+	if stale := instances.OlderThan(now().Add(-this.staleThreshold)); len(stale) > 0 {
+		return stale
+	}
+
+	return nil
+}
+
+// reportInstanceError invokes the configured InstanceErrorFunc, if any, for a skipped child
+func (this *serviceWatcher) reportInstanceError(childId string, data []byte, err error) {
+	if this.instanceError != nil {
+		this.instanceError(this.servicePath, childId, data, err)
+	}
+}
+
+// skippedInstances returns the number of child znodes skipped during the most recent fetch
+// of each base path
+func (this *serviceWatcher) skippedInstances() int {
+	skipped := 0
+	for _, pathWatcher := range this.pathWatchers() {
+		skipped += int(atomic.LoadInt64(&pathWatcher.metrics.skipped))
+	}
+
+	return skipped
+}
+
+// fetchService obtains the ServiceInstance stored in a single child node.  If the child
+// could not be read or deserialized, this method returns nil.
+func (this *serviceWatcher) fetchService(ctx context.Context, childId string) *discovery.ServiceInstance {
+	instancePath := this.servicePath + "/" + childId
+	this.logger.Debug("Obtaining data for znode: %s", instancePath)
+	childContext, cancel := this.withFetchTimeout(ctx)
+	defer cancel()
+
+	data, err := this.readData(childContext, childId)
+	if ctx.Err() != nil {
+		// the entire fetch is being abandoned, so this child was not really skipped
+		return nil
+	} else if childContext.Err() != nil {
+		// a hung read, e.g. during a zookeeper disk stall, must not hold up the other children
+		atomic.AddUint64(&this.metrics.fetchTimeouts, 1)
+		this.logger.Error("Timed out after %s reading data from %s", this.fetchTimeout, instancePath)
+		this.reportInstanceError(childId, nil, ErrorFetchTimeout)
+		return nil
+	} else if err != nil {
+		// ignore errors when obtaining the child data, as its possible for the
+		// current set of children to have changed before this method was called
+		this.logger.Debug("Error retrieving data from %s: %s", instancePath, err)
+		this.reportInstanceError(childId, nil, err)
+		return nil
+	}
+
+	return this.deserializeService(childId, data)
+}
+
+// withFetchTimeout returns a context for reading the data of children, which is done once the
+// fetchTimeout elapses.  When there is no fetchTimeout, the given context is used as is.
+func (this *serviceWatcher) withFetchTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if this.fetchTimeout > 0 {
+		return context.WithTimeout(ctx, this.fetchTimeout)
+	}
+
+	return ctx, func() {}
+}
+
+// deserializeService obtains the ServiceInstance from the data of a single child node.  If the
+// data could not be deserialized, this method returns nil.
+func (this *serviceWatcher) deserializeService(childId string, data []byte) *discovery.ServiceInstance {
+	instancePath := this.servicePath + "/" + childId
+	serviceInstance, err := this.instanceSerializer.Deserialize(data)
+	if err != nil {
+		// ignore deserialization errors, as it's possible when doing upgrades
+		// for multiple versions of the discovery client to run simultaneously
+		this.logger.Error("Error deserializing service instance from %s: %s", instancePath, err)
+		this.reportInstanceError(childId, data, err)
+		return nil
 	}
+
+	serviceInstance.Id = childId
+	this.recordFetched(serviceInstance)
+	return serviceInstance
+}
+
+// fetchBatch obtains the ServiceInstance objects stored in the given child nodes with a single
+// batched read, storing each in the corresponding element of fetched.  If the batch fails, each
+// child is read individually instead, so that a child which cannot be read is skipped without
+// also skipping the rest of its batch.  A batch which exceeds the fetchTimeout is also read
+// individually, so that only the children which hang are skipped.
+func (this *serviceWatcher) fetchBatch(ctx context.Context, reader batchReader, childIds []string, fetched Instances) {
+	paths := make([]string, len(childIds))
+	for index, childId := range childIds {
+		paths[index] = this.servicePath + "/" + childId
+	}
+
+	batchContext, cancel := this.withFetchTimeout(ctx)
+	batch, err := reader.dataBatch(batchContext, paths)
+	cancel()
+	if ctx.Err() != nil {
+		return
+	} else if err == nil && len(batch) != len(childIds) {
+		err = errors.New(
+			fmt.Sprintf("Expected %d results but got %d", len(childIds), len(batch)),
+		)
+	}
+
+	if err != nil {
+		this.logger.Debug("Error reading a batch of %d children of %s, reading each instead: %s", len(childIds), this.servicePath, err)
+		for index, childId := range childIds {
+			fetched[index] = this.fetchService(ctx, childId)
+		}
+
+		return
+	}
+
+	for index, childId := range childIds {
+		fetched[index] = this.deserializeService(childId, batch[index])
+	}
+}
+
+// readData reads the data of the given child.  When data is watched, a data watch is set on
+// the child unless one is already outstanding.
+func (this *serviceWatcher) readData(ctx context.Context, childId string) ([]byte, error) {
+	instancePath := this.servicePath + "/" + childId
+	if !this.watchData || !this.claimDataWatch(childId) {
+		return this.client.data(ctx, instancePath)
+	}
+
+	data, err := this.client.watchData(ctx, instancePath)
+	if err != nil {
+		// zookeeper does not set a watch when the read fails
+		this.releaseDataWatch(childId)
+	}
+
+	return data, err
+}
+
+// claimDataWatch records that a data watch is being set on the given child, returning false
+// if the child already has one
+func (this *serviceWatcher) claimDataWatch(childId string) bool {
+	this.dataWatchMutex.Lock()
+	defer this.dataWatchMutex.Unlock()
+	if this.dataWatches[childId] {
+		return false
+	}
+
+	if this.dataWatches == nil {
+		this.dataWatches = make(map[string]bool)
+	}
+
+	this.dataWatches[childId] = true
+	return true
+}
+
+// releaseDataWatch forgets the data watch on the given child, which has fired or was never set
+func (this *serviceWatcher) releaseDataWatch(childId string) {
+	this.dataWatchMutex.Lock()
+	defer this.dataWatchMutex.Unlock()
+	delete(this.dataWatches, childId)
+}
+
+// pruneDataWatches forgets the data watches of any children not in the given child ids.
+// Zookeeper discards the watch on a deleted child once it fires, so nothing leaks if the
+// deletion event is never processed.
+func (this *serviceWatcher) pruneDataWatches(childIds []string) {
+	present := make(map[string]bool, len(childIds))
+	for _, childId := range childIds {
+		present[childId] = true
+	}
+
+	this.dataWatchMutex.Lock()
+	defer this.dataWatchMutex.Unlock()
+	for childId := range this.dataWatches {
+		if !present[childId] {
+			delete(this.dataWatches, childId)
+		}
+	}
+}
+
+// dataWatchCount returns the number of children with an outstanding data watch
+func (this *serviceWatcher) dataWatchCount() int {
+	this.dataWatchMutex.Lock()
+	defer this.dataWatchMutex.Unlock()
+	return len(this.dataWatches)
 }
 
 // fetchServices obtains the ServiceInstance objects from the given slice
@@ -59,196 +775,966 @@ func (this *serviceWatcher) dispatch(instances Instances) {
 // since during network flapping it's possible that the slice of child ids
 // is no longer valid.  This will be reflected in a partially filled or empty
 // Instances result.
-func (this *serviceWatcher) fetchServices(childIds []string) Instances {
-	this.logger.Printf("fetchServices(childIds=%s)", childIds)
-	instances := make(Instances, 0, len(childIds))
+//
+// Child nodes are read by a bounded pool of goroutines, and the results are
+// kept in the same order as the child ids.  If the context is done before all
+// children are read, no further children are read and the context's error is returned.
+// Instances rejected by the InstanceFilter, if any, are omitted from the result.
+//
+// When a readBatchSize is configured and the client can read batches, each goroutine reads
+// up to that many children per round trip instead of one.  Batches are not used when data is
+// watched, since each child's data watch is set individually.
+//
+// A completed fetch is summarized in a single info message, with the counts of children and
+// instances and a sample of at most logSampleSize ids.  Every id is only logged at the debug level.
+func (this *serviceWatcher) fetchServices(ctx context.Context, childIds []string) (Instances, error) {
+	this.logger.Debug("fetchServices(childIds=%s)", childIds)
+	fetched := make(Instances, len(childIds))
 
-	for _, childId := range childIds {
-		instancePath := this.servicePath + "/" + childId
-		this.logger.Printf("Obtaining data for znode: %s", instancePath)
-		data, err := this.curatorConnection.GetData().ForPath(instancePath)
-		if err != nil {
-			// ignore errors when obtaining the child data, as its possible for the
-			// current set of children to have changed before this method was called
-			this.logger.Printf("Error retrieving data from %s: %s", instancePath, err)
-			continue
+	batchSize := 1
+	reader, batched := batchReaderOf(this.client)
+	if batched = batched && this.readBatchSize > 1 && !this.watchData; batched {
+		batchSize = this.readBatchSize
+	}
+
+	batchCount := (len(childIds) + batchSize - 1) / batchSize
+	workerCount := this.fetchConcurrency
+	if workerCount < 1 {
+		workerCount = 1
+	} else if workerCount > batchCount {
+		workerCount = batchCount
+	}
+
+	starts := make(chan int)
+	waitGroup := &sync.WaitGroup{}
+	waitGroup.Add(workerCount)
+	for worker := 0; worker < workerCount; worker++ {
+		go func() {
+			defer waitGroup.Done()
+			for start := range starts {
+				if batched {
+					end := start + batchSize
+					if end > len(childIds) {
+						end = len(childIds)
+					}
+
+					this.fetchBatch(ctx, reader, childIds[start:end], fetched[start:end])
+				} else {
+					fetched[start] = this.fetchService(ctx, childIds[start])
+				}
+			}
+		}()
+	}
+
+produce:
+	for start := 0; start < len(childIds); start += batchSize {
+		select {
+		case starts <- start:
+		case <-ctx.Done():
+			break produce
 		}
+	}
 
-		serviceInstance, err := this.instanceSerializer.Deserialize(data)
-		if err != nil {
-			// ignore deserialization errors, as it's possible when doing upgrades
-			// for multiple versions of the discovery client to run simultaneously
-			this.logger.Printf("Error deserializing service instance from %s: %s", instancePath, err)
-			continue
+	close(starts)
+	waitGroup.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	instances := make(Instances, 0, len(childIds))
+	skipped, filtered, versionExcluded := 0, 0, 0
+	for _, serviceInstance := range fetched {
+		if serviceInstance == nil {
+			skipped++
+		} else if this.instanceFilter != nil && !this.instanceFilter(serviceInstance) {
+			this.logger.Debug("Filtered out %s from %s", serviceInstance.Id, this.servicePath)
+			filtered++
+		} else if !this.versionConstraint.Accepts(serviceInstance) {
+			this.logger.Debug("Excluded %s from %s by its version", serviceInstance.Id, this.servicePath)
+			versionExcluded++
+		} else {
+			instances = append(instances, serviceInstance)
 		}
+	}
 
-		serviceInstance.Id = childId
-		instances = append(instances, serviceInstance)
+	if this.watchData {
+		this.pruneDataWatches(childIds)
 	}
 
-	return instances
+	atomic.StoreInt64(&this.metrics.skipped, int64(skipped))
+	atomic.StoreInt64(&this.metrics.filtered, int64(filtered))
+	atomic.StoreInt64(&this.metrics.versionExcluded, int64(versionExcluded))
+	this.logger.Info(
+		"Fetched %d instances from %d children of %s [skipped=%d, filtered=%d, versionExcluded=%d, childIds=%s]",
+		len(instances), len(childIds), this.servicePath, skipped, filtered, versionExcluded, this.sampleIds(childIds),
+	)
+
+	return instances, nil
 }
 
-// readServices obtains the current child nodes, then invokes readServices
-func (this *serviceWatcher) readServices() (Instances, error) {
-	this.logger.Printf("readServices() [servicePath=%s]", this.servicePath)
-	childIds, err := this.curatorConnection.GetChildren().ForPath(this.servicePath)
-	if err != nil {
+// sampleIds formats at most logSampleSize of the given child ids for a log message, noting how
+// many were left out.  This bounds the size of the summary logged for services with many instances.
+func (this *serviceWatcher) sampleIds(childIds []string) string {
+	sampleSize := this.logSampleSize
+	if sampleSize < 1 {
+		sampleSize = DefaultLogSampleSize
+	}
+
+	if len(childIds) <= sampleSize {
+		return fmt.Sprintf("%s", childIds)
+	}
+
+	return fmt.Sprintf("%s ... and %d more", childIds[:sampleSize], len(childIds)-sampleSize)
+}
+
+// recordRead updates the fetch metrics for a read which began at the given time.  Reads
+// that are abandoned because the context is done are not recorded.
+func (this *serviceWatcher) recordRead(ctx context.Context, start time.Time, err *error) {
+	if ctx.Err() == nil {
+		this.metrics.recordFetch(time.Since(start), *err)
+	}
+}
+
+// readServices obtains the current child nodes, then invokes fetchServices.  If the
+// context is done before the read completes, the context's error is returned.
+func (this *serviceWatcher) readServices(ctx context.Context) (instances Instances, err error) {
+	this.logger.Debug("readServices() [servicePath=%s]", this.servicePath)
+	defer this.recordRead(ctx, time.Now(), &err)
+
+	var childIds []string
+	ctx, endTrace := this.startRead(ctx, false)
+	defer func() { endTrace(len(childIds), len(instances), err) }()
+
+	childIds, err = this.client.children(ctx, this.servicePath)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	} else if err != nil {
 		return nil, errors.New(
 			fmt.Sprintf("Error while fetching children for path %s: %v", this.servicePath, err),
 		)
 	}
 
-	return this.fetchServices(childIds), nil
+	return this.fetchServices(ctx, childIds)
 }
 
 // readServicesAndWatch is like readServices, except that it also sets a watch
 // on the watched service path
-func (this *serviceWatcher) readServicesAndWatch() (Instances, error) {
-	this.logger.Printf("readServicesAndWatch() [servicePath=%s]", this.servicePath)
-	childIds, err := this.curatorConnection.GetChildren().
-		Watched().
-		ForPath(this.servicePath)
-	if err != nil {
+func (this *serviceWatcher) readServicesAndWatch(ctx context.Context) (instances Instances, err error) {
+	this.logger.Debug("readServicesAndWatch() [servicePath=%s]", this.servicePath)
+	defer this.recordRead(ctx, time.Now(), &err)
+
+	var childIds []string
+	ctx, endTrace := this.startRead(ctx, true)
+	defer func() { endTrace(len(childIds), len(instances), err) }()
+
+	childIds, err = this.client.watchChildren(ctx, this.servicePath)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	} else if err != nil {
+		this.metrics.recordWatchLost()
 		return nil, errors.New(
 			fmt.Sprintf("Error while getting children with watch for path %s: %v", this.servicePath, err),
 		)
 	}
 
-	return this.fetchServices(childIds), nil
+	this.metrics.recordWatchSet()
+
+	return this.fetchServices(ctx, childIds)
 }
 
-// setWatch simply sets a watch on the service path
-func (this *serviceWatcher) setWatch() error {
-	this.logger.Printf("setWatch() [servicePath=%s]", this.servicePath)
-	_, err := this.curatorConnection.GetChildren().
-		Watched().
-		ForPath(this.servicePath)
-	if err != nil {
-		return errors.New(
-			fmt.Sprintf("Error while setting child watch for path %s: %v", this.servicePath, err),
-		)
+// rewatch re-establishes the watch on this service's path in the background, retrying
+// with exponential backoff.  Once the watch is set, the services read along with it are
+// dispatched so that listeners catch up on anything missed.  At most one rewatch runs
+// at a time for a given watcher, and a rewatch is abandoned if this watcher is stopped.
+func (this *serviceWatcher) rewatch() {
+	if !atomic.CompareAndSwapUint32(&this.rewatching, 0, 1) {
+		return
 	}
 
-	return nil
+	go func() {
+		defer atomic.StoreUint32(&this.rewatching, 0)
+		backoff := newBackoff(this.retryOptions)
+		for {
+			delay, ok := backoff.next()
+			if !ok {
+				this.logger.Error("Giving up on re-establishing the watch for path %s", this.servicePath)
+				return
+			}
+
+			timer := time.NewTimer(delay)
+			select {
+			case <-this.context.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			instances, err := this.readServicesAndWatch(this.context)
+			if this.context.Err() != nil {
+				return
+			} else if err == nil {
+				this.logger.Info("Re-established watch for path %s", this.servicePath)
+				atomic.AddUint64(&this.metrics.rewatches, 1)
+				this.dispatch(instances)
+				return
+			}
+
+			this.logger.Error("Unable to re-establish watch: %v", err)
+		}
+	}()
 }
 
-// initialize sets up this watcher with a curator connection and ensures that any necessary
-// znode paths exist.  The initial set of services is dispatched to any listeners.
-func (this *serviceWatcher) initialize(curatorConnection discovery.Conn) error {
-	this.logger.Printf("initialize(curatorConnection=%v)", curatorConnection)
-	this.curatorConnection = curatorConnection
+// retryInitialization retries a failed initialization in the background, backing off between
+// attempts, until it succeeds or this watcher is stopped.  Until then, this watcher is reported as
+// pending, and is skipped by polling and resyncs.  If the retry policy is exhausted, the watcher
+// remains pending.
+func (this *serviceWatcher) retryInitialization(client zookeeperClient) {
+	if !atomic.CompareAndSwapUint32(&this.initializationPending, 0, 1) {
+		return
+	}
 
-	this.logger.Printf("Ensuring %s exists ...", this.servicePath)
-	err := curator.NewEnsurePath(this.servicePath).Ensure(this.curatorConnection.ZookeeperClient())
-	if err != nil && err != zk.ErrNodeExists {
-		return errors.New(
-			fmt.Sprintf("Error during initialization while ensuring path %s: %v", this.servicePath, err),
-		)
+	go func() {
+		backoff := newBackoff(this.retryOptions)
+		for {
+			delay, ok := backoff.next()
+			if !ok {
+				this.logger.Error("Giving up on initializing the watch for path %s", this.servicePath)
+				return
+			}
+
+			timer := time.NewTimer(delay)
+			select {
+			case <-this.context.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			err := this.initialize(client)
+			if this.context.Err() != nil {
+				return
+			} else if err == nil {
+				this.logger.Info("Initialized watch for path %s", this.servicePath)
+				atomic.StoreUint32(&this.initializationPending, 0)
+				return
+			}
+
+			this.logger.Error("Unable to initialize watch: %v", err)
+		}
+	}()
+}
+
+// isInitializationPending tests if this watcher is still retrying a failed initialization
+func (this *serviceWatcher) isInitializationPending() bool {
+	return atomic.LoadUint32(&this.initializationPending) != 0
+}
+
+// checkWatch logs a warning if this watcher's path has been without a watch for longer than the
+// given threshold.  Warnings escalate: the first is logged once the threshold is exceeded, and
+// each later one is logged as an error once the time without a watch has doubled again, so that a
+// watch which is never recovered grows more prominent without flooding the log.
+func (this *serviceWatcher) checkWatch(threshold time.Duration) {
+	watchGeneration, lastWatchSet, unwatchedSince := this.metrics.watchState()
+	if unwatchedSince.IsZero() {
+		this.watchLossWarnings = 0
+		return
+	}
+
+	unwatched := time.Since(unwatchedSince)
+	if unwatched <= threshold<<uint(this.watchLossWarnings) {
+		return
+	}
+
+	this.watchLossWarnings++
+	if this.watchLossWarnings == 1 {
+		this.logger.Info("No watch has been set on path %s for %s [generation=%d, lastWatchSet=%s]", this.servicePath, unwatched, watchGeneration, lastWatchSet)
+	} else {
+		this.logger.Error("No watch has been set on path %s for %s [generation=%d, lastWatchSet=%s]", this.servicePath, unwatched, watchGeneration, lastWatchSet)
+	}
+}
+
+// resync reads this watcher's services and re-sets its watch, dispatching the services only
+// if their membership differs from the last-known set.  A resync is skipped if another resync
+// of this watcher is still in progress.
+func (this *serviceWatcher) resync() {
+	if !atomic.CompareAndSwapUint32(&this.resyncing, 0, 1) {
+		this.logger.Debug("Resync of [%s] already in progress", this.serviceName)
+		return
+	}
+
+	defer atomic.StoreUint32(&this.resyncing, 0)
+	instances, err := this.readServicesAndWatch(this.context)
+	if this.context.Err() != nil {
+		return
+	} else if err != nil {
+		this.logger.Error("Error while resyncing [%s] services: %v", this.serviceName, err)
+		this.rewatch()
+		return
+	}
+
+	if cached, ok := this.cachedInstances(); ok && cached.Equal(instances, InstanceId) {
+		this.logger.Debug("Resync found no changes to [%s]", this.serviceName)
+		this.retainFetched(cached)
+		return
+	}
+
+	this.logger.Info("Resync found changes to [%s]", this.serviceName)
+	this.dispatch(instances)
+}
+
+// readAndDispatch reads this watcher's services along with a new watch, then dispatches them.
+// If the read fails, the watch is re-established in the background.
+func (this *serviceWatcher) readAndDispatch() {
+	instances, err := this.readServicesAndWatch(this.context)
+	if this.context.Err() != nil {
+		return
+	} else if err != nil {
+		this.logger.Error("Error while updating services: %v", err)
+		this.rewatch()
+	} else {
+		this.dispatch(instances)
+	}
+}
+
+// coalescedUpdate calls readAndDispatch in the background.  While an update is waiting to
+// begin, e.g. because reads are being throttled, further events are coalesced into it rather
+// than queued, so each watcher has at most one update waiting.
+func (this *serviceWatcher) coalescedUpdate() {
+	if !atomic.CompareAndSwapUint32(&this.updatePending, 0, 1) {
+		this.logger.Debug("Coalescing event for path %s", this.servicePath)
+		return
+	}
+
+	go func() {
+		this.updateMutex.Lock()
+		defer this.updateMutex.Unlock()
+
+		// events from this point on require another read
+		atomic.StoreUint32(&this.updatePending, 0)
+		this.readAndDispatch()
+	}()
+}
+
+// childrenChanged handles a child watch event on this watcher's path.  Without a debounce
+// window, the services are read along with a new watch and dispatched immediately.  When
+// reads are rate limited, this happens in the background so that a throttled read never
+// blocks the processing of other events.
+//
+// When a debounce window is configured, the watch is re-set immediately, so that no changes
+// are missed, but the services are not read and dispatched until the window has elapsed.
+// Any further events within the window are coalesced into that single read.
+func (this *serviceWatcher) childrenChanged() {
+	// zookeeper watches fire only once, so this path is unwatched until the watch is set again
+	this.metrics.recordWatchLost()
+	if this.debounceWindow <= 0 {
+		if this.coalesceReads {
+			this.coalescedUpdate()
+		} else {
+			this.readAndDispatch()
+		}
+
+		return
+	}
+
+	if _, err := this.client.watchChildren(this.context, this.servicePath); err != nil {
+		if this.context.Err() == nil {
+			this.logger.Error("Error while resetting the watch for path %s: %v", this.servicePath, err)
+			this.rewatch()
+		}
+
+		return
 	}
 
+	this.metrics.recordWatchSet()
+	if !atomic.CompareAndSwapUint32(&this.updatePending, 0, 1) {
+		this.logger.Debug("Coalescing event for path %s", this.servicePath)
+		return
+	}
+
+	time.AfterFunc(this.debounceWindow, func() {
+		this.updateMutex.Lock()
+		defer this.updateMutex.Unlock()
+
+		// events from this point on require another read
+		atomic.StoreUint32(&this.updatePending, 0)
+		instances, err := this.readServices(this.context)
+		if this.context.Err() != nil {
+			return
+		} else if err != nil {
+			this.logger.Error("Error while updating services: %v", err)
+			this.rewatch()
+		} else {
+			this.dispatch(instances)
+		}
+	})
+}
+
+// instanceChanged handles a data watch event on one of this watcher's children.  The watch has
+// fired, so it is forgotten.  Unless the child was deleted, which is handled by the child watch,
+// the child is read again along with a new data watch, and the updated Instances are dispatched.
+// If the child is not in the last-known set, e.g. because the InstanceFilter previously rejected
+// it, all of this watcher's services are read instead.
+func (this *serviceWatcher) instanceChanged(childId string, deleted bool) {
+	this.releaseDataWatch(childId)
+	if deleted || this.isStopped() {
+		return
+	}
+
+	serviceInstance := this.fetchService(this.context, childId)
+	if this.context.Err() != nil || serviceInstance == nil {
+		return
+	}
+
+	accepted := (this.instanceFilter == nil || this.instanceFilter(serviceInstance)) &&
+		this.versionConstraint.Accepts(serviceInstance)
+
+	this.lockDispatch()
 	this.listenerMutex.Lock()
-	defer this.listenerMutex.Unlock()
+	if this.initialized {
+		for index, cached := range this.instances {
+			if cached != nil && cached.Id == childId {
+				updated := make(Instances, 0, len(this.instances))
+				updated = append(updated, this.instances[:index]...)
+				if accepted {
+					updated = append(updated, serviceInstance)
+				}
 
-	if len(this.listeners) > 0 {
-		instances, err := this.readServicesAndWatch()
-		if err != nil {
-			return err
+				updated = append(updated, this.instances[index+1:]...)
+				pending := this.prepareDispatch(updated)
+				this.listenerMutex.Unlock()
+				this.deliver(pending)
+				this.unlockDispatch()
+				return
+			}
 		}
+	}
 
-		// manually dispatch to listeners, since locks are reentrant
-		for _, listener := range this.listeners {
-			listener.ServicesChanged(this.serviceName, instances)
+	this.listenerMutex.Unlock()
+	this.unlockDispatch()
+	if !accepted {
+		return
+	}
+
+	instances, err := this.readServices(this.context)
+	if this.context.Err() != nil {
+		return
+	} else if err != nil {
+		this.logger.Error("Error while updating services: %v", err)
+		this.rewatch()
+	} else {
+		this.dispatch(instances)
+	}
+}
+
+// initialize sets up this watcher with a zookeeper client and ensures that any necessary
+// znode paths exist.  The initial set of services is read, a watch is set, and the services
+// are dispatched to any listeners.  Listeners added afterward receive the same initial set
+// when they are added.
+func (this *serviceWatcher) initialize(client zookeeperClient) error {
+	this.logger.Debug("initialize() [servicePath=%s]", this.servicePath)
+	if len(this.sources) > 0 {
+		// the merged services are dispatched once the last source is initialized
+		for _, source := range this.sources {
+			if err := source.initialize(client); err != nil {
+				return err
+			}
 		}
+
+		return nil
+	}
+
+	this.client = client
+	if ready, err := this.preparePath(); !ready {
+		return err
 	}
 
-	return this.setWatch()
+	// the dispatchMutex is held while reading, so that no other dispatch intervenes
+	this.lockDispatch()
+	defer this.unlockDispatch()
+
+	instances, err := this.readServicesAndWatch(this.context)
+	if err != nil {
+		return err
+	}
+
+	this.listenerMutex.Lock()
+	pending := this.prepareDispatch(instances)
+	this.listenerMutex.Unlock()
+	this.deliver(pending)
+	return nil
 }
 
-// serviceWatcherSet is an internal collection type that maps serviceWatches by name and path
+// serviceWatcherSet is an internal collection type that maps serviceWatches by name and path.
+// A serviceWatcherSet is safe for concurrent use.
 type serviceWatcherSet struct {
+	mutex sync.RWMutex
+
+	// serviceNames holds the name of each watched service, without duplicates and in sorted order,
+	// which is the order in which the watchers are initialized
 	serviceNames []string
 	byName       map[string]*serviceWatcher
 	byPath       map[string]*serviceWatcher
-	logger       zk.Logger
+
+	// patternListeners are attached to every matching service, including those added later
+	patternListeners []*patternListener
+
+	// watchedServices delivers each change to the serviceNames
+	watchedServices *watchedServicesMonitor
+
+	// aggregates delivers the snapshots of every service after any of them changes
+	aggregates *aggregateMonitor
+
+	basePaths          []string
+	instanceSerializer discovery.InstanceSerializer
+	options            watcherOptions
+	context            context.Context
+	logger             Logger
+}
+
+// watcherOptions holds the configuration shared by each serviceWatcher in a set
+type watcherOptions struct {
+	dispatch          dispatchOptions
+	retry             retryOptions
+	fetchConcurrency  int
+	readBatchSize     int
+	fetchTimeout      time.Duration
+	logSampleSize     int
+	instanceError     InstanceErrorFunc
+	instanceFilter    InstanceFilter
+	versionConstraint *VersionConstraint
+	debounceWindow    time.Duration
+	watchData         bool
+	tracer            Tracer
+
+	// aggregateWindow is the time during which changes to any service are coalesced before
+	// the snapshots of every service are delivered to each AggregateListener
+	aggregateWindow time.Duration
+
+	// eventHistorySize is the number of dispatched events recorded for each service, where zero
+	// disables the history
+	eventHistorySize int
+
+	// staleThreshold is the age beyond which instances are reported as stale, where zero disables
+	// staleness.  now returns the current time, and defaults to time.Now when nil.
+	staleThreshold time.Duration
+	now            func() time.Time
+
+	// pathMode is how a missing service path is treated, unless overridden in pathModes by service name
+	pathMode  servicePathMode
+	pathModes map[string]servicePathMode
+
+	// servicePaths maps the names of services which are watched at a configured path, rather than
+	// beneath the base paths, to that path
+	servicePaths map[string]string
+
+	// lenient is set when a watcher which cannot be initialized should be retried in the
+	// background rather than failing the whole set
+	lenient bool
+
+	// coalesceReads is set when reads are rate limited, so that watch events which arrive while
+	// a read is throttled are coalesced
+	coalesceReads bool
+
+	// rootContext is the context from which each watcher's context is derived.
+	// When nil, context.Background() is used.
+	rootContext context.Context
+
+	// instanceSerializer defaults to a discovery.JsonInstanceSerializer when nil
+	instanceSerializer discovery.InstanceSerializer
+}
+
+// servicePathMode returns how a missing path is treated for the named service
+func (this watcherOptions) servicePathMode(serviceName string) servicePathMode {
+	if pathMode, ok := this.pathModes[serviceName]; ok {
+		return pathMode
+	}
+
+	return this.pathMode
 }
 
 // newServiceWatcherSet is an internal Factory Method that creates one serviceWatcher
 // for each service name, then returns a serviceWatcherSet with the services mapped.
-func newServiceWatcherSet(logger zk.Logger, serviceNames []string, basePath string) *serviceWatcherSet {
-	logger.Printf("newServiceWatcherSet(serviceNames=%s, basePath=%s)", serviceNames, basePath)
+// When there is more than one base path, the instances of each service are merged
+// across all of them, except for services with a configured path in the options.  An
+// error is returned if there are no base paths, if any base path, configured path, or
+// service name is invalid, or if two services would be watched at the same path.
+func newServiceWatcherSet(logger Logger, serviceNames []string, basePaths []string, options watcherOptions) (*serviceWatcherSet, error) {
+	logger.Debug("newServiceWatcherSet(serviceNames=%s, basePaths=%s)", serviceNames, basePaths)
+	if len(basePaths) == 0 {
+		return nil, ErrorNoBasePaths
+	}
+
+	normalizedBasePaths := make([]string, 0, len(basePaths))
+	seen := make(map[string]bool, len(basePaths))
+	for _, basePath := range basePaths {
+		normalized, err := normalizeBasePath(basePath)
+		if err != nil {
+			return nil, err
+		}
+
+		// ignore duplicate base paths, which would otherwise double every instance
+		if !seen[normalized] {
+			seen[normalized] = true
+			normalizedBasePaths = append(normalizedBasePaths, normalized)
+		}
+	}
+
+	if err := validateServiceNames(serviceNames); err != nil {
+		return nil, err
+	}
+
+	servicePaths, err := normalizeServicePaths(options.servicePaths)
+	if err != nil {
+		return nil, err
+	}
+
+	options.servicePaths = servicePaths
+	instanceSerializer := options.instanceSerializer
+	if instanceSerializer == nil {
+		instanceSerializer = &discovery.JsonInstanceSerializer{}
+	}
+
+	rootContext := options.rootContext
+	if rootContext == nil {
+		rootContext = context.Background()
+	}
+
 	watcherCount := len(serviceNames)
-	byName := make(map[string]*serviceWatcher, watcherCount)
-	byPath := make(map[string]*serviceWatcher, watcherCount)
-	instanceSerializer := &discovery.JsonInstanceSerializer{}
+	serviceWatcherSet := &serviceWatcherSet{
+		byName:             make(map[string]*serviceWatcher, watcherCount),
+		byPath:             make(map[string]*serviceWatcher, watcherCount),
+		basePaths:          normalizedBasePaths,
+		instanceSerializer: instanceSerializer,
+		options:            options,
+		context:            rootContext,
+		logger:             logger,
+	}
 
+	serviceWatcherSet.aggregates = newAggregateMonitor(logger, options.aggregateWindow, serviceWatcherSet.snapshots)
 	for _, serviceName := range serviceNames {
 		// ignore duplicate service names
-		if _, ok := byName[serviceName]; ok {
-			logger.Printf("Skipping duplicate watched service name: %s", serviceName)
+		if _, ok := serviceWatcherSet.byName[serviceName]; ok {
+			logger.Info("Skipping duplicate watched service name: %s", serviceName)
 			continue
 		}
 
-		servicePath := basePath + "/" + serviceName
-		serviceWatcher := &serviceWatcher{
-			instanceSerializer: instanceSerializer,
-			servicePath:        servicePath,
-			serviceName:        serviceName,
-			logger:             logger,
+		serviceWatcher := serviceWatcherSet.newServiceWatcher(serviceName)
+		if err := serviceWatcherSet.checkPaths(serviceWatcher); err != nil {
+			return nil, err
 		}
 
-		byName[serviceWatcher.serviceName] = serviceWatcher
-		byPath[serviceWatcher.servicePath] = serviceWatcher
+		serviceWatcherSet.put(serviceWatcher)
+		serviceWatcherSet.serviceNames = append(serviceWatcherSet.serviceNames, serviceName)
 	}
 
-	serviceWatcherSet := &serviceWatcherSet{
-		serviceNames: make([]string, len(byName)),
-		byName:       byName,
-		byPath:       byPath,
-		logger:       logger,
+	// the sorted names determine the order in which the watchers are initialized
+	sort.Strings(serviceWatcherSet.serviceNames)
+	serviceWatcherSet.watchedServices = newWatchedServicesMonitor(logger, serviceWatcherSet.cloneServiceNames())
+
+	logger.Debug("using serviceWatcherSet: %v", serviceWatcherSet)
+	return serviceWatcherSet, nil
+}
+
+// newServiceWatcher creates a serviceWatcher for the given service name using the configuration
+// of this set.  The returned watcher is not added to this set.  A service with a configured path
+// is read only from that path.  Otherwise, when this set has more than one base path, the returned
+// watcher merges the snapshots of one source watcher per base path.
+func (this *serviceWatcherSet) newServiceWatcher(serviceName string) *serviceWatcher {
+	if servicePath, ok := this.options.servicePaths[serviceName]; ok {
+		serviceWatcher := this.newPathWatcher(this.context, servicePath, serviceName, this.options.dispatch)
+		serviceWatcher.history = newEventHistory(this.options.eventHistorySize)
+		return serviceWatcher
+	} else if len(this.basePaths) == 1 {
+		serviceWatcher := this.newPathWatcher(this.context, this.basePaths[0]+"/"+serviceName, serviceName, this.options.dispatch)
+		serviceWatcher.history = newEventHistory(this.options.eventHistorySize)
+		return serviceWatcher
 	}
 
-	// copying the keys ensures that the service names have been deduped
-	index := 0
-	for serviceName := range serviceWatcherSet.byName {
-		serviceWatcherSet.serviceNames[index] = serviceName
-		index++
+	watcherContext, cancel := context.WithCancel(this.context)
+	merged := &serviceWatcher{
+		serviceName:       serviceName,
+		logger:            this.logger,
+		dispatchOptions:   this.options.dispatch,
+		watchData:         this.options.watchData,
+		staleThreshold:    this.options.staleThreshold,
+		now:               this.options.now,
+		initializedSignal: make(chan struct{}),
+		context:           watcherContext,
+		cancel:            cancel,
+		history:           newEventHistory(this.options.eventHistorySize),
 	}
 
-	logger.Printf("using serviceWatcherSet: %v", serviceWatcherSet)
-	return serviceWatcherSet
+	// sources dispatch synchronously to the merged watcher, which applies the configured dispatch options
+	sourceOptions := dispatchOptions{dispatchUnchanged: this.options.dispatch.dispatchUnchanged}
+	for _, basePath := range this.basePaths {
+		source := this.newPathWatcher(merged.context, basePath+"/"+serviceName, serviceName, sourceOptions)
+		source.addListener(ListenerFunc(func(serviceName string, instances Instances) {
+			merged.mergeSources()
+		}))
+
+		merged.sources = append(merged.sources, source)
+	}
+
+	return merged
+}
+
+// newPathWatcher creates a serviceWatcher which reads the given service from a single path.  The
+// base path of the watcher is the parent of that path.
+func (this *serviceWatcherSet) newPathWatcher(parent context.Context, servicePath, serviceName string, dispatchOptions dispatchOptions) *serviceWatcher {
+	watcherContext, cancel := context.WithCancel(parent)
+	return &serviceWatcher{
+		instanceSerializer: this.instanceSerializer,
+		basePath:           parentPath(servicePath),
+		servicePath:        servicePath,
+		serviceName:        serviceName,
+		logger:             this.logger,
+		dispatchOptions:    dispatchOptions,
+		retryOptions:       this.options.retry,
+		fetchConcurrency:   this.options.fetchConcurrency,
+		readBatchSize:      this.options.readBatchSize,
+		fetchTimeout:       this.options.fetchTimeout,
+		logSampleSize:      this.options.logSampleSize,
+		debounceWindow:     this.options.debounceWindow,
+		instanceError:      this.options.instanceError,
+		instanceFilter:     this.options.instanceFilter,
+		versionConstraint:  this.options.versionConstraint,
+		watchData:          this.options.watchData,
+		coalesceReads:      this.options.coalesceReads,
+		tracer:             this.options.tracer,
+		staleThreshold:     this.options.staleThreshold,
+		now:                this.options.now,
+		pathMode:           this.options.servicePathMode(serviceName),
+		initializedSignal:  make(chan struct{}),
+		context:            watcherContext,
+		cancel:             cancel,
+	}
+}
+
+// checkPaths returns a ServicePathCollisionError if any path of the given watcher is already
+// watched by another service in this set.  Callers must hold a lock or otherwise have exclusive
+// access to this set.
+func (this *serviceWatcherSet) checkPaths(serviceWatcher *serviceWatcher) error {
+	for _, pathWatcher := range serviceWatcher.pathWatchers() {
+		if existing, ok := this.byPath[pathWatcher.servicePath]; ok {
+			return ServicePathCollisionError{
+				Path:         pathWatcher.servicePath,
+				ServiceNames: []string{existing.serviceName, serviceWatcher.serviceName},
+			}
+		}
+	}
+
+	return nil
+}
+
+// put maps the given watcher by name, and each of its path watchers by path.  Callers
+// must hold the write lock or otherwise have exclusive access to this set.
+func (this *serviceWatcherSet) put(serviceWatcher *serviceWatcher) {
+	serviceWatcher.dispatched = this.aggregates.changed
+	this.byName[serviceWatcher.serviceName] = serviceWatcher
+	for _, pathWatcher := range serviceWatcher.pathWatchers() {
+		this.byPath[pathWatcher.servicePath] = pathWatcher
+	}
 }
 
 func (this *serviceWatcherSet) serviceCount() int {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
 	return len(this.serviceNames)
 }
 
+// cloneServiceNames returns a copy of the names of the services in this set, in sorted order
 func (this *serviceWatcherSet) cloneServiceNames() []string {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
 	serviceNames := make([]string, len(this.serviceNames))
 	copy(serviceNames, this.serviceNames)
 	return serviceNames
 }
 
+// isWatching tests whether the named service is in this set
+func (this *serviceWatcherSet) isWatching(serviceName string) bool {
+	_, ok := this.findByName(serviceName)
+	return ok
+}
+
 func (this *serviceWatcherSet) findByName(serviceName string) (*serviceWatcher, bool) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
 	value, ok := this.byName[serviceName]
 	return value, ok
 }
 
 func (this *serviceWatcherSet) findByPath(path string) (*serviceWatcher, bool) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
 	value, ok := this.byPath[path]
 	return value, ok
 }
 
-// initialize initializes all watchers in this set
-func (this *serviceWatcherSet) initialize(curatorConnection discovery.Conn) error {
-	this.logger.Printf("initialize(curatorConnection=%v)", curatorConnection)
-	for _, serviceWatcher := range this.byName {
-		err := serviceWatcher.initialize(curatorConnection)
+// watchers returns a snapshot of the serviceWatchers currently in this set, in the sorted order
+// of their service names.  Watchers are always initialized, refreshed, and stopped in this order,
+// so that a deployment in which one service path depends on another behaves the same every time.
+func (this *serviceWatcherSet) watchers() []*serviceWatcher {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	watchers := make([]*serviceWatcher, 0, len(this.serviceNames))
+	for _, serviceName := range this.serviceNames {
+		watchers = append(watchers, this.byName[serviceName])
+	}
+
+	return watchers
+}
+
+// snapshots returns the last-known Instances of each service in this set which has been read,
+// keyed by service name
+func (this *serviceWatcherSet) snapshots() map[string]Instances {
+	snapshots := make(map[string]Instances)
+	for _, serviceWatcher := range this.watchers() {
+		if instances, ok := serviceWatcher.cachedInstances(); ok {
+			snapshots[serviceWatcher.serviceName] = instances
+		}
+	}
+
+	return snapshots
+}
+
+// pathWatchers returns a snapshot of the serviceWatchers which read from zookeeper, i.e. one per
+// service and base path.  They are ordered as in watchers, then by the order of the base paths.
+func (this *serviceWatcherSet) pathWatchers() []*serviceWatcher {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	watchers := make([]*serviceWatcher, 0, len(this.byPath))
+	for _, serviceName := range this.serviceNames {
+		watchers = append(watchers, this.byName[serviceName].pathWatchers()...)
+	}
+
+	return watchers
+}
+
+// add creates a serviceWatcher for the given service name and adds it to this set.  If the
+// service is already in this set, the existing watcher is returned along with false.  An
+// invalid service name is rejected with a ServiceNamesError, and a service whose path is
+// already watched by another service is rejected with a ServicePathCollisionError.
+func (this *serviceWatcherSet) add(serviceName string) (*serviceWatcher, bool, error) {
+	if err := validateServiceNames([]string{serviceName}); err != nil {
+		return nil, false, err
+	}
+
+	this.mutex.Lock()
+	if existing, ok := this.byName[serviceName]; ok {
+		this.mutex.Unlock()
+		return existing, false, nil
+	}
+
+	serviceWatcher := this.newServiceWatcher(serviceName)
+	if err := this.checkPaths(serviceWatcher); err != nil {
+		this.mutex.Unlock()
+		serviceWatcher.stop()
+		return nil, false, err
+	}
+
+	this.put(serviceWatcher)
+
+	// the names are kept sorted, so that they can be copied without sorting
+	index := sort.SearchStrings(this.serviceNames, serviceName)
+	this.serviceNames = append(this.serviceNames, "")
+	copy(this.serviceNames[index+1:], this.serviceNames[index:])
+	this.serviceNames[index] = serviceName
+
+	// a new watcher has read nothing, so attaching cannot invoke a listener while locked
+	for _, patternListener := range this.matchingPatternListeners(serviceName) {
+		patternListener.attach(serviceWatcher)
+	}
+
+	this.mutex.Unlock()
+	this.watchedServices.changed(this.cloneServiceNames)
+	return serviceWatcher, true, nil
+}
+
+// remove deletes the named service from this set and stops its watcher.  The removed
+// watcher is returned, or false if no such service was in this set.
+func (this *serviceWatcherSet) remove(serviceName string) (*serviceWatcher, bool) {
+	this.mutex.Lock()
+	serviceWatcher, ok := this.byName[serviceName]
+	if ok {
+		delete(this.byName, serviceName)
+		for _, pathWatcher := range serviceWatcher.pathWatchers() {
+			delete(this.byPath, pathWatcher.servicePath)
+		}
+
+		for index, candidate := range this.serviceNames {
+			if candidate == serviceName {
+				this.serviceNames = append(this.serviceNames[:index], this.serviceNames[index+1:]...)
+				break
+			}
+		}
+	}
+
+	patternListeners := this.matchingPatternListeners(serviceName)
+	this.mutex.Unlock()
+	if ok {
+		serviceWatcher.stop()
+		for _, patternListener := range patternListeners {
+			patternListener.detach(serviceWatcher)
+		}
+
+		this.watchedServices.changed(this.cloneServiceNames)
+		this.aggregates.changed()
+	}
+
+	return serviceWatcher, ok
+}
+
+// initialize initializes all watchers in this set.  Every watcher is attempted, even if earlier
+// watchers fail, and a ServicesError is returned describing each service that failed.
+func (this *serviceWatcherSet) initialize(client zookeeperClient) error {
+	this.logger.Debug("initialize(client=%v)", client)
+	var failures ServicesError
+	for _, serviceWatcher := range this.watchers() {
+		err := this.initializeWatcher(serviceWatcher, client)
 		if err != nil {
-			this.logger.Printf("Error initializing service watcher %v: %s", serviceWatcher, err)
-			return err
+			this.logger.Error("Error initializing service watcher %v: %s", serviceWatcher, err)
+			failures = append(failures, ServiceError{serviceWatcher.serviceName, err})
+		}
+	}
+
+	return failures.errorOrNil()
+}
+
+// initializeWatcher initializes a single watcher of this set.  When this set is lenient, each
+// base path of the service that cannot be initialized is logged and retried in the background
+// instead, and no error is returned.  A watcher which has already been initialized, or which
+// is being initialized on another goroutine, is skipped.
+func (this *serviceWatcherSet) initializeWatcher(serviceWatcher *serviceWatcher, client zookeeperClient) error {
+	if !atomic.CompareAndSwapUint32(&serviceWatcher.initializeClaimed, 0, 1) {
+		return nil
+	}
+
+	if !this.options.lenient {
+		err := serviceWatcher.initialize(client)
+		if err != nil {
+			// a failed watcher may be initialized again
+			atomic.StoreUint32(&serviceWatcher.initializeClaimed, 0)
+		}
+
+		return err
+	}
+
+	for _, pathWatcher := range serviceWatcher.pathWatchers() {
+		if err := pathWatcher.initialize(client); err != nil {
+			this.logger.Error("Unable to initialize [%s] services, retrying in the background: %v", pathWatcher.serviceName, err)
+			pathWatcher.retryInitialization(client)
 		}
 	}
 
 	return nil
 }
+
+// stop stops every watcher in this set, which removes all listeners and abandons
+// any background attempts to re-establish watches
+func (this *serviceWatcherSet) stop() {
+	this.aggregates.stop()
+	for _, serviceWatcher := range this.watchers() {
+		serviceWatcher.stop()
+	}
+}
@@ -0,0 +1,1828 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/foursquare/fsgo/net/discovery"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServiceWatcherSetRemove(t *testing.T) {
+	assert := assert.New(t)
+
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{"first", "second", "third"}, []string{testBasePath}, watcherOptions{dispatch: dispatchOptions{}})
+	removedWatcher, ok := serviceWatcherSet.findByName("second")
+	if !assert.True(ok) {
+		return
+	}
+
+	dispatched := false
+	removedWatcher.addListener(ListenerFunc(func(serviceName string, instances Instances) {
+		dispatched = true
+	}))
+
+	serviceWatcher, ok := serviceWatcherSet.remove("second")
+	assert.True(ok)
+	assert.Equal(removedWatcher, serviceWatcher)
+	assert.Equal(2, serviceWatcherSet.serviceCount())
+	assert.NotContains(serviceWatcherSet.cloneServiceNames(), "second")
+	assert.Len(serviceWatcherSet.watchers(), 2)
+
+	_, ok = serviceWatcherSet.findByName("second")
+	assert.False(ok)
+	_, ok = serviceWatcherSet.findByPath(testBasePath + "/second")
+	assert.False(ok)
+
+	// an outstanding watch for the removed service must not reach listeners
+	removedWatcher.dispatch(Instances{})
+	assert.False(dispatched)
+
+	_, ok = serviceWatcherSet.remove("second")
+	assert.False(ok)
+
+	_, ok = serviceWatcherSet.findByPath(testBasePath + "/first")
+	assert.True(ok)
+}
+
+func TestServiceWatcherSetConcurrentRemove(t *testing.T) {
+	serviceNames := []string{"first", "second", "third", "fourth"}
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, serviceNames, []string{testBasePath}, watcherOptions{dispatch: dispatchOptions{}})
+
+	waitGroup := &sync.WaitGroup{}
+	for _, serviceName := range serviceNames {
+		waitGroup.Add(2)
+		go func(serviceName string) {
+			defer waitGroup.Done()
+			serviceWatcherSet.remove(serviceName)
+		}(serviceName)
+
+		go func(serviceName string) {
+			defer waitGroup.Done()
+			if serviceWatcher, ok := serviceWatcherSet.findByPath(testBasePath + "/" + serviceName); ok {
+				serviceWatcher.dispatch(Instances{})
+			}
+
+			serviceWatcherSet.cloneServiceNames()
+			serviceWatcherSet.watchers()
+		}(serviceName)
+	}
+
+	waitGroup.Wait()
+	assert.Equal(t, 0, serviceWatcherSet.serviceCount())
+}
+
+func TestServiceWatcherSetAdd(t *testing.T) {
+	assert := assert.New(t)
+
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{"first"}, []string{testBasePath}, watcherOptions{dispatch: dispatchOptions{async: true}})
+	existing, _ := serviceWatcherSet.findByName("first")
+
+	serviceWatcher, added, err := serviceWatcherSet.add("first")
+	assert.False(added)
+	assert.Nil(err)
+	assert.Equal(existing, serviceWatcher)
+	assert.Equal(1, serviceWatcherSet.serviceCount())
+
+	serviceWatcher, added, err = serviceWatcherSet.add("second")
+	assert.True(added)
+	assert.Nil(err)
+	assert.Equal("second", serviceWatcher.serviceName)
+	assert.Equal(testBasePath+"/second", serviceWatcher.servicePath)
+	assert.Equal(existing.instanceSerializer, serviceWatcher.instanceSerializer)
+	assert.Equal(existing.dispatchOptions, serviceWatcher.dispatchOptions)
+	assert.Equal(2, serviceWatcherSet.serviceCount())
+	assert.Contains(serviceWatcherSet.cloneServiceNames(), "second")
+
+	found, ok := serviceWatcherSet.findByPath(testBasePath + "/second")
+	assert.True(ok)
+	assert.Equal(serviceWatcher, found)
+
+	serviceWatcher, added, err = serviceWatcherSet.add("invalid/name")
+	assert.Nil(serviceWatcher)
+	assert.False(added)
+	assert.IsType(ServiceNamesError{}, err)
+	assert.Equal(2, serviceWatcherSet.serviceCount())
+}
+
+// orderRecordingClient records the order in which watches are set on service paths
+type orderRecordingClient struct {
+	*fakeZookeeperClient
+
+	mutex   sync.Mutex
+	watched []string
+}
+
+func (this *orderRecordingClient) watchChildren(ctx context.Context, path string) ([]string, error) {
+	this.mutex.Lock()
+	this.watched = append(this.watched, path)
+	this.mutex.Unlock()
+	return this.fakeZookeeperClient.watchChildren(ctx, path)
+}
+
+func TestServiceWatcherSetInitializationOrder(t *testing.T) {
+	var testData = []struct {
+		serviceNames         []string
+		basePaths            []string
+		expectedServiceNames []string
+		expectedPaths        []string
+	}{
+		{
+			[]string{"delta", "alpha", "charlie", "bravo", "echo"},
+			[]string{"/base"},
+			[]string{"alpha", "bravo", "charlie", "delta", "echo"},
+			[]string{"/base/alpha", "/base/bravo", "/base/charlie", "/base/delta", "/base/echo"},
+		},
+		{
+			[]string{"charlie", "alpha", "charlie", "bravo", "alpha"},
+			[]string{"/base"},
+			[]string{"alpha", "bravo", "charlie"},
+			[]string{"/base/alpha", "/base/bravo", "/base/charlie"},
+		},
+		{
+			[]string{"bravo", "alpha", "bravo"},
+			[]string{"/second", "/first"},
+			[]string{"alpha", "bravo"},
+			[]string{"/second/alpha", "/first/alpha", "/second/bravo", "/first/bravo"},
+		},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+
+		// map iteration order varies from one run to the next, so the order is checked repeatedly
+		for repeat := 0; repeat < 10; repeat++ {
+			serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, record.serviceNames, record.basePaths, watcherOptions{})
+			assert.Equal(record.expectedServiceNames, serviceWatcherSet.cloneServiceNames())
+
+			client := &orderRecordingClient{fakeZookeeperClient: newFakeZookeeperClient()}
+			assert.Nil(serviceWatcherSet.initialize(client))
+			assert.Equal(record.expectedPaths, client.watched)
+
+			serviceNames := []string{}
+			for _, serviceWatcher := range serviceWatcherSet.watchers() {
+				serviceNames = append(serviceNames, serviceWatcher.serviceName)
+			}
+
+			assert.Equal(record.expectedServiceNames, serviceNames)
+			serviceWatcherSet.stop()
+		}
+	}
+}
+
+func TestServiceWatcherSetServicePaths(t *testing.T) {
+	var testData = []struct {
+		serviceNames  []string
+		basePaths     []string
+		servicePaths  map[string]string
+		expectedPaths map[string][]string
+		expectedError error
+	}{
+		{
+			[]string{"alpha", "bravo"},
+			[]string{"/services"},
+			nil,
+			map[string][]string{"alpha": {"/services/alpha"}, "bravo": {"/services/bravo"}},
+			nil,
+		},
+		{
+			[]string{"alpha", "bravo"},
+			[]string{"/services"},
+			map[string]string{"bravo": "/discovery/v2/bravo-service/"},
+			map[string][]string{"alpha": {"/services/alpha"}, "bravo": {"/discovery/v2/bravo-service"}},
+			nil,
+		},
+		{
+			[]string{"alpha", "bravo"},
+			[]string{"/first", "/second"},
+			map[string]string{"alpha": "/alpha"},
+			map[string][]string{"alpha": {"/alpha"}, "bravo": {"/first/bravo", "/second/bravo"}},
+			nil,
+		},
+		{
+			[]string{"alpha", "bravo"},
+			[]string{"/services"},
+			map[string]string{"alpha": "/shared", "bravo": "/shared"},
+			nil,
+			ErrorServicePathCollision,
+		},
+		{
+			[]string{"alpha", "bravo"},
+			[]string{"/first", "/second"},
+			map[string]string{"bravo": "/second/alpha"},
+			nil,
+			ErrorServicePathCollision,
+		},
+		{
+			[]string{"alpha"},
+			[]string{"/services"},
+			map[string]string{"alpha": "/"},
+			nil,
+			ErrorInvalidWatchPath,
+		},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+
+		options := watcherOptions{servicePaths: record.servicePaths}
+		serviceWatcherSet, err := newServiceWatcherSet(&testLogger{t}, record.serviceNames, record.basePaths, options)
+		if record.expectedError != nil {
+			assert.Nil(serviceWatcherSet)
+			assert.True(errors.Is(err, record.expectedError), "%v", err)
+			continue
+		} else if !assert.Nil(err) {
+			continue
+		}
+
+		actualPaths := make(map[string][]string)
+		for _, pathWatcher := range serviceWatcherSet.pathWatchers() {
+			actualPaths[pathWatcher.serviceName] = append(actualPaths[pathWatcher.serviceName], pathWatcher.servicePath)
+			serviceWatcher, ok := serviceWatcherSet.findByPath(pathWatcher.servicePath)
+			assert.True(ok)
+			assert.Equal(pathWatcher, serviceWatcher)
+		}
+
+		assert.Equal(record.expectedPaths, actualPaths)
+		serviceWatcherSet.stop()
+	}
+}
+
+func TestServiceWatcherSetServicePathCollision(t *testing.T) {
+	assert := assert.New(t)
+
+	options := watcherOptions{servicePaths: map[string]string{"alpha": "/services/bravo"}}
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{"alpha"}, []string{"/services"}, options)
+	defer serviceWatcherSet.stop()
+
+	alpha, ok := serviceWatcherSet.findByName("alpha")
+	if assert.True(ok) {
+		assert.Equal("/services", alpha.basePath)
+	}
+
+	// a service added later cannot take the path of a service with a configured path
+	serviceWatcher, added, err := serviceWatcherSet.add("bravo")
+	assert.Nil(serviceWatcher)
+	assert.False(added)
+	assert.Equal(ServicePathCollisionError{"/services/bravo", []string{"alpha", "bravo"}}, err)
+	assert.False(serviceWatcherSet.isWatching("bravo"))
+
+	// a removed service is watched at its configured path when added again
+	_, ok = serviceWatcherSet.remove("alpha")
+	assert.True(ok)
+	serviceWatcher, added, err = serviceWatcherSet.add("alpha")
+	assert.True(added)
+	assert.Nil(err)
+	if assert.NotNil(serviceWatcher) {
+		assert.Equal("/services/bravo", serviceWatcher.servicePath)
+	}
+}
+
+func TestAddListenerReceivesLastKnownInstances(t *testing.T) {
+	assert := assert.New(t)
+
+	serviceWatcher := &serviceWatcher{serviceName: testServiceName, logger: &testLogger{t}}
+	var early []Instances
+	serviceWatcher.addListener(ListenerFunc(func(serviceName string, instances Instances) {
+		early = append(early, instances)
+	}))
+
+	// nothing has been read yet, so there is nothing to deliver
+	assert.Empty(early)
+
+	initial := testInstancesWithIds("initial")
+	serviceWatcher.dispatch(initial)
+	assert.Equal([]Instances{initial}, early)
+
+	var late []Instances
+	serviceWatcher.addListener(ListenerFunc(func(serviceName string, instances Instances) {
+		late = append(late, instances)
+	}))
+
+	assert.Equal([]Instances{initial}, late)
+
+	updated := testInstancesWithIds("updated")
+	serviceWatcher.dispatch(updated)
+	assert.Equal([]Instances{initial, updated}, early)
+	assert.Equal([]Instances{initial, updated}, late)
+
+	// an empty set of services is still a valid snapshot
+	serviceWatcher.dispatch(Instances{})
+	var empty []Instances
+	serviceWatcher.addListener(ListenerFunc(func(serviceName string, instances Instances) {
+		empty = append(empty, instances)
+	}))
+
+	assert.Equal([]Instances{Instances{}}, empty)
+}
+
+func TestDispatchInstanceEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	serviceWatcher := &serviceWatcher{serviceName: testServiceName, logger: &testLogger{t}}
+	var early []InstanceEvent
+	serviceWatcher.addListener(InstancesListenerFunc(func(serviceName string, event InstanceEvent) {
+		early = append(early, event)
+	}))
+
+	first := newTestInstance("1", "localhost", 1234)
+	second := newTestInstance("2", "localhost", 1235)
+	third := newTestInstance("3", "localhost", 1236)
+
+	serviceWatcher.dispatch(Instances{first, second})
+	serviceWatcher.dispatch(Instances{second, first})
+	serviceWatcher.dispatch(Instances{second, third})
+
+	assert.Equal(
+		[]InstanceEvent{
+			InstanceEvent{
+				Added:     Instances{first, second},
+				Current:   Instances{first, second},
+				Annotated: testAnnotations(1, first, second),
+				Sequence:  1,
+			},
+			InstanceEvent{
+				Added:     Instances{third},
+				Removed:   Instances{first},
+				Current:   Instances{second, third},
+				Annotated: testAnnotations(2, second, third),
+				Sequence:  2,
+			},
+		},
+		early,
+	)
+
+	// a late listener sees every current instance as added
+	var late []InstanceEvent
+	serviceWatcher.addListener(InstancesListenerFunc(func(serviceName string, event InstanceEvent) {
+		late = append(late, event)
+	}))
+
+	assert.Equal(
+		[]InstanceEvent{
+			InstanceEvent{
+				Added:     Instances{second, third},
+				Current:   Instances{second, third},
+				Annotated: testAnnotations(2, second, third),
+				Sequence:  2,
+			},
+		},
+		late,
+	)
+
+	// plain listeners continue to receive only the current instances
+	var plain []Instances
+	serviceWatcher.addListener(ListenerFunc(func(serviceName string, instances Instances) {
+		plain = append(plain, instances)
+	}))
+
+	serviceWatcher.dispatch(Instances{})
+	assert.Equal([]Instances{Instances{second, third}, Instances{}}, plain)
+	assert.Equal(
+		InstanceEvent{
+			Removed:   Instances{second, third},
+			Current:   Instances{},
+			Annotated: AnnotatedInstances{},
+			Sequence:  3,
+		},
+		late[1],
+	)
+}
+
+func TestCachedInstances(t *testing.T) {
+	assert := assert.New(t)
+
+	serviceWatcher := &serviceWatcher{serviceName: testServiceName, logger: &testLogger{t}}
+	_, ok := serviceWatcher.cachedInstances()
+	assert.False(ok)
+
+	instances := testInstancesWithIds("1")
+	serviceWatcher.dispatch(instances)
+	cached, ok := serviceWatcher.cachedInstances()
+	assert.True(ok)
+	assert.Equal(instances, cached)
+
+	serviceWatcher.stop()
+	serviceWatcher.dispatch(testInstancesWithIds("2"))
+	cached, ok = serviceWatcher.cachedInstances()
+	assert.True(ok)
+	assert.Equal(instances, cached)
+}
+
+func TestDispatchSuppressesUnchangedMembership(t *testing.T) {
+	for _, dispatchUnchanged := range []bool{false, true} {
+		assert := assert.New(t)
+
+		serviceWatcher := &serviceWatcher{
+			serviceName:     testServiceName,
+			logger:          &testLogger{t},
+			dispatchOptions: dispatchOptions{dispatchUnchanged: dispatchUnchanged},
+		}
+
+		dispatchCount := 0
+		serviceWatcher.addListener(ListenerFunc(func(serviceName string, instances Instances) {
+			dispatchCount++
+		}))
+
+		first := newTestInstance("1", "localhost", 1234)
+		second := newTestInstance("2", "localhost", 1235)
+
+		serviceWatcher.dispatch(Instances{})
+		serviceWatcher.dispatch(Instances{})
+		serviceWatcher.dispatch(Instances{first, second})
+		serviceWatcher.dispatch(Instances{second, first})
+
+		if dispatchUnchanged {
+			assert.Equal(4, dispatchCount)
+		} else {
+			assert.Equal(2, dispatchCount)
+		}
+
+		// the cache always reflects the most recent snapshot
+		cached, _ := serviceWatcher.cachedInstances()
+		assert.Equal(Instances{second, first}, cached)
+	}
+}
+
+func TestDispatchSuppressesEquivalentMembership(t *testing.T) {
+	for _, suppressEquivalent := range []bool{false, true} {
+		assert := assert.New(t)
+
+		serviceWatcher := &serviceWatcher{
+			serviceName:     testServiceName,
+			logger:          &testLogger{t},
+			dispatchOptions: dispatchOptions{suppressEquivalent: suppressEquivalent},
+		}
+
+		var events []InstanceEvent
+		serviceWatcher.addListener(InstancesListenerFunc(func(serviceName string, event InstanceEvent) {
+			events = append(events, event)
+		}))
+
+		first := newTestInstance("1", "localhost", 1234)
+		second := newTestInstance("2", "localhost", 1235)
+		secondReregistered := newTestInstance("3", "localhost", 1235)
+		secondMoved := newTestInstance("4", "localhost", 1236)
+
+		serviceWatcher.dispatch(Instances{first, second})
+		serviceWatcher.dispatch(Instances{secondReregistered, first})
+		serviceWatcher.dispatch(Instances{first, secondMoved})
+
+		if suppressEquivalent {
+			if assert.Len(events, 2) {
+				assert.Equal([]string{"4"}, instanceIds(events[1].Added))
+				assert.Equal([]string{"3"}, instanceIds(events[1].Removed))
+			}
+		} else {
+			assert.Len(events, 3)
+		}
+
+		// the cache always reflects the most recent snapshot
+		cached, _ := serviceWatcher.cachedInstances()
+		assert.Equal(Instances{first, secondMoved}, cached)
+	}
+}
+
+func TestFetchServices(t *testing.T) {
+	assert := assert.New(t)
+
+	client := newFakeZookeeperClient()
+	servicePath := testBasePath + "/" + testServiceName
+	childIds := []string{}
+	for index := 0; index < 20; index++ {
+		serviceInstance := newTestInstance(fmt.Sprintf("%02d", index), "host.com", 8080+index)
+		client.addInstance(servicePath, serviceInstance)
+		childIds = append(childIds, serviceInstance.Id)
+	}
+
+	// a child that vanished and a child that cannot be deserialized are both skipped
+	client.set(servicePath+"/garbage", []byte("this is not json"))
+	childIds = append(childIds[:5], append([]string{"missing", "garbage"}, childIds[5:]...)...)
+
+	var testData = []struct {
+		fetchConcurrency int
+	}{
+		{0},
+		{1},
+		{8},
+		{100},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, watcherOptions{fetchConcurrency: record.fetchConcurrency})
+		serviceWatcher, ok := serviceWatcherSet.findByName(testServiceName)
+		if !assert.True(ok) {
+			return
+		}
+
+		serviceWatcher.client = client
+		instances, err := serviceWatcher.fetchServices(context.Background(), childIds)
+		assert.Nil(err)
+		if assert.Len(instances, 20) {
+			for index, serviceInstance := range instances {
+				assert.Equal(fmt.Sprintf("%02d", index), serviceInstance.Id)
+				assert.Equal(8080+index, *serviceInstance.Port)
+			}
+		}
+	}
+}
+
+func TestFetchServicesBatched(t *testing.T) {
+	assert := assert.New(t)
+
+	servicePath := testBasePath + "/" + testServiceName
+	var testData = []struct {
+		readBatchSize      int
+		watchData          bool
+		failFirstBatch     bool
+		expectedRoundTrips int
+	}{
+		{0, false, false, 22},
+		{1, false, false, 22},
+		// the batch holding the missing child is read again one child at a time
+		{4, false, false, 6 + 4},
+		{4, false, true, 6 + 4 + 4},
+		{22, false, false, 1 + 22},
+		{100, false, false, 1 + 22},
+		{4, true, false, 22},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		client := newFakeZookeeperClient()
+		childIds := []string{}
+		for index := 0; index < 20; index++ {
+			serviceInstance := newTestInstance(fmt.Sprintf("%02d", index), "host.com", 8080+index)
+			client.addInstance(servicePath, serviceInstance)
+			childIds = append(childIds, serviceInstance.Id)
+		}
+
+		client.set(servicePath+"/garbage", []byte("this is not json"))
+		childIds = append(childIds[:5], append([]string{"missing", "garbage"}, childIds[5:]...)...)
+		if record.failFirstBatch {
+			client.failNext(fakeDataBatch, servicePath+"/"+childIds[0], errors.New("expected"))
+		}
+
+		serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, watcherOptions{fetchConcurrency: 3, readBatchSize: record.readBatchSize, watchData: record.watchData})
+		serviceWatcher, _ := serviceWatcherSet.findByName(testServiceName)
+		serviceWatcher.client = client
+
+		instances, err := serviceWatcher.fetchServices(context.Background(), childIds)
+		assert.Nil(err)
+		if assert.Len(instances, 20) {
+			for index, serviceInstance := range instances {
+				assert.Equal(fmt.Sprintf("%02d", index), serviceInstance.Id)
+				assert.Equal(8080+index, *serviceInstance.Port)
+			}
+		}
+
+		assert.Equal(2, serviceWatcher.skippedInstances())
+		assert.Equal(record.expectedRoundTrips, client.dataRoundTrips())
+		serviceWatcherSet.stop()
+	}
+}
+
+func TestFetchServicesSummary(t *testing.T) {
+	assert := assert.New(t)
+
+	client := newFakeZookeeperClient()
+	servicePath := testBasePath + "/" + testServiceName
+	childIds := []string{}
+	for index := 0; index < 25; index++ {
+		serviceInstance := newTestInstance(fmt.Sprintf("%02d", index), "host.com", 8080+index)
+		client.addInstance(servicePath, serviceInstance)
+		childIds = append(childIds, serviceInstance.Id)
+	}
+
+	client.set(servicePath+"/garbage", []byte("this is not json"))
+	childIds = append(childIds, "garbage")
+
+	// only the summary and the child which could not be deserialized are logged without debug
+	var output bytes.Buffer
+	logger := NewStdLogger(log.New(&output, "", 0), false)
+	serviceWatcherSet := mustNewServiceWatcherSet(t, logger, []string{testServiceName}, []string{testBasePath}, watcherOptions{logSampleSize: 3})
+	defer serviceWatcherSet.stop()
+	serviceWatcher, _ := serviceWatcherSet.findByName(testServiceName)
+	serviceWatcher.client = client
+
+	instances, err := serviceWatcher.fetchServices(context.Background(), childIds)
+	assert.Nil(err)
+	assert.Len(instances, 25)
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if assert.Len(lines, 2) {
+		assert.True(strings.HasPrefix(lines[0], "[ERROR] Error deserializing service instance from "+servicePath+"/garbage"))
+		assert.Equal(
+			"[INFO] Fetched 25 instances from 26 children of "+servicePath+" [skipped=1, filtered=0, versionExcluded=0, childIds=[00 01 02] ... and 23 more]",
+			lines[1],
+		)
+	}
+}
+
+func TestSampleIds(t *testing.T) {
+	var testData = []struct {
+		logSampleSize int
+		childIds      []string
+		expected      string
+	}{
+		{0, []string{}, "[]"},
+		{0, []string{"a", "b"}, "[a b]"},
+		{2, []string{"a", "b"}, "[a b]"},
+		{2, []string{"a", "b", "c"}, "[a b] ... and 1 more"},
+		{1, []string{"a", "b", "c"}, "[a] ... and 2 more"},
+		{0, testInstanceIds(DefaultLogSampleSize + 5), fmt.Sprintf("%s ... and 5 more", testInstanceIds(DefaultLogSampleSize))},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+		serviceWatcher := &serviceWatcher{logSampleSize: record.logSampleSize}
+		assert.Equal(record.expected, serviceWatcher.sampleIds(record.childIds))
+	}
+}
+
+// testInstanceIds returns the given number of sequential child ids
+func testInstanceIds(count int) []string {
+	childIds := make([]string, count)
+	for index := range childIds {
+		childIds[index] = fmt.Sprintf("%02d", index)
+	}
+
+	return childIds
+}
+
+func benchmarkFetchServices(b *testing.B, fetchConcurrency, readBatchSize int) {
+	client := newFakeZookeeperClient()
+	client.delay = time.Millisecond
+	servicePath := testBasePath + "/" + testServiceName
+	childIds := []string{}
+	for index := 0; index < 50; index++ {
+		serviceInstance := newTestInstance(fmt.Sprintf("%02d", index), "host.com", 8080+index)
+		client.addInstance(servicePath, serviceInstance)
+		childIds = append(childIds, serviceInstance.Id)
+	}
+
+	serviceWatcher := mustNewServiceWatcherSet(b, NopLogger{}, []string{testServiceName}, []string{testBasePath}, watcherOptions{fetchConcurrency: fetchConcurrency, readBatchSize: readBatchSize}).
+		newServiceWatcher(testServiceName)
+	serviceWatcher.client = client
+
+	b.ResetTimer()
+	for iteration := 0; iteration < b.N; iteration++ {
+		serviceWatcher.fetchServices(context.Background(), childIds)
+	}
+
+	b.ReportMetric(float64(client.dataRoundTrips())/float64(b.N), "roundtrips/op")
+}
+
+func BenchmarkFetchServicesSerial(b *testing.B) {
+	benchmarkFetchServices(b, 1, 0)
+}
+
+func BenchmarkFetchServicesConcurrent(b *testing.B) {
+	benchmarkFetchServices(b, DefaultFetchConcurrency, 0)
+}
+
+func BenchmarkFetchServicesBatchedSerial(b *testing.B) {
+	benchmarkFetchServices(b, 1, 10)
+}
+
+func BenchmarkFetchServicesBatchedConcurrent(b *testing.B) {
+	benchmarkFetchServices(b, DefaultFetchConcurrency, 10)
+}
+
+// versionedSerializer prefixes JSON with a version byte
+type versionedSerializer struct {
+	discovery.JsonInstanceSerializer
+}
+
+func (this *versionedSerializer) Serialize(serviceInstance *discovery.ServiceInstance) ([]byte, error) {
+	data, err := this.JsonInstanceSerializer.Serialize(serviceInstance)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{1}, data...), nil
+}
+
+func (this *versionedSerializer) Deserialize(data []byte) (*discovery.ServiceInstance, error) {
+	if len(data) == 0 || data[0] != 1 {
+		return nil, errors.New("Unsupported version")
+	}
+
+	return this.JsonInstanceSerializer.Deserialize(data[1:])
+}
+
+func TestFetchServicesWithInstanceSerializer(t *testing.T) {
+	assert := assert.New(t)
+
+	client := newFakeZookeeperClient()
+	servicePath := testBasePath + "/" + testServiceName
+	serializer := &versionedSerializer{}
+	client.addSerializedInstance(servicePath, newTestInstance("versioned", "host.com", 8080), serializer)
+	client.addInstance(servicePath, newTestInstance("json", "host.com", 8081))
+
+	var testData = []struct {
+		instanceSerializer discovery.InstanceSerializer
+		expectedId         string
+	}{
+		{nil, "json"},
+		{&discovery.JsonInstanceSerializer{}, "json"},
+		{serializer, "versioned"},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, watcherOptions{instanceSerializer: record.instanceSerializer})
+		serviceWatcher, ok := serviceWatcherSet.findByName(testServiceName)
+		if !assert.True(ok) {
+			return
+		}
+
+		serviceWatcher.client = client
+		instances, err := serviceWatcher.fetchServices(context.Background(), []string{"json", "versioned"})
+		assert.Nil(err)
+		if assert.Len(instances, 1) {
+			assert.Equal(record.expectedId, instances[0].Id)
+		}
+	}
+}
+
+func TestFetchServicesReportsInstanceErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	client := newFakeZookeeperClient()
+	servicePath := testBasePath + "/" + testServiceName
+	client.addInstance(servicePath, newTestInstance("valid", "host.com", 8080))
+	client.set(servicePath+"/garbage", []byte("this is not json"))
+
+	var (
+		mutex     sync.Mutex
+		reported  = make(map[string][]byte)
+		reportErr = func(reportedPath, childId string, data []byte, err error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			assert.Equal(servicePath, reportedPath)
+			assert.NotNil(err)
+			reported[childId] = data
+		}
+	)
+
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, watcherOptions{instanceError: reportErr})
+	serviceWatcher, ok := serviceWatcherSet.findByName(testServiceName)
+	if !assert.True(ok) {
+		return
+	}
+
+	serviceWatcher.client = client
+	assert.Equal(0, serviceWatcher.skippedInstances())
+
+	instances, err := serviceWatcher.fetchServices(context.Background(), []string{"valid", "garbage", "missing"})
+	assert.Nil(err)
+	assert.Len(instances, 1)
+	assert.Equal(2, serviceWatcher.skippedInstances())
+	assert.Equal(
+		map[string][]byte{"garbage": []byte("this is not json"), "missing": nil},
+		reported,
+	)
+
+	instances, err = serviceWatcher.fetchServices(context.Background(), []string{"valid"})
+	assert.Nil(err)
+	assert.Len(instances, 1)
+	assert.Equal(0, serviceWatcher.skippedInstances())
+}
+
+func TestFetchServicesTimesOutHungChildren(t *testing.T) {
+	servicePath := testBasePath + "/" + testServiceName
+	var testData = []struct {
+		readBatchSize int
+	}{
+		{0},
+		// the hung batch is read again one child at a time, so only the hung child is skipped
+		{4},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+
+		client := newFakeZookeeperClient()
+		for _, id := range []string{"1", "2", "3"} {
+			client.addInstance(servicePath, newTestInstance(id, "host.com", 8080))
+		}
+
+		client.hang(servicePath + "/2")
+
+		var (
+			mutex    sync.Mutex
+			reported = make(map[string]error)
+		)
+
+		options := watcherOptions{
+			fetchConcurrency: 3,
+			readBatchSize:    record.readBatchSize,
+			fetchTimeout:     20 * time.Millisecond,
+			instanceError: func(reportedPath, childId string, data []byte, err error) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				reported[childId] = err
+			},
+		}
+
+		serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, options)
+		serviceWatcher, _ := serviceWatcherSet.findByName(testServiceName)
+		serviceWatcher.client = client
+
+		instances, err := serviceWatcher.fetchServices(context.Background(), []string{"1", "2", "3"})
+		assert.Nil(err)
+		assert.Equal([]string{"1", "3"}, instanceIds(instances))
+		assert.Equal(1, serviceWatcher.skippedInstances())
+		assert.Equal(uint64(1), serviceWatcher.metrics.snapshot().FetchTimeouts)
+		assert.Equal(uint64(0), serviceWatcher.metrics.snapshot().FetchErrors)
+		assert.Equal(map[string]error{"2": ErrorFetchTimeout}, reported)
+		serviceWatcherSet.stop()
+	}
+}
+
+func TestWaitForInitialized(t *testing.T) {
+	assert := assert.New(t)
+
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{"first", "second"}, []string{testBasePath}, watcherOptions{})
+	first, _ := serviceWatcherSet.findByName("first")
+	second, _ := serviceWatcherSet.findByName("second")
+
+	expired, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	instances, err := first.waitForInitialized(expired)
+	assert.Nil(instances)
+	assert.Equal(context.DeadlineExceeded, err)
+
+	// waiters that start before initialization are released by the first dispatch
+	expected := testInstancesWithIds("1")
+	results := make(chan Instances, 2)
+	waitGroup := &sync.WaitGroup{}
+	waitGroup.Add(2)
+	for repeat := 0; repeat < 2; repeat++ {
+		go func() {
+			defer waitGroup.Done()
+			instances, err := first.waitForInitialized(context.Background())
+			assert.Nil(err)
+			results <- instances
+		}()
+	}
+
+	first.dispatch(expected)
+	waitGroup.Wait()
+	close(results)
+	for instances := range results {
+		assert.Equal(expected, instances)
+	}
+
+	// after initialization, the snapshot is returned even for a done context
+	instances, err = first.waitForInitialized(expired)
+	assert.Equal(expected, instances)
+	assert.Nil(err)
+
+	// stopping a watcher releases its waiters
+	go serviceWatcherSet.remove("second")
+	instances, err = second.waitForInitialized(context.Background())
+	assert.Nil(instances)
+	assert.Equal(ErrorNoSuchService, err)
+}
+
+func TestReadServicesCancellation(t *testing.T) {
+	assert := assert.New(t)
+
+	client := newFakeZookeeperClient()
+	client.delay = time.Hour
+	servicePath := testBasePath + "/" + testServiceName
+	for index := 0; index < 20; index++ {
+		client.addInstance(servicePath, newTestInstance(fmt.Sprintf("%02d", index), "host.com", 8080+index))
+	}
+
+	rootContext, cancel := context.WithCancel(context.Background())
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, watcherOptions{rootContext: rootContext, fetchConcurrency: 2})
+	serviceWatcher, _ := serviceWatcherSet.findByName(testServiceName)
+	serviceWatcher.client = client
+
+	results := make(chan error, 2)
+	go func() {
+		_, err := serviceWatcher.readServices(serviceWatcher.context)
+		results <- err
+	}()
+
+	go func() {
+		_, err := serviceWatcher.readServicesAndWatch(serviceWatcher.context)
+		results <- err
+	}()
+
+	cancel()
+	for repeat := 0; repeat < 2; repeat++ {
+		select {
+		case err := <-results:
+			assert.Equal(context.Canceled, err)
+		case <-time.After(10 * time.Second):
+			assert.Fail("Cancelling the root context did not abandon the read")
+			return
+		}
+	}
+
+	assert.Equal(0, serviceWatcher.skippedInstances())
+	instances, err := serviceWatcher.readServices(serviceWatcher.context)
+	assert.Nil(instances)
+	assert.Equal(context.Canceled, err)
+}
+
+func TestChildrenChangedCoalescesEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	client := newFakeZookeeperClient()
+	servicePath := testBasePath + "/" + testServiceName
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, watcherOptions{debounceWindow: 100 * time.Millisecond})
+	defer serviceWatcherSet.stop()
+
+	serviceWatcher, _ := serviceWatcherSet.findByName(testServiceName)
+	dispatched := make(chan Instances, 10)
+	serviceWatcher.addListener(ListenerFunc(func(serviceName string, instances Instances) {
+		dispatched <- instances
+	}))
+
+	assert.Nil(serviceWatcher.initialize(client))
+	assert.Empty(<-dispatched)
+
+	for index := 0; index < 5; index++ {
+		client.addInstance(servicePath, newTestInstance(strconv.Itoa(index), "host.com", 8080+index))
+		serviceWatcher.childrenChanged()
+	}
+
+	// the watch is re-set for every event, but only one read is dispatched
+	assert.Equal(6, client.watches())
+	select {
+	case instances := <-dispatched:
+		assert.Len(instances, 5)
+	case <-time.After(5 * time.Second):
+		assert.Fail("The coalesced services were not dispatched")
+	}
+
+	select {
+	case instances := <-dispatched:
+		assert.Fail("Unexpected dispatch", "%#v", instances)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// events after the window elapses are read again
+	client.addInstance(servicePath, newTestInstance("5", "host.com", 8085))
+	serviceWatcher.childrenChanged()
+	select {
+	case instances := <-dispatched:
+		assert.Len(instances, 6)
+	case <-time.After(5 * time.Second):
+		assert.Fail("The updated services were not dispatched")
+	}
+}
+
+func TestWatchDebounceWindow(t *testing.T) {
+	var testData = []struct {
+		builder        DiscoveryBuilder
+		expectedWindow time.Duration
+		expectedError  error
+	}{
+		{DiscoveryBuilder{}, 0, nil},
+		{DiscoveryBuilder{WatchDebounceWindow: "250ms"}, 250 * time.Millisecond, nil},
+		{DiscoveryBuilder{WatchDebounceWindow: "2"}, 2 * time.Second, nil},
+		{DiscoveryBuilder{WatchDebounceWindow: "-1s"}, -1, ErrorInvalidWatchDebounceWindow},
+		{DiscoveryBuilder{WatchDebounceWindow: "soon"}, -1, ErrorInvalidWatchDebounceWindow},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+		window, err := record.builder.watchDebounceWindow()
+		assert.Equal(record.expectedWindow, window)
+		assert.Equal(record.expectedError, err)
+	}
+}
+
+func TestResync(t *testing.T) {
+	assert := assert.New(t)
+
+	client := newFakeZookeeperClient()
+	servicePath := testBasePath + "/" + testServiceName
+	client.addInstance(servicePath, newTestInstance("1", "host.com", 8080))
+
+	// even when unchanged snapshots are dispatched, a resync only dispatches changes
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, watcherOptions{dispatch: dispatchOptions{dispatchUnchanged: true}})
+	defer serviceWatcherSet.stop()
+
+	serviceWatcher, _ := serviceWatcherSet.findByName(testServiceName)
+	dispatchCount := 0
+	serviceWatcher.addListener(ListenerFunc(func(serviceName string, instances Instances) {
+		dispatchCount++
+	}))
+
+	assert.Nil(serviceWatcher.initialize(client))
+	assert.Equal(1, dispatchCount)
+	assert.Equal(1, client.watches())
+
+	serviceWatcher.resync()
+	assert.Equal(1, dispatchCount)
+	assert.Equal(2, client.watches())
+
+	client.addInstance(servicePath, newTestInstance("2", "host.com", 8081))
+	serviceWatcher.resync()
+	assert.Equal(2, dispatchCount)
+	assert.Equal(3, client.watches())
+	cached, _ := serviceWatcher.cachedInstances()
+	assert.Len(cached, 2)
+
+	// a resync already in progress prevents another from starting
+	serviceWatcher.resyncing = 1
+	serviceWatcher.resync()
+	assert.Equal(3, client.watches())
+}
+
+func TestResyncInterval(t *testing.T) {
+	var testData = []struct {
+		builder          DiscoveryBuilder
+		expectedInterval time.Duration
+		expectedError    error
+	}{
+		{DiscoveryBuilder{}, 0, nil},
+		{DiscoveryBuilder{ResyncInterval: "10m"}, 10 * time.Minute, nil},
+		{DiscoveryBuilder{ResyncInterval: "30"}, 30 * time.Second, nil},
+		{DiscoveryBuilder{ResyncInterval: "-1m"}, -1, ErrorInvalidResyncInterval},
+		{DiscoveryBuilder{ResyncInterval: "often"}, -1, ErrorInvalidResyncInterval},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+		interval, err := record.builder.resyncInterval()
+		assert.Equal(record.expectedInterval, interval)
+		assert.Equal(record.expectedError, err)
+	}
+}
+
+func TestServiceWatcherSetMergesBasePaths(t *testing.T) {
+	assert := assert.New(t)
+
+	eastPath := testBasePath + "/us-east"
+	westPath := testBasePath + "/us-west"
+	client := newFakeZookeeperClient()
+	client.addInstance(eastPath+"/"+testServiceName, newTestInstance("east-1", "east.com", 8080))
+	client.addInstance(eastPath+"/"+testServiceName, newTestInstance("east-2", "east.com", 8081))
+	client.addInstance(westPath+"/"+testServiceName, newTestInstance("west-1", "west.com", 8080))
+	client.set(westPath+"/"+testServiceName+"/corrupt", []byte("not json"))
+
+	// duplicate base paths are ignored
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{eastPath, westPath + "/", westPath}, watcherOptions{})
+	defer serviceWatcherSet.stop()
+	assert.Len(serviceWatcherSet.watchers(), 1)
+	assert.Len(serviceWatcherSet.pathWatchers(), 2)
+
+	merged, ok := serviceWatcherSet.findByName(testServiceName)
+	assert.True(ok)
+	east, ok := serviceWatcherSet.findByPath(eastPath + "/" + testServiceName)
+	assert.True(ok)
+	west, ok := serviceWatcherSet.findByPath(westPath + "/" + testServiceName)
+	assert.True(ok)
+	assert.Equal([]*serviceWatcher{east, west}, merged.pathWatchers())
+
+	var dispatched []Instances
+	merged.addListener(ListenerFunc(func(serviceName string, instances Instances) {
+		dispatched = append(dispatched, instances)
+	}))
+
+	assert.Nil(merged.initialize(client))
+	if assert.Len(dispatched, 1) {
+		assert.Equal([]string{"east-1", "east-2", "west-1"}, instanceIds(dispatched[0]))
+	}
+
+	basePath, ok := merged.instanceBasePath("east-2")
+	assert.True(ok)
+	assert.Equal(eastPath, basePath)
+	basePath, ok = merged.instanceBasePath("west-1")
+	assert.True(ok)
+	assert.Equal(westPath, basePath)
+	_, ok = merged.instanceBasePath("nosuch")
+	assert.False(ok)
+
+	// removing one datacenter's children only removes that datacenter's contribution
+	client.mutex.Lock()
+	delete(client.nodes, westPath+"/"+testServiceName+"/west-1")
+	client.mutex.Unlock()
+	instances, err := west.readServicesAndWatch(west.context)
+	assert.Nil(err)
+	west.dispatch(instances)
+	if assert.Len(dispatched, 2) {
+		assert.Equal([]string{"east-1", "east-2"}, instanceIds(dispatched[1]))
+	}
+
+	cached, ok := merged.cachedInstances()
+	assert.True(ok)
+	assert.Equal([]string{"east-1", "east-2"}, instanceIds(cached))
+	assert.Equal(1, merged.skippedInstances())
+
+	metrics := merged.metricsSnapshot()
+	assert.Equal(2, metrics.Instances)
+	assert.Equal(uint64(2), metrics.Dispatches)
+	assert.Equal(1, metrics.SkippedInstances)
+
+	serviceWatcherSet.remove(testServiceName)
+	assert.True(east.isStopped())
+	assert.True(west.isStopped())
+	assert.Empty(serviceWatcherSet.pathWatchers())
+}
+
+func TestNewServiceWatcherSetRequiresBasePath(t *testing.T) {
+	assert := assert.New(t)
+
+	serviceWatcherSet, err := newServiceWatcherSet(&testLogger{t}, []string{testServiceName}, nil, watcherOptions{})
+	assert.Nil(serviceWatcherSet)
+	assert.Equal(ErrorNoBasePaths, err)
+}
+
+func TestWatchEventsDispatchChanges(t *testing.T) {
+	assert := assert.New(t)
+
+	client := newFakeZookeeperClient()
+	servicePath := testBasePath + "/" + testServiceName
+	client.addInstance(servicePath, newTestInstance("1", "host.com", 8080))
+
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, watcherOptions{})
+	defer serviceWatcherSet.stop()
+	client.watchWith(serviceWatcherSet)
+
+	serviceWatcher, _ := serviceWatcherSet.findByName(testServiceName)
+	var dispatched []Instances
+	serviceWatcher.addListener(ListenerFunc(func(serviceName string, instances Instances) {
+		dispatched = append(dispatched, instances)
+	}))
+
+	assert.False(client.isWatched(servicePath))
+	assert.Nil(serviceWatcher.initialize(client))
+	assert.True(client.isWatched(servicePath))
+
+	// each change fires the watch, which is re-set along with the read
+	client.addInstance(servicePath, newTestInstance("2", "host.com", 8081))
+	assert.True(client.isWatched(servicePath))
+	client.removeInstance(servicePath, "1")
+	assert.True(client.isWatched(servicePath))
+
+	// changes to data and to other paths do not fire the watch
+	client.addInstance(servicePath, newTestInstance("2", "other.com", 8081))
+	client.addInstance(testBasePath+"/other", newTestInstance("3", "host.com", 8082))
+
+	if assert.Equal(3, len(dispatched)) {
+		assert.Equal([]string{"1"}, instanceIds(dispatched[0]))
+		assert.Equal([]string{"1", "2"}, instanceIds(dispatched[1]))
+		assert.Equal([]string{"2"}, instanceIds(dispatched[2]))
+	}
+
+	assert.Equal(3, client.watches())
+}
+
+func TestEmptyServiceDispatchesEmptyInstances(t *testing.T) {
+	servicePath := testBasePath + "/" + testServiceName
+	var testData = []struct {
+		options watcherOptions
+	}{
+		{watcherOptions{}},
+		{watcherOptions{readBatchSize: 4}},
+		{watcherOptions{watchData: true}},
+		{watcherOptions{pathMode: servicePathRequire}},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+
+		client := newFakeZookeeperClient()
+		client.ensurePath(context.Background(), servicePath)
+		serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, record.options)
+		client.watchWith(serviceWatcherSet)
+
+		serviceWatcher, _ := serviceWatcherSet.findByName(testServiceName)
+		var dispatched []Instances
+		serviceWatcher.addListener(ListenerFunc(func(serviceName string, instances Instances) {
+			dispatched = append(dispatched, instances)
+		}))
+
+		// the first read is dispatched even though the service has no instances
+		assert.Nil(serviceWatcherSet.initialize(client))
+		if assert.Len(dispatched, 1) {
+			assert.NotNil(dispatched[0])
+			assert.Empty(dispatched[0])
+		}
+
+		// a listener added afterward is replayed the empty snapshot
+		var replayed []InstanceEvent
+		serviceWatcher.addListener(InstancesListenerFunc(func(serviceName string, event InstanceEvent) {
+			replayed = append(replayed, event)
+		}))
+
+		if assert.Len(replayed, 1) {
+			assert.NotNil(replayed[0].Current)
+			assert.Empty(replayed[0].Current)
+		}
+
+		// removing the last instance dispatches an empty snapshot, as does a resync
+		client.addInstance(servicePath, newTestInstance("1", "host.com", 8080))
+		client.removeInstance(servicePath, "1")
+		if assert.Len(dispatched, 3) {
+			assert.Equal([]string{"1"}, instanceIds(dispatched[1]))
+			assert.NotNil(dispatched[2])
+			assert.Empty(dispatched[2])
+		}
+
+		serviceWatcher.resync()
+		instances, ok := serviceWatcher.cachedInstances()
+		assert.True(ok)
+		assert.NotNil(instances)
+		assert.Empty(instances)
+		serviceWatcherSet.stop()
+	}
+}
+
+func TestDispatchNilInstances(t *testing.T) {
+	assert := assert.New(t)
+
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, watcherOptions{})
+	defer serviceWatcherSet.stop()
+	serviceWatcher, _ := serviceWatcherSet.findByName(testServiceName)
+
+	var events []InstanceEvent
+	serviceWatcher.addListener(InstancesListenerFunc(func(serviceName string, event InstanceEvent) {
+		events = append(events, event)
+	}))
+
+	serviceWatcher.dispatch(nil)
+	if assert.Len(events, 1) {
+		assert.Equal(Instances{}, events[0].Current)
+	}
+
+	instances, ok := serviceWatcher.cachedInstances()
+	assert.True(ok)
+	assert.Equal(Instances{}, instances)
+}
+
+func TestInitializeErrors(t *testing.T) {
+	servicePath := testBasePath + "/" + testServiceName
+	var testData = []struct {
+		operation fakeOperation
+		path      string
+	}{
+		{fakeEnsurePath, servicePath},
+		{fakeWatchChildren, servicePath},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+
+		client := newFakeZookeeperClient()
+		client.addInstance(servicePath, newTestInstance("1", "host.com", 8080))
+		client.failNext(record.operation, record.path, errors.New("expected"))
+
+		serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, watcherOptions{})
+		serviceWatcher, _ := serviceWatcherSet.findByName(testServiceName)
+		dispatchCount := 0
+		serviceWatcher.addListener(ListenerFunc(func(serviceName string, instances Instances) {
+			dispatchCount++
+		}))
+
+		err := serviceWatcher.initialize(client)
+		if assert.NotNil(err) {
+			assert.Contains(err.Error(), servicePath)
+			assert.Contains(err.Error(), "expected")
+		}
+
+		assert.Equal(0, dispatchCount)
+		_, ok := serviceWatcher.cachedInstances()
+		assert.False(ok)
+
+		// the failure was only scripted once
+		assert.Nil(serviceWatcher.initialize(client))
+		assert.Equal(1, dispatchCount)
+		serviceWatcherSet.stop()
+	}
+}
+
+func TestWatchEventRewatchesAfterError(t *testing.T) {
+	assert := assert.New(t)
+
+	client := newFakeZookeeperClient()
+	servicePath := testBasePath + "/" + testServiceName
+	client.addInstance(servicePath, newTestInstance("1", "host.com", 8080))
+
+	options := watcherOptions{retry: retryOptions{initialDelay: time.Millisecond, maxDelay: 10 * time.Millisecond}}
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, options)
+	defer serviceWatcherSet.stop()
+	client.watchWith(serviceWatcherSet)
+
+	serviceWatcher, _ := serviceWatcherSet.findByName(testServiceName)
+	dispatched := make(chan Instances, 10)
+	serviceWatcher.addListener(ListenerFunc(func(serviceName string, instances Instances) {
+		dispatched <- instances
+	}))
+
+	assert.Nil(serviceWatcher.initialize(client))
+	assert.Equal([]string{"1"}, instanceIds(<-dispatched))
+
+	// the read triggered by the watch fails, as does the first retry
+	client.failNext(fakeWatchChildren, servicePath, errors.New("expected"), errors.New("expected"))
+	client.addInstance(servicePath, newTestInstance("2", "host.com", 8081))
+
+	select {
+	case instances := <-dispatched:
+		assert.Equal([]string{"1", "2"}, instanceIds(instances))
+	case <-time.After(5 * time.Second):
+		assert.Fail("The watch was not re-established")
+	}
+
+	assert.True(client.isWatched(servicePath))
+	assert.Equal(4, client.watches())
+
+	metrics := serviceWatcher.metricsSnapshot()
+	assert.Equal(uint64(1), metrics.Rewatches)
+	assert.Equal(uint64(2), metrics.FetchErrors)
+}
+
+func TestReadServicesToleratesDataErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	client := newFakeZookeeperClient()
+	servicePath := testBasePath + "/" + testServiceName
+	for index := 1; index <= 3; index++ {
+		client.addInstance(servicePath, newTestInstance(strconv.Itoa(index), "host.com", 8080+index))
+	}
+
+	// an instance can disappear between reading the children and reading its data
+	client.failNext(fakeData, servicePath+"/2", errors.New("No such node"))
+
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, watcherOptions{})
+	defer serviceWatcherSet.stop()
+
+	serviceWatcher, _ := serviceWatcherSet.findByName(testServiceName)
+	assert.Nil(serviceWatcher.initialize(client))
+	cached, _ := serviceWatcher.cachedInstances()
+	assert.Equal([]string{"1", "3"}, instanceIds(cached))
+	assert.Equal(1, serviceWatcher.skippedInstances())
+
+	instances, err := serviceWatcher.readServices(context.Background())
+	assert.Nil(err)
+	assert.Equal([]string{"1", "2", "3"}, instanceIds(instances))
+	assert.Equal(0, serviceWatcher.skippedInstances())
+
+	client.failNext(fakeChildren, servicePath, errors.New("expected"))
+	_, err = serviceWatcher.readServices(context.Background())
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), servicePath)
+	}
+}
+
+func TestWatchInstanceData(t *testing.T) {
+	assert := assert.New(t)
+
+	client := newFakeZookeeperClient()
+	servicePath := testBasePath + "/" + testServiceName
+	client.addInstance(servicePath, newTestInstance("1", "host.com", 8080))
+	client.addInstance(servicePath, newTestInstance("2", "host.com", 8081))
+
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, watcherOptions{watchData: true})
+	defer serviceWatcherSet.stop()
+	client.watchWith(serviceWatcherSet)
+
+	serviceWatcher, _ := serviceWatcherSet.findByName(testServiceName)
+	var events []InstanceEvent
+	serviceWatcher.addListener(InstancesListenerFunc(func(serviceName string, event InstanceEvent) {
+		events = append(events, event)
+	}))
+
+	assert.Nil(serviceWatcher.initialize(client))
+	assert.True(client.isDataWatched(servicePath + "/1"))
+	assert.True(client.isDataWatched(servicePath + "/2"))
+	assert.Equal(2, serviceWatcher.dataWatchCount())
+
+	// a payload change is dispatched even though the membership is the same
+	client.addInstance(servicePath, newTestInstanceWithPayload("1", `{"weight": 5}`))
+	assert.True(client.isDataWatched(servicePath + "/1"))
+	if assert.Equal(2, len(events)) {
+		assert.Empty(events[1].Added)
+		assert.Empty(events[1].Removed)
+		if assert.Equal([]string{"1"}, instanceIds(events[1].Updated)) {
+			assert.Equal(`{"weight": 5}`, *events[1].Updated[0].Payload)
+		}
+
+		assert.Equal([]string{"1", "2"}, instanceIds(events[1].Current))
+	}
+
+	// removed children do not keep their watches
+	client.removeInstance(servicePath, "2")
+	assert.False(client.isDataWatched(servicePath + "/2"))
+	assert.Equal(1, serviceWatcher.dataWatchCount())
+	if assert.Equal(3, len(events)) {
+		assert.Equal([]string{"2"}, instanceIds(events[2].Removed))
+		assert.Empty(events[2].Updated)
+	}
+
+	// each child has only one watch, no matter how often it is read
+	for repeat := 0; repeat < 3; repeat++ {
+		_, err := serviceWatcher.readServicesAndWatch(context.Background())
+		assert.Nil(err)
+	}
+
+	client.addInstance(servicePath, newTestInstanceWithPayload("1", `{"weight": 6}`))
+	assert.Equal(4, len(events))
+	assert.Equal(1, serviceWatcher.dataWatchCount())
+
+	// a failed read sets no watch, so the next read tries again
+	client.failNext(fakeWatchData, servicePath+"/3", errors.New("expected"))
+	client.addInstance(servicePath, newTestInstance("3", "host.com", 8082))
+	assert.False(client.isDataWatched(servicePath + "/3"))
+	_, err := serviceWatcher.readServicesAndWatch(context.Background())
+	assert.Nil(err)
+	assert.True(client.isDataWatched(servicePath + "/3"))
+}
+
+func TestWatchInstanceDataWithInstanceFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	client := newFakeZookeeperClient()
+	servicePath := testBasePath + "/" + testServiceName
+	client.addInstance(servicePath, newTestInstanceWithPayload("1", `{"enabled": true}`))
+	client.addInstance(servicePath, newTestInstanceWithPayload("2", `{"enabled": false}`))
+
+	options := watcherOptions{watchData: true, instanceFilter: PayloadFlagFilter("enabled", false)}
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, options)
+	defer serviceWatcherSet.stop()
+	client.watchWith(serviceWatcherSet)
+
+	serviceWatcher, _ := serviceWatcherSet.findByName(testServiceName)
+	assert.Nil(serviceWatcher.initialize(client))
+	cached, _ := serviceWatcher.cachedInstances()
+	assert.Equal([]string{"1"}, instanceIds(cached))
+
+	client.addInstance(servicePath, newTestInstanceWithPayload("2", `{"enabled": true}`))
+	cached, _ = serviceWatcher.cachedInstances()
+	assert.Equal([]string{"1", "2"}, instanceIds(cached))
+
+	client.addInstance(servicePath, newTestInstanceWithPayload("1", `{"enabled": false}`))
+	cached, _ = serviceWatcher.cachedInstances()
+	assert.Equal([]string{"2"}, instanceIds(cached))
+}
+
+func TestInstanceDataIsNotWatchedByDefault(t *testing.T) {
+	assert := assert.New(t)
+
+	client := newFakeZookeeperClient()
+	servicePath := testBasePath + "/" + testServiceName
+	client.addInstance(servicePath, newTestInstance("1", "host.com", 8080))
+
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, watcherOptions{})
+	defer serviceWatcherSet.stop()
+	client.watchWith(serviceWatcherSet)
+
+	serviceWatcher, _ := serviceWatcherSet.findByName(testServiceName)
+	dispatchCount := 0
+	serviceWatcher.addListener(ListenerFunc(func(serviceName string, instances Instances) {
+		dispatchCount++
+	}))
+
+	assert.Nil(serviceWatcher.initialize(client))
+	assert.False(client.isDataWatched(servicePath + "/1"))
+	assert.Equal(0, serviceWatcher.dataWatchCount())
+
+	client.addInstance(servicePath, newTestInstance("1", "host.com", 9090))
+	assert.Equal(1, dispatchCount)
+}
+
+func TestLenientInitialization(t *testing.T) {
+	assert := assert.New(t)
+
+	client := newFakeZookeeperClient()
+	brokenPath := testBasePath + "/broken"
+	client.addInstance(testBasePath+"/working", newTestInstance("1", "host.com", 8080))
+	client.addInstance(brokenPath, newTestInstance("2", "host.com", 8081))
+
+	// without lenient initialization, one broken service fails the whole set
+	client.failNext(fakeWatchChildren, brokenPath, errors.New("expected"))
+	strict := mustNewServiceWatcherSet(t, &testLogger{t}, []string{"broken", "working"}, []string{testBasePath}, watcherOptions{})
+	err := strict.initialize(client)
+	if servicesError, ok := err.(ServicesError); assert.True(ok) && assert.Len(servicesError, 1) {
+		assert.Equal([]string{"broken"}, servicesError.Names())
+		assert.Contains(servicesError.Error(), "1 service(s) failed: [broken]: ")
+	}
+
+	// every other service is still initialized
+	working, _ := strict.findByName("working")
+	_, ok := working.cachedInstances()
+	assert.True(ok)
+	strict.stop()
+
+	options := watcherOptions{
+		lenient: true,
+		retry:   retryOptions{initialDelay: 10 * time.Millisecond, maxDelay: 10 * time.Millisecond},
+	}
+
+	client.failNext(fakeWatchChildren, brokenPath, errors.New("expected"), errors.New("expected"))
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{"broken", "working"}, []string{testBasePath}, options)
+	defer serviceWatcherSet.stop()
+
+	broken, _ := serviceWatcherSet.findByName("broken")
+	initialized := make(chan Instances, 1)
+	broken.addListener(ListenerFunc(func(serviceName string, instances Instances) {
+		initialized <- instances
+	}))
+
+	assert.Nil(serviceWatcherSet.initialize(client))
+	working, _ = serviceWatcherSet.findByName("working")
+	instances, ok := working.cachedInstances()
+	assert.True(ok)
+	assert.Len(instances, 1)
+	assert.Equal(0, working.metricsSnapshot().PendingInitializations)
+
+	// the broken service is pending until a background retry succeeds
+	assert.True(broken.isInitializationPending())
+	assert.Equal(1, broken.metricsSnapshot().PendingInitializations)
+
+	select {
+	case instances := <-initialized:
+		assert.Equal([]string{"2"}, instanceIds(instances))
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The broken service was not initialized in the background")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for broken.isInitializationPending() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.False(broken.isInitializationPending())
+	assert.Equal(0, broken.metricsSnapshot().PendingInitializations)
+}
+
+func TestLenientInitializationStopsRetrying(t *testing.T) {
+	client := newFakeZookeeperClient()
+	brokenPath := testBasePath + "/broken"
+	client.failNext(fakeEnsurePath, brokenPath, errors.New("expected"), errors.New("expected"), errors.New("expected"))
+
+	options := watcherOptions{
+		lenient: true,
+		retry:   retryOptions{initialDelay: time.Hour, maxDelay: time.Hour},
+	}
+
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{"broken"}, []string{testBasePath}, options)
+	assert.Nil(t, serviceWatcherSet.initialize(client))
+	broken, _ := serviceWatcherSet.findByName("broken")
+	assert.True(t, broken.isInitializationPending())
+
+	// stopping the set abandons the retry, which would otherwise wait an hour
+	serviceWatcherSet.stop()
+	_, ok := broken.cachedInstances()
+	assert.False(t, ok)
+}
+
+func TestStaleInstances(t *testing.T) {
+	assert := assert.New(t)
+
+	registeredAt := func(id string, registered time.Time) *discovery.ServiceInstance {
+		serviceInstance := newTestInstance(id, "host.com", 8080)
+		serviceInstance.RegistrationTimeUTC = registered.UnixNano() / int64(time.Millisecond)
+		return serviceInstance
+	}
+
+	now := time.Date(2020, time.January, 1, 12, 0, 0, 0, time.UTC)
+	client := newFakeZookeeperClient()
+	servicePath := testBasePath + "/" + testServiceName
+	client.addInstance(servicePath, registeredAt("zombie", now.Add(-48*time.Hour)))
+	client.addInstance(servicePath, registeredAt("fresh", now.Add(-time.Minute)))
+
+	options := watcherOptions{
+		staleThreshold: 24 * time.Hour,
+		now:            func() time.Time { return now },
+	}
+
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, options)
+	defer serviceWatcherSet.stop()
+
+	serviceWatcher, _ := serviceWatcherSet.findByName(testServiceName)
+	events := make(chan InstanceEvent, 10)
+	serviceWatcher.addListener(InstancesListenerFunc(func(serviceName string, event InstanceEvent) {
+		events <- event
+	}))
+
+	// stale instances are tagged, but remain in the snapshot
+	assert.Nil(serviceWatcher.initialize(client))
+	event := <-events
+	assert.Equal([]string{"fresh", "zombie"}, instanceIds(event.Current))
+	assert.Equal([]string{"zombie"}, instanceIds(event.Stale))
+	assert.Equal(1, serviceWatcher.metricsSnapshot().StaleInstances)
+
+	// listeners added later see the same tags
+	replayed := make(chan InstanceEvent, 1)
+	serviceWatcher.addListener(InstancesListenerFunc(func(serviceName string, event InstanceEvent) {
+		replayed <- event
+	}))
+
+	assert.Equal([]string{"zombie"}, instanceIds((<-replayed).Stale))
+
+	// staleness is measured against the clock at each dispatch
+	now = now.Add(24 * time.Hour)
+	client.addInstance(servicePath, registeredAt("new", now))
+	serviceWatcher.childrenChanged()
+	event = <-events
+	assert.Equal([]string{"fresh", "zombie"}, instanceIds(event.Stale))
+	assert.Equal(2, serviceWatcher.metricsSnapshot().StaleInstances)
+}
+
+func TestStaleInstancesDisabled(t *testing.T) {
+	assert := assert.New(t)
+
+	client := newFakeZookeeperClient()
+	servicePath := testBasePath + "/" + testServiceName
+	zombie := newTestInstance("zombie", "host.com", 8080)
+	zombie.RegistrationTimeUTC = 1
+	client.addInstance(servicePath, zombie)
+
+	serviceWatcherSet := mustNewServiceWatcherSet(t, &testLogger{t}, []string{testServiceName}, []string{testBasePath}, watcherOptions{})
+	defer serviceWatcherSet.stop()
+
+	serviceWatcher, _ := serviceWatcherSet.findByName(testServiceName)
+	events := make(chan InstanceEvent, 1)
+	serviceWatcher.addListener(InstancesListenerFunc(func(serviceName string, event InstanceEvent) {
+		events <- event
+	}))
+
+	assert.Nil(serviceWatcher.initialize(client))
+	event := <-events
+	assert.Len(event.Current, 1)
+	assert.Nil(event.Stale)
+	assert.Equal(0, serviceWatcher.metricsSnapshot().StaleInstances)
+}
+
+func TestStaleInstanceThreshold(t *testing.T) {
+	var testData = []struct {
+		builder           DiscoveryBuilder
+		expectedThreshold time.Duration
+		expectedError     error
+	}{
+		{DiscoveryBuilder{}, 0, nil},
+		{DiscoveryBuilder{StaleInstanceThreshold: "72h"}, 72 * time.Hour, nil},
+		{DiscoveryBuilder{StaleInstanceThreshold: "3600"}, time.Hour, nil},
+		{DiscoveryBuilder{StaleInstanceThreshold: "-1h"}, -1, ErrorInvalidStaleThreshold},
+		{DiscoveryBuilder{StaleInstanceThreshold: "ancient"}, -1, ErrorInvalidStaleThreshold},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+		threshold, err := record.builder.staleInstanceThreshold()
+		assert.Equal(record.expectedThreshold, threshold)
+		assert.Equal(record.expectedError, err)
+	}
+}
+
+func TestCheckWatch(t *testing.T) {
+	assert := assert.New(t)
+
+	recorder := &recordingLogger{}
+	serviceWatcherSet := mustNewServiceWatcherSet(t, NewZkLogger(recorder), []string{testServiceName}, []string{testBasePath}, watcherOptions{})
+	defer serviceWatcherSet.stop()
+	serviceWatcher, _ := serviceWatcherSet.findByName(testServiceName)
+
+	var testData = []struct {
+		unwatched        time.Duration
+		expectedWarnings int
+		expectedLevel    string
+	}{
+		{0, 0, ""},
+		{30 * time.Second, 0, ""},
+		{90 * time.Second, 1, "[INFO]"},
+		{100 * time.Second, 1, ""},
+		{150 * time.Second, 2, "[ERROR]"},
+		{3 * time.Minute, 2, ""},
+		{5 * time.Minute, 3, "[ERROR]"},
+		{0, 0, ""},
+		{90 * time.Second, 1, "[INFO]"},
+	}
+
+	threshold := time.Minute
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		if record.unwatched > 0 {
+			atomic.StoreInt64(&serviceWatcher.metrics.unwatchedSince, time.Now().Add(-record.unwatched).UnixNano())
+		} else {
+			serviceWatcher.metrics.recordWatchSet()
+		}
+
+		recorder.messages = nil
+		serviceWatcher.checkWatch(threshold)
+		assert.Equal(record.expectedWarnings, serviceWatcher.watchLossWarnings)
+		if len(record.expectedLevel) > 0 {
+			if assert.Len(recorder.messages, 1) {
+				assert.True(strings.HasPrefix(recorder.messages[0], record.expectedLevel), recorder.messages[0])
+				assert.Contains(recorder.messages[0], serviceWatcher.servicePath)
+			}
+		} else {
+			assert.Empty(recorder.messages)
+		}
+	}
+}
+
+func TestWatchLossThreshold(t *testing.T) {
+	var testData = []struct {
+		builder           DiscoveryBuilder
+		expectedThreshold time.Duration
+		expectedError     error
+	}{
+		{DiscoveryBuilder{}, 0, nil},
+		{DiscoveryBuilder{WatchLossThreshold: "10m"}, 10 * time.Minute, nil},
+		{DiscoveryBuilder{WatchLossThreshold: "30"}, 30 * time.Second, nil},
+		{DiscoveryBuilder{WatchLossThreshold: "-1m"}, -1, ErrorInvalidWatchLossThreshold},
+		{DiscoveryBuilder{WatchLossThreshold: "eventually"}, -1, ErrorInvalidWatchLossThreshold},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+		threshold, err := record.builder.watchLossThreshold()
+		assert.Equal(record.expectedThreshold, threshold)
+		assert.Equal(record.expectedError, err)
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	var testData = []struct {
+		builder         DiscoveryBuilder
+		expectedTimeout time.Duration
+		expectedError   error
+	}{
+		{DiscoveryBuilder{}, DefaultFetchTimeout, nil},
+		{DiscoveryBuilder{FetchTimeout: "0"}, 0, nil},
+		{DiscoveryBuilder{FetchTimeout: "2"}, 2 * time.Second, nil},
+		{DiscoveryBuilder{FetchTimeout: "750ms"}, 750 * time.Millisecond, nil},
+		{DiscoveryBuilder{FetchTimeout: "-1s"}, -1, ErrorInvalidFetchTimeout},
+		{DiscoveryBuilder{FetchTimeout: "invalid"}, -1, ErrorInvalidFetchTimeout},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+		timeout, err := record.builder.fetchTimeout()
+		assert.Equal(record.expectedTimeout, timeout)
+		assert.Equal(record.expectedError, err)
+	}
+}
+
+func TestReadBatchSize(t *testing.T) {
+	var testData = []struct {
+		builder           DiscoveryBuilder
+		expectedBatchSize int
+		expectedError     error
+	}{
+		{DiscoveryBuilder{}, 0, nil},
+		{DiscoveryBuilder{ReadBatchSize: 1}, 1, nil},
+		{DiscoveryBuilder{ReadBatchSize: 50}, 50, nil},
+		{DiscoveryBuilder{ReadBatchSize: -1}, -1, ErrorInvalidReadBatchSize},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+		batchSize, err := record.builder.readBatchSize()
+		assert.Equal(record.expectedBatchSize, batchSize)
+		assert.Equal(record.expectedError, err)
+	}
+}
+
+func TestLogSampleSize(t *testing.T) {
+	var testData = []struct {
+		builder            DiscoveryBuilder
+		expectedSampleSize int
+		expectedError      error
+	}{
+		{DiscoveryBuilder{}, DefaultLogSampleSize, nil},
+		{DiscoveryBuilder{LogSampleSize: 1}, 1, nil},
+		{DiscoveryBuilder{LogSampleSize: 50}, 50, nil},
+		{DiscoveryBuilder{LogSampleSize: -1}, -1, ErrorInvalidLogSampleSize},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+		sampleSize, err := record.builder.logSampleSize()
+		assert.Equal(record.expectedSampleSize, sampleSize)
+		assert.Equal(record.expectedError, err)
+	}
+}
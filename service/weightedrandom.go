@@ -0,0 +1,118 @@
+package service
+
+import (
+	"github.com/foursquare/fsgo/net/discovery"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// WeightFunc extracts the relative weight of a ServiceInstance
+type WeightFunc func(*discovery.ServiceInstance) int
+
+// PayloadWeight returns a WeightFunc which reads an integer weight from the named field of
+// each instance's JSON payload.  The field may be either a JSON number or a string.  Instances
+// without a valid weight are given a weight of zero.
+func PayloadWeight(field string) WeightFunc {
+	keyFunc := PayloadFieldKey(field)
+	return func(serviceInstance *discovery.ServiceInstance) int {
+		weight, err := strconv.Atoi(keyFunc(serviceInstance))
+		if err != nil {
+			return 0
+		}
+
+		return weight
+	}
+}
+
+// WeightedRandom selects service instances at random, in proportion to their weights.
+// A WeightedRandom is a Listener, and it is safe for concurrent use.
+type WeightedRandom struct {
+	weightFunc    WeightFunc
+	defaultWeight int
+
+	mutex     sync.Mutex
+	random    *rand.Rand
+	instances Instances
+
+	// cumulative holds the running total of weights, parallel to instances.  It is nil
+	// when every weight is zero, in which case instances are selected uniformly.
+	cumulative []int
+}
+
+var _ Selector = (*WeightedRandom)(nil)
+
+// NewWeightedRandom creates an empty WeightedRandom.  Instances whose weight is nonpositive,
+// or every instance if weightFunc is nil, are given defaultWeight instead.  If the source is
+// nil, a source seeded with the current time is used.
+func NewWeightedRandom(weightFunc WeightFunc, defaultWeight int, source rand.Source) *WeightedRandom {
+	if source == nil {
+		source = rand.NewSource(time.Now().UnixNano())
+	}
+
+	return &WeightedRandom{
+		weightFunc:    weightFunc,
+		defaultWeight: defaultWeight,
+		random:        rand.New(source),
+	}
+}
+
+// weight returns the effective weight of an instance
+func (this *WeightedRandom) weight(serviceInstance *discovery.ServiceInstance) int {
+	if this.weightFunc != nil {
+		if weight := this.weightFunc(serviceInstance); weight > 0 {
+			return weight
+		}
+	}
+
+	if this.defaultWeight > 0 {
+		return this.defaultWeight
+	}
+
+	return 0
+}
+
+// Update replaces the instances this WeightedRandom selects from
+func (this *WeightedRandom) Update(instances Instances) {
+	updated := make(Instances, 0, len(instances))
+	cumulative := make([]int, 0, len(instances))
+	total := 0
+	for _, serviceInstance := range instances {
+		if serviceInstance != nil {
+			total += this.weight(serviceInstance)
+			updated = append(updated, serviceInstance)
+			cumulative = append(cumulative, total)
+		}
+	}
+
+	if total == 0 {
+		cumulative = nil
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.instances = updated
+	this.cumulative = cumulative
+}
+
+// Next returns a randomly selected instance.  If there are no instances, this method returns nil.
+func (this *WeightedRandom) Next() *discovery.ServiceInstance {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if len(this.instances) == 0 {
+		return nil
+	} else if this.cumulative == nil {
+		return this.instances[this.random.Intn(len(this.instances))]
+	}
+
+	target := this.random.Intn(this.cumulative[len(this.cumulative)-1])
+	index := sort.Search(len(this.cumulative), func(i int) bool { return this.cumulative[i] > target })
+	return this.instances[index]
+}
+
+// ServicesChanged updates this WeightedRandom with the new instances
+func (this *WeightedRandom) ServicesChanged(serviceName string, instances Instances) {
+	this.Update(instances)
+}
@@ -0,0 +1,154 @@
+package service
+
+import (
+	"fmt"
+	"github.com/foursquare/fsgo/net/discovery"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+// newWeightedInstance creates a test instance with a weight in its payload
+func newWeightedInstance(id string, weight string) *discovery.ServiceInstance {
+	serviceInstance := newTestInstance(id, id+".com", 8080)
+	if len(weight) > 0 {
+		payload := fmt.Sprintf(`{"weight": %s}`, weight)
+		serviceInstance.Payload = &payload
+	}
+
+	return serviceInstance
+}
+
+func TestPayloadWeight(t *testing.T) {
+	assert := assert.New(t)
+
+	var testData = []struct {
+		weight   string
+		expected int
+	}{
+		{"", 0},
+		{"5", 5},
+		{`"7"`, 7},
+		{"-1", -1},
+		{"1.5", 0},
+		{`"heavy"`, 0},
+	}
+
+	weightFunc := PayloadWeight("weight")
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert.Equal(record.expected, weightFunc(newWeightedInstance("a", record.weight)))
+	}
+}
+
+func TestWeightedRandomDistribution(t *testing.T) {
+	assert := assert.New(t)
+
+	var testData = []struct {
+		defaultWeight int
+		instances     Instances
+		expected      map[string]float64
+	}{
+		{
+			0,
+			Instances{newWeightedInstance("a", "1"), newWeightedInstance("b", "3"), nil},
+			map[string]float64{"a": 0.25, "b": 0.75},
+		},
+		{
+			2,
+			Instances{newWeightedInstance("a", "6"), newWeightedInstance("b", ""), newWeightedInstance("c", "0")},
+			map[string]float64{"a": 0.6, "b": 0.2, "c": 0.2},
+		},
+		{
+			0,
+			Instances{newWeightedInstance("a", "4"), newWeightedInstance("b", ""), newWeightedInstance("c", "-3")},
+			map[string]float64{"a": 1.0},
+		},
+
+		// all-zero weights fall back to uniform selection
+		{
+			0,
+			Instances{newWeightedInstance("a", ""), newWeightedInstance("b", "0"), newWeightedInstance("c", "")},
+			map[string]float64{"a": 1.0 / 3, "b": 1.0 / 3, "c": 1.0 / 3},
+		},
+	}
+
+	const selections = 30000
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		weightedRandom := NewWeightedRandom(PayloadWeight("weight"), record.defaultWeight, rand.NewSource(1))
+		weightedRandom.ServicesChanged(testServiceName, record.instances)
+
+		counts := make(map[string]int)
+		for repeat := 0; repeat < selections; repeat++ {
+			counts[weightedRandom.Next().Id]++
+		}
+
+		assert.Len(counts, len(record.expected))
+		for id, fraction := range record.expected {
+			assert.InDelta(fraction*selections, counts[id], selections*0.02, "instance %s", id)
+		}
+	}
+}
+
+func TestWeightedRandomDeterminism(t *testing.T) {
+	assert := assert.New(t)
+
+	instances := Instances{newWeightedInstance("a", "1"), newWeightedInstance("b", "2"), newWeightedInstance("c", "3")}
+	sequence := func() []string {
+		weightedRandom := NewWeightedRandom(PayloadWeight("weight"), 1, rand.NewSource(42))
+		weightedRandom.Update(instances)
+		ids := make([]string, 20)
+		for index := range ids {
+			ids[index] = weightedRandom.Next().Id
+		}
+
+		return ids
+	}
+
+	assert.Equal(sequence(), sequence())
+}
+
+func TestWeightedRandomEmpty(t *testing.T) {
+	assert := assert.New(t)
+
+	weightedRandom := NewWeightedRandom(PayloadWeight("weight"), 1, nil)
+	assert.Nil(weightedRandom.Next())
+
+	weightedRandom.Update(Instances{nil})
+	assert.Nil(weightedRandom.Next())
+
+	weightedRandom.Update(Instances{newWeightedInstance("a", "1")})
+	assert.Equal("a", weightedRandom.Next().Id)
+
+	weightedRandom.Update(Instances{})
+	assert.Nil(weightedRandom.Next())
+}
+
+func TestWeightedRandomConcurrency(t *testing.T) {
+	weightedRandom := NewWeightedRandom(PayloadWeight("weight"), 1, nil)
+	updates := []Instances{
+		{newWeightedInstance("a", "1"), newWeightedInstance("b", "2")},
+		{},
+		{newWeightedInstance("c", "")},
+	}
+
+	waitGroup := &sync.WaitGroup{}
+	waitGroup.Add(2)
+	go func() {
+		defer waitGroup.Done()
+		for repeat := 0; repeat < 1000; repeat++ {
+			weightedRandom.Update(updates[repeat%len(updates)])
+		}
+	}()
+
+	go func() {
+		defer waitGroup.Done()
+		for repeat := 0; repeat < 1000; repeat++ {
+			weightedRandom.Next()
+		}
+	}()
+
+	waitGroup.Wait()
+}
@@ -0,0 +1,187 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/foursquare/fsgo/net/discovery"
+)
+
+const (
+	// InstancesDocumentVersion is the version of the format written by MarshalInstances.  Documents
+	// with any other version are rejected by UnmarshalInstances.
+	InstancesDocumentVersion = 1
+)
+
+var (
+	ErrorInstancesDocumentVersion = errors.New(fmt.Sprintf("The instances document is not in a supported format.  Only version %d is supported.", InstancesDocumentVersion))
+)
+
+// InstanceDocument is the stable wire format of a single ServiceInstance.  Unlike the JSON of a
+// ServiceInstance itself, which is whatever the underlying curator library produces, this format
+// is independent of that library and omits its internal fields, such as the ServiceType and UriSpec.
+//
+// The Payload is embedded as JSON when the instance's payload is a JSON object, array, number,
+// boolean, or null, so that consumers need not decode it twice.  Any other payload, including a
+// payload which is itself a JSON string, is written as a JSON string holding the payload's text.
+// Unset ports and payloads are omitted.
+type InstanceDocument struct {
+	Id                  string          `json:"id"`
+	Name                string          `json:"name"`
+	Address             string          `json:"address"`
+	Port                *int            `json:"port,omitempty"`
+	SslPort             *int            `json:"sslPort,omitempty"`
+	Payload             json.RawMessage `json:"payload,omitempty"`
+	RegistrationTimeUTC int64           `json:"registrationTimeUTC"`
+}
+
+// NewInstanceDocument converts a ServiceInstance into its wire format
+func NewInstanceDocument(serviceInstance *discovery.ServiceInstance) InstanceDocument {
+	return InstanceDocument{
+		Id:                  serviceInstance.Id,
+		Name:                serviceInstance.Name,
+		Address:             serviceInstance.Address,
+		Port:                copyPort(serviceInstance.Port),
+		SslPort:             copyPort(serviceInstance.SslPort),
+		Payload:             encodeDocumentPayload(serviceInstance.Payload),
+		RegistrationTimeUTC: serviceInstance.RegistrationTimeUTC,
+	}
+}
+
+// ServiceInstance converts this wire format back into a ServiceInstance.  An error is returned if
+// the Payload is not valid JSON.
+func (this InstanceDocument) ServiceInstance() (*discovery.ServiceInstance, error) {
+	payload, err := decodeDocumentPayload(this.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return &discovery.ServiceInstance{
+		Id:                  this.Id,
+		Name:                this.Name,
+		Address:             this.Address,
+		Port:                copyPort(this.Port),
+		SslPort:             copyPort(this.SslPort),
+		Payload:             payload,
+		RegistrationTimeUTC: this.RegistrationTimeUTC,
+	}, nil
+}
+
+// InstancesDocument is the versioned wire format of an Instances, e.g. for sending a snapshot of
+// a service to another process or persisting it:
+//
+//	{
+//	  "version": 1,
+//	  "instances": [
+//	    {"id": "...", "name": "foo", "address": "host", "port": 8080, "sslPort": 8443,
+//	     "payload": {"zone": "east"}, "registrationTimeUTC": 1454612000000}
+//	  ]
+//	}
+type InstancesDocument struct {
+	Version   int                `json:"version"`
+	Instances []InstanceDocument `json:"instances"`
+}
+
+// NewInstancesDocument converts an Instances into its wire format.  Nil elements are omitted.
+func NewInstancesDocument(instances Instances) InstancesDocument {
+	document := InstancesDocument{
+		Version:   InstancesDocumentVersion,
+		Instances: make([]InstanceDocument, 0, len(instances)),
+	}
+
+	for _, serviceInstance := range instances {
+		if serviceInstance != nil {
+			document.Instances = append(document.Instances, NewInstanceDocument(serviceInstance))
+		}
+	}
+
+	return document
+}
+
+// ToInstances converts this wire format back into an Instances, which is never nil.  An error is
+// returned if the Version is not supported or any payload is not valid JSON.
+func (this InstancesDocument) ToInstances() (Instances, error) {
+	if this.Version != InstancesDocumentVersion {
+		return nil, ErrorInstancesDocumentVersion
+	}
+
+	instances := make(Instances, 0, len(this.Instances))
+	for _, instanceDocument := range this.Instances {
+		serviceInstance, err := instanceDocument.ServiceInstance()
+		if err != nil {
+			return nil, err
+		}
+
+		instances = append(instances, serviceInstance)
+	}
+
+	return instances, nil
+}
+
+// MarshalInstances encodes an Instances as JSON in the InstancesDocument format
+func MarshalInstances(instances Instances) ([]byte, error) {
+	return json.Marshal(NewInstancesDocument(instances))
+}
+
+// UnmarshalInstances decodes JSON in the InstancesDocument format, as produced by MarshalInstances
+func UnmarshalInstances(data []byte) (Instances, error) {
+	var document InstancesDocument
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, errors.New(
+			fmt.Sprintf("Unable to read the instances document: %v", err),
+		)
+	}
+
+	return document.ToInstances()
+}
+
+// copyPort copies an optional port, so that a document and its ServiceInstance share no state
+func copyPort(port *int) *int {
+	if port == nil {
+		return nil
+	}
+
+	value := *port
+	return &value
+}
+
+// encodeDocumentPayload embeds a payload which is JSON other than a string, and otherwise encodes
+// the payload's text as a JSON string
+func encodeDocumentPayload(payload *string) json.RawMessage {
+	if payload == nil {
+		return nil
+	}
+
+	text := []byte(*payload)
+	var value interface{}
+	if json.Unmarshal(text, &value) == nil {
+		if _, isString := value.(string); !isString {
+			return json.RawMessage(text)
+		}
+	}
+
+	encoded, _ := json.Marshal(*payload)
+	return json.RawMessage(encoded)
+}
+
+// decodeDocumentPayload reverses encodeDocumentPayload: a JSON string yields its text, and any
+// other JSON is the payload itself
+func decodeDocumentPayload(raw json.RawMessage) (*string, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	if raw[0] == '"' {
+		var text string
+		if json.Unmarshal(raw, &text) == nil {
+			return &text, nil
+		}
+	} else if json.Valid(raw) {
+		payload := string(raw)
+		return &payload, nil
+	}
+
+	return nil, errors.New(
+		fmt.Sprintf("Invalid instance payload: %s", raw),
+	)
+}
@@ -0,0 +1,144 @@
+package service
+
+import (
+	"encoding/json"
+	"github.com/foursquare/fsgo/net/discovery"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestInstancesDocumentRoundTrip(t *testing.T) {
+	sslPort := 8443
+	noPorts := newTestInstance("2", "host2", 0)
+	noPorts.Port = nil
+	withSslPort := newTestInstanceWithPayload("3", `{"zone": "east", "weights": [1, 2.5], "tags": {"canary": true}, "empty": null}`)
+	withSslPort.SslPort = &sslPort
+	withSslPort.RegistrationTimeUTC = 1454612000000
+
+	var testData = []struct {
+		instances Instances
+	}{
+		{nil},
+		{Instances{}},
+		{Instances{newTestInstance("1", "host1", 1234)}},
+		{Instances{noPorts, withSslPort}},
+		{Instances{
+			newTestInstanceWithPayload("4", ""),
+			newTestInstanceWithPayload("5", "plain text"),
+			newTestInstanceWithPayload("6", `"quoted"`),
+			newTestInstanceWithPayload("7", "null"),
+			newTestInstanceWithPayload("8", "42"),
+			newTestInstanceWithPayload("9", `["a", {"b": null}]`),
+			newTestInstanceWithPayload("10", `{"unterminated": `),
+		}},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+		data, err := MarshalInstances(record.instances)
+		if !assert.Nil(err) {
+			continue
+		}
+
+		t.Logf("%s", data)
+		decoded, err := UnmarshalInstances(data)
+		if !assert.Nil(err) || !assert.NotNil(decoded) || !assert.Len(decoded, len(record.instances)) {
+			continue
+		}
+
+		for index, expected := range record.instances {
+			actual := decoded[index]
+			assert.True(InstanceEquivalent(expected, actual), "%#v %#v", expected, actual)
+			assert.Equal(expected.Id, actual.Id)
+			assert.Equal(expected.RegistrationTimeUTC, actual.RegistrationTimeUTC)
+			assert.Equal(expected.Port, actual.Port)
+			assert.Equal(expected.SslPort, actual.SslPort)
+			assert.Equal(expected.Payload == nil, actual.Payload == nil)
+		}
+
+		// encoding again yields the same document
+		again, err := MarshalInstances(decoded)
+		assert.Nil(err)
+		assert.Equal(string(data), string(again))
+	}
+}
+
+func TestInstancesDocumentFormat(t *testing.T) {
+	assert := assert.New(t)
+
+	port := 8080
+	payload := `{"zone": "east"}`
+	data, err := MarshalInstances(Instances{
+		nil,
+		&discovery.ServiceInstance{
+			Name:                "foo",
+			Id:                  "1",
+			Address:             "host",
+			Port:                &port,
+			Payload:             &payload,
+			RegistrationTimeUTC: 1454612000000,
+			ServiceType:         discovery.DYNAMIC,
+		},
+	})
+
+	assert.Nil(err)
+	assert.JSONEq(
+		`{"version": 1, "instances": [{"id": "1", "name": "foo", "address": "host", "port": 8080, "payload": {"zone": "east"}, "registrationTimeUTC": 1454612000000}]}`,
+		string(data),
+	)
+
+	var fields struct {
+		Instances []map[string]interface{} `json:"instances"`
+	}
+
+	assert.Nil(json.Unmarshal(data, &fields))
+	if assert.Len(fields.Instances, 1) {
+		assert.NotContains(fields.Instances[0], "serviceType")
+		assert.NotContains(fields.Instances[0], "sslPort")
+	}
+}
+
+func TestUnmarshalInstancesErrors(t *testing.T) {
+	var testData = []struct {
+		data          string
+		expectedError error
+	}{
+		{`{"version": 1}`, nil},
+		{`{"version": 2, "instances": []}`, ErrorInstancesDocumentVersion},
+		{`{"instances": []}`, ErrorInstancesDocumentVersion},
+		{`[]`, nil},
+		{`not json`, nil},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+		instances, err := UnmarshalInstances([]byte(record.data))
+		if record.expectedError != nil {
+			assert.Nil(instances)
+			assert.Equal(record.expectedError, err)
+		} else if record.data[0] == '{' {
+			assert.Equal(Instances{}, instances)
+			assert.Nil(err)
+		} else {
+			assert.Nil(instances)
+			assert.NotNil(err)
+		}
+	}
+}
+
+func TestInstanceDocumentInvalidPayload(t *testing.T) {
+	assert := assert.New(t)
+
+	document := InstanceDocument{Id: "1", Payload: json.RawMessage(`{"unterminated": `)}
+	serviceInstance, err := document.ServiceInstance()
+	assert.Nil(serviceInstance)
+	assert.NotNil(err)
+
+	// the document shares no ports with the instance it was converted from
+	original := newTestInstance("1", "localhost", 1234)
+	converted := NewInstanceDocument(original)
+	*converted.Port = 5678
+	assert.Equal(1234, *original.Port)
+}
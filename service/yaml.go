@@ -0,0 +1,146 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.yaml.in/yaml/v3"
+	"io"
+)
+
+var (
+	ErrorEmptyYAML = errors.New("The YAML configuration is empty")
+)
+
+// yamlToJSON converts a decoded YAML value into a value that encoding/json can marshal.
+// YAML permits mapping keys of any type, whereas JSON objects only have string keys.
+func yamlToJSON(value interface{}) (interface{}, error) {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		converted := make(map[string]interface{}, len(typed))
+		for key, element := range typed {
+			var err error
+			if converted[key], err = yamlToJSON(element); err != nil {
+				return nil, err
+			}
+		}
+
+		return converted, nil
+
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(typed))
+		for key, element := range typed {
+			name, ok := key.(string)
+			if !ok {
+				return nil, errors.New(
+					fmt.Sprintf("The YAML mapping key %v is not a string", key),
+				)
+			}
+
+			var err error
+			if converted[name], err = yamlToJSON(element); err != nil {
+				return nil, err
+			}
+		}
+
+		return converted, nil
+
+	case []interface{}:
+		converted := make([]interface{}, len(typed))
+		for index, element := range typed {
+			var err error
+			if converted[index], err = yamlToJSON(element); err != nil {
+				return nil, err
+			}
+		}
+
+		return converted, nil
+	}
+
+	return value, nil
+}
+
+// encodePayloads replaces any registration payload given as a YAML mapping or sequence with its
+// JSON text, since a ServiceInstance holds its payload as a string
+func encodePayloads(configuration map[string]interface{}) error {
+	registrations, ok := configuration["registrations"].([]interface{})
+	if !ok {
+		return nil
+	}
+
+	for _, registration := range registrations {
+		fields, ok := registration.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		switch payload := fields["payload"].(type) {
+		case map[string]interface{}, []interface{}:
+			text, err := json.Marshal(payload)
+			if err != nil {
+				return errors.New(
+					fmt.Sprintf("Unable to encode the registration payload: %v", err),
+				)
+			}
+
+			fields["payload"] = string(text)
+		}
+	}
+
+	return nil
+}
+
+// UnmarshalYAML allows a DiscoveryBuilder to be decoded from YAML, either on its own or embedded
+// within a larger YAML configuration.  The YAML keys are the same as the JSON keys, and a
+// registration payload may be written as a YAML mapping, which is stored as its JSON text.
+// Unlike JSON decoding, unknown keys are rejected rather than ignored.
+func (this *DiscoveryBuilder) UnmarshalYAML(node *yaml.Node) error {
+	var decoded interface{}
+	if err := node.Decode(&decoded); err != nil {
+		return err
+	}
+
+	converted, err := yamlToJSON(decoded)
+	if err != nil {
+		return err
+	}
+
+	configuration, ok := converted.(map[string]interface{})
+	if !ok {
+		return errors.New(
+			fmt.Sprintf("The YAML configuration at line %d must be a mapping", node.Line),
+		)
+	} else if err := encodePayloads(configuration); err != nil {
+		return err
+	}
+
+	text, err := json.Marshal(configuration)
+	if err != nil {
+		return err
+	}
+
+	var builder DiscoveryBuilder
+	decoder := json.NewDecoder(bytes.NewReader(text))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&builder); err != nil {
+		return errors.New(
+			fmt.Sprintf("Invalid YAML configuration at line %d: %v", node.Line, err),
+		)
+	}
+
+	*this = builder
+	return nil
+}
+
+// NewDiscoveryBuilderFromYAML reads a DiscoveryBuilder from a YAML document.  See UnmarshalYAML.
+func NewDiscoveryBuilderFromYAML(reader io.Reader) (*DiscoveryBuilder, error) {
+	builder := &DiscoveryBuilder{}
+	if err := yaml.NewDecoder(reader).Decode(builder); err == io.EOF {
+		return nil, ErrorEmptyYAML
+	} else if err != nil {
+		return nil, err
+	}
+
+	return builder, nil
+}
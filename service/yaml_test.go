@@ -0,0 +1,106 @@
+package service
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"go.yaml.in/yaml/v3"
+	"strings"
+	"testing"
+)
+
+const testYAMLConfiguration = `
+connection: zk1:2181,zk2:2181
+connectTimeout: 5s
+basePath: /test/services
+watches:
+  - foo
+  - bar
+watchPollInterval: 30s
+registrations:
+  - name: foo
+    address: foo.example.com
+    port: 8080
+    sslPort: 8443
+    payload:
+      weight: 2
+      tags: [primary, east]
+  - name: bar
+    address: bar.example.com
+    port: 9090
+    payload: '{"weight": 1}'
+`
+
+func TestNewDiscoveryBuilderFromYAML(t *testing.T) {
+	assert := assert.New(t)
+
+	builder, err := NewDiscoveryBuilderFromYAML(strings.NewReader(testYAMLConfiguration))
+	assert.Nil(err)
+	if !assert.NotNil(builder) {
+		return
+	}
+
+	assert.Equal("zk1:2181,zk2:2181", builder.Connection)
+	assert.Equal("5s", builder.ConnectTimeout)
+	assert.Equal("/test/services", builder.BasePath)
+	assert.Equal([]string{"foo", "bar"}, builder.Watches)
+	assert.Equal("30s", builder.WatchPollInterval)
+
+	if assert.Len(builder.Registrations, 2) {
+		foo := builder.Registrations[0]
+		assert.Equal("foo", foo.Name)
+		assert.Equal("foo.example.com", foo.Address)
+		assert.Equal(8080, *foo.Port)
+		assert.Equal(8443, *foo.SslPort)
+		if assert.NotNil(foo.Payload) {
+			var payload map[string]interface{}
+			assert.Nil(json.Unmarshal([]byte(*foo.Payload), &payload))
+			assert.Equal(map[string]interface{}{"weight": 2.0, "tags": []interface{}{"primary", "east"}}, payload)
+		}
+
+		bar := builder.Registrations[1]
+		assert.Equal("bar", bar.Name)
+		assert.Nil(bar.SslPort)
+		if assert.NotNil(bar.Payload) {
+			assert.Equal(`{"weight": 1}`, *bar.Payload)
+		}
+	}
+}
+
+func TestDiscoveryBuilderEmbeddedInYAML(t *testing.T) {
+	assert := assert.New(t)
+
+	var configuration struct {
+		Name      string           `yaml:"name"`
+		Discovery DiscoveryBuilder `yaml:"discovery"`
+	}
+
+	assert.Nil(yaml.Unmarshal([]byte("name: app\ndiscovery:\n  basePath: /test\n  watches: [foo]\n"), &configuration))
+	assert.Equal("app", configuration.Name)
+	assert.Equal("/test", configuration.Discovery.BasePath)
+	assert.Equal([]string{"foo"}, configuration.Discovery.Watches)
+}
+
+func TestNewDiscoveryBuilderFromYAMLErrors(t *testing.T) {
+	var testData = []struct {
+		configuration string
+		expectedError string
+	}{
+		{"", ErrorEmptyYAML.Error()},
+		{"basePath: /test\nwatchs: [foo]\n", `unknown field "watchs"`},
+		{"registrations:\n  - name: foo\n    port: 8080\n    weight: 2\n", `unknown field "weight"`},
+		{"- foo\n- bar\n", "must be a mapping"},
+		{"basePath: [/test]\n", "basePath"},
+		{"basePath: /test\n1: foo\n", "not a string"},
+		{"basePath: /test\n  watches: foo\n", "yaml"},
+	}
+
+	for _, record := range testData {
+		t.Logf("%#v", record)
+		assert := assert.New(t)
+		builder, err := NewDiscoveryBuilderFromYAML(strings.NewReader(record.configuration))
+		assert.Nil(builder)
+		if assert.NotNil(err) {
+			assert.Contains(err.Error(), record.expectedError)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package service
+
+import (
+	"context"
+	"github.com/foursquare/curator.go"
+	"github.com/foursquare/fsgo/net/discovery"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// zookeeperClient is the subset of zookeeper operations used by serviceWatchers.  Watchers
+// depend on this interface rather than a curator connection directly, so that they can be
+// exercised without a live zookeeper ensemble.
+//
+// Each operation returns the context's error as soon as the context is done, even if the
+// underlying zookeeper call has not yet completed.
+type zookeeperClient interface {
+	// children returns the names of the child znodes of the given path
+	children(ctx context.Context, path string) ([]string, error)
+
+	// watchChildren is like children, except that it also sets a child watch on the path
+	watchChildren(ctx context.Context, path string) ([]string, error)
+
+	// data returns the data stored in the znode at the given path
+	data(ctx context.Context, path string) ([]byte, error)
+
+	// watchData is like data, except that it also sets a data watch on the path
+	watchData(ctx context.Context, path string) ([]byte, error)
+
+	// ensurePath creates the given path, including any parents, if it does not exist
+	ensurePath(ctx context.Context, path string) error
+
+	// exists tests whether a znode exists at the given path
+	exists(ctx context.Context, path string) (bool, error)
+
+	// watchExists is like exists, except that it also sets a watch which fires when the
+	// znode is created, deleted, or has its data changed
+	watchExists(ctx context.Context, path string) (bool, error)
+}
+
+// batchReader is implemented by zookeeperClients which can read the data of several znodes in a
+// single round trip, e.g. with a zookeeper multi-read.  The curator client does not, since the
+// underlying zookeeper library only supports multi requests which write.
+type batchReader interface {
+	// dataBatch returns the data stored in each of the znodes at the given paths, in order.  If
+	// any znode cannot be read, the whole batch fails and no data is returned.
+	dataBatch(ctx context.Context, paths []string) ([][]byte, error)
+}
+
+// batchReaderOf returns the batchReader which reads through the given client, if it has one
+func batchReaderOf(client zookeeperClient) (batchReader, bool) {
+	switch typed := client.(type) {
+	case *rateLimitedClient:
+		if _, ok := batchReaderOf(typed.client); ok {
+			return typed, true
+		}
+
+	case batchReader:
+		return typed, true
+	}
+
+	return nil, false
+}
+
+// runWithContext executes a blocking operation on a separate goroutine, returning early
+// with the context's error if the context is done first.  Curator calls cannot be
+// interrupted, so an abandoned operation is left to complete on its own.  Callers must
+// not read anything written by the operation unless this function returns nil.
+func runWithContext(ctx context.Context, operation func()) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		operation()
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// curatorClient is the zookeeperClient implementation backed by a curator connection.
+// Paths are ensured with the given ACLs, or with curator's default if there are none.  A
+// readOnly client refuses to ensure paths, since that may create them.
+type curatorClient struct {
+	connection discovery.Conn
+	acls       []zk.ACL
+	readOnly   bool
+}
+
+var _ zookeeperClient = (*curatorClient)(nil)
+
+func (this *curatorClient) children(ctx context.Context, path string) ([]string, error) {
+	var (
+		childIds []string
+		err      error
+	)
+
+	if contextErr := runWithContext(ctx, func() {
+		childIds, err = this.connection.GetChildren().ForPath(path)
+	}); contextErr != nil {
+		return nil, contextErr
+	}
+
+	return childIds, err
+}
+
+func (this *curatorClient) watchChildren(ctx context.Context, path string) ([]string, error) {
+	var (
+		childIds []string
+		err      error
+	)
+
+	if contextErr := runWithContext(ctx, func() {
+		childIds, err = this.connection.GetChildren().Watched().ForPath(path)
+	}); contextErr != nil {
+		return nil, contextErr
+	}
+
+	return childIds, err
+}
+
+func (this *curatorClient) data(ctx context.Context, path string) ([]byte, error) {
+	var (
+		data []byte
+		err  error
+	)
+
+	if contextErr := runWithContext(ctx, func() {
+		data, err = this.connection.GetData().ForPath(path)
+	}); contextErr != nil {
+		return nil, contextErr
+	}
+
+	return data, err
+}
+
+func (this *curatorClient) watchData(ctx context.Context, path string) ([]byte, error) {
+	var (
+		data []byte
+		err  error
+	)
+
+	if contextErr := runWithContext(ctx, func() {
+		data, err = this.connection.GetData().Watched().ForPath(path)
+	}); contextErr != nil {
+		return nil, contextErr
+	}
+
+	return data, err
+}
+
+func (this *curatorClient) ensurePath(ctx context.Context, path string) error {
+	if this.readOnly {
+		return ReadOnlyError{Operation: "create", Path: path}
+	}
+
+	var err error
+	if contextErr := runWithContext(ctx, func() {
+		err = curator.NewEnsurePathWithAcl(path, newACLProvider(this.acls)).Ensure(this.connection.ZookeeperClient())
+	}); contextErr != nil {
+		return contextErr
+	}
+
+	if err == zk.ErrNodeExists {
+		return nil
+	}
+
+	return err
+}
+
+func (this *curatorClient) exists(ctx context.Context, path string) (bool, error) {
+	var (
+		stat *zk.Stat
+		err  error
+	)
+
+	if contextErr := runWithContext(ctx, func() {
+		stat, err = this.connection.CheckExists().ForPath(path)
+	}); contextErr != nil {
+		return false, contextErr
+	}
+
+	return stat != nil, err
+}
+
+func (this *curatorClient) watchExists(ctx context.Context, path string) (bool, error) {
+	var (
+		stat *zk.Stat
+		err  error
+	)
+
+	if contextErr := runWithContext(ctx, func() {
+		stat, err = this.connection.CheckExists().Watched().ForPath(path)
+	}); contextErr != nil {
+		return false, contextErr
+	}
+
+	return stat != nil, err
+}
@@ -0,0 +1,517 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/foursquare/fsgo/net/discovery"
+	"github.com/samuel/go-zookeeper/zk"
+	"github.com/stretchr/testify/assert"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeOperation identifies the zookeeperClient operations of a fakeZookeeperClient
+type fakeOperation string
+
+const (
+	fakeChildren      fakeOperation = "children"
+	fakeWatchChildren fakeOperation = "watchChildren"
+	fakeData          fakeOperation = "data"
+	fakeWatchData     fakeOperation = "watchData"
+	fakeDataBatch     fakeOperation = "dataBatch"
+	fakeEnsurePath    fakeOperation = "ensurePath"
+	fakeExists        fakeOperation = "exists"
+	fakeWatchExists   fakeOperation = "watchExists"
+)
+
+// fakeCall is an operation on a specific path, used to script failures
+type fakeCall struct {
+	operation fakeOperation
+	path      string
+}
+
+// fakeZookeeperClient is an in-memory zookeeperClient.  Reads of data can be delayed
+// to simulate network latency, and a delayed read is abandoned when its context is done.
+// Failures can be scripted for any operation on any path via failNext, and reads of the data
+// of any path can be made to hang via hang until their context is done.
+//
+// Watches behave as they do in zookeeper:  each watch fires at most once.  A child watch
+// fires the first time a child of the watched path is added or removed, and a data watch
+// fires the first time the watched node's data is set or the node is removed, and an existence
+// watch fires the first time the watched node is created.  A node exists if it has been set or
+// ensured, or if any node beneath it exists.  A fired watch
+// invokes watchHandler, which is typically wired to the serviceWatchers of a set.  The number
+// of child watches set is recorded in watchCount, and the number of round trips made to read
+// data, whether for a single node or a batch, is recorded in dataReads.
+type fakeZookeeperClient struct {
+	mutex        sync.Mutex
+	nodes        map[string][]byte
+	delay        time.Duration
+	hung         map[string]bool
+	failures     map[fakeCall][]error
+	watched      map[string]bool
+	dataWatched  map[string]bool
+	existWatched map[string]bool
+	watchCount   int
+	dataReads    int
+	watchHandler func(event zk.Event)
+}
+
+var _ zookeeperClient = (*fakeZookeeperClient)(nil)
+var _ batchReader = (*fakeZookeeperClient)(nil)
+
+func newFakeZookeeperClient() *fakeZookeeperClient {
+	return &fakeZookeeperClient{
+		nodes:        make(map[string][]byte),
+		hung:         make(map[string]bool),
+		failures:     make(map[fakeCall][]error),
+		watched:      make(map[string]bool),
+		dataWatched:  make(map[string]bool),
+		existWatched: make(map[string]bool),
+	}
+}
+
+// failNext causes the next calls of the given operation on the given path to return the
+// given errors, in order.  Calls afterward succeed as usual.
+func (this *fakeZookeeperClient) failNext(operation fakeOperation, path string, errs ...error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	call := fakeCall{operation, path}
+	this.failures[call] = append(this.failures[call], errs...)
+}
+
+// nextFailure consumes the next scripted error for a call, if any.  Callers must hold the mutex.
+func (this *fakeZookeeperClient) nextFailure(operation fakeOperation, path string) error {
+	call := fakeCall{operation, path}
+	if errs := this.failures[call]; len(errs) > 0 {
+		this.failures[call] = errs[1:]
+		return errs[0]
+	}
+
+	return nil
+}
+
+// setWatchHandler sets the function invoked when a watch fires
+func (this *fakeZookeeperClient) setWatchHandler(watchHandler func(event zk.Event)) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.watchHandler = watchHandler
+}
+
+// watchWith wires fired watches to the watchers in the given set, as curatorDiscovery does
+func (this *fakeZookeeperClient) watchWith(serviceWatcherSet *serviceWatcherSet) {
+	discovery := &curatorDiscovery{serviceWatcherSet: serviceWatcherSet}
+	this.setWatchHandler(func(event zk.Event) {
+		switch event.Type {
+		case zk.EventNodeChildrenChanged:
+			discovery.updateServices(event.Path)
+		case zk.EventNodeDataChanged, zk.EventNodeDeleted:
+			discovery.updateInstance(event.Path, event.Type == zk.EventNodeDeleted)
+		case zk.EventNodeCreated:
+			discovery.serviceCreated(event.Path)
+		}
+	})
+}
+
+// addInstance serializes a ServiceInstance as JSON into a child of the given path
+func (this *fakeZookeeperClient) addInstance(path string, serviceInstance *discovery.ServiceInstance) {
+	this.addSerializedInstance(path, serviceInstance, &discovery.JsonInstanceSerializer{})
+}
+
+// addSerializedInstance uses the given serializer to store a ServiceInstance into a child of the given path
+func (this *fakeZookeeperClient) addSerializedInstance(path string, serviceInstance *discovery.ServiceInstance, serializer discovery.InstanceSerializer) {
+	data, err := serializer.Serialize(serviceInstance)
+	if err != nil {
+		panic(err)
+	}
+
+	this.set(path+"/"+serviceInstance.Id, data)
+}
+
+// removeInstance deletes the child of the given path that holds the given instance
+func (this *fakeZookeeperClient) removeInstance(path string, instanceId string) {
+	this.remove(path + "/" + instanceId)
+}
+
+// set stores data in a node, creating it if necessary.  Creating a node fires any existence watch
+// on it and any child watch on its parent, along with any existence watch on a parent which did not
+// exist before.  Replacing the data of an existing node fires any data watch on the node.
+func (this *fakeZookeeperClient) set(nodePath string, data []byte) {
+	this.mutex.Lock()
+	_, exists := this.nodes[nodePath]
+	parentChanged := this.childrenChangedEvent(nodePath)
+	parentExisted := this.existsLocked(parentChanged.Path)
+	this.nodes[nodePath] = data
+	if exists {
+		this.fireWatches(zk.Event{Type: zk.EventNodeDataChanged, Path: nodePath})
+	} else if !parentExisted {
+		this.fireWatches(zk.Event{Type: zk.EventNodeCreated, Path: nodePath}, parentChanged, zk.Event{Type: zk.EventNodeCreated, Path: parentChanged.Path})
+	} else {
+		this.fireWatches(zk.Event{Type: zk.EventNodeCreated, Path: nodePath}, parentChanged)
+	}
+}
+
+// existsLocked tests whether a node exists, either explicitly or as the ancestor of another node.
+// Callers must hold the mutex.
+func (this *fakeZookeeperClient) existsLocked(path string) bool {
+	if _, ok := this.nodes[path]; ok {
+		return true
+	}
+
+	prefix := path + "/"
+	for nodePath := range this.nodes {
+		if strings.HasPrefix(nodePath, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// remove deletes a node, firing any data watch on it and any child watch on its parent
+func (this *fakeZookeeperClient) remove(nodePath string) {
+	this.mutex.Lock()
+	if _, exists := this.nodes[nodePath]; !exists {
+		this.mutex.Unlock()
+		return
+	}
+
+	delete(this.nodes, nodePath)
+	this.fireWatches(zk.Event{Type: zk.EventNodeDeleted, Path: nodePath}, this.childrenChangedEvent(nodePath))
+}
+
+func (this *fakeZookeeperClient) childrenChangedEvent(nodePath string) zk.Event {
+	return zk.Event{Type: zk.EventNodeChildrenChanged, Path: nodePath[:strings.LastIndex(nodePath, "/")]}
+}
+
+// fireWatches consumes the watches matching the given events, then invokes the watch handler
+// for each outside the lock.  Callers must hold the mutex, which is released by this method.
+func (this *fakeZookeeperClient) fireWatches(events ...zk.Event) {
+	var fired []zk.Event
+	for _, event := range events {
+		watched := this.dataWatched
+		if event.Type == zk.EventNodeChildrenChanged {
+			watched = this.watched
+		} else if event.Type == zk.EventNodeCreated {
+			watched = this.existWatched
+		}
+
+		if watched[event.Path] {
+			delete(watched, event.Path)
+			fired = append(fired, event)
+		}
+	}
+
+	watchHandler := this.watchHandler
+	this.mutex.Unlock()
+	if watchHandler != nil {
+		for _, event := range fired {
+			watchHandler(event)
+		}
+	}
+}
+
+// childrenOf returns the sorted names of the direct children of a path.  Callers must hold the mutex.
+func (this *fakeZookeeperClient) childrenOf(path string) []string {
+	prefix := path + "/"
+	childIds := []string{}
+	for nodePath := range this.nodes {
+		if strings.HasPrefix(nodePath, prefix) && !strings.Contains(nodePath[len(prefix):], "/") {
+			childIds = append(childIds, nodePath[len(prefix):])
+		}
+	}
+
+	sort.Strings(childIds)
+	return childIds
+}
+
+func (this *fakeZookeeperClient) children(ctx context.Context, path string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if err := this.nextFailure(fakeChildren, path); err != nil {
+		return nil, err
+	}
+
+	return this.childrenOf(path), nil
+}
+
+func (this *fakeZookeeperClient) watchChildren(ctx context.Context, path string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.watchCount++
+	if err := this.nextFailure(fakeWatchChildren, path); err != nil {
+		return nil, err
+	}
+
+	this.watched[path] = true
+	return this.childrenOf(path), nil
+}
+
+func (this *fakeZookeeperClient) watches() int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.watchCount
+}
+
+// isWatched tests whether a child watch is currently set on the given path
+func (this *fakeZookeeperClient) isWatched(path string) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.watched[path]
+}
+
+// isDataWatched tests whether a data watch is currently set on the given path
+func (this *fakeZookeeperClient) isDataWatched(path string) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.dataWatched[path]
+}
+
+// hang causes subsequent reads of the given paths' data, individually or in a batch, to block
+// until their context is done
+func (this *fakeZookeeperClient) hang(paths ...string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for _, path := range paths {
+		this.hung[path] = true
+	}
+}
+
+// isHung tests whether reads of any of the given paths hang
+func (this *fakeZookeeperClient) isHung(paths ...string) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for _, path := range paths {
+		if this.hung[path] {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (this *fakeZookeeperClient) data(ctx context.Context, path string) ([]byte, error) {
+	if this.isHung(path) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	if this.delay > 0 {
+		timer := time.NewTimer(this.delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.dataReads++
+	if err := this.nextFailure(fakeData, path); err != nil {
+		return nil, err
+	} else if data, ok := this.nodes[path]; ok {
+		return data, nil
+	}
+
+	return nil, errors.New("No such node: " + path)
+}
+
+// watchData is like data, except that it sets a data watch when the read succeeds.  Reads
+// are not delayed.
+func (this *fakeZookeeperClient) watchData(ctx context.Context, path string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.dataReads++
+	if err := this.nextFailure(fakeWatchData, path); err != nil {
+		return nil, err
+	} else if data, ok := this.nodes[path]; ok {
+		this.dataWatched[path] = true
+		return data, nil
+	}
+
+	return nil, errors.New("No such node: " + path)
+}
+
+// dataBatch reads every path with a single, possibly delayed, round trip.  As with a zookeeper
+// multi-read, the batch fails if any node does not exist.  Failures are scripted by the first path.
+func (this *fakeZookeeperClient) dataBatch(ctx context.Context, paths []string) ([][]byte, error) {
+	if this.isHung(paths...) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	if this.delay > 0 {
+		timer := time.NewTimer(this.delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.dataReads++
+	if len(paths) > 0 {
+		if err := this.nextFailure(fakeDataBatch, paths[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	batch := make([][]byte, len(paths))
+	for index, path := range paths {
+		data, ok := this.nodes[path]
+		if !ok {
+			return nil, errors.New("No such node: " + path)
+		}
+
+		batch[index] = data
+	}
+
+	return batch, nil
+}
+
+// dataRoundTrips returns the number of round trips made to read data
+func (this *fakeZookeeperClient) dataRoundTrips() int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.dataReads
+}
+
+func (this *fakeZookeeperClient) ensurePath(ctx context.Context, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if err := this.nextFailure(fakeEnsurePath, path); err != nil {
+		return err
+	} else if !this.existsLocked(path) {
+		this.nodes[path] = nil
+	}
+
+	return nil
+}
+
+func (this *fakeZookeeperClient) exists(ctx context.Context, path string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if err := this.nextFailure(fakeExists, path); err != nil {
+		return false, err
+	}
+
+	return this.existsLocked(path), nil
+}
+
+// watchExists is like exists, except that it sets an existence watch when the node does not exist
+func (this *fakeZookeeperClient) watchExists(ctx context.Context, path string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if err := this.nextFailure(fakeWatchExists, path); err != nil {
+		return false, err
+	}
+
+	exists := this.existsLocked(path)
+	if !exists {
+		this.existWatched[path] = true
+	}
+
+	return exists, nil
+}
+
+// isExistWatched tests whether an existence watch is currently set on the given path
+func (this *fakeZookeeperClient) isExistWatched(path string) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.existWatched[path]
+}
+
+func TestRunWithContext(t *testing.T) {
+	assert := assert.New(t)
+
+	executed := false
+	assert.Nil(runWithContext(context.Background(), func() { executed = true }))
+	assert.True(executed)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	executed = false
+	assert.Equal(context.Canceled, runWithContext(cancelled, func() { executed = true }))
+	assert.False(executed)
+
+	blocked := make(chan struct{})
+	defer close(blocked)
+	expired, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(context.DeadlineExceeded, runWithContext(expired, func() { <-blocked }))
+}
+
+func TestBatchReaderOf(t *testing.T) {
+	assert := assert.New(t)
+
+	fake := newFakeZookeeperClient()
+	servicePath := testBasePath + "/" + testServiceName
+	fake.addInstance(servicePath, newTestInstance("1", "host.com", 8080))
+	fake.addInstance(servicePath, newTestInstance("2", "host.com", 8081))
+
+	_, ok := batchReaderOf(&curatorClient{})
+	assert.False(ok)
+	_, ok = batchReaderOf(&rateLimitedClient{&curatorClient{}, newRateLimiter(100, 10)})
+	assert.False(ok)
+
+	reader, ok := batchReaderOf(fake)
+	assert.True(ok)
+	assert.True(reader == fake)
+
+	// a rate limited batch takes a single token
+	limiter := newRateLimiter(0.1, 1)
+	reader, ok = batchReaderOf(&rateLimitedClient{fake, limiter})
+	if assert.True(ok) {
+		batch, err := reader.dataBatch(context.Background(), []string{servicePath + "/1", servicePath + "/2"})
+		assert.Len(batch, 2)
+		assert.Nil(err)
+
+		expired, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		batch, err = reader.dataBatch(expired, []string{servicePath + "/1"})
+		assert.Nil(batch)
+		assert.Equal(context.DeadlineExceeded, err)
+	}
+
+	assert.Equal(1, fake.dataRoundTrips())
+}
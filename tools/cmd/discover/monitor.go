@@ -57,8 +57,8 @@ func (m *Monitor) update(serviceName string, newInstances service.Instances) Cat
 			}
 		}
 
-		for _, newInstance := range newInstancesByID {
-			categories[CategoryNew] = append(categories[CategoryNew], newInstance)
+		if len(newInstancesByID) > 0 {
+			categories[CategoryNew] = newInstancesByID.Instances()
 		}
 	} else {
 		categories[CategoryInitial] = newInstances